@@ -0,0 +1,38 @@
+package main
+
+import (
+	"io"
+
+	"go.mau.fi/zeroconfig"
+	"gopkg.in/natefinch/lumberjack.v2"
+
+	"github.com/lrhodin/imessage/pkg/connector"
+)
+
+// installLogRedaction routes every log writer the logging config can create
+// through connector.PIIRedactingWriter, so phone numbers and email addresses
+// are masked in all log lines — including bridgev2's and mautrix's own — when
+// network.log_pii is false. Must run after PreInit (config loaded) and before
+// Init (which compiles the logger).
+//
+// zeroconfig resolves stdout/stderr through package variables and other
+// writer types through a registry, so both are swapped here. The file writer
+// is rebuilt the same way zeroconfig builds it.
+func installLogRedaction() {
+	zeroconfig.Stdout = connector.NewPIIRedactingWriter(zeroconfig.Stdout)
+	zeroconfig.Stderr = connector.NewPIIRedactingWriter(zeroconfig.Stderr)
+	zeroconfig.RegisterWriter(zeroconfig.WriterTypeFile, func(wc *zeroconfig.WriterConfig) (io.Writer, error) {
+		writer := &lumberjack.Logger{
+			Filename:   wc.Filename,
+			MaxSize:    wc.MaxSize,
+			MaxAge:     wc.MaxAge,
+			MaxBackups: wc.MaxBackups,
+			LocalTime:  wc.LocalTime,
+			Compress:   wc.Compress,
+		}
+		if err := writer.Rotate(); err != nil {
+			return nil, err
+		}
+		return connector.NewPIIRedactingWriter(writer), nil
+	})
+}
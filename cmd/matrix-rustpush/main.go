@@ -90,6 +90,16 @@ func main() {
 				fmt.Println(h)
 			}
 			return
+		case "export-session":
+			// Write this host's session state and keys, encrypted with a
+			// passphrase, for import-session on another host.
+			runExportSession()
+			return
+		case "import-session":
+			// Restore a session exported with export-session. The next
+			// start auto-restores the login without re-authenticating.
+			runImportSession()
+			return
 		case "carddav-setup":
 			// Discover CardDAV URL + encrypt password for install scripts.
 			runCardDAVSetup()
@@ -133,6 +143,9 @@ func main() {
 	// repair broken permissions before validateConfig() runs in Init().
 	m.PreInit()
 	repairPermissions(&m)
+	if conn, ok := m.Connector.(*connector.IMConnector); ok && !conn.Config.LogPII {
+		installLogRedaction()
+	}
 	m.Init()
 	m.Start()
 	exitCode := m.WaitForInterrupt()
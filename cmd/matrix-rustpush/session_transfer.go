@@ -0,0 +1,78 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2024 Ludvig Rhodin
+//
+// CLI subcommands for moving a login to another host: export-session writes
+// the session state and keys to an encrypted file, import-session restores
+// it. Run both with the bridge stopped.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/lrhodin/imessage/pkg/connector"
+)
+
+// sessionPassphraseEnv lets install scripts pass the passphrase without a
+// prompt.
+const sessionPassphraseEnv = "MAUTRIX_IMESSAGE_SESSION_PASSPHRASE"
+
+func sessionPassphrase(confirm bool) string {
+	if passphrase := os.Getenv(sessionPassphraseEnv); passphrase != "" {
+		return passphrase
+	}
+	passphrase := prompt("Passphrase")
+	if confirm && prompt("Repeat passphrase") != passphrase {
+		fmt.Fprintln(os.Stderr, "ERROR: Passphrases don't match")
+		os.Exit(1)
+	}
+	return passphrase
+}
+
+// runExportSession handles the export-session subcommand.
+func runExportSession() {
+	fs := flag.NewFlagSet("export-session", flag.ExitOnError)
+	out := fs.String("out", "", "File to write the encrypted session to")
+	fs.Parse(os.Args[2:])
+
+	if *out == "" {
+		fmt.Fprintln(os.Stderr, "Usage: export-session --out <file>")
+		os.Exit(1)
+	}
+	data, err := connector.ExportSession(sessionPassphrase(true))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		os.Exit(1)
+	}
+	if err = os.WriteFile(*out, data, 0600); err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: Failed to write %s: %v\n", *out, err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "✓ Session exported to %s\n", *out)
+	fmt.Fprintln(os.Stderr, "  Stop this bridge before starting the imported one: two hosts can't share a session.")
+}
+
+// runImportSession handles the import-session subcommand.
+func runImportSession() {
+	fs := flag.NewFlagSet("import-session", flag.ExitOnError)
+	in := fs.String("in", "", "Encrypted session file from export-session")
+	overwrite := fs.Bool("overwrite", false, "Replace this host's existing session files")
+	fs.Parse(os.Args[2:])
+
+	if *in == "" {
+		fmt.Fprintln(os.Stderr, "Usage: import-session --in <file> [--overwrite]")
+		os.Exit(1)
+	}
+	data, err := os.ReadFile(*in)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: Failed to read %s: %v\n", *in, err)
+		os.Exit(1)
+	}
+	if err = connector.ImportSession(data, sessionPassphrase(false), *overwrite); err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Fprintln(os.Stderr, "✓ Session imported — the login is restored on the next start")
+}
@@ -0,0 +1,131 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2024 Ludvig Rhodin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+package imessage
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// chatDBRequiredColumns lists the tables and columns every chat.db reader
+// relies on. Optional columns that only exist on newer macOS versions
+// (thread_originator_guid, group_action_type, ...) are detected by
+// DetectChatDBSchema and aren't listed here. An iPhone backup's sms.db
+// uses the same schema, so it passes the same check.
+var chatDBRequiredColumns = []struct {
+	table   string
+	columns []string
+}{
+	{"message", []string{"guid", "date", "text", "handle_id", "is_from_me", "item_type"}},
+	{"chat", []string{"guid", "chat_identifier", "service_name"}},
+	{"handle", []string{"id", "service"}},
+	{"chat_message_join", []string{"chat_id", "message_id"}},
+	{"attachment", []string{"guid", "filename", "mime_type"}},
+	{"message_attachment_join", []string{"message_id", "attachment_id"}},
+}
+
+// DefaultChatDBPath returns the path of the local Messages database,
+// ~/Library/Messages/chat.db.
+func DefaultChatDBPath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to get home directory: %w", err)
+	}
+	return filepath.Join(home, "Library", "Messages", "chat.db"), nil
+}
+
+// ResolveChatDBPath returns the chat.db path to open: path with "~/"
+// expanded, or DefaultChatDBPath when path is empty.
+func ResolveChatDBPath(path string) (string, error) {
+	if path == "" {
+		return DefaultChatDBPath()
+	}
+	if strings.HasPrefix(path, "~/") {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", fmt.Errorf("failed to get home directory: %w", err)
+		}
+		path = filepath.Join(home, path[2:])
+	}
+	return path, nil
+}
+
+// OpenChatDB opens the chat.db at path (see ResolveChatDBPath) read-only and
+// checks that it really is a Messages database before handing it out, so a
+// wrong chatdb_path fails at startup instead of on the first query. The
+// caller must have the sqlite3 driver registered.
+func OpenChatDB(path string) (*sql.DB, string, error) {
+	path, err := ResolveChatDBPath(path)
+	if err != nil {
+		return nil, "", err
+	}
+	if _, err = os.Stat(path); err != nil {
+		return nil, path, err
+	}
+	db, err := sql.Open("sqlite3", ChatDBURI(path, nil))
+	if err != nil {
+		return nil, path, err
+	}
+	if err = ValidateChatDBSchema(db); err != nil {
+		_ = db.Close()
+		return nil, path, fmt.Errorf("%s: %w", path, err)
+	}
+	return db, path, nil
+}
+
+// ChatDBURI returns the read-only SQLite file URI for the chat.db at path,
+// with extra added to the query. The path is percent-escaped, so a '?', '#'
+// or '%' in a directory name stays part of the path instead of being read as
+// URI syntax.
+func ChatDBURI(path string, extra url.Values) string {
+	query := url.Values{"mode": {"ro"}}
+	for key, values := range extra {
+		query[key] = values
+	}
+	return "file:" + (&url.URL{Path: path}).EscapedPath() + "?" + query.Encode()
+}
+
+// ValidateChatDBSchema checks that db has the tables and columns of a
+// Messages chat.db (see chatDBRequiredColumns).
+func ValidateChatDBSchema(db *sql.DB) error {
+	for _, required := range chatDBRequiredColumns {
+		table := required.table
+		rows, err := db.Query(fmt.Sprintf("SELECT name FROM pragma_table_info('%s')", table))
+		if err != nil {
+			return fmt.Errorf("failed to read schema of %s: %w", table, err)
+		}
+		have := make(map[string]bool)
+		for rows.Next() {
+			var name string
+			if err = rows.Scan(&name); err != nil {
+				rows.Close()
+				return fmt.Errorf("failed to read schema of %s: %w", table, err)
+			}
+			have[strings.ToLower(name)] = true
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return fmt.Errorf("failed to read schema of %s: %w", table, err)
+		}
+		if len(have) == 0 {
+			return fmt.Errorf("not a chat.db: missing table %s", table)
+		}
+		for _, column := range required.columns {
+			if !have[strings.ToLower(column)] {
+				return fmt.Errorf("not a chat.db: table %s has no column %s", table, column)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2024 Ludvig Rhodin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+package imessage
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// ChatDBOptionalColumn is a column that only exists in some macOS versions'
+// chat.db. Queries refer to it as Expr, which AdaptQuery swaps for Default
+// when the column is missing.
+type ChatDBOptionalColumn struct {
+	Table   string
+	Column  string
+	Expr    string
+	Default string
+}
+
+// ChatDBOptionalColumns lists the optional columns the chat.db readers
+// select, with the expression each query uses for them.
+var ChatDBOptionalColumns = []ChatDBOptionalColumn{
+	{"message", "attributedBody", "message.attributedBody", "NULL"},
+	{"message", "thread_originator_guid", "COALESCE(message.thread_originator_guid, '')", "''"},
+	{"message", "thread_originator_part", "COALESCE(message.thread_originator_part, '')", "''"},
+	{"message", "group_action_type", "message.group_action_type", "0"},
+	// Edits and unsends (macOS 13+).
+	{"message", "date_edited", "COALESCE(message.date_edited, 0)", "0"},
+	{"message", "date_retracted", "COALESCE(message.date_retracted, 0)", "0"},
+	{"chat", "group_id", "chat.group_id", "''"},
+}
+
+// ChatDBSchema is what DetectChatDBSchema found in a chat.db.
+type ChatDBSchema struct {
+	// ClientVersion is the _ClientVersion recorded by Messages in
+	// _SqliteDatabaseProperties, or "" if the database doesn't have one
+	// (e.g. an sms.db from an old iPhone backup).
+	ClientVersion string
+	// Missing lists the optional columns the database doesn't have, as
+	// table.column.
+	Missing []string
+
+	columns map[string]map[string]bool
+}
+
+// DetectChatDBSchema reads the columns of the message and chat tables and
+// the Messages client version of db.
+func DetectChatDBSchema(db *sql.DB) (*ChatDBSchema, error) {
+	schema := &ChatDBSchema{columns: make(map[string]map[string]bool)}
+	for _, table := range []string{"message", "chat"} {
+		columns, err := tableColumns(db, table)
+		if err != nil {
+			return nil, err
+		}
+		schema.columns[table] = columns
+	}
+	for _, col := range ChatDBOptionalColumns {
+		if !schema.HasColumn(col.Table, col.Column) {
+			schema.Missing = append(schema.Missing, col.Table+"."+col.Column)
+		}
+	}
+	// The properties table is only informational, so a database without it
+	// is fine.
+	var version sql.NullString
+	_ = db.QueryRow("SELECT value FROM _SqliteDatabaseProperties WHERE key='_ClientVersion'").Scan(&version)
+	schema.ClientVersion = version.String
+	return schema, nil
+}
+
+func tableColumns(db *sql.DB, table string) (map[string]bool, error) {
+	rows, err := db.Query(fmt.Sprintf("SELECT name FROM pragma_table_info('%s')", table))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schema of %s: %w", table, err)
+	}
+	defer rows.Close()
+	columns := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			return nil, fmt.Errorf("failed to read schema of %s: %w", table, err)
+		}
+		columns[strings.ToLower(name)] = true
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read schema of %s: %w", table, err)
+	}
+	return columns, nil
+}
+
+// HasColumn reports whether table has column. Names are case-insensitive,
+// like in SQLite.
+func (s *ChatDBSchema) HasColumn(table, column string) bool {
+	return s.columns[strings.ToLower(table)][strings.ToLower(column)]
+}
+
+// Version describes the schema for logging: the client version if known,
+// plus which optional columns are missing.
+func (s *ChatDBSchema) Version() string {
+	version := s.ClientVersion
+	if version == "" {
+		version = "unknown"
+	}
+	if len(s.Missing) == 0 {
+		return version + " (all optional columns present)"
+	}
+	return fmt.Sprintf("%s (missing %s)", version, strings.Join(s.Missing, ", "))
+}
+
+// AdaptQuery replaces the expressions of missing optional columns in query
+// with their defaults, so the query prepares on this database and scans
+// the same number of columns.
+func (s *ChatDBSchema) AdaptQuery(query string) string {
+	for _, col := range ChatDBOptionalColumns {
+		if !s.HasColumn(col.Table, col.Column) {
+			query = strings.ReplaceAll(query, col.Expr, col.Default)
+		}
+	}
+	return query
+}
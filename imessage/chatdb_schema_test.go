@@ -0,0 +1,138 @@
+package imessage
+
+import (
+	"database/sql"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// schemaTestQuery selects every optional column the way the readers do.
+const schemaTestQuery = `
+SELECT message.guid, message.attributedBody,
+  COALESCE(message.thread_originator_guid, ''), COALESCE(message.thread_originator_part, ''),
+  message.group_action_type, COALESCE(message.date_edited, 0), COALESCE(message.date_retracted, 0), chat.group_id
+FROM message
+JOIN chat_message_join ON chat_message_join.message_id = message.ROWID
+JOIN chat              ON chat_message_join.chat_id = chat.ROWID
+WHERE message.group_action_type=0
+`
+
+// oldChatDBSchema is a pre-Big Sur style chat.db: none of the optional
+// columns and no properties table.
+var oldChatDBSchema = []string{
+	`CREATE TABLE message (ROWID INTEGER PRIMARY KEY, guid TEXT, date INTEGER, text TEXT, handle_id INTEGER, is_from_me INTEGER, item_type INTEGER)`,
+	`CREATE TABLE chat (ROWID INTEGER PRIMARY KEY, guid TEXT, chat_identifier TEXT, service_name TEXT)`,
+	`CREATE TABLE chat_message_join (chat_id INTEGER, message_id INTEGER)`,
+	`INSERT INTO message (ROWID, guid, date, text, handle_id, is_from_me, item_type) VALUES (1, 'OLD-1', 1, 'hi', 0, 0, 0)`,
+	`INSERT INTO chat (ROWID, guid, chat_identifier, service_name) VALUES (1, 'iMessage;-;+15550001', '+15550001', 'iMessage')`,
+	`INSERT INTO chat_message_join VALUES (1, 1)`,
+}
+
+// newChatDBSchema is a Ventura style chat.db with every optional column.
+var newChatDBSchema = []string{
+	`CREATE TABLE message (ROWID INTEGER PRIMARY KEY, guid TEXT, date INTEGER, text TEXT, handle_id INTEGER, is_from_me INTEGER, item_type INTEGER,
+		attributedBody BLOB, thread_originator_guid TEXT, thread_originator_part TEXT, group_action_type INTEGER, date_edited INTEGER, date_retracted INTEGER)`,
+	`CREATE TABLE chat (ROWID INTEGER PRIMARY KEY, guid TEXT, chat_identifier TEXT, service_name TEXT, group_id TEXT)`,
+	`CREATE TABLE chat_message_join (chat_id INTEGER, message_id INTEGER)`,
+	`CREATE TABLE _SqliteDatabaseProperties (key TEXT, value TEXT)`,
+	`INSERT INTO _SqliteDatabaseProperties VALUES ('_ClientVersion', '17001')`,
+	`INSERT INTO message VALUES (1, 'NEW-1', 1, 'hi', 0, 0, 0, x'01', 'ORIG-1', '0:0:2', 0, 5, 0)`,
+	`INSERT INTO chat VALUES (1, 'iMessage;+;chat1', 'chat1', 'iMessage', 'GROUP-1')`,
+	`INSERT INTO chat_message_join VALUES (1, 1)`,
+}
+
+func openSchemaTestDB(t *testing.T, schema []string) *sql.DB {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "chat.db")
+	writeTestChatDB(t, path, schema)
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatalf("sql.Open(%s) error = %v", path, err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestDetectChatDBSchema(t *testing.T) {
+	tests := []struct {
+		name        string
+		schema      []string
+		wantVersion string
+		wantMissing []string
+	}{
+		{"old", oldChatDBSchema, "", []string{
+			"message.attributedBody", "message.thread_originator_guid", "message.thread_originator_part",
+			"message.group_action_type", "message.date_edited", "message.date_retracted", "chat.group_id",
+		}},
+		{"new", newChatDBSchema, "17001", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			schema, err := DetectChatDBSchema(openSchemaTestDB(t, tt.schema))
+			if err != nil {
+				t.Fatalf("DetectChatDBSchema() error = %v", err)
+			}
+			if schema.ClientVersion != tt.wantVersion {
+				t.Errorf("DetectChatDBSchema() ClientVersion = %q, want %q", schema.ClientVersion, tt.wantVersion)
+			}
+			if !reflect.DeepEqual(schema.Missing, tt.wantMissing) {
+				t.Errorf("DetectChatDBSchema() Missing = %v, want %v", schema.Missing, tt.wantMissing)
+			}
+		})
+	}
+}
+
+func TestAdaptQuery(t *testing.T) {
+	type row struct {
+		guid, threadGUID, threadPart, groupID string
+		attributedBody                        []byte
+		groupAction, edited, retracted        int64
+	}
+	tests := []struct {
+		name   string
+		schema []string
+		want   row
+	}{
+		{"old", oldChatDBSchema, row{guid: "OLD-1"}},
+		{"new", newChatDBSchema, row{
+			guid: "NEW-1", threadGUID: "ORIG-1", threadPart: "0:0:2", groupID: "GROUP-1",
+			attributedBody: []byte{1}, edited: 5,
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := openSchemaTestDB(t, tt.schema)
+			schema, err := DetectChatDBSchema(db)
+			if err != nil {
+				t.Fatalf("DetectChatDBSchema() error = %v", err)
+			}
+			var got row
+			err = db.QueryRow(schema.AdaptQuery(schemaTestQuery)).Scan(&got.guid, &got.attributedBody,
+				&got.threadGUID, &got.threadPart, &got.groupAction, &got.edited, &got.retracted, &got.groupID)
+			if err != nil {
+				t.Fatalf("adapted query error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("adapted query = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChatDBSchemaVersion(t *testing.T) {
+	tests := []struct {
+		schema ChatDBSchema
+		want   string
+	}{
+		{ChatDBSchema{ClientVersion: "17001"}, "17001 (all optional columns present)"},
+		{ChatDBSchema{Missing: []string{"message.date_edited", "chat.group_id"}}, "unknown (missing message.date_edited, chat.group_id)"},
+	}
+	for _, tt := range tests {
+		if got := tt.schema.Version(); got != tt.want {
+			t.Errorf("Version() = %q, want %q", got, tt.want)
+		}
+	}
+}
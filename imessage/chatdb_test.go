@@ -0,0 +1,142 @@
+package imessage
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// chatDBTestSchema is the subset of the Messages schema OpenChatDB checks.
+var chatDBTestSchema = []string{
+	`CREATE TABLE message (ROWID INTEGER PRIMARY KEY, guid TEXT, date INTEGER, text TEXT, handle_id INTEGER, is_from_me INTEGER, item_type INTEGER)`,
+	`CREATE TABLE chat (ROWID INTEGER PRIMARY KEY, guid TEXT, chat_identifier TEXT, service_name TEXT)`,
+	`CREATE TABLE handle (ROWID INTEGER PRIMARY KEY, id TEXT, service TEXT)`,
+	`CREATE TABLE chat_message_join (chat_id INTEGER, message_id INTEGER)`,
+	`CREATE TABLE attachment (ROWID INTEGER PRIMARY KEY, guid TEXT, filename TEXT, mime_type TEXT)`,
+	`CREATE TABLE message_attachment_join (message_id INTEGER, attachment_id INTEGER)`,
+}
+
+func writeTestChatDB(t *testing.T, path string, schema []string) {
+	t.Helper()
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatalf("sql.Open(%s) error = %v", path, err)
+	}
+	defer db.Close()
+	for _, stmt := range schema {
+		if _, err = db.Exec(stmt); err != nil {
+			t.Fatalf("Exec(%q) error = %v", stmt, err)
+		}
+	}
+}
+
+func TestOpenChatDBCustomPath(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "backup", "sms.db")
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		t.Fatalf("MkdirAll() error = %v", err)
+	}
+	writeTestChatDB(t, path, append(chatDBTestSchema,
+		`INSERT INTO message (guid, date, text, handle_id, is_from_me, item_type) VALUES ('ABC-123', 1, 'hello', 0, 0, 0)`))
+
+	db, gotPath, err := OpenChatDB(path)
+	if err != nil {
+		t.Fatalf("OpenChatDB(%s) error = %v", path, err)
+	}
+	defer db.Close()
+	if gotPath != path {
+		t.Errorf("OpenChatDB() path = %q, want %q", gotPath, path)
+	}
+	var text string
+	if err = db.QueryRow("SELECT text FROM message WHERE guid='ABC-123'").Scan(&text); err != nil {
+		t.Fatalf("query on opened chat.db error = %v", err)
+	}
+	if text != "hello" {
+		t.Errorf("message text = %q, want %q", text, "hello")
+	}
+	if _, err = db.Exec("DELETE FROM message"); err == nil {
+		t.Errorf("write to chat.db succeeded, want read-only")
+	}
+}
+
+func TestOpenChatDBEscapesPath(t *testing.T) {
+	// Without escaping, "?" would start the URI query and "#" the fragment,
+	// and sqlite would open (or create) a different file.
+	dir := t.TempDir()
+	writeTestChatDB(t, filepath.Join(dir, "sms.db"), chatDBTestSchema)
+	path := filepath.Join(dir, "Backup ?mode=rw #1 100%.db")
+	if err := os.Rename(filepath.Join(dir, "sms.db"), path); err != nil {
+		t.Fatalf("Rename() error = %v", err)
+	}
+
+	db, _, err := OpenChatDB(path)
+	if err != nil {
+		t.Fatalf("OpenChatDB(%s) error = %v", path, err)
+	}
+	defer db.Close()
+	if _, err = db.Exec("DELETE FROM message"); err == nil {
+		t.Errorf("write to chat.db succeeded, want read-only")
+	}
+}
+
+func TestOpenChatDBRejectsOtherFiles(t *testing.T) {
+	dir := t.TempDir()
+
+	missingTable := filepath.Join(dir, "missing-table.db")
+	writeTestChatDB(t, missingTable, chatDBTestSchema[:len(chatDBTestSchema)-1])
+
+	missingColumn := filepath.Join(dir, "missing-column.db")
+	schema := append([]string{`CREATE TABLE message (ROWID INTEGER PRIMARY KEY, guid TEXT, date INTEGER)`}, chatDBTestSchema[1:]...)
+	writeTestChatDB(t, missingColumn, schema)
+
+	notSQLite := filepath.Join(dir, "notes.txt")
+	if err := os.WriteFile(notSQLite, []byte("not a database at all, just some text"), 0600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		path    string
+		wantErr string
+	}{
+		{"missing table", missingTable, "missing table message_attachment_join"},
+		{"missing column", missingColumn, "table message has no column text"},
+		{"not sqlite", notSQLite, notSQLite},
+		{"nonexistent file", filepath.Join(dir, "nope.db"), "nope.db"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, _, err := OpenChatDB(tt.path)
+			if err == nil {
+				db.Close()
+				t.Fatalf("OpenChatDB(%s) error = nil, want error", tt.path)
+			}
+			if !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("OpenChatDB(%s) error = %q, want it to mention %q", tt.path, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestResolveChatDBPath(t *testing.T) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		t.Skipf("no home directory: %v", err)
+	}
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"", filepath.Join(home, "Library", "Messages", "chat.db")},
+		{"~/backup/sms.db", filepath.Join(home, "backup", "sms.db")},
+		{"/srv/backup/sms.db", "/srv/backup/sms.db"},
+	}
+	for _, tt := range tests {
+		if got, err := ResolveChatDBPath(tt.path); err != nil || got != tt.want {
+			t.Errorf("ResolveChatDBPath(%q) = %q, %v, want %q", tt.path, got, err, tt.want)
+		}
+	}
+}
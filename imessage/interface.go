@@ -47,6 +47,12 @@ type ChatInfoAPI interface {
 	GetGroupAvatar(chatID string) (*Attachment, error)
 }
 
+// PinnedChatsAPI is implemented by platforms that can read which
+// conversations the user pinned to the top of Messages.
+type PinnedChatsAPI interface {
+	GetPinnedChatGUIDs() ([]string, error)
+}
+
 type VenturaFeatures interface {
 	UnsendMessage(chatID, targetGUID string, targetPart int) (*SendResponse, error)
 	EditMessage(chatID, targetGUID string, newText string, targetPart int) (*SendResponse, error)
@@ -153,6 +159,10 @@ type PlatformConfig struct {
 
 	DeleteMediaAfterUpload bool `yaml:"delete_media_after_upload"`
 
+	// ChatDBPath overrides the chat.db the mac platform reads, e.g. an sms.db
+	// extracted from an iPhone backup. Empty means ~/Library/Messages/chat.db.
+	ChatDBPath string `yaml:"chatdb_path"`
+
 	BlueBubblesURL      string `yaml:"bluebubbles_url"`
 	BlueBubblesPassword string `yaml:"bluebubbles_password"`
 }
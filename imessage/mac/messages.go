@@ -22,7 +22,6 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
-	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -41,7 +40,8 @@ SELECT
   chat.guid, COALESCE(sender_handle.id, ''), COALESCE(sender_handle.service, ''), COALESCE(target_handle.id, ''), COALESCE(target_handle.service, ''),
   message.is_from_me, message.date_read, message.is_delivered, message.is_sent, message.is_emote, message.is_audio_message,
   COALESCE(message.thread_originator_guid, ''), COALESCE(message.thread_originator_part, ''), COALESCE(message.associated_message_guid, ''), message.associated_message_type,
-  message.group_title, message.item_type, message.group_action_type, chat.group_id
+  message.group_title, message.item_type, message.group_action_type, chat.group_id,
+  COALESCE(message.date_edited, 0), COALESCE(message.date_retracted, 0)
 FROM message
 JOIN chat_message_join         ON chat_message_join.message_id = message.ROWID
 JOIN chat                      ON chat_message_join.chat_id = chat.ROWID
@@ -56,32 +56,32 @@ WHERE message_attachment_join.message_id = $1
 ORDER BY ROWID
 `
 
-var newMessagesQuery = baseMessagesQuery + `
+const newMessagesQuery = baseMessagesQuery + `
 WHERE message.ROWID > $1
 ORDER BY message.date ASC
 `
 
-var singleMessageQuery = baseMessagesQuery + `
+const singleMessageQuery = baseMessagesQuery + `
 WHERE message.guid = $1
 `
 
-var messagesAfterQuery = baseMessagesQuery + `
+const messagesAfterQuery = baseMessagesQuery + `
 WHERE (chat.guid=$1 OR $1='') AND message.date>$2
 ORDER BY message.date ASC
 `
 
-var messagesBetweenQuery = baseMessagesQuery + `
+const messagesBetweenQuery = baseMessagesQuery + `
 WHERE (chat.guid=$1 OR $1='') AND message.date>$2 AND message.date<$3
 ORDER BY message.date DESC
 `
 
-var messagesBeforeWithLimitQuery = baseMessagesQuery + `
+const messagesBeforeWithLimitQuery = baseMessagesQuery + `
 WHERE (chat.guid=$1 OR $1='') AND message.date<$2
 ORDER BY message.date DESC
 LIMIT $3
 `
 
-var limitedMessagesQuery = baseMessagesQuery + `
+const limitedMessagesQuery = baseMessagesQuery + `
 WHERE (chat.guid=$1 OR $1='')
 ORDER BY message.date DESC
 LIMIT $2
@@ -110,7 +110,7 @@ ORDER BY message.date DESC LIMIT 1
 `
 
 const chatQuery = `
-SELECT chat_identifier, service_name, COALESCE(display_name, ''), group_id
+SELECT chat_identifier, service_name, COALESCE(display_name, ''), chat.group_id
 FROM chat
 WHERE guid=$1
 `
@@ -125,7 +125,7 @@ LIMIT 1
 `
 
 const recentChatsQuery = `
-SELECT chat.guid, chat.group_id FROM message
+SELECT chat.guid, chat.group_id, MAX(message.date) FROM message
 JOIN chat_message_join ON chat_message_join.message_id = message.ROWID
 JOIN chat              ON chat_message_join.chat_id = chat.ROWID
 WHERE message.date>$1
@@ -143,18 +143,17 @@ JOIN chat              ON chat_message_join.chat_id = chat.ROWID
 WHERE date_read>$1 AND is_read=1
 `
 
-func openChatDB() (*sql.DB, string, error) {
-	path, err := os.UserHomeDir()
-	if err != nil {
-		return nil, "", fmt.Errorf("failed to get home directory: %w", err)
+// chatDBPathOverride returns the configured chat.db path, or "" for the
+// default ~/Library/Messages/chat.db.
+func (mac *macOSDatabase) chatDBPathOverride() string {
+	if mac.bridge == nil {
+		return ""
 	}
-	path = filepath.Join(path, "Library", "Messages", "chat.db")
-	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?mode=ro", path))
-	return db, path, err
+	return mac.bridge.GetConnectorConfig().ChatDBPath
 }
 
 func CheckPermissions() error {
-	db, _, err := openChatDB()
+	db, _, err := imessage.OpenChatDB("")
 	if err != nil {
 		return err
 	}
@@ -170,44 +169,31 @@ func CheckPermissions() error {
 
 func (mac *macOSDatabase) prepareMessages() error {
 	var err error
-	mac.chatDB, mac.chatDBPath, err = openChatDB()
+	mac.chatDB, mac.chatDBPath, err = imessage.OpenChatDB(mac.chatDBPathOverride())
 	if err != nil {
 		return err
 	}
-	if !columnExists(mac.chatDB, "message", "thread_originator_guid") {
-		messagesAfterQuery = strings.ReplaceAll(messagesAfterQuery, "COALESCE(message.thread_originator_guid, '')", "''")
-		messagesBetweenQuery = strings.ReplaceAll(messagesBetweenQuery, "COALESCE(message.thread_originator_guid, '')", "''")
-		limitedMessagesQuery = strings.ReplaceAll(limitedMessagesQuery, "COALESCE(message.thread_originator_guid, '')", "''")
-		newMessagesQuery = strings.ReplaceAll(newMessagesQuery, "COALESCE(message.thread_originator_guid, '')", "''")
-		singleMessageQuery = strings.ReplaceAll(singleMessageQuery, "COALESCE(message.thread_originator_guid, '')", "''")
-	}
-	if !columnExists(mac.chatDB, "message", "thread_originator_part") {
-		messagesAfterQuery = strings.ReplaceAll(messagesAfterQuery, "COALESCE(message.thread_originator_part, '')", "''")
-		messagesBetweenQuery = strings.ReplaceAll(messagesBetweenQuery, "COALESCE(message.thread_originator_part, '')", "''")
-		limitedMessagesQuery = strings.ReplaceAll(limitedMessagesQuery, "COALESCE(message.thread_originator_part, '')", "''")
-		newMessagesQuery = strings.ReplaceAll(newMessagesQuery, "COALESCE(message.thread_originator_part, '')", "''")
-		singleMessageQuery = strings.ReplaceAll(singleMessageQuery, "COALESCE(message.thread_originator_part, '')", "''")
-	}
-	if !columnExists(mac.chatDB, "message", "group_action_type") {
-		messagesAfterQuery = strings.ReplaceAll(messagesAfterQuery, "message.group_action_type", "0")
-		messagesBetweenQuery = strings.ReplaceAll(messagesBetweenQuery, "message.group_action_type", "0")
-		limitedMessagesQuery = strings.ReplaceAll(limitedMessagesQuery, "message.group_action_type", "0")
-		newMessagesQuery = strings.ReplaceAll(newMessagesQuery, "message.group_action_type", "0")
-		singleMessageQuery = strings.ReplaceAll(singleMessageQuery, "message.group_action_type", "0")
-	}
-	mac.messagesAfterQuery, err = mac.chatDB.Prepare(messagesAfterQuery)
+	// Older macOS versions lack some of the columns the queries select.
+	// Those are swapped for defaults, so e.g. replies and edits just don't
+	// show up instead of every query failing to prepare.
+	schema, err := imessage.DetectChatDBSchema(mac.chatDB)
+	if err != nil {
+		return fmt.Errorf("failed to detect chat.db schema: %w", err)
+	}
+	mac.log.Infofln("Detected chat.db schema version %s", schema.Version())
+	mac.messagesAfterQuery, err = mac.chatDB.Prepare(schema.AdaptQuery(messagesAfterQuery))
 	if err != nil {
 		return fmt.Errorf("failed to prepare message query: %w", err)
 	}
-	mac.messagesBetweenQuery, err = mac.chatDB.Prepare(messagesBetweenQuery)
+	mac.messagesBetweenQuery, err = mac.chatDB.Prepare(schema.AdaptQuery(messagesBetweenQuery))
 	if err != nil {
 		return fmt.Errorf("failed to prepare message query: %w", err)
 	}
-	mac.messagesBeforeWithLimitQuery, err = mac.chatDB.Prepare(messagesBeforeWithLimitQuery)
+	mac.messagesBeforeWithLimitQuery, err = mac.chatDB.Prepare(schema.AdaptQuery(messagesBeforeWithLimitQuery))
 	if err != nil {
 		return fmt.Errorf("failed to prepare message query: %w", err)
 	}
-	mac.singleMessageQuery, err = mac.chatDB.Prepare(singleMessageQuery)
+	mac.singleMessageQuery, err = mac.chatDB.Prepare(schema.AdaptQuery(singleMessageQuery))
 	if err != nil {
 		return fmt.Errorf("failed to prepare single message query: %w", err)
 	}
@@ -215,16 +201,16 @@ func (mac *macOSDatabase) prepareMessages() error {
 	if err != nil {
 		return fmt.Errorf("failed to prepare attachments query: %w", err)
 	}
-	mac.groupActionQuery, err = mac.chatDB.Prepare(groupActionQuery)
+	mac.groupActionQuery, err = mac.chatDB.Prepare(schema.AdaptQuery(groupActionQuery))
 	if err != nil {
 		mac.log.Warnln("Failed to prepare group action query:", err)
 		mac.groupActionQuery = nil
 	}
-	mac.limitedMessagesQuery, err = mac.chatDB.Prepare(limitedMessagesQuery)
+	mac.limitedMessagesQuery, err = mac.chatDB.Prepare(schema.AdaptQuery(limitedMessagesQuery))
 	if err != nil {
 		return fmt.Errorf("failed to prepare limited message query: %w", err)
 	}
-	mac.newMessagesQuery, err = mac.chatDB.Prepare(newMessagesQuery)
+	mac.newMessagesQuery, err = mac.chatDB.Prepare(schema.AdaptQuery(newMessagesQuery))
 	if err != nil {
 		return fmt.Errorf("failed to prepare new message query: %w", err)
 	}
@@ -232,7 +218,7 @@ func (mac *macOSDatabase) prepareMessages() error {
 	if err != nil {
 		return fmt.Errorf("failed to prepare new receipt query: %w", err)
 	}
-	mac.chatQuery, err = mac.chatDB.Prepare(chatQuery)
+	mac.chatQuery, err = mac.chatDB.Prepare(schema.AdaptQuery(chatQuery))
 	if err != nil {
 		return fmt.Errorf("failed to prepare chat query: %w", err)
 	}
@@ -240,7 +226,7 @@ func (mac *macOSDatabase) prepareMessages() error {
 	if err != nil {
 		return fmt.Errorf("failed to prepare chat GUID query: %w", err)
 	}
-	mac.recentChatsQuery, err = mac.chatDB.Prepare(recentChatsQuery)
+	mac.recentChatsQuery, err = mac.chatDB.Prepare(schema.AdaptQuery(recentChatsQuery))
 	if err != nil {
 		return fmt.Errorf("failed to prepare recent chats query: %w", err)
 	}
@@ -263,16 +249,20 @@ func (mac *macOSDatabase) scanMessages(res *sql.Rows) (messages []*imessage.Mess
 		var readAt int64
 		var newGroupTitle sql.NullString
 		var threadOriginatorPart string
+		var dateEdited, dateRetracted int64
 		err = res.Scan(&message.RowID, &message.GUID, &timestamp, &message.Subject, &message.Text, &attributedBody,
 			&message.ChatGUID, &message.Sender.LocalID, &message.Sender.Service, &message.Target.LocalID, &message.Target.Service,
 			&message.IsFromMe, &readAt, &message.IsDelivered, &message.IsSent, &message.IsEmote, &message.IsAudioMessage,
 			&message.ReplyToGUID, &threadOriginatorPart, &tapback.TargetGUID, &tapback.Type,
-			&newGroupTitle, &message.ItemType, &message.GroupActionType, &message.ThreadID)
+			&newGroupTitle, &message.ItemType, &message.GroupActionType, &message.ThreadID,
+			&dateEdited, &dateRetracted)
 		if err != nil {
 			err = fmt.Errorf("error scanning row: %w", err)
 			return
 		}
 		message.Time = time.Unix(imessage.AppleEpoch.Unix(), timestamp)
+		message.IsEdited = dateEdited != 0
+		message.IsRetracted = dateRetracted != 0
 		if readAt != 0 {
 			message.ReadAt = time.Unix(imessage.AppleEpoch.Unix(), readAt)
 			message.IsRead = true
@@ -302,7 +292,9 @@ func (mac *macOSDatabase) scanMessages(res *sql.Rows) (messages []*imessage.Mess
 			} else {
 				//d, _ := json.MarshalIndent(decoded, "", "  ")
 				//fmt.Println(string(d))
-				if len(message.Text) == 0 && len(decoded.Content) > 0 {
+				// attributedBody holds the current version of an edited
+				// message; the text column can still have the original.
+				if (len(message.Text) == 0 || message.IsEdited) && len(decoded.Content) > 0 {
 					message.Text = strings.TrimSpace(decoded.Content)
 				}
 				message.Attachments = decoded.SortAttachments(mac.log, message.Attachments)
@@ -347,13 +339,6 @@ func reverseArray(messages []*imessage.Message) {
 	}
 }
 
-func columnExists(db *sql.DB, table, column string) bool {
-	row := db.QueryRow(fmt.Sprintf(`SELECT name FROM pragma_table_info("%s") WHERE name=$1;`, table), column)
-	var name string
-	_ = row.Scan(&name)
-	return name == column
-}
-
 func (mac *macOSDatabase) GetMessagesWithLimit(chatID string, limit int, backfillID string) ([]*imessage.Message, error) {
 	res, err := mac.limitedMessagesQuery.Query(chatID, limit)
 	if err != nil {
@@ -486,11 +471,16 @@ func (mac *macOSDatabase) GetChatsWithMessagesAfter(minDate time.Time) ([]imessa
 	var chats []imessage.ChatIdentifier
 	for res.Next() {
 		var chatID, groupID string
-		err = res.Scan(&chatID, &groupID)
+		var lastDate int64
+		err = res.Scan(&chatID, &groupID, &lastDate)
 		if err != nil {
 			return chats, fmt.Errorf("error scanning row: %w", err)
 		}
-		chats = append(chats, imessage.ChatIdentifier{ChatGUID: chatID, ThreadID: groupID})
+		chats = append(chats, imessage.ChatIdentifier{
+			ChatGUID:        chatID,
+			ThreadID:        groupID,
+			LastMessageTime: time.Unix(imessage.AppleEpoch.Unix(), lastDate),
+		})
 	}
 	return chats, nil
 }
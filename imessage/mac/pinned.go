@@ -0,0 +1,79 @@
+//go:build darwin
+
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2024 Ludvig Rhodin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+package mac
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// Pinned conversations aren't stored in chat.db. Messages keeps them in its
+// com.apple.messages.pinning preferences under pD.pP, as a list of chat
+// identifiers ("+15551234567", "chat123456789…") or, on some versions, full
+// chat GUIDs. plutil extracts the list as JSON, and each entry is resolved to
+// a chat GUID through the chat table.
+
+const pinnedChatQuery = `
+SELECT guid FROM chat WHERE guid=$1 OR chat_identifier=$1
+`
+
+func pinningPrefsPath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, "Library", "Preferences", "com.apple.messages.pinning.plist"), nil
+}
+
+func (mac *macOSDatabase) GetPinnedChatGUIDs() ([]string, error) {
+	path, err := pinningPrefsPath()
+	if err != nil {
+		return nil, err
+	}
+	if _, err = os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		// Nothing has ever been pinned on this Mac.
+		return nil, nil
+	}
+	out, err := exec.Command("plutil", "-extract", "pD.pP", "json", "-o", "-", path).Output()
+	if err != nil {
+		// plutil fails when the key path is missing, i.e. no pins.
+		return nil, nil
+	}
+	var identifiers []string
+	if err = json.Unmarshal(out, &identifiers); err != nil {
+		return nil, fmt.Errorf("failed to parse pinned chat list: %w", err)
+	}
+	var guids []string
+	for _, identifier := range identifiers {
+		rows, err := mac.chatDB.Query(pinnedChatQuery, identifier)
+		if err != nil {
+			return nil, fmt.Errorf("error querying pinned chat %q: %w", identifier, err)
+		}
+		for rows.Next() {
+			var guid string
+			if err = rows.Scan(&guid); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("error scanning row: %w", err)
+			}
+			guids = append(guids, guid)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return guids, nil
+}
@@ -121,6 +121,9 @@ const (
 	ItemTypeName
 	ItemTypeAvatar
 
+	// ItemTypeFaceTime is chat.db's record of a FaceTime call in the chat.
+	ItemTypeFaceTime ItemType = 6
+
 	ItemTypeError ItemType = -100
 )
 
@@ -213,6 +216,9 @@ func (attachment *Attachment) Delete() error {
 type ChatIdentifier struct {
 	ChatGUID string `json:"chat_guid"`
 	ThreadID string `json:"thread_id,omitempty"`
+
+	// LastMessageTime is the time of the newest message in the chat, if known.
+	LastMessageTime time.Time `json:"-"`
 }
 
 type ChatInfo struct {
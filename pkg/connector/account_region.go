@@ -0,0 +1,202 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2024 Ludvig Rhodin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+package connector
+
+// Apple ID region (UserLoginMetadata.AccountRegion).
+//
+// The account's region is the ISO 3166-1 alpha-2 country code of its
+// storefront. Login detects it from the country calling code of the
+// account's phone number, and `set-region` sets or clears it by hand.
+//
+// Only CardDAV contacts use it: it is sent as X-MMe-Country on those
+// requests, which the bridge makes itself and rustpush otherwise pins to US.
+// The rustpush config the bridge builds (WrappedOsConfig) has no region or
+// storefront input, so IDS registration, CloudKit sync and every other
+// request made inside rustpush still go out as US.
+
+import (
+	"fmt"
+	"strings"
+
+	"maunium.net/go/mautrix/bridgev2/commands"
+)
+
+// callingCodeRegions maps country calling codes to the region they belong
+// to. Only codes used by a single country are listed. +1 is shared by the
+// US, Canada and the Caribbean and is told apart by area code
+// (northAmericanRegion); +7 (Russia and Kazakhstan) is left out.
+var callingCodeRegions = map[string]string{
+	"20": "EG", "27": "ZA", "30": "GR", "31": "NL", "32": "BE", "33": "FR",
+	"34": "ES", "36": "HU", "39": "IT", "40": "RO", "41": "CH", "43": "AT",
+	"44": "GB", "45": "DK", "46": "SE", "47": "NO", "48": "PL", "49": "DE",
+	"51": "PE", "52": "MX", "54": "AR", "55": "BR", "56": "CL", "57": "CO",
+	"60": "MY", "61": "AU", "62": "ID", "63": "PH", "64": "NZ", "65": "SG",
+	"66": "TH", "81": "JP", "82": "KR", "84": "VN", "86": "CN", "90": "TR",
+	"91": "IN", "92": "PK", "234": "NG", "254": "KE", "351": "PT", "352": "LU",
+	"353": "IE", "354": "IS", "358": "FI", "420": "CZ", "421": "SK",
+	"852": "HK", "853": "MO", "886": "TW", "966": "SA", "971": "AE", "972": "IL",
+}
+
+// canadianAreaCodes are the North American Numbering Plan area codes
+// assigned to Canada.
+var canadianAreaCodes = map[string]bool{
+	"204": true, "226": true, "236": true, "249": true, "250": true, "263": true,
+	"289": true, "306": true, "343": true, "354": true, "365": true, "367": true,
+	"368": true, "382": true, "387": true, "403": true, "416": true, "418": true,
+	"428": true, "431": true, "437": true, "438": true, "450": true, "468": true,
+	"474": true, "506": true, "514": true, "519": true, "548": true, "579": true,
+	"581": true, "584": true, "587": true, "600": true, "604": true, "613": true,
+	"639": true, "647": true, "672": true, "683": true, "705": true, "709": true,
+	"742": true, "753": true, "778": true, "780": true, "782": true, "807": true,
+	"819": true, "825": true, "867": true, "873": true, "879": true, "902": true,
+	"905": true,
+}
+
+// northAmericanRegion returns the region of a +1 number given its digits
+// after the calling code: CA for a Canadian area code and US otherwise.
+// Caribbean numbers come out as US too, which is also what rustpush
+// assumes; set-region corrects them.
+func northAmericanRegion(digits string) string {
+	if len(digits) >= 3 && canadianAreaCodes[digits[:3]] {
+		return "CA"
+	}
+	return "US"
+}
+
+// normalizeAccountRegion validates a region code, returning it upper-cased.
+// An empty value is valid and means "unknown".
+func normalizeAccountRegion(raw string) (string, error) {
+	region := strings.ToUpper(strings.TrimSpace(raw))
+	if region == "" {
+		return "", nil
+	}
+	if len(region) != 2 || region[0] < 'A' || region[0] > 'Z' || region[1] < 'A' || region[1] > 'Z' {
+		return "", fmt.Errorf("%q is not a two-letter country code", raw)
+	}
+	return region, nil
+}
+
+// detectAccountRegion returns the region of the first phone number handle
+// with an unambiguous calling code, falling back to the first +1 number's
+// (northAmericanRegion), or "" if there is neither.
+func detectAccountRegion(handles []string) string {
+	northAmerican := ""
+	for _, handle := range handles {
+		normalized := normalizeIdentifierForPortalID(handle)
+		if !strings.HasPrefix(normalized, "tel:+") {
+			continue
+		}
+		digits := strings.TrimPrefix(normalized, "tel:+")
+		if rest, ok := strings.CutPrefix(digits, "1"); ok {
+			if northAmerican == "" {
+				northAmerican = northAmericanRegion(rest)
+			}
+			continue
+		}
+		for n := 3; n >= 1; n-- {
+			if len(digits) > n {
+				if region, ok := callingCodeRegions[digits[:n]]; ok {
+					return region
+				}
+			}
+		}
+	}
+	return northAmerican
+}
+
+var cmdSetRegion = &commands.FullHandler{
+	Name:    "set-region",
+	Aliases: []string{"region"},
+	Func:    fnSetRegion,
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionChats,
+		Description: "Show or set the region (two-letter country code) of your Apple ID used for iCloud contacts, or `reset` it to the detected one.",
+		Args:        "[country code|reset]",
+	},
+	RequiresLogin: true,
+}
+
+func fnSetRegion(ce *commands.Event) {
+	login := ce.User.GetDefaultLogin()
+	if login == nil {
+		ce.Reply("No active login found.")
+		return
+	}
+	meta, ok := login.Metadata.(*UserLoginMetadata)
+	if !ok || meta == nil {
+		ce.Reply("Login metadata unavailable.")
+		return
+	}
+
+	arg := strings.TrimSpace(ce.RawArgs)
+	if arg == "" {
+		if meta.AccountRegion == "" {
+			ce.Reply("Your Apple ID region is unknown. Use `$cmdprefix set-region <country code>` to set it, e.g. `DE`.")
+		} else {
+			ce.Reply("Your Apple ID region is **%s**.", meta.AccountRegion)
+		}
+		return
+	}
+
+	var region string
+	if strings.EqualFold(arg, "reset") {
+		handles := []string{meta.PreferredHandle}
+		if client, ok := login.Client.(*IMClient); ok && client != nil {
+			handles = append(handles, client.allHandles...)
+		}
+		region = detectAccountRegion(handles)
+	} else {
+		var err error
+		if region, err = normalizeAccountRegion(arg); err != nil {
+			ce.Reply("Invalid region: %v.", err)
+			return
+		}
+	}
+	meta.AccountRegion = region
+	if err := login.Save(ce.Ctx); err != nil {
+		ce.Reply("Failed to save settings: %v", err)
+		return
+	}
+	if region == "" {
+		ce.Reply("Couldn't detect your Apple ID region from your phone number; it's now unset.")
+	} else {
+		ce.Reply("Apple ID region set to **%s**.", region)
+	}
+}
+
+// accountRegion returns the login's Apple ID region, or "" if unknown.
+func (c *IMClient) accountRegion() string {
+	if c.UserLogin == nil {
+		return ""
+	}
+	meta, ok := c.UserLogin.Metadata.(*UserLoginMetadata)
+	if !ok || meta == nil {
+		return ""
+	}
+	return meta.AccountRegion
+}
+
+// regionalICloudAuth overrides the X-MMe-Country header of the wrapped
+// provider with the account's region. region is read on every request so
+// set-region applies without reconnecting.
+type regionalICloudAuth struct {
+	icloudAuthProvider
+	region func() string
+}
+
+func (a regionalICloudAuth) GetIcloudAuthHeaders() (*map[string]string, error) {
+	headers, err := a.icloudAuthProvider.GetIcloudAuthHeaders()
+	if err != nil || headers == nil || a.region == nil {
+		return headers, err
+	}
+	if region := a.region(); region != "" {
+		(*headers)["X-MMe-Country"] = region
+	}
+	return headers, nil
+}
@@ -0,0 +1,73 @@
+package connector
+
+import "testing"
+
+func TestNormalizeAccountRegion(t *testing.T) {
+	tests := []struct {
+		raw     string
+		want    string
+		wantErr bool
+	}{
+		{"de", "DE", false},
+		{" GB ", "GB", false},
+		{"", "", false},
+		{"DEU", "", true},
+		{"d1", "", true},
+		{"é", "", true},
+	}
+	for _, tt := range tests {
+		got, err := normalizeAccountRegion(tt.raw)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("normalizeAccountRegion(%q) = %q, %v, want %q (error %v)", tt.raw, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestDetectAccountRegion(t *testing.T) {
+	tests := []struct {
+		name    string
+		handles []string
+		want    string
+	}{
+		{"German number", []string{"tel:+4915112345678"}, "DE"},
+		{"three-digit code", []string{"tel:+353861234567"}, "IE"},
+		{"email first", []string{"mailto:me@example.com", "tel:+447700900123"}, "GB"},
+		{"US number", []string{"tel:+12125551234"}, "US"},
+		{"Canadian number", []string{"tel:+14165551234"}, "CA"},
+		{"unambiguous code wins over +1", []string{"tel:+14165551234", "tel:+81312345678"}, "JP"},
+		{"Russian or Kazakh number is ambiguous", []string{"tel:+74951234567"}, ""},
+		{"email only", []string{"mailto:me@example.com"}, ""},
+		{"no handles", nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := detectAccountRegion(tt.handles); got != tt.want {
+				t.Errorf("detectAccountRegion(%v) = %q, want %q", tt.handles, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRegionalICloudAuth(t *testing.T) {
+	tests := []struct {
+		name   string
+		region string
+		want   string
+		wantOK bool
+	}{
+		{"region set", "DE", "DE", true},
+		{"region unknown", "", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auth := regionalICloudAuth{fakeICloudAuth{}, func() string { return tt.region }}
+			headers, err := auth.GetIcloudAuthHeaders()
+			if err != nil {
+				t.Fatalf("GetIcloudAuthHeaders() error = %v", err)
+			}
+			if got, ok := (*headers)["X-MMe-Country"]; got != tt.want || ok != tt.wantOK {
+				t.Errorf("X-MMe-Country = %q (present %v), want %q (present %v)", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2024 Ludvig Rhodin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+package connector
+
+import (
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxAttachmentFileNameBytes caps attachment filenames at the common
+// filesystem limit, since clients save downloads under this name.
+const maxAttachmentFileNameBytes = 255
+
+// maxKeptExtensionBytes is the longest extension kept when a name is cut.
+const maxKeptExtensionBytes = 16
+
+// sanitizeAttachmentFileName makes a sender-supplied attachment filename
+// (transfer_name, the MMCS filename, a shared album asset name) safe to
+// upload under: only the last path element is kept, control and bidi
+// override characters are dropped, and the name is capped in length with
+// its extension kept. Returns "" when nothing usable is left, so callers
+// keep their own fallback name.
+func sanitizeAttachmentFileName(name string) string {
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
+	name = strings.Map(func(r rune) rune {
+		if r == utf8.RuneError || unicode.IsControl(r) || isBidiControl(r) {
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.TrimLeft(strings.TrimSpace(name), ".")
+	if name == "" {
+		return ""
+	}
+	if len(name) <= maxAttachmentFileNameBytes {
+		return name
+	}
+	ext := filepath.Ext(name)
+	if len(ext) > maxKeptExtensionBytes {
+		ext = ""
+	}
+	return truncateUTF8(strings.TrimSuffix(name, ext), maxAttachmentFileNameBytes-len(ext)) + ext
+}
+
+// isBidiControl reports whether r changes text direction, which can make a
+// name like "photo<U+202E>gpj.exe" display as "photoexe.jpg".
+func isBidiControl(r rune) bool {
+	return (r >= '\u202a' && r <= '\u202e') || (r >= '\u2066' && r <= '\u2069') || r == '\u200e' || r == '\u200f' || r == '\u061c'
+}
+
+// truncateUTF8 cuts s to at most n bytes without splitting a character.
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
@@ -0,0 +1,60 @@
+package connector
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSanitizeAttachmentFileName(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"plain", "IMG_0001.HEIC", "IMG_0001.HEIC"},
+		{"unicode", "Überweisung März.pdf", "Überweisung März.pdf"},
+		{"unix traversal", "../../../etc/passwd", "passwd"},
+		{"windows traversal", `..\..\Windows\System32\evil.dll`, "evil.dll"},
+		{"absolute path", "/var/mobile/Library/SMS/Attachments/ab/12/photo.jpg", "photo.jpg"},
+		{"only dots", "..", ""},
+		{"trailing separator", "photos/", ""},
+		{"hidden file", ".bashrc", "bashrc"},
+		{"control characters", "in\x00voice\r\n.pdf", "invoice.pdf"},
+		{"bidi override", "photo\u202egpj.exe", "photogpj.exe"},
+		{"bidi isolate", "\u2066report\u2069.txt", "report.txt"},
+		{"invalid UTF-8", "bad\xffname.txt", "badname.txt"},
+		{"whitespace", "  notes.txt \t", "notes.txt"},
+		{"empty", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sanitizeAttachmentFileName(tt.in); got != tt.want {
+				t.Errorf("sanitizeAttachmentFileName(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSanitizeAttachmentFileNameLength(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		wantExt string
+	}{
+		{"long ascii", strings.Repeat("a", 400) + ".jpeg", ".jpeg"},
+		{"long multibyte", strings.Repeat("é", 300) + ".pdf", ".pdf"},
+		{"long extension", "a." + strings.Repeat("x", 300), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := sanitizeAttachmentFileName(tt.in)
+			if len(got) > maxAttachmentFileNameBytes || !utf8.ValidString(got) {
+				t.Errorf("sanitizeAttachmentFileName() = %d bytes (valid UTF-8: %v), want at most %d", len(got), utf8.ValidString(got), maxAttachmentFileNameBytes)
+			}
+			if tt.wantExt != "" && !strings.HasSuffix(got, tt.wantExt) {
+				t.Errorf("sanitizeAttachmentFileName() = %q, want extension %q kept", got, tt.wantExt)
+			}
+		})
+	}
+}
@@ -0,0 +1,220 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2024 Ludvig Rhodin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+package connector
+
+import (
+	"bytes"
+	"image/jpeg"
+	"path/filepath"
+	"strings"
+
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/event"
+
+	"github.com/lrhodin/imessage/pkg/rustpushgo"
+)
+
+// Some image messages carry the same picture twice: a small inline preview
+// (AttachmentType::Inline, bytes in the push payload) and the full-resolution
+// original as an MMCS reference. Bridging both would post the picture twice,
+// and the preview is the only one guaranteed to have bytes if the MMCS
+// download fails, so the pair is collapsed into a single attachment here.
+
+// bridgedAttachment is one attachment to bridge, with the inline preview it
+// was paired with (if any).
+type bridgedAttachment struct {
+	Attachment rustpushgo.WrappedAttachment
+	// Preview is the low-res inline copy of Attachment. Used as the Matrix
+	// thumbnail when the full-res download succeeded.
+	Preview []byte
+}
+
+// isReferencedAttachment reports whether att came in as an MMCS reference
+// (its bytes, if present, were downloaded rather than inlined).
+func isReferencedAttachment(att *rustpushgo.WrappedAttachment) bool {
+	return att.MmcsDescriptorJson != nil && *att.MmcsDescriptorJson != ""
+}
+
+// attachmentBaseName is the pairing key: the file name without extension,
+// case-folded. The preview may be a JPEG of a HEIC original.
+func attachmentBaseName(att *rustpushgo.WrappedAttachment) string {
+	return strings.ToLower(strings.TrimSuffix(att.Filename, filepath.Ext(att.Filename)))
+}
+
+// isPreviewOf reports whether preview is an inline low-res copy of full.
+// Both must be images: a Live Photo is a still plus a video with the same
+// base name, and both halves have to be bridged.
+func isPreviewOf(preview, full *rustpushgo.WrappedAttachment) bool {
+	if isReferencedAttachment(preview) || !isReferencedAttachment(full) {
+		return false
+	}
+	if preview.InlineData == nil || !strings.HasPrefix(preview.MimeType, "image/") || !strings.HasPrefix(full.MimeType, "image/") {
+		return false
+	}
+	name := attachmentBaseName(preview)
+	return name != "" && name == attachmentBaseName(full) && uint64(len(*preview.InlineData)) < full.Size
+}
+
+// selectAttachmentVariants collapses inline-preview + full-res pairs in a
+// message's attachment list. The full-res attachment wins when its download
+// succeeded, with the preview kept as its thumbnail; otherwise the preview's
+// bytes are bridged in its place so the message still shows the picture.
+// Unpaired attachments pass through unchanged, in their original order.
+func selectAttachmentVariants(atts []rustpushgo.WrappedAttachment) []bridgedAttachment {
+	previewFor := make(map[int]int)
+	isPreview := make(map[int]bool)
+	for i := range atts {
+		if !isReferencedAttachment(&atts[i]) {
+			continue
+		}
+		for j := range atts {
+			if !isPreview[j] && isPreviewOf(&atts[j], &atts[i]) {
+				previewFor[i] = j
+				isPreview[j] = true
+				break
+			}
+		}
+	}
+
+	out := make([]bridgedAttachment, 0, len(atts))
+	for i, att := range atts {
+		if isPreview[i] {
+			continue
+		}
+		j, paired := previewFor[i]
+		if !paired {
+			out = append(out, bridgedAttachment{Attachment: att})
+			continue
+		}
+		preview := atts[j]
+		if att.InlineData != nil {
+			out = append(out, bridgedAttachment{Attachment: att, Preview: *preview.InlineData})
+		} else {
+			// Full-res download failed: fall back to the preview, under the
+			// original's name so the Matrix event reads the same.
+			preview.Filename = att.Filename
+			out = append(out, bridgedAttachment{Attachment: preview})
+		}
+	}
+	return out
+}
+
+// previewThumbnail turns an inline preview into a JPEG thumbnail for the
+// Matrix event. Returns nil if the preview can't be decoded.
+func previewThumbnail(preview []byte) ([]byte, int, int) {
+	img, _, isJPEG := decodeImageData(preview)
+	if img == nil {
+		return nil, 0, 0
+	}
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w > 800 || h > 800 {
+		return scaleAndEncodeThumb(img, w, h)
+	}
+	if isJPEG {
+		return preview, w, h
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 75}); err != nil {
+		return nil, 0, 0
+	}
+	return buf.Bytes(), w, h
+}
+
+// Live Photos arrive as two attachments: the still (HEIC/JPEG) and its
+// paired QuickTime video, with the same base name and Apple's iris flag or
+// the live-photo-bundle UTI on at least one half. Both halves are bridged,
+// but the video is sent as a "Live Photo" reply to the still so Matrix
+// clients show the two together instead of as unrelated events.
+
+const livePhotoBundleUTI = "com.apple.live-photo-bundle"
+
+// isLivePhotoFlagged reports whether Apple marked att as part of a Live Photo.
+func isLivePhotoFlagged(att *rustpushgo.WrappedAttachment) bool {
+	return att.Iris || att.UtiType == livePhotoBundleUTI
+}
+
+func isLivePhotoStill(att *rustpushgo.WrappedAttachment) bool {
+	switch att.UtiType {
+	case "public.heic", "public.heif", "public.jpeg":
+		return true
+	}
+	return strings.HasPrefix(att.MimeType, "image/")
+}
+
+func isLivePhotoVideo(att *rustpushgo.WrappedAttachment) bool {
+	return att.UtiType == "com.apple.quicktime-movie" || att.MimeType == "video/quicktime"
+}
+
+// pairLivePhotos finds the Live Photos in a message's attachments and
+// returns a map from each video's index to its still's index. A video pairs
+// with the still of the same base name. If that leaves exactly one flagged
+// still and one flagged video unpaired (Apple doesn't always keep the names
+// in step), those two are paired as well.
+func pairLivePhotos(atts []bridgedAttachment) map[int]int {
+	pairs := make(map[int]int)
+	pairedStill := make(map[int]bool)
+	for v := range atts {
+		video := &atts[v].Attachment
+		if !isLivePhotoVideo(video) {
+			continue
+		}
+		name := attachmentBaseName(video)
+		for s := range atts {
+			still := &atts[s].Attachment
+			if s == v || pairedStill[s] || !isLivePhotoStill(still) {
+				continue
+			}
+			if name != "" && name == attachmentBaseName(still) && (isLivePhotoFlagged(video) || isLivePhotoFlagged(still)) {
+				pairs[v] = s
+				pairedStill[s] = true
+				break
+			}
+		}
+	}
+
+	var flaggedStills, flaggedVideos []int
+	for i := range atts {
+		att := &atts[i].Attachment
+		if !isLivePhotoFlagged(att) {
+			continue
+		}
+		if _, paired := pairs[i]; paired || pairedStill[i] {
+			continue
+		}
+		if isLivePhotoVideo(att) {
+			flaggedVideos = append(flaggedVideos, i)
+		} else if isLivePhotoStill(att) {
+			flaggedStills = append(flaggedStills, i)
+		}
+	}
+	if len(flaggedStills) == 1 && len(flaggedVideos) == 1 {
+		pairs[flaggedVideos[0]] = flaggedStills[0]
+	}
+	return pairs
+}
+
+// markLivePhotoVideo labels the converted video half of a Live Photo and
+// makes it a reply to the still, unless the message already replies to
+// something else.
+func markLivePhotoVideo(cm *bridgev2.ConvertedMessage, stillID networkid.MessageID) {
+	for _, part := range cm.Parts {
+		if part.Content == nil || part.Content.MsgType != event.MsgVideo {
+			continue
+		}
+		if part.Content.FileName == "" {
+			part.Content.FileName = part.Content.Body
+		}
+		part.Content.Body = "Live Photo"
+	}
+	if cm.ReplyTo == nil {
+		cm.ReplyTo = &networkid.MessageOptionalPartID{MessageID: stillID}
+	}
+}
@@ -0,0 +1,174 @@
+package connector
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"reflect"
+	"testing"
+
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/event"
+
+	"github.com/lrhodin/imessage/pkg/rustpushgo"
+)
+
+func TestSelectAttachmentVariants(t *testing.T) {
+	descriptor := `{"signature":"00"}`
+	previewBytes := []byte("low-res")
+	fullBytes := []byte("full-resolution image bytes")
+	inline := func(name, mime string, data []byte) rustpushgo.WrappedAttachment {
+		d := data
+		return rustpushgo.WrappedAttachment{Filename: name, MimeType: mime, IsInline: true, InlineData: &d, Size: uint64(len(data))}
+	}
+	referenced := func(name, mime string, data []byte) rustpushgo.WrappedAttachment {
+		att := rustpushgo.WrappedAttachment{Filename: name, MimeType: mime, MmcsDescriptorJson: &descriptor, Size: uint64(len(fullBytes))}
+		if data != nil {
+			d := data
+			att.IsInline = true
+			att.InlineData = &d
+		}
+		return att
+	}
+
+	tests := []struct {
+		name        string
+		atts        []rustpushgo.WrappedAttachment
+		wantNames   []string
+		wantData    []string
+		wantPreview []string
+	}{
+		{
+			name:        "full-res downloaded, preview becomes thumbnail",
+			atts:        []rustpushgo.WrappedAttachment{inline("IMG_1.jpeg", "image/jpeg", previewBytes), referenced("IMG_1.HEIC", "image/heic", fullBytes)},
+			wantNames:   []string{"IMG_1.HEIC"},
+			wantData:    []string{string(fullBytes)},
+			wantPreview: []string{string(previewBytes)},
+		},
+		{
+			name:        "full-res download failed, falls back to preview",
+			atts:        []rustpushgo.WrappedAttachment{referenced("IMG_1.HEIC", "image/heic", nil), inline("IMG_1.jpeg", "image/jpeg", previewBytes)},
+			wantNames:   []string{"IMG_1.HEIC"},
+			wantData:    []string{string(previewBytes)},
+			wantPreview: []string{""},
+		},
+		{
+			name:        "unrelated inline and referenced pass through",
+			atts:        []rustpushgo.WrappedAttachment{inline("a.png", "image/png", previewBytes), referenced("b.jpg", "image/jpeg", fullBytes)},
+			wantNames:   []string{"a.png", "b.jpg"},
+			wantData:    []string{string(previewBytes), string(fullBytes)},
+			wantPreview: []string{"", ""},
+		},
+		{
+			name:        "live photo still and video are not paired",
+			atts:        []rustpushgo.WrappedAttachment{inline("IMG_2.jpeg", "image/jpeg", previewBytes), referenced("IMG_2.MOV", "video/quicktime", fullBytes)},
+			wantNames:   []string{"IMG_2.jpeg", "IMG_2.MOV"},
+			wantData:    []string{string(previewBytes), string(fullBytes)},
+			wantPreview: []string{"", ""},
+		},
+		{
+			name:        "inline copy not smaller is not a preview",
+			atts:        []rustpushgo.WrappedAttachment{inline("IMG_3.jpeg", "image/jpeg", fullBytes), referenced("IMG_3.jpeg", "image/jpeg", fullBytes)},
+			wantNames:   []string{"IMG_3.jpeg", "IMG_3.jpeg"},
+			wantData:    []string{string(fullBytes), string(fullBytes)},
+			wantPreview: []string{"", ""},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := selectAttachmentVariants(tt.atts)
+			if len(got) != len(tt.wantNames) {
+				t.Fatalf("got %d attachments, want %d", len(got), len(tt.wantNames))
+			}
+			for i, ba := range got {
+				if ba.Attachment.Filename != tt.wantNames[i] {
+					t.Errorf("[%d] Filename = %q, want %q", i, ba.Attachment.Filename, tt.wantNames[i])
+				}
+				data := ""
+				if ba.Attachment.InlineData != nil {
+					data = string(*ba.Attachment.InlineData)
+				}
+				if data != tt.wantData[i] {
+					t.Errorf("[%d] data = %q, want %q", i, data, tt.wantData[i])
+				}
+				if string(ba.Preview) != tt.wantPreview[i] {
+					t.Errorf("[%d] Preview = %q, want %q", i, ba.Preview, tt.wantPreview[i])
+				}
+			}
+		})
+	}
+}
+
+func TestPreviewThumbnail(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 320, 240))); err != nil {
+		t.Fatal(err)
+	}
+	thumb, w, h := previewThumbnail(buf.Bytes())
+	if detectImageMIME(thumb) != "image/jpeg" || w != 320 || h != 240 {
+		t.Errorf("previewThumbnail() = %s %dx%d, want image/jpeg 320x240", detectImageMIME(thumb), w, h)
+	}
+	if thumb, _, _ := previewThumbnail([]byte("not an image")); thumb != nil {
+		t.Errorf("previewThumbnail(garbage) = %d bytes, want nil", len(thumb))
+	}
+}
+
+func TestPairLivePhotos(t *testing.T) {
+	att := func(name, mime, uti string, iris bool) bridgedAttachment {
+		return bridgedAttachment{Attachment: rustpushgo.WrappedAttachment{Filename: name, MimeType: mime, UtiType: uti, Iris: iris}}
+	}
+	heic := func(name string, iris bool) bridgedAttachment { return att(name, "image/heic", "public.heic", iris) }
+	mov := func(name string, iris bool) bridgedAttachment {
+		return att(name, "video/quicktime", "com.apple.quicktime-movie", iris)
+	}
+	tests := []struct {
+		name string
+		atts []bridgedAttachment
+		want map[int]int
+	}{
+		{"heic still and mov with iris flag", []bridgedAttachment{heic("IMG_1.HEIC", true), mov("IMG_1.MOV", true)}, map[int]int{1: 0}},
+		{"video listed first", []bridgedAttachment{mov("IMG_1.MOV", true), heic("IMG_1.HEIC", false)}, map[int]int{0: 1}},
+		{"jpeg still by UTI only", []bridgedAttachment{att("IMG_1.JPG", "", "public.jpeg", false), mov("img_1.mov", true)}, map[int]int{1: 0}},
+		{"live-photo-bundle UTI with mismatched names", []bridgedAttachment{att("still.heic", "image/heic", livePhotoBundleUTI, false), att("video.mov", "video/quicktime", livePhotoBundleUTI, false)}, map[int]int{1: 0}},
+		{"same name without live photo flags", []bridgedAttachment{heic("IMG_1.HEIC", false), mov("IMG_1.MOV", false)}, map[int]int{}},
+		{"unrelated photo and video", []bridgedAttachment{heic("IMG_1.HEIC", false), mov("IMG_9.MOV", false)}, map[int]int{}},
+		{
+			"two live photos in one message",
+			[]bridgedAttachment{heic("IMG_1.HEIC", true), heic("IMG_2.HEIC", true), mov("IMG_2.MOV", true), mov("IMG_1.MOV", true)},
+			map[int]int{2: 1, 3: 0},
+		},
+		{"ambiguous flagged leftovers stay unpaired", []bridgedAttachment{heic("a.heic", true), heic("b.heic", true), mov("c.mov", true)}, map[int]int{}},
+		{"mp4 is not a live photo video", []bridgedAttachment{heic("IMG_1.HEIC", true), att("IMG_1.mp4", "video/mp4", "public.mpeg-4", true)}, map[int]int{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := pairLivePhotos(tt.atts); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("pairLivePhotos() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMarkLivePhotoVideo(t *testing.T) {
+	cm := &bridgev2.ConvertedMessage{Parts: []*bridgev2.ConvertedMessagePart{{
+		Content: &event.MessageEventContent{MsgType: event.MsgVideo, Body: "IMG_1.mp4"},
+	}}}
+	markLivePhotoVideo(cm, "STILL-UUID")
+	content := cm.Parts[0].Content
+	if content.Body != "Live Photo" || content.FileName != "IMG_1.mp4" {
+		t.Errorf("markLivePhotoVideo() content body/filename = %q/%q, want Live Photo/IMG_1.mp4", content.Body, content.FileName)
+	}
+	if cm.ReplyTo == nil || cm.ReplyTo.MessageID != "STILL-UUID" {
+		t.Errorf("markLivePhotoVideo() ReplyTo = %+v, want STILL-UUID", cm.ReplyTo)
+	}
+
+	existing := &networkid.MessageOptionalPartID{MessageID: "QUOTED"}
+	cm = &bridgev2.ConvertedMessage{ReplyTo: existing, Parts: []*bridgev2.ConvertedMessagePart{{
+		Content: &event.MessageEventContent{MsgType: event.MsgVideo, Body: "IMG_1.mp4"},
+	}}}
+	markLivePhotoVideo(cm, "STILL-UUID")
+	if cm.ReplyTo != existing {
+		t.Errorf("markLivePhotoVideo() replaced an existing reply target with %+v", cm.ReplyTo)
+	}
+}
@@ -102,6 +102,13 @@ func (r *attachmentRetrier) attempt(ctx context.Context, row *pendingAttachmentR
 		Int("attempt", row.AttemptCount+1).
 		Logger()
 
+	// A failed Matrix upload kept the downloaded bytes; only the upload
+	// needs redoing.
+	if row.hasRetainedData() {
+		r.retryUpload(ctx, row)
+		return
+	}
+
 	// Stage 1: rustpush retry — reloads APS connection between tries and
 	// re-runs the Layer-1 3-attempt backoff inside download_one_mmcs_attachment.
 	data, err := r.downloadViaMMCS(ctx, row)
@@ -136,6 +143,28 @@ func (r *attachmentRetrier) attempt(ctx context.Context, row *pendingAttachmentR
 	log.Info().Int("bytes", len(data)).Msg("Attachment recovered via background retry")
 }
 
+// retryUpload re-delivers an attachment whose Matrix upload failed. The
+// upload happens inside the queued edit, after this tick has moved on, so
+// the row is rescheduled up front and only deleted by the edit once the
+// upload goes through. If this was the last allowed attempt, reschedule
+// drops the row and the edit is the final try.
+func (r *attachmentRetrier) retryUpload(ctx context.Context, row *pendingAttachmentRow) {
+	data, err := row.retainedData()
+	if err != nil || len(data) == 0 {
+		r.log.Warn().Err(err).Str("msg_guid", row.MessageGUID).Int("att_index", row.AttIndex).
+			Msg("Retained attachment is gone; dropping pending row")
+		_ = r.Client.pendingAttachments.Delete(ctx, row)
+		return
+	}
+	if err = r.deliverAsEdit(ctx, row, data); err != nil {
+		r.log.Err(err).Str("msg_guid", row.MessageGUID).Int("att_index", row.AttIndex).
+			Msg("Failed to deliver retained attachment")
+		r.reschedule(ctx, row, err)
+		return
+	}
+	r.reschedule(ctx, row, errors.New("upload not confirmed yet"))
+}
+
 // downloadViaMMCS re-invokes the Rust wrapper's manual MMCS download path
 // via retry_mmcs_from_descriptor. The call is wrapped in the same panic +
 // timeout guard as other FFI calls to keep a single rustpush panic from
@@ -144,6 +173,9 @@ func (r *attachmentRetrier) downloadViaMMCS(_ context.Context, row *pendingAttac
 	if r.Client.client == nil {
 		return nil, errors.New("rustpush client not ready")
 	}
+	if row.MmcsDescriptor == "" {
+		return nil, errors.New("no MMCS descriptor for attachment")
+	}
 	type res struct {
 		data []byte
 		err  error
@@ -214,6 +246,10 @@ func (r *attachmentRetrier) deliverAsEdit(ctx context.Context, row *pendingAttac
 	if err != nil {
 		return err
 	}
+	if notice == nil && row.hasRetainedData() && time.Since(row.CreatedAt) < failedUploadPlaceholderGrace {
+		// A backfilled placeholder may not have been sent yet.
+		return errors.New("placeholder not bridged yet")
+	}
 	if notice == nil {
 		r.log.Warn().
 			Str("msg_guid", row.MessageGUID).
@@ -249,6 +285,7 @@ func (r *attachmentRetrier) deliverAsEdit(ctx context.Context, row *pendingAttac
 	videoTranscoding := r.Client.videoTranscoding()
 	heicConversion := r.Client.heicConversion()
 	heicQuality := r.Client.Main.Config.HEICJPEGQuality
+	hideMediaFilenames := r.Client.Main.Config.HideMediaFilenames
 
 	sender := r.Client.canonicalizeDMSender(portalKey, r.Client.makeEventSender(&senderCopy))
 	ts := time.UnixMilli(row.TimestampMs)
@@ -277,10 +314,17 @@ func (r *attachmentRetrier) deliverAsEdit(ctx context.Context, row *pendingAttac
 			strconv.FormatInt(time.Now().UnixMilli(), 10)),
 		TargetMessage: makeMessageID(row.AttID),
 		ConvertEditFunc: func(ctx context.Context, portal *bridgev2.Portal, intent bridgev2.MatrixAPI, existing []*database.Message, attMsg *attachmentMessage) (*bridgev2.ConvertedEdit, error) {
-			cm, err := convertAttachment(ctx, portal, intent, attMsg, videoTranscoding, heicConversion, heicQuality)
+			cm, err := convertAttachment(ctx, portal, intent, attMsg, videoTranscoding, heicConversion, heicQuality, hideMediaFilenames)
 			if err != nil {
 				return nil, err
 			}
+			if row.hasRetainedData() {
+				// Retained bytes from a failed upload: this edit was the
+				// retry, and the upload went through.
+				if delErr := r.Client.pendingAttachments.Delete(ctx, row); delErr != nil {
+					zerolog.Ctx(ctx).Warn().Err(delErr).Msg("Failed to delete pending row after upload retry")
+				}
+			}
 			if cm == nil || len(cm.Parts) == 0 {
 				return nil, errors.New("convertAttachment returned no parts")
 			}
@@ -292,6 +336,13 @@ func (r *attachmentRetrier) deliverAsEdit(ctx context.Context, row *pendingAttac
 			if target == nil && len(existing) > 0 {
 				target = existing[0]
 			}
+			// A deferred attachment (attachment_download_rules) is no longer
+			// waiting once its placeholder is replaced.
+			if target != nil {
+				if meta, ok := target.Metadata.(*MessageMetadata); ok {
+					meta.DeferredAttachment = nil
+				}
+			}
 			main := cm.Parts[len(cm.Parts)-1]
 			return &bridgev2.ConvertedEdit{
 				ModifiedParts: []*bridgev2.ConvertedEditPart{{
@@ -309,7 +360,7 @@ func (r *attachmentRetrier) deliverAsEdit(ctx context.Context, row *pendingAttac
 func (r *attachmentRetrier) reschedule(ctx context.Context, row *pendingAttachmentRow, cause error) {
 	row.AttemptCount++
 	row.LastAttemptAt = time.Now()
-	if row.AttemptCount >= attachmentRetrierMaxAttempts || time.Since(row.CreatedAt) > attachmentRetrierMaxLifetime {
+	if row.AttemptCount >= row.maxAttempts() || time.Since(row.CreatedAt) > attachmentRetrierMaxLifetime {
 		r.log.Warn().Err(cause).
 			Str("msg_guid", row.MessageGUID).
 			Int("att_index", row.AttIndex).
@@ -371,6 +422,18 @@ func makeAttID(uuid string, index int, hasText bool) string {
 	return fmt.Sprintf("%s_att%d", uuid, index)
 }
 
+// wrappedMessageHasText reports whether handleMessage bridges a text part
+// for msg: non-empty text once attachment placeholders are stripped, or a
+// subject line on its own (bridged as a notice by subjectMessageContent).
+// This is the hasText that makeAttID is given for live messages.
+func wrappedMessageHasText(msg *rustpushgo.WrappedMessage) bool {
+	if msg == nil {
+		return false
+	}
+	return (msg.Text != nil && strings.TrimRight(*msg.Text, "\ufffc \n") != "") ||
+		(msg.Subject != nil && strings.TrimSpace(*msg.Subject) != "")
+}
+
 // enqueuePendingMMCSRecovery persists an entry in pending_attachment_retry
 // for a MMCS attachment whose push-time download exhausted the Layer-1
 // retries. Called from the ConvertMessageFunc closure that wraps
@@ -386,9 +449,7 @@ func (c *IMClient) enqueuePendingMMCSRecovery(ctx context.Context, portal *bridg
 		return
 	}
 
-	hasText := attMsg.WrappedMessage != nil && attMsg.WrappedMessage.Text != nil &&
-		strings.TrimRight(*attMsg.WrappedMessage.Text, "\ufffc \n") != ""
-	attID := makeAttID(attMsg.Uuid, attMsg.Index, hasText)
+	attID := makeAttID(attMsg.Uuid, attMsg.Index, wrappedMessageHasText(attMsg.WrappedMessage))
 
 	sender := ""
 	if attMsg.WrappedMessage != nil && attMsg.WrappedMessage.Sender != nil {
@@ -418,21 +479,7 @@ func (c *IMClient) enqueuePendingMMCSRecovery(ctx context.Context, portal *bridg
 		AttemptCount:   0,
 		NextAttemptAt:  now.Add(attachmentRetrierBackoff(1)),
 	}
-	// Bounded retry on transient DB failures (SQLITE_BUSY, locked). A failed
-	// Insert means the notice placeholder ships but nothing will ever edit it
-	// into the real attachment, so make a best effort before giving up.
-	var insertErr error
-	for attempt := 1; attempt <= 3; attempt++ {
-		insertErr = c.pendingAttachments.Insert(ctx, row)
-		if insertErr == nil {
-			break
-		}
-		if ctx.Err() != nil {
-			break
-		}
-		time.Sleep(time.Duration(attempt) * 100 * time.Millisecond)
-	}
-	if insertErr != nil {
+	if insertErr := c.insertPendingAttachment(ctx, row); insertErr != nil {
 		zerolog.Ctx(ctx).Err(insertErr).
 			Str("msg_guid", attMsg.Uuid).
 			Int("att_index", attMsg.Index).
@@ -448,6 +495,22 @@ func (c *IMClient) enqueuePendingMMCSRecovery(ctx context.Context, portal *bridg
 		Msg("Enqueued MMCS attachment for background retry")
 }
 
+// insertPendingAttachment inserts row into pending_attachment_retry with a
+// bounded retry on transient DB failures (SQLITE_BUSY, locked). A failed
+// Insert means the notice placeholder ships but nothing will ever edit it
+// into the real attachment, so make a best effort before giving up.
+func (c *IMClient) insertPendingAttachment(ctx context.Context, row *pendingAttachmentRow) error {
+	var err error
+	for attempt := 1; attempt <= 3; attempt++ {
+		err = c.pendingAttachments.Insert(ctx, row)
+		if err == nil || ctx.Err() != nil {
+			break
+		}
+		time.Sleep(time.Duration(attempt) * 100 * time.Millisecond)
+	}
+	return err
+}
+
 // errorFromRecovered formats a recovered panic into an error without pulling
 // in the full debug stack — which is already logged by safeCloudDownloadAttachment
 // for the CloudKit-side panics.
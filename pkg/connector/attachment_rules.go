@@ -0,0 +1,212 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2024 Ludvig Rhodin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+package connector
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/commands"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// Deferred attachments (attachment_download_rules).
+//
+// Live MMCS attachments that the rules don't auto-download are bridged as a
+// notice placeholder carrying the MMCS descriptor in its MessageMetadata.
+// The `download` command fetches the file through the same
+// RetryMmcsFromDescriptor path the attachment retrier uses and edits the
+// placeholder into the real attachment with attachmentRetrier.deliverAsEdit.
+// Note that rustpush has already fetched the bytes from Apple by the time
+// the connector sees the message; the rules bound what gets uploaded to the
+// homeserver and pushed to Matrix clients, not the bridge host's own traffic.
+
+// mimePatternMatches reports whether mimeType matches an
+// attachment_download_rules pattern: "*", "type/*" or an exact type.
+func mimePatternMatches(pattern, mimeType string) bool {
+	pattern = strings.ToLower(strings.TrimSpace(pattern))
+	mimeType = strings.ToLower(mimeType)
+	if pattern == "*" {
+		return true
+	}
+	if prefix, ok := strings.CutSuffix(pattern, "/*"); ok {
+		return strings.HasPrefix(mimeType, prefix+"/")
+	}
+	return pattern == mimeType
+}
+
+// attachmentAutoDownload evaluates the rules for one attachment. The first
+// rule matching mimeType decides; no match means download.
+func attachmentAutoDownload(rules []AttachmentDownloadRule, mimeType string, size int64) bool {
+	for _, rule := range rules {
+		if !mimePatternMatches(rule.Mime, mimeType) {
+			continue
+		}
+		if rule.Never {
+			return false
+		}
+		return rule.MaxSizeMB <= 0 || size <= int64(rule.MaxSizeMB)*1024*1024
+	}
+	return true
+}
+
+// formatAttachmentSize renders a byte count for placeholder notices.
+func formatAttachmentSize(size int64) string {
+	switch {
+	case size >= 1024*1024:
+		return fmt.Sprintf("%.1f MB", float64(size)/(1024*1024))
+	case size >= 1024:
+		return fmt.Sprintf("%.0f KB", float64(size)/1024)
+	default:
+		return fmt.Sprintf("%d bytes", size)
+	}
+}
+
+// attachmentExpires reports whether attMsg is an attachment the sender's
+// devices delete on their own: an audio message, which expires two minutes
+// after it's played unless it's kept. Once it's gone from the sender it's
+// gone from CloudKit too, so a later download or retry would find nothing.
+func attachmentExpires(attMsg *attachmentMessage) bool {
+	return attMsg.WrappedMessage != nil && attMsg.IsVoice
+}
+
+// deferAttachment returns the placeholder to bridge instead of attMsg when
+// the download rules skip it, or nil to bridge it normally. Only MMCS
+// attachments can be deferred: the descriptor is what lets the download
+// command fetch them again. Expiring attachments are never deferred, since
+// the descriptor may no longer work by the time someone asks.
+func (c *IMClient) deferAttachment(attMsg *attachmentMessage) *bridgev2.ConvertedMessage {
+	att := attMsg.Attachment
+	if att == nil || att.MmcsDescriptorJson == nil || *att.MmcsDescriptorJson == "" {
+		return nil
+	}
+	if attachmentExpires(attMsg) {
+		return nil
+	}
+	size := int64(att.Size)
+	if attachmentAutoDownload(c.Main.Config.AttachmentDownloadRules, att.MimeType, size) {
+		return nil
+	}
+	deferred := &DeferredAttachment{
+		MessageGUID:    attMsg.Uuid,
+		AttIndex:       attMsg.Index,
+		Filename:       att.Filename,
+		MimeType:       att.MimeType,
+		UtiType:        att.UtiType,
+		SizeBytes:      size,
+		MmcsDescriptor: *att.MmcsDescriptorJson,
+	}
+	if attMsg.WrappedMessage != nil {
+		deferred.TimestampMs = int64(attMsg.TimestampMs)
+		if attMsg.Sender != nil {
+			deferred.Sender = *attMsg.Sender
+		}
+	}
+	return &bridgev2.ConvertedMessage{
+		ReplyTo: wrappedReplyTarget(attMsg.WrappedMessage),
+		Parts: []*bridgev2.ConvertedMessagePart{{
+			ID:   networkid.PartID(attachmentPartID(attMsg.Index)),
+			Type: event.EventMessage,
+			Content: &event.MessageEventContent{
+				MsgType: event.MsgNotice,
+				Body: fmt.Sprintf("Attachment not downloaded: %s (%s). Reply to this message with the `download` command to fetch it.",
+					att.Filename, formatAttachmentSize(size)),
+			},
+			DBMetadata: &MessageMetadata{HasAttachments: true, DeferredAttachment: deferred},
+		}},
+	}
+}
+
+var cmdDownload = &commands.FullHandler{
+	Name: "download",
+	Func: fnDownload,
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionChats,
+		Description: "Fetch an attachment that wasn't downloaded automatically. Reply to its placeholder, or pass the placeholder's event ID.",
+		Args:        "[<event ID>]",
+	},
+	RequiresLogin:  true,
+	RequiresPortal: true,
+}
+
+func fnDownload(ce *commands.Event) {
+	login := ce.User.GetDefaultLogin()
+	if login == nil {
+		ce.Reply("Not logged in.")
+		return
+	}
+	client, ok := login.Client.(*IMClient)
+	if !ok || client == nil {
+		ce.Reply("Bridge client not available.")
+		return
+	}
+	target := ce.ReplyTo
+	if len(ce.Args) > 0 {
+		target = id.EventID(ce.Args[0])
+	}
+	if target == "" {
+		ce.Reply("Reply to an attachment placeholder with `$cmdprefix download`, or pass its event ID.")
+		return
+	}
+	part, err := ce.Bridge.DB.Message.GetPartByMXID(ce.Ctx, target)
+	if err != nil {
+		ce.Reply("Failed to look up that message: %v", err)
+		return
+	}
+	var deferred *DeferredAttachment
+	if part != nil && part.Room == ce.Portal.PortalKey {
+		if meta, ok := part.Metadata.(*MessageMetadata); ok {
+			deferred = meta.DeferredAttachment
+		}
+	}
+	if deferred == nil {
+		ce.Reply("That message isn't an attachment waiting to be downloaded.")
+		return
+	}
+
+	row := &pendingAttachmentRow{
+		LoginID:        client.UserLogin.ID,
+		MessageGUID:    deferred.MessageGUID,
+		AttIndex:       deferred.AttIndex,
+		AttID:          string(part.ID),
+		PortalID:       string(ce.Portal.ID),
+		Sender:         deferred.Sender,
+		TimestampMs:    deferred.TimestampMs,
+		Filename:       deferred.Filename,
+		MimeType:       deferred.MimeType,
+		UtiType:        deferred.UtiType,
+		SizeBytes:      deferred.SizeBytes,
+		MmcsDescriptor: deferred.MmcsDescriptor,
+		CreatedAt:      time.Now(),
+	}
+	retrier := &attachmentRetrier{Client: client, log: ce.Log.With().Str("component", "attachment_download").Logger()}
+	ce.Reply("Downloading %s (%s)…", deferred.Filename, formatAttachmentSize(deferred.SizeBytes))
+	data, err := retrier.downloadViaMMCS(ce.Ctx, row)
+	if err == nil && len(data) == 0 {
+		err = errors.New("download returned empty bytes")
+	}
+	if err != nil {
+		// The MMCS URL may have expired; CloudKit may have the record.
+		var ckErr error
+		if data, ckErr = retrier.downloadViaCloudKit(ce.Ctx, row); ckErr != nil {
+			ce.Reply("Failed to download %s: %v", deferred.Filename, errors.Join(err, ckErr))
+			return
+		}
+	}
+	if err = retrier.deliverAsEdit(ce.Ctx, row, data); err != nil {
+		ce.Reply("Failed to bridge %s: %v", deferred.Filename, err)
+		return
+	}
+	ce.React("✅")
+}
@@ -0,0 +1,129 @@
+package connector
+
+import (
+	"testing"
+
+	"github.com/lrhodin/imessage/pkg/rustpushgo"
+)
+
+func TestAttachmentAutoDownload(t *testing.T) {
+	const mb = 1024 * 1024
+	rules := []AttachmentDownloadRule{
+		{Mime: "image/*"},
+		{Mime: "video/*", MaxSizeMB: 25},
+		{Mime: "Application/ZIP", Never: true},
+		{Mime: "application/*", MaxSizeMB: 5},
+	}
+	tests := []struct {
+		name  string
+		rules []AttachmentDownloadRule
+		mime  string
+		size  int64
+		want  bool
+	}{
+		{"image of any size", rules, "image/jpeg", 500 * mb, true},
+		{"small video", rules, "video/quicktime", 10 * mb, true},
+		{"video at the limit", rules, "video/mp4", 25 * mb, true},
+		{"large video", rules, "video/mp4", 25*mb + 1, false},
+		{"never mime, case-insensitive", rules, "application/zip", 1, false},
+		{"first matching rule wins", rules, "application/pdf", 6 * mb, false},
+		{"small pdf", rules, "application/pdf", 1 * mb, true},
+		{"no matching rule", rules, "audio/x-caf", 900 * mb, true},
+		{"no rules", nil, "video/mp4", 900 * mb, true},
+		{"catch-all never", []AttachmentDownloadRule{{Mime: "image/*"}, {Mime: "*", Never: true}}, "text/vcard", 10, false},
+		{"type wildcard doesn't match prefix", []AttachmentDownloadRule{{Mime: "video/*", Never: true}}, "videox/mp4", 10, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := attachmentAutoDownload(tt.rules, tt.mime, tt.size); got != tt.want {
+				t.Errorf("attachmentAutoDownload(%q, %d) = %v, want %v", tt.mime, tt.size, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeferAttachment(t *testing.T) {
+	c := &IMClient{Main: &IMConnector{Config: IMConfig{
+		AttachmentDownloadRules: []AttachmentDownloadRule{{Mime: "video/*", MaxSizeMB: 1}},
+	}}}
+	descriptor := `{"url":"https://example.com"}`
+	sender := "tel:+15551234567"
+	newAttMsg := func(mime string, size uint64, mmcs bool) *attachmentMessage {
+		att := &rustpushgo.WrappedAttachment{MimeType: mime, Filename: "clip.mov", Size: size}
+		if mmcs {
+			att.MmcsDescriptorJson = &descriptor
+		}
+		return &attachmentMessage{
+			WrappedMessage: &rustpushgo.WrappedMessage{Uuid: "MSG-GUID", Sender: &sender, TimestampMs: 1700000000000},
+			Attachment:     att,
+			Index:          1,
+		}
+	}
+
+	if cm := c.deferAttachment(newAttMsg("video/quicktime", 512*1024, true)); cm != nil {
+		t.Errorf("deferAttachment() for a video under the limit = %+v, want nil", cm)
+	}
+	if cm := c.deferAttachment(newAttMsg("video/quicktime", 5*1024*1024, false)); cm != nil {
+		t.Errorf("deferAttachment() for an inline attachment = %+v, want nil", cm)
+	}
+
+	// Audio messages expire on the sender's devices, so they're bridged
+	// right away whatever the rules say.
+	voiceRules := &IMClient{Main: &IMConnector{Config: IMConfig{
+		AttachmentDownloadRules: []AttachmentDownloadRule{{Mime: "audio/*", Never: true}},
+	}}}
+	voice := newAttMsg("audio/x-caf", 40*1024, true)
+	if cm := voiceRules.deferAttachment(voice); cm == nil {
+		t.Errorf("deferAttachment() for a non-voice audio attachment = nil, want a placeholder")
+	}
+	voice.IsVoice = true
+	if cm := voiceRules.deferAttachment(voice); cm != nil {
+		t.Errorf("deferAttachment() for an expiring audio message = %+v, want nil", cm)
+	}
+
+	cm := c.deferAttachment(newAttMsg("video/quicktime", 5*1024*1024, true))
+	if cm == nil || len(cm.Parts) != 1 {
+		t.Fatalf("deferAttachment() for a large video = %+v, want one placeholder part", cm)
+	}
+	part := cm.Parts[0]
+	if part.ID != "att1" {
+		t.Errorf("placeholder part ID = %q, want att1", part.ID)
+	}
+	meta, ok := part.DBMetadata.(*MessageMetadata)
+	if !ok || meta.DeferredAttachment == nil {
+		t.Fatalf("placeholder metadata = %+v, want a DeferredAttachment", part.DBMetadata)
+	}
+	want := DeferredAttachment{
+		MessageGUID:    "MSG-GUID",
+		AttIndex:       1,
+		Sender:         sender,
+		TimestampMs:    1700000000000,
+		Filename:       "clip.mov",
+		MimeType:       "video/quicktime",
+		SizeBytes:      5 * 1024 * 1024,
+		MmcsDescriptor: descriptor,
+	}
+	if *meta.DeferredAttachment != want {
+		t.Errorf("DeferredAttachment = %+v, want %+v", *meta.DeferredAttachment, want)
+	}
+}
+
+func TestAttachmentExpires(t *testing.T) {
+	att := &rustpushgo.WrappedAttachment{MimeType: "audio/x-caf", Filename: "Audio Message.caf"}
+	tests := []struct {
+		name string
+		msg  *attachmentMessage
+		want bool
+	}{
+		{"audio message", &attachmentMessage{WrappedMessage: &rustpushgo.WrappedMessage{IsVoice: true}, Attachment: att}, true},
+		{"audio file", &attachmentMessage{WrappedMessage: &rustpushgo.WrappedMessage{}, Attachment: att}, false},
+		{"no message", &attachmentMessage{Attachment: att}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := attachmentExpires(tt.msg); got != tt.want {
+				t.Errorf("attachmentExpires() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,168 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2024 Ludvig Rhodin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+package connector
+
+// Transport-aware attachment sends (attachment_transport_retry,
+// mms_image_max_kb).
+//
+// iMessage and MMS fail attachments for different reasons: iMessage on
+// MMCS uploads and its own limits, MMS on carrier size limits and the
+// iPhone relay. An attachment that fails one way can often go the other,
+// so with attachment_transport_retry a failed DM attachment is resent once
+// over the other transport, without switching the chat. Images going out
+// as MMS are shrunk under mms_image_max_kb first, since carriers reject
+// anything over their limit.
+//
+// Flow:
+//   handleMatrixFile send fails (after sms_fallback had its go)
+//   → sent as iMessage, SMS relay available: resend as MMS
+//   → sent as MMS, contact reachable on iMessage: resend as iMessage
+//   → otherwise, or for groups: the original error
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"path/filepath"
+	"strings"
+
+	"github.com/rs/zerolog"
+	"golang.org/x/image/draw"
+	"maunium.net/go/mautrix/bridgev2"
+
+	"github.com/lrhodin/imessage/pkg/rustpushgo"
+)
+
+// attachmentRetryAction is what to do after an attachment send failed.
+type attachmentRetryAction int
+
+const (
+	// attachmentRetryNone: return the error as-is.
+	attachmentRetryNone attachmentRetryAction = iota
+	// attachmentRetrySMS: resend as MMS through the SMS relay.
+	attachmentRetrySMS
+	// attachmentRetryIMessage: resend over iMessage.
+	attachmentRetryIMessage
+)
+
+// isTransportIndependentSendError reports whether a send failed for a reason
+// that sending over the other transport wouldn't fix, or already failed
+// over both (sms_fallback).
+func isTransportIndependentSendError(err error) bool {
+	return isNoValidTargetsError(err) ||
+		errors.Is(err, errSMSFallbackFailed) ||
+		errors.Is(err, bridgev2.ErrNotLoggedIn) ||
+		errors.Is(err, context.Canceled) ||
+		isNonRetryableResourceClosed(err) ||
+		classifyCredentialFailure(err) != credentialFailureNone
+}
+
+// decideAttachmentRetry picks the retry for an attachment that failed to
+// send with err. Only DMs are retried: switching a group's transport would
+// split it into another conversation on the recipients' phones. NoValidTargets
+// is sms_fallback's to handle.
+func decideAttachmentRetry(err error, sentAsSMS, isGroup, optIn, relayAvailable, iMessageReachable bool) attachmentRetryAction {
+	if err == nil || !optIn || isGroup || isTransportIndependentSendError(err) {
+		return attachmentRetryNone
+	}
+	if sentAsSMS {
+		if iMessageReachable {
+			return attachmentRetryIMessage
+		}
+	} else if relayAvailable {
+		return attachmentRetrySMS
+	}
+	return attachmentRetryNone
+}
+
+// retryAttachmentTransport resends a failed attachment over the other
+// transport if decideAttachmentRetry allows it. On success conv is updated
+// to the transport that worked, so a caption follows the attachment.
+func (c *IMClient) retryAttachmentTransport(ctx context.Context, portal *bridgev2.Portal, conv *rustpushgo.WrappedConversation, sendErr error, send func(rustpushgo.WrappedConversation) (string, error)) (string, error) {
+	if !c.Main.Config.AttachmentTransportRetry {
+		return "", sendErr
+	}
+	portalID := string(portal.ID)
+	isGroup := conv.SenderGuid != nil || strings.HasPrefix(portalID, "gid:") || strings.Contains(portalID, ",")
+	var reachable bool
+	if conv.IsSms && !isGroup && len(conv.Participants) > 0 {
+		reachable, _ = c.cachedReachability(conv.Participants[len(conv.Participants)-1], c.portalHandle(portal))
+	}
+	action := decideAttachmentRetry(sendErr, conv.IsSms, isGroup, true, c.smsRelayAvailable(), reachable)
+	if action == attachmentRetryNone {
+		return "", sendErr
+	}
+	retryConv := *conv
+	retryConv.IsSms = action == attachmentRetrySMS
+	transport := "iMessage"
+	if retryConv.IsSms {
+		transport = "MMS"
+	}
+	log := zerolog.Ctx(ctx)
+	log.Info().Err(sendErr).Str("portal_id", portalID).Str("transport", transport).
+		Msg("Attachment send failed, retrying over the other transport")
+	uuid, err := send(retryConv)
+	if err != nil {
+		return "", fmt.Errorf("%w (retry as %s also failed: %v)", sendErr, transport, err)
+	}
+	*conv = retryConv
+	return uuid, nil
+}
+
+// fitImageForMMS shrinks an image over maxBytes into a JPEG that fits,
+// scaling it down step by step. Anything else, GIFs (whose animation
+// re-encoding would drop) and images already small enough are returned as
+// they are. If no step fits, the smallest one is returned.
+func fitImageForMMS(data []byte, mimeType, fileName string, maxBytes int) ([]byte, string, string) {
+	if maxBytes <= 0 || len(data) <= maxBytes || !looksLikeImage(data) ||
+		mimeType == "image/gif" || bytes.HasPrefix(data, []byte("GIF8")) {
+		return data, mimeType, fileName
+	}
+	img, _, _ := decodeImageData(data)
+	if img == nil {
+		return data, mimeType, fileName
+	}
+	var best []byte
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	for attempt := 0; attempt < 8 && width > 0 && height > 0; attempt++ {
+		scaled := img
+		if attempt > 0 {
+			dst := image.NewRGBA(image.Rect(0, 0, width, height))
+			draw.CatmullRom.Scale(dst, dst.Bounds(), img, img.Bounds(), draw.Src, nil)
+			scaled = dst
+		}
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, scaled, &jpeg.Options{Quality: 80}); err != nil {
+			break
+		}
+		if best == nil || buf.Len() < len(best) {
+			best = buf.Bytes()
+		}
+		if buf.Len() <= maxBytes {
+			break
+		}
+		width, height = width*3/4, height*3/4
+	}
+	if best == nil || len(best) >= len(data) {
+		return data, mimeType, fileName
+	}
+	return best, "image/jpeg", strings.TrimSuffix(fileName, filepath.Ext(fileName)) + ".jpg"
+}
+
+// mmsImageMaxBytes returns the MMS image size limit, or zero when images
+// aren't shrunk.
+func (c *IMClient) mmsImageMaxBytes() int {
+	if c.Main.Config.MMSImageMaxKB <= 0 {
+		return 0
+	}
+	return c.Main.Config.MMSImageMaxKB * 1024
+}
@@ -0,0 +1,153 @@
+package connector
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+
+	"github.com/lrhodin/imessage/pkg/rustpushgo"
+)
+
+func TestDecideAttachmentRetry(t *testing.T) {
+	uploadErr := errors.New("MMCS upload failed")
+	tests := []struct {
+		name              string
+		err               error
+		sentAsSMS         bool
+		isGroup           bool
+		optIn             bool
+		relayAvailable    bool
+		iMessageReachable bool
+		want              attachmentRetryAction
+	}{
+		{"iMessage failure, relay", uploadErr, false, false, true, true, false, attachmentRetrySMS},
+		{"iMessage failure, no relay", uploadErr, false, false, true, false, false, attachmentRetryNone},
+		{"MMS failure, reachable", errors.New("MMS too big for carrier"), true, false, true, true, true, attachmentRetryIMessage},
+		{"MMS failure, not reachable", uploadErr, true, false, true, true, false, attachmentRetryNone},
+		{"not opted in", uploadErr, false, false, false, true, true, attachmentRetryNone},
+		{"group", uploadErr, false, true, true, true, true, attachmentRetryNone},
+		{"no valid targets", errors.New("NoValidTargets"), false, false, true, true, false, attachmentRetryNone},
+		{"sms fallback already failed", fmt.Errorf("%w: %w", errSMSFallbackFailed, uploadErr), false, false, true, true, false, attachmentRetryNone},
+		{"not logged in", bridgev2.ErrNotLoggedIn, false, false, true, true, false, attachmentRetryNone},
+		{"keystore lost", errors.New("Keystore error Key not found"), false, false, true, true, false, attachmentRetryNone},
+		{"no error", nil, false, false, true, true, true, attachmentRetryNone},
+	}
+	for _, tt := range tests {
+		got := decideAttachmentRetry(tt.err, tt.sentAsSMS, tt.isGroup, tt.optIn, tt.relayAvailable, tt.iMessageReachable)
+		if got != tt.want {
+			t.Errorf("decideAttachmentRetry(%s) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRetryAttachmentTransport(t *testing.T) {
+	const target = "tel:+15551234567"
+	newClient := func(optIn, relay bool) *IMClient {
+		c := &IMClient{
+			Main:      &IMConnector{Config: IMConfig{AttachmentTransportRetry: optIn}},
+			UserLogin: &bridgev2.UserLogin{Log: zerolog.Nop()},
+		}
+		c.smsRelayEnabled.Store(relay)
+		c.reachability.set(target, true, time.Now())
+		return c
+	}
+	portal := &bridgev2.Portal{Portal: &database.Portal{PortalKey: networkid.PortalKey{ID: target}}}
+	sendErr := errors.New("MMCS upload failed")
+
+	tests := []struct {
+		name      string
+		optIn     bool
+		relay     bool
+		isSms     bool
+		retryErr  error
+		wantSends []bool
+		wantSms   bool
+		wantErr   bool
+	}{
+		{"iMessage to MMS", true, true, false, nil, []bool{true}, true, false},
+		{"MMS to iMessage", true, false, true, nil, []bool{false}, false, false},
+		{"retry fails too", true, true, false, errors.New("relay offline"), []bool{true}, false, true},
+		{"off", false, true, false, nil, nil, false, true},
+	}
+	for _, tt := range tests {
+		c := newClient(tt.optIn, tt.relay)
+		conv := rustpushgo.WrappedConversation{Participants: []string{"tel:+15550000000", target}, IsSms: tt.isSms}
+		var sends []bool
+		send := func(conv rustpushgo.WrappedConversation) (string, error) {
+			sends = append(sends, conv.IsSms)
+			return "RETRY-UUID", tt.retryErr
+		}
+		uuid, err := c.retryAttachmentTransport(context.Background(), portal, &conv, sendErr, send)
+		if fmt.Sprint(sends) != fmt.Sprint(tt.wantSends) {
+			t.Errorf("retryAttachmentTransport(%s) sent with IsSms %v, want %v", tt.name, sends, tt.wantSends)
+		}
+		if (err != nil) != tt.wantErr || (err == nil && uuid != "RETRY-UUID") {
+			t.Errorf("retryAttachmentTransport(%s) = %q, %v, want error %v", tt.name, uuid, err, tt.wantErr)
+		}
+		if err != nil && !errors.Is(err, sendErr) {
+			t.Errorf("retryAttachmentTransport(%s) error = %v, want it to wrap the original error", tt.name, err)
+		}
+		if !tt.wantErr && conv.IsSms != tt.wantSms {
+			t.Errorf("retryAttachmentTransport(%s) left conv.IsSms = %v, want %v", tt.name, conv.IsSms, tt.wantSms)
+		}
+	}
+}
+
+func TestFitImageForMMS(t *testing.T) {
+	// Noise doesn't compress, so the PNG is large.
+	img := image.NewRGBA(image.Rect(0, 0, 600, 400))
+	seed := uint32(1)
+	for i := range img.Pix {
+		seed = seed*1664525 + 1013904223
+		img.Pix[i] = uint8(seed >> 24)
+	}
+	var pngBuf bytes.Buffer
+	if err := png.Encode(&pngBuf, img); err != nil {
+		t.Fatalf("png.Encode() error = %v", err)
+	}
+	large := pngBuf.Bytes()
+	const maxBytes = 60 * 1024
+
+	data, mimeType, fileName := fitImageForMMS(large, "image/png", "photo.png", maxBytes)
+	if len(data) > maxBytes || mimeType != "image/jpeg" || fileName != "photo.jpg" {
+		t.Errorf("fitImageForMMS(large) = %d bytes, %q, %q, want at most %d bytes of image/jpeg photo.jpg", len(data), mimeType, fileName, maxBytes)
+	}
+	if _, format, err := image.Decode(bytes.NewReader(data)); err != nil || format != "jpeg" {
+		t.Errorf("fitImageForMMS(large) decodes as %q, %v, want jpeg", format, err)
+	}
+
+	var gifBuf bytes.Buffer
+	pal := image.NewPaletted(image.Rect(0, 0, 4, 4), color.Palette{color.Black, color.White})
+	if err := gif.Encode(&gifBuf, pal, nil); err != nil {
+		t.Fatalf("gif.Encode() error = %v", err)
+	}
+	unchanged := []struct {
+		name     string
+		data     []byte
+		mimeType string
+		maxBytes int
+	}{
+		{"under the limit", large, "image/png", len(large)},
+		{"disabled", large, "image/png", 0},
+		{"gif", gifBuf.Bytes(), "image/gif", 1},
+		{"not an image", bytes.Repeat([]byte("x"), 1000), "application/pdf", 10},
+	}
+	for _, tt := range unchanged {
+		data, mimeType, _ := fitImageForMMS(tt.data, tt.mimeType, "file", tt.maxBytes)
+		if !bytes.Equal(data, tt.data) || mimeType != tt.mimeType {
+			t.Errorf("fitImageForMMS(%s) changed the file to %d bytes of %q", tt.name, len(data), mimeType)
+		}
+	}
+}
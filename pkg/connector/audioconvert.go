@@ -422,35 +422,78 @@ type oggOpusInfo struct {
 }
 
 func parseOGGOpus(data []byte) (*oggOpusInfo, error) {
-	packets, granule, err := readOGGPackets(data)
+	streams, err := readOGGPackets(data)
 	if err != nil {
 		return nil, err
 	}
-	if len(packets) < 3 {
-		return nil, fmt.Errorf("OGG stream too short: %d packets", len(packets))
+	if len(streams) == 0 || len(streams[0].Packets) < 3 {
+		n := 0
+		if len(streams) > 0 {
+			n = len(streams[0].Packets)
+		}
+		return nil, fmt.Errorf("OGG stream too short: %d packets", n)
 	}
 
-	head := packets[0]
+	first := streams[0]
+	head := first.Packets[0]
 	if len(head) < 19 || string(head[:8]) != "OpusHead" {
 		return nil, fmt.Errorf("not an OGG Opus stream")
 	}
-
-	return &oggOpusInfo{
+	info := &oggOpusInfo{
 		Channels:   int(head[9]),
 		PreSkip:    int(binary.LittleEndian.Uint16(head[10:12])),
 		OpusHead:   head,
-		Packets:    packets[2:], // skip OpusHead + OpusTags
-		GranulePos: granule,
-	}, nil
+		Packets:    first.Packets[2:], // skip OpusHead + OpusTags
+		GranulePos: first.Granule,
+	}
+
+	// Chained links (a new BOS after the first stream ended) are appended as
+	// one continuous stream. Each link's granule restarts at zero and
+	// counts its own pre-skip, so only the audible part of later links is
+	// added to the total. A link with a different channel count can't share
+	// the first link's CAF description and ends the chain.
+	for _, link := range streams[1:] {
+		if len(link.Packets) < 2 {
+			continue
+		}
+		linkHead := link.Packets[0]
+		if len(linkHead) < 19 || string(linkHead[:8]) != "OpusHead" || int(linkHead[9]) != info.Channels {
+			break
+		}
+		linkPreSkip := int64(binary.LittleEndian.Uint16(linkHead[10:12]))
+		info.Packets = append(info.Packets, link.Packets[2:]...)
+		if link.Granule > linkPreSkip {
+			info.GranulePos += link.Granule - linkPreSkip
+		}
+	}
+	return info, nil
+}
+
+// oggLogicalStream is one logical bitstream of an OGG file, identified by
+// its serial number.
+type oggLogicalStream struct {
+	Serial  uint32
+	Packets [][]byte
+	Granule int64 // granule position from the stream's last page
 }
 
-// readOGGPackets reads all OGG pages and assembles complete packets.
-// Returns the packets and the granule position from the last page.
-func readOGGPackets(data []byte) ([][]byte, int64, error) {
+const (
+	oggFlagContinued = 0x01
+	oggFlagBOS       = 0x02
+)
+
+// readOGGPackets reads all OGG pages and assembles complete packets per
+// logical stream, in the order the streams begin. Chained files (several
+// voice notes concatenated, each starting with its own BOS page) come back
+// as separate streams instead of one run of packets with headers in the
+// middle. Packet assembly is per serial and restarts at each BOS page, so a
+// packet left unfinished at a stream boundary is dropped rather than glued
+// onto the next stream's first packet.
+func readOGGPackets(data []byte) ([]oggLogicalStream, error) {
 	r := bytes.NewReader(data)
-	var packets [][]byte
-	var current []byte
-	var lastGranule int64
+	var streams []*oggLogicalStream
+	bySerial := make(map[uint32]*oggLogicalStream)
+	partial := make(map[uint32][]byte)
 
 	for {
 		// Sync: read "OggS" magic
@@ -459,47 +502,83 @@ func readOGGPackets(data []byte) ([][]byte, int64, error) {
 			break
 		}
 		if string(magic[:]) != "OggS" {
-			return nil, 0, fmt.Errorf("invalid OGG page sync")
+			return nil, fmt.Errorf("invalid OGG page sync")
 		}
 
 		// Page header: version(1) + type(1) + granule(8) + serial(4) + seq(4) + crc(4) = 22 bytes
 		var hdr [22]byte
 		if _, err := io.ReadFull(r, hdr[:]); err != nil {
-			return nil, 0, fmt.Errorf("truncated OGG page header: %w", err)
+			return nil, fmt.Errorf("truncated OGG page header: %w", err)
 		}
+		flags := hdr[1]
 		granule := int64(binary.LittleEndian.Uint64(hdr[2:10]))
+		serial := binary.LittleEndian.Uint32(hdr[10:14])
+
+		stream := bySerial[serial]
+		if stream == nil || flags&oggFlagBOS != 0 {
+			// A BOS page starts a new logical stream, even when an earlier
+			// link in the chain happened to reuse the serial.
+			stream = &oggLogicalStream{Serial: serial}
+			streams = append(streams, stream)
+			bySerial[serial] = stream
+			delete(partial, serial)
+		}
 		if granule > 0 {
-			lastGranule = granule
+			stream.Granule = granule
 		}
 
 		// Segment count + table
 		var nSeg [1]byte
 		if _, err := io.ReadFull(r, nSeg[:]); err != nil {
-			return nil, 0, err
+			return nil, err
 		}
 		segTable := make([]byte, nSeg[0])
 		if _, err := io.ReadFull(r, segTable); err != nil {
-			return nil, 0, err
+			return nil, err
+		}
+
+		// A page that doesn't continue a packet means any unfinished one
+		// was truncated; one that does, with nothing pending (first page
+		// seen for the stream), starts with the tail of a packet we never
+		// saw the beginning of.
+		current, pending := partial[serial]
+		skipTail := flags&oggFlagContinued != 0 && !pending
+		if flags&oggFlagContinued == 0 {
+			current = nil
 		}
 
 		// Read segments, assemble packets (segment < 255 = packet boundary)
 		for _, segSize := range segTable {
 			seg := make([]byte, segSize)
 			if _, err := io.ReadFull(r, seg); err != nil {
-				return nil, 0, err
+				return nil, err
+			}
+			if skipTail {
+				skipTail = segSize == 255
+				continue
 			}
 			current = append(current, seg...)
 			if segSize < 255 {
-				packets = append(packets, current)
+				stream.Packets = append(stream.Packets, current)
 				current = nil
 			}
 		}
+		if current != nil {
+			partial[serial] = current
+		} else {
+			delete(partial, serial)
+		}
 	}
 
-	if current != nil {
-		packets = append(packets, current)
+	out := make([]oggLogicalStream, len(streams))
+	for i, stream := range streams {
+		// Keep a trailing unfinished packet of a truncated file, as before.
+		if current := partial[stream.Serial]; current != nil && i == len(streams)-1 {
+			stream.Packets = append(stream.Packets, current)
+		}
+		out[i] = *stream
 	}
-	return packets, lastGranule, nil
+	return out, nil
 }
 
 // ============================================================================
@@ -417,3 +417,127 @@ func TestConvertAudioForMatrix_FileExtension(t *testing.T) {
 		t.Errorf("mime = %q, want %q", outMime, "application/octet-stream")
 	}
 }
+
+// buildOGGOpusLink creates one OGG Opus stream whose audio packets are
+// count packets of size bytes, each filled with fill.
+func buildOGGOpusLink(t *testing.T, preSkip int, granule int64, count, size int, fill byte) []byte {
+	t.Helper()
+	info := &oggOpusInfo{
+		Channels:   1,
+		PreSkip:    preSkip,
+		OpusHead:   buildOpusHead(1, preSkip),
+		GranulePos: granule,
+	}
+	for i := 0; i < count; i++ {
+		pkt := bytes.Repeat([]byte{fill}, size)
+		pkt[0] = 0x98
+		info.Packets = append(info.Packets, pkt)
+	}
+	data, err := writeOGGOpus(info)
+	if err != nil {
+		t.Fatalf("writeOGGOpus error: %v", err)
+	}
+	return data
+}
+
+// TestReadOGGPackets_Chained tests that concatenated OGG streams come back as
+// separate logical streams with their own header packets.
+func TestReadOGGPackets_Chained(t *testing.T) {
+	data := append(buildOGGOpusLink(t, 312, 48000, 50, 40, 0x11), buildOGGOpusLink(t, 120, 24000, 25, 40, 0x22)...)
+
+	streams, err := readOGGPackets(data)
+	if err != nil {
+		t.Fatalf("readOGGPackets error: %v", err)
+	}
+	if len(streams) != 2 {
+		t.Fatalf("stream count = %d, want 2", len(streams))
+	}
+	for i, want := range []struct {
+		packets int
+		granule int64
+		fill    byte
+	}{{52, 48000, 0x11}, {27, 24000, 0x22}} {
+		s := streams[i]
+		if len(s.Packets) != want.packets {
+			t.Errorf("stream %d packets = %d, want %d", i, len(s.Packets), want.packets)
+			continue
+		}
+		if s.Granule != want.granule {
+			t.Errorf("stream %d granule = %d, want %d", i, s.Granule, want.granule)
+		}
+		if !bytes.HasPrefix(s.Packets[0], []byte("OpusHead")) || !bytes.HasPrefix(s.Packets[1], []byte("OpusTags")) {
+			t.Errorf("stream %d does not start with OpusHead + OpusTags", i)
+		}
+		if last := s.Packets[len(s.Packets)-1]; last[1] != want.fill {
+			t.Errorf("stream %d last packet fill = %#x, want %#x", i, last[1], want.fill)
+		}
+	}
+}
+
+// TestParseOGGOpus_Chained tests that a chained voice note is remuxed as one
+// continuous stream without the second link's header packets.
+func TestParseOGGOpus_Chained(t *testing.T) {
+	data := append(buildOGGOpusLink(t, 312, 48000, 50, 40, 0x11), buildOGGOpusLink(t, 120, 24000, 25, 40, 0x22)...)
+
+	info, err := parseOGGOpus(data)
+	if err != nil {
+		t.Fatalf("parseOGGOpus error: %v", err)
+	}
+	if len(info.Packets) != 75 {
+		t.Fatalf("packet count = %d, want 75", len(info.Packets))
+	}
+	for i, pkt := range info.Packets {
+		if bytes.HasPrefix(pkt, []byte("Opus")) {
+			t.Fatalf("packet %d is a header packet", i)
+		}
+	}
+	if info.Packets[49][1] != 0x11 || info.Packets[50][1] != 0x22 {
+		t.Errorf("chain boundary packets = %#x, %#x, want 0x11, 0x22", info.Packets[49][1], info.Packets[50][1])
+	}
+	if want := int64(48000 + 24000 - 120); info.GranulePos != want {
+		t.Errorf("GranulePos = %d, want %d", info.GranulePos, want)
+	}
+	if info.PreSkip != 312 {
+		t.Errorf("PreSkip = %d, want 312", info.PreSkip)
+	}
+}
+
+// TestReadOGGPackets_UnfinishedPacketAtBOS tests that a packet left open at a
+// stream boundary is dropped instead of being glued onto the next stream.
+func TestReadOGGPackets_UnfinishedPacketAtBOS(t *testing.T) {
+	var buf bytes.Buffer
+	writeOGGPage(&buf, 1, 0, 0, 0x02, [][]byte{buildOpusHead(1, 0)})
+	writeOGGPage(&buf, 1, 1, 0, 0x00, [][]byte{buildOpusTags()})
+	// A single 255-byte segment with no terminating segment: the packet
+	// continues on a page that never comes. (readOGGPackets doesn't check
+	// CRCs, so the page is written by hand.)
+	buf.WriteString("OggS")
+	buf.WriteByte(0)                                   // version
+	buf.WriteByte(0)                                   // header type
+	binary.Write(&buf, binary.LittleEndian, int64(0))  // granule
+	binary.Write(&buf, binary.LittleEndian, uint32(1)) // serial
+	binary.Write(&buf, binary.LittleEndian, uint32(2)) // seq
+	binary.Write(&buf, binary.LittleEndian, uint32(0)) // crc
+	buf.WriteByte(1)                                   // 1 segment
+	buf.WriteByte(255)                                 // segment size
+	buf.Write(bytes.Repeat([]byte{0xAA}, 255))
+	second := buildOGGOpusLink(t, 0, 9600, 10, 40, 0x22)
+	buf.Write(second)
+
+	streams, err := readOGGPackets(buf.Bytes())
+	if err != nil {
+		t.Fatalf("readOGGPackets error: %v", err)
+	}
+	if len(streams) != 2 {
+		t.Fatalf("stream count = %d, want 2", len(streams))
+	}
+	if len(streams[0].Packets) != 2 {
+		t.Errorf("first stream packets = %d, want 2 (headers only)", len(streams[0].Packets))
+	}
+	if !bytes.HasPrefix(streams[1].Packets[0], []byte("OpusHead")) {
+		t.Errorf("second stream first packet = %q, want OpusHead", streams[1].Packets[0][:8])
+	}
+	if len(streams[1].Packets) != 12 {
+		t.Errorf("second stream packets = %d, want 12", len(streams[1].Packets))
+	}
+}
@@ -0,0 +1,66 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2024 Ludvig Rhodin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+package connector
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync"
+
+	"maunium.net/go/mautrix/bridgev2/networkid"
+)
+
+// Contact and shared-profile avatars have no ID of their own, so the avatar
+// ID is derived from the image bytes. bridgev2 only re-uploads an avatar when
+// its ID changes, which makes the ID the change detector: it has to change
+// whenever the bytes do, and stay put when they don't.
+
+// makeAvatarID derives the avatar ID for data from the full SHA-256 of the
+// bytes, scoped by kind ("contact", "improfile") and identifier.
+func makeAvatarID(kind, identifier string, data []byte) networkid.AvatarID {
+	hash := sha256.Sum256(data)
+	return networkid.AvatarID(fmt.Sprintf("%s:%s:%s", kind, identifier, hex.EncodeToString(hash[:])))
+}
+
+// avatarIDCache memoizes makeAvatarID per kind and identifier. GetUserInfo
+// and GetChatInfo run for every ghost on each contact refresh, and rehashing
+// every contact photo each time adds up. Contact syncs replace avatar slices
+// wholesale rather than mutating them, so an entry stays valid while it is
+// the same slice; anything else is rehashed. The zero value is ready to use.
+type avatarIDCache struct {
+	mu      sync.Mutex
+	entries map[string]avatarIDEntry
+}
+
+type avatarIDEntry struct {
+	data []byte
+	id   networkid.AvatarID
+}
+
+func sameSlice(a, b []byte) bool {
+	return len(a) == len(b) && len(a) > 0 && &a[0] == &b[0]
+}
+
+// get returns the avatar ID for data, hashing only when data isn't the slice
+// the cached ID was computed from.
+func (ac *avatarIDCache) get(kind, identifier string, data []byte) networkid.AvatarID {
+	key := kind + ":" + identifier
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	if entry, ok := ac.entries[key]; ok && sameSlice(entry.data, data) {
+		return entry.id
+	}
+	id := makeAvatarID(kind, identifier, data)
+	if ac.entries == nil {
+		ac.entries = make(map[string]avatarIDEntry)
+	}
+	ac.entries[key] = avatarIDEntry{data: data, id: id}
+	return id
+}
@@ -0,0 +1,63 @@
+package connector
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestMakeAvatarID(t *testing.T) {
+	photo := bytes.Repeat([]byte{0xff, 0xd8, 0xff, 0xe0}, 64)
+	samePrefix := append(append([]byte{}, photo...), 0x01)
+	modified := append([]byte{}, photo...)
+	modified[len(modified)-1] ^= 0xff
+
+	id := makeAvatarID("contact", "tel:+15551234567", photo)
+	if !strings.HasPrefix(string(id), "contact:tel:+15551234567:") || len(id) != len("contact:tel:+15551234567:")+64 {
+		t.Errorf("makeAvatarID() = %q, want contact:<identifier>:<full sha256>", id)
+	}
+	tests := []struct {
+		name       string
+		kind       string
+		identifier string
+		data       []byte
+		wantSame   bool
+	}{
+		{"unchanged copy", "contact", "tel:+15551234567", append([]byte{}, photo...), true},
+		{"modified last byte", "contact", "tel:+15551234567", modified, false},
+		{"same prefix, longer", "contact", "tel:+15551234567", samePrefix, false},
+		{"other identifier", "contact", "tel:+15559876543", photo, false},
+		{"other kind", "improfile", "tel:+15551234567", photo, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := makeAvatarID(tt.kind, tt.identifier, tt.data)
+			if (got == id) != tt.wantSame {
+				t.Errorf("makeAvatarID() = %q, same as original = %v, want %v", got, got == id, tt.wantSame)
+			}
+		})
+	}
+}
+
+func TestAvatarIDCache(t *testing.T) {
+	var cache avatarIDCache
+	photo := []byte("first photo bytes")
+
+	first := cache.get("contact", "tel:+15551234567", photo)
+	if want := makeAvatarID("contact", "tel:+15551234567", photo); first != want {
+		t.Errorf("get() = %q, want %q", first, want)
+	}
+	if again := cache.get("contact", "tel:+15551234567", photo); again != first {
+		t.Errorf("get() on unchanged slice = %q, want %q", again, first)
+	}
+	if cp := cache.get("contact", "tel:+15551234567", append([]byte{}, photo...)); cp != first {
+		t.Errorf("get() on identical copy = %q, want %q", cp, first)
+	}
+	updated := []byte("first photo bytez")
+	if got := cache.get("contact", "tel:+15551234567", updated); got == first {
+		t.Errorf("get() on updated photo = %q, want a new ID", got)
+	}
+	if got := cache.get("contact", "tel:+15551234567", updated); got != makeAvatarID("contact", "tel:+15551234567", updated) {
+		t.Errorf("get() after update = %q, want ID of updated photo", got)
+	}
+}
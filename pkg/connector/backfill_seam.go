@@ -0,0 +1,90 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2024 Ludvig Rhodin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+package connector
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"maunium.net/go/mautrix/bridgev2/networkid"
+)
+
+// Backward backfill seam.
+//
+// A portal created mid-history (by a live message, or recreated after a
+// delete) already has messages in its room when backward backfill starts
+// filling in what came before. The seam is the oldest message in the room:
+// backward backfill must stay strictly before it. Paging by the anchor's
+// timestamp isn't quite enough on its own, because the timestamp a message
+// was bridged with live (APNs) and the one CloudKit or chat.db reports for
+// it can differ slightly, so a message delivered live just after the seam
+// can sort just before it in the backfill source and be bridged a second
+// time. The seam therefore also remembers the IDs bridged shortly after it
+// and drops those regardless of their source timestamp.
+
+// backfillSeamSkew bounds how far a live-bridged message's timestamp may be
+// from its backfill source's. Bridged messages up to this long after the
+// seam are matched by ID.
+const backfillSeamSkew = 5 * time.Minute
+
+// backfillSeam is the boundary backward backfill must stay before. A nil
+// seam (empty room) excludes nothing.
+type backfillSeam struct {
+	ts      time.Time
+	bridged map[string]bool
+}
+
+// excludes reports whether a backfill candidate with the given message GUID
+// and source timestamp is on the live side of the seam: newer than the
+// oldest message in the room, or the same message bridged live with a
+// slightly different timestamp.
+func (s *backfillSeam) excludes(guid string, ts time.Time) bool {
+	if s == nil {
+		return false
+	}
+	return ts.After(s.ts) || s.bridged[strings.ToUpper(guid)]
+}
+
+// loadBackfillSeam returns the seam for a portal from the messages already
+// in its room, or nil if the room has none.
+func (c *IMClient) loadBackfillSeam(ctx context.Context, portalKey networkid.PortalKey) (*backfillSeam, error) {
+	msgDB := c.Main.Bridge.DB.Message
+	first, err := msgDB.GetFirstPortalMessage(ctx, portalKey)
+	if err != nil || first == nil {
+		return nil, err
+	}
+	seam := &backfillSeam{ts: first.Timestamp, bridged: make(map[string]bool)}
+	// GetMessagesBetweenTimeQuery's start bound is exclusive.
+	near, err := msgDB.GetMessagesBetweenTimeQuery(ctx, portalKey, first.Timestamp.Add(-time.Millisecond), first.Timestamp.Add(backfillSeamSkew))
+	if err != nil {
+		return nil, err
+	}
+	for _, msg := range near {
+		guid, _ := extractTapbackTarget(string(msg.ID))
+		seam.bridged[strings.ToUpper(guid)] = true
+	}
+	return seam, nil
+}
+
+// cloudRowsBeforeSeam returns the rows that are on the backfill side of the
+// seam. The input slice is left untouched so callers can still derive the
+// pagination cursor from the full page.
+func cloudRowsBeforeSeam(rows []cloudMessageRow, seam *backfillSeam) []cloudMessageRow {
+	if seam == nil {
+		return rows
+	}
+	kept := make([]cloudMessageRow, 0, len(rows))
+	for _, row := range rows {
+		if !seam.excludes(row.GUID, time.UnixMilli(row.TimestampMS)) {
+			kept = append(kept, row)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,109 @@
+package connector
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestBackfillSeamPreventsOverlap(t *testing.T) {
+	ctx := context.Background()
+	db := newTestBridgeDB(t)
+	c := &IMClient{Main: &IMConnector{Bridge: &bridgev2.Bridge{DB: db}}}
+	portalKey := networkid.PortalKey{ID: "tel:+15551234567", Receiver: "login"}
+	emptyKey := networkid.PortalKey{ID: "tel:+15550000000", Receiver: "login"}
+	for _, key := range []networkid.PortalKey{portalKey, emptyKey} {
+		if err := db.Portal.Insert(ctx, &database.Portal{PortalKey: key}); err != nil {
+			t.Fatalf("Portal.Insert() error = %v", err)
+		}
+	}
+	// The portal was created by a live message at creation; two more
+	// arrived live after it.
+	creation := time.Unix(1700000000, 0)
+	for _, live := range []struct {
+		id     string
+		mxid   id.EventID
+		offset time.Duration
+	}{
+		{"LIVE-1", "$live1", 0},
+		{"LIVE-2_att0", "$live2", 2 * time.Second},
+		{"LIVE-3", "$live3", time.Hour},
+	} {
+		err := db.Message.Insert(ctx, &database.Message{
+			ID:        makeMessageID(live.id),
+			MXID:      live.mxid,
+			Room:      portalKey,
+			SenderID:  "tel:+15551234567",
+			Timestamp: creation.Add(live.offset),
+		})
+		if err != nil {
+			t.Fatalf("Message.Insert(%s) error = %v", live.id, err)
+		}
+	}
+
+	if seam, err := c.loadBackfillSeam(ctx, emptyKey); err != nil || seam != nil {
+		t.Fatalf("loadBackfillSeam(empty room) = %+v, %v, want nil seam", seam, err)
+	}
+	seam, err := c.loadBackfillSeam(ctx, portalKey)
+	if err != nil {
+		t.Fatalf("loadBackfillSeam() error = %v", err)
+	}
+	if seam == nil || !seam.ts.Equal(creation) {
+		t.Fatalf("loadBackfillSeam() = %+v, want seam at %v", seam, creation)
+	}
+
+	ms := func(offset time.Duration) int64 { return creation.Add(offset).UnixMilli() }
+	rows := []cloudMessageRow{
+		{GUID: "HISTORY-1", TimestampMS: ms(-time.Hour)},
+		{GUID: "HISTORY-2", TimestampMS: ms(-time.Second)},
+		// CloudKit's copy of a live message, timestamped just before the seam.
+		{GUID: "live-2", TimestampMS: ms(-500 * time.Millisecond)},
+		{GUID: "SAME-MS", TimestampMS: ms(0)},
+		{GUID: "LIVE-1", TimestampMS: ms(0)},
+		{GUID: "AFTER-SEAM", TimestampMS: ms(time.Second)},
+		// Far from the seam, so only the timestamp bound can catch it.
+		{GUID: "LIVE-3", TimestampMS: ms(time.Hour)},
+	}
+	var got []string
+	for _, row := range cloudRowsBeforeSeam(rows, seam) {
+		got = append(got, row.GUID)
+	}
+	want := []string{"HISTORY-1", "HISTORY-2", "SAME-MS"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("cloudRowsBeforeSeam() = %v, want %v", got, want)
+	}
+	if len(rows) != 7 {
+		t.Errorf("cloudRowsBeforeSeam() modified its input, len = %d", len(rows))
+	}
+}
+
+func TestBackfillSeamExcludes(t *testing.T) {
+	seamTS := time.Unix(1700000000, 0)
+	seam := &backfillSeam{ts: seamTS, bridged: map[string]bool{"ABC": true}}
+	tests := []struct {
+		name string
+		seam *backfillSeam
+		guid string
+		ts   time.Time
+		want bool
+	}{
+		{"before seam", seam, "OLD", seamTS.Add(-time.Minute), false},
+		{"at seam, not bridged", seam, "OLD", seamTS, false},
+		{"after seam", seam, "NEW", seamTS.Add(time.Millisecond), true},
+		{"bridged with earlier source time", seam, "abc", seamTS.Add(-time.Second), true},
+		{"no seam", nil, "NEW", seamTS.Add(time.Hour), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.seam.excludes(tt.guid, tt.ts); got != tt.want {
+				t.Errorf("excludes(%q, %v) = %v, want %v", tt.guid, tt.ts, got, tt.want)
+			}
+		})
+	}
+}
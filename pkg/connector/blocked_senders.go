@@ -0,0 +1,161 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2024 Ludvig Rhodin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+package connector
+
+// block / report-junk / unblock — stop bridging a sender.
+//
+// Short-code and marketing SMS keep arriving long after the user has lost
+// interest, and iOS's "Report Junk" isn't something the bridge can do: the
+// report goes through Messages on the user's own devices, not over the IDS
+// or SMS-forwarding protocol the bridge speaks. Instead, both commands add
+// the DM's sender to a local blocklist (the blocked_sender table) that
+// handleMessage consults before bridging anything, so the chat simply goes
+// quiet on Matrix. report-junk only differs in the reason it records and in
+// telling the user to report the sender from an Apple device if they want
+// Apple to know.
+//
+// Flow (in the DM portal):
+//   !im block          → messages from this contact are no longer bridged
+//   !im report-junk    → same, recorded as junk
+//   !im unblock        → bridging resumes with the next message
+
+import (
+	"context"
+	"strings"
+
+	"maunium.net/go/mautrix/bridgev2/commands"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+)
+
+const (
+	blockReasonBlocked = "blocked"
+	blockReasonJunk    = "junk"
+)
+
+// isBlockedSender reports whether an inbound message must be dropped because
+// its sender is on the local blocklist. DM portals are also matched by their
+// portal ID, which covers the same contact writing from another of their
+// handles once the portal has been canonicalized. Messages from the user's
+// own devices are never dropped.
+func (c *IMClient) isBlockedSender(ctx context.Context, sender *string, portalKey networkid.PortalKey) bool {
+	if c.cloudStore == nil || sender == nil || *sender == "" || c.isMyHandle(*sender) {
+		return false
+	}
+	ids := []string{normalizeIdentifierForPortalID(*sender)}
+	if portalID := string(portalKey.ID); !isGroupPortalID(portalID) {
+		ids = append(ids, portalID)
+	}
+	blocked, err := c.cloudStore.isSenderBlocked(ctx, ids...)
+	if err != nil {
+		c.UserLogin.Log.Warn().Err(err).Str("sender", *sender).Msg("Failed to check sender blocklist")
+		return false
+	}
+	return blocked
+}
+
+var cmdBlockSender = &commands.FullHandler{
+	Name: "block",
+	Func: func(ce *commands.Event) { fnBlockSender(ce, blockReasonBlocked) },
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionChats,
+		Description: "Stop bridging messages from the contact in this DM.",
+	},
+	RequiresLogin:  true,
+	RequiresPortal: true,
+}
+
+var cmdReportJunk = &commands.FullHandler{
+	Name:    "report-junk",
+	Aliases: []string{"junk"},
+	Func:    func(ce *commands.Event) { fnBlockSender(ce, blockReasonJunk) },
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionChats,
+		Description: "Mark the sender of this DM as junk and stop bridging their messages.",
+	},
+	RequiresLogin:  true,
+	RequiresPortal: true,
+}
+
+var cmdUnblockSender = &commands.FullHandler{
+	Name: "unblock",
+	Func: fnUnblockSender,
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionChats,
+		Description: "Resume bridging messages from a blocked contact (the one in this DM, or the given handle).",
+		Args:        "[handle]",
+	},
+	RequiresLogin: true,
+}
+
+// blockCommandClient returns the login's client, replying with the reason
+// when there's none to use.
+func blockCommandClient(ce *commands.Event) *IMClient {
+	login := ce.User.GetDefaultLogin()
+	if login == nil {
+		ce.Reply("Not logged in.")
+		return nil
+	}
+	client, ok := login.Client.(*IMClient)
+	if !ok || client == nil || client.cloudStore == nil {
+		ce.Reply("Bridge client not available.")
+		return nil
+	}
+	return client
+}
+
+func fnBlockSender(ce *commands.Event, reason string) {
+	portalID := string(ce.Portal.ID)
+	if isGroupPortalID(portalID) {
+		ce.Reply("This only works in a DM. Leave the group chat instead to stop receiving it.")
+		return
+	}
+	client := blockCommandClient(ce)
+	if client == nil {
+		return
+	}
+	if err := client.cloudStore.blockSender(ce.Ctx, portalID, reason); err != nil {
+		ce.Reply("Failed to block `%s`: %v", portalID, err)
+		return
+	}
+	ce.Log.Info().Str("portal_id", portalID).Str("reason", reason).Msg("Blocked sender")
+	if reason == blockReasonJunk {
+		ce.Reply("Marked `%s` as junk; their messages will no longer be bridged. "+
+			"The bridge can't report junk to Apple — use Report Junk in Messages on your iPhone or Mac for that. "+
+			"Use `$cmdprefix unblock` here to undo.", portalID)
+		return
+	}
+	ce.Reply("Blocked `%s`; their messages will no longer be bridged. Use `$cmdprefix unblock` here to undo.", portalID)
+}
+
+func fnUnblockSender(ce *commands.Event) {
+	var sender string
+	switch {
+	case len(ce.Args) > 0:
+		sender = normalizeIdentifierForPortalID(strings.Join(ce.Args, ""))
+	case ce.Portal != nil && !isGroupPortalID(string(ce.Portal.ID)):
+		sender = string(ce.Portal.ID)
+	default:
+		ce.Reply("**Usage:** `$cmdprefix unblock <phone number or email>`, or `$cmdprefix unblock` in the blocked contact's DM.")
+		return
+	}
+	client := blockCommandClient(ce)
+	if client == nil {
+		return
+	}
+	removed, err := client.cloudStore.unblockSender(ce.Ctx, sender)
+	if err != nil {
+		ce.Reply("Failed to unblock `%s`: %v", sender, err)
+		return
+	} else if !removed {
+		ce.Reply("`%s` is not blocked.", sender)
+		return
+	}
+	ce.Log.Info().Str("sender", sender).Msg("Unblocked sender")
+	ce.Reply("Unblocked `%s`; their next message will be bridged.", sender)
+}
@@ -0,0 +1,63 @@
+package connector
+
+import (
+	"context"
+	"testing"
+
+	"maunium.net/go/mautrix/bridgev2/networkid"
+)
+
+func TestIsBlockedSender(t *testing.T) {
+	ctx := context.Background()
+	store := newTestCloudStore(t)
+	c := &IMClient{cloudStore: store, allHandles: []string{"mailto:me@example.com"}}
+	str := func(s string) *string { return &s }
+
+	spammer := networkid.PortalKey{ID: "tel:+15551234567"}
+	friend := networkid.PortalKey{ID: "tel:+15557654321"}
+	group := networkid.PortalKey{ID: "gid:0b7c3e1f"}
+
+	if c.isBlockedSender(ctx, str("tel:+15551234567"), spammer) {
+		t.Fatalf("isBlockedSender() = true before anything was blocked")
+	}
+	if err := store.blockSender(ctx, string(spammer.ID), blockReasonJunk); err != nil {
+		t.Fatalf("blockSender() error = %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		sender    *string
+		portalKey networkid.PortalKey
+		want      bool
+	}{
+		{"blocked sender", str("tel:+15551234567"), spammer, true},
+		{"blocked sender, other formatting", str("+15551234567"), spammer, true},
+		{"blocked sender in a group", str("tel:+15551234567"), group, true},
+		{"other handle canonicalized to the blocked DM", str("mailto:spam@example.com"), spammer, true},
+		{"other sender", str("tel:+15557654321"), friend, false},
+		{"other sender in a group", str("tel:+15557654321"), group, false},
+		{"own message in the blocked DM", str("mailto:me@example.com"), spammer, false},
+		{"no sender", nil, spammer, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := c.isBlockedSender(ctx, tt.sender, tt.portalKey); got != tt.want {
+				t.Errorf("isBlockedSender() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// Blocking again only updates the reason.
+	if err := store.blockSender(ctx, string(spammer.ID), blockReasonBlocked); err != nil {
+		t.Fatalf("blockSender() again error = %v", err)
+	}
+	if removed, err := store.unblockSender(ctx, string(spammer.ID)); err != nil || !removed {
+		t.Fatalf("unblockSender() = %v, %v, want true", removed, err)
+	}
+	if c.isBlockedSender(ctx, str("tel:+15551234567"), spammer) {
+		t.Errorf("isBlockedSender() = true after unblock, want false")
+	}
+	if removed, err := store.unblockSender(ctx, string(spammer.ID)); err != nil || removed {
+		t.Errorf("unblockSender() of a sender that isn't blocked = %v, %v, want false", removed, err)
+	}
+}
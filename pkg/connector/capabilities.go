@@ -100,6 +100,9 @@ func init() {
 var generalCaps = &bridgev2.NetworkGeneralCapabilities{
 	DisappearingMessages: false,
 	AggressiveUpdateInfo: true,
+	Provisioning: bridgev2.ProvisioningCapabilities{
+		GroupCreation: groupCreationCaps,
+	},
 }
 
 func (c *IMConnector) GetCapabilities() *bridgev2.NetworkGeneralCapabilities {
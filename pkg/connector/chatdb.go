@@ -11,9 +11,11 @@ package connector
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"image"
 	"image/jpeg"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"sort"
@@ -35,15 +37,20 @@ type chatDB struct {
 	api imessage.API
 }
 
-// openChatDB attempts to open the local iMessage chat.db database.
-// Returns nil if chat.db is not accessible (e.g., no Full Disk Access).
-func openChatDB(log zerolog.Logger) *chatDB {
-	if !canReadChatDB(log) {
+// openChatDB attempts to open the local iMessage chat.db database, or the
+// one at path (chatdb_path) if set. Returns nil if chat.db is not accessible
+// (e.g., no Full Disk Access) or isn't a Messages database.
+func openChatDB(log zerolog.Logger, path string) *chatDB {
+	// A custom path (e.g. an iPhone backup's sms.db) normally lives outside
+	// the TCC-protected Messages folder, so there's no Full Disk Access to
+	// wait for; the platform validates it when opening.
+	if path == "" && !canReadChatDB(log) {
 		showDialogAndOpenFDA(log)
 		waitForFDA(log)
 	}
 
 	adapter := newBridgeAdapter(&log)
+	adapter.config.ChatDBPath = path
 	api, err := imessage.NewAPI(adapter)
 	if err != nil {
 		log.Warn().Err(err).Msg("Failed to initialize chat.db API via imessage.NewAPI")
@@ -122,6 +129,24 @@ func chatDBReplyTarget(replyGUID string, replyPart int) *networkid.MessageOption
 	return &networkid.MessageOptionalPartID{MessageID: makeMessageID(targetID)}
 }
 
+// chatDBUnreadWindow returns the unread tail of a chat's chronologically
+// sorted messages: everything after the last message the user sent or read
+// (initial_sync_unread_only). Only real messages move the read point; chat.db
+// never marks incoming tapbacks or group actions read, so counting them
+// would leave a chat looking unread forever.
+func chatDBUnreadWindow(messages []*imessage.Message) []*imessage.Message {
+	for i := len(messages) - 1; i >= 0; i-- {
+		msg := messages[i]
+		if msg.ItemType != imessage.ItemTypeMessage || (msg.Tapback != nil && !msg.IsFromMe) {
+			continue
+		}
+		if msg.IsFromMe || msg.IsRead {
+			return messages[i+1:]
+		}
+	}
+	return messages
+}
+
 // FetchMessages retrieves historical messages from chat.db for backfill.
 func (db *chatDB) FetchMessages(ctx context.Context, params bridgev2.FetchMessagesParams, c *IMClient) (*bridgev2.FetchMessagesResponse, error) {
 	portalID := string(params.Portal.ID)
@@ -184,19 +209,59 @@ func (db *chatDB) FetchMessages(ctx context.Context, params bridgev2.FetchMessag
 		return nil, fmt.Errorf("failed to fetch messages from chat.db: %w", lastErr)
 	}
 
-	// Sort chronologically — messages may come from multiple chat GUIDs
+	// Sort chronologically — messages may come from multiple chat GUIDs.
+	// Same-time messages go by GUID, like the CloudKit store orders them.
 	sort.Slice(messages, func(i, j int) bool {
-		return messages[i].Time.Before(messages[j].Time)
+		if !messages[i].Time.Equal(messages[j].Time) {
+			return messages[i].Time.Before(messages[j].Time)
+		}
+		return messages[i].GUID < messages[j].GUID
 	})
 
 	log.Info().Strs("chat_guids", chatGUIDs).Int("raw_message_count", len(messages)).Msg("Got messages from chat.db")
 
+	// Backward backfill stays before the oldest message already in the room
+	// (see backfillSeam); chat.db dates can differ slightly from the ones
+	// messages were bridged with live. HasMore goes by the fetched count so
+	// trimming at the seam doesn't end pagination early.
+	fetched := len(messages)
+	if !params.Forward {
+		seam, err := c.loadBackfillSeam(ctx, params.Portal.PortalKey)
+		if err != nil {
+			log.Warn().Err(err).Str("portal_id", portalID).Msg("Failed to load backfill seam")
+		} else if seam != nil {
+			kept := messages[:0]
+			for _, msg := range messages {
+				if !seam.excludes(msg.GUID, msg.Time) {
+					kept = append(kept, msg)
+				}
+			}
+			messages = kept
+		}
+	}
+
+	// Initial backfill in unread-only mode: keep just the unread tail, and
+	// report no more history so backward backfill doesn't fetch the rest.
+	unreadOnly := params.AnchorMessage == nil && c.Main.Config.InitialSyncUnreadOnly
+	if unreadOnly {
+		messages = chatDBUnreadWindow(messages)
+		log.Info().Strs("chat_guids", chatGUIDs).Int("unread_count", len(messages)).Msg("Limiting initial backfill to unread messages")
+	}
+
 	// Get an intent for uploading media. The bot intent works for all uploads.
 	intent := c.Main.Bridge.Bot
 
+	// Attachment paths come straight from chat.db; only read files that
+	// really live in the Messages attachment directories.
+	home, _ := os.UserHomeDir()
+	attachmentRoots := chatDBAttachmentRoots(home, c.Main.Config.ChatDBExtraAttachmentRoot)
+
 	backfillMessages := make([]*bridgev2.BackfillMessage, 0, len(messages))
+	var tapbacks []chatDBTapback
+	unsent := make(map[string]bool)
 	for _, msg := range messages {
-		if msg.ItemType != imessage.ItemTypeMessage || msg.Tapback != nil {
+		isFaceTimeCall := msg.ItemType == imessage.ItemTypeFaceTime && !c.disableFaceTime()
+		if msg.ItemType != imessage.ItemTypeMessage && !isFaceTimeCall {
 			continue
 		}
 		sender := chatDBMakeEventSender(msg, c)
@@ -205,6 +270,36 @@ func (db *chatDB) FetchMessages(ctx context.Context, params bridgev2.FetchMessag
 		}
 		sender = c.canonicalizeDMSender(params.Portal.PortalKey, sender)
 
+		if isFaceTimeCall {
+			backfillMessages = append(backfillMessages, &bridgev2.BackfillMessage{
+				ConvertedMessage: chatDBFaceTimeCallNotice(msg),
+				Sender:           sender,
+				ID:               makeMessageID(msg.GUID),
+				TxnID:            networkid.TransactionID(msg.GUID),
+				Timestamp:        msg.Time,
+			})
+			continue
+		}
+
+		// Tapbacks aren't messages of their own: collect them and attach
+		// them to their targets once the whole batch is converted.
+		if msg.Tapback != nil {
+			if chatDBTapbackEmoji(msg.Tapback) == unknownTapbackEmoji {
+				log.Warn().Int("tapback_type", int(msg.Tapback.Type)).Str("guid", msg.GUID).
+					Msg("Unknown tapback type in chat.db, bridging it as a generic reaction")
+			}
+			tapbacks = append(tapbacks, chatDBTapback{Tapback: msg.Tapback, Sender: sender, Timestamp: msg.Time})
+			continue
+		}
+
+		// Backfill shows messages as they are now: an unsent message is
+		// left out (with its tapbacks), an edited one has its latest text.
+		if msg.IsRetracted {
+			unsent[msg.GUID] = true
+			continue
+		}
+		converted := len(backfillMessages)
+
 		// Strip U+FFFC (object replacement character) — inline attachment
 		// placeholders from NSAttributedString that render as blank
 		msg.Text = strings.ReplaceAll(msg.Text, "\uFFFC", "")
@@ -213,6 +308,9 @@ func (db *chatDB) FetchMessages(ctx context.Context, params bridgev2.FetchMessag
 		// Only create a text part if there's actual text content
 		if msg.Text != "" || msg.Subject != "" {
 			cm, err := convertChatDBMessage(ctx, params.Portal, intent, msg)
+			if err == nil && msg.IsEdited && c.Main.Config.EditedMarker {
+				markChatDBEdited(cm)
+			}
 			if err == nil {
 				backfillMessages = append(backfillMessages, &bridgev2.BackfillMessage{
 					ConvertedMessage: cm,
@@ -220,7 +318,6 @@ func (db *chatDB) FetchMessages(ctx context.Context, params bridgev2.FetchMessag
 					ID:               makeMessageID(msg.GUID),
 					TxnID:            networkid.TransactionID(msg.GUID),
 					Timestamp:        msg.Time,
-					StreamOrder:      msg.Time.UnixMilli(),
 				})
 			}
 		}
@@ -230,13 +327,46 @@ func (db *chatDB) FetchMessages(ctx context.Context, params bridgev2.FetchMessag
 		// attachment table. Bridge the original attachment first, then
 		// check for and bridge any companion MOV alongside it.
 		for i, att := range msg.Attachments {
-			if att == nil {
+			if att == nil || isChatDBRichLinkSideband(att) {
 				continue
 			}
-			attCm, err := convertChatDBAttachment(ctx, params.Portal, intent, msg, att, c.videoTranscoding(), c.heicConversion(), c.Main.Config.HEICJPEGQuality)
-			if err != nil {
-				log.Warn().Err(err).Str("guid", msg.GUID).Int("att_index", i).Msg("Failed to convert attachment, skipping")
+			realPath, err := resolveChatDBAttachmentPath(att.PathOnDisk, home, attachmentRoots)
+			if err == nil {
+				err = checkChatDBAttachmentFile(realPath)
+			}
+			var attCm *bridgev2.ConvertedMessage
+			unavailable := errors.Is(err, errChatDBAttachmentUnavailable)
+			switch {
+			case unavailable:
+				// The transfer never finished on the Mac; keep the rest of
+				// the message and mark where the attachment was.
+				log.Warn().Err(err).Str("guid", msg.GUID).Int("att_index", i).Msg("Attachment file unavailable, bridging placeholder")
+				attCm = chatDBUnavailableAttachment(att)
+			case err != nil:
+				log.Warn().Err(err).Str("guid", msg.GUID).Int("att_index", i).Msg("Rejecting attachment path, skipping")
 				continue
+			default:
+				att.PathOnDisk = realPath
+				attCm, err = convertChatDBAttachment(ctx, params.Portal, intent, msg, att, c.videoTranscoding(), c.heicConversion(), c.Main.Config.HEICJPEGQuality, c.Main.Config.HideMediaFilenames)
+				if errors.Is(err, errAttachmentUpload) {
+					// Keep the file for an upload retry (see failed_upload.go).
+					if data, readErr := att.Read(); readErr == nil {
+						fileName, mimeType := chatDBAttachmentNameAndMime(att)
+						if placeholder := c.failedBackfillUpload(ctx, params.Portal.ID, &pendingAttachmentRow{
+							MessageGUID: msg.GUID,
+							AttIndex:    i,
+							AttID:       fmt.Sprintf("%s_att%d", msg.GUID, i),
+							Filename:    fileName,
+							MimeType:    mimeType,
+						}, data, err, sender, msg.Time); placeholder != nil {
+							attCm, err = placeholder, nil
+						}
+					}
+				}
+				if err != nil {
+					log.Warn().Err(err).Str("guid", msg.GUID).Int("att_index", i).Msg("Failed to convert attachment, skipping")
+					continue
+				}
 			}
 			partID := fmt.Sprintf("%s_att%d", msg.GUID, i)
 			if msg.ReplyToGUID != "" {
@@ -248,13 +378,15 @@ func (db *chatDB) FetchMessages(ctx context.Context, params bridgev2.FetchMessag
 				ID:               makeMessageID(partID),
 				TxnID:            networkid.TransactionID(partID),
 				Timestamp:        msg.Time.Add(time.Duration(i+1) * time.Millisecond),
-				StreamOrder:      msg.Time.UnixMilli() + int64(i+1),
 			})
 
 			// If there's a Live Photo MOV companion on disk, bridge it too.
+			if unavailable {
+				continue
+			}
 			movAtt := chatDBResolveLivePhoto(att, log)
 			if movAtt.PathOnDisk != att.PathOnDisk {
-				movCm, movErr := convertChatDBAttachment(ctx, params.Portal, intent, msg, movAtt, c.videoTranscoding(), c.heicConversion(), c.Main.Config.HEICJPEGQuality)
+				movCm, movErr := convertChatDBAttachment(ctx, params.Portal, intent, msg, movAtt, c.videoTranscoding(), c.heicConversion(), c.Main.Config.HEICJPEGQuality, c.Main.Config.HideMediaFilenames)
 				if movErr != nil {
 					log.Warn().Err(movErr).Str("guid", msg.GUID).Int("att_index", i).Msg("Failed to convert Live Photo MOV companion, skipping")
 				} else {
@@ -265,21 +397,176 @@ func (db *chatDB) FetchMessages(ctx context.Context, params bridgev2.FetchMessag
 						ID:               makeMessageID(movID),
 						TxnID:            networkid.TransactionID(movID),
 						Timestamp:        msg.Time.Add(time.Duration(i+1)*time.Millisecond + 500*time.Microsecond),
-						StreamOrder:      msg.Time.UnixMilli() + int64(i+1),
 					})
 				}
 			}
 		}
+		if c.Main.Config.MessageServiceInBackfill {
+			markMessageService(backfillMessages[converted:], chatDBMessageService(msg))
+		}
+	}
+
+	tapbacks = dropChatDBTapbacksOnUnsent(tapbacks, unsent)
+	for _, tb := range attachChatDBTapbacks(backfillMessages, tapbacks) {
+		c.queueChatDBTapback(ctx, params.Portal.PortalKey, tb)
 	}
 
 	return &bridgev2.FetchMessagesResponse{
 		Messages:                backfillMessages,
-		HasMore:                 len(messages) >= count,
+		HasMore:                 !unreadOnly && fetched >= count,
 		Forward:                 params.Forward,
 		AggressiveDeduplication: params.Forward,
 	}, nil
 }
 
+// markChatDBEdited appends the edited_marker suffix to a backfilled edited
+// message, like convertRemoteEdit does for live edits.
+func markChatDBEdited(cm *bridgev2.ConvertedMessage) {
+	for _, part := range cm.Parts {
+		part.Content.Body += " (edited)"
+		if part.Content.FormattedBody != "" {
+			part.Content.FormattedBody += " (edited)"
+		}
+	}
+}
+
+// dropChatDBTapbacksOnUnsent removes tapbacks on messages that were unsent,
+// which backfill leaves out.
+func dropChatDBTapbacksOnUnsent(tapbacks []chatDBTapback, unsent map[string]bool) []chatDBTapback {
+	if len(unsent) == 0 {
+		return tapbacks
+	}
+	kept := tapbacks[:0]
+	for _, tb := range tapbacks {
+		if !unsent[tb.Tapback.TargetGUID] {
+			kept = append(kept, tb)
+		}
+	}
+	return kept
+}
+
+// chatDBTapback is a chat.db tapback row held back from the backfill
+// message stream.
+type chatDBTapback struct {
+	Tapback   *imessage.Tapback
+	Sender    bridgev2.EventSender
+	Timestamp time.Time
+}
+
+// chatDBTapbackEmoji maps a parsed chat.db tapback to its Matrix emoji,
+// through the same standardTapbacks table as rustpush tapbacks. Returns ""
+// for types that can't be bridged from chat.db alone (custom emoji and
+// sticker tapbacks keep their payload in columns we don't read).
+func chatDBTapbackEmoji(tb *imessage.Tapback) string {
+	if tb.Type < imessage.TapbackLove || tb.Type >= imessage.TapbackLove+imessage.TapbackRemoveOffset {
+		return ""
+	}
+	idx := uint32(tb.Type - imessage.TapbackLove)
+	if idx == tapbackTypeEmoji || idx == tapbackTypeSticker {
+		return ""
+	}
+	return tapbackTypeToEmoji(&idx, nil)
+}
+
+// attachChatDBTapbacks attaches backfilled tapbacks to their target messages
+// as BackfillReactions, the same way cloudRowsToBackfillMessages does for
+// CloudKit. Targets follow the reply convention (chatDBReplyTarget): part 0
+// is the text, part N the (N-1)th attachment; part 0 of an attachment-only
+// message falls back to its first attachment. Tapbacks are replayed in
+// order, so a later tapback from the same sender replaces an earlier one and
+// a remove cancels it — iMessage allows one tapback per sender per message.
+//
+// Tapbacks whose target isn't in this batch are returned (latest per target
+// and sender, removes included) for the caller to queue as live events.
+func attachChatDBTapbacks(messages []*bridgev2.BackfillMessage, tapbacks []chatDBTapback) []chatDBTapback {
+	byID := make(map[networkid.MessageID]*bridgev2.BackfillMessage, len(messages))
+	for _, m := range messages {
+		byID[m.ID] = m
+	}
+	type reactionKey struct {
+		target networkid.MessageID
+		sender networkid.UserID
+	}
+	var order []reactionKey
+	latest := make(map[reactionKey]chatDBTapback)
+	for _, tb := range tapbacks {
+		if chatDBTapbackEmoji(tb.Tapback) == "" {
+			continue
+		}
+		targetID := chatDBReplyTarget(tb.Tapback.TargetGUID, tb.Tapback.TargetPart).MessageID
+		if _, ok := byID[targetID]; !ok && tb.Tapback.TargetPart <= 0 {
+			if attID := chatDBReplyTarget(tb.Tapback.TargetGUID, 1).MessageID; byID[attID] != nil {
+				targetID = attID
+			}
+		}
+		key := reactionKey{target: targetID, sender: tb.Sender.Sender}
+		if _, seen := latest[key]; !seen {
+			order = append(order, key)
+		}
+		latest[key] = tb
+	}
+
+	var outside []chatDBTapback
+	for _, key := range order {
+		tb := latest[key]
+		target, inBatch := byID[key.target]
+		if !inBatch {
+			outside = append(outside, tb)
+			continue
+		}
+		if tb.Tapback.Remove {
+			continue
+		}
+		target.Reactions = append(target.Reactions, &bridgev2.BackfillReaction{
+			Sender:    tb.Sender,
+			Emoji:     chatDBTapbackEmoji(tb.Tapback),
+			Timestamp: tb.Timestamp,
+		})
+	}
+	return outside
+}
+
+// chatDBTapbackTargets lists the message IDs a chat.db tapback's target may
+// be stored under, most specific first.
+func chatDBTapbackTargets(tb *imessage.Tapback) []networkid.MessageID {
+	targetID := chatDBReplyTarget(tb.TargetGUID, tb.TargetPart).MessageID
+	if tb.TargetPart >= 1 {
+		return []networkid.MessageID{targetID, makeMessageID(tb.TargetGUID)}
+	}
+	return []networkid.MessageID{targetID, chatDBReplyTarget(tb.TargetGUID, 1).MessageID}
+}
+
+// queueChatDBTapback bridges a backfilled tapback whose target is outside
+// the backfill batch as a live reaction event, if the target message has
+// already been bridged and doesn't already have that reaction (see
+// tapback_reconcile.go). Targets older than the backfill window are dropped
+// rather than flooding the portal queue with events bridgev2 would discard.
+// Like the live path, a target that isn't stored under its own ID is looked
+// up under the other form: the "_att0" part for a whole-message tapback on
+// an attachment message, the bare UUID for a part tapback on a message
+// bridged before part IDs.
+func (c *IMClient) queueChatDBTapback(ctx context.Context, portalKey networkid.PortalKey, tb chatDBTapback) {
+	var targetID networkid.MessageID
+	for _, candidate := range chatDBTapbackTargets(tb.Tapback) {
+		target, err := c.Main.Bridge.DB.Message.GetFirstPartByID(ctx, c.UserLogin.ID, candidate)
+		if err == nil && target != nil {
+			targetID = candidate
+			break
+		}
+	}
+	if targetID == "" {
+		zerolog.Ctx(ctx).Debug().Str("target_guid", tb.Tapback.TargetGUID).Msg("Dropping backfilled tapback for message outside the bridged history")
+		return
+	}
+	c.queueTapbackChanges(ctx, portalKey, []tapbackChange{{
+		Target:    targetID,
+		Sender:    tb.Sender,
+		Emoji:     chatDBTapbackEmoji(tb.Tapback),
+		Remove:    tb.Tapback.Remove,
+		Timestamp: tb.Timestamp,
+	}})
+}
+
 // ============================================================================
 // chat.db ↔ portal ID conversion
 // ============================================================================
@@ -344,24 +631,12 @@ func chatDBMakeEventSender(msg *imessage.Message, c *IMClient) bridgev2.EventSen
 	}
 	return bridgev2.EventSender{
 		IsFromMe: false,
-		Sender:   makeUserID(addIdentifierPrefix(stripSmsSuffix(msg.Sender.LocalID))),
+		Sender:   c.canonicalGhostID(addIdentifierPrefix(stripSmsSuffix(msg.Sender.LocalID))),
 	}
 }
 
 func convertChatDBMessage(ctx context.Context, portal *bridgev2.Portal, intent bridgev2.MatrixAPI, msg *imessage.Message) (*bridgev2.ConvertedMessage, error) {
-	content := &event.MessageEventContent{
-		MsgType: event.MsgText,
-		Body:    msg.Text,
-	}
-	if msg.Subject != "" {
-		if msg.Text != "" {
-			content.Body = fmt.Sprintf("**%s**\n%s", msg.Subject, msg.Text)
-			content.Format = event.FormatHTML
-			content.FormattedBody = fmt.Sprintf("<strong>%s</strong><br/>%s", msg.Subject, msg.Text)
-		} else {
-			content.Body = msg.Subject
-		}
-	}
+	content := subjectMessageContent(msg.Subject, msg.Text)
 	if msg.IsEmote {
 		content.MsgType = event.MsgEmote
 	}
@@ -375,8 +650,9 @@ func convertChatDBMessage(ctx context.Context, portal *bridgev2.Portal, intent b
 
 	cm := &bridgev2.ConvertedMessage{
 		Parts: []*bridgev2.ConvertedMessagePart{{
-			Type:    event.EventMessage,
-			Content: content,
+			Type:       event.EventMessage,
+			Content:    content,
+			DBMetadata: subjectMetadata(msg.Subject),
 		}},
 	}
 	if msg.ReplyToGUID != "" {
@@ -385,9 +661,44 @@ func convertChatDBMessage(ctx context.Context, portal *bridgev2.Portal, intent b
 	return cm, nil
 }
 
-func convertChatDBAttachment(ctx context.Context, portal *bridgev2.Portal, intent bridgev2.MatrixAPI, msg *imessage.Message, att *imessage.Attachment, videoTranscoding, heicConversion bool, heicQuality int) (*bridgev2.ConvertedMessage, error) {
-	mimeType := att.GetMimeType()
-	fileName := att.GetFileName()
+// chatDBAttachmentNameAndMime returns the display name and MIME type of a
+// chat.db attachment. transfer_name (FileName) is the name the sender gave
+// the file, but the copy on disk may be named differently or have no
+// extension, so the two are reconciled:
+//
+//   - the name is transfer_name, or the disk name if there is none; if it
+//     has no extension but the disk name does, that one is appended.
+//   - chat.db's mime_type is used when set. Otherwise the extension decides,
+//     transfer_name's first, then the disk path's, and only then the file's
+//     contents.
+func chatDBAttachmentNameAndMime(att *imessage.Attachment) (fileName, mimeType string) {
+	var diskName string
+	if att.PathOnDisk != "" {
+		diskName = filepath.Base(att.PathOnDisk)
+	}
+	fileName = sanitizeAttachmentFileName(att.GetFileName())
+	if fileName == "" {
+		fileName = sanitizeAttachmentFileName(diskName)
+	}
+	if filepath.Ext(fileName) == "" {
+		fileName += filepath.Ext(diskName)
+	}
+
+	mimeType = att.MimeType
+	if mimeType == "" || mimeType == "application/octet-stream" {
+		if byExt := extToMIME(filepath.Ext(fileName)); byExt != "" {
+			mimeType = byExt
+		} else if byExt = extToMIME(filepath.Ext(diskName)); byExt != "" {
+			mimeType = byExt
+		} else if mimeType == "" {
+			mimeType = att.GetMimeType()
+		}
+	}
+	return fileName, mimeType
+}
+
+func convertChatDBAttachment(ctx context.Context, portal *bridgev2.Portal, intent bridgev2.MatrixAPI, msg *imessage.Message, att *imessage.Attachment, videoTranscoding, heicConversion bool, heicQuality int, hideMediaFilenames bool) (*bridgev2.ConvertedMessage, error) {
+	fileName, mimeType := chatDBAttachmentNameAndMime(att)
 
 	data, err := att.Read()
 	if err != nil {
@@ -469,7 +780,6 @@ func convertChatDBAttachment(ctx context.Context, portal *bridgev2.Portal, inten
 
 	content := &event.MessageEventContent{
 		MsgType: mimeToMsgType(mimeType),
-		Body:    fileName,
 		Info: &event.FileInfo{
 			MimeType: mimeType,
 			Size:     len(data),
@@ -477,6 +787,7 @@ func convertChatDBAttachment(ctx context.Context, portal *bridgev2.Portal, inten
 			Height:   imgHeight,
 		},
 	}
+	setAttachmentBody(content, fileName, hideMediaFilenames)
 
 	// Mark as voice message if this was a CAF voice recording
 	if durationMs > 0 {
@@ -489,7 +800,7 @@ func convertChatDBAttachment(ctx context.Context, portal *bridgev2.Portal, inten
 	if intent != nil {
 		url, encFile, err := intent.UploadMedia(ctx, "", data, fileName, mimeType)
 		if err != nil {
-			return nil, fmt.Errorf("failed to upload attachment: %w", err)
+			return nil, fmt.Errorf("%w: %w", errAttachmentUpload, err)
 		}
 		if encFile != nil {
 			content.File = encFile
@@ -567,3 +878,124 @@ func chatDBResolveLivePhoto(att *imessage.Attachment, log *zerolog.Logger) *imes
 		MimeType:   "video/quicktime",
 	}
 }
+
+// ============================================================================
+// chat.db attachment path allowlist
+// ============================================================================
+
+// chatDBAttachmentRoots returns the real (symlink-resolved) directories that
+// chat.db attachment paths may point into: Messages' Attachments and
+// StickerCache folders, plus the configured chatdb_extra_attachment_root.
+// Roots that don't exist are left out.
+func chatDBAttachmentRoots(home, extraRoot string) []string {
+	candidates := []string{
+		filepath.Join(home, "Library", "Messages", "Attachments"),
+		filepath.Join(home, "Library", "Messages", "StickerCache"),
+	}
+	if extraRoot != "" {
+		if strings.HasPrefix(extraRoot, "~/") {
+			extraRoot = filepath.Join(home, extraRoot[2:])
+		}
+		candidates = append(candidates, extraRoot)
+	}
+	roots := make([]string, 0, len(candidates))
+	for _, root := range candidates {
+		if resolved, err := filepath.EvalSymlinks(root); err == nil {
+			roots = append(roots, resolved)
+		}
+	}
+	return roots
+}
+
+// resolveChatDBAttachmentPath expands and resolves an attachment path from
+// chat.db and checks it against the allowed roots. Symlinks are followed
+// before the check, so a symlinked attachment whose real file lives under
+// another allowed root is accepted, and one that points outside every root
+// is rejected even though its own path looks fine. Returns the real path.
+func resolveChatDBAttachmentPath(path, home string, roots []string) (string, error) {
+	if strings.HasPrefix(path, "~/") {
+		path = filepath.Join(home, path[2:])
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	resolved, err := filepath.EvalSymlinks(abs)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", fmt.Errorf("%w: %w", errChatDBAttachmentUnavailable, err)
+	} else if err != nil {
+		return "", err
+	}
+	for _, root := range roots {
+		rel, err := filepath.Rel(root, resolved)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return resolved, nil
+		}
+	}
+	return "", fmt.Errorf("attachment path %s is outside the allowed attachment directories", resolved)
+}
+
+// errChatDBAttachmentUnavailable marks a chat.db attachment whose file
+// never finished transferring to the Mac: the row exists, but the file is
+// missing from disk or empty.
+var errChatDBAttachmentUnavailable = errors.New("attachment file unavailable")
+
+// checkChatDBAttachmentFile returns errChatDBAttachmentUnavailable if the
+// attachment file at path is missing or zero bytes.
+func checkChatDBAttachmentFile(path string) error {
+	info, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("%w: %w", errChatDBAttachmentUnavailable, err)
+	} else if err != nil {
+		return err
+	} else if info.Size() == 0 {
+		return fmt.Errorf("%w: %s is empty", errChatDBAttachmentUnavailable, path)
+	}
+	return nil
+}
+
+// isChatDBRichLinkSideband reports whether a chat.db attachment is the
+// rich-link plugin payload stored alongside a URL balloon. Like the CloudKit
+// path (isPluginPayloadAttachment), it's skipped rather than bridged as a
+// file: the URL is in the message text. transfer_name is sometimes empty,
+// so the on-disk path is checked as well.
+func isChatDBRichLinkSideband(att *imessage.Attachment) bool {
+	return isPluginPayloadFilename(att.FileName) || isPluginPayloadFilename(att.PathOnDisk)
+}
+
+// chatDBFaceTimeCallNotice is the notice bridged for a FaceTime call
+// recorded in chat.db. chat.db doesn't say whether a call was answered, only
+// who placed it; the notice is sent as that person, so it doesn't name them.
+func chatDBFaceTimeCallNotice(msg *imessage.Message) *bridgev2.ConvertedMessage {
+	ev := faceTimeCallIncoming
+	if msg.IsFromMe {
+		ev = faceTimeCallOutgoing
+	}
+	return &bridgev2.ConvertedMessage{
+		Parts: []*bridgev2.ConvertedMessagePart{{
+			Type: event.EventMessage,
+			Content: &event.MessageEventContent{
+				MsgType: event.MsgNotice,
+				Body:    faceTimeCallHeadline(ev, ""),
+			},
+		}},
+	}
+}
+
+// chatDBUnavailableAttachment is the notice bridged in place of an
+// attachment whose file is unavailable.
+func chatDBUnavailableAttachment(att *imessage.Attachment) *bridgev2.ConvertedMessage {
+	name := att.GetFileName()
+	if name == "" {
+		name = filepath.Base(att.PathOnDisk)
+	}
+	return &bridgev2.ConvertedMessage{
+		Parts: []*bridgev2.ConvertedMessagePart{{
+			Type: event.EventMessage,
+			Content: &event.MessageEventContent{
+				MsgType: event.MsgNotice,
+				Body:    fmt.Sprintf("Attachment unavailable (%s): the file was never fully downloaded to this Mac.", name),
+			},
+		}},
+	}
+}
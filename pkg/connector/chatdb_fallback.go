@@ -0,0 +1,60 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2024 Ludvig Rhodin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+package connector
+
+// chat.db fallback for CloudKit backfill (chatdb_backfill_fallback).
+//
+// CloudKit doesn't have every chat: Messages in iCloud can have gaps, and
+// chats from before it was turned on may never have been uploaded. On a
+// Mac, chat.db often still has them. With the fallback on, FetchMessages
+// keeps CloudKit as the source, but a portal CloudKit has no messages for
+// at all is backfilled from chat.db instead. The choice is per portal and
+// covers both directions, so a portal's history never mixes the two
+// sources and their pagination cursors.
+
+import (
+	"context"
+
+	"github.com/rs/zerolog"
+)
+
+// useChatDBBackfillFallback decides whether a portal on CloudKit backfill
+// is backfilled from chat.db. A failed CloudKit lookup doesn't count as
+// empty: the portal may well have messages there.
+func useChatDBBackfillFallback(enabled, chatDBOpen, cloudHasMessages bool, cloudErr error) bool {
+	return enabled && chatDBOpen && cloudErr == nil && !cloudHasMessages
+}
+
+// openChatDBBackfillFallback opens chat.db for the fallback when it's
+// enabled and readable. Unlike backfill_source "chatdb", it doesn't prompt
+// for Full Disk Access or wait for it, and doesn't start the chat.db sync.
+func (c *IMClient) openChatDBBackfillFallback(log zerolog.Logger) {
+	if !c.Main.Config.ChatDBBackfillFallback || c.chatDB != nil {
+		return
+	}
+	if c.Main.Config.ChatDBPath == "" && !canReadChatDB(log) {
+		log.Info().Msg("chat.db not readable, CloudKit backfill will run without the chat.db fallback")
+		return
+	}
+	c.chatDB = openChatDB(log, c.Main.Config.ChatDBPath)
+	if c.chatDB != nil {
+		log.Info().Msg("chat.db available as a fallback for CloudKit backfill")
+	}
+}
+
+// chatDBBackfillFallback reports whether a portal should be backfilled from
+// chat.db because CloudKit has nothing for it.
+func (c *IMClient) chatDBBackfillFallback(ctx context.Context, portalID string) bool {
+	enabled, chatDBOpen := c.Main.Config.ChatDBBackfillFallback, c.chatDB != nil
+	if !enabled || !chatDBOpen || c.cloudStore == nil {
+		return false
+	}
+	hasMessages, err := c.cloudStore.hasPortalMessages(ctx, portalID)
+	return useChatDBBackfillFallback(enabled, chatDBOpen, hasMessages, err)
+}
@@ -0,0 +1,36 @@
+package connector
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestUseChatDBBackfillFallback(t *testing.T) {
+	tests := []struct {
+		name             string
+		enabled          bool
+		chatDBOpen       bool
+		cloudHasMessages bool
+		cloudErr         error
+		want             bool
+	}{
+		{"CloudKit empty", true, true, false, nil, true},
+		{"CloudKit has messages", true, true, true, nil, false},
+		{"CloudKit lookup failed", true, true, false, errors.New("database is locked"), false},
+		{"chat.db not open", true, false, false, nil, false},
+		{"disabled", false, true, false, nil, false},
+	}
+	for _, tt := range tests {
+		if got := useChatDBBackfillFallback(tt.enabled, tt.chatDBOpen, tt.cloudHasMessages, tt.cloudErr); got != tt.want {
+			t.Errorf("useChatDBBackfillFallback(%s) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestChatDBBackfillFallbackWithoutChatDB(t *testing.T) {
+	c := &IMClient{Main: &IMConnector{Config: IMConfig{ChatDBBackfillFallback: true}}}
+	if c.chatDBBackfillFallback(context.Background(), "tel:+15551234567") {
+		t.Errorf("chatDBBackfillFallback() without chat.db = true, want false")
+	}
+}
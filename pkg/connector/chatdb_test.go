@@ -0,0 +1,417 @@
+package connector
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/event"
+
+	"github.com/lrhodin/imessage/imessage"
+)
+
+func TestChatDBTapbackEmoji(t *testing.T) {
+	tests := []struct {
+		name string
+		typ  imessage.TapbackType
+		want string
+	}{
+		{"love", imessage.TapbackLove, "❤️"},
+		{"like", imessage.TapbackLike, "👍"},
+		{"question", imessage.TapbackQuestion, "❓"},
+		{"emoji", imessage.TapbackType(2006), ""},
+		{"sticker", imessage.TapbackType(2007), ""},
+		{"unknown", imessage.TapbackType(2008), unknownTapbackEmoji},
+		{"zero", imessage.TapbackType(0), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := chatDBTapbackEmoji(&imessage.Tapback{Type: tt.typ}); got != tt.want {
+				t.Errorf("chatDBTapbackEmoji(%d) = %q, want %q", tt.typ, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAttachChatDBTapbacks(t *testing.T) {
+	alice := bridgev2.EventSender{Sender: "tel:+15551234567"}
+	bob := bridgev2.EventSender{Sender: "mailto:bob@example.com"}
+	base := time.Unix(1700000000, 0)
+	tapback := func(sender bridgev2.EventSender, target string, part int, typ imessage.TapbackType, remove bool, offset int) chatDBTapback {
+		return chatDBTapback{
+			Tapback:   &imessage.Tapback{TargetGUID: target, TargetPart: part, Type: typ, Remove: remove},
+			Sender:    sender,
+			Timestamp: base.Add(time.Duration(offset) * time.Second),
+		}
+	}
+	newBatch := func() []*bridgev2.BackfillMessage {
+		return []*bridgev2.BackfillMessage{
+			{ID: "text-guid"},
+			{ID: "photo-guid_att0"},
+			{ID: "mixed-guid"},
+			{ID: "mixed-guid_att0"},
+		}
+	}
+	reactionsOf := func(batch []*bridgev2.BackfillMessage, id networkid.MessageID) []string {
+		for _, m := range batch {
+			if m.ID != id {
+				continue
+			}
+			var out []string
+			for _, r := range m.Reactions {
+				out = append(out, string(r.Sender.Sender)+" "+r.Emoji)
+			}
+			return out
+		}
+		return nil
+	}
+
+	tests := []struct {
+		name        string
+		tapbacks    []chatDBTapback
+		want        map[networkid.MessageID][]string
+		wantOutside int
+	}{
+		{
+			name:     "text target",
+			tapbacks: []chatDBTapback{tapback(alice, "text-guid", 0, imessage.TapbackLove, false, 1)},
+			want:     map[networkid.MessageID][]string{"text-guid": {"tel:+15551234567 ❤️"}},
+		},
+		{
+			name:     "attachment part",
+			tapbacks: []chatDBTapback{tapback(alice, "mixed-guid", 1, imessage.TapbackLike, false, 1)},
+			want: map[networkid.MessageID][]string{
+				"mixed-guid":      nil,
+				"mixed-guid_att0": {"tel:+15551234567 👍"},
+			},
+		},
+		{
+			name:     "attachment-only message falls back to first attachment",
+			tapbacks: []chatDBTapback{tapback(bob, "photo-guid", 0, imessage.TapbackLaugh, false, 1)},
+			want:     map[networkid.MessageID][]string{"photo-guid_att0": {"mailto:bob@example.com 😂"}},
+		},
+		{
+			name: "later tapback replaces earlier one",
+			tapbacks: []chatDBTapback{
+				tapback(alice, "text-guid", 0, imessage.TapbackLove, false, 1),
+				tapback(alice, "text-guid", 0, imessage.TapbackDislike, false, 2),
+				tapback(bob, "text-guid", 0, imessage.TapbackLike, false, 3),
+			},
+			want: map[networkid.MessageID][]string{"text-guid": {"tel:+15551234567 👎", "mailto:bob@example.com 👍"}},
+		},
+		{
+			name: "remove cancels add",
+			tapbacks: []chatDBTapback{
+				tapback(alice, "text-guid", 0, imessage.TapbackLove, false, 1),
+				tapback(alice, "text-guid", 0, imessage.TapbackLove, true, 2),
+			},
+			want: map[networkid.MessageID][]string{"text-guid": nil},
+		},
+		{
+			name:     "unknown type is skipped",
+			tapbacks: []chatDBTapback{tapback(alice, "text-guid", 0, imessage.TapbackType(2006), false, 1)},
+			want:     map[networkid.MessageID][]string{"text-guid": nil},
+		},
+		{
+			name: "targets outside the batch are returned",
+			tapbacks: []chatDBTapback{
+				tapback(alice, "old-guid", 0, imessage.TapbackLove, false, 1),
+				tapback(alice, "old-guid", 0, imessage.TapbackLike, false, 2),
+				tapback(bob, "old-guid", 0, imessage.TapbackLove, true, 3),
+				tapback(bob, "text-guid", 0, imessage.TapbackEmphasis, false, 4),
+			},
+			want:        map[networkid.MessageID][]string{"text-guid": {"mailto:bob@example.com ‼️"}},
+			wantOutside: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			batch := newBatch()
+			outside := attachChatDBTapbacks(batch, tt.tapbacks)
+			if len(outside) != tt.wantOutside {
+				t.Errorf("attachChatDBTapbacks() returned %d outside tapbacks, want %d", len(outside), tt.wantOutside)
+			}
+			for id, want := range tt.want {
+				got := reactionsOf(batch, id)
+				if len(got) != len(want) {
+					t.Errorf("reactions on %s = %v, want %v", id, got, want)
+					continue
+				}
+				for i := range got {
+					if got[i] != want[i] {
+						t.Errorf("reactions on %s = %v, want %v", id, got, want)
+						break
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestChatDBTapbackTargets(t *testing.T) {
+	tests := []struct {
+		name string
+		part int
+		want []networkid.MessageID
+	}{
+		{"whole message", 0, []networkid.MessageID{"guid", "guid_att0"}},
+		{"first part", 1, []networkid.MessageID{"guid_att0", "guid"}},
+		{"second part", 2, []networkid.MessageID{"guid_att1", "guid"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := chatDBTapbackTargets(&imessage.Tapback{TargetGUID: "guid", TargetPart: tt.part})
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("chatDBTapbackTargets() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChatDBUnreadWindow(t *testing.T) {
+	incoming := func(guid string, read bool) *imessage.Message {
+		return &imessage.Message{GUID: guid, IsRead: read}
+	}
+	outgoing := func(guid string) *imessage.Message {
+		return &imessage.Message{GUID: guid, IsFromMe: true}
+	}
+	tapback := func(guid string, fromMe bool) *imessage.Message {
+		return &imessage.Message{GUID: guid, IsFromMe: fromMe, Tapback: &imessage.Tapback{Type: imessage.TapbackLike}}
+	}
+	rename := &imessage.Message{GUID: "rename", ItemType: imessage.ItemTypeName}
+
+	tests := []struct {
+		name     string
+		messages []*imessage.Message
+		want     []string
+	}{
+		{"all read", []*imessage.Message{incoming("a", true), incoming("b", true)}, nil},
+		{"unread after read", []*imessage.Message{incoming("a", true), incoming("b", false), incoming("c", false)}, []string{"b", "c"}},
+		{"reply marks everything before read", []*imessage.Message{incoming("a", false), outgoing("b"), incoming("c", false)}, []string{"c"}},
+		{"nothing read", []*imessage.Message{incoming("a", false), incoming("b", false)}, []string{"a", "b"}},
+		{"incoming tapback doesn't move read point", []*imessage.Message{incoming("a", true), tapback("t", false)}, []string{"t"}},
+		{"own tapback moves read point", []*imessage.Message{incoming("a", false), tapback("t", true), incoming("b", false)}, []string{"b"}},
+		{"group action doesn't move read point", []*imessage.Message{outgoing("a"), rename, incoming("b", false)}, []string{"rename", "b"}},
+		{"empty chat", nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, msg := range chatDBUnreadWindow(tt.messages) {
+				got = append(got, msg.GUID)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("chatDBUnreadWindow() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveChatDBAttachmentPath(t *testing.T) {
+	home := t.TempDir()
+	attachments := filepath.Join(home, "Library", "Messages", "Attachments")
+	extra := filepath.Join(home, "Relocated")
+	outside := filepath.Join(home, "Documents")
+	for _, dir := range []string{filepath.Join(attachments, "ab", "01"), extra, outside} {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile := func(path string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte("data"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	symlink := func(target, link string) {
+		t.Helper()
+		if err := os.Symlink(target, link); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile(filepath.Join(attachments, "ab", "01", "IMG_0001.HEIC"))
+	writeFile(filepath.Join(extra, "MailDrop.zip"))
+	writeFile(filepath.Join(outside, "secret.txt"))
+	symlink(filepath.Join(extra, "MailDrop.zip"), filepath.Join(attachments, "ab", "01", "MailDrop.zip"))
+	symlink(filepath.Join(outside, "secret.txt"), filepath.Join(attachments, "ab", "01", "escape.txt"))
+
+	roots := chatDBAttachmentRoots(home, "~/Relocated")
+	rootsWithoutExtra := chatDBAttachmentRoots(home, "")
+	realExtra, _ := filepath.EvalSymlinks(extra)
+	realAttachments, _ := filepath.EvalSymlinks(attachments)
+
+	tests := []struct {
+		name    string
+		path    string
+		roots   []string
+		want    string
+		wantErr bool
+	}{
+		{"plain attachment", "~/Library/Messages/Attachments/ab/01/IMG_0001.HEIC", roots, filepath.Join(realAttachments, "ab", "01", "IMG_0001.HEIC"), false},
+		{"symlink into extra root", "~/Library/Messages/Attachments/ab/01/MailDrop.zip", roots, filepath.Join(realExtra, "MailDrop.zip"), false},
+		{"symlink into extra root without it configured", "~/Library/Messages/Attachments/ab/01/MailDrop.zip", rootsWithoutExtra, "", true},
+		{"symlink escaping the roots", "~/Library/Messages/Attachments/ab/01/escape.txt", roots, "", true},
+		{"dot-dot escape", "~/Library/Messages/Attachments/../../Documents/secret.txt", roots, "", true},
+		{"missing file", "~/Library/Messages/Attachments/ab/01/missing.jpg", roots, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := resolveChatDBAttachmentPath(tt.path, home, tt.roots)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("resolveChatDBAttachmentPath(%s) error = %v, wantErr %v", tt.path, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("resolveChatDBAttachmentPath(%s) = %q, want %q", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChatDBAttachmentUnavailable(t *testing.T) {
+	home := t.TempDir()
+	dir := filepath.Join(home, "Library", "Messages", "Attachments", "ab", "01")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "IMG_0001.HEIC"), []byte("data"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "IMG_0002.HEIC"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	roots := chatDBAttachmentRoots(home, "")
+
+	tests := []struct {
+		name            string
+		path            string
+		wantUnavailable bool
+	}{
+		{"complete file", "~/Library/Messages/Attachments/ab/01/IMG_0001.HEIC", false},
+		{"zero bytes", "~/Library/Messages/Attachments/ab/01/IMG_0002.HEIC", true},
+		{"missing file", "~/Library/Messages/Attachments/ab/01/IMG_0003.HEIC", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			realPath, err := resolveChatDBAttachmentPath(tt.path, home, roots)
+			if err == nil {
+				err = checkChatDBAttachmentFile(realPath)
+			}
+			if got := errors.Is(err, errChatDBAttachmentUnavailable); got != tt.wantUnavailable {
+				t.Errorf("attachment %s unavailable = %v (err %v), want %v", tt.path, got, err, tt.wantUnavailable)
+			}
+			if !tt.wantUnavailable && err != nil {
+				t.Errorf("attachment %s error = %v, want nil", tt.path, err)
+			}
+		})
+	}
+
+	cm := chatDBUnavailableAttachment(&imessage.Attachment{FileName: "IMG_0002.HEIC", PathOnDisk: filepath.Join(dir, "IMG_0002.HEIC")})
+	if len(cm.Parts) != 1 || cm.Parts[0].Content.MsgType != event.MsgNotice {
+		t.Fatalf("chatDBUnavailableAttachment() parts = %+v, want one notice", cm.Parts)
+	}
+	if body := cm.Parts[0].Content.Body; !strings.Contains(body, "IMG_0002.HEIC") {
+		t.Errorf("chatDBUnavailableAttachment() body = %q, want it to name the file", body)
+	}
+}
+
+func TestIsChatDBRichLinkSideband(t *testing.T) {
+	tests := []struct {
+		name string
+		att  imessage.Attachment
+		want bool
+	}{
+		{"plugin payload", imessage.Attachment{FileName: "8C1D.pluginPayloadAttachment", PathOnDisk: "~/Library/Messages/Attachments/8c/12/8C1D.pluginPayloadAttachment"}, true},
+		{"no transfer name", imessage.Attachment{PathOnDisk: "~/Library/Messages/Attachments/8c/12/8C1D.pluginPayloadAttachment"}, true},
+		{"photo", imessage.Attachment{FileName: "IMG_0001.HEIC", PathOnDisk: "~/Library/Messages/Attachments/ab/01/IMG_0001.HEIC", MimeType: "image/heic"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isChatDBRichLinkSideband(&tt.att); got != tt.want {
+				t.Errorf("isChatDBRichLinkSideband() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChatDBAttachmentNameAndMime(t *testing.T) {
+	tests := []struct {
+		name     string
+		att      imessage.Attachment
+		wantName string
+		wantMime string
+	}{
+		{"chat.db mime wins", imessage.Attachment{FileName: "IMG_0001.HEIC", PathOnDisk: "/a/IMG_0001.HEIC", MimeType: "image/heic"}, "IMG_0001.HEIC", "image/heic"},
+		{"disk has no extension", imessage.Attachment{FileName: "IMG_0002.MOV", PathOnDisk: "/a/B8E4C0F2", MimeType: ""}, "IMG_0002.MOV", "video/quicktime"},
+		{"octet-stream uses transfer name", imessage.Attachment{FileName: "Audio Message.caf", PathOnDisk: "/a/file", MimeType: "application/octet-stream"}, "Audio Message.caf", "audio/x-caf"},
+		{"transfer name has no extension", imessage.Attachment{FileName: "scan", PathOnDisk: "/a/scan.pdf"}, "scan.pdf", "application/pdf"},
+		{"no transfer name", imessage.Attachment{PathOnDisk: "/a/IMG_0003.jpeg"}, "IMG_0003.jpeg", "image/jpeg"},
+		{"transfer name preferred over disk", imessage.Attachment{FileName: "clip.mp4", PathOnDisk: "/a/clip.mov"}, "clip.mp4", "video/mp4"},
+		{"transfer name with a path", imessage.Attachment{FileName: "../../Library/x\u202egpj.exe", PathOnDisk: "/a/file", MimeType: "application/x-msdownload"}, "xgpj.exe", "application/x-msdownload"},
+		{"unknown extension keeps octet-stream", imessage.Attachment{FileName: "archive.xyz", PathOnDisk: "/a/archive.xyz", MimeType: "application/octet-stream"}, "archive.xyz", "application/octet-stream"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotName, gotMime := chatDBAttachmentNameAndMime(&tt.att)
+			if gotName != tt.wantName || gotMime != tt.wantMime {
+				t.Errorf("chatDBAttachmentNameAndMime() = %q, %q, want %q, %q", gotName, gotMime, tt.wantName, tt.wantMime)
+			}
+		})
+	}
+}
+
+func TestChatDBFaceTimeCallNotice(t *testing.T) {
+	tests := []struct {
+		name     string
+		isFromMe bool
+		want     string
+	}{
+		{"incoming", false, "📞 Incoming FaceTime call."},
+		{"outgoing", true, "📞 Outgoing FaceTime call."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cm := chatDBFaceTimeCallNotice(&imessage.Message{GUID: "CALL", ItemType: imessage.ItemTypeFaceTime, IsFromMe: tt.isFromMe})
+			if len(cm.Parts) != 1 || cm.Parts[0].Content.MsgType != event.MsgNotice {
+				t.Fatalf("chatDBFaceTimeCallNotice() parts = %+v, want one notice", cm.Parts)
+			}
+			if got := cm.Parts[0].Content.Body; got != tt.want {
+				t.Errorf("chatDBFaceTimeCallNotice() body = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChatDBBackfillEditedAndUnsent(t *testing.T) {
+	edited := &imessage.Message{GUID: "EDITED", Text: "fixed typo", IsEdited: true}
+	cm, err := convertChatDBMessage(context.Background(), &bridgev2.Portal{Portal: &database.Portal{}}, nil, edited)
+	if err != nil {
+		t.Fatalf("convertChatDBMessage() error = %v", err)
+	}
+	markChatDBEdited(cm)
+	if body := cm.Parts[0].Content.Body; body != "fixed typo (edited)" {
+		t.Errorf("edited backfill body = %q, want %q", body, "fixed typo (edited)")
+	}
+
+	tb := func(target string) chatDBTapback {
+		return chatDBTapback{Tapback: &imessage.Tapback{TargetGUID: target, Type: imessage.TapbackLove}}
+	}
+	tapbacks := []chatDBTapback{tb("KEPT"), tb("UNSENT"), tb("KEPT-2")}
+	var got []string
+	for _, kept := range dropChatDBTapbacksOnUnsent(tapbacks, map[string]bool{"UNSENT": true}) {
+		got = append(got, kept.Tapback.TargetGUID)
+	}
+	if want := []string{"KEPT", "KEPT-2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("dropChatDBTapbacksOnUnsent() targets = %v, want %v", got, want)
+	}
+	if got := dropChatDBTapbacksOnUnsent(tapbacks, nil); len(got) != 3 {
+		t.Errorf("dropChatDBTapbacksOnUnsent(no unsent) kept %d tapbacks, want 3", len(got))
+	}
+}
@@ -0,0 +1,217 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2024 Ludvig Rhodin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+package connector
+
+// Apple "Check In" (Messages safety feature) notices.
+//
+// Check In updates arrive as iMessage app balloons from the SafetyMonitor
+// extension. The balloon has no text body and no attachments, so without
+// special handling it is dropped as an empty message. The payload lives in
+// the balloon URL's query string; we pull out the session state plus the
+// optional destination and ETA and post a readable bot notice instead.
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/event"
+
+	"github.com/lrhodin/imessage/pkg/rustpushgo"
+)
+
+// checkInBundleIDMarker identifies the SafetyMonitor extension in a balloon
+// bundle id ("com.apple.messages.MSMessageExtensionBalloonPlugin:<team>:
+// com.apple.SafetyMonitorApp.SafetyMonitorMessages").
+const checkInBundleIDMarker = "com.apple.SafetyMonitorApp"
+
+type checkInKind int
+
+const (
+	checkInUnknown checkInKind = iota
+	checkInStarted
+	checkInArrived
+	checkInOverdue
+	checkInCancelled
+)
+
+// checkInNotice is the parsed form of a Check In balloon payload.
+type checkInNotice struct {
+	Kind checkInKind
+	// Subtype is the raw message type from the payload, kept for logging
+	// when Kind is checkInUnknown.
+	Subtype     string
+	Destination string
+	// ETA is the expected end of the Check In session; zero if absent.
+	ETA time.Time
+}
+
+// isCheckInBalloon reports whether an extension bundle id belongs to Check In.
+func isCheckInBalloon(bundleID string) bool {
+	return strings.Contains(bundleID, checkInBundleIDMarker)
+}
+
+// parseCheckIn parses a Check In balloon URL. Keys are matched
+// case-insensitively because the casing has differed between iOS releases.
+// The session state is read from messageType (falling back to type/state);
+// both numeric and named states are accepted. If the URL has no usable
+// state, the localized summary text (ldText) is used as a last resort.
+// Unrecognized states yield checkInUnknown rather than an error so the
+// caller can still post a generic notice.
+func parseCheckIn(balloonURL, ldText string) checkInNotice {
+	params := make(map[string]string)
+	if idx := strings.IndexByte(balloonURL, '?'); idx >= 0 {
+		balloonURL = balloonURL[idx+1:]
+	}
+	if values, err := url.ParseQuery(balloonURL); err == nil {
+		for key, vals := range values {
+			if len(vals) > 0 {
+				params[strings.ToLower(key)] = strings.TrimSpace(vals[0])
+			}
+		}
+	}
+	first := func(keys ...string) string {
+		for _, key := range keys {
+			if v := params[key]; v != "" {
+				return v
+			}
+		}
+		return ""
+	}
+
+	notice := checkInNotice{
+		Subtype:     first("messagetype", "type", "state"),
+		Destination: first("destinationname", "destination"),
+	}
+	if eta := first("estimatedendtime", "eta", "endtime"); eta != "" {
+		notice.ETA = parseCheckInTime(eta)
+	}
+
+	switch strings.ToLower(notice.Subtype) {
+	case "1", "start", "started", "session_started":
+		notice.Kind = checkInStarted
+	case "2", "end", "ended", "complete", "completed", "arrived", "session_ended":
+		notice.Kind = checkInArrived
+	case "3", "timeout", "timedout", "overdue", "expired", "session_timed_out":
+		notice.Kind = checkInOverdue
+	case "4", "cancel", "cancelled", "canceled", "session_cancelled":
+		notice.Kind = checkInCancelled
+	case "":
+		notice.Kind = checkInKindFromText(ldText)
+	}
+	return notice
+}
+
+// parseCheckInTime accepts either Unix seconds, Unix milliseconds or RFC 3339.
+func parseCheckInTime(s string) time.Time {
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil && n > 0 {
+		if n > 1e12 {
+			return time.UnixMilli(n)
+		}
+		return time.Unix(n, 0)
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t
+	}
+	return time.Time{}
+}
+
+// checkInKindFromText guesses the state from the notification summary text
+// ("Check In: Started", "… arrived", "… is overdue").
+func checkInKindFromText(text string) checkInKind {
+	text = strings.ToLower(text)
+	switch {
+	case strings.Contains(text, "overdue") || strings.Contains(text, "not responded"):
+		return checkInOverdue
+	case strings.Contains(text, "arrived") || strings.Contains(text, "ended") || strings.Contains(text, "complete"):
+		return checkInArrived
+	case strings.Contains(text, "cancel"):
+		return checkInCancelled
+	case strings.Contains(text, "started") || strings.Contains(text, "start"):
+		return checkInStarted
+	}
+	return checkInUnknown
+}
+
+// Text renders the notice body for the given sender display name.
+func (n checkInNotice) Text(name string) string {
+	switch n.Kind {
+	case checkInStarted:
+		text := "🧭 " + name + " started a Check In"
+		if n.Destination != "" {
+			text += " to " + n.Destination
+		}
+		if !n.ETA.IsZero() {
+			text += ", expected by " + n.ETA.Local().Format("15:04")
+		}
+		return text
+	case checkInArrived:
+		if n.Destination != "" {
+			return "✅ " + name + " arrived at " + n.Destination
+		}
+		return "✅ " + name + " arrived"
+	case checkInOverdue:
+		return "⚠️ " + name + "'s Check In is overdue"
+	case checkInCancelled:
+		return "🧭 " + name + " ended their Check In"
+	default:
+		return "🧭 " + name + " sent a Check In update"
+	}
+}
+
+// handleCheckIn posts a bot notice for a Check In balloon into the portal of
+// the chat it was sent in. Stored messages are dropped like other
+// notification-style events: a replayed "started" hours later is misleading.
+func (c *IMClient) handleCheckIn(log zerolog.Logger, msg rustpushgo.WrappedMessage) {
+	if msg.IsStoredMessage {
+		log.Debug().Msg("Skipping stored Check In message")
+		return
+	}
+
+	ctx := context.Background()
+	portalKey := c.makePortalKey(msg.Participants, msg.GroupName, msg.Sender, msg.SenderGuid)
+	portal, err := c.Main.Bridge.GetExistingPortalByKey(ctx, portalKey)
+	if err != nil || portal == nil || portal.MXID == "" {
+		log.Debug().Err(err).Msg("CheckIn: no portal found, skipping notice")
+		return
+	}
+
+	senderHandle := ptrStringOr(msg.Sender, "")
+	name := stripIdentifierPrefix(senderHandle)
+	if senderHandle != "" {
+		ghost, ghostErr := c.Main.Bridge.GetGhostByID(ctx, makeUserID(normalizeIdentifierForPortalID(senderHandle)))
+		if ghostErr == nil && ghost != nil && ghost.Name != "" {
+			name = ghost.Name
+		}
+	}
+	if name == "" {
+		name = "someone"
+	}
+
+	notice := parseCheckIn(ptrStringOr(msg.BalloonUrl, ""), ptrStringOr(msg.BalloonLdText, ""))
+	log.Info().
+		Str("sender", senderHandle).
+		Str("subtype", notice.Subtype).
+		Str("portal_mxid", string(portal.MXID)).
+		Msg("CheckIn: posting notice")
+
+	_, sendErr := c.Main.Bridge.Bot.SendMessage(ctx, portal.MXID, event.EventMessage, &event.Content{
+		Parsed: &event.MessageEventContent{
+			MsgType:  event.MsgNotice,
+			Body:     notice.Text(name),
+			Mentions: &event.Mentions{},
+		},
+	}, nil)
+	if sendErr != nil {
+		log.Warn().Err(sendErr).Msg("CheckIn: failed to send notice")
+	}
+}
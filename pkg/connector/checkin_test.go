@@ -0,0 +1,107 @@
+package connector
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIsCheckInBalloon(t *testing.T) {
+	tests := []struct {
+		bundleID string
+		want     bool
+	}{
+		{"com.apple.messages.MSMessageExtensionBalloonPlugin:0000000000:com.apple.SafetyMonitorApp.SafetyMonitorMessages", true},
+		{"com.apple.messages.MSMessageExtensionBalloonPlugin:0000000000:com.apple.PassbookUIService.PeerPaymentMessagesExtension", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := isCheckInBalloon(tt.bundleID); got != tt.want {
+			t.Errorf("isCheckInBalloon(%q) = %v, want %v", tt.bundleID, got, tt.want)
+		}
+	}
+}
+
+func TestParseCheckIn(t *testing.T) {
+	tests := []struct {
+		name     string
+		url      string
+		ldText   string
+		wantKind checkInKind
+		wantDest string
+		wantETA  time.Time
+	}{
+		{
+			name:     "started with destination and eta",
+			url:      "data:?messageType=1&sessionID=ABC&destinationName=Home&estimatedEndTime=1700000000",
+			wantKind: checkInStarted,
+			wantDest: "Home",
+			wantETA:  time.Unix(1700000000, 0),
+		},
+		{
+			name:     "arrived by name, mixed-case keys",
+			url:      "?MessageType=ended&DestinationName=Work",
+			wantKind: checkInArrived,
+			wantDest: "Work",
+		},
+		{
+			name:     "overdue with millisecond eta",
+			url:      "?messageType=timeout&estimatedEndTime=1700000000000",
+			wantKind: checkInOverdue,
+			wantETA:  time.UnixMilli(1700000000000),
+		},
+		{
+			name:     "cancelled",
+			url:      "?type=cancelled",
+			wantKind: checkInCancelled,
+		},
+		{
+			name:     "unknown subtype",
+			url:      "?messageType=42",
+			wantKind: checkInUnknown,
+		},
+		{
+			name:     "no payload falls back to summary text",
+			url:      "",
+			ldText:   "Check In: Overdue",
+			wantKind: checkInOverdue,
+		},
+		{
+			name:     "nothing usable",
+			wantKind: checkInUnknown,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseCheckIn(tt.url, tt.ldText)
+			if got.Kind != tt.wantKind {
+				t.Errorf("Kind = %v, want %v", got.Kind, tt.wantKind)
+			}
+			if got.Destination != tt.wantDest {
+				t.Errorf("Destination = %q, want %q", got.Destination, tt.wantDest)
+			}
+			if !got.ETA.Equal(tt.wantETA) {
+				t.Errorf("ETA = %v, want %v", got.ETA, tt.wantETA)
+			}
+		})
+	}
+}
+
+func TestCheckInNoticeText(t *testing.T) {
+	tests := []struct {
+		notice checkInNotice
+		want   string
+	}{
+		{checkInNotice{Kind: checkInStarted}, "🧭 Alice started a Check In"},
+		{checkInNotice{Kind: checkInStarted, Destination: "Home"}, "🧭 Alice started a Check In to Home"},
+		{checkInNotice{Kind: checkInArrived}, "✅ Alice arrived"},
+		{checkInNotice{Kind: checkInArrived, Destination: "Home"}, "✅ Alice arrived at Home"},
+		{checkInNotice{Kind: checkInOverdue}, "⚠️ Alice's Check In is overdue"},
+		{checkInNotice{Kind: checkInCancelled}, "🧭 Alice ended their Check In"},
+		{checkInNotice{Kind: checkInUnknown, Subtype: "42"}, "🧭 Alice sent a Check In update"},
+	}
+	for _, tt := range tests {
+		if got := tt.notice.Text("Alice"); got != tt.want {
+			t.Errorf("Text() = %q, want %q", got, tt.want)
+		}
+	}
+}
@@ -11,10 +11,9 @@ package connector
 import (
 	"bytes"
 	"context"
-	"crypto/sha256"
 	"encoding/base64"
-	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html"
 	"image"
@@ -226,6 +225,9 @@ type IMClient struct {
 	connection *rustpushgo.WrappedApsConnection
 	handle     string   // Primary iMessage handle used for sending (e.g., tel:+1234567890)
 	allHandles []string // All registered handles (for IsThisUser checks)
+	// hardwareKey is the key the config was created from: the login's, or a
+	// copy pointing at a relay found over mDNS (relay_discovery.go).
+	hardwareKey string
 
 	// iCloud token provider (auth for CardDAV, CloudKit, etc.)
 	tokenProvider **rustpushgo.WrappedTokenProvider
@@ -376,6 +378,28 @@ type IMClient struct {
 	recentUnsends     map[string]time.Time
 	recentUnsendsLock sync.Mutex
 
+	// Echoes of renames sent from Matrix (group_rename.go)
+	outboundRenames outboundRenameSet
+
+	// Group renames and membership changes held back to be coalesced
+	// (group_notice_coalesce.go)
+	groupNotices groupNoticeCoalescer
+
+	// Delivery/read receipt re-delivery suppression (receipt_dedup.go)
+	recentReceipts receiptDedupSet
+
+	// Highest receipt state per outgoing message (receipt_state.go)
+	receiptStates messageReceiptStates
+
+	// Typing indicator expiry per portal member (typing_expiry.go)
+	typingExpiry typingExpiry
+
+	// UUIDs of messages sent from Matrix, to drop their echoes (own_echo.go)
+	recentOutboundSends receiptDedupSet
+
+	// cloudFetchLimiter paces CloudFetchRecentMessages calls.
+	cloudFetchLimiter cloudFetchLimiter
+
 	// SMS reaction echo suppression: tracks UUIDs of SMS reaction messages sent
 	// from Matrix so the outgoing echo from the iPhone relay is not processed as
 	// a duplicate plain-text message in the Matrix room.
@@ -391,6 +415,42 @@ type IMClient struct {
 	// SMS portal tracking: portal IDs known to be SMS-only contacts
 	smsPortals     map[string]bool
 	smsPortalsLock sync.RWMutex
+	// smsRelayEnabled mirrors UserLoginMetadata.SMSRelay; gates the
+	// automatic SMS fallback (sms_fallback.go).
+	smsRelayEnabled atomic.Bool
+	// reachability caches per-target iMessage reachability for per-send
+	// DM transport selection (transport_select.go).
+	reachability reachabilityCache
+	// avatarIDs memoizes contact/profile avatar IDs (avatar_id.go).
+	avatarIDs avatarIDCache
+	// fallbackAvatars keeps generated avatars (fallback_avatar.go).
+	fallbackAvatars fallbackAvatarCache
+	// doublePuppetRetry throttles ensureDoublePuppet
+	// (double_puppet_health.go).
+	doublePuppetRetry doublePuppetRetryState
+	// portalCatchUp tracks when each portal was last checked for missed
+	// messages (portal_catchup.go).
+	portalCatchUp portalCatchUpState
+	// replayBacklogs holds live messages past realtime_max_age_hours until
+	// they're backfilled (replay_backlog.go).
+	replayBacklogs replayBacklogState
+	// groupJoinBackfills tracks the groups whose recent messages were
+	// fetched after joining (group_join_backfill.go).
+	groupJoinBackfills groupJoinBackfillState
+	// credentialFailureReported is set once a lost keystore or rejected
+	// Apple ID was reported (credential_failure.go).
+	credentialFailureReported atomic.Bool
+	// pendingSends holds messages Apple will retry after a transient
+	// error until they're delivered or time out (send_pending.go).
+	pendingSends pendingSendState
+
+	// peerReceipts tracks whether DM contacts send read receipts
+	// (peer_read_receipts.go).
+	peerReceipts peerReceiptTracker
+
+	// contactNames remembers the contact name fields ghosts were last
+	// refreshed with (contact_names.go).
+	contactNames contactNameSnapshots
 
 	// Initial sync gate: closed once initial sync completes (or is skipped),
 	// so real-time messages don't race ahead of backfill.
@@ -434,6 +494,10 @@ type IMClient struct {
 	// has newer messages.
 	queuedPortals map[string]int64
 
+	// cloudPortalImports counts new CloudKit messages per portal for
+	// createPortalsFromCloudSync (cloud_upsert_grouping.go).
+	cloudPortalImports cloudPortalImports
+
 	// recentlyDeletedPortals tracks portal IDs that were deleted this
 	// session. Populated by:
 	// - CloudKit tombstones (ingestCloudChats, during sync before cloudSyncDone)
@@ -523,9 +587,12 @@ var _ bridgev2.ReactionHandlingNetworkAPI = (*IMClient)(nil)
 var _ bridgev2.ReadReceiptHandlingNetworkAPI = (*IMClient)(nil)
 var _ bridgev2.TypingHandlingNetworkAPI = (*IMClient)(nil)
 var _ bridgev2.IdentifierResolvingNetworkAPI = (*IMClient)(nil)
+var _ bridgev2.GroupCreatingNetworkAPI = (*IMClient)(nil)
 var _ bridgev2.BackfillingNetworkAPI = (*IMClient)(nil)
 var _ bridgev2.BackfillingNetworkAPIWithLimits = (*IMClient)(nil)
 var _ bridgev2.DeleteChatHandlingNetworkAPI = (*IMClient)(nil)
+var _ bridgev2.MembershipHandlingNetworkAPI = (*IMClient)(nil)
+var _ bridgev2.RoomNameHandlingNetworkAPI = (*IMClient)(nil)
 var _ rustpushgo.MessageCallback = (*IMClient)(nil)
 var _ rustpushgo.UpdateUsersCallback = (*IMClient)(nil)
 var _ rustpushgo.StatusCallback = (*IMClient)(nil)
@@ -678,24 +745,23 @@ func (c *IMClient) sendGhostReadReceipt(
 
 	// Step 3: Look up the target message in the bridge DB and ensure we target
 	// the same room as the portal to avoid "target event in different room".
-	dbMessages, err := c.Main.Bridge.DB.Message.GetAllPartsByID(ctx, portalKey.Receiver, makeMessageID(guid))
-	if err != nil || len(dbMessages) == 0 {
+	// Receipts for messages sent from the user's other Apple devices may name
+	// a GUID the bridge never saw; those mark up to the read time instead.
+	targetMsg, exact, err := findReceiptTarget(ctx, c.Main.Bridge.DB.Message, portalKey, guid, readTime)
+	if err != nil || targetMsg == nil {
 		log.Debug().Err(err).Str("portal_id", string(portalKey.ID)).Str("guid", guid).
-			Msg("Target message not in bridge DB, falling back to QueueRemoteEvent with ReadUpTo")
+			Msg("No target message in bridge DB, falling back to QueueRemoteEvent with ReadUpTo")
 		c.queueGhostReceiptFallback(ghostUserID, portalKey, guid, readTime)
 		return
 	}
-	targetMsg := dbMessages[0]
-	for _, candidate := range dbMessages {
-		if candidate.HasFakeMXID() {
-			continue
-		}
-		if candidate.Room.ID == portalKey.ID && candidate.Room.Receiver == portalKey.Receiver {
-			targetMsg = candidate
-			break
-		}
+	if !exact {
+		log.Debug().
+			Str("portal_id", string(portalKey.ID)).
+			Str("guid", guid).
+			Str("fallback_target", string(targetMsg.ID)).
+			Msg("Read receipt target not in bridge DB, marking read up to the receipt time")
 	}
-	if targetMsg == nil || targetMsg.HasFakeMXID() {
+	if targetMsg.HasFakeMXID() {
 		log.Debug().
 			Str("portal_id", string(portalKey.ID)).
 			Str("guid", guid).
@@ -753,6 +819,31 @@ func (c *IMClient) sendGhostReadReceipt(
 		Msg("Set ghost read receipt via SetReadMarkers with correct timestamp")
 }
 
+// findReceiptTarget returns the bridged message a read receipt for guid
+// should point at in portalKey. It prefers a real (non-fake) part of guid in
+// portalKey's room, then any part of guid. If guid isn't in the bridge DB at
+// all — typically a message the user sent from their iPhone or Mac that
+// never went through the bridge — it falls back to the last bridged message
+// at or before readTime, since reading a message means everything before it
+// was read too. exact reports whether guid itself was found; a nil message
+// means there is nothing to mark.
+func findReceiptTarget(ctx context.Context, mq *database.MessageQuery, portalKey networkid.PortalKey, guid string, readTime time.Time) (msg *database.Message, exact bool, err error) {
+	parts, err := mq.GetAllPartsByID(ctx, portalKey.Receiver, makeMessageID(guid))
+	if err != nil {
+		return nil, false, err
+	}
+	if len(parts) > 0 {
+		for _, candidate := range parts {
+			if !candidate.HasFakeMXID() && candidate.Room == portalKey {
+				return candidate, true, nil
+			}
+		}
+		return parts[0], true, nil
+	}
+	msg, err = mq.GetLastNonFakePartAtOrBeforeTime(ctx, portalKey, readTime)
+	return msg, false, err
+}
+
 // queueGhostReceiptFallback sends a ghost read receipt via the standard
 // QueueRemoteEvent path. The homeserver may ignore BeeperReadExtra["ts"]
 // (showing server time instead), but the receipt itself will still be created.
@@ -863,6 +954,7 @@ func (c *IMClient) loadSenderGuidsFromDB(log zerolog.Logger) {
 	c.migrateSmsSuffixPortals(log, ctx, portals)
 
 	loadedGuids := 0
+	hasSMSPortal := false
 	for _, portal := range portals {
 		if portal.Receiver != c.UserLogin.ID {
 			continue // Skip portals for other users
@@ -876,6 +968,7 @@ func (c *IMClient) loadSenderGuidsFromDB(log zerolog.Logger) {
 			}
 			if meta.IsSms {
 				c.updatePortalSMS(string(portal.ID), true)
+				hasSMSPortal = true
 			}
 			// NOTE: Do NOT pre-populate imGroupNames from portal metadata.
 			// The metadata GroupName can be stale (polluted by previous CloudKit
@@ -889,6 +982,7 @@ func (c *IMClient) loadSenderGuidsFromDB(log zerolog.Logger) {
 	if loadedGuids > 0 {
 		log.Info().Int("count", loadedGuids).Msg("Pre-populated sender_guid cache from database")
 	}
+	c.migrateSMSRelayState(log, hasSMSPortal)
 }
 
 // migrateSmsSuffixPortals re-IDs portals whose IDs contain stale Apple SMS
@@ -973,6 +1067,7 @@ func (c *IMClient) Connect(ctx context.Context) {
 	c.UserLogin.BridgeState.Send(status.BridgeState{StateEvent: status.StateConnecting})
 
 	rustpushgo.InitLogger()
+	c.initSMSRelayState()
 
 	// Validate that the software keystore still has the signing keys referenced
 	// by the saved user state.  If the keystore file was deleted/reset while the
@@ -996,36 +1091,16 @@ func (c *IMClient) Connect(ctx context.Context) {
 	}
 
 	// Restore token provider from persisted credentials if not already set
+	tokenProviderRestoreFailed := false
 	if c.tokenProvider == nil || *c.tokenProvider == nil {
-		meta := c.UserLogin.Metadata.(*UserLoginMetadata)
-		if meta.AccountUsername != "" && meta.AccountPET != "" && meta.AccountSPDBase64 != "" {
+		if c.hasPersistedTokenProviderCredentials() {
 			log.Info().Msg("Restoring iCloud TokenProvider from persisted credentials")
-			tp, err := safeRestoreTokenProvider(c.config, c.connection,
-				meta.AccountUsername, meta.AccountHashedPasswordHex,
-				meta.AccountPET, meta.AccountSPDBase64)
-			if err != nil {
-				log.Warn().Err(err).Msg("Failed to restore TokenProvider — cloud services unavailable")
-			} else {
-				c.tokenProvider = &tp
-				// Seed the persisted MobileMe delegate so CloudKit / keychain
-				// ops have something to work with on first use. The wrapper's
-				// RestoreTokenProvider path intentionally returns a
-				// WrappedTokenProvider with empty mme_delegate_bytes (see
-				// pkg/rustpushgo/src/lib.rs::restore_token_provider — "callers
-				// must seed_mme_delegate_json() from persisted state before
-				// using keychain/contacts features"), so we seed it here. The
-				// delegate is whatever was captured during the most recent
-				// successful login; if it's expired, CloudKit calls will
-				// surface an auth error and the user can re-login.
-				if meta.MmeDelegateJSON != "" {
-					if seedErr := tp.SeedMmeDelegateJson(meta.MmeDelegateJSON); seedErr != nil {
-						log.Warn().Err(seedErr).Msg("Failed to seed persisted MobileMe delegate — CloudKit unavailable until re-login")
-					} else {
-						log.Info().Msg("Seeded persisted MobileMe delegate into restored TokenProvider")
-					}
-				} else {
-					log.Warn().Msg("TokenProvider restored but no persisted MobileMe delegate — CloudKit unavailable until re-login captures a fresh one")
+			if err := c.restoreTokenProvider(log); err != nil {
+				if c.checkCredentialFailure(err) {
+					return
 				}
+				log.Warn().Err(err).Msg("Failed to restore TokenProvider — cloud services unavailable, will retry periodically")
+				tokenProviderRestoreFailed = true
 			}
 		}
 	}
@@ -1033,6 +1108,10 @@ func (c *IMClient) Connect(ctx context.Context) {
 	client, err := rustpushgo.NewClient(c.connection, c.users, c.identity, c.config, c.tokenProvider, c, c)
 	if err != nil {
 		log.Err(err).Msg("Failed to create rustpush client")
+		c.reportErrorNotice(errorNoticeConnectFailed, "", err)
+		if c.checkCredentialFailure(err) {
+			return
+		}
 		c.UserLogin.BridgeState.Send(status.BridgeState{
 			StateEvent: status.StateBadCredentials,
 			Message:    fmt.Sprintf("Failed to connect: %v", err),
@@ -1381,7 +1460,19 @@ func (c *IMClient) Connect(ctx context.Context) {
 		} else if healed > 0 {
 			log.Info().Int("healed", healed).Msg("Healed mis-routed group messages at startup")
 		}
+		if fts, err := c.cloudStore.setupMessageSearch(context.Background(), c.Main.Config.MessageSearchFTS); err != nil {
+			log.Warn().Err(err).Msg("Failed to set up message search index, search will scan messages")
+		} else if c.Main.Config.MessageSearchFTS && !fts {
+			log.Info().Msg("SQLite has no FTS5 support, message search will scan messages")
+		}
+		go c.periodicDeletedMessagePrune(log)
+		go c.periodicAbandonedPortalCleanup(log)
+		go c.periodicOrphanedMessageCleanup(log)
+		go c.periodicPendingCloudDeletions(log)
 	}
+	go c.periodicMatrixRetention(log)
+	go c.periodicSMSUpgradeCheck(log)
+	go c.ensureQuietBackfillPushRule(log)
 	c.UserLogin.BridgeState.Send(status.BridgeState{StateEvent: status.StateConnected})
 
 	// Backstop the APNs receive path: if it goes fully silent (no frames, not
@@ -1390,6 +1481,7 @@ func (c *IMClient) Connect(ctx context.Context) {
 	// receiving" reconnect-storm stall without a manual restart. Passed
 	// c.stopChan by value so it tracks this connect epoch.
 	go c.runReceiveWedgeWatchdog(c.stopChan, log.With().Str("component", "receive_wedge_watchdog").Logger())
+	go c.runRelayHealthMonitor(c.stopChan, log.With().Str("component", "relay_health").Logger())
 
 	// Eagerly silence bridge bot push notifications so the rule is in place
 	// before any bot message (StatusKit notices, admin messages, etc.) fires.
@@ -1427,7 +1519,7 @@ func (c *IMClient) Connect(ctx context.Context) {
 			log.Warn().Msg("Local macOS contacts unavailable — contact names will not be resolved")
 		}
 	} else {
-		cloudContacts := newCloudContactsClient(c.client, log)
+		cloudContacts := newCloudContactsClient(c.client, c.accountRegion, log)
 		if cloudContacts != nil {
 			c.contacts = cloudContacts
 			log.Info().Str("url", cloudContacts.baseURL).Msg("Cloud contacts available (iCloud CardDAV)")
@@ -1438,6 +1530,11 @@ func (c *IMClient) Connect(ctx context.Context) {
 				c.persistMmeDelegate(log)
 			}
 			go c.periodicCloudContactSync(log)
+		} else if tokenProviderRestoreFailed {
+			// The rust Client was built without a TokenProvider, so
+			// retryCloudContacts can never succeed; retry the restore
+			// itself and bring contacts up from the restored provider.
+			go c.retryTokenProviderRestore(log)
 		} else {
 			// No cloud contacts available — retry periodically.
 			// The MobileMe delegate may have been expired on startup;
@@ -1449,17 +1546,20 @@ func (c *IMClient) Connect(ctx context.Context) {
 
 	if c.Main.Config.UseChatDBBackfill() {
 		// Chat.db backfill: read local macOS Messages database
-		c.chatDB = openChatDB(log)
+		c.chatDB = openChatDB(log, c.Main.Config.ChatDBPath)
 		if c.chatDB != nil {
 			log.Info().Msg("Chat.db available for backfill")
 			go c.runChatDBInitialSync(log)
+			go c.periodicPinnedChatSync(log)
 		} else {
 			log.Warn().Msg("Chat.db backfill configured but chat.db not accessible")
 		}
 		// No CloudKit gate needed — open immediately
 		c.setCloudSyncDone()
 	} else if cloudStoreReady && c.useCloudKitBackfill() {
+		c.openChatDBBackfillFallback(log)
 		c.startCloudSyncController(log)
+		go c.runPortalReconciliation(log)
 	} else {
 		if !c.Main.Config.CloudKitBackfill {
 			log.Info().Msg("CloudKit backfill disabled by config — skipping cloud sync")
@@ -2422,6 +2522,7 @@ func (c *IMClient) eagerResolveReshareSender(sender, normalizedUser string, log
 
 // OnMessage is called by rustpush when a message is received via APNs.
 func (c *IMClient) OnMessage(msg rustpushgo.WrappedMessage) {
+	c.Main.metrics.messageReceived(inboundMessageType(&msg))
 	log := c.UserLogin.Log.With().
 		Str("component", "imessage").
 		Str("msg_uuid", msg.Uuid).
@@ -2464,22 +2565,22 @@ func (c *IMClient) OnMessage(msg rustpushgo.WrappedMessage) {
 		c.handleReadReceipt(log, msg)
 		return
 	}
-	if msg.IsTyping {
+	if msg.IsTyping || msg.IsTypingStop {
 		c.handleTyping(log, msg)
 		return
 	}
 	if msg.IsError {
-		log.Warn().
-			Str("for_uuid", ptrStringOr(msg.ErrorForUuid, "")).
-			Uint64("status", ptrUint64Or(msg.ErrorStatus, 0)).
-			Str("status_str", ptrStringOr(msg.ErrorStatusStr, "")).
-			Msg("Received iMessage error")
+		c.handleMessageError(log, msg)
 		return
 	}
 	if msg.IsPeerCacheInvalidate {
 		log.Debug().Msg("Peer cache invalidated")
 		return
 	}
+	if msg.IsSmsActivation != nil {
+		c.setSMSRelay(log, *msg.IsSmsActivation)
+		return
+	}
 	if msg.IsMoveToRecycleBin || msg.IsPermanentDelete {
 		c.handleChatDelete(log, msg)
 		return
@@ -2565,9 +2666,34 @@ func (c *IMClient) OnMessage(msg rustpushgo.WrappedMessage) {
 		go c.handleNotifyAnyways(log, msg)
 		return
 	}
+	// Check In (safety feature) balloons carry no text or attachments and
+	// would otherwise be dropped as empty messages; post a notice instead.
+	if isCheckInBalloon(ptrStringOr(msg.BalloonBundleId, "")) {
+		if c.cloudStore != nil {
+			if known, _ := c.cloudStore.hasMessageUUID(context.Background(), msg.Uuid); known {
+				return
+			}
+			if err := c.cloudStore.persistMessageUUID(context.Background(), msg.Uuid, "", int64(msg.TimestampMs), false); err != nil {
+				log.Warn().Err(err).Str("uuid", msg.Uuid).Msg("Failed to persist Check In UUID; duplicates possible on restart")
+			}
+		}
+		go c.handleCheckIn(log, msg)
+		return
+	}
 	if msg.IsSetTranscriptBackground {
 		return
 	}
+	// Audio message played/kept, mark unread, read on another device, … —
+	// nothing to bridge, and handleMessage would record them as messages.
+	if isContentlessMessage(&msg) {
+		log.Debug().
+			Bool("mark_unread", msg.IsMarkUnread).
+			Bool("read_on_device", msg.IsMessageReadOnDevice).
+			Bool("unschedule", msg.IsUnschedule).
+			Bool("update_extension", msg.IsUpdateExtension).
+			Msg("Ignoring control message without content")
+		return
+	}
 
 	// Buffer regular messages, tapbacks, and edits for timestamp-based
 	// reordering. APNs delivers messages grouped by sender rather than
@@ -2665,9 +2791,31 @@ func (c *IMClient) UpdateUsers(users *rustpushgo.WrappedIdsUsers) {
 // Incoming message handlers
 // ============================================================================
 
+// realtimeMaxAge returns the realtime_max_age_hours cutoff, or 0 if disabled.
+func (c *IMClient) realtimeMaxAge() time.Duration {
+	hours := c.Main.Config.RealtimeMaxAgeHours
+	if hours <= 0 {
+		return 0
+	}
+	return time.Duration(hours) * time.Hour
+}
+
+// realtimeMessageTooOld reports whether a live message sent at msgTS (Unix
+// ms) is past the realtime_max_age_hours cutoff. Messages without a
+// timestamp are never considered too old.
+func realtimeMessageTooOld(msgTS int64, now time.Time, maxAge time.Duration) bool {
+	return maxAge > 0 && msgTS > 0 && now.Sub(time.UnixMilli(msgTS)) > maxAge
+}
+
 func (c *IMClient) handleMessage(log zerolog.Logger, msg rustpushgo.WrappedMessage) {
+	if msg.Uuid == "" {
+		// Without a UUID the message would get an empty ID and skip every
+		// dedup check below; use a deterministic synthetic one instead.
+		msg.Uuid = apnsMessageGUID(&msg, msg.Sender != nil && c.isMyHandle(*msg.Sender))
+		log.Warn().Str("synthetic_guid", msg.Uuid).Msg("Message has no UUID, using synthetic ID")
+	}
 	if c.wasUnsent(msg.Uuid) {
-		log.Debug().Str("uuid", msg.Uuid).Msg("Suppressing re-delivery of unsent message")
+		log.Debug().Str("uuid", msg.Uuid).Msg("Suppressing re-delivery of unsent or deleted message")
 		return
 	}
 	if c.wasSmsReactionEcho(msg.Uuid) {
@@ -2689,6 +2837,7 @@ func (c *IMClient) handleMessage(log zerolog.Logger, msg rustpushgo.WrappedMessa
 			// Apple's SMS relay can reuse UUIDs across different short-code
 			// conversations, causing false-positive dedup drops.
 			if dbMsgs[0].Room.ID == portalKey.ID {
+				c.applySendAck(context.Background(), log, &msg, dbMsgs)
 				log.Debug().Str("uuid", msg.Uuid).Bool("is_stored", msg.IsStoredMessage).Msg("Skipping message already in bridge DB")
 				return
 			}
@@ -2728,10 +2877,24 @@ func (c *IMClient) handleMessage(log zerolog.Logger, msg rustpushgo.WrappedMessa
 		}
 	}
 
+	// Echo of a message sent from Matrix that bridgev2 hasn't stored yet.
+	// Checked after the bridge DB lookup so a stored one still gets its
+	// send ack.
+	if c.isOutboundEcho(&msg) || c.isSplitPartEcho(context.Background(), &msg) {
+		log.Debug().Str("uuid", msg.Uuid).Msg("Suppressing echo of message sent from Matrix")
+		return
+	}
+
 	sender := c.makeEventSender(msg.Sender)
 	portalKey := c.makePortalKey(msg.Participants, msg.GroupName, msg.Sender, msg.SenderGuid)
 	sender = c.canonicalizeDMSender(portalKey, sender)
 
+	// Senders blocked with the block / report-junk commands.
+	if c.isBlockedSender(context.Background(), msg.Sender, portalKey) {
+		log.Debug().Str("uuid", msg.Uuid).Str("portal_id", string(portalKey.ID)).Msg("Dropping message from blocked sender")
+		return
+	}
+
 	// Keep the stored gid: group roster in sync with the sender's current view
 	// of the conversation. Only trust live (non-stored) messages — a stored
 	// backfill message carries the membership as it was at that message's time,
@@ -2788,6 +2951,9 @@ func (c *IMClient) handleMessage(log zerolog.Logger, msg rustpushgo.WrappedMessa
 	// Track SMS portals so outbound replies use the correct service type.
 	// Unconditional so SMS→iMessage transitions are reflected immediately.
 	smsChanged := c.updatePortalSMS(string(portalKey.ID), msg.IsSms)
+	if msg.IsSms {
+		c.setSMSRelay(log, true)
+	}
 
 	// Only create new portals after CloudKit sync is done.
 	cloudSyncDone := c.isCloudSyncDone()
@@ -2991,6 +3157,18 @@ func (c *IMClient) handleMessage(log zerolog.Logger, msg rustpushgo.WrappedMessa
 			log.Warn().Err(err).Str("uuid", msg.Uuid).Msg("Failed to persist message UUID; duplicates may occur on restart")
 		}
 	}
+	// Replay flood guard (realtime_max_age_hours). Runs after every dedup
+	// and deleted-chat check, so only a message that would have been
+	// bridged live goes to backfill instead (see replay_backlog.go).
+	if realtimeMessageTooOld(int64(msg.TimestampMs), time.Now(), c.realtimeMaxAge()) {
+		log.Info().
+			Str("uuid", msg.Uuid).
+			Bool("is_stored", msg.IsStoredMessage).
+			Time("msg_ts", time.UnixMilli(int64(msg.TimestampMs))).
+			Msg("Message older than realtime_max_age_hours, routing it to backfill")
+		c.queueReplayedMessage(log, portalKey, createPortal, sender, msg)
+		return
+	}
 	c.maybeNotifyIncomingFaceTimeInvite(log, &msg, portalKey, sender.IsFromMe, createPortal)
 	if createPortal || sender.IsFromMe {
 		log.Info().
@@ -3001,8 +3179,16 @@ func (c *IMClient) handleMessage(log zerolog.Logger, msg rustpushgo.WrappedMessa
 			Str("portal_id", string(portalKey.ID)).
 			Msg("Portal creation decision for message")
 	}
+	if createPortal && missingPortal && !msg.IsStoredMessage {
+		c.maybeBackfillGroupJoin(log, portalKey, ptr.Val(msg.SenderGuid), time.UnixMilli(msgTS))
+	}
 
-	hasText := msg.Text != nil && *msg.Text != "" && strings.TrimRight(*msg.Text, "\ufffc \n") != ""
+	// A subject line on its own still gets a text part (bridged as a
+	// notice by subjectMessageContent), matching CloudKit backfill.
+	hasText := wrappedMessageHasText(&msg)
+	// Text first, then the attachments in order (see stream_order.go).
+	liveTS := time.UnixMilli(msgTS)
+	part := 0
 	if hasText {
 		c.Main.Bridge.QueueRemoteEvent(c.UserLogin, &simplevent.Message[*rustpushgo.WrappedMessage]{
 			EventMeta: simplevent.EventMeta{
@@ -3010,64 +3196,135 @@ func (c *IMClient) handleMessage(log zerolog.Logger, msg rustpushgo.WrappedMessa
 				PortalKey:    portalKey,
 				CreatePortal: createPortal,
 				Sender:       sender,
-				Timestamp:    time.UnixMilli(int64(msg.TimestampMs)),
+				Timestamp:    liveTS,
+				StreamOrder:  liveStreamOrder(liveTS, msg.Uuid, part),
 				LogContext: func(lc zerolog.Context) zerolog.Context {
 					return lc.Str("msg_uuid", msg.Uuid)
 				},
 			},
 			Data:               &msg,
 			ID:                 makeMessageID(msg.Uuid),
-			ConvertMessageFunc: convertMessage,
+			ConvertMessageFunc: c.convertLiveText,
 		})
+		part++
 	}
 
-	// Live Photo handling: bridge both the still image and the video.
-	attIndex := 0
-	for _, att := range msg.Attachments {
-		// Skip rich link sideband attachments (handled in convertMessage)
-		if att.MimeType == "x-richlink/meta" || att.MimeType == "x-richlink/image" {
-			continue
-		}
-		attID := msg.Uuid
-		if attIndex > 0 || hasText {
-			attID = fmt.Sprintf("%s_att%d", msg.Uuid, attIndex)
-		}
-		attMsg := &attachmentMessage{
-			WrappedMessage: &msg,
-			Attachment:     &att,
-			Index:          attIndex,
-		}
-		attIndex++
+	for _, attMsg := range liveAttachmentMessages(&msg, hasText) {
+		attID := attMsg.ID
 		c.Main.Bridge.QueueRemoteEvent(c.UserLogin, &simplevent.Message[*attachmentMessage]{
 			EventMeta: simplevent.EventMeta{
 				Type:         bridgev2.RemoteEventMessage,
 				PortalKey:    portalKey,
 				CreatePortal: createPortal,
 				Sender:       sender,
-				Timestamp:    time.UnixMilli(int64(msg.TimestampMs)),
+				Timestamp:    liveTS,
+				StreamOrder:  liveStreamOrder(liveTS, msg.Uuid, part),
 				LogContext: func(lc zerolog.Context) zerolog.Context {
-					return lc.Str("msg_uuid", attID)
+					return lc.Str("msg_uuid", string(attID))
 				},
 			},
-			Data: attMsg,
-			ID:   makeMessageID(attID),
-			ConvertMessageFunc: func(ctx context.Context, portal *bridgev2.Portal, intent bridgev2.MatrixAPI, data *attachmentMessage) (*bridgev2.ConvertedMessage, error) {
-				// Layer-2 MMCS retry enqueue: when download_mmcs_attachments
-				// (pkg/rustpushgo/src/lib.rs) exhausts the Layer-1 retries,
-				// it leaves the attachment non-inline with no bytes but
-				// keeps the MMCS descriptor JSON. Record that shape so the
-				// background retrier can replay the download later and edit
-				// the notice placeholder into the real m.image/m.video.
-				if data.Attachment != nil && !data.Attachment.IsInline &&
-					data.Attachment.InlineData == nil &&
-					data.Attachment.MmcsDescriptorJson != nil &&
-					*data.Attachment.MmcsDescriptorJson != "" {
-					c.enqueuePendingMMCSRecovery(ctx, portal, data)
-				}
-				return convertAttachment(ctx, portal, intent, data, c.videoTranscoding(), c.heicConversion(), c.Main.Config.HEICJPEGQuality)
-			},
+			Data:               attMsg,
+			ID:                 attID,
+			ConvertMessageFunc: c.convertLiveAttachment,
 		})
+		part++
+	}
+	if !sender.IsFromMe {
+		c.notePeerReply(log, portalKey, msg.IsStoredMessage)
+	}
+}
+
+// liveAttachmentMessages returns the attachment parts msg is bridged as, in
+// order. Live Photos keep both the still image and the video, with the
+// video replying to the still (see pairLivePhotos); inline-preview +
+// full-res pairs are collapsed to one attachment, and rich link sideband
+// attachments are skipped (handled in convertMessage).
+func liveAttachmentMessages(msg *rustpushgo.WrappedMessage, hasText bool) []*attachmentMessage {
+	variants := selectAttachmentVariants(msg.Attachments)
+	livePhotoStills := pairLivePhotos(variants)
+	attIDs := make([]string, len(variants))
+	attIndex := 0
+	for i, variant := range variants {
+		if isRichLinkSidebandMime(variant.Attachment.MimeType) {
+			continue
+		}
+		attIDs[i] = makeAttID(msg.Uuid, attIndex, hasText)
+		attIndex++
+	}
+	var atts []*attachmentMessage
+	attIndex = 0
+	for i, variant := range variants {
+		att := variant.Attachment
+		if attIDs[i] == "" {
+			continue
+		}
+		attMsg := &attachmentMessage{
+			WrappedMessage: msg,
+			Attachment:     &att,
+			Index:          attIndex,
+			Preview:        variant.Preview,
+			ID:             makeMessageID(attIDs[i]),
+		}
+		if stillIdx, ok := livePhotoStills[i]; ok && attIDs[stillIdx] != "" {
+			attMsg.LivePhotoStill = makeMessageID(attIDs[stillIdx])
+		}
+		attIndex++
+		atts = append(atts, attMsg)
+	}
+	return atts
+}
+
+// convertLiveText is the ConvertMessageFunc for the text part of a live
+// message.
+func (c *IMClient) convertLiveText(ctx context.Context, portal *bridgev2.Portal, intent bridgev2.MatrixAPI, data *rustpushgo.WrappedMessage) (*bridgev2.ConvertedMessage, error) {
+	cm, err := convertMessage(ctx, portal, intent, data, c.Main.Config.EffectNoteInBody)
+	if cm != nil {
+		cm.ReplyTo = c.resolveReplyTarget(cm.ReplyTo)
+		c.addReplyQuoteFallback(ctx, portal, cm)
+		c.addSelfMention(cm, data)
+		if c.Main.Config.SourceDeviceField {
+			applySourceDevice(cm, messageSourceDevice(data))
+		}
+	}
+	return cm, err
+}
+
+// convertLiveAttachment is the ConvertMessageFunc for the attachments of a
+// live message.
+func (c *IMClient) convertLiveAttachment(ctx context.Context, portal *bridgev2.Portal, intent bridgev2.MatrixAPI, data *attachmentMessage) (*bridgev2.ConvertedMessage, error) {
+	// attachment_download_rules: bridge a placeholder that the
+	// download command can replace later.
+	if cm := c.deferAttachment(data); cm != nil {
+		cm.ReplyTo = c.resolveReplyTarget(cm.ReplyTo)
+		return cm, nil
+	}
+	// Layer-2 MMCS retry enqueue: when download_mmcs_attachments
+	// (pkg/rustpushgo/src/lib.rs) exhausts the Layer-1 retries,
+	// it leaves the attachment non-inline with no bytes but
+	// keeps the MMCS descriptor JSON. Record that shape so the
+	// background retrier can replay the download later and edit
+	// the notice placeholder into the real m.image/m.video.
+	if data.Attachment != nil && !data.Attachment.IsInline &&
+		data.Attachment.InlineData == nil &&
+		data.Attachment.MmcsDescriptorJson != nil &&
+		*data.Attachment.MmcsDescriptorJson != "" {
+		c.enqueuePendingMMCSRecovery(ctx, portal, data)
+	}
+	cm, err := convertAttachment(ctx, portal, intent, data, c.videoTranscoding(), c.heicConversion(), c.Main.Config.HEICJPEGQuality, c.Main.Config.HideMediaFilenames)
+	// A homeserver hiccup shouldn't lose the media: keep the bytes and
+	// bridge a placeholder that the retrier edits once an upload works.
+	if errors.Is(err, errAttachmentUpload) {
+		if placeholder := c.enqueueFailedUpload(ctx, portal, data, err); placeholder != nil {
+			cm, err = placeholder, nil
+		}
+	}
+	if cm != nil {
+		cm.ReplyTo = c.resolveReplyTarget(cm.ReplyTo)
+		if data.LivePhotoStill != "" {
+			markLivePhotoVideo(cm, data.LivePhotoStill)
+		}
 	}
+	return cm, err
 }
 
 func (c *IMClient) handleTapback(log zerolog.Logger, msg rustpushgo.WrappedMessage) {
@@ -3115,20 +3372,27 @@ func (c *IMClient) handleTapback(log zerolog.Logger, msg rustpushgo.WrappedMessa
 		sender := c.makeEventSender(msg.Sender)
 		storedType := uint32(2000) // sentinel default (Love) when TapbackType is nil
 		if msg.TapbackType != nil {
-			storedType = *msg.TapbackType + 2000
-			if msg.TapbackRemove {
-				storedType += 1000 // removals: 3000-3006, matching TapbackRemoveOffset
-			}
+			storedType = storedTapbackType(*msg.TapbackType, msg.TapbackRemove)
 		}
 		if err := c.cloudStore.persistTapbackUUID(context.Background(), msg.Uuid, string(portalKey.ID), int64(msg.TimestampMs), sender.IsFromMe, storedType); err != nil {
 			log.Warn().Err(err).Str("uuid", msg.Uuid).Msg("Failed to persist tapback UUID; duplicates may occur on restart")
 		}
 	}
 
+	// Echo of a tapback sent from Matrix (see own_echo.go).
+	if c.isOutboundEcho(&msg) {
+		log.Debug().Str("uuid", msg.Uuid).Msg("Suppressing echo of tapback sent from Matrix")
+		return
+	}
+
 	// Sticker tapbacks (type 7) carry an image placed on top of a message
 	// bubble. Matrix reactions are text-only, so bridge the sticker as an
 	// image message replying to the target instead.
 	if msg.TapbackType != nil && *msg.TapbackType == 7 && msg.StickerData != nil && len(*msg.StickerData) > 0 {
+		stickerPart := 0
+		if msg.TapbackTargetPart != nil {
+			stickerPart = int(*msg.TapbackTargetPart)
+		}
 		stickerData := *msg.StickerData
 		stickerMime := "image/png"
 		if msg.StickerMime != nil && *msg.StickerMime != "" {
@@ -3144,7 +3408,7 @@ func (c *IMClient) handleTapback(log zerolog.Logger, msg rustpushgo.WrappedMessa
 			Data: &stickerTapbackData{
 				ImageData: stickerData,
 				MimeType:  stickerMime,
-				TargetID:  targetGUID,
+				TargetID:  c.resolveTapbackTargetID(targetGUID, stickerPart),
 			},
 			ID: makeMessageID(msg.Uuid),
 			ConvertMessageFunc: func(ctx context.Context, portal *bridgev2.Portal, intent bridgev2.MatrixAPI, data *stickerTapbackData) (*bridgev2.ConvertedMessage, error) {
@@ -3155,6 +3419,10 @@ func (c *IMClient) handleTapback(log zerolog.Logger, msg rustpushgo.WrappedMessa
 	}
 
 	emoji := tapbackTypeToEmoji(msg.TapbackType, msg.TapbackEmoji)
+	if !isKnownTapbackType(msg.TapbackType) {
+		log.Warn().Any("tapback_type", msg.TapbackType).Str("uuid", msg.Uuid).
+			Msg("Unknown tapback type, bridging it as a generic reaction")
+	}
 
 	evtType := bridgev2.RemoteEventReaction
 	if msg.TapbackRemove {
@@ -3166,12 +3434,24 @@ func (c *IMClient) handleTapback(log zerolog.Logger, msg rustpushgo.WrappedMessa
 		tapbackPart = int(*msg.TapbackTargetPart)
 	}
 	tapbackTargetMsgID := c.resolveTapbackTargetID(targetGUID, tapbackPart)
+	sender := c.canonicalizeDMSender(portalKey, c.makeEventSender(msg.Sender))
+
+	if msg.TapbackRemove && !c.removedTapbackMatches(portalKey, tapbackTargetMsgID, sender.Sender, emoji) {
+		log.Debug().Str("target_guid", targetGUID).Str("emoji", emoji).
+			Msg("Ignoring tapback removal that doesn't match the sender's current reaction")
+		return
+	}
+	if sender.IsFromMe && !msg.TapbackRemove && c.ownTapbackBridged(portalKey, tapbackTargetMsgID, sender.Sender, emoji) {
+		log.Debug().Str("target_guid", targetGUID).Str("emoji", emoji).
+			Msg("Ignoring own tapback that's already the user's reaction")
+		return
+	}
 
 	c.Main.Bridge.QueueRemoteEvent(c.UserLogin, &simplevent.Reaction{
 		EventMeta: simplevent.EventMeta{
 			Type:      evtType,
 			PortalKey: portalKey,
-			Sender:    c.canonicalizeDMSender(portalKey, c.makeEventSender(msg.Sender)),
+			Sender:    sender,
 			Timestamp: time.UnixMilli(int64(msg.TimestampMs)),
 		},
 		TargetMessage: tapbackTargetMsgID,
@@ -3179,6 +3459,30 @@ func (c *IMClient) handleTapback(log zerolog.Logger, msg rustpushgo.WrappedMessa
 	})
 }
 
+// storedTapbackType converts a rustpush tapback type (0-6) to the
+// cloud_message tapback_type: 2000-2006, or 3000-3006 for removals,
+// matching TapbackRemoveOffset.
+func storedTapbackType(tapbackType uint32, remove bool) uint32 {
+	if remove {
+		return tapbackType + 3000
+	}
+	return tapbackType + 2000
+}
+
+// removedTapbackMatches reports whether a tapback removal is for the
+// sender's current reaction on the target. Reactions are stored without an
+// emoji ID, one per sender as on iMessage, so bridgev2 would remove whatever
+// the sender has; a late removal of a tapback that has since been replaced
+// must not take the new one with it. If there's no stored reaction, or it
+// can't be read, the removal goes through and bridgev2 sorts it out.
+func (c *IMClient) removedTapbackMatches(portalKey networkid.PortalKey, targetID networkid.MessageID, senderID networkid.UserID, emoji string) bool {
+	existing, err := c.Main.Bridge.DB.Reaction.GetByIDWithoutMessagePart(context.Background(), portalKey.Receiver, targetID, senderID, "")
+	if err != nil || existing == nil {
+		return true
+	}
+	return sameTapback(existing.Emoji, emoji)
+}
+
 func (c *IMClient) handleEdit(log zerolog.Logger, msg rustpushgo.WrappedMessage) {
 	targetGUID := ptrStringOr(msg.EditTargetUuid, "")
 
@@ -3191,36 +3495,134 @@ func (c *IMClient) handleEdit(log zerolog.Logger, msg rustpushgo.WrappedMessage)
 	}
 
 	newText := ptrStringOr(msg.EditNewText, "")
+	editTS := time.UnixMilli(int64(msg.TimestampMs))
 
 	c.Main.Bridge.QueueRemoteEvent(c.UserLogin, &simplevent.Message[string]{
 		EventMeta: simplevent.EventMeta{
 			Type:      bridgev2.RemoteEventEdit,
 			PortalKey: portalKey,
 			Sender:    c.canonicalizeDMSender(portalKey, c.makeEventSender(msg.Sender)),
-			Timestamp: time.UnixMilli(int64(msg.TimestampMs)),
+			Timestamp: editTS,
 		},
 		Data:          newText,
 		ID:            makeMessageID(msg.Uuid),
 		TargetMessage: makeMessageID(targetGUID),
 		ConvertEditFunc: func(ctx context.Context, portal *bridgev2.Portal, intent bridgev2.MatrixAPI, existing []*database.Message, text string) (*bridgev2.ConvertedEdit, error) {
-			var targetPart *database.Message
-			if len(existing) > 0 {
-				targetPart = existing[0]
-			}
-			return &bridgev2.ConvertedEdit{
-				ModifiedParts: []*bridgev2.ConvertedEditPart{{
-					Part: targetPart,
-					Type: event.EventMessage,
-					Content: &event.MessageEventContent{
-						MsgType: event.MsgText,
-						Body:    text,
-					},
-				}},
-			}, nil
+			target := editTargetPart(existing)
+			if !acceptRemoteEdit(target, editTS) {
+				log.Debug().Str("target_guid", targetGUID).
+					Msg("Dropping edit older than the latest edit already applied")
+				return nil, bridgev2.ErrIgnoringRemoteEvent
+			}
+			if len(existing) > 0 && editTS.Sub(existing[0].Timestamp) > iMessageEditWindow {
+				// Apple only accepts edits inside the window, so this is an
+				// edit made on time and delivered late (or a skewed clock).
+				// It's still the sender's latest text, so apply it.
+				log.Debug().Str("target_guid", targetGUID).
+					Time("message_ts", existing[0].Timestamp).
+					Msg("Applying edit timestamped past the edit window")
+			}
+			return convertRemoteEdit(existing, text, msg.Subject, c.Main.Config.EditedMarker), nil
 		},
 	})
 }
 
+// iMessageEditWindow is how long after sending iMessage lets a message be
+// edited.
+const iMessageEditWindow = 15 * time.Minute
+
+// editTargetPart picks the part an edit applies to: the text part, which has
+// the empty part ID (attachment parts are attN), or else the first part.
+func editTargetPart(existing []*database.Message) *database.Message {
+	for _, part := range existing {
+		if part.PartID == "" {
+			return part
+		}
+	}
+	if len(existing) > 0 {
+		return existing[0]
+	}
+	return nil
+}
+
+// acceptRemoteEdit orders edits by their timestamp rather than by arrival.
+// Rapid edits can arrive out of order (APNs redelivery, the user's other
+// devices), and each carries the full new text, so an edit older than the
+// last one applied would roll the message back. It returns false for such
+// an edit (or a redelivery of the last one), and otherwise records the edit
+// on the part, which bridgev2 saves once the edit is sent.
+func acceptRemoteEdit(part *database.Message, editTS time.Time) bool {
+	if part == nil {
+		return true
+	}
+	meta, ok := part.Metadata.(*MessageMetadata)
+	if !ok || meta == nil {
+		meta = &MessageMetadata{}
+		part.Metadata = meta
+	}
+	ts := editTS.UnixMilli()
+	if meta.LastEditTS != 0 && ts <= meta.LastEditTS {
+		return false
+	}
+	meta.LastEditTS = ts
+	return true
+}
+
+// editCountField is the custom m.new_content field carrying how many times
+// the message has been edited on iMessage, for clients that want to show it.
+const editCountField = "fi.mau.imessage.edit_count"
+
+// convertRemoteEdit builds the Matrix edit for an iMessage edit. bridgev2
+// adds the m.replace relation and m.new_content wrapper (SetEdit must not be
+// called here); this picks the target part, bumps its EditCount (persisted
+// by bridgev2 after the edit is sent) and exposes the count. With
+// editedMarker the body also gets an "(edited)" suffix for clients that
+// don't render edits.
+//
+// iMessage edits carry only the new text — prior versions aren't sent, so
+// there's no history to bridge beyond the sequence of edit events itself.
+// The part's subject line (MessageMetadata.Subject) is put back above the
+// new text; subject replaces it when the edit carries one, "" removing it.
+func convertRemoteEdit(existing []*database.Message, text string, subject *string, editedMarker bool) *bridgev2.ConvertedEdit {
+	targetPart := editTargetPart(existing)
+	editCount := 1
+	var currentSubject string
+	if targetPart != nil {
+		targetPart.EditCount++
+		editCount = targetPart.EditCount
+		meta, _ := targetPart.Metadata.(*MessageMetadata)
+		if subject != nil {
+			if meta == nil {
+				meta = &MessageMetadata{}
+				targetPart.Metadata = meta
+			}
+			meta.Subject = strings.TrimSpace(*subject)
+		}
+		if meta != nil {
+			currentSubject = meta.Subject
+		}
+	} else if subject != nil {
+		currentSubject = *subject
+	}
+	content := subjectMessageContent(currentSubject, text)
+	if editedMarker {
+		content.Body += " (edited)"
+		if content.Format == event.FormatHTML {
+			content.FormattedBody += " (edited)"
+		}
+	}
+	return &bridgev2.ConvertedEdit{
+		ModifiedParts: []*bridgev2.ConvertedEditPart{{
+			Part:    targetPart,
+			Type:    event.EventMessage,
+			Content: content,
+			Extra: map[string]any{
+				editCountField: editCount,
+			},
+		}},
+	}
+}
+
 func (c *IMClient) handleUnsend(log zerolog.Logger, msg rustpushgo.WrappedMessage) {
 	targetGUID := ptrStringOr(msg.UnsendTargetUuid, "")
 
@@ -3239,6 +3641,12 @@ func (c *IMClient) handleUnsend(log zerolog.Logger, msg rustpushgo.WrappedMessag
 	if portalKey.ID == "" {
 		portalKey = c.makePortalKey(msg.Participants, msg.GroupName, msg.Sender, msg.SenderGuid)
 	}
+	// Past the in-memory window, wasUnsent relies on this record.
+	if c.cloudStore != nil && targetGUID != "" {
+		if err := c.cloudStore.markMessageUnsent(context.Background(), targetGUID, string(portalKey.ID), int64(msg.TimestampMs)); err != nil {
+			log.Warn().Err(err).Str("target_uuid", targetGUID).Msg("Failed to record unsend; re-deliveries may resurrect the message")
+		}
+	}
 
 	c.Main.Bridge.QueueRemoteEvent(c.UserLogin, &simplevent.MessageRemove{
 		EventMeta: simplevent.EventMeta{
@@ -3260,6 +3668,10 @@ func (c *IMClient) handleRename(log zerolog.Logger, msg rustpushgo.WrappedMessag
 	}
 	portalKey := c.makePortalKey(msg.Participants, msg.GroupName, msg.Sender, msg.SenderGuid)
 	newName := ptrStringOr(msg.NewChatName, "")
+	if c.outboundRenames.consumeEcho(string(portalKey.ID), newName, time.Now()) {
+		log.Debug().Str("uuid", msg.Uuid).Msg("Skipping echo of rename sent from Matrix")
+		return
+	}
 
 	// Update the cached iMessage group name to the NEW name so outbound
 	// messages (portalToConversation) use it. makePortalKey cached whatever
@@ -3295,19 +3707,7 @@ func (c *IMClient) handleRename(log zerolog.Logger, msg rustpushgo.WrappedMessag
 		}()
 	}
 
-	c.Main.Bridge.QueueRemoteEvent(c.UserLogin, &simplevent.ChatInfoChange{
-		EventMeta: simplevent.EventMeta{
-			Type:      bridgev2.RemoteEventChatInfoChange,
-			PortalKey: portalKey,
-			Sender:    c.makeEventSender(msg.Sender),
-			Timestamp: time.UnixMilli(int64(msg.TimestampMs)),
-		},
-		ChatInfoChange: &bridgev2.ChatInfoChange{
-			ChatInfo: &bridgev2.ChatInfo{
-				Name: &newName,
-			},
-		},
-	})
+	c.queueGroupNotice(groupNoticeRename, c.groupRenameEvent(portalKey, msg, newName))
 }
 
 func (c *IMClient) handleParticipantChange(log zerolog.Logger, msg rustpushgo.WrappedMessage) {
@@ -3321,8 +3721,25 @@ func (c *IMClient) handleParticipantChange(log zerolog.Logger, msg rustpushgo.Wr
 	oldPortalKey := c.makePortalKey(msg.Participants, msg.GroupName, msg.Sender, msg.SenderGuid)
 
 	if len(msg.NewParticipants) == 0 {
-		// No new participant list — fall back to a resync with current info.
-		log.Warn().Msg("Participant change with empty NewParticipants, falling back to resync")
+		// No new participant list — fall back to the current chat info. Sent
+		// as a ChatInfoChange from the acting member when the portal exists,
+		// so the change isn't attributed to the bridge bot like a resync is.
+		log.Warn().Msg("Participant change with empty NewParticipants, falling back to current chat info")
+		ctx := context.Background()
+		if portal, _ := c.Main.Bridge.GetExistingPortalByKey(ctx, oldPortalKey); portal != nil && portal.MXID != "" {
+			if info, err := c.GetChatInfo(ctx, portal); err == nil && info != nil {
+				c.Main.Bridge.QueueRemoteEvent(c.UserLogin, &simplevent.ChatInfoChange{
+					EventMeta: simplevent.EventMeta{
+						Type:      bridgev2.RemoteEventChatInfoChange,
+						PortalKey: oldPortalKey,
+						Sender:    c.makeEventSender(msg.Sender),
+						Timestamp: time.UnixMilli(int64(msg.TimestampMs)),
+					},
+					ChatInfoChange: &bridgev2.ChatInfoChange{ChatInfo: info},
+				})
+				return
+			}
+		}
 		c.Main.Bridge.QueueRemoteEvent(c.UserLogin, &simplevent.ChatResync{
 			EventMeta: simplevent.EventMeta{
 				Type:      bridgev2.RemoteEventChatResync,
@@ -3370,6 +3787,10 @@ func (c *IMClient) handleParticipantChange(log zerolog.Logger, msg rustpushgo.Wr
 		finalPortalKey = newPortalKey
 	}
 
+	if addedToGroup(msg.Participants, msg.NewParticipants, c.isMyHandle) {
+		c.maybeBackfillGroupJoin(log, finalPortalKey, ptr.Val(msg.SenderGuid), time.UnixMilli(int64(msg.TimestampMs)))
+	}
+
 	// Cache sender_guid and group_name under the (possibly new) portal ID.
 	// For comma-based portals and gid: portals, cache the sender_guid so
 	// future messages can be resolved to this portal. This is skipped for
@@ -3397,7 +3818,7 @@ func (c *IMClient) handleParticipantChange(log zerolog.Logger, msg rustpushgo.Wr
 		if normalized == "" {
 			continue
 		}
-		userID := makeUserID(normalized)
+		userID := c.canonicalGhostID(normalized)
 		if c.isMyHandle(normalized) {
 			memberMap[userID] = bridgev2.ChatMember{
 				EventSender: bridgev2.EventSender{
@@ -3417,18 +3838,19 @@ func (c *IMClient) handleParticipantChange(log zerolog.Logger, msg rustpushgo.Wr
 
 	// Queue a ChatInfoChange with the full member list so bridgev2 syncs
 	// the Matrix room membership (invites new members, kicks removed ones).
-	c.Main.Bridge.QueueRemoteEvent(c.UserLogin, &simplevent.ChatInfoChange{
+	sender := c.makeEventSender(msg.Sender)
+	c.queueGroupNotice(groupNoticeMembers, &simplevent.ChatInfoChange{
 		EventMeta: simplevent.EventMeta{
 			Type:      bridgev2.RemoteEventChatInfoChange,
 			PortalKey: finalPortalKey,
-			Sender:    c.makeEventSender(msg.Sender),
+			Sender:    sender,
 			Timestamp: time.UnixMilli(int64(msg.TimestampMs)),
 		},
 		ChatInfoChange: &bridgev2.ChatInfoChange{
-			MemberChanges: &bridgev2.ChatMemberList{
+			MemberChanges: withGroupActor(&bridgev2.ChatMemberList{
 				IsFull:    true,
 				MemberMap: memberMap,
-			},
+			}, sender, c.Main.Config.GroupActorPowerLevel),
 		},
 	})
 }
@@ -3734,9 +4156,8 @@ func (c *IMClient) handleFaceTimeRingNotice(log zerolog.Logger, msg rustpushgo.W
 	// anchor in the formatted_body. Plain-URL notices aren't autolinked by
 	// every Matrix client; wrapping the URL in [text](url) guarantees an
 	// <a> tag reaches the client.
-	noticeMarkdown := "📞 **Incoming FaceTime call from " + name + ".**"
+	noticeMarkdown := faceTimeCallNoticeMarkdown(faceTimeCallIncoming, name, "Answer FaceTime call", link)
 	if link != "" {
-		noticeMarkdown += "\n\n[**Answer FaceTime call**](" + link + ")"
 		noticeMarkdown += "\n\nRaw link (if the button above doesn't open): " + link
 	}
 
@@ -3802,7 +4223,7 @@ func (c *IMClient) handleFaceTimeMissedNotice(log zerolog.Logger, msg rustpushgo
 	// and provided no bridge integration. If the bridge-link arm fails we
 	// still post the notice with no callback button; the user can always
 	// `!im facetime` in the portal manually.
-	noticeMarkdown := "📞 **Missed FaceTime call from " + name + ".**"
+	noticeMarkdown := faceTimeCallNoticeMarkdown(faceTimeCallMissed, name, "", "")
 	if senderHandle != "" && c.handle != "" {
 		if ft, ftErr := c.client.GetFacetimeClient(); ftErr == nil {
 			if webLink, _, armErr := armBridgeFaceTimeCall(ft, c.handle, senderHandle, 3600, c.resolveFaceTimeDisplayName(ctx)); armErr == nil {
@@ -3845,7 +4266,7 @@ func (c *IMClient) handleFaceTimeMissedNotice(log zerolog.Logger, msg rustpushgo
 
 func (c *IMClient) handleFaceTimeAnsweredElsewhereNotice(log zerolog.Logger, msg rustpushgo.WrappedMessage) {
 	ctx := context.Background()
-	notice := "📞 Incoming FaceTime call was answered on another device."
+	notice := faceTimeCallHeadline(faceTimeCallAnsweredElsewhere, "")
 	portalKey := c.makePortalKey(msg.Participants, msg.GroupName, msg.Sender, msg.SenderGuid)
 	portal, err := c.Main.Bridge.GetExistingPortalByKey(ctx, portalKey)
 	sendNotice := func(roomID id.RoomID) error {
@@ -4278,6 +4699,7 @@ func (c *IMClient) runRestoreBackfillPipeline(opts restorePipelineOptions) {
 	if err := c.cloudStore.setRestoreOverride(ctx, portalID); err != nil {
 		log.Warn().Err(err).Msg("Failed to persist restore override")
 	}
+	c.cancelDeleteFromApple(log.WithContext(ctx), portalID)
 	c.recentlyDeletedPortalsMu.Lock()
 	delete(c.recentlyDeletedPortals, portalID)
 	c.recentlyDeletedPortalsMu.Unlock()
@@ -4521,7 +4943,7 @@ func (c *IMClient) refreshRecoveredChatMetadata(log zerolog.Logger, portalID str
 			Str("cloud_chat_id", chat.CloudChatId).
 			Str("group_id", chat.GroupId).
 			Int64("style", chat.Style).
-			Str("display_name", dn).
+			Str("display_name", logText(dn)).
 			Int("participants", len(chat.Participants)).
 			Msg("refreshRecoveredChatMetadata: recycle bin entry")
 	}
@@ -4892,14 +5314,71 @@ type restoreFetchDiagnostic struct {
 // Rust CloudKit parsing panics (e.g. "Operation UUID has no response?") propagate
 // through FFI as Go panics. Recovering here prevents a single bad CloudKit
 // response from crashing the whole bridge.
+//
+// Calls are paced and paused on CloudKit throttling by c.cloudFetchLimiter
+// (see cloud_fetch_limiter.go).
 func (c *IMClient) safeCloudFetchRecent(log zerolog.Logger, chatID *string, maxPages, maxMessages uint32) (msgs []rustpushgo.WrappedCloudSyncMessage, err error) {
+	wait, err := c.cloudFetchLimiter.reserve(time.Now(), c.cloudFetchInterval())
+	if err != nil {
+		return nil, err
+	} else if wait > 0 {
+		time.Sleep(wait)
+	}
 	defer func() {
 		if r := recover(); r != nil {
 			err = fmt.Errorf("CloudFetchRecentMessages panicked: %v", r)
 			log.Error().Err(err).Msg("Caught Rust panic in CloudFetchRecentMessages")
 		}
 	}()
-	return c.client.CloudFetchRecentMessages(0, chatID, maxPages, maxMessages)
+	msgs, err = c.client.CloudFetchRecentMessages(0, chatID, maxPages, maxMessages)
+	if backoff := c.cloudFetchLimiter.finished(time.Now(), err); backoff > 0 {
+		log.Warn().Err(err).Dur("backoff", backoff).Msg("CloudKit is throttling, pausing CloudFetchRecentMessages")
+	}
+	return msgs, err
+}
+
+// cloudSyncMessageRow converts a live (non-deleted) message from a targeted
+// CloudKit fetch into a cloud_message row for portalID.
+func cloudSyncMessageRow(msg rustpushgo.WrappedCloudSyncMessage, portalID string) cloudMessageRow {
+	msg.Guid = cloudMessageGUID(&msg)
+	text := ""
+	if msg.Text != nil {
+		text = *msg.Text
+	}
+	subject := ""
+	if msg.Subject != nil {
+		subject = *msg.Subject
+	}
+	timestampMS := msg.TimestampMs
+	if timestampMS <= 0 {
+		timestampMS = time.Now().UnixMilli()
+	}
+	tapbackTargetGUID := ""
+	if msg.TapbackTargetGuid != nil {
+		tapbackTargetGUID = *msg.TapbackTargetGuid
+	}
+	tapbackEmoji := ""
+	if msg.TapbackEmoji != nil {
+		tapbackEmoji = *msg.TapbackEmoji
+	}
+	return cloudMessageRow{
+		GUID:              msg.Guid,
+		RecordName:        msg.RecordName,
+		CloudChatID:       msg.CloudChatId,
+		PortalID:          portalID,
+		TimestampMS:       timestampMS,
+		Sender:            msg.Sender,
+		IsFromMe:          msg.IsFromMe,
+		Text:              text,
+		Subject:           subject,
+		Service:           msg.Service,
+		Deleted:           false,
+		TapbackType:       msg.TapbackType,
+		TapbackTargetGUID: tapbackTargetGUID,
+		TapbackEmoji:      tapbackEmoji,
+		DateReadMS:        msg.DateReadMs,
+		HasBody:           msg.HasBody,
+	}
 }
 
 // fetchRecoveredMessagesFromCloudKit runs the targeted restore fetch path and
@@ -4975,9 +5454,13 @@ func (c *IMClient) fetchRecoveredMessagesFromCloudKit(ctx context.Context, log z
 	}
 
 	var matched []rustpushgo.WrappedCloudSyncMessage
+	budget := c.newCloudFetchBudget()
 	tryTargetedFetch := func(chatID string) {
 		if chatID == "" || ctx.Err() != nil {
 			return
+		} else if !budget.take() {
+			log.Debug().Str("cloud_chat_id", chatID).Msg("CloudKit fetch budget for this restore spent, skipping targeted fetch")
+			return
 		}
 		chatIDCopy := chatID
 		targeted, fetchErr := c.safeCloudFetchRecent(log, &chatIDCopy, 50, 5000)
@@ -5033,6 +5516,9 @@ func (c *IMClient) fetchRecoveredMessagesFromCloudKit(ctx context.Context, log z
 	if len(matched) == 0 && ctx.Err() != nil {
 		return 0, nil, ctx.Err()
 	}
+	if len(matched) == 0 && !budget.take() {
+		return 0, nil, fmt.Errorf("no CloudKit fetch budget left for the unfiltered scan (cloudkit_fetch_recent_max_per_restore)")
+	}
 	if len(matched) == 0 {
 		log.Info().Str("portal_id", portalID).
 			Msg("All targeted fetches returned 0 — falling back to unfiltered CloudFetchRecentMessages")
@@ -5091,47 +5577,9 @@ func (c *IMClient) fetchRecoveredMessagesFromCloudKit(ctx context.Context, log z
 
 	rows := make([]cloudMessageRow, 0, len(matched))
 	for _, msg := range matched {
-		if msg.Guid == "" || msg.Deleted {
-			continue
+		if !msg.Deleted {
+			rows = append(rows, cloudSyncMessageRow(msg, portalID))
 		}
-		text := ""
-		if msg.Text != nil {
-			text = *msg.Text
-		}
-		subject := ""
-		if msg.Subject != nil {
-			subject = *msg.Subject
-		}
-		timestampMS := msg.TimestampMs
-		if timestampMS <= 0 {
-			timestampMS = time.Now().UnixMilli()
-		}
-		tapbackTargetGUID := ""
-		if msg.TapbackTargetGuid != nil {
-			tapbackTargetGUID = *msg.TapbackTargetGuid
-		}
-		tapbackEmoji := ""
-		if msg.TapbackEmoji != nil {
-			tapbackEmoji = *msg.TapbackEmoji
-		}
-		rows = append(rows, cloudMessageRow{
-			GUID:              msg.Guid,
-			RecordName:        msg.RecordName,
-			CloudChatID:       msg.CloudChatId,
-			PortalID:          portalID,
-			TimestampMS:       timestampMS,
-			Sender:            msg.Sender,
-			IsFromMe:          msg.IsFromMe,
-			Text:              text,
-			Subject:           subject,
-			Service:           msg.Service,
-			Deleted:           false,
-			TapbackType:       msg.TapbackType,
-			TapbackTargetGUID: tapbackTargetGUID,
-			TapbackEmoji:      tapbackEmoji,
-			DateReadMS:        msg.DateReadMs,
-			HasBody:           msg.HasBody,
-		})
 	}
 	if len(rows) == 0 {
 		return 0, diag, nil
@@ -5222,6 +5670,11 @@ func (c *IMClient) handleReadReceipt(log zerolog.Logger, msg rustpushgo.WrappedM
 		}
 	}
 
+	if c.isDuplicateReceipt("read", msg.Uuid, ptrStringOr(msg.Sender, "")) {
+		log.Debug().Str("uuid", msg.Uuid).Msg("Skipping re-delivered read receipt")
+		return
+	}
+
 	portalKey := c.makeReceiptPortalKey(msg.Participants, msg.GroupName, msg.Sender, msg.SenderGuid)
 	ctx := context.Background()
 
@@ -5291,6 +5744,8 @@ resolved:
 	sender = c.canonicalizeDMSender(portalKey, sender)
 
 	if !sender.IsFromMe {
+		c.notePeerRead(log, portalKey)
+		c.receiptStates.advance(msg.Uuid, receiptRead, time.Now())
 		// Skip ghost receipts for messages that were backfilled from CloudKit.
 		// APNs read receipts for group chats lack participants/senderGuid, so
 		// the portal key often resolves to a DM rather than a gid: portal.
@@ -5313,6 +5768,7 @@ resolved:
 		// users, causing the homeserver to use server time instead of the actual
 		// read time from the APNs receipt.
 		c.sendGhostReadReceipt(&log, sender.Sender, portalKey, msg.Uuid, readTime)
+		c.recordReceipt("read", msg.Uuid, ptrStringOr(msg.Sender, ""))
 	} else {
 		// Self-receipt (unlikely for APNs read receipts, but handle gracefully).
 		c.Main.Bridge.QueueRemoteEvent(c.UserLogin, &simplevent.Receipt{
@@ -5323,7 +5779,11 @@ resolved:
 				Timestamp: readTime,
 			},
 			LastTarget: makeMessageID(msg.Uuid),
+			// The target may have been sent from another Apple device and
+			// never bridged; bridgev2 then marks up to this time instead.
+			ReadUpTo: readTime,
 		})
+		c.recordReceipt("read", msg.Uuid, ptrStringOr(msg.Sender, ""))
 	}
 }
 
@@ -5336,6 +5796,22 @@ func (c *IMClient) handleDeliveryReceipt(log zerolog.Logger, msg rustpushgo.Wrap
 	// on handleReadReceipt didn't have the same visible regression.
 	ctx := context.Background()
 
+	if c.isDuplicateReceipt("delivered", msg.Uuid, "") {
+		log.Debug().Str("uuid", msg.Uuid).Msg("Skipping re-delivered delivery receipt")
+		return
+	}
+	// Delivered after all: the success status below replaces the pending one.
+	if c.pendingSends.resolve(msg.Uuid) {
+		log.Info().Str("uuid", msg.Uuid).Msg("Pending message was delivered after a transient error")
+	}
+	// Another device of the recipient's (a watch, an iPad waking up) can
+	// report delivery after the message was read; don't show it as
+	// delivered again.
+	if c.receiptStates.deliveryDowngrades(msg.Uuid, time.Now()) {
+		log.Debug().Str("uuid", msg.Uuid).Msg("Skipping delivery receipt for a message already read")
+		return
+	}
+
 	// Mirror handleReadReceipt's portal-resolution chain. Without these
 	// fallbacks, any drift in makeReceiptPortalKey output (e.g. sender_guid
 	// format churn) silently drops every delivery receipt while read receipts
@@ -5478,10 +5954,10 @@ func (c *IMClient) handleDeliveryReceipt(log zerolog.Logger, msg rustpushgo.Wrap
 	// For DM portals, use the portal ID as the sender identity so the ghost
 	// matches the canonical handle (avoids phantom ghost from alternate handles).
 	portalID := string(portalKey.ID)
+	senderUserID := c.canonicalGhostID(normalizedSender)
 	if !strings.Contains(portalID, ",") && !strings.HasPrefix(portalID, "gid:") {
-		normalizedSender = portalID
+		senderUserID = makeUserID(portalID)
 	}
-	senderUserID := makeUserID(normalizedSender)
 	ghost, err := c.Main.Bridge.GetGhostByID(ctx, senderUserID)
 	if err != nil || ghost == nil {
 		log.Debug().
@@ -5503,9 +5979,19 @@ func (c *IMClient) handleDeliveryReceipt(log zerolog.Logger, msg rustpushgo.Wrap
 			Sender:        dbMsg.SenderMXID,
 		})
 	}
+	c.recordReceipt("delivered", msg.Uuid, "")
+	c.receiptStates.advance(msg.Uuid, receiptDelivered, time.Now())
+	c.notePeerDelivered(portalKey)
 }
 
 func (c *IMClient) handleTyping(log zerolog.Logger, msg rustpushgo.WrappedMessage) {
+	// Typing on the user's own iPhone or Mac isn't shown: there's no other
+	// member to show it to, and it would make the user's own Matrix account
+	// appear to type.
+	if msg.Sender == nil || *msg.Sender == "" || c.isMyHandle(*msg.Sender) {
+		log.Debug().Msg("Ignoring typing indicator from own device")
+		return
+	}
 	portalKey := c.makePortalKey(msg.Participants, msg.GroupName, msg.Sender, msg.SenderGuid)
 
 	// For group typing indicators, iMessage may only include [sender, target]
@@ -5554,15 +6040,54 @@ func (c *IMClient) handleTyping(log zerolog.Logger, msg rustpushgo.WrappedMessag
 	}
 found:
 
+	sender := c.typingEventSender(portalKey, *msg.Sender)
+	timeout := typingTimeout(msg)
 	c.Main.Bridge.QueueRemoteEvent(c.UserLogin, &simplevent.Typing{
 		EventMeta: simplevent.EventMeta{
 			Type:      bridgev2.RemoteEventTyping,
 			PortalKey: portalKey,
-			Sender:    c.canonicalizeDMSender(portalKey, c.makeEventSender(msg.Sender)),
+			Sender:    sender,
 			Timestamp: time.UnixMilli(int64(msg.TimestampMs)),
 		},
-		Timeout: 60 * time.Second,
+		Timeout: timeout,
 	})
+	member := typingMember{portal: portalKey, sender: sender.Sender}
+	if timeout == 0 {
+		c.typingExpiry.stop(member)
+		return
+	}
+	c.typingExpiry.start(member, timeout, func() {
+		log.Debug().Str("sender", string(sender.Sender)).Msg("Typing indicator timed out without a stop, clearing it")
+		c.Main.Bridge.QueueRemoteEvent(c.UserLogin, &simplevent.Typing{
+			EventMeta: simplevent.EventMeta{
+				Type:      bridgev2.RemoteEventTyping,
+				PortalKey: portalKey,
+				Sender:    sender,
+				Timestamp: time.Now(),
+			},
+			Timeout: 0,
+		})
+	})
+}
+
+// typingEventSender returns the ghost a typing indicator is shown as. In a
+// group that's the member who is typing, so members typing at once each
+// show up; in a DM it's the portal's ghost whichever of the contact's
+// handles they type from.
+func (c *IMClient) typingEventSender(portalKey networkid.PortalKey, sender string) bridgev2.EventSender {
+	return c.canonicalizeDMSender(portalKey, bridgev2.EventSender{Sender: c.canonicalGhostID(sender)})
+}
+
+// typingTimeout returns the Matrix typing timeout for an inbound typing
+// indicator. A typing start keeps the indicator up for 60 seconds (iMessage
+// re-sends while the user is still typing); an explicit typing stop returns
+// 0 so bridgev2 clears the indicator immediately instead of letting it linger
+// until the timeout expires.
+func typingTimeout(msg rustpushgo.WrappedMessage) time.Duration {
+	if msg.IsTypingStop {
+		return 0
+	}
+	return 60 * time.Second
 }
 
 // ============================================================================
@@ -5589,9 +6114,9 @@ func (c *IMClient) convertURLPreviewToIMessage(ctx context.Context, content *eve
 			canonical = lp.MatchedURL
 		}
 		log.Debug().
-			Str("matched_url", lp.MatchedURL).
-			Str("canonical_url", canonical).
-			Str("title", lp.Title).
+			Str("matched_url", logText(lp.MatchedURL)).
+			Str("canonical_url", logText(canonical)).
+			Str("title", logText(lp.Title)).
 			Msg("Encoding Beeper link preview for iMessage")
 		return "\x00RL\x01" + lp.MatchedURL + "\x01" + canonical + "\x01" + lp.Title + "\x01" + lp.Description + "\x00" + body
 	}
@@ -5599,14 +6124,14 @@ func (c *IMClient) convertURLPreviewToIMessage(ctx context.Context, content *eve
 	// Priority 2: Auto-detect URL and fetch preview via homeserver or og: scraping
 	if detectedURL := urlRegex.FindString(body); detectedURL != "" && isLikelyURL(detectedURL) {
 		fetchURL := normalizeURL(detectedURL)
-		log.Debug().Str("detected_url", detectedURL).Msg("Auto-detected URL in outbound message, fetching preview")
+		log.Debug().Str("detected_url", logText(detectedURL)).Msg("Auto-detected URL in outbound message, fetching preview")
 		title, desc := "", ""
 		// Try homeserver preview first
 		if mc, ok := c.Main.Bridge.Matrix.(bridgev2.MatrixConnectorWithURLPreviews); ok {
 			if lp, err := mc.GetURLPreview(ctx, fetchURL); err == nil && lp != nil {
 				title = lp.Title
 				desc = lp.Description
-				log.Debug().Str("title", title).Str("description", desc).Msg("Got URL preview from homeserver for outbound")
+				log.Debug().Str("title", logText(title)).Str("description", logText(desc)).Msg("Got URL preview from homeserver for outbound")
 			} else if err != nil {
 				log.Debug().Err(err).Msg("Failed to fetch URL preview from homeserver for outbound")
 			}
@@ -5617,7 +6142,7 @@ func (c *IMClient) convertURLPreviewToIMessage(ctx context.Context, content *eve
 			title = ogData["title"]
 			desc = ogData["description"]
 			if title != "" || desc != "" {
-				log.Debug().Str("title", title).Str("description", desc).Msg("Got URL preview from og: scraping for outbound")
+				log.Debug().Str("title", logText(title)).Str("description", logText(desc)).Msg("Got URL preview from og: scraping for outbound")
 			}
 		}
 		return "\x00RL\x01" + detectedURL + "\x01" + fetchURL + "\x01" + title + "\x01" + desc + "\x00" + body
@@ -5645,28 +6170,58 @@ func retrySendOnAPNsFlap(op func() error) error {
 	return err
 }
 
-func (c *IMClient) HandleMatrixMessage(ctx context.Context, msg *bridgev2.MatrixMessage) (*bridgev2.MatrixMessageResponse, error) {
+func (c *IMClient) HandleMatrixMessage(ctx context.Context, msg *bridgev2.MatrixMessage) (_ *bridgev2.MatrixMessageResponse, retErr error) {
+	defer func(start time.Time) { c.sendFinished("message", msg.Portal, start, retErr) }(time.Now())
 	if c.client == nil {
 		return nil, bridgev2.ErrNotLoggedIn
 	}
+	c.catchUpPortal(ctx, msg.Portal)
 
-	conv := c.portalToConversation(msg.Portal)
+	conv := c.sendConversation(msg.Portal)
+	// The first message in a group created from Matrix is what creates it
+	// on iMessage (see group_create.go).
+	if c.preparePendingGroup(ctx, msg.Portal, &conv) {
+		defer func() {
+			if retErr == nil {
+				c.finishPendingGroup(ctx, msg.Portal, conv)
+			}
+		}()
+	}
 
 	// File/image messages
 	if msg.Content.URL != "" || msg.Content.File != nil {
 		return c.handleMatrixFile(ctx, msg, conv)
 	}
 
+	// A message that's only a GIPHY/Tenor link goes out as a GIF attachment
+	// so iMessage plays it inline instead of showing a static link card.
+	if resp, handled, err := c.trySendGIFURL(ctx, msg, conv); handled {
+		return resp, err
+	}
+
 	textToSend := c.convertURLPreviewToIMessage(ctx, msg.Content)
 
+	// Too long for one iMessage: split it or send it as a file.
+	if parts := planLongMessage(textToSend, c.Main.Config.LongMessageLimit, c.Main.Config.longMessageMode()); parts != nil {
+		return c.sendLongMessage(ctx, msg, conv, parts)
+	}
+
 	replyGuid, replyPart := extractReplyInfo(msg.ReplyTo)
 	// Rust-side send_with_flap_retry handles SendTimedOut retry with a stable
 	// UUID (lib.rs:~7373). No Go-side retry here — a retry would generate a
 	// fresh MessageInst and orphan delivery receipts for the first attempt.
-	uuid, err := c.client.SendMessage(conv, textToSend, nil, c.handle, replyGuid, replyPart, nil)
+	uuid, err := c.sendWithSMSFallback(ctx, msg.Portal, &conv, func(conv rustpushgo.WrappedConversation) (string, error) {
+		text := textToSend
+		if conv.IsSms && !c.isPortalSMS(string(msg.Portal.ID)) {
+			// SMS retry: rich links are iMessage-only, send the plain body.
+			text = msg.Content.Body
+		}
+		return c.client.SendMessage(conv, text, nil, c.portalHandle(msg.Portal), replyGuid, replyPart, nil)
+	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to send iMessage: %w", err)
 	}
+	c.rememberOutboundSend(uuid)
 	zerolog.Ctx(ctx).Info().
 		Str("uuid", uuid).
 		Str("portal_id", string(msg.Portal.ID)).
@@ -5694,7 +6249,7 @@ func (c *IMClient) HandleMatrixMessage(ctx context.Context, msg *bridgev2.Matrix
 	return &bridgev2.MatrixMessageResponse{
 		DB: &database.Message{
 			ID:        makeMessageID(uuid),
-			SenderID:  makeUserID(c.handle),
+			SenderID:  makeUserID(c.portalHandle(msg.Portal)),
 			Timestamp: time.Now(),
 			Metadata:  &MessageMetadata{},
 		},
@@ -5707,7 +6262,7 @@ func (c *IMClient) addOutboundURLPreview(eventID id.EventID, roomID id.RoomID, b
 	log := c.UserLogin.Log.With().
 		Str("component", "url_preview").
 		Stringer("event_id", eventID).
-		Str("detected_url", detectedURL).
+		Str("detected_url", logText(detectedURL)).
 		Logger()
 	ctx := log.WithContext(context.Background())
 
@@ -5731,7 +6286,7 @@ func (c *IMClient) addOutboundURLPreview(eventID id.EventID, roomID id.RoomID, b
 	if err != nil {
 		log.Warn().Err(err).Msg("Failed to send outbound URL preview edit")
 	} else {
-		log.Debug().Str("title", preview.Title).Msg("Sent outbound URL preview edit")
+		log.Debug().Str("title", logText(preview.Title)).Msg("Sent outbound URL preview edit")
 	}
 }
 
@@ -5816,12 +6371,10 @@ func (c *IMClient) handleMatrixFile(ctx context.Context, msg *bridgev2.MatrixMes
 	var matrixEdited bool
 	if looksLikeImage(data) {
 		origMime := mimeType
-		if mimeType == "image/gif" {
-			// GIFs are fine as-is, just detect correct MIME
-			if detected := detectImageMIME(data); detected != "" && detected != mimeType {
-				mimeType = detected
-				fileName = strings.TrimSuffix(fileName, filepath.Ext(fileName)) + ".gif"
-			}
+		if gifMime, gifName, isGIF := outboundGIFMeta(data, mimeType, fileName); isGIF {
+			// GIFs are sent byte-for-byte: decoding keeps only the first
+			// frame, so the JPEG path below would drop the animation.
+			mimeType, fileName = gifMime, gifName
 		} else if img, _, isJPEG := decodeImageData(data); img != nil {
 			if !isJPEG {
 				var buf bytes.Buffer
@@ -5863,10 +6416,22 @@ func (c *IMClient) handleMatrixFile(ctx context.Context, msg *bridgev2.MatrixMes
 
 	// Rust-side send_with_flap_retry handles SendTimedOut retry with a stable
 	// UUID — no Go-side retry here (would orphan delivery receipts).
-	uuid, err := c.client.SendAttachment(conv, data, mimeType, mimeToUTI(mimeType), fileName, c.handle, replyGuid, replyPart, nil)
+	sendAttachment := func(conv rustpushgo.WrappedConversation) (string, error) {
+		data, mimeType, fileName := data, mimeType, fileName
+		if conv.IsSms {
+			// Carriers reject MMS over their size limit (attachment_transport.go).
+			data, mimeType, fileName = fitImageForMMS(data, mimeType, fileName, c.mmsImageMaxBytes())
+		}
+		return c.client.SendAttachment(conv, data, mimeType, mimeToUTI(mimeType), fileName, c.portalHandle(msg.Portal), replyGuid, replyPart, nil)
+	}
+	uuid, err := c.sendWithSMSFallback(ctx, msg.Portal, &conv, sendAttachment)
+	if err != nil {
+		uuid, err = c.retryAttachmentTransport(ctx, msg.Portal, &conv, err, sendAttachment)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to send attachment: %w", err)
 	}
+	c.rememberOutboundSend(uuid)
 	// Persist UUID immediately so echo detection works even if the portal
 	// is deleted before the APNs echo arrives.
 	if c.cloudStore != nil {
@@ -5882,12 +6447,13 @@ func (c *IMClient) handleMatrixFile(ctx context.Context, msg *bridgev2.MatrixMes
 	textMXID := id.EventID("")
 	siblingUUID := ""
 	if msg.Content.FileName != "" && msg.Content.Body != "" && msg.Content.Body != msg.Content.FileName {
-		tUUID, textErr := c.client.SendMessage(conv, msg.Content.Body, nil, c.handle, nil, nil, nil)
+		tUUID, textErr := c.client.SendMessage(conv, msg.Content.Body, nil, c.portalHandle(msg.Portal), nil, nil, nil)
 		if textErr != nil {
 			zerolog.Ctx(ctx).Warn().Err(textErr).Str("attachment_uuid", uuid).Msg("Failed to send caption as follow-up text; attachment was delivered")
 		} else {
 			textUUID = tUUID
 			siblingUUID = uuid
+			c.rememberOutboundSend(tUUID)
 			if c.cloudStore != nil {
 				if err := c.cloudStore.persistMessageUUID(ctx, tUUID, string(msg.Portal.ID), time.Now().UnixMilli(), true); err != nil {
 					zerolog.Ctx(ctx).Warn().Err(err).Str("uuid", tUUID).Msg("Failed to persist sent text UUID; echo may be delivered as duplicate")
@@ -5934,7 +6500,7 @@ func (c *IMClient) handleMatrixFile(ctx context.Context, msg *bridgev2.MatrixMes
 		bridgeRef := c.Main.Bridge
 		userLogin := c.UserLogin
 		portalKey := msg.Portal.PortalKey
-		senderID := makeUserID(c.handle)
+		senderID := makeUserID(c.portalHandle(msg.Portal))
 		now := time.Now()
 		return &bridgev2.MatrixMessageResponse{
 			DB: &database.Message{
@@ -5972,7 +6538,7 @@ func (c *IMClient) handleMatrixFile(ctx context.Context, msg *bridgev2.MatrixMes
 	return &bridgev2.MatrixMessageResponse{
 		DB: &database.Message{
 			ID:        makeMessageID(finalUUID),
-			SenderID:  makeUserID(c.handle),
+			SenderID:  makeUserID(c.portalHandle(msg.Portal)),
 			Timestamp: time.Now(),
 			Metadata:  &MessageMetadata{HasAttachments: hasAttachments, SiblingUUID: siblingUUID},
 		},
@@ -5980,6 +6546,7 @@ func (c *IMClient) handleMatrixFile(ctx context.Context, msg *bridgev2.MatrixMes
 }
 
 func (c *IMClient) HandleMatrixTyping(ctx context.Context, msg *bridgev2.MatrixTyping) error {
+	c.catchUpPortal(ctx, msg.Portal)
 	if c.client == nil || !c.Main.Config.TypingNotifications {
 		return nil
 	}
@@ -5988,11 +6555,48 @@ func (c *IMClient) HandleMatrixTyping(ctx context.Context, msg *bridgev2.MatrixT
 		return nil
 	}
 	return retrySendOnAPNsFlap(func() error {
-		return c.client.SendTyping(conv, msg.IsTyping, c.handle)
+		return c.client.SendTyping(conv, msg.IsTyping, c.portalHandle(msg.Portal))
 	})
 }
 
+// readReceiptTarget returns the iMessage UUID a Matrix read receipt should
+// be sent for. A receipt on a bridged message targets that message. A
+// receipt without one — "mark as read" on the whole room, or a receipt on a
+// state event — covers the conversation up to ReadUpTo, so it targets the
+// latest bridged message in this portal at or before that time; Apple
+// treats a read receipt as covering everything before it in the chat.
+// Portal keys are per-conversation, so a group's receipt never lands on a
+// message from a DM with one of its members. Returns nil when the portal
+// has no bridged messages, which sends a receipt without a target UUID.
+func (c *IMClient) readReceiptTarget(ctx context.Context, receipt *bridgev2.MatrixReadReceipt) *string {
+	msg := receipt.ExactMessage
+	if msg == nil {
+		readUpTo := receipt.ReadUpTo
+		if readUpTo.IsZero() {
+			readUpTo = time.Now()
+		}
+		last, err := c.Main.Bridge.DB.Message.GetLastNonFakePartAtOrBeforeTime(ctx, receipt.Portal.PortalKey, readUpTo)
+		if err != nil {
+			zerolog.Ctx(ctx).Warn().Err(err).
+				Str("portal_id", string(receipt.Portal.ID)).
+				Msg("Failed to find latest message for conversation read receipt")
+			return nil
+		}
+		if last == nil {
+			return nil
+		}
+		msg = last
+	}
+	// Strip attachment suffixes like _att0, _att1 — Rust expects a pure UUID
+	uuid, _ := extractTapbackTarget(string(msg.ID))
+	if isSyntheticGUID(uuid) {
+		return nil
+	}
+	return &uuid
+}
+
 func (c *IMClient) HandleMatrixReadReceipt(ctx context.Context, receipt *bridgev2.MatrixReadReceipt) error {
+	c.catchUpPortal(ctx, receipt.Portal)
 	if c.client == nil || !c.Main.Config.ReadReceipts {
 		return nil
 	}
@@ -6000,17 +6604,9 @@ func (c *IMClient) HandleMatrixReadReceipt(ctx context.Context, receipt *bridgev
 	if conv.IsSms {
 		return nil
 	}
-	var forUuid *string
-	if receipt.ExactMessage != nil {
-		uuid := string(receipt.ExactMessage.ID)
-		// Strip attachment suffixes like _att0, _att1 — Rust expects a pure UUID
-		if idx := strings.Index(uuid, "_att"); idx > 0 {
-			uuid = uuid[:idx]
-		}
-		forUuid = &uuid
-	}
+	forUuid := c.readReceiptTarget(ctx, receipt)
 	err := retrySendOnAPNsFlap(func() error {
-		return c.client.SendReadReceipt(conv, c.handle, forUuid)
+		return c.client.SendReadReceipt(conv, c.portalHandle(receipt.Portal), forUuid)
 	})
 	if err != nil {
 		errStr := err.Error()
@@ -6029,7 +6625,8 @@ func (c *IMClient) HandleMatrixReadReceipt(ctx context.Context, receipt *bridgev
 	return nil
 }
 
-func (c *IMClient) HandleMatrixEdit(ctx context.Context, msg *bridgev2.MatrixEdit) error {
+func (c *IMClient) HandleMatrixEdit(ctx context.Context, msg *bridgev2.MatrixEdit) (retErr error) {
+	defer func(start time.Time) { c.sendFinished("edit", msg.Portal, start, retErr) }(time.Now())
 	if c.client == nil {
 		return bridgev2.ErrNotLoggedIn
 	}
@@ -6039,9 +6636,17 @@ func (c *IMClient) HandleMatrixEdit(ctx context.Context, msg *bridgev2.MatrixEdi
 		return fmt.Errorf("edits are not supported for SMS conversations")
 	}
 	targetGUID := string(msg.EditTarget.ID)
+	if isSyntheticGUID(targetGUID) {
+		return errSyntheticTarget
+	}
+
+	body := msg.Content.Body
+	if meta, ok := msg.EditTarget.Metadata.(*MessageMetadata); ok && meta != nil {
+		body = stripSubjectLine(body, meta.Subject)
+	}
 
 	// Rust-side retry handles SendTimedOut with stable UUID.
-	_, err := c.client.SendEdit(conv, targetGUID, 0, msg.Content.Body, c.handle)
+	_, err := c.client.SendEdit(conv, targetGUID, 0, body, c.portalHandle(msg.Portal))
 	if err == nil {
 		// Work around mautrix-go bridgev2 not incrementing EditCount before saving.
 		msg.EditTarget.EditCount++
@@ -6049,7 +6654,8 @@ func (c *IMClient) HandleMatrixEdit(ctx context.Context, msg *bridgev2.MatrixEdi
 	return err
 }
 
-func (c *IMClient) HandleMatrixMessageRemove(ctx context.Context, msg *bridgev2.MatrixMessageRemove) error {
+func (c *IMClient) HandleMatrixMessageRemove(ctx context.Context, msg *bridgev2.MatrixMessageRemove) (retErr error) {
+	defer func(start time.Time) { c.sendFinished("unsend", msg.Portal, start, retErr) }(time.Now())
 	if c.client == nil {
 		return bridgev2.ErrNotLoggedIn
 	}
@@ -6058,19 +6664,36 @@ func (c *IMClient) HandleMatrixMessageRemove(ctx context.Context, msg *bridgev2.
 	if conv.IsSms {
 		return fmt.Errorf("message retraction is not supported for SMS conversations")
 	}
+	if isSyntheticGUID(string(msg.TargetMessage.ID)) {
+		return errSyntheticTarget
+	}
 
 	// If this Matrix event was bridged as two iMessages (attachment + caption text),
 	// unsend the sibling first. The attachment was sent before the text on the wire,
 	// so unsend it first to keep the same wire ordering — some peers ignore unsends
 	// that arrive out of timeline order for an attachment.
 	var siblingUUID string
+	var splitUUIDs []string
 	if meta, ok := msg.TargetMessage.Metadata.(*MessageMetadata); ok && meta != nil {
 		siblingUUID = meta.SiblingUUID
+		splitUUIDs = meta.SplitUUIDs
+	}
+
+	// The rest of a long message that was split into several iMessages.
+	for _, splitUUID := range splitUUIDs {
+		c.trackOutboundUnsend(splitUUID)
+		if _, splitErr := c.client.SendUnsend(conv, splitUUID, 0, c.portalHandle(msg.Portal)); splitErr != nil {
+			zerolog.Ctx(ctx).Warn().Err(splitErr).
+				Str("split_uuid", splitUUID).
+				Msg("Failed to unsend part of split long message")
+		} else if c.cloudStore != nil {
+			c.cloudStore.softDeleteMessageByGUID(ctx, splitUUID)
+		}
 	}
 
 	if siblingUUID != "" {
 		c.trackOutboundUnsend(siblingUUID)
-		if _, sibErr := c.client.SendUnsend(conv, siblingUUID, 0, c.handle); sibErr != nil {
+		if _, sibErr := c.client.SendUnsend(conv, siblingUUID, 0, c.portalHandle(msg.Portal)); sibErr != nil {
 			zerolog.Ctx(ctx).Warn().Err(sibErr).
 				Str("sibling_uuid", siblingUUID).
 				Msg("Failed to unsend sibling iMessage on split image+caption redact")
@@ -6082,7 +6705,7 @@ func (c *IMClient) HandleMatrixMessageRemove(ctx context.Context, msg *bridgev2.
 	// Track outbound unsend so we can suppress the APNs echo.
 	c.trackOutboundUnsend(string(msg.TargetMessage.ID))
 	// Rust-side retry handles SendTimedOut with stable UUID.
-	_, err := c.client.SendUnsend(conv, string(msg.TargetMessage.ID), 0, c.handle)
+	_, err := c.client.SendUnsend(conv, string(msg.TargetMessage.ID), 0, c.portalHandle(msg.Portal))
 
 	// Soft-delete the message in local DB so it doesn't re-bridge on backfill,
 	// while preserving the UUID for echo detection.
@@ -6095,16 +6718,20 @@ func (c *IMClient) HandleMatrixMessageRemove(ctx context.Context, msg *bridgev2.
 
 func (c *IMClient) PreHandleMatrixReaction(ctx context.Context, msg *bridgev2.MatrixReaction) (bridgev2.MatrixReactionPreResponse, error) {
 	return bridgev2.MatrixReactionPreResponse{
-		SenderID: makeUserID(c.handle),
+		SenderID: c.ownReactionSenderID(),
 		Emoji:    msg.Content.RelatesTo.Key,
 	}, nil
 }
 
-func (c *IMClient) HandleMatrixReaction(ctx context.Context, msg *bridgev2.MatrixReaction) (*database.Reaction, error) {
+func (c *IMClient) HandleMatrixReaction(ctx context.Context, msg *bridgev2.MatrixReaction) (_ *database.Reaction, retErr error) {
+	defer func(start time.Time) { c.sendFinished("reaction", msg.Portal, start, retErr) }(time.Now())
 	if c.client == nil {
 		return nil, bridgev2.ErrNotLoggedIn
 	}
 
+	if isSyntheticGUID(string(msg.TargetMessage.ID)) {
+		return nil, errSyntheticTarget
+	}
 	conv := c.portalToConversation(msg.Portal)
 	reaction, emoji := emojiToTapbackType(msg.Content.RelatesTo.Key)
 
@@ -6131,7 +6758,7 @@ func (c *IMClient) HandleMatrixReaction(ctx context.Context, msg *bridgev2.Matri
 			}
 		}
 		// Rust-side retry handles SendTimedOut with stable UUID.
-		uuid, err := c.client.SendMessage(conv, reactionText, nil, c.handle, &targetGUID, nil, nil)
+		uuid, err := c.client.SendMessage(conv, reactionText, nil, c.portalHandle(msg.Portal), &targetGUID, nil, nil)
 		if err != nil {
 			return nil, fmt.Errorf("failed to send SMS reaction: %w", err)
 		}
@@ -6145,14 +6772,15 @@ func (c *IMClient) HandleMatrixReaction(ctx context.Context, msg *bridgev2.Matri
 
 	targetUUID, targetPart := extractTapbackTarget(string(msg.TargetMessage.ID))
 	// Rust-side retry handles SendTimedOut with stable UUID.
-	_, err := c.client.SendTapback(conv, targetUUID, targetPart, reaction, emoji, false, c.handle)
+	uuid, err := c.client.SendTapback(conv, targetUUID, targetPart, reaction, emoji, false, c.portalHandle(msg.Portal))
 	if err != nil {
 		return nil, fmt.Errorf("failed to send tapback: %w", err)
 	}
+	c.rememberSentTapback(ctx, msg.Portal, uuid, reaction, false)
 
 	return &database.Reaction{
 		MessageID: msg.TargetMessage.ID,
-		SenderID:  makeUserID(c.handle),
+		SenderID:  c.ownReactionSenderID(),
 		Emoji:     msg.Content.RelatesTo.Key,
 		Metadata:  &MessageMetadata{},
 		MXID:      msg.Event.ID,
@@ -6164,6 +6792,9 @@ func (c *IMClient) HandleMatrixReactionRemove(ctx context.Context, msg *bridgev2
 		return bridgev2.ErrNotLoggedIn
 	}
 
+	if isSyntheticGUID(string(msg.TargetReaction.MessageID)) {
+		return errSyntheticTarget
+	}
 	conv := c.portalToConversation(msg.Portal)
 	reaction, emoji := emojiToTapbackType(msg.TargetReaction.Emoji)
 
@@ -6180,7 +6811,7 @@ func (c *IMClient) HandleMatrixReactionRemove(ctx context.Context, msg *bridgev2
 			}
 		}
 		// Rust-side retry handles SendTimedOut with stable UUID.
-		uuid, err := c.client.SendMessage(conv, reactionText, nil, c.handle, &targetGUID, nil, nil)
+		uuid, err := c.client.SendMessage(conv, reactionText, nil, c.portalHandle(msg.Portal), &targetGUID, nil, nil)
 		if err != nil {
 			return err
 		}
@@ -6190,8 +6821,12 @@ func (c *IMClient) HandleMatrixReactionRemove(ctx context.Context, msg *bridgev2
 
 	targetUUID, targetPart := extractTapbackTarget(string(msg.TargetReaction.MessageID))
 	// Rust-side retry handles SendTimedOut with stable UUID.
-	_, err := c.client.SendTapback(conv, targetUUID, targetPart, reaction, emoji, true, c.handle)
-	return err
+	uuid, err := c.client.SendTapback(conv, targetUUID, targetPart, reaction, emoji, true, c.portalHandle(msg.Portal))
+	if err != nil {
+		return err
+	}
+	c.rememberSentTapback(ctx, msg.Portal, uuid, reaction, true)
+	return nil
 }
 
 // HandleMatrixDeleteChat is called when the user deletes a chat in Matrix/Beeper.
@@ -6256,9 +6891,10 @@ func (c *IMClient) HandleMatrixDeleteChat(ctx context.Context, msg *bridgev2.Mat
 	}
 
 	// Delete from Apple — CloudKit backend only. chatdb users should not have
-	// Apple-side chats deleted when they remove a portal from Beeper.
+	// Apple-side chats deleted when they remove a portal from Beeper. May wait
+	// out a grace period first (cloud_delete_grace.go).
 	if c.useCloudKitBackfill() {
-		c.deleteFromApple(portalID, conv, chatGuid, chatRecordNames, msgRecordNames)
+		c.scheduleDeleteFromApple(ctx, portalID, conv, chatGuid, chatRecordNames, msgRecordNames)
 	}
 
 	return nil
@@ -6494,6 +7130,9 @@ func (c *IMClient) GetChatInfo(ctx context.Context, portal *bridgev2.Portal) (*b
 				canBackfill = true
 			}
 		}
+		if !canBackfill {
+			canBackfill = c.chatDBBackfillFallback(ctx, portalID)
+		}
 	}
 
 	chatInfo := &bridgev2.ChatInfo{
@@ -6509,11 +7148,14 @@ func (c *IMClient) GetChatInfo(ctx context.Context, portal *bridgev2.Portal) (*b
 
 		// For gid: portals, look up members from cloud_chat table;
 		// for legacy comma-separated IDs, parse from the portal ID.
-		memberList := c.resolveGroupMembers(ctx, portalID)
+		memberList, partialMembers := c.resolveGroupMembersPartial(ctx, portalID)
+		// Very large groups only get their first members in the room (see
+		// group_member_limit.go).
+		memberList, cappedMembers := c.limitGroupMembers(ctx, portalID, memberList)
 
 		memberMap := make(map[networkid.UserID]bridgev2.ChatMember)
 		for _, member := range memberList {
-			userID := makeUserID(member)
+			userID := c.canonicalGhostID(member)
 			if c.isMyHandle(member) {
 				memberMap[userID] = bridgev2.ChatMember{
 					EventSender: bridgev2.EventSender{
@@ -6546,7 +7188,10 @@ func (c *IMClient) GetChatInfo(ctx context.Context, portal *bridgev2.Portal) (*b
 			}
 		}
 		chatInfo.Members = &bridgev2.ChatMemberList{
-			IsFull:    true,
+			// A roster derived from message senders is missing everyone
+			// who hasn't spoken, and a capped one everyone past the limit;
+			// don't let either kick them from the room.
+			IsFull:    !partialMembers && !cappedMembers,
 			MemberMap: memberMap,
 			PowerLevels: &bridgev2.PowerLevelOverrides{
 				Invite: ptr.Ptr(95), // Prevent Matrix users from inviting — the bridge manages membership
@@ -6563,6 +7208,11 @@ func (c *IMClient) GetChatInfo(ctx context.Context, portal *bridgev2.Portal) (*b
 			groupName, _ := c.resolveGroupName(ctx, portalID)
 			chatInfo.Name = &groupName
 		}
+		groupName := portal.Name
+		if chatInfo.Name != nil {
+			groupName = *chatInfo.Name
+		}
+		c.applyAutoJoin(chatInfo.Members, portalID, groupName)
 
 		// Set group photo from cache or CloudKit.
 		//
@@ -6677,17 +7327,13 @@ func (c *IMClient) GetChatInfo(ctx context.Context, portal *bridgev2.Portal) (*b
 			chatInfo.Name = &selfName
 
 			// Pull contact photo for self-chat room avatar.
-			localID := stripIdentifierPrefix(portalID)
-			if c.contacts != nil {
-				if contact, _ := c.contacts.GetContactInfo(localID); contact != nil && len(contact.Avatar) > 0 {
-					avatarHash := sha256.Sum256(contact.Avatar)
-					avatarData := contact.Avatar
-					chatInfo.Avatar = &bridgev2.Avatar{
-						ID: networkid.AvatarID(fmt.Sprintf("contact:%s:%s", portalID, hex.EncodeToString(avatarHash[:8]))),
-						Get: func(ctx context.Context) ([]byte, error) {
-							return avatarData, nil
-						},
-					}
+			if contact := c.lookupContact(portalID); contact != nil && len(contact.Avatar) > 0 {
+				avatarData := contact.Avatar
+				chatInfo.Avatar = &bridgev2.Avatar{
+					ID: c.avatarIDs.get("contact", portalID, avatarData),
+					Get: func(ctx context.Context) ([]byte, error) {
+						return avatarData, nil
+					},
 				}
 			}
 		}
@@ -6695,6 +7341,7 @@ func (c *IMClient) GetChatInfo(ctx context.Context, portal *bridgev2.Portal) (*b
 		// private_chat_portal_meta, the framework derives it from the ghost's
 		// display name, which auto-updates when contacts are edited.
 		chatInfo.Members = members
+		c.applyAutoJoin(members, portalID, "")
 
 		// New-portal-creation StatusKit invite hook. When bridgev2 materializes
 		// a fresh DM portal mid-uptime (incoming iMessage from a contact whose
@@ -6741,19 +7388,13 @@ func (c *IMClient) GetChatInfo(ctx context.Context, portal *bridgev2.Portal) (*b
 // raw identifier if no contact is found.
 func (c *IMClient) resolveContactDisplayname(identifier string) string {
 	localID := stripIdentifierPrefix(identifier)
-	if c.contacts != nil {
-		contact, contactErr := c.contacts.GetContactInfo(localID)
-		if contactErr != nil {
-			c.Main.Bridge.Log.Debug().Err(contactErr).Str("id", localID).Msg("Failed to resolve contact info")
-		}
-		if contact != nil && contact.HasName() {
-			return c.Main.Config.FormatDisplayname(DisplaynameParams{
-				FirstName: contact.FirstName,
-				LastName:  contact.LastName,
-				Nickname:  contact.Nickname,
-				ID:        localID,
-			})
-		}
+	if contact := c.lookupContact(localID); contact != nil && contact.HasName() {
+		return c.Main.Config.FormatDisplayname(DisplaynameParams{
+			FirstName: contact.FirstName,
+			LastName:  contact.LastName,
+			Nickname:  contact.Nickname,
+			ID:        localID,
+		})
 	}
 	return c.Main.Config.FormatDisplayname(identifierToDisplaynameParams(identifier))
 }
@@ -6770,19 +7411,13 @@ func (c *IMClient) GetUserInfo(ctx context.Context, ghost *bridgev2.Ghost) (*bri
 		Identifiers: []string{identifier},
 	}
 
-	// Try contact info from cloud contacts (iCloud CardDAV)
+	// Try contact info from the unified contact lookup (CardDAV / iCloud /
+	// chat.db, merged per contact_merge_strategy).
 	localID := stripIdentifierPrefix(identifier)
-	var contact *imessage.Contact
-	if c.contacts != nil {
-		var contactErr error
-		contact, contactErr = c.contacts.GetContactInfo(localID)
-		if contactErr != nil {
-			zerolog.Ctx(ctx).Debug().Err(contactErr).Str("id", localID).Msg("Failed to resolve contact info")
-		}
-	}
+	contact := c.lookupContact(localID)
 
 	// User-provided contacts (CardDAV / iCloud) always win. Any match from
-	// c.contacts fully overrides the shared iMessage profile, regardless of
+	// the contact sources fully overrides the shared iMessage profile, regardless of
 	// whether the contact has a name or photo: the user adding an entry is
 	// itself the signal that they want their own data used. Shared profiles
 	// only fill the gap when the identifier is unknown to the address book.
@@ -6799,21 +7434,21 @@ func (c *IMClient) GetUserInfo(ctx context.Context, ghost *bridgev2.Ghost) (*bri
 			name := c.Main.Config.FormatDisplayname(identifierToDisplaynameParams(identifier))
 			ui.Name = &name
 		}
-		for _, phone := range contact.Phones {
-			ui.Identifiers = append(ui.Identifiers, "tel:"+phone)
-		}
-		for _, email := range contact.Emails {
-			ui.Identifiers = append(ui.Identifiers, "mailto:"+email)
-		}
+		ui.Identifiers = ghostIdentifiers(identifier, contact)
 		if len(contact.Avatar) > 0 {
-			avatarHash := sha256.Sum256(contact.Avatar)
 			avatarData := contact.Avatar // capture for closure
 			ui.Avatar = &bridgev2.Avatar{
-				ID: networkid.AvatarID(fmt.Sprintf("contact:%s:%s", identifier, hex.EncodeToString(avatarHash[:8]))),
+				ID: c.avatarIDs.get("contact", identifier, avatarData),
 				Get: func(ctx context.Context) ([]byte, error) {
 					return avatarData, nil
 				},
 			}
+		} else {
+			name := strings.TrimSpace(contact.FirstName + " " + contact.LastName)
+			if name == "" {
+				name = contact.Nickname
+			}
+			ui.Avatar = c.fallbackAvatar(identifier, name)
 		}
 		return ui, nil
 	}
@@ -6821,25 +7456,22 @@ func (c *IMClient) GetUserInfo(ctx context.Context, ghost *bridgev2.Ghost) (*bri
 	// No user-provided contact — fall back to a shared iMessage profile
 	// (Name & Photo Sharing / Me card) if one was received and cached.
 	if profile := c.lookupSharedProfile(identifier); profile != nil {
-		if profile.FirstName != "" || profile.LastName != "" || profile.DisplayName != "" {
-			name := c.Main.Config.FormatDisplayname(DisplaynameParams{
-				FirstName: profile.FirstName,
-				LastName:  profile.LastName,
-				ID:        localID,
-			})
+		if name := c.sharedProfileName(identifier); name != "" {
 			ui.Name = &name
 		}
 		if profile.Avatar != nil && len(*profile.Avatar) > 0 {
 			avatarData := *profile.Avatar
-			avatarHash := sha256.Sum256(avatarData)
 			ui.Avatar = &bridgev2.Avatar{
-				ID: networkid.AvatarID(fmt.Sprintf("improfile:%s:%s", identifier, hex.EncodeToString(avatarHash[:8]))),
+				ID: c.avatarIDs.get("improfile", identifier, avatarData),
 				Get: func(ctx context.Context) ([]byte, error) {
 					return avatarData, nil
 				},
 			}
 		}
 		if ui.Name != nil {
+			if ui.Avatar == nil {
+				ui.Avatar = c.fallbackAvatar(identifier, *ui.Name)
+			}
 			return ui, nil
 		}
 	}
@@ -6847,6 +7479,9 @@ func (c *IMClient) GetUserInfo(ctx context.Context, ghost *bridgev2.Ghost) (*bri
 	// Final fallback: format from identifier
 	name := c.Main.Config.FormatDisplayname(identifierToDisplaynameParams(identifier))
 	ui.Name = &name
+	if ui.Avatar == nil {
+		ui.Avatar = c.fallbackAvatar(identifier, "")
+	}
 	return ui, nil
 }
 
@@ -6919,9 +7554,33 @@ type cloudBackfillCursor struct {
 	GUID        string `json:"g"`
 }
 
-func (c *IMClient) FetchMessages(ctx context.Context, params bridgev2.FetchMessagesParams) (*bridgev2.FetchMessagesResponse, error) {
+func (c *IMClient) FetchMessages(ctx context.Context, params bridgev2.FetchMessagesParams) (resp *bridgev2.FetchMessagesResponse, _ error) {
+	// A replayed backlog carries its own messages and isn't part of the
+	// initial backfill bookkeeping below.
+	if backlog, ok := params.BundledData.(*replayBacklog); ok && params.Forward {
+		return c.convertReplayBacklog(ctx, params.Portal, backlog), nil
+	}
 	fetchStart := time.Now()
 	log := zerolog.Ctx(ctx)
+	defer func(source string) {
+		if resp != nil {
+			c.Main.metrics.backfillAdd(source, len(resp.Messages))
+		}
+	}(c.backfillSource())
+	// Unique stream orders, so same-millisecond messages keep their order
+	// (see stream_order.go).
+	defer func() {
+		if resp != nil {
+			assignBackfillStreamOrders(resp.Messages)
+		}
+	}()
+	// Historical messages don't notify during a quiet bootstrap (see
+	// quiet_bootstrap.go).
+	defer func(quiet bool) {
+		if resp != nil && quiet {
+			markQuietBackfill(resp.Messages)
+		}
+	}(c.quietBackfill(params.Forward))
 
 	// For forward backfill calls: ensure the bootstrap pending counter is
 	// decremented on every return path. The normal path (with messages) sets
@@ -6985,6 +7644,21 @@ func (c *IMClient) FetchMessages(ctx context.Context, params bridgev2.FetchMessa
 		}
 	}
 
+	// CloudKit has nothing for this portal: backfill it from chat.db
+	// (see chatdb_fallback.go).
+	if c.chatDBBackfillFallback(ctx, portalID) {
+		log.Info().Str("portal_id", portalID).Bool("forward", params.Forward).
+			Msg("FetchMessages: no CloudKit messages for portal, falling back to chat.db")
+		return c.chatDB.FetchMessages(ctx, params, c)
+	}
+	// Off the Mac, the relay's copy of chat.db stands in for it (see
+	// relay_backfill.go).
+	if source := c.relayBackfillFallback(ctx, portalID); source != nil {
+		log.Info().Str("portal_id", portalID).Bool("forward", params.Forward).
+			Msg("FetchMessages: no CloudKit messages for portal, falling back to the NAC relay")
+		return c.fetchRelayMessages(ctx, params, source)
+	}
+
 	// Look up the group display name for system message filtering.
 	// Group rename system messages have text == display name but no attributedBody;
 	// this lets cloudRowToBackfillMessages filter them with an AND condition.
@@ -7276,6 +7950,11 @@ func (c *IMClient) FetchMessages(ctx context.Context, params bridgev2.FetchMessa
 					for i, j := 0, len(rows)-1; i < j; i, j = i+1, j-1 {
 						rows[i], rows[j] = rows[j], rows[i]
 					}
+					// Live messages may have reached the room since it
+					// was emptied; don't bridge those a second time.
+					if seam, seamErr := c.loadBackfillSeam(ctx, params.Portal.PortalKey); seamErr == nil {
+						rows = cloudRowsBeforeSeam(rows, seam)
+					}
 					allMessages := c.cloudRowsToBackfillMessages(ctx, rows, groupDisplayName)
 					log.Info().
 						Str("portal_id", portalID).
@@ -7317,8 +7996,14 @@ func (c *IMClient) FetchMessages(ctx context.Context, params bridgev2.FetchMessa
 	}
 	reverseCloudMessageRows(rows)
 
+	// Stay before the oldest message already in the room; rows is kept
+	// whole for the cursor below.
+	seam, seamErr := c.loadBackfillSeam(ctx, params.Portal.PortalKey)
+	if seamErr != nil {
+		log.Warn().Err(seamErr).Str("portal_id", portalID).Msg("Backward backfill: failed to load backfill seam")
+	}
 	convertStart := time.Now()
-	messages := c.cloudRowsToBackfillMessages(ctx, rows, groupDisplayName)
+	messages := c.cloudRowsToBackfillMessages(ctx, cloudRowsBeforeSeam(rows, seam), groupDisplayName)
 	convertElapsed := time.Since(convertStart)
 
 	var nextCursor networkid.PaginationCursor
@@ -7356,8 +8041,9 @@ func (c *IMClient) FetchMessages(ctx context.Context, params bridgev2.FetchMessa
 // This two-pass approach ensures reactions appear in BackfillMessage.Reactions
 // (correct DAG ordering) instead of being queued via QueueRemoteEvent (which
 // places them at the end of the DAG, making the sidebar show old reactions).
-// Tapback removes and tapbacks targeting messages outside this batch still
-// fall back to QueueRemoteEvent.
+// Tapbacks are reconciled rather than replayed (see tapback_reconcile.go):
+// only the state each sender's tapbacks end in is bridged, and tapbacks on
+// messages outside this batch only queue the changes from what's bridged.
 func (c *IMClient) cloudRowsToBackfillMessages(ctx context.Context, rows []cloudMessageRow, groupDisplayName string) []*bridgev2.BackfillMessage {
 	// Pass 1: convert regular messages, defer tapback rows.
 	var messages []*bridgev2.BackfillMessage
@@ -7379,8 +8065,11 @@ func (c *IMClient) cloudRowsToBackfillMessages(ctx context.Context, rows []cloud
 		}
 	}
 
-	// Pass 2: resolve tapbacks — attach to target if in this batch,
-	// otherwise fall back to QueueRemoteEvent.
+	// Pass 2: resolve tapbacks — split them by whether their target is in
+	// this batch.
+	var inBatch, outside []tapbackChange
+	messageByID := make(map[networkid.MessageID]*bridgev2.BackfillMessage, len(messageByGUID))
+	var portalKey networkid.PortalKey
 	for _, row := range tapbackRows {
 		sender := c.makeCloudSender(row)
 		if sender.Sender == "" && !sender.IsFromMe {
@@ -7390,6 +8079,10 @@ func (c *IMClient) cloudRowsToBackfillMessages(ctx context.Context, rows []cloud
 
 		tapbackType := *row.TapbackType
 		isRemove := tapbackType >= 3000
+		idx := tapbackType - 2000
+		if isRemove {
+			idx = tapbackType - 3000
+		}
 
 		// Parse target GUID and balloon-part index from "p:N/GUID" format.
 		targetGUID := row.TapbackTargetGUID
@@ -7402,33 +8095,49 @@ func (c *IMClient) cloudRowsToBackfillMessages(ctx context.Context, rows []cloud
 			continue
 		}
 
-		// Removes can't use BackfillReaction (framework only supports add).
-		// Tapbacks targeting messages outside this batch also fall back.
-		targetMsg, inBatch := messageByGUID[targetGUID]
-		if !isRemove && inBatch {
-			ts := time.UnixMilli(row.TimestampMS)
-			idx := tapbackType - 2000
-			emoji := tapbackTypeToEmoji(&idx, &row.TapbackEmoji)
+		if !isKnownTapbackType(&idx) {
+			zerolog.Ctx(ctx).Warn().Uint32("tapback_type", tapbackType).Str("guid", row.GUID).
+				Msg("Unknown tapback type in CloudKit, bridging it as a generic reaction")
+		}
+		change := tapbackChange{
+			Sender:    sender,
+			Emoji:     tapbackTypeToEmoji(&idx, &row.TapbackEmoji),
+			Remove:    isRemove,
+			Timestamp: time.UnixMilli(row.TimestampMS),
+		}
+		if targetMsg, ok := messageByGUID[targetGUID]; ok {
 			// Map balloon-part index to bridge part ID:
 			// bp 0 = text body (nil TargetPart → first part),
 			// bp >= 1 = attachment (att0, att1, …).
-			var targetPart *networkid.PartID
+			change.Target = targetMsg.ID
 			if bp >= 1 {
 				p := networkid.PartID(fmt.Sprintf("att%d", bp-1))
-				targetPart = &p
+				change.Part = &p
 			}
-			targetMsg.Reactions = append(targetMsg.Reactions, &bridgev2.BackfillReaction{
-				Sender:     sender,
-				Emoji:      emoji,
-				Timestamp:  ts,
-				TargetPart: targetPart,
-			})
+			messageByID[targetMsg.ID] = targetMsg
+			inBatch = append(inBatch, change)
 		} else {
-			// Fall back to QueueRemoteEvent for removes and out-of-batch targets.
-			c.cloudTapbackToBackfill(row, sender, time.UnixMilli(row.TimestampMS))
+			change.Target = c.resolveTapbackTargetID(targetGUID, bp)
+			portalKey = networkid.PortalKey{ID: networkid.PortalID(row.PortalID), Receiver: c.UserLogin.ID}
+			outside = append(outside, change)
 		}
 	}
 
+	// Messages in this batch aren't bridged yet, so they get the final
+	// tapbacks as BackfillReactions, and removals have nothing to undo.
+	for _, tc := range reconcileTapbacks(nil, latestTapbacks(inBatch)) {
+		targetMsg := messageByID[tc.Target]
+		targetMsg.Reactions = append(targetMsg.Reactions, &bridgev2.BackfillReaction{
+			Sender:     tc.Sender,
+			Emoji:      tc.Emoji,
+			Timestamp:  tc.Timestamp,
+			TargetPart: tc.Part,
+		})
+	}
+	if len(outside) > 0 {
+		c.queueTapbackChanges(ctx, portalKey, outside)
+	}
+
 	return messages
 }
 
@@ -7470,26 +8179,9 @@ func (c *IMClient) cloudRowToBackfillMessages(ctx context.Context, row cloudMess
 	var messages []*bridgev2.BackfillMessage
 
 	// Text message — trim OBJ placeholders before building body.
-	body := strings.Trim(row.Text, "\ufffc \n")
-	var formattedBody string
-	if row.Subject != "" {
-		if body != "" {
-			formattedBody = fmt.Sprintf("<strong>%s</strong><br>%s", html.EscapeString(row.Subject), html.EscapeString(body))
-			body = fmt.Sprintf("**%s**\n%s", row.Subject, body)
-		} else {
-			body = row.Subject
-		}
-	}
-	hasText := strings.TrimSpace(body) != ""
+	textContent := subjectMessageContent(row.Subject, strings.Trim(row.Text, "\ufffc \n"))
+	hasText := strings.TrimSpace(textContent.Body) != ""
 	if hasText {
-		textContent := &event.MessageEventContent{
-			MsgType: event.MsgText,
-			Body:    body,
-		}
-		if formattedBody != "" {
-			textContent.Format = event.FormatHTML
-			textContent.FormattedBody = formattedBody
-		}
 		if c.Main.Config.URLPreviewsInBackfill {
 			if detectedURL := urlRegex.FindString(row.Text); detectedURL != "" {
 				textContent.BeeperLinkPreviews = []*event.BeeperLinkPreview{
@@ -7503,8 +8195,9 @@ func (c *IMClient) cloudRowToBackfillMessages(ctx context.Context, row cloudMess
 			Timestamp: ts,
 			ConvertedMessage: &bridgev2.ConvertedMessage{
 				Parts: []*bridgev2.ConvertedMessagePart{{
-					Type:    event.EventMessage,
-					Content: textContent,
+					Type:       event.EventMessage,
+					Content:    textContent,
+					DBMetadata: subjectMetadata(row.Subject),
 				}},
 			},
 		})
@@ -7537,6 +8230,9 @@ func (c *IMClient) cloudRowToBackfillMessages(ctx context.Context, row cloudMess
 		})
 	}
 
+	if c.Main.Config.MessageServiceInBackfill {
+		markMessageService(messages, row.Service)
+	}
 	return messages
 }
 
@@ -7556,9 +8252,9 @@ func (c *IMClient) makeCloudSender(row cloudMessageRow) bridgev2.EventSender {
 		}
 	}
 	if normalizedSender == "" {
-		normalizedSender = row.Sender
+		return bridgev2.EventSender{Sender: makeUserID(row.Sender)}
 	}
-	return bridgev2.EventSender{Sender: makeUserID(normalizedSender)}
+	return bridgev2.EventSender{Sender: c.canonicalGhostID(normalizedSender)}
 }
 
 // cloudTapbackToBackfill converts a CloudKit reaction record to a backfill reaction event.
@@ -7570,6 +8266,10 @@ func (c *IMClient) cloudTapbackToBackfill(row cloudMessageRow, sender bridgev2.E
 		idx = tapbackType - 3000
 	}
 	emoji := tapbackTypeToEmoji(&idx, &row.TapbackEmoji)
+	if !isKnownTapbackType(&idx) {
+		c.UserLogin.Log.Warn().Uint32("tapback_type", tapbackType).Str("guid", row.GUID).
+			Msg("Unknown tapback type in CloudKit, bridging it as a generic reaction")
+	}
 
 	// Parse target GUID from "p:N/GUID" format, preserving the part index.
 	targetGUID := row.TapbackTargetGUID
@@ -7628,7 +8328,13 @@ func (c *IMClient) cloudTapbackToBackfill(row cloudMessageRow, sender bridgev2.E
 // message). Filename-based because that's the only signal CloudKit reliably
 // preserves; the plist always uses the .pluginPayloadAttachment extension.
 func isPluginPayloadAttachment(att cloudAttachmentRow) bool {
-	return strings.HasSuffix(att.Filename, ".pluginPayloadAttachment")
+	return isPluginPayloadFilename(att.Filename)
+}
+
+// isPluginPayloadFilename reports whether a filename or path is a rich-link
+// plugin payload sideband. Shared by the CloudKit and chat.db backfill paths.
+func isPluginPayloadFilename(name string) bool {
+	return strings.HasSuffix(name, ".pluginPayloadAttachment")
 }
 
 // cloudAttachmentResult holds the result of a concurrent attachment download+upload.
@@ -7868,9 +8574,11 @@ func (c *IMClient) downloadAndUploadAttachment(
 			Msg("CloudKit attachment returned empty data")
 		return nil
 	}
+	// The download as is, for an upload retry (see failed_upload.go).
+	downloaded := data
 
 	mimeType := att.MimeType
-	fileName := att.Filename
+	fileName := sanitizeAttachmentFileName(att.Filename)
 	if mimeType == "" {
 		mimeType = utiToMIME(att.UTIType)
 	}
@@ -7961,7 +8669,6 @@ func (c *IMClient) downloadAndUploadAttachment(
 	msgType := mimeToMsgType(mimeType)
 	content := &event.MessageEventContent{
 		MsgType: msgType,
-		Body:    fileName,
 		Info: &event.FileInfo{
 			MimeType: mimeType,
 			Size:     len(data),
@@ -7969,6 +8676,7 @@ func (c *IMClient) downloadAndUploadAttachment(
 			Height:   imgHeight,
 		},
 	}
+	setAttachmentBody(content, fileName, c.Main.Config.HideMediaFilenames)
 
 	// Mark as voice message if this was a CAF voice recording
 	if durationMs > 0 {
@@ -7980,6 +8688,21 @@ func (c *IMClient) downloadAndUploadAttachment(
 
 	url, encFile, uploadErr := intent.UploadMedia(ctx, "", data, fileName, mimeType)
 	if uploadErr != nil {
+		if placeholder := c.failedBackfillUpload(ctx, networkid.PortalID(row.PortalID), &pendingAttachmentRow{
+			MessageGUID: row.GUID,
+			AttIndex:    i,
+			AttID:       attID,
+			Filename:    att.Filename,
+			MimeType:    att.MimeType,
+			UtiType:     att.UTIType,
+		}, downloaded, uploadErr, sender, ts); placeholder != nil {
+			return []*bridgev2.BackfillMessage{{
+				Sender:           sender,
+				ID:               makeMessageID(attID),
+				Timestamp:        ts,
+				ConvertedMessage: placeholder,
+			}}
+		}
 		fe := c.recordAttachmentFailure(att.RecordName, uploadErr.Error())
 		log.Warn().Err(uploadErr).
 			Str("guid", row.GUID).
@@ -8584,6 +9307,58 @@ func (c *IMClient) periodicPetRefresh(log zerolog.Logger) {
 	}
 }
 
+// defaultDeletedMessageRetentionDays is the fallback retention window when
+// deleted_message_retention_days is unset or invalid.
+const defaultDeletedMessageRetentionDays = 30
+
+// deletedMessageRetention is how long soft-deleted cloud_message rows are kept
+// for echo detection. See IMConfig.DeletedMessageRetentionDays.
+func (c *IMClient) deletedMessageRetention() time.Duration {
+	days := c.Main.Config.DeletedMessageRetentionDays
+	if days <= 0 {
+		days = defaultDeletedMessageRetentionDays
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// periodicDeletedMessagePrune drops soft-deleted cloud_message rows that have
+// outlived the retention window. Runs once at startup and then every 12h.
+// Portals in recentlyDeletedPortals are passed as protected so a deletion
+// that's still being processed never loses its echo-detection rows.
+func (c *IMClient) periodicDeletedMessagePrune(log zerolog.Logger) {
+	if c.cloudStore == nil {
+		return
+	}
+	log = log.With().Str("component", "deleted_message_prune").Logger()
+	prune := func() {
+		c.recentlyDeletedPortalsMu.RLock()
+		protected := make([]string, 0, len(c.recentlyDeletedPortals))
+		for portalID := range c.recentlyDeletedPortals {
+			protected = append(protected, portalID)
+		}
+		c.recentlyDeletedPortalsMu.RUnlock()
+
+		cutoff := time.Now().Add(-c.deletedMessageRetention()).UnixMilli()
+		if pruned, err := c.cloudStore.pruneDeletedMessages(context.Background(), cutoff, protected); err != nil {
+			log.Warn().Err(err).Msg("Failed to prune deleted cloud messages")
+		} else if pruned > 0 {
+			log.Info().Int64("pruned", pruned).Msg("Pruned deleted cloud_message rows past retention window")
+		}
+	}
+
+	prune()
+	ticker := time.NewTicker(12 * time.Hour)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			prune()
+		case <-c.stopChan:
+			return
+		}
+	}
+}
+
 // periodicStatusSharingReinvite re-runs the pending-only StatusKit invite
 // sweep every 4h. Peers who've already keyed us are skipped inside the
 // sweep. The periodic path sets respectSpacing=true so per-handle KV
@@ -8604,24 +9379,34 @@ func (c *IMClient) periodicStatusSharingReinvite(log zerolog.Logger) {
 	}
 }
 
-// periodicCloudContactSync re-fetches contacts from iCloud CardDAV every
-// 15 minutes. Also re-runs the shared iMessage profile re-fetch on the
-// same tick so we keep one ticker but don't gate the share-profile path
-// behind CardDAV success — refreshAllSharedProfiles only needs CloudKit
-// (ProfilesClient) and runs independently even if SyncContacts errors.
+// periodicCloudContactSync re-fetches contacts from CardDAV every
+// contactSyncInterval, retrying failed syncs sooner (see
+// contact_sync_health.go). Also re-runs the shared iMessage profile
+// re-fetch on the regular interval, so we keep one timer but don't gate
+// the share-profile path behind CardDAV success — refreshAllSharedProfiles
+// only needs CloudKit (ProfilesClient) and runs independently even if
+// SyncContacts errors.
 func (c *IMClient) periodicCloudContactSync(log zerolog.Logger) {
-	ticker := time.NewTicker(15 * time.Minute)
-	defer ticker.Stop()
+	health := c.newContactSyncHealth()
+	lastProfileRefresh := time.Now()
+	timer := time.NewTimer(health.nextSync())
+	defer timer.Stop()
 	for {
 		select {
-		case <-ticker.C:
-			if err := c.contacts.SyncContacts(log); err != nil {
-				log.Warn().Err(err).Msg("Periodic CardDAV sync failed")
+		case <-timer.C:
+			err := c.contacts.SyncContacts(log)
+			if err != nil {
+				log.Warn().Err(err).Int("failures", health.failures+1).Msg("Periodic CardDAV sync failed")
 			} else {
 				c.setContactsReady(log)
 				c.persistMmeDelegate(log)
 			}
-			c.refreshAllSharedProfiles(log)
+			c.reportContactSync(log, health, err)
+			if time.Since(lastProfileRefresh) >= contactSyncInterval {
+				c.refreshAllSharedProfiles(log)
+				lastProfileRefresh = time.Now()
+			}
+			timer.Reset(health.nextSync())
 		case <-c.stopChan:
 			return
 		}
@@ -8665,7 +9450,7 @@ func (c *IMClient) retryCloudContacts(log zerolog.Logger) {
 		select {
 		case <-ticker.C:
 			log.Info().Msg("Retrying cloud contacts initialization...")
-			c.contacts = newCloudContactsClient(c.client, log)
+			c.contacts = newCloudContactsClient(c.client, c.accountRegion, log)
 			if c.contacts != nil {
 				if syncErr := c.contacts.SyncContacts(log); syncErr != nil {
 					log.Warn().Err(syncErr).Msg("Cloud contacts retry: sync failed")
@@ -8718,6 +9503,7 @@ func (c *IMClient) refreshAllGhosts(log zerolog.Logger) {
 	}
 
 	updated := 0
+	pacer := c.newGhostUpdatePacer()
 	for _, ghostID := range ghostIDs {
 		ghost, err := c.Main.Bridge.GetGhostByID(ctx, ghostID)
 		if err != nil {
@@ -8728,6 +9514,10 @@ func (c *IMClient) refreshAllGhosts(log zerolog.Logger) {
 		if err != nil || info == nil {
 			continue
 		}
+		if !pacer.wait() {
+			log.Info().Int("updated", updated).Msg("Contact refresh: stopped before all ghosts were refreshed")
+			return
+		}
 		ghost.UpdateInfo(ctx, info)
 		updated++
 	}
@@ -8832,16 +9622,11 @@ func normalizePhoneIdentifierForPortalID(local string) string {
 func (c *IMClient) makeEventSender(sender *string) bridgev2.EventSender {
 	if sender == nil || *sender == "" || c.isMyHandle(*sender) {
 		c.ensureDoublePuppet()
-		return bridgev2.EventSender{
-			IsFromMe:    true,
-			SenderLogin: c.UserLogin.ID,
-			Sender:      makeUserID(c.handle),
-		}
+		return fromMeEventSender(c.UserLogin.ID, c.handle)
 	}
-	normalizedSender := normalizeIdentifierForPortalID(*sender)
 	return bridgev2.EventSender{
 		IsFromMe: false,
-		Sender:   makeUserID(normalizedSender),
+		Sender:   c.canonicalGhostID(*sender),
 	}
 }
 
@@ -8856,6 +9641,8 @@ func (c *IMClient) makeEventSender(sender *string) bridgev2.EventSender {
 //
 // This workaround detects the cached nil and re-attempts login using the
 // saved access token, which succeeds once IDS registration stabilizes.
+// Retries are throttled, and stop for good when the token has expired (see
+// double_puppet_health.go).
 func (c *IMClient) ensureDoublePuppet() {
 	ctx := context.Background()
 	user := c.UserLogin.User
@@ -8863,14 +9650,23 @@ func (c *IMClient) ensureDoublePuppet() {
 		return // already working
 	}
 	token := user.AccessToken
-	if token == "" {
-		return // no token to retry with
+	if !c.doublePuppetRetry.shouldAttempt(token, time.Now()) {
+		return // no token to retry with, or too soon after the last failure
 	}
 	user.LogoutDoublePuppet(ctx)
-	if err := user.LoginDoublePuppet(ctx, token); err != nil {
-		c.UserLogin.Log.Warn().Err(err).Msg("Failed to re-establish double puppet")
-	} else {
+	err := user.LoginDoublePuppet(ctx, token)
+	switch {
+	case err == nil:
+		c.doublePuppetRetry.reset()
 		c.UserLogin.Log.Info().Msg("Re-established double puppet after previous failure")
+	case c.doublePuppetRetry.recordFailure(err, time.Now()):
+		// The token stays cleared, so there are no more retries until the
+		// user sets a new one.
+		c.UserLogin.Log.Warn().Err(err).Msg("Double puppet access token has expired, not retrying until it's refreshed")
+		go c.promptDoublePuppetRefresh(ctx, c.UserLogin.Log, err)
+	default:
+		c.restoreDoublePuppetToken(ctx, token)
+		c.UserLogin.Log.Warn().Err(err).Msg("Failed to re-establish double puppet")
 	}
 }
 
@@ -8915,6 +9711,31 @@ func (c *IMClient) resolveExistingDMPortalID(identifier string) networkid.Portal
 		return defaultID
 	}
 
+	ctx := context.Background()
+	for _, candidate := range legacyDMPortalCandidates(identifier) {
+		portal, err := c.Main.Bridge.GetExistingPortalByKey(ctx, networkid.PortalKey{
+			ID:       networkid.PortalID(candidate),
+			Receiver: c.UserLogin.ID,
+		})
+		if err == nil && portal != nil && portal.MXID != "" {
+			c.UserLogin.Log.Debug().
+				Str("normalized", identifier).
+				Str("resolved", candidate).
+				Msg("Resolved DM portal to existing legacy identifier")
+			return networkid.PortalID(candidate)
+		}
+	}
+
+	return defaultID
+}
+
+// legacyDMPortalCandidates lists the older key variants a DM portal for a
+// normalized tel: identifier may have been created under, in the order
+// resolveExistingDMPortalID tries them. Other identifiers have none.
+func legacyDMPortalCandidates(identifier string) []string {
+	if !strings.HasPrefix(identifier, "tel:") {
+		return nil
+	}
 	local := strings.TrimPrefix(identifier, "tel:")
 	candidates := make([]string, 0, 3)
 	seen := map[string]bool{identifier: true}
@@ -8940,23 +9761,7 @@ func (c *IMClient) resolveExistingDMPortalID(identifier string) networkid.Portal
 			add("tel:" + local[1:])
 		}
 	}
-
-	ctx := context.Background()
-	for _, candidate := range candidates {
-		portal, err := c.Main.Bridge.GetExistingPortalByKey(ctx, networkid.PortalKey{
-			ID:       networkid.PortalID(candidate),
-			Receiver: c.UserLogin.ID,
-		})
-		if err == nil && portal != nil && portal.MXID != "" {
-			c.UserLogin.Log.Debug().
-				Str("normalized", identifier).
-				Str("resolved", candidate).
-				Msg("Resolved DM portal to existing legacy identifier")
-			return networkid.PortalID(candidate)
-		}
-	}
-
-	return defaultID
+	return candidates
 }
 
 // ensureGroupPortalIndex lazily loads all existing group portals from the DB
@@ -9812,8 +10617,22 @@ func (c *IMClient) makeConversation(participants []string, groupName *string) ru
 	}
 }
 
+// portalToConversation builds the conversation to send to portal. The
+// iMessage/SMS choice only uses cached reachability, so it never waits on
+// IDS; message sends use sendConversation (see transport_select.go).
 func (c *IMClient) portalToConversation(portal *bridgev2.Portal) rustpushgo.WrappedConversation {
+	return c.buildConversation(portal, false)
+}
+
+// sendConversation is portalToConversation for message sends: targets whose
+// reachability isn't cached are looked up first.
+func (c *IMClient) sendConversation(portal *bridgev2.Portal) rustpushgo.WrappedConversation {
+	return c.buildConversation(portal, true)
+}
+
+func (c *IMClient) buildConversation(portal *bridgev2.Portal, lookupReachability bool) rustpushgo.WrappedConversation {
 	portalID := string(portal.ID)
+	sendHandle := c.portalHandle(portal)
 	isSms := c.isPortalSMS(portalID)
 
 	isGroup := strings.HasPrefix(portalID, "gid:") || strings.Contains(portalID, ",")
@@ -9886,6 +10705,16 @@ func (c *IMClient) portalToConversation(portal *bridgev2.Portal) rustpushgo.Wrap
 		if guid != "" {
 			senderGuid = &guid
 		}
+		if sendHandle != c.handle {
+			participants = withSendHandle(participants, sendHandle, c.isMyHandle)
+		}
+		// Re-check the group's service: members joining or leaving
+		// iMessage flip it between an iMessage and an SMS group
+		// (see transport_select.go).
+		if groupIsSms := c.groupTransportIsSMS(participants, sendHandle, isSms, lookupReachability); groupIsSms != isSms {
+			c.setPortalSMS(context.Background(), portal, groupIsSms)
+			isSms = groupIsSms
+		}
 		return rustpushgo.WrappedConversation{
 			Participants: participants,
 			GroupName:    groupName,
@@ -9905,9 +10734,14 @@ func (c *IMClient) portalToConversation(portal *bridgev2.Portal) rustpushgo.Wrap
 	// For self-chats, only include one participant. Duplicating our own
 	// handle (e.g. [self, self]) causes rustpush to reject the message
 	// with NoValidTargets because all targets belong to the sender.
-	participants := []string{c.handle, sendTo}
+	participants := []string{sendHandle, sendTo}
 	if c.isMyHandle(sendTo) {
 		participants = []string{sendTo}
+	} else if cleanPortalID == portalID {
+		// Pick iMessage or SMS per send from cached reachability rather
+		// than the sticky smsPortals flag (see transport_select.go).
+		// Legacy suffixed portal IDs can only ever be SMS.
+		isSms = c.dmTransportIsSMS(sendTo, sendHandle, isSms, lookupReachability)
 	}
 
 	return rustpushgo.WrappedConversation{
@@ -9921,11 +10755,18 @@ func (c *IMClient) portalToConversation(portal *bridgev2.Portal) rustpushgo.Wrap
 // by makePortalKey), then the cloud store DB; for legacy comma-separated
 // portal IDs it splits the ID string.
 func (c *IMClient) resolveGroupMembers(ctx context.Context, portalID string) []string {
+	members, _ := c.resolveGroupMembersPartial(ctx, portalID)
+	return members
+}
+
+// resolveGroupMembersPartial is resolveGroupMembers, also reporting whether
+// the list is only the partial roster derived from message senders.
+func (c *IMClient) resolveGroupMembersPartial(ctx context.Context, portalID string) (members []string, partial bool) {
 	if strings.HasPrefix(portalID, "gid:") {
 		// 1) Check cloud store DB (persisted from CloudKit sync or previous messages)
 		if c.cloudStore != nil {
 			if participants, err := c.cloudStore.getChatParticipantsByPortalID(ctx, portalID); err == nil && len(participants) > 0 {
-				return participants
+				return participants, false
 			}
 		}
 		// 2) Fallback to in-memory cache (populated synchronously by makePortalKey).
@@ -9935,11 +10776,19 @@ func (c *IMClient) resolveGroupMembers(ctx context.Context, portalID string) []s
 		cached := c.imGroupParticipants[portalID]
 		c.imGroupParticipantsMu.RUnlock()
 		if len(cached) > 0 {
-			return cached
+			return cached, false
 		}
-		return nil
+		// 3) The chat record never synced (CloudKit gap) and nothing live
+		// has arrived: take whoever sent the group's synced messages, so
+		// the room isn't empty. Partial by nature.
+		if c.cloudStore != nil {
+			if senders, err := c.cloudStore.getSenderParticipantsByPortalID(ctx, portalID); err == nil && len(senders) > 0 {
+				return senders, true
+			}
+		}
+		return nil, false
 	}
-	return strings.Split(portalID, ",")
+	return strings.Split(portalID, ","), false
 }
 
 // resolveGroupName determines the best display name for a group portal.
@@ -9977,45 +10826,59 @@ func (c *IMClient) resolveGroupName(ctx context.Context, portalID string) (name
 }
 
 // buildGroupName creates a human-readable group name from member identifiers
-// by resolving contact names where possible, falling back to phone/email.
+// by resolving contact names where possible, then names shared with Name and
+// Photo Sharing, falling back to phone/email.
+//
+// Only the members that end up in the name are resolved, so a group with
+// hundreds of members costs three lookups, not hundreds.
 func (c *IMClient) buildGroupName(members []string) string {
-	var names []string
+	var others []string
 	for _, memberID := range members {
-		if c.isMyHandle(memberID) {
-			continue // skip self
+		if !c.isMyHandle(memberID) {
+			others = append(others, memberID)
 		}
-		// Strip tel:/mailto: prefix for contact lookup
-		lookupID := stripIdentifierPrefix(memberID)
-		name := ""
-		var contact *imessage.Contact
-		if c.contacts != nil {
-			var contactErr error
-			contact, contactErr = c.contacts.GetContactInfo(lookupID)
-			if contactErr != nil {
-				c.Main.Bridge.Log.Debug().Err(contactErr).Str("id", lookupID).Msg("Failed to resolve contact info")
-			}
-		}
-
-		if contact != nil && contact.HasName() {
-			name = c.Main.Config.FormatDisplayname(DisplaynameParams{
-				FirstName: contact.FirstName,
-				LastName:  contact.LastName,
-				Nickname:  contact.Nickname,
-				ID:        lookupID,
-			})
+	}
+	if len(others) == 0 {
+		return "Group Chat"
+	}
+	shown := others
+	if len(others) > 4 {
+		shown = others[:3]
+	}
+	names := make([]string, 0, len(shown))
+	for _, memberID := range shown {
+		name := c.memberContactName(memberID)
+		if name == "" {
+			// The name the member shares in Messages, as their iPhone shows it.
+			name = c.sharedProfileName(normalizeIdentifierForPortalID(memberID))
 		}
 		if name == "" {
-			name = lookupID // raw phone/email without prefix
+			name = stripIdentifierPrefix(memberID) // raw phone/email without prefix
 		}
 		names = append(names, name)
 	}
-	if len(names) == 0 {
-		return "Group Chat"
-	}
-	if len(names) <= 4 {
+	if len(others) <= 4 {
 		return strings.Join(names, ", ")
 	}
-	return fmt.Sprintf("%s, %s, %s +%d more", names[0], names[1], names[2], len(names)-3)
+	return fmt.Sprintf("%s, %s, %s +%d more", names[0], names[1], names[2], len(others)-3)
+}
+
+// memberContactName returns the contact name of a member identifier
+// formatted with the displayname template, or "" if there's no contact with
+// a name for it.
+func (c *IMClient) memberContactName(memberID string) string {
+	// Strip tel:/mailto: prefix for contact lookup
+	lookupID := stripIdentifierPrefix(memberID)
+	contact := c.lookupContact(lookupID)
+	if contact == nil || !contact.HasName() {
+		return ""
+	}
+	return c.Main.Config.FormatDisplayname(DisplaynameParams{
+		FirstName: contact.FirstName,
+		LastName:  contact.LastName,
+		Nickname:  contact.Nickname,
+		ID:        lookupID,
+	})
 }
 
 // ============================================================================
@@ -10026,15 +10889,24 @@ type attachmentMessage struct {
 	*rustpushgo.WrappedMessage
 	Attachment *rustpushgo.WrappedAttachment
 	Index      int
+	// Preview is the inline low-res copy that came with a full-res MMCS
+	// attachment (see selectAttachmentVariants); used as the thumbnail.
+	Preview []byte
+	// LivePhotoStill is set on the video half of a Live Photo to the
+	// message ID of its still (see pairLivePhotos).
+	LivePhotoStill networkid.MessageID
+	// ID is the message ID the attachment is bridged under.
+	ID networkid.MessageID
 }
 
 // stickerTapbackData carries the image bytes for a sticker placed on a
-// message bubble (iMessage sticker tapback, type 7). Bridged as an image
-// message replying to the target since Matrix reactions are text-only.
+// message bubble (iMessage sticker tapback, type 7). Bridged as an m.sticker
+// replying to the target since Matrix reactions are text-only.
 type stickerTapbackData struct {
 	ImageData []byte
 	MimeType  string
-	TargetID  string // UUID of the message the sticker was placed on
+	// TargetID is the message (part) the sticker was placed on.
+	TargetID networkid.MessageID
 }
 
 func convertStickerTapback(ctx context.Context, intent bridgev2.MatrixAPI, data *stickerTapbackData) (*bridgev2.ConvertedMessage, error) {
@@ -10046,6 +10918,15 @@ func convertStickerTapback(ctx context.Context, intent bridgev2.MatrixAPI, data
 			Size:     len(data.ImageData),
 		},
 	}
+	// Anything that isn't an image stays an m.image.
+	partType := event.EventMessage
+	if stickerKindImage.bridgesAsSticker(data.MimeType) {
+		if cfg, _, err := image.DecodeConfig(bytes.NewReader(data.ImageData)); err == nil {
+			content.Info.Width, content.Info.Height = cfg.Width, cfg.Height
+		}
+		partType = event.EventSticker
+		makeStickerContent(content, stickerKindImage)
+	}
 	if intent != nil {
 		url, encFile, err := intent.UploadMedia(ctx, "", data.ImageData, "sticker.png", data.MimeType)
 		if err != nil {
@@ -10059,16 +10940,23 @@ func convertStickerTapback(ctx context.Context, intent bridgev2.MatrixAPI, data
 	}
 	cm := &bridgev2.ConvertedMessage{
 		Parts: []*bridgev2.ConvertedMessagePart{{
-			Type:    event.EventMessage,
+			Type:    partType,
 			Content: content,
 		}},
 	}
 	if data.TargetID != "" {
-		cm.ReplyTo = &networkid.MessageOptionalPartID{MessageID: makeMessageID(data.TargetID)}
+		cm.ReplyTo = &networkid.MessageOptionalPartID{MessageID: data.TargetID}
 	}
 	return cm, nil
 }
 
+// isRichLinkSidebandMime reports whether an attachment is one of the rich
+// link sidebands the Rust wrapper encodes for a URL balloon. They feed
+// convertURLPreviewToBeeper and must never be bridged as files or images.
+func isRichLinkSidebandMime(mimeType string) bool {
+	return strings.HasPrefix(mimeType, "x-richlink/")
+}
+
 // convertURLPreviewToBeeper parses rich link sideband attachments from an
 // inbound iMessage and returns Beeper link previews. Follows the pattern
 // from mautrix-whatsapp's urlpreview.go.
@@ -10107,10 +10995,10 @@ func convertURLPreviewToBeeper(ctx context.Context, portal *bridgev2.Portal, int
 		}
 
 		log.Debug().
-			Str("original_url", originalURL).
-			Str("canonical_url", canonicalURL).
-			Str("title", title).
-			Str("description", description).
+			Str("original_url", logText(originalURL)).
+			Str("canonical_url", logText(canonicalURL)).
+			Str("title", logText(title)).
+			Str("description", logText(description)).
 			Str("image_mime", imageMime).
 			Msg("Parsed rich link sideband data from iMessage")
 
@@ -10151,52 +11039,82 @@ func convertURLPreviewToBeeper(ctx context.Context, portal *bridgev2.Portal, int
 			}
 		}
 
-		log.Debug().Str("matched_url", matchedURL).Str("title", title).Msg("Inbound rich link preview ready")
+		log.Debug().Str("matched_url", logText(matchedURL)).Str("title", logText(title)).Msg("Inbound rich link preview ready")
 		return []*event.BeeperLinkPreview{preview}
 	}
 
 	// No rich link from iMessage — auto-detect URL and fetch og: metadata + image
 	if detectedURL := urlRegex.FindString(bodyText); detectedURL != "" {
-		log.Debug().Str("detected_url", detectedURL).Msg("No iMessage rich link, fetching URL preview")
+		log.Debug().Str("detected_url", logText(detectedURL)).Msg("No iMessage rich link, fetching URL preview")
 		return []*event.BeeperLinkPreview{fetchURLPreview(ctx, portal.Bridge, intent, portal.MXID, detectedURL)}
 	}
 
 	return nil
 }
 
-func convertMessage(ctx context.Context, portal *bridgev2.Portal, intent bridgev2.MatrixAPI, msg *rustpushgo.WrappedMessage) (*bridgev2.ConvertedMessage, error) {
-	text := strings.TrimSpace(strings.ReplaceAll(ptrStringOr(msg.Text, ""), "\uFFFC", ""))
+// subjectMessageContent builds the text content of a message with an
+// optional subject line. A subject with a body is shown as a bold first
+// line. A subject on its own is an announcement rather than conversation —
+// some iMessage flows send a group's subject line with no body — so it's
+// bridged as an m.notice.
+func subjectMessageContent(subject, text string) *event.MessageEventContent {
 	content := &event.MessageEventContent{
 		MsgType: event.MsgText,
 		Body:    text,
 	}
-	if msg.Subject != nil && *msg.Subject != "" {
-		if text != "" {
-			content.Body = fmt.Sprintf("**%s**\n%s", *msg.Subject, text)
-			content.Format = event.FormatHTML
-			content.FormattedBody = fmt.Sprintf("<strong>%s</strong><br/>%s", *msg.Subject, text)
-		} else {
-			content.Body = *msg.Subject
-		}
+	subject = strings.TrimSpace(subject)
+	if subject == "" {
+		return content
+	}
+	if text == "" {
+		content.MsgType = event.MsgNotice
+		content.Body = subject
+		return content
 	}
+	content.Body = fmt.Sprintf("**%s**\n%s", subject, text)
+	content.Format = event.FormatHTML
+	content.FormattedBody = fmt.Sprintf("<strong>%s</strong><br/>%s", html.EscapeString(subject), html.EscapeString(text))
+	return content
+}
 
-	content.BeeperLinkPreviews = convertURLPreviewToBeeper(ctx, portal, intent, msg, text)
+// subjectMetadata returns the part metadata that remembers a message's
+// subject line for later edits, or nil if it has none.
+func subjectMetadata(subject string) any {
+	subject = strings.TrimSpace(subject)
+	if subject == "" {
+		return nil
+	}
+	return &MessageMetadata{Subject: subject}
+}
 
-	cm := &bridgev2.ConvertedMessage{
-		Parts: []*bridgev2.ConvertedMessagePart{{
-			Type:    event.EventMessage,
-			Content: content,
-		}},
+// stripSubjectLine removes the subject line subjectMessageContent put above
+// body, so a Matrix edit of a message with a subject sends only the text.
+// iMessage edits can't change the subject.
+func stripSubjectLine(body, subject string) string {
+	subject = strings.TrimSpace(subject)
+	if subject == "" {
+		return body
 	}
+	return strings.TrimPrefix(body, "**"+subject+"**\n")
+}
 
-	if msg.ReplyGuid != nil && *msg.ReplyGuid != "" {
-		bp := 0
-		if msg.ReplyPart != nil {
-			bp = parseBalloonPart(*msg.ReplyPart, "%d:")
-		}
-		cm.ReplyTo = chatDBReplyTarget(*msg.ReplyGuid, bp)
+func convertMessage(ctx context.Context, portal *bridgev2.Portal, intent bridgev2.MatrixAPI, msg *rustpushgo.WrappedMessage, effectNoteInBody bool) (*bridgev2.ConvertedMessage, error) {
+	text := strings.TrimSpace(strings.ReplaceAll(ptrStringOr(msg.Text, ""), "\uFFFC", ""))
+	content := subjectMessageContent(ptrStringOr(msg.Subject, ""), text)
+	part := &bridgev2.ConvertedMessagePart{
+		Type:       event.EventMessage,
+		Content:    content,
+		DBMetadata: subjectMetadata(ptrStringOr(msg.Subject, "")),
 	}
+	applyMessageEffect(part, msg.Effect, effectNoteInBody)
 
+	content.BeeperLinkPreviews = convertURLPreviewToBeeper(ctx, portal, intent, msg, text)
+
+	cm := &bridgev2.ConvertedMessage{
+		Parts: []*bridgev2.ConvertedMessagePart{part},
+	}
+
+	cm.ReplyTo = wrappedReplyTarget(msg)
 	return cm, nil
 }
 
@@ -10260,10 +11178,13 @@ func makeVCardPreviewContent(data []byte) *event.MessageEventContent {
 	}
 }
 
-func convertAttachment(ctx context.Context, portal *bridgev2.Portal, intent bridgev2.MatrixAPI, attMsg *attachmentMessage, videoTranscoding, heicConversion bool, heicQuality int) (*bridgev2.ConvertedMessage, error) {
+func convertAttachment(ctx context.Context, portal *bridgev2.Portal, intent bridgev2.MatrixAPI, attMsg *attachmentMessage, videoTranscoding, heicConversion bool, heicQuality int, hideMediaFilenames bool) (*bridgev2.ConvertedMessage, error) {
 	att := attMsg.Attachment
 	mimeType := att.MimeType
-	fileName := att.Filename
+	fileName := sanitizeAttachmentFileName(att.Filename)
+	if fileName == "" {
+		fileName = "attachment"
+	}
 	var durationMs int
 
 	// Convert CAF Opus voice messages to OGG Opus for Matrix clients
@@ -10394,6 +11315,14 @@ func convertAttachment(ctx context.Context, portal *bridgev2.Portal, intent brid
 		}
 	}
 
+	// Prefer the sender's own low-res preview as the thumbnail over one
+	// scaled down from the full-res image.
+	if attMsg.Preview != nil && strings.HasPrefix(mimeType, "image/") {
+		if previewThumb, w, h := previewThumbnail(attMsg.Preview); previewThumb != nil {
+			thumbData, thumbW, thumbH = previewThumb, w, h
+		}
+	}
+
 	msgType := mimeToMsgType(mimeType)
 
 	fileSize := int(att.Size)
@@ -10402,7 +11331,6 @@ func convertAttachment(ctx context.Context, portal *bridgev2.Portal, intent brid
 	}
 	content := &event.MessageEventContent{
 		MsgType: msgType,
-		Body:    fileName,
 		Info: &event.FileInfo{
 			MimeType: mimeType,
 			Size:     fileSize,
@@ -10410,6 +11338,14 @@ func convertAttachment(ctx context.Context, portal *bridgev2.Portal, intent brid
 			Height:   imgHeight,
 		},
 	}
+	setAttachmentBody(content, fileName, hideMediaFilenames)
+
+	// Stickers sent as their own message (see sticker.go).
+	partType := event.EventMessage
+	if kind := stickerKindForUTI(att.UtiType); kind.bridgesAsSticker(mimeType) {
+		partType = event.EventSticker
+		makeStickerContent(content, kind)
+	}
 
 	// Mark as voice message if this was a CAF voice recording
 	if durationMs > 0 {
@@ -10423,7 +11359,7 @@ func convertAttachment(ctx context.Context, portal *bridgev2.Portal, intent brid
 	if inlineData != nil && intent != nil {
 		url, encFile, err := intent.UploadMedia(ctx, "", inlineData, fileName, mimeType)
 		if err != nil {
-			return nil, fmt.Errorf("failed to upload attachment: %w", err)
+			return nil, fmt.Errorf("%w: %w", errAttachmentUpload, err)
 		}
 		if encFile != nil {
 			content.File = encFile
@@ -10462,7 +11398,7 @@ func convertAttachment(ctx context.Context, portal *bridgev2.Portal, intent brid
 	}
 	parts = append(parts, &bridgev2.ConvertedMessagePart{
 		ID:      networkid.PartID(fmt.Sprintf("att%d", attMsg.Index)),
-		Type:    event.EventMessage,
+		Type:    partType,
 		Content: content,
 	})
 
@@ -10470,17 +11406,23 @@ func convertAttachment(ctx context.Context, portal *bridgev2.Portal, intent brid
 		Parts: parts,
 	}
 
-	if attMsg.WrappedMessage.ReplyGuid != nil && *attMsg.WrappedMessage.ReplyGuid != "" {
-		bp := 0
-		if attMsg.WrappedMessage.ReplyPart != nil {
-			bp = parseBalloonPart(*attMsg.WrappedMessage.ReplyPart, "%d:")
-		}
-		cm.ReplyTo = chatDBReplyTarget(*attMsg.WrappedMessage.ReplyGuid, bp)
-	}
-
+	cm.ReplyTo = wrappedReplyTarget(attMsg.WrappedMessage)
 	return cm, nil
 }
 
+// wrappedReplyTarget returns the reply target of an inbound message, or nil
+// if it isn't a reply. See chatDBReplyTarget for the balloon-part mapping.
+func wrappedReplyTarget(msg *rustpushgo.WrappedMessage) *networkid.MessageOptionalPartID {
+	if msg == nil || msg.ReplyGuid == nil || *msg.ReplyGuid == "" {
+		return nil
+	}
+	bp := 0
+	if msg.ReplyPart != nil {
+		bp = parseBalloonPart(*msg.ReplyPart, "%d:")
+	}
+	return chatDBReplyTarget(*msg.ReplyGuid, bp)
+}
+
 // resolveTapbackTargetID constructs the message ID for a tapback target,
 // handling backward compatibility with messages stored before part-targeting
 // was introduced. For bp >= 1 it tries the suffixed ID (e.g. "uuid_att0")
@@ -10501,6 +11443,24 @@ func (c *IMClient) resolveTapbackTargetID(targetGUID string, bp int) networkid.M
 	return makeMessageID(targetGUID)
 }
 
+// resolveReplyTarget applies resolveTapbackTargetID to a live reply target
+// built by chatDBReplyTarget, so a reply to attachment part bp lands on the
+// stored event for that part: "uuid_attN" when the target was bridged with
+// part IDs, the bare UUID for attachment-only messages (whose first
+// attachment is stored without a suffix) and messages bridged before
+// part-targeting. Not used for backfill, where the target may be in the same
+// batch and not in the database yet.
+func (c *IMClient) resolveReplyTarget(target *networkid.MessageOptionalPartID) *networkid.MessageOptionalPartID {
+	if target == nil || target.PartID != nil {
+		return target
+	}
+	guid, bp := extractTapbackTarget(string(target.MessageID))
+	if bp == 0 {
+		return target
+	}
+	return &networkid.MessageOptionalPartID{MessageID: c.resolveTapbackTargetID(guid, int(bp))}
+}
+
 // ============================================================================
 // Static helpers
 // ============================================================================
@@ -10528,8 +11488,10 @@ func extractTapbackTarget(messageID string) (string, uint64) {
 // iMessage reply_guid and reply_part strings expected by rustpush.
 // reply_guid is the message UUID; reply_part uses the iMessage format "bp:type:length".
 // We don't have the original text length, so we use 0 as a placeholder.
+// A reply to a message with a synthetic ID is sent as a plain message, since
+// Apple doesn't know that ID.
 func extractReplyInfo(replyTo *database.Message) (*string, *string) {
-	if replyTo == nil {
+	if replyTo == nil || isSyntheticGUID(string(replyTo.ID)) {
 		return nil, nil
 	}
 	guid := string(replyTo.ID)
@@ -10637,52 +11599,6 @@ func decodeImageData(data []byte) (image.Image, string, bool) {
 	return nil, "", false
 }
 
-func tapbackTypeToEmoji(tapbackType *uint32, tapbackEmoji *string) string {
-	if tapbackType == nil {
-		return "❤️"
-	}
-	switch *tapbackType {
-	case 0:
-		return "❤️"
-	case 1:
-		return "👍"
-	case 2:
-		return "👎"
-	case 3:
-		return "😂"
-	case 4:
-		return "‼️"
-	case 5:
-		return "❓"
-	case 6:
-		if tapbackEmoji != nil {
-			return *tapbackEmoji
-		}
-		return "👍"
-	default:
-		return "❤️"
-	}
-}
-
-func emojiToTapbackType(emoji string) (uint32, *string) {
-	switch emoji {
-	case "❤️", "♥️":
-		return 0, nil
-	case "👍":
-		return 1, nil
-	case "👎":
-		return 2, nil
-	case "😂":
-		return 3, nil
-	case "❗", "‼️":
-		return 4, nil
-	case "❓":
-		return 5, nil
-	default:
-		return 6, &emoji
-	}
-}
-
 // formatSMSReactionText returns the SMS/RCS reaction text for a tapback with an
 // empty quoted body (when the original message text is not available). The result
 // matches Apple's SMS relay format exactly so the iPhone can thread it correctly.
@@ -10695,135 +11611,26 @@ func formatSMSReactionText(tapbackType uint32, customEmoji *string, isRemove boo
 // Mirrors the Rust ReactMessageType::get_text() output so SMS contacts see the
 // same reaction text they would receive from a native iMessage client.
 func formatSMSReactionTextWithBody(tapbackType uint32, customEmoji *string, body string, isRemove bool) string {
-	var word string
-	if isRemove {
-		switch tapbackType {
-		case 0:
-			word = "Removed a heart from"
-		case 1:
-			word = "Removed a like from"
-		case 2:
-			word = "Removed a dislike from"
-		case 3:
-			word = "Removed a laugh from"
-		case 4:
-			word = "Removed an exclamation from"
-		case 5:
-			word = "Removed a question mark from"
-		case 6:
-			if customEmoji != nil {
-				word = "Removed a " + *customEmoji + " from"
-			} else {
-				word = "Removed a like from"
-			}
-		default:
-			word = "Removed a heart from"
+	quoted := " \u201c" + body + "\u201d"
+	if tapbackType == tapbackTypeEmoji && customEmoji != nil {
+		if isRemove {
+			return "Removed a " + *customEmoji + " from" + quoted
 		}
-		return word + " \u201c" + body + "\u201d"
-	}
-	switch tapbackType {
-	case 0:
-		word = "Loved"
-	case 1:
-		word = "Liked"
-	case 2:
-		word = "Disliked"
-	case 3:
-		word = "Laughed at"
-	case 4:
-		word = "Emphasized"
-	case 5:
-		word = "Questioned"
-	case 6:
-		if customEmoji != nil {
-			return "Reacted " + *customEmoji + " to \u201c" + body + "\u201d"
-		}
-		word = "Liked"
-	default:
-		word = "Loved"
-	}
-	return word + " \u201c" + body + "\u201d"
-}
-
-func mimeToUTI(mime string) string {
-	switch {
-	case mime == "image/jpeg":
-		return "public.jpeg"
-	case mime == "image/png":
-		return "public.png"
-	case mime == "image/gif":
-		return "com.compuserve.gif"
-	case mime == "image/heic":
-		return "public.heic"
-	case mime == "video/mp4":
-		return "public.mpeg-4"
-	case mime == "video/quicktime":
-		return "com.apple.quicktime-movie"
-	case mime == "audio/mpeg", mime == "audio/mp3":
-		return "public.mp3"
-	case mime == "audio/aac", mime == "audio/mp4":
-		return "public.aac-audio"
-	case mime == "audio/x-caf":
-		return "com.apple.coreaudio-format"
-	case mime == "text/vcard", mime == "text/x-vcard", mime == "text/directory":
-		return "public.vcard"
-	case strings.HasPrefix(mime, "image/"):
-		return "public.image"
-	case strings.HasPrefix(mime, "video/"):
-		return "public.movie"
-	case strings.HasPrefix(mime, "audio/"):
-		return "public.audio"
-	default:
-		return "public.data"
+		return "Reacted " + *customEmoji + " to" + quoted
 	}
-}
-
-// utiToMIME converts an Apple UTI type to its MIME equivalent.
-// Used as a fallback when CloudKit attachment records have a UTI but no MIME type.
-func utiToMIME(uti string) string {
-	switch uti {
-	case "public.jpeg":
-		return "image/jpeg"
-	case "public.png":
-		return "image/png"
-	case "com.compuserve.gif":
-		return "image/gif"
-	case "public.tiff":
-		return "image/tiff"
-	case "public.heic":
-		return "image/heic"
-	case "public.heif":
-		return "image/heif"
-	case "public.webp":
-		return "image/webp"
-	case "public.mpeg-4":
-		return "video/mp4"
-	case "com.apple.quicktime-movie":
-		return "video/quicktime"
-	case "public.mp3":
-		return "audio/mpeg"
-	case "public.aac-audio":
-		return "audio/aac"
-	case "com.apple.coreaudio-format":
-		return "audio/x-caf"
-	case "public.vcard":
-		return "text/vcard"
-	default:
-		return ""
+	tb, ok := lookupStandardTapback(tapbackType)
+	if !ok {
+		// Like rustpush: an emoji tapback without its emoji reads as a like,
+		// anything else as a heart.
+		tb = standardTapbacks[0]
+		if tapbackType == tapbackTypeEmoji {
+			tb = standardTapbacks[1]
+		}
 	}
-}
-
-func mimeToMsgType(mime string) event.MessageType {
-	switch {
-	case strings.HasPrefix(mime, "image/"):
-		return event.MsgImage
-	case strings.HasPrefix(mime, "video/"):
-		return event.MsgVideo
-	case strings.HasPrefix(mime, "audio/"):
-		return event.MsgAudio
-	default:
-		return event.MsgFile
+	if isRemove {
+		return tb.RemoveVerb + quoted
 	}
+	return tb.Verb + quoted
 }
 
 func (c *IMClient) updatePortalSMS(portalID string, isSms bool) bool {
@@ -10846,24 +11653,46 @@ func (c *IMClient) isPortalSMS(portalID string) bool {
 	return portalID != stripSmsSuffix(portalID)
 }
 
+// unsendSuppressionWindow returns how long unsent UUIDs are kept in memory
+// (unsend_suppression_seconds), or 0 if disabled.
+func (c *IMClient) unsendSuppressionWindow() time.Duration {
+	secs := c.Main.Config.UnsendSuppressionSeconds
+	if secs <= 0 {
+		return 0
+	}
+	return time.Duration(secs) * time.Second
+}
+
 func (c *IMClient) trackUnsend(uuid string) {
+	window := c.unsendSuppressionWindow()
+	if window == 0 {
+		return
+	}
 	c.recentUnsendsLock.Lock()
 	defer c.recentUnsendsLock.Unlock()
 	c.recentUnsends[uuid] = time.Now()
 	for k, t := range c.recentUnsends {
-		if time.Since(t) > 5*time.Minute {
+		if time.Since(t) > window {
 			delete(c.recentUnsends, k)
 		}
 	}
 }
 
+// wasUnsent reports whether uuid is a message that was unsent or deleted:
+// recently unsent according to the in-memory map, or recorded as deleted in
+// cloud_message, which still holds after the window and across restarts.
 func (c *IMClient) wasUnsent(uuid string) bool {
 	c.recentUnsendsLock.Lock()
-	defer c.recentUnsendsLock.Unlock()
-	if t, ok := c.recentUnsends[uuid]; ok {
-		return time.Since(t) < 5*time.Minute
+	t, ok := c.recentUnsends[uuid]
+	c.recentUnsendsLock.Unlock()
+	if ok && time.Since(t) < c.unsendSuppressionWindow() {
+		return true
 	}
-	return false
+	if c.cloudStore == nil {
+		return false
+	}
+	deleted, err := c.cloudStore.isMessageDeleted(context.Background(), uuid)
+	return err == nil && deleted
 }
 
 func (c *IMClient) trackSmsReactionEcho(uuid string) {
@@ -11001,23 +11830,46 @@ func normalizeURL(u string) string {
 	return u
 }
 
-func ptrStringOr(s *string, def string) string {
-	if s != nil {
-		return *s
-	}
-	return def
+// ============================================================================
+// Chat.db initial sync
+// ============================================================================
+
+// chatDBSyncEntry is a chat found by the chat.db initial sync.
+type chatDBSyncEntry struct {
+	chatGUID    string
+	portalKey   networkid.PortalKey
+	info        *imessage.ChatInfo
+	isSms       bool
+	lastMessage time.Time
 }
 
-func ptrUint64Or(v *uint64, def uint64) uint64 {
-	if v != nil {
-		return *v
+// latestMessageTS is the LatestMessageTS for the chat's ChatResync: its
+// newest message, so bridgev2 sees the chat's real last activity. Falls
+// back to now when chat.db didn't report one.
+func (e chatDBSyncEntry) latestMessageTS() time.Time {
+	if e.lastMessage.IsZero() {
+		return time.Now()
 	}
-	return def
+	return e.lastMessage
 }
 
-// ============================================================================
-// Chat.db initial sync
-// ============================================================================
+// sortChatDBSyncEntries orders entries by newest message, oldest first.
+// Chats are created in this order, so the room list ends up sorted by real
+// recency rather than by creation order. Without message times for every
+// chat it falls back to reversing chat.db's newest-first order.
+func sortChatDBSyncEntries(entries []chatDBSyncEntry) {
+	for _, entry := range entries {
+		if entry.lastMessage.IsZero() {
+			for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+				entries[i], entries[j] = entries[j], entries[i]
+			}
+			return
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].lastMessage.Before(entries[j].lastMessage)
+	})
+}
 
 // runChatDBInitialSync creates portals and backfills messages for all recent
 // chats found in chat.db. Runs once on first login, then marks ChatsSynced.
@@ -11035,13 +11887,7 @@ func (c *IMClient) runChatDBInitialSync(log zerolog.Logger) {
 		return
 	}
 
-	type chatEntry struct {
-		chatGUID  string
-		portalKey networkid.PortalKey
-		info      *imessage.ChatInfo
-		isSms     bool
-	}
-	var entries []chatEntry
+	var entries []chatDBSyncEntry
 	for _, chat := range chats {
 		info, err := c.chatDB.api.GetChatInfo(chat.ChatGUID, chat.ThreadID)
 		if err != nil || info == nil {
@@ -11070,15 +11916,17 @@ func (c *IMClient) runChatDBInitialSync(log zerolog.Logger) {
 		if isSms {
 			c.updatePortalSMS(string(portalKey.ID), true)
 		}
-		entries = append(entries, chatEntry{
-			chatGUID:  chat.ChatGUID,
-			portalKey: portalKey,
-			info:      info,
-			isSms:     isSms,
+		entries = append(entries, chatDBSyncEntry{
+			chatGUID:    chat.ChatGUID,
+			portalKey:   portalKey,
+			info:        info,
+			isSms:       isSms,
+			lastMessage: chat.LastMessageTime,
 		})
 	}
 
-	// Deduplicate DM entries for contacts with multiple phone numbers.
+	// Deduplicate DM entries for contacts with multiple phone numbers (or a
+	// phone number and an email, with link_email_phone_contacts).
 	{
 		type contactGroup struct {
 			indices []int
@@ -11090,7 +11938,7 @@ func (c *IMClient) runChatDBInitialSync(log zerolog.Logger) {
 				continue
 			}
 			contact := c.lookupContact(portalID)
-			key := contactKeyFromContact(contact)
+			key := contactKeyFromContact(contact, c.Main.Config.LinkEmailPhoneContacts)
 			if key == "" {
 				continue
 			}
@@ -11106,18 +11954,29 @@ func (c *IMClient) runChatDBInitialSync(log zerolog.Logger) {
 			if len(group.indices) <= 1 {
 				continue
 			}
+			// Keep a phone number's portal over an email's, which
+			// link_email_phone_contacts also routes to the phone.
 			primaryIdx := group.indices[0]
-			for _, idx := range group.indices[1:] {
+			for _, idx := range group.indices {
+				if strings.HasPrefix(string(entries[idx].portalKey.ID), "tel:") {
+					primaryIdx = idx
+					break
+				}
+			}
+			for _, idx := range group.indices {
+				if idx == primaryIdx {
+					continue
+				}
 				skip[idx] = true
 				log.Info().
 					Str("skip_portal", string(entries[idx].portalKey.ID)).
 					Str("primary_portal", string(entries[primaryIdx].portalKey.ID)).
-					Msg("Merging DM portal for contact with multiple phone numbers")
+					Msg("Merging DM portal for contact with multiple handles")
 			}
 		}
 
 		if len(skip) > 0 {
-			var merged []chatEntry
+			var merged []chatDBSyncEntry
 			for i, entry := range entries {
 				if !skip[i] {
 					merged = append(merged, entry)
@@ -11128,20 +11987,23 @@ func (c *IMClient) runChatDBInitialSync(log zerolog.Logger) {
 		}
 	}
 
-	// Reverse to process oldest-activity first, so the most recent chat
-	// gets the highest stream_ordering.
-	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
-		entries[i], entries[j] = entries[j], entries[i]
-	}
+	// Process oldest activity first, so the most recent chat gets the
+	// highest stream_ordering.
+	sortChatDBSyncEntries(entries)
 
 	log.Info().
 		Int("chat_count", len(entries)).
 		Msg("Initial sync: processing chats sequentially (oldest activity first)")
 
+	pinned, pinsKnown := c.chatDB.pinnedChatGUIDs(log)
+
 	synced := 0
 	for _, entry := range entries {
 		done := make(chan struct{})
 		chatInfo := c.chatDBInfoToBridgev2(entry.info)
+		if pinsKnown {
+			applyPinnedTag(chatInfo, chatGUIDsPinned([]string{entry.chatGUID}, pinned), false)
+		}
 		chatGUID := entry.chatGUID
 		isSms := entry.isSms
 		c.UserLogin.QueueRemoteEvent(&simplevent.ChatResync{
@@ -11172,7 +12034,7 @@ func (c *IMClient) runChatDBInitialSync(log zerolog.Logger) {
 				},
 			},
 			ChatInfo:        chatInfo,
-			LatestMessageTS: time.Now(),
+			LatestMessageTS: entry.latestMessageTS(),
 		})
 
 		select {
@@ -11239,13 +12101,14 @@ func (c *IMClient) chatDBInfoToBridgev2(info *imessage.ChatInfo) *bridgev2.ChatI
 			Membership: event.MembershipJoin,
 		}
 		for _, memberID := range info.Members {
-			userID := makeUserID(addIdentifierPrefix(stripSmsSuffix(memberID)))
+			userID := c.canonicalGhostID(addIdentifierPrefix(stripSmsSuffix(memberID)))
 			members.MemberMap[userID] = bridgev2.ChatMember{
 				EventSender: bridgev2.EventSender{Sender: userID},
 				Membership:  event.MembershipJoin,
 			}
 		}
 		chatInfo.Members = members
+		c.applyAutoJoin(members, "", ptr.Val(chatInfo.Name))
 	} else {
 		chatInfo.Type = ptr.Ptr(database.RoomTypeDM)
 		portalID := addIdentifierPrefix(stripSmsSuffix(parsed.LocalID))
@@ -11287,22 +12150,19 @@ func (c *IMClient) chatDBInfoToBridgev2(info *imessage.ChatInfo) *bridgev2.ChatI
 			chatInfo.Name = &selfName
 
 			// Pull contact photo for self-chat room avatar.
-			localID := stripIdentifierPrefix(portalID)
-			if c.contacts != nil {
-				if contact, _ := c.contacts.GetContactInfo(localID); contact != nil && len(contact.Avatar) > 0 {
-					avatarHash := sha256.Sum256(contact.Avatar)
-					avatarData := contact.Avatar
-					chatInfo.Avatar = &bridgev2.Avatar{
-						ID: networkid.AvatarID(fmt.Sprintf("contact:%s:%s", portalID, hex.EncodeToString(avatarHash[:8]))),
-						Get: func(ctx context.Context) ([]byte, error) {
-							return avatarData, nil
-						},
-					}
+			if contact := c.lookupContact(portalID); contact != nil && len(contact.Avatar) > 0 {
+				avatarData := contact.Avatar
+				chatInfo.Avatar = &bridgev2.Avatar{
+					ID: c.avatarIDs.get("contact", portalID, avatarData),
+					Get: func(ctx context.Context) ([]byte, error) {
+						return avatarData, nil
+					},
 				}
 			}
 		}
 
 		chatInfo.Members = members
+		c.applyAutoJoin(members, portalID, "")
 	}
 
 	return chatInfo
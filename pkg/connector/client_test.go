@@ -0,0 +1,690 @@
+package connector
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/rs/zerolog"
+	"go.mau.fi/util/dbutil"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/lrhodin/imessage/pkg/rustpushgo"
+)
+
+func TestTypingTimeout(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  rustpushgo.WrappedMessage
+		want time.Duration
+	}{
+		{"start", rustpushgo.WrappedMessage{IsTyping: true}, 60 * time.Second},
+		{"start with app", rustpushgo.WrappedMessage{IsTyping: true, TypingAppIcon: &[]byte{1}}, 60 * time.Second},
+		{"stop", rustpushgo.WrappedMessage{IsTypingStop: true}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := typingTimeout(tt.msg); got != tt.want {
+				t.Errorf("typingTimeout() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTypingEventSender(t *testing.T) {
+	c := &IMClient{
+		Main:       &IMConnector{},
+		UserLogin:  &bridgev2.UserLogin{Log: zerolog.Nop()},
+		allHandles: []string{"tel:+15550001111"},
+	}
+	group := networkid.PortalKey{ID: "gid:abc"}
+	legacyGroup := networkid.PortalKey{ID: "mailto:bob@example.com,tel:+15550002222"}
+	dm := networkid.PortalKey{ID: "tel:+15550002222"}
+	tests := []struct {
+		name      string
+		portalKey networkid.PortalKey
+		sender    string
+		want      networkid.UserID
+	}{
+		{"group member", group, "tel:+15550002222", "tel:+15550002222"},
+		{"another group member", group, "mailto:Bob@Example.com", "mailto:bob@example.com"},
+		{"legacy group member", legacyGroup, "mailto:bob@example.com", "mailto:bob@example.com"},
+		{"DM from another handle", dm, "mailto:bob@example.com", "tel:+15550002222"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := c.typingEventSender(tt.portalKey, tt.sender)
+			if got.Sender != tt.want || got.IsFromMe {
+				t.Errorf("typingEventSender() = %+v, want sender %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleTypingIgnoresOwnDevices(t *testing.T) {
+	// No bridge is set up, so anything past the own-device check panics.
+	c := &IMClient{
+		Main:       &IMConnector{},
+		UserLogin:  &bridgev2.UserLogin{Log: zerolog.Nop()},
+		allHandles: []string{"tel:+15550001111"},
+	}
+	own := "tel:+15550001111"
+	for _, sender := range []*string{&own, nil} {
+		c.handleTyping(zerolog.Nop(), rustpushgo.WrappedMessage{IsTyping: true, Sender: sender})
+	}
+}
+
+func TestSubjectMessageContent(t *testing.T) {
+	tests := []struct {
+		name          string
+		subject       string
+		text          string
+		wantType      event.MessageType
+		wantBody      string
+		wantFormatted string
+	}{
+		{"plain text", "", "hello", event.MsgText, "hello", ""},
+		{"subject and body", "Dinner", "7pm at mine?", event.MsgText, "**Dinner**\n7pm at mine?", "<strong>Dinner</strong><br/>7pm at mine?"},
+		{"subject only", "Family Reunion 2026", "", event.MsgNotice, "Family Reunion 2026", ""},
+		{"whitespace subject", "  ", "hello", event.MsgText, "hello", ""},
+		{"subject is escaped", "<b>hi</b>", "a & b", event.MsgText, "**<b>hi</b>**\na & b", "<strong>&lt;b&gt;hi&lt;/b&gt;</strong><br/>a &amp; b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := subjectMessageContent(tt.subject, tt.text)
+			if got.MsgType != tt.wantType || got.Body != tt.wantBody || got.FormattedBody != tt.wantFormatted {
+				t.Errorf("subjectMessageContent(%q, %q) = (%s, %q, %q), want (%s, %q, %q)",
+					tt.subject, tt.text, got.MsgType, got.Body, got.FormattedBody, tt.wantType, tt.wantBody, tt.wantFormatted)
+			}
+			if (got.Format == event.FormatHTML) != (tt.wantFormatted != "") {
+				t.Errorf("subjectMessageContent(%q, %q) Format = %q", tt.subject, tt.text, got.Format)
+			}
+		})
+	}
+}
+
+func TestConvertRemoteEdit(t *testing.T) {
+	textPart := &database.Message{ID: "uuid", PartID: "", MXID: "$text", EditCount: 1}
+	attPart := &database.Message{ID: "uuid", PartID: "att0", MXID: "$att"}
+	tests := []struct {
+		name          string
+		existing      []*database.Message
+		marker        bool
+		wantTarget    *database.Message
+		wantBody      string
+		wantEditCount int
+	}{
+		{"targets text part", []*database.Message{attPart, textPart}, false, textPart, "new text", 2},
+		{"falls back to first part", []*database.Message{attPart}, false, attPart, "new text", 1},
+		{"edited marker", []*database.Message{textPart}, true, textPart, "new text (edited)", 2},
+		{"no existing parts", nil, false, nil, "new text", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			textPart.EditCount, attPart.EditCount = 1, 0
+			got := convertRemoteEdit(tt.existing, "new text", nil, tt.marker)
+			if len(got.ModifiedParts) != 1 {
+				t.Fatalf("got %d modified parts, want 1", len(got.ModifiedParts))
+			}
+			part := got.ModifiedParts[0]
+			if part.Part != tt.wantTarget {
+				t.Errorf("Part = %+v, want %+v", part.Part, tt.wantTarget)
+			}
+			if part.Content.Body != tt.wantBody {
+				t.Errorf("Body = %q, want %q", part.Content.Body, tt.wantBody)
+			}
+			if part.Extra[editCountField] != tt.wantEditCount {
+				t.Errorf("edit count = %v, want %d", part.Extra[editCountField], tt.wantEditCount)
+			}
+			// bridgev2 adds the relation itself; the converter must not.
+			if part.Content.RelatesTo != nil {
+				t.Errorf("RelatesTo = %+v, want nil (bridgev2 sets m.replace)", part.Content.RelatesTo)
+			}
+			if tt.wantTarget != nil {
+				part.Content.SetEdit(tt.wantTarget.MXID)
+				if rel := part.Content.RelatesTo; rel.Type != event.RelReplace || rel.EventID != id.EventID(tt.wantTarget.MXID) {
+					t.Errorf("relation = %s %s, want m.replace %s", rel.Type, rel.EventID, tt.wantTarget.MXID)
+				}
+			}
+		})
+	}
+}
+
+func TestConvertRemoteEditSubject(t *testing.T) {
+	newPart := func(subject string) *database.Message {
+		return &database.Message{ID: "uuid", MXID: "$text", Metadata: &MessageMetadata{Subject: subject}}
+	}
+	ptr := func(s string) *string { return &s }
+	tests := []struct {
+		name          string
+		part          *database.Message
+		subject       *string
+		marker        bool
+		wantBody      string
+		wantFormatted string
+		wantSubject   string
+	}{
+		{"body edit keeps subject", newPart("Dinner"), nil, false, "**Dinner**\nnew text", "<strong>Dinner</strong><br/>new text", "Dinner"},
+		{"subject edited", newPart("Dinner"), ptr("Lunch"), false, "**Lunch**\nnew text", "<strong>Lunch</strong><br/>new text", "Lunch"},
+		{"subject removed", newPart("Dinner"), ptr(""), false, "new text", "", ""},
+		{"subject added", &database.Message{ID: "uuid", MXID: "$text"}, ptr("Plans"), false, "**Plans**\nnew text", "<strong>Plans</strong><br/>new text", "Plans"},
+		{"edited marker", newPart("Dinner"), nil, true, "**Dinner**\nnew text (edited)", "<strong>Dinner</strong><br/>new text (edited)", "Dinner"},
+		{"no subject", newPart(""), nil, false, "new text", "", ""},
+	}
+	for _, tt := range tests {
+		got := convertRemoteEdit([]*database.Message{tt.part}, "new text", tt.subject, tt.marker).ModifiedParts[0].Content
+		if got.Body != tt.wantBody || got.FormattedBody != tt.wantFormatted {
+			t.Errorf("convertRemoteEdit(%s) = (%q, %q), want (%q, %q)", tt.name, got.Body, got.FormattedBody, tt.wantBody, tt.wantFormatted)
+		}
+		gotSubject := ""
+		if meta, ok := tt.part.Metadata.(*MessageMetadata); ok && meta != nil {
+			gotSubject = meta.Subject
+		}
+		if gotSubject != tt.wantSubject {
+			t.Errorf("convertRemoteEdit(%s) stored subject = %q, want %q", tt.name, gotSubject, tt.wantSubject)
+		}
+	}
+}
+
+func TestStripSubjectLine(t *testing.T) {
+	tests := []struct {
+		body, subject, want string
+	}{
+		{"**Dinner**\n7pm at mine?", "Dinner", "7pm at mine?"},
+		{"**Dinner**\n7pm at mine?", "", "**Dinner**\n7pm at mine?"},
+		{"7pm at mine?", "Dinner", "7pm at mine?"},
+		{"**Lunch**\n7pm at mine?", "Dinner", "**Lunch**\n7pm at mine?"},
+	}
+	for _, tt := range tests {
+		if got := stripSubjectLine(tt.body, tt.subject); got != tt.want {
+			t.Errorf("stripSubjectLine(%q, %q) = %q, want %q", tt.body, tt.subject, got, tt.want)
+		}
+	}
+}
+
+func TestAcceptRemoteEditOutOfOrder(t *testing.T) {
+	base := time.UnixMilli(1_700_000_000_000)
+	tests := []struct {
+		name   string
+		edits  []int // edit timestamps, seconds after base, in arrival order
+		want   []bool
+		wantTS int
+	}{
+		{"in order", []int{1, 2, 3}, []bool{true, true, true}, 3},
+		{"older edit arrives last", []int{1, 3, 2}, []bool{true, true, false}, 3},
+		{"latest arrives first", []int{5, 1, 2, 4}, []bool{true, false, false, false}, 5},
+		{"redelivered edit", []int{1, 2, 2}, []bool{true, true, false}, 2},
+	}
+	for _, tt := range tests {
+		part := &database.Message{ID: "uuid", Timestamp: base}
+		var applied []string
+		for i, sec := range tt.edits {
+			ts := base.Add(time.Duration(sec) * time.Second)
+			got := acceptRemoteEdit(part, ts)
+			if got != tt.want[i] {
+				t.Errorf("acceptRemoteEdit(%s, edit %d) = %v, want %v", tt.name, i, got, tt.want[i])
+			}
+			if got {
+				applied = append(applied, convertRemoteEdit([]*database.Message{part}, fmt.Sprintf("v%d", sec), nil, false).ModifiedParts[0].Content.Body)
+			}
+		}
+		if want := fmt.Sprintf("v%d", tt.wantTS); applied[len(applied)-1] != want {
+			t.Errorf("acceptRemoteEdit(%s) left the text at %q, want %q", tt.name, applied[len(applied)-1], want)
+		}
+		if got, want := part.Metadata.(*MessageMetadata).LastEditTS, base.Add(time.Duration(tt.wantTS)*time.Second).UnixMilli(); got != want {
+			t.Errorf("acceptRemoteEdit(%s) LastEditTS = %d, want %d", tt.name, got, want)
+		}
+	}
+}
+
+func TestAcceptRemoteEditKeepsMetadata(t *testing.T) {
+	part := &database.Message{ID: "uuid", Metadata: &MessageMetadata{HasAttachments: true}}
+	if !acceptRemoteEdit(part, time.UnixMilli(1000)) {
+		t.Fatalf("acceptRemoteEdit() = false for the first edit, want true")
+	}
+	if meta := part.Metadata.(*MessageMetadata); !meta.HasAttachments || meta.LastEditTS != 1000 {
+		t.Errorf("metadata = %+v, want HasAttachments kept and LastEditTS 1000", meta)
+	}
+	if !acceptRemoteEdit(nil, time.UnixMilli(1000)) {
+		t.Errorf("acceptRemoteEdit(nil) = false, want true")
+	}
+}
+
+// newTestBridgeDB returns a bridgev2 database backed by a fresh in-memory
+// SQLite database with the bridgev2 schema applied.
+func newTestBridgeDB(t *testing.T) *database.Database {
+	t.Helper()
+	rawDB, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("failed to open sqlite: %v", err)
+	}
+	rawDB.SetMaxOpenConns(1)
+	t.Cleanup(func() { _ = rawDB.Close() })
+	db, err := dbutil.NewWithDB(rawDB, "sqlite3")
+	if err != nil {
+		t.Fatalf("failed to wrap sqlite: %v", err)
+	}
+	bridgeDB := database.New("test-bridge", database.MetaTypes{}, db)
+	if err = bridgeDB.Upgrade(context.Background()); err != nil {
+		t.Fatalf("Upgrade() error = %v", err)
+	}
+	return bridgeDB
+}
+
+func TestFindReceiptTarget(t *testing.T) {
+	ctx := context.Background()
+	db := newTestBridgeDB(t)
+	portalKey := networkid.PortalKey{ID: "tel:+15551234567", Receiver: "login"}
+	otherKey := networkid.PortalKey{ID: "tel:+15559876543", Receiver: "login"}
+	base := time.Unix(1700000000, 0)
+	for _, key := range []networkid.PortalKey{portalKey, otherKey} {
+		if err := db.Portal.Insert(ctx, &database.Portal{PortalKey: key}); err != nil {
+			t.Fatalf("Portal.Insert() error = %v", err)
+		}
+	}
+	insert := func(guid string, room networkid.PortalKey, mxid id.EventID, offset time.Duration) {
+		t.Helper()
+		err := db.Message.Insert(ctx, &database.Message{
+			ID:        makeMessageID(guid),
+			MXID:      mxid,
+			Room:      room,
+			SenderID:  "tel:+15551234567",
+			Timestamp: base.Add(offset),
+		})
+		if err != nil {
+			t.Fatalf("Message.Insert(%s) error = %v", guid, err)
+		}
+	}
+	insert("BRIDGED-1", portalKey, "$bridged1", 0)
+	insert("BRIDGED-2", portalKey, "$bridged2", time.Minute)
+	insert("BRIDGED-3", portalKey, "$bridged3", 10*time.Minute)
+	insert("OTHER-ROOM", otherKey, "$other", 2*time.Minute)
+
+	tests := []struct {
+		name      string
+		guid      string
+		readTime  time.Time
+		wantMXID  id.EventID
+		wantExact bool
+	}{
+		{"known message", "BRIDGED-1", base.Add(20 * time.Minute), "$bridged1", true},
+		{"known message in other room", "OTHER-ROOM", base.Add(20 * time.Minute), "$other", true},
+		{"unknown message uses read time", "SENT-FROM-IPHONE", base.Add(5 * time.Minute), "$bridged2", false},
+		{"unknown message ignores other rooms", "SENT-FROM-IPHONE", base.Add(3 * time.Minute), "$bridged2", false},
+		{"unknown message after everything", "SENT-FROM-IPHONE", base.Add(time.Hour), "$bridged3", false},
+		{"unknown message before everything", "SENT-FROM-IPHONE", base.Add(-time.Minute), "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, exact, err := findReceiptTarget(ctx, db.Message, portalKey, tt.guid, tt.readTime)
+			if err != nil {
+				t.Fatalf("findReceiptTarget() error = %v", err)
+			}
+			var gotMXID id.EventID
+			if got != nil {
+				gotMXID = got.MXID
+			}
+			if gotMXID != tt.wantMXID || exact != tt.wantExact {
+				t.Errorf("findReceiptTarget(%q) = (%q, %v), want (%q, %v)", tt.guid, gotMXID, exact, tt.wantMXID, tt.wantExact)
+			}
+		})
+	}
+}
+
+func TestReadReceiptTargetWholeConversation(t *testing.T) {
+	ctx := context.Background()
+	db := newTestBridgeDB(t)
+	c := &IMClient{Main: &IMConnector{Bridge: &bridgev2.Bridge{DB: db}}}
+	dmKey := networkid.PortalKey{ID: "tel:+15551234567", Receiver: "login"}
+	groupKey := networkid.PortalKey{ID: "gid:9b2c6a5e-1111-2222-3333-444455556666", Receiver: "login"}
+	emptyKey := networkid.PortalKey{ID: "tel:+15550000000", Receiver: "login"}
+	base := time.Unix(1700000000, 0)
+	for _, key := range []networkid.PortalKey{dmKey, groupKey, emptyKey} {
+		if err := db.Portal.Insert(ctx, &database.Portal{PortalKey: key}); err != nil {
+			t.Fatalf("Portal.Insert() error = %v", err)
+		}
+	}
+	insert := func(msgID string, room networkid.PortalKey, mxid id.EventID, offset time.Duration) {
+		t.Helper()
+		err := db.Message.Insert(ctx, &database.Message{
+			ID:        makeMessageID(msgID),
+			MXID:      mxid,
+			Room:      room,
+			SenderID:  "tel:+15551234567",
+			Timestamp: base.Add(offset),
+		})
+		if err != nil {
+			t.Fatalf("Message.Insert(%s) error = %v", msgID, err)
+		}
+	}
+	insert("DM-1", dmKey, "$dm1", 0)
+	insert("DM-2_att0", dmKey, "$dm2", time.Minute)
+	insert("DM-PLACEHOLDER", dmKey, database.FakeMXIDPrefix+"placeholder", 2*time.Minute)
+	insert("GROUP-1", groupKey, "$group1", 30*time.Second)
+	insert("GROUP-2", groupKey, "$group2", 90*time.Second)
+	// Newer than everything in the group, so a receipt scoped to the wrong
+	// portal would pick it.
+	insert("DM-3", dmKey, "$dm3", 5*time.Minute)
+
+	tests := []struct {
+		name     string
+		portal   networkid.PortalKey
+		exact    *database.Message
+		readUpTo time.Time
+		want     string
+	}{
+		{"DM mark as read", dmKey, nil, base.Add(3 * time.Minute), "DM-2"},
+		{"DM mark as read without a time", dmKey, nil, time.Time{}, "DM-3"},
+		{"group mark as read", groupKey, nil, base.Add(time.Hour), "GROUP-2"},
+		{"group mark as read before later message", groupKey, nil, base.Add(time.Minute), "GROUP-1"},
+		{"exact message", dmKey, &database.Message{ID: "DM-1_att2"}, base.Add(time.Hour), "DM-1"},
+		{"conversation with no messages", emptyKey, nil, base.Add(time.Hour), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			receipt := &bridgev2.MatrixReadReceipt{
+				Portal:       &bridgev2.Portal{Portal: &database.Portal{PortalKey: tt.portal}},
+				ExactMessage: tt.exact,
+				ReadUpTo:     tt.readUpTo,
+			}
+			var got string
+			if uuid := c.readReceiptTarget(ctx, receipt); uuid != nil {
+				got = *uuid
+			}
+			if got != tt.want {
+				t.Errorf("readReceiptTarget() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReplyToAttachmentPartRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	db := newTestBridgeDB(t)
+	portalKey := networkid.PortalKey{ID: "tel:+15551234567", Receiver: "login"}
+	if err := db.Portal.Insert(ctx, &database.Portal{PortalKey: portalKey}); err != nil {
+		t.Fatalf("Portal.Insert() error = %v", err)
+	}
+	base := time.Unix(1700000000, 0)
+	insert := func(msgID string, partID networkid.PartID, mxid id.EventID) *database.Message {
+		t.Helper()
+		msg := &database.Message{
+			ID:        makeMessageID(msgID),
+			PartID:    partID,
+			MXID:      mxid,
+			Room:      portalKey,
+			SenderID:  "tel:+15551234567",
+			Timestamp: base,
+		}
+		if err := db.Message.Insert(ctx, msg); err != nil {
+			t.Fatalf("Message.Insert(%s) error = %v", msgID, err)
+		}
+		return msg
+	}
+	// Text + two images, as handleMessage stores them.
+	insert("MIXED", "", "$text")
+	insert("MIXED_att0", "att0", "$image0")
+	image1 := insert("MIXED_att1", "att1", "$image1")
+	// Attachment-only message: the first attachment has no suffix.
+	insert("IMAGES", "att0", "$only0")
+	insert("IMAGES_att1", "att1", "$only1")
+
+	c := &IMClient{
+		Main:      &IMConnector{Bridge: &bridgev2.Bridge{DB: db}},
+		UserLogin: &bridgev2.UserLogin{UserLogin: &database.UserLogin{ID: "login"}},
+	}
+
+	// Matrix → iMessage: replying to att1 sends balloon part 2.
+	replyGUID, replyPart := extractReplyInfo(image1)
+	if *replyGUID != "MIXED" || *replyPart != "2:0:0" {
+		t.Fatalf("extractReplyInfo(MIXED_att1) = (%q, %q), want (%q, %q)", *replyGUID, *replyPart, "MIXED", "2:0:0")
+	}
+
+	tests := []struct {
+		name      string
+		replyGUID string
+		replyPart string
+		wantID    networkid.MessageID
+	}{
+		{"round trip to att1", *replyGUID, *replyPart, "MIXED_att1"},
+		{"text body", "MIXED", "0:0:5", "MIXED"},
+		{"first image", "MIXED", "1:0:1", "MIXED_att0"},
+		{"attachment-only first part", "IMAGES", "1:0:1", "IMAGES"},
+		{"attachment-only second part", "IMAGES", "2:0:1", "IMAGES_att1"},
+		{"part never bridged", "UNKNOWN", "3:0:1", "UNKNOWN"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// iMessage → Matrix: what convertMessage/convertAttachment build,
+			// resolved against the bridged parts.
+			target := c.resolveReplyTarget(chatDBReplyTarget(tt.replyGUID, parseBalloonPart(tt.replyPart, "%d:")))
+			if target.MessageID != tt.wantID {
+				t.Errorf("resolveReplyTarget(%s, %s) = %q, want %q", tt.replyGUID, tt.replyPart, target.MessageID, tt.wantID)
+			}
+		})
+	}
+}
+
+func TestRealtimeMessageTooOld(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	maxAge := 6 * time.Hour
+	tests := []struct {
+		name   string
+		msgTS  int64
+		maxAge time.Duration
+		want   bool
+	}{
+		{"fresh message", now.Add(-time.Minute).UnixMilli(), maxAge, false},
+		{"just inside the cutoff", now.Add(-maxAge).UnixMilli(), maxAge, false},
+		{"replayed backlog", now.Add(-maxAge - time.Minute).UnixMilli(), maxAge, true},
+		{"cutoff disabled", now.Add(-30 * 24 * time.Hour).UnixMilli(), 0, false},
+		{"no timestamp", 0, maxAge, false},
+		{"clock skew into the future", now.Add(time.Hour).UnixMilli(), maxAge, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := realtimeMessageTooOld(tt.msgTS, now, tt.maxAge); got != tt.want {
+				t.Errorf("realtimeMessageTooOld(%d, %v) = %v, want %v", tt.msgTS, tt.maxAge, got, tt.want)
+			}
+		})
+	}
+}
+func TestResolveGroupMembersPartial(t *testing.T) {
+	ctx := context.Background()
+	const portalID = "gid:9b2c6a5e-1111-2222-3333-444455556666"
+
+	newClient := func(t *testing.T) *IMClient {
+		store := newTestCloudStore(t)
+		if _, err := store.db.Exec(ctx,
+			`INSERT INTO cloud_message (login_id, guid, portal_id, timestamp_ms, sender, is_from_me, created_ts, updated_ts)
+			 VALUES ($1, 'MSG', $2, 1, 'tel:+15550000001', FALSE, 1, 1)`,
+			store.loginID, portalID,
+		); err != nil {
+			t.Fatalf("insert cloud_message: %v", err)
+		}
+		return &IMClient{cloudStore: store, imGroupParticipants: map[string][]string{}}
+	}
+
+	t.Run("falls back to message senders", func(t *testing.T) {
+		c := newClient(t)
+		members, partial := c.resolveGroupMembersPartial(ctx, portalID)
+		if !reflect.DeepEqual(members, []string{"tel:+15550000001"}) || !partial {
+			t.Errorf("resolveGroupMembersPartial() = %v, %v, want [tel:+15550000001], true", members, partial)
+		}
+		if got := c.resolveGroupMembers(ctx, portalID); !reflect.DeepEqual(got, members) {
+			t.Errorf("resolveGroupMembers() = %v, want %v", got, members)
+		}
+	})
+
+	t.Run("chat record wins", func(t *testing.T) {
+		c := newClient(t)
+		roster := []string{"tel:+15550000001", "tel:+15550000002"}
+		if err := c.cloudStore.upsertChat(ctx, "chat1", "rec1", "", portalID, "iMessage", nil, nil, roster, 1); err != nil {
+			t.Fatalf("upsertChat() error = %v", err)
+		}
+		members, partial := c.resolveGroupMembersPartial(ctx, portalID)
+		if !reflect.DeepEqual(members, roster) || partial {
+			t.Errorf("resolveGroupMembersPartial() = %v, %v, want %v, false", members, partial, roster)
+		}
+	})
+
+	t.Run("live roster wins", func(t *testing.T) {
+		c := newClient(t)
+		roster := []string{"tel:+15550000001", "tel:+15550000003"}
+		c.imGroupParticipants[portalID] = roster
+		members, partial := c.resolveGroupMembersPartial(ctx, portalID)
+		if !reflect.DeepEqual(members, roster) || partial {
+			t.Errorf("resolveGroupMembersPartial() = %v, %v, want %v, false", members, partial, roster)
+		}
+	})
+
+	t.Run("legacy group IDs are never partial", func(t *testing.T) {
+		c := newClient(t)
+		members, partial := c.resolveGroupMembersPartial(ctx, "tel:+15550000001,tel:+15550000002")
+		if len(members) != 2 || partial {
+			t.Errorf("resolveGroupMembersPartial(legacy) = %v, %v, want 2 members, false", members, partial)
+		}
+	})
+}
+
+func TestRichLinkSidebandsNotBridgedAsAttachments(t *testing.T) {
+	meta := []byte("bplist00")
+	img := []byte("\xff\xd8\xff")
+	photo := []byte("photo")
+	atts := []rustpushgo.WrappedAttachment{
+		{Filename: "meta", MimeType: "x-richlink/meta", IsInline: true, InlineData: &meta},
+		{Filename: "image", MimeType: "x-richlink/image", IsInline: true, InlineData: &img},
+		{Filename: "IMG_1.jpeg", MimeType: "image/jpeg", IsInline: true, InlineData: &photo},
+	}
+	var bridged []string
+	for _, variant := range selectAttachmentVariants(atts) {
+		if isRichLinkSidebandMime(variant.Attachment.MimeType) {
+			continue
+		}
+		bridged = append(bridged, variant.Attachment.Filename)
+	}
+	if want := []string{"IMG_1.jpeg"}; !reflect.DeepEqual(bridged, want) {
+		t.Errorf("bridged attachments = %v, want %v", bridged, want)
+	}
+
+	tests := []struct {
+		mime string
+		want bool
+	}{
+		{"x-richlink/meta", true},
+		{"x-richlink/image", true},
+		{"image/jpeg", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := isRichLinkSidebandMime(tt.mime); got != tt.want {
+			t.Errorf("isRichLinkSidebandMime(%q) = %v, want %v", tt.mime, got, tt.want)
+		}
+	}
+}
+
+func TestSortChatDBSyncEntries(t *testing.T) {
+	base := time.Unix(1700000000, 0)
+	entry := func(guid string, last time.Time) chatDBSyncEntry {
+		return chatDBSyncEntry{chatGUID: guid, lastMessage: last}
+	}
+	guids := func(entries []chatDBSyncEntry) []string {
+		out := make([]string, len(entries))
+		for i, e := range entries {
+			out[i] = e.chatGUID
+		}
+		return out
+	}
+
+	// chat.db lists chats newest first; creation runs oldest first so the
+	// most recently active room ends up on top.
+	entries := []chatDBSyncEntry{
+		entry("b", base.Add(2*time.Hour)),
+		entry("c", base.Add(3*time.Hour)),
+		entry("a", base.Add(time.Hour)),
+	}
+	sortChatDBSyncEntries(entries)
+	if got, want := guids(entries), []string{"a", "b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("sortChatDBSyncEntries() = %v, want %v", got, want)
+	}
+	for _, e := range entries {
+		if got := e.latestMessageTS(); !got.Equal(e.lastMessage) {
+			t.Errorf("latestMessageTS(%s) = %v, want %v", e.chatGUID, got, e.lastMessage)
+		}
+	}
+
+	// Without a time for every chat, keep reversing chat.db's order.
+	entries = []chatDBSyncEntry{
+		entry("c", base.Add(3*time.Hour)),
+		entry("b", time.Time{}),
+		entry("a", base.Add(time.Hour)),
+	}
+	sortChatDBSyncEntries(entries)
+	if got, want := guids(entries), []string{"a", "b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("sortChatDBSyncEntries(missing time) = %v, want %v", got, want)
+	}
+	if got := entries[1].latestMessageTS(); got.IsZero() {
+		t.Errorf("latestMessageTS(missing time) = zero, want now")
+	}
+}
+
+func TestWasUnsentBeyondWindow(t *testing.T) {
+	ctx := context.Background()
+	for _, window := range []int{300, 0} {
+		store := newTestCloudStore(t)
+		c := &IMClient{
+			Main:          &IMConnector{Config: IMConfig{UnsendSuppressionSeconds: window}},
+			cloudStore:    store,
+			recentUnsends: make(map[string]time.Time),
+		}
+		// A message bridged before it was unsent (CloudKit GUIDs are
+		// lowercase), and one whose unsend came in first.
+		if err := store.persistMessageUUID(ctx, "0a1b2c3d-0000-4000-8000-000000000001", "tel:+15551111111", 1700000000000, false); err != nil {
+			t.Fatalf("persistMessageUUID() error = %v", err)
+		}
+		for _, uuid := range []string{"0A1B2C3D-0000-4000-8000-000000000001", "0A1B2C3D-0000-4000-8000-000000000002"} {
+			c.trackUnsend(uuid)
+			if err := store.markMessageUnsent(ctx, uuid, "tel:+15551111111", 1700000060000); err != nil {
+				t.Fatalf("markMessageUnsent(%s) error = %v", uuid, err)
+			}
+		}
+		// Only in memory: suppressed during the window, not after it.
+		c.trackUnsend("0A1B2C3D-0000-4000-8000-000000000003")
+
+		if window > 0 && !c.wasUnsent("0A1B2C3D-0000-4000-8000-000000000003") {
+			t.Errorf("wasUnsent() within the %ds window = false, want true", window)
+		}
+		c.recentUnsendsLock.Lock()
+		for uuid := range c.recentUnsends {
+			c.recentUnsends[uuid] = time.Now().Add(-time.Hour)
+		}
+		c.recentUnsendsLock.Unlock()
+
+		tests := []struct {
+			uuid string
+			want bool
+		}{
+			{"0A1B2C3D-0000-4000-8000-000000000001", true},
+			{"0a1b2c3d-0000-4000-8000-000000000001", true},
+			{"0A1B2C3D-0000-4000-8000-000000000002", true},
+			{"0A1B2C3D-0000-4000-8000-000000000003", false},
+			{"0A1B2C3D-0000-4000-8000-000000000004", false},
+		}
+		for _, tt := range tests {
+			if got := c.wasUnsent(tt.uuid); got != tt.want {
+				t.Errorf("wasUnsent(%s) an hour later with a %ds window = %v, want %v", tt.uuid, window, got, tt.want)
+			}
+		}
+		if known, _ := store.hasMessageUUID(ctx, "0A1B2C3D-0000-4000-8000-000000000001"); !known {
+			t.Errorf("hasMessageUUID() after markMessageUnsent() = false, want true")
+		}
+	}
+}
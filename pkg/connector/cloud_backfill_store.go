@@ -6,8 +6,11 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
+	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/rs/zerolog"
@@ -18,6 +21,9 @@ import (
 type cloudBackfillStore struct {
 	db      *dbutil.Database
 	loginID networkid.UserLoginID
+	// searchFTS is set when message search can use the FTS5 index
+	// (message_search.go).
+	searchFTS atomic.Bool
 }
 
 type cloudMessageRow struct {
@@ -76,15 +82,21 @@ func newCloudBackfillStore(db *dbutil.Database, loginID networkid.UserLoginID) *
 // ADD COLUMN IF NOT EXISTS natively; SQLite requires a pragma existence check
 // first since it has no IF NOT EXISTS on ALTER TABLE.
 func (s *cloudBackfillStore) migrateColumns(ctx context.Context, table string, cols []struct{ name, def string }) error {
+	return migrateTableColumns(ctx, s.db, table, cols)
+}
+
+// migrateTableColumns is migrateColumns for tables outside the cloud
+// backfill store.
+func migrateTableColumns(ctx context.Context, db *dbutil.Database, table string, cols []struct{ name, def string }) error {
 	for _, col := range cols {
 		var err error
-		if s.db.Dialect == dbutil.Postgres {
-			_, err = s.db.Exec(ctx, fmt.Sprintf(`ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s %s`, table, col.name, col.def))
+		if db.Dialect == dbutil.Postgres {
+			_, err = db.Exec(ctx, fmt.Sprintf(`ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s %s`, table, col.name, col.def))
 		} else {
 			var exists int
-			_ = s.db.QueryRow(ctx, fmt.Sprintf(`SELECT COUNT(*) FROM pragma_table_info('%s') WHERE name=$1`, table), col.name).Scan(&exists)
+			_ = db.QueryRow(ctx, fmt.Sprintf(`SELECT COUNT(*) FROM pragma_table_info('%s') WHERE name=$1`, table), col.name).Scan(&exists)
 			if exists == 0 {
-				_, err = s.db.Exec(ctx, fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, table, col.name, col.def))
+				_, err = db.Exec(ctx, fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, table, col.name, col.def))
 			}
 		}
 		if err != nil {
@@ -152,6 +164,23 @@ func (s *cloudBackfillStore) ensureSchema(ctx context.Context) error {
 			updated_ts BIGINT NOT NULL,
 			PRIMARY KEY (login_id, portal_id)
 		)`,
+		`CREATE TABLE IF NOT EXISTS pending_cloud_deletion (
+			login_id TEXT NOT NULL,
+			portal_id TEXT NOT NULL,
+			chat_guid TEXT NOT NULL,
+			conversation_json TEXT NOT NULL,
+			chat_record_names_json TEXT NOT NULL,
+			due_ts BIGINT NOT NULL,
+			created_ts BIGINT NOT NULL,
+			PRIMARY KEY (login_id, portal_id)
+		)`,
+		`CREATE TABLE IF NOT EXISTS blocked_sender (
+			login_id TEXT NOT NULL,
+			sender TEXT NOT NULL,
+			reason TEXT NOT NULL,
+			created_ts BIGINT NOT NULL,
+			PRIMARY KEY (login_id, sender)
+		)`,
 		`CREATE INDEX IF NOT EXISTS cloud_chat_portal_idx
 			ON cloud_chat (login_id, portal_id, cloud_chat_id)`,
 		`CREATE INDEX IF NOT EXISTS cloud_message_portal_ts_idx
@@ -407,6 +436,52 @@ func (s *cloudBackfillStore) hasAnySyncState(ctx context.Context) (bool, error)
 	return count > 0, err
 }
 
+// syncZoneState is one zone's row in cloud_sync_state.
+type syncZoneState struct {
+	Zone          string
+	HasToken      bool
+	LastSuccessTS int64 // 0 if the zone never synced
+	LastError     string
+	UpdatedTS     int64
+}
+
+// listSyncZoneStates returns the sync state of every CloudKit zone, sorted
+// by zone. Rows with a leading underscore (version markers, StatusKit
+// bookkeeping) aren't zones and are left out.
+func (s *cloudBackfillStore) listSyncZoneStates(ctx context.Context) ([]syncZoneState, error) {
+	rows, err := s.db.Query(ctx, `
+		SELECT zone, continuation_token, last_success_ts, last_error, updated_ts
+		FROM cloud_sync_state
+		WHERE login_id=$1
+		ORDER BY zone
+	`, s.loginID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []syncZoneState
+	for rows.Next() {
+		var (
+			st          syncZoneState
+			token       sql.NullString
+			lastSuccess sql.NullInt64
+			lastError   sql.NullString
+		)
+		if err = rows.Scan(&st.Zone, &token, &lastSuccess, &lastError, &st.UpdatedTS); err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(st.Zone, "_") {
+			continue
+		}
+		st.HasToken = token.Valid && token.String != ""
+		st.LastSuccessTS = lastSuccess.Int64
+		st.LastError = lastError.String
+		out = append(out, st)
+	}
+	return out, rows.Err()
+}
+
 func (s *cloudBackfillStore) setSyncStateError(ctx context.Context, zone, errMsg string) error {
 	nowMS := time.Now().UnixMilli()
 	_, err := s.db.Exec(ctx, `
@@ -475,21 +550,8 @@ func (s *cloudBackfillStore) upsertMessageBatch(ctx context.Context, rows []clou
 	if len(rows) == 0 {
 		return nil
 	}
-	// CloudKit can occasionally return duplicate GUID entries within a fetch
-	// window; keep only the newest row per GUID to make batch inserts idempotent.
-	rowsByGUID := make(map[string]cloudMessageRow, len(rows))
-	order := make([]string, 0, len(rows))
-	for _, row := range rows {
-		if row.GUID == "" {
-			continue
-		}
-		if prev, ok := rowsByGUID[row.GUID]; !ok {
-			rowsByGUID[row.GUID] = row
-			order = append(order, row.GUID)
-		} else if row.TimestampMS >= prev.TimestampMS {
-			rowsByGUID[row.GUID] = row
-		}
-	}
+	// Keep only the newest row per GUID to make batch inserts idempotent.
+	rows = dedupCloudMessageRows(rows)
 	tx, err := s.beginTx(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to begin transaction: %w", err)
@@ -529,8 +591,7 @@ func (s *cloudBackfillStore) upsertMessageBatch(ctx context.Context, rows []clou
 	defer stmt.Close()
 
 	nowMS := time.Now().UnixMilli()
-	for _, guid := range order {
-		row := rowsByGUID[guid]
+	for _, row := range rows {
 		_, err = stmt.ExecContext(ctx,
 			s.loginID, row.GUID, row.RecordName, row.CloudChatID, row.PortalID, row.TimestampMS,
 			row.Sender, row.IsFromMe, row.Text, row.Subject, row.Service, row.Deleted,
@@ -824,6 +885,18 @@ func (s *cloudBackfillStore) upsertChatBatch(ctx context.Context, chats []cloudC
 // hasMessageBatch checks existence of multiple GUIDs in a single query and
 // returns the set of GUIDs that already exist.
 func (s *cloudBackfillStore) hasMessageBatch(ctx context.Context, guids []string) (map[string]bool, error) {
+	return s.messageGUIDBatch(ctx, guids, "")
+}
+
+// liveMessageBatch returns which of the given GUIDs are stored and not yet
+// marked deleted.
+func (s *cloudBackfillStore) liveMessageBatch(ctx context.Context, guids []string) (map[string]bool, error) {
+	return s.messageGUIDBatch(ctx, guids, " AND deleted=FALSE")
+}
+
+// messageGUIDBatch returns the subset of guids that have a cloud_message row
+// matching the extra WHERE condition.
+func (s *cloudBackfillStore) messageGUIDBatch(ctx context.Context, guids []string, cond string) (map[string]bool, error) {
 	if len(guids) == 0 {
 		return nil, nil
 	}
@@ -846,8 +919,8 @@ func (s *cloudBackfillStore) hasMessageBatch(ctx context.Context, guids []string
 		}
 
 		query := fmt.Sprintf(
-			`SELECT guid FROM cloud_message WHERE login_id=$1 AND guid IN (%s)`,
-			strings.Join(placeholders, ","),
+			`SELECT guid FROM cloud_message WHERE login_id=$1 AND guid IN (%s)%s`,
+			strings.Join(placeholders, ","), cond,
 		)
 		rows, err := s.db.Query(ctx, query, args...)
 		if err != nil {
@@ -1236,6 +1309,79 @@ func (s *cloudBackfillStore) listDeletedPortalIDs(ctx context.Context) ([]string
 	return portalIDs, rows.Err()
 }
 
+// listKnownPortalIDs returns every portal ID the cloud store has any record
+// of — live, soft-deleted or filtered, from cloud_chat or cloud_message.
+// Used by the startup reconciliation to tell portals CloudKit has never heard
+// of apart from ones it knows but deliberately doesn't create.
+func (s *cloudBackfillStore) listKnownPortalIDs(ctx context.Context) ([]string, error) {
+	rows, err := s.db.Query(ctx, `
+		SELECT portal_id FROM cloud_chat
+		WHERE login_id=$1 AND portal_id IS NOT NULL AND portal_id <> ''
+		UNION
+		SELECT portal_id FROM cloud_message
+		WHERE login_id=$1 AND portal_id IS NOT NULL AND portal_id <> ''
+	`, s.loginID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var portalIDs []string
+	for rows.Next() {
+		var id string
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		portalIDs = append(portalIDs, id)
+	}
+	return portalIDs, rows.Err()
+}
+
+// blockSender adds a sender to the local blocklist (see blocked_senders.go).
+// Blocking an already-blocked sender updates the reason.
+func (s *cloudBackfillStore) blockSender(ctx context.Context, sender, reason string) error {
+	_, err := s.db.Exec(ctx, `
+		INSERT INTO blocked_sender (login_id, sender, reason, created_ts)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (login_id, sender) DO UPDATE SET reason=excluded.reason
+	`, s.loginID, sender, reason, time.Now().UnixMilli())
+	return err
+}
+
+// unblockSender removes a sender from the blocklist and reports whether it
+// was on it.
+func (s *cloudBackfillStore) unblockSender(ctx context.Context, sender string) (bool, error) {
+	res, err := s.db.Exec(ctx,
+		`DELETE FROM blocked_sender WHERE login_id=$1 AND sender=$2`,
+		s.loginID, sender,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// isSenderBlocked reports whether any of the given identifiers is blocked.
+func (s *cloudBackfillStore) isSenderBlocked(ctx context.Context, senders ...string) (bool, error) {
+	for _, sender := range senders {
+		if sender == "" {
+			continue
+		}
+		var count int
+		err := s.db.QueryRow(ctx,
+			`SELECT COUNT(*) FROM blocked_sender WHERE login_id=$1 AND sender=$2`,
+			s.loginID, sender,
+		).Scan(&count)
+		if err != nil {
+			return false, err
+		} else if count > 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
 func (s *cloudBackfillStore) setRestoreOverride(ctx context.Context, portalID string) error {
 	_, err := s.db.Exec(ctx, `
 		INSERT INTO restore_override (login_id, portal_id, updated_ts)
@@ -1253,6 +1399,79 @@ func (s *cloudBackfillStore) clearRestoreOverride(ctx context.Context, portalID
 	return err
 }
 
+// schedulePendingCloudDeletion records an Apple-side chat deletion to run at
+// d.DueTS (see cloud_delete_grace.go). Deleting the chat again while one is
+// pending replaces it.
+func (s *cloudBackfillStore) schedulePendingCloudDeletion(ctx context.Context, d pendingCloudDeletion) error {
+	convJSON, err := json.Marshal(d.Conversation)
+	if err != nil {
+		return err
+	}
+	recordsJSON, err := json.Marshal(d.ChatRecordNames)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(ctx, `
+		INSERT INTO pending_cloud_deletion (login_id, portal_id, chat_guid, conversation_json, chat_record_names_json, due_ts, created_ts)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (login_id, portal_id) DO UPDATE SET
+			chat_guid=excluded.chat_guid, conversation_json=excluded.conversation_json,
+			chat_record_names_json=excluded.chat_record_names_json, due_ts=excluded.due_ts
+	`, s.loginID, d.PortalID, d.ChatGUID, string(convJSON), string(recordsJSON), d.DueTS, time.Now().UnixMilli())
+	return err
+}
+
+// cancelPendingCloudDeletion drops the pending deletion of portalID and
+// reports whether there was one.
+func (s *cloudBackfillStore) cancelPendingCloudDeletion(ctx context.Context, portalID string) (bool, error) {
+	res, err := s.db.Exec(ctx,
+		`DELETE FROM pending_cloud_deletion WHERE login_id=$1 AND portal_id=$2`,
+		s.loginID, portalID,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// listPendingCloudDeletions returns every pending deletion, soonest due
+// first.
+func (s *cloudBackfillStore) listPendingCloudDeletions(ctx context.Context) ([]pendingCloudDeletion, error) {
+	return s.listDuePendingCloudDeletions(ctx, math.MaxInt64)
+}
+
+// listDuePendingCloudDeletions returns the pending deletions due at nowMS,
+// oldest first.
+func (s *cloudBackfillStore) listDuePendingCloudDeletions(ctx context.Context, nowMS int64) ([]pendingCloudDeletion, error) {
+	rows, err := s.db.Query(ctx, `
+		SELECT portal_id, chat_guid, conversation_json, chat_record_names_json, due_ts
+		FROM pending_cloud_deletion
+		WHERE login_id=$1 AND due_ts<=$2
+		ORDER BY due_ts
+	`, s.loginID, nowMS)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var pending []pendingCloudDeletion
+	for rows.Next() {
+		var d pendingCloudDeletion
+		var convJSON, recordsJSON string
+		if err = rows.Scan(&d.PortalID, &d.ChatGUID, &convJSON, &recordsJSON, &d.DueTS); err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal([]byte(convJSON), &d.Conversation); err != nil {
+			return nil, fmt.Errorf("invalid conversation for pending deletion of %s: %w", d.PortalID, err)
+		}
+		if err = json.Unmarshal([]byte(recordsJSON), &d.ChatRecordNames); err != nil {
+			return nil, fmt.Errorf("invalid record names for pending deletion of %s: %w", d.PortalID, err)
+		}
+		pending = append(pending, d)
+	}
+	return pending, rows.Err()
+}
+
 func (s *cloudBackfillStore) hasRestoreOverride(ctx context.Context, portalID string) (bool, error) {
 	var count int
 	err := s.db.QueryRow(ctx,
@@ -1506,6 +1725,39 @@ func (s *cloudBackfillStore) getChatParticipantsByPortalID(ctx context.Context,
 	return normalized, nil
 }
 
+// getSenderParticipantsByPortalID derives a partial roster for a group
+// portal from the distinct senders of its cloud_message rows, normalized to
+// portal ID format and sorted. It's the fallback for groups whose cloud_chat
+// record never synced: members who never sent a message in the synced
+// history are missing, and so is the user (their rows have no sender).
+func (s *cloudBackfillStore) getSenderParticipantsByPortalID(ctx context.Context, portalID string) ([]string, error) {
+	rows, err := s.db.Query(ctx, `
+		SELECT DISTINCT sender FROM cloud_message
+		WHERE login_id=$1 AND portal_id=$2 AND is_from_me=FALSE AND sender IS NOT NULL AND sender <> ''
+	`, s.loginID, portalID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	seen := make(map[string]bool)
+	var senders []string
+	for rows.Next() {
+		var sender string
+		if err = rows.Scan(&sender); err != nil {
+			return nil, err
+		}
+		if n := normalizeIdentifierForPortalID(sender); n != "" && !seen[n] {
+			seen[n] = true
+			senders = append(senders, n)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	sort.Strings(senders)
+	return senders, nil
+}
+
 // updateChatParticipants overwrites the persisted participant roster for an
 // existing cloud_chat row, touching only participants_json (and updated_ts).
 //
@@ -1841,6 +2093,50 @@ func (s *cloudBackfillStore) softDeleteMessageByGUID(ctx context.Context, guid s
 	)
 }
 
+// markMessageUnsent records an unsent message as deleted, inserting a
+// minimal row when the message itself isn't known yet (its unsend can be
+// replayed ahead of it), so isMessageDeleted keeps matching its UUID.
+func (s *cloudBackfillStore) markMessageUnsent(ctx context.Context, uuid, portalID string, timestampMS int64) error {
+	nowMS := time.Now().UnixMilli()
+	res, err := s.db.Exec(ctx,
+		`UPDATE cloud_message SET deleted=TRUE, updated_ts=$3 WHERE login_id=$1 AND UPPER(guid)=UPPER($2)`,
+		s.loginID, uuid, nowMS,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		return nil
+	}
+	_, err = s.db.Exec(ctx, `
+		INSERT INTO cloud_message (login_id, guid, portal_id, timestamp_ms, is_from_me, deleted, created_ts, updated_ts)
+		VALUES ($1, $2, $3, $4, FALSE, TRUE, $5, $5)
+		ON CONFLICT DO NOTHING
+	`, s.loginID, uuid, portalID, timestampMS, nowMS)
+	return err
+}
+
+// isMessageDeleted reports whether a message UUID is known and soft-deleted,
+// by an unsend or a deletion. Case-insensitive like hasMessageUUID.
+func (s *cloudBackfillStore) isMessageDeleted(ctx context.Context, uuid string) (bool, error) {
+	var count int
+	err := s.db.QueryRow(ctx,
+		`SELECT COUNT(*) FROM cloud_message WHERE login_id=$1 AND UPPER(guid)=UPPER($2) AND deleted=TRUE`,
+		s.loginID, uuid,
+	).Scan(&count)
+	return count > 0, err
+}
+
+// reassignMessagePortalID moves the cloud_message rows of one portal to
+// another, for portals merged into one.
+func (s *cloudBackfillStore) reassignMessagePortalID(ctx context.Context, fromPortalID, toPortalID string) error {
+	_, err := s.db.Exec(ctx,
+		`UPDATE cloud_message SET portal_id=$3 WHERE login_id=$1 AND portal_id=$2`,
+		s.loginID, fromPortalID, toPortalID,
+	)
+	return err
+}
+
 // getGroupPhotoByPortalID returns the group_photo_guid and record_name for
 // the most recently updated cloud_chat row that has a group photo set.
 // Returns ("", "", nil) if no photo is set.
@@ -2078,6 +2374,23 @@ func (s *cloudBackfillStore) hasMessageUUID(ctx context.Context, uuid string) (b
 	return count > 0, err
 }
 
+// hasSentMessageUUID reports whether uuid was recorded by persistMessageUUID
+// as a message sent from this login and not yet seen by CloudKit sync. Unlike
+// hasMessageUUID it compares the GUID exactly, so it is a primary key lookup:
+// the UUIDs it is asked about are the ones the send returned.
+func (s *cloudBackfillStore) hasSentMessageUUID(ctx context.Context, uuid string) (bool, error) {
+	var one int
+	err := s.db.QueryRow(ctx,
+		`SELECT 1 FROM cloud_message
+		 WHERE login_id=$1 AND guid=$2 AND is_from_me=TRUE AND chat_id IS NULL AND tapback_type IS NULL`,
+		s.loginID, uuid,
+	).Scan(&one)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
 // getMessageTimestampByGUID returns the Unix-millisecond send timestamp for a
 // message UUID, and whether the row was found. Used to enforce the pre-startup
 // receipt filter when the message is still being backfilled into the Matrix DB
@@ -2101,6 +2414,26 @@ func (s *cloudBackfillStore) getMessageTextByGUID(ctx context.Context, uuid stri
 	return text.String, nil
 }
 
+// getMessageAttachmentsByGUID returns the attachments of a message by UUID,
+// in balloon-part order. Returns nil if the message isn't found or has none.
+func (s *cloudBackfillStore) getMessageAttachmentsByGUID(ctx context.Context, uuid string) ([]cloudAttachmentRow, error) {
+	var attsJSON sql.NullString
+	err := s.db.QueryRow(ctx,
+		`SELECT attachments_json FROM cloud_message WHERE login_id=$1 AND UPPER(guid)=UPPER($2) AND tapback_type IS NULL LIMIT 1`,
+		s.loginID, uuid,
+	).Scan(&attsJSON)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && attsJSON.String == "") {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var atts []cloudAttachmentRow
+	if err = json.Unmarshal([]byte(attsJSON.String), &atts); err != nil {
+		return nil, err
+	}
+	return atts, nil
+}
+
 func (s *cloudBackfillStore) getMessageTimestampByGUID(ctx context.Context, uuid string) (int64, bool, error) {
 	var ts int64
 	// UPPER() on both sides: APNs delivers UUIDs as uppercase while CloudKit
@@ -2550,11 +2883,13 @@ func (s *cloudBackfillStore) queryMessages(ctx context.Context, query string, ar
 }
 
 // portalWithNewestMessage pairs a portal ID with its newest message timestamp
-// and message count. Used to prioritize portal creation during initial sync.
+// and message counts. Used to prioritize portal creation during initial sync.
 type portalWithNewestMessage struct {
 	PortalID     string
 	NewestTS     int64
 	MessageCount int
+	// IncomingCount is how many of the messages aren't is_from_me.
+	IncomingCount int
 }
 
 // listPortalIDsWithNewestTimestamp returns all portal IDs from both messages
@@ -2563,15 +2898,18 @@ type portalWithNewestMessage struct {
 // their updated_ts from the cloud_chat table so they still get portals created.
 func (s *cloudBackfillStore) listPortalIDsWithNewestTimestamp(ctx context.Context) ([]portalWithNewestMessage, error) {
 	rows, err := s.db.Query(ctx, `
-		SELECT sub.portal_id, MAX(sub.newest_ts) AS newest_ts, SUM(sub.msg_count) AS msg_count FROM (
-			SELECT portal_id, MAX(timestamp_ms) AS newest_ts, COUNT(*) AS msg_count
+		SELECT sub.portal_id, MAX(sub.newest_ts) AS newest_ts, SUM(sub.msg_count) AS msg_count,
+			SUM(sub.incoming_count) AS incoming_count
+		FROM (
+			SELECT portal_id, MAX(timestamp_ms) AS newest_ts, COUNT(*) AS msg_count,
+				SUM(CASE WHEN is_from_me THEN 0 ELSE 1 END) AS incoming_count
 			FROM cloud_message
 			WHERE login_id=$1 AND portal_id IS NOT NULL AND portal_id <> '' AND deleted=FALSE AND record_name <> ''
 			GROUP BY portal_id
 
 			UNION ALL
 
-			SELECT cc.portal_id, COALESCE(cc.updated_ts, 0) AS newest_ts, 0 AS msg_count
+			SELECT cc.portal_id, COALESCE(cc.updated_ts, 0) AS newest_ts, 0 AS msg_count, 0 AS incoming_count
 			FROM cloud_chat cc
 			WHERE cc.login_id=$1 AND cc.portal_id IS NOT NULL AND cc.portal_id <> ''
 			AND COALESCE(cc.is_filtered, 0) = 0
@@ -2596,7 +2934,7 @@ func (s *cloudBackfillStore) listPortalIDsWithNewestTimestamp(ctx context.Contex
 	var out []portalWithNewestMessage
 	for rows.Next() {
 		var p portalWithNewestMessage
-		if err = rows.Scan(&p.PortalID, &p.NewestTS, &p.MessageCount); err != nil {
+		if err = rows.Scan(&p.PortalID, &p.NewestTS, &p.MessageCount, &p.IncomingCount); err != nil {
 			return nil, err
 		}
 		out = append(out, p)
@@ -2859,6 +3197,32 @@ func (s *cloudBackfillStore) listSoftDeletedPortals(ctx context.Context) ([]soft
 	return out, rows.Err()
 }
 
+// clearDeletedPortal hard-deletes the soft-deleted cloud_chat and
+// cloud_message rows for a portal. This is the manual override for the
+// resurrection guard: once the rows are gone, listDeletedPortalIDs no longer
+// reports the portal and hasMessageUUID no longer recognizes its old UUIDs, so
+// the next inbound message creates a fresh portal. Live rows are untouched.
+// Returns the number of chat and message rows removed.
+func (s *cloudBackfillStore) clearDeletedPortal(ctx context.Context, portalID string) (chats, messages int64, err error) {
+	result, err := s.db.Exec(ctx,
+		`DELETE FROM cloud_chat WHERE login_id=$1 AND portal_id=$2 AND deleted=TRUE`,
+		s.loginID, portalID,
+	)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to clear deleted cloud_chat rows for portal %s: %w", portalID, err)
+	}
+	chats, _ = result.RowsAffected()
+	result, err = s.db.Exec(ctx,
+		`DELETE FROM cloud_message WHERE login_id=$1 AND portal_id=$2 AND deleted=TRUE`,
+		s.loginID, portalID,
+	)
+	if err != nil {
+		return chats, 0, fmt.Errorf("failed to clear deleted cloud_message rows for portal %s: %w", portalID, err)
+	}
+	messages, _ = result.RowsAffected()
+	return chats, messages, nil
+}
+
 // cloudChatRecord holds the data needed to re-upload a chat record to CloudKit.
 type cloudChatRecord struct {
 	RecordName     string
@@ -3194,6 +3558,137 @@ func (s *cloudBackfillStore) pruneOrphanedAttachmentCache(ctx context.Context) (
 	return n, nil
 }
 
+// pruneDeletedMessages hard-deletes soft-deleted cloud_message rows whose
+// deletion (updated_ts) is older than cutoffMS. These rows only exist for
+// hasMessageUUID echo detection, and stale APNs echoes stop arriving long
+// before the retention window closes, so without pruning they accumulate
+// forever for every chat that was ever deleted.
+//
+// Two groups of portals are never pruned, regardless of age:
+//   - portals whose cloud_chat rows are still fully soft-deleted (the same
+//     set listDeletedPortalIDs reports): the chat is gone, so its UUIDs are
+//     the only thing stopping an old echo from resurrecting it;
+//   - protectedPortalIDs, for portals the caller knows are mid-deletion
+//     (recentlyDeletedPortals) but whose rows may not be marked yet.
+//
+// Returns the number of rows deleted.
+func (s *cloudBackfillStore) pruneDeletedMessages(ctx context.Context, cutoffMS int64, protectedPortalIDs []string) (int64, error) {
+	rows, err := s.db.Query(ctx, `
+		SELECT DISTINCT COALESCE(portal_id, '')
+		FROM cloud_message
+		WHERE login_id=$1 AND deleted=TRUE AND updated_ts < $2
+		  AND COALESCE(portal_id, '') NOT IN (
+			SELECT portal_id FROM cloud_chat
+			WHERE login_id=$1 AND portal_id <> ''
+			GROUP BY portal_id
+			HAVING MAX(CASE WHEN deleted=TRUE THEN 1 ELSE 0 END) = 1
+			   AND MAX(CASE WHEN deleted=FALSE THEN 1 ELSE 0 END) = 0
+		  )
+	`, s.loginID, cutoffMS)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list prunable deleted messages: %w", err)
+	}
+	protected := make(map[string]bool, len(protectedPortalIDs))
+	for _, id := range protectedPortalIDs {
+		protected[id] = true
+	}
+	var portalIDs []string
+	for rows.Next() {
+		var portalID string
+		if err = rows.Scan(&portalID); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan prunable portal: %w", err)
+		}
+		if !protected[portalID] {
+			portalIDs = append(portalIDs, portalID)
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, fmt.Errorf("failed to list prunable deleted messages: %w", err)
+	}
+
+	var total int64
+	for _, portalID := range portalIDs {
+		result, err := s.db.Exec(ctx,
+			`DELETE FROM cloud_message WHERE login_id=$1 AND deleted=TRUE AND updated_ts < $2 AND COALESCE(portal_id, '')=$3`,
+			s.loginID, cutoffMS, portalID,
+		)
+		if err != nil {
+			return total, fmt.Errorf("failed to prune deleted messages for portal %s: %w", portalID, err)
+		}
+		n, _ := result.RowsAffected()
+		total += n
+	}
+	return total, nil
+}
+
+// listOrphanedMessagePortals returns the portal IDs that cloud_message rows
+// point at but that have neither a cloud_chat row nor a bridgev2 portal of
+// receiver, and whose newest row was stored before cutoffMS. Rows without a
+// portal ID aren't included: they're unresolved, not orphaned.
+func (s *cloudBackfillStore) listOrphanedMessagePortals(ctx context.Context, bridgeID networkid.BridgeID, receiver networkid.UserLoginID, cutoffMS int64) ([]string, error) {
+	rows, err := s.db.Query(ctx, `
+		SELECT cm.portal_id
+		FROM cloud_message cm
+		WHERE cm.login_id=$1 AND cm.portal_id IS NOT NULL AND cm.portal_id <> ''
+		  AND NOT EXISTS (
+			SELECT 1 FROM cloud_chat cc WHERE cc.login_id=$1 AND cc.portal_id=cm.portal_id
+		  )
+		  AND NOT EXISTS (
+			SELECT 1 FROM portal p WHERE p.bridge_id=$2 AND p.id=cm.portal_id AND p.receiver=$3
+		  )
+		GROUP BY cm.portal_id
+		HAVING MAX(cm.created_ts) < $4
+		ORDER BY cm.portal_id
+	`, s.loginID, bridgeID, receiver, cutoffMS)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list orphaned message portals: %w", err)
+	}
+	defer rows.Close()
+	var portalIDs []string
+	for rows.Next() {
+		var portalID string
+		if err = rows.Scan(&portalID); err != nil {
+			return nil, fmt.Errorf("failed to scan orphaned message portal: %w", err)
+		}
+		portalIDs = append(portalIDs, portalID)
+	}
+	return portalIDs, rows.Err()
+}
+
+// pruneOrphanedPortalMessages hard-deletes the live cloud_message rows of
+// the portals listOrphanedMessagePortals reports, except protectedPortalIDs.
+// Soft-deleted rows are left to pruneDeletedMessages, which keeps them for
+// echo detection until the retention window closes. Returns the number of
+// rows deleted.
+func (s *cloudBackfillStore) pruneOrphanedPortalMessages(ctx context.Context, bridgeID networkid.BridgeID, receiver networkid.UserLoginID, cutoffMS int64, protectedPortalIDs []string) (int64, error) {
+	portalIDs, err := s.listOrphanedMessagePortals(ctx, bridgeID, receiver, cutoffMS)
+	if err != nil {
+		return 0, err
+	}
+	protected := make(map[string]bool, len(protectedPortalIDs))
+	for _, id := range protectedPortalIDs {
+		protected[id] = true
+	}
+	var total int64
+	for _, portalID := range portalIDs {
+		if protected[portalID] {
+			continue
+		}
+		result, err := s.db.Exec(ctx,
+			`DELETE FROM cloud_message WHERE login_id=$1 AND deleted=FALSE AND portal_id=$2`,
+			s.loginID, portalID,
+		)
+		if err != nil {
+			return total, fmt.Errorf("failed to prune orphaned messages for portal %s: %w", portalID, err)
+		}
+		n, _ := result.RowsAffected()
+		total += n
+	}
+	return total, nil
+}
+
 // deleteOrphanedMessages hard-deletes cloud_message rows that are already
 // soft-deleted (deleted=TRUE) AND whose portal_id has no matching cloud_chat
 // entry. This is conservative: DM portals legitimately have messages without
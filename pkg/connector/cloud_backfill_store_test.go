@@ -1,6 +1,36 @@
 package connector
 
-import "testing"
+import (
+	"context"
+	"database/sql"
+	"reflect"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"go.mau.fi/util/dbutil"
+)
+
+// newTestCloudStore returns a cloudBackfillStore backed by a fresh in-memory
+// SQLite database with the schema applied.
+func newTestCloudStore(t *testing.T) *cloudBackfillStore {
+	t.Helper()
+	rawDB, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("failed to open sqlite: %v", err)
+	}
+	rawDB.SetMaxOpenConns(1)
+	t.Cleanup(func() { _ = rawDB.Close() })
+	db, err := dbutil.NewWithDB(rawDB, "sqlite3")
+	if err != nil {
+		t.Fatalf("failed to wrap sqlite: %v", err)
+	}
+	store := newCloudBackfillStore(db, "test-login")
+	if err = store.ensureSchema(context.Background()); err != nil {
+		t.Fatalf("ensureSchema() error = %v", err)
+	}
+	return store
+}
 
 func TestParticipantSetsMatch(t *testing.T) {
 	self := "tel:+15551234567"
@@ -113,3 +143,108 @@ func TestParticipantSetsMatch(t *testing.T) {
 		})
 	}
 }
+
+func TestPruneDeletedMessages(t *testing.T) {
+	ctx := context.Background()
+	store := newTestCloudStore(t)
+	now := time.Now()
+	old := now.Add(-60 * 24 * time.Hour).UnixMilli()
+	recent := now.Add(-time.Hour).UnixMilli()
+	cutoff := now.Add(-30 * 24 * time.Hour).UnixMilli()
+
+	chats := []struct {
+		portalID string
+		deleted  bool
+	}{
+		{"tel:+15550000001", false}, // revived chat: old deleted rows are prunable
+		{"tel:+15550000002", true},  // still deleted: rows protect against echoes
+		{"tel:+15550000003", false}, // mid-deletion (passed as protected)
+	}
+	for _, chat := range chats {
+		if _, err := store.db.Exec(ctx,
+			`INSERT INTO cloud_chat (login_id, cloud_chat_id, portal_id, deleted, created_ts) VALUES ($1, $2, $3, $4, $5)`,
+			store.loginID, "chat-"+chat.portalID, chat.portalID, chat.deleted, old,
+		); err != nil {
+			t.Fatalf("insert cloud_chat: %v", err)
+		}
+	}
+	messages := []struct {
+		guid     string
+		portalID string
+		deleted  bool
+		ts       int64
+	}{
+		{"old-deleted-revived", "tel:+15550000001", true, old},
+		{"recent-deleted-revived", "tel:+15550000001", true, recent},
+		{"old-live-revived", "tel:+15550000001", false, old},
+		{"old-deleted-still-deleted", "tel:+15550000002", true, old},
+		{"old-deleted-protected", "tel:+15550000003", true, old},
+	}
+	for _, msg := range messages {
+		if _, err := store.db.Exec(ctx,
+			`INSERT INTO cloud_message (login_id, guid, portal_id, timestamp_ms, is_from_me, deleted, created_ts, updated_ts)
+			 VALUES ($1, $2, $3, $4, FALSE, $5, $4, $4)`,
+			store.loginID, msg.guid, msg.portalID, msg.ts, msg.deleted,
+		); err != nil {
+			t.Fatalf("insert cloud_message: %v", err)
+		}
+	}
+
+	pruned, err := store.pruneDeletedMessages(ctx, cutoff, []string{"tel:+15550000003"})
+	if err != nil {
+		t.Fatalf("pruneDeletedMessages() error = %v", err)
+	}
+	if pruned != 1 {
+		t.Errorf("pruneDeletedMessages() = %d, want 1", pruned)
+	}
+	for _, msg := range messages {
+		want := msg.guid != "old-deleted-revived"
+		got, err := store.hasMessageUUID(ctx, msg.guid)
+		if err != nil {
+			t.Fatalf("hasMessageUUID(%q) error = %v", msg.guid, err)
+		}
+		if got != want {
+			t.Errorf("hasMessageUUID(%q) = %v, want %v", msg.guid, got, want)
+		}
+	}
+}
+
+func TestGetSenderParticipantsByPortalID(t *testing.T) {
+	ctx := context.Background()
+	store := newTestCloudStore(t)
+	const portalID = "gid:9b2c6a5e-1111-2222-3333-444455556666"
+
+	insert := func(guid, portal, sender string, isFromMe bool) {
+		t.Helper()
+		if _, err := store.db.Exec(ctx,
+			`INSERT INTO cloud_message (login_id, guid, portal_id, timestamp_ms, sender, is_from_me, created_ts, updated_ts)
+			 VALUES ($1, $2, $3, 1, $4, $5, 1, 1)`,
+			store.loginID, guid, portal, sender, isFromMe,
+		); err != nil {
+			t.Fatalf("insert %s: %v", guid, err)
+		}
+	}
+	insert("A", portalID, "tel:+15550000002", false)
+	insert("B", portalID, "+15550000001", false)
+	// Same member in another format, and a duplicate.
+	insert("C", portalID, "tel:+15550000001", false)
+	insert("D", portalID, "Friend@Example.com", false)
+	// The user's own messages and rows without a sender don't count.
+	insert("E", portalID, "tel:+15559999999", true)
+	insert("F", portalID, "", false)
+	// Other portals don't leak in.
+	insert("G", "gid:other", "tel:+15550000003", false)
+
+	got, err := store.getSenderParticipantsByPortalID(ctx, portalID)
+	if err != nil {
+		t.Fatalf("getSenderParticipantsByPortalID() error = %v", err)
+	}
+	want := []string{"mailto:friend@example.com", "tel:+15550000001", "tel:+15550000002"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("getSenderParticipantsByPortalID() = %v, want %v", got, want)
+	}
+
+	if got, err = store.getSenderParticipantsByPortalID(ctx, "gid:unknown"); err != nil || len(got) != 0 {
+		t.Errorf("getSenderParticipantsByPortalID(unknown) = %v, %v, want none", got, err)
+	}
+}
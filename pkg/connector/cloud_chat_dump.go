@@ -0,0 +1,114 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2024 Ludvig Rhodin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+package connector
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/lrhodin/imessage/pkg/rustpushgo"
+)
+
+// CloudKit chat dump (cloudkit_chat_dump_path).
+//
+// A debugging aid: every chat record CloudKit chat sync returns is written to
+// a file as one JSON array. Sync can page through tens of thousands of chats,
+// so records are streamed out as each page arrives instead of being held
+// until the end, and the dump is off unless a path is configured.
+
+// jsonArrayWriter streams values to w as the elements of a single JSON array.
+// The output is only a complete array once close has been called.
+type jsonArrayWriter struct {
+	w     io.Writer
+	count int
+}
+
+// writeItem appends one element to the array, writing the opening bracket
+// before the first.
+func (a *jsonArrayWriter) writeItem(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	sep := ",\n"
+	if a.count == 0 {
+		sep = "[\n"
+	}
+	if _, err = io.WriteString(a.w, sep); err != nil {
+		return err
+	}
+	if _, err = a.w.Write(data); err != nil {
+		return err
+	}
+	a.count++
+	return nil
+}
+
+// close terminates the array. An array with no elements is written as [].
+func (a *jsonArrayWriter) close() error {
+	end := "\n]\n"
+	if a.count == 0 {
+		end = "[]\n"
+	}
+	_, err := io.WriteString(a.w, end)
+	return err
+}
+
+// cloudChatDump is an open cloudkit_chat_dump_path file.
+type cloudChatDump struct {
+	file  *os.File
+	buf   *bufio.Writer
+	array jsonArrayWriter
+}
+
+// openCloudChatDump creates (or truncates) the dump file at path.
+func openCloudChatDump(path string) (*cloudChatDump, error) {
+	if strings.HasPrefix(path, "~/") {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		path = filepath.Join(home, path[2:])
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create chat dump: %w", err)
+	}
+	buf := bufio.NewWriter(file)
+	return &cloudChatDump{file: file, buf: buf, array: jsonArrayWriter{w: buf}}, nil
+}
+
+// writePage appends a page of chat records and flushes them to disk, so the
+// dump never holds more than one page.
+func (d *cloudChatDump) writePage(chats []rustpushgo.WrappedCloudSyncChat) error {
+	for _, chat := range chats {
+		if err := d.array.writeItem(chat); err != nil {
+			return err
+		}
+	}
+	return d.buf.Flush()
+}
+
+// Close finishes the JSON array and closes the file. Returns the number of
+// records written.
+func (d *cloudChatDump) Close() (int, error) {
+	err := d.array.close()
+	if err == nil {
+		err = d.buf.Flush()
+	}
+	if closeErr := d.file.Close(); err == nil {
+		err = closeErr
+	}
+	return d.array.count, err
+}
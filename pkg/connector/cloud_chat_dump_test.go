@@ -0,0 +1,106 @@
+package connector
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/lrhodin/imessage/pkg/rustpushgo"
+)
+
+func TestJSONArrayWriter(t *testing.T) {
+	tests := []struct {
+		name  string
+		items []any
+	}{
+		{"empty", nil},
+		{"one", []any{map[string]any{"a": "x"}}},
+		{"several", []any{"plain", 1.5, map[string]any{"quote": `"[,]"`}, []any{"nested"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			a := jsonArrayWriter{w: &buf}
+			for _, item := range tt.items {
+				if err := a.writeItem(item); err != nil {
+					t.Fatalf("writeItem() error = %v", err)
+				}
+			}
+			if err := a.close(); err != nil {
+				t.Fatalf("close() error = %v", err)
+			}
+			var got []any
+			if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+				t.Fatalf("output %q is not valid JSON: %v", buf.String(), err)
+			}
+			if got == nil {
+				t.Fatalf("output %q decoded to null, want an array", buf.String())
+			}
+			want := tt.items
+			if want == nil {
+				want = []any{}
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("decoded array = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestCloudChatDumpStreamsPages(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chats.json")
+	dump, err := openCloudChatDump(path)
+	if err != nil {
+		t.Fatalf("openCloudChatDump() error = %v", err)
+	}
+	name := "Family"
+	pages := [][]rustpushgo.WrappedCloudSyncChat{
+		{{RecordName: "rec-1", CloudChatId: "chat1", Participants: []string{"tel:+15551234567"}}},
+		{},
+		{
+			{RecordName: "rec-2", CloudChatId: "chat2", DisplayName: &name, Style: 43},
+			{RecordName: "rec-3", CloudChatId: "chat3", Deleted: true},
+		},
+	}
+	var sizes []int64
+	for i, page := range pages {
+		if err = dump.writePage(page); err != nil {
+			t.Fatalf("writePage(%d) error = %v", i, err)
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("Stat() error = %v", err)
+		}
+		sizes = append(sizes, info.Size())
+	}
+	// Each non-empty page is on disk as soon as it's written.
+	if sizes[0] == 0 || sizes[2] <= sizes[1] {
+		t.Errorf("dump sizes after each page = %v, want them to grow with each page", sizes)
+	}
+	n, err := dump.Close()
+	if err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if n != 3 {
+		t.Errorf("Close() count = %d, want 3", n)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	var got []rustpushgo.WrappedCloudSyncChat
+	if err = json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("dump is not valid JSON: %v\n%s", err, data)
+	}
+	var want []rustpushgo.WrappedCloudSyncChat
+	for _, page := range pages {
+		want = append(want, page...)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("dump = %+v, want %+v", got, want)
+	}
+}
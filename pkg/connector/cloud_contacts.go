@@ -39,7 +39,7 @@ type contactSource interface {
 type cloudContactsClient struct {
 	baseURL    string             // CardDAV URL from MobileMe delegate
 	dsid       string             // cached DSID for URL construction
-	rustClient *rustpushgo.Client // for getting auth headers via TokenProvider
+	rustClient icloudAuthProvider // for getting auth headers via TokenProvider
 	httpClient *http.Client
 
 	mu       sync.RWMutex
@@ -49,14 +49,30 @@ type cloudContactsClient struct {
 	lastSync time.Time
 }
 
+// icloudAuthProvider is the slice of the TokenProvider that CardDAV needs.
+// Normally the rust Client, which forwards to the TokenProvider it was built
+// with; tokenProviderAuth adapts a TokenProvider restored after the Client
+// was created.
+type icloudAuthProvider interface {
+	GetContactsUrl() (*string, error)
+	GetDsid() (*string, error)
+	GetIcloudAuthHeaders() (*map[string]string, error)
+}
+
 // newCloudContactsClient creates a CardDAV contacts client using the rust Client's
-// TokenProvider for authentication. Returns nil if the token provider is unavailable
+// TokenProvider for authentication, sending region as the account's country
+// (see account_region.go). Returns nil if the token provider is unavailable
 // or the contacts URL can't be retrieved.
-func newCloudContactsClient(rustClient *rustpushgo.Client, log zerolog.Logger) *cloudContactsClient {
+func newCloudContactsClient(rustClient *rustpushgo.Client, region func() string, log zerolog.Logger) *cloudContactsClient {
 	if rustClient == nil {
 		return nil
 	}
+	return newCloudContactsClientWithAuth(regionalICloudAuth{rustClient, region}, log)
+}
 
+// newCloudContactsClientWithAuth is newCloudContactsClient for an arbitrary
+// auth source.
+func newCloudContactsClientWithAuth(rustClient icloudAuthProvider, log zerolog.Logger) *cloudContactsClient {
 	contactsURL, err := rustClient.GetContactsUrl()
 	if err != nil {
 		log.Warn().Err(err).Msg("Failed to get contacts URL from TokenProvider")
@@ -531,7 +547,7 @@ func (c *cloudContactsClient) parseAddressBookList(data []byte, homeSetURL strin
 			if ps.Prop.ResourceType.AddressBook != nil {
 				log.Debug().
 					Str("address_book_host", logSafeURL(href)).
-					Str("name", ps.Prop.DisplayName).
+					Str("name", logText(ps.Prop.DisplayName)).
 					Msg("CardDAV: found address book")
 				addressBooks = append(addressBooks, href)
 			}
@@ -850,7 +866,7 @@ func downloadContactPhotos(contacts []*imessage.Contact, log zerolog.Logger, aut
 					deadContactPhotoURLs.Store(c.AvatarURL, time.Now())
 				}
 				log.Debug().Err(sanitizeURLError(err, c.AvatarURL)).
-					Str("name", c.Name()).
+					Str("name", logText(c.Name())).
 					Str("url_host", logSafeURL(c.AvatarURL)).
 					Msg("Failed to download contact photo URL")
 				return
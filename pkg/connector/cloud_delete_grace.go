@@ -0,0 +1,160 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2024 Ludvig Rhodin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+package connector
+
+// Grace period for Apple-side chat deletion (cloud_delete_grace_minutes).
+//
+// Deleting a room from Matrix also deletes the chat on Apple's side: a
+// MoveToRecycleBin to the user's devices and a delete of the CloudKit chat
+// record, which takes the chat off every device. One accidental room delete
+// is enough for that. With a grace period, HandleMatrixDeleteChat still
+// cleans up locally right away but only records the Apple-side deletion in
+// pending_cloud_deletion; it runs once the period is over, including after
+// a restart. Restoring the chat (restore-chat) or unblock-portal cancels
+// it, and so does the portal having a room again when it comes due, e.g.
+// because a new message recreated it. list-blocked-portals shows the ones
+// still waiting.
+//
+// Flow:
+//   room deleted → local soft-delete now, pending_cloud_deletion due later
+//   restore-chat within the period → pending deletion dropped
+//   period over, no room → deleteFromApple
+
+import (
+	"context"
+	"time"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+
+	"github.com/lrhodin/imessage/pkg/rustpushgo"
+)
+
+// pendingCloudDeletionInterval is how often due deletions are looked for.
+const pendingCloudDeletionInterval = time.Minute
+
+// pendingCloudDeletion is an Apple-side chat deletion waiting out the grace
+// period: the arguments deleteFromApple needs once the portal is gone.
+type pendingCloudDeletion struct {
+	PortalID        string
+	ChatGUID        string
+	Conversation    rustpushgo.WrappedConversation
+	ChatRecordNames []string
+	DueTS           int64
+}
+
+// cloudDeleteGrace returns how long Apple-side deletions wait, or zero when
+// they run right away.
+func (c *IMClient) cloudDeleteGrace() time.Duration {
+	minutes := c.Main.Config.CloudDeleteGraceMinutes
+	if minutes <= 0 || c.cloudStore == nil {
+		return 0
+	}
+	return time.Duration(minutes) * time.Minute
+}
+
+// scheduleDeleteFromApple runs deleteFromApple now, or records it to run
+// after the grace period.
+func (c *IMClient) scheduleDeleteFromApple(ctx context.Context, portalID string, conv rustpushgo.WrappedConversation, chatGuid string, chatRecordNames, msgRecordNames []string) {
+	grace := c.cloudDeleteGrace()
+	if grace == 0 {
+		c.deleteFromApple(portalID, conv, chatGuid, chatRecordNames, msgRecordNames)
+		return
+	}
+	log := zerolog.Ctx(ctx)
+	due := time.Now().Add(grace)
+	err := c.cloudStore.schedulePendingCloudDeletion(ctx, pendingCloudDeletion{
+		PortalID:        portalID,
+		ChatGUID:        chatGuid,
+		Conversation:    conv,
+		ChatRecordNames: chatRecordNames,
+		DueTS:           due.UnixMilli(),
+	})
+	if err != nil {
+		// Better to delete now than to lose the deletion.
+		log.Warn().Err(err).Str("portal_id", portalID).Msg("Failed to schedule deletion from Apple, deleting now")
+		c.deleteFromApple(portalID, conv, chatGuid, chatRecordNames, msgRecordNames)
+		return
+	}
+	log.Info().Str("portal_id", portalID).Time("due", due).Msg("Deletion from Apple scheduled, restore the chat before then to cancel it")
+}
+
+// cancelDeleteFromApple drops a pending Apple-side deletion of portalID.
+func (c *IMClient) cancelDeleteFromApple(ctx context.Context, portalID string) {
+	if c.cloudStore == nil {
+		return
+	}
+	if cancelled, err := c.cloudStore.cancelPendingCloudDeletion(ctx, portalID); err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Str("portal_id", portalID).Msg("Failed to cancel pending deletion from Apple")
+	} else if cancelled {
+		zerolog.Ctx(ctx).Info().Str("portal_id", portalID).Msg("Cancelled pending deletion from Apple")
+	}
+}
+
+// pendingDeletionCancelled reports whether the portal of a due deletion has
+// a room again, or is being restored.
+func (c *IMClient) pendingDeletionCancelled(ctx context.Context, portalID string) bool {
+	portal, err := c.Main.Bridge.DB.Portal.GetByKey(ctx, networkid.PortalKey{ID: networkid.PortalID(portalID), Receiver: c.UserLogin.ID})
+	if err == nil && portal != nil && portal.MXID != "" {
+		return true
+	}
+	restoring, err := c.cloudStore.hasRestoreOverride(ctx, portalID)
+	return err == nil && restoring
+}
+
+// runDuePendingCloudDeletions carries out the deletions whose grace period
+// is over and drops the cancelled ones. Returns how many were carried out.
+func (c *IMClient) runDuePendingCloudDeletions(ctx context.Context, log zerolog.Logger, now time.Time, deleteFromApple func(pendingCloudDeletion)) int {
+	due, err := c.cloudStore.listDuePendingCloudDeletions(ctx, now.UnixMilli())
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to list pending deletions from Apple")
+		return 0
+	}
+	deleted := 0
+	for _, d := range due {
+		// Dropped before deleting, so a crash can't delete twice; a lost
+		// deletion only leaves the chat on Apple's side.
+		if _, err = c.cloudStore.cancelPendingCloudDeletion(ctx, d.PortalID); err != nil {
+			log.Warn().Err(err).Str("portal_id", d.PortalID).Msg("Failed to clear pending deletion from Apple")
+			continue
+		}
+		if c.pendingDeletionCancelled(ctx, d.PortalID) {
+			log.Info().Str("portal_id", d.PortalID).Msg("Chat was recreated during the grace period, not deleting it from Apple")
+			continue
+		}
+		deleteFromApple(d)
+		deleted++
+	}
+	return deleted
+}
+
+// periodicPendingCloudDeletions runs due Apple-side deletions. It runs even
+// with the grace period off, so deletions scheduled before are carried out.
+func (c *IMClient) periodicPendingCloudDeletions(log zerolog.Logger) {
+	if c.cloudStore == nil || c.client == nil {
+		return
+	}
+	log = log.With().Str("component", "pending_cloud_deletion").Logger()
+	run := func() {
+		c.runDuePendingCloudDeletions(context.Background(), log, time.Now(), func(d pendingCloudDeletion) {
+			c.deleteFromApple(d.PortalID, d.Conversation, d.ChatGUID, d.ChatRecordNames, nil)
+		})
+	}
+	run()
+	ticker := time.NewTicker(pendingCloudDeletionInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			run()
+		case <-c.stopChan:
+			return
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package connector
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/lrhodin/imessage/pkg/rustpushgo"
+)
+
+func TestPendingCloudDeletionStore(t *testing.T) {
+	ctx := context.Background()
+	s := newTestCloudStore(t)
+	sender := "sender-guid"
+	want := pendingCloudDeletion{
+		PortalID:        "tel:+15551111111",
+		ChatGUID:        "iMessage;-;+15551111111",
+		Conversation:    rustpushgo.WrappedConversation{Participants: []string{"tel:+15551111111", "tel:+15550000000"}, SenderGuid: &sender},
+		ChatRecordNames: []string{"rec1", "rec2"},
+		DueTS:           2000,
+	}
+	if err := s.schedulePendingCloudDeletion(ctx, want); err != nil {
+		t.Fatalf("schedulePendingCloudDeletion() error = %v", err)
+	}
+
+	if due, err := s.listDuePendingCloudDeletions(ctx, 1999); err != nil || len(due) != 0 {
+		t.Errorf("listDuePendingCloudDeletions(before due) = %v, %v, want none", due, err)
+	}
+	due, err := s.listDuePendingCloudDeletions(ctx, 2000)
+	if err != nil {
+		t.Fatalf("listDuePendingCloudDeletions() error = %v", err)
+	}
+	if len(due) != 1 || !reflect.DeepEqual(due[0], want) {
+		t.Errorf("listDuePendingCloudDeletions() = %+v, want %+v", due, want)
+	}
+
+	// Scheduling again replaces the entry.
+	want.DueTS = 5000
+	want.ChatRecordNames = nil
+	if err = s.schedulePendingCloudDeletion(ctx, want); err != nil {
+		t.Fatalf("schedulePendingCloudDeletion() again error = %v", err)
+	}
+	if due, err = s.listDuePendingCloudDeletions(ctx, 4999); err != nil || len(due) != 0 {
+		t.Errorf("listDuePendingCloudDeletions() after reschedule = %v, %v, want none", due, err)
+	}
+	if due, err = s.listDuePendingCloudDeletions(ctx, 5000); err != nil || len(due) != 1 || len(due[0].ChatRecordNames) != 0 {
+		t.Errorf("listDuePendingCloudDeletions() after reschedule = %+v, %v, want one without record names", due, err)
+	}
+	if all, err := s.listPendingCloudDeletions(ctx); err != nil || len(all) != 1 || all[0].DueTS != 5000 {
+		t.Errorf("listPendingCloudDeletions() = %+v, %v, want the rescheduled entry", all, err)
+	}
+
+	if cancelled, err := s.cancelPendingCloudDeletion(ctx, want.PortalID); err != nil || !cancelled {
+		t.Errorf("cancelPendingCloudDeletion() = %v, %v, want true, nil", cancelled, err)
+	}
+	if cancelled, err := s.cancelPendingCloudDeletion(ctx, want.PortalID); err != nil || cancelled {
+		t.Errorf("cancelPendingCloudDeletion() again = %v, %v, want false, nil", cancelled, err)
+	}
+	if due, err = s.listDuePendingCloudDeletions(ctx, 10000); err != nil || len(due) != 0 {
+		t.Errorf("listDuePendingCloudDeletions() after cancel = %v, %v, want none", due, err)
+	}
+}
+
+func TestRunDuePendingCloudDeletions(t *testing.T) {
+	ctx := context.Background()
+	db := newTestBridgeDB(t)
+	c := &IMClient{
+		Main:       &IMConnector{Bridge: &bridgev2.Bridge{DB: db}, Config: IMConfig{CloudDeleteGraceMinutes: 60}},
+		UserLogin:  &bridgev2.UserLogin{UserLogin: &database.UserLogin{ID: "login"}},
+		cloudStore: newTestCloudStore(t),
+	}
+	now := time.UnixMilli(100_000)
+	schedule := func(portalID string, due time.Time) {
+		t.Helper()
+		err := c.cloudStore.schedulePendingCloudDeletion(ctx, pendingCloudDeletion{PortalID: portalID, ChatGUID: "iMessage;-;" + portalID, DueTS: due.UnixMilli()})
+		if err != nil {
+			t.Fatalf("schedulePendingCloudDeletion(%s) error = %v", portalID, err)
+		}
+	}
+	schedule("tel:+1", now.Add(-time.Minute))
+	schedule("tel:+2", now.Add(time.Minute))
+	schedule("tel:+3", now.Add(-time.Minute))
+	schedule("tel:+4", now.Add(-time.Minute))
+	schedule("tel:+5", now.Add(-time.Minute))
+
+	// tel:+3 got a room again, tel:+4 is being restored, and tel:+5 was
+	// restored before it was due.
+	err := db.Portal.Insert(ctx, &database.Portal{PortalKey: networkid.PortalKey{ID: "tel:+3", Receiver: "login"}, MXID: id.RoomID("!room:example.com")})
+	if err != nil {
+		t.Fatalf("Portal.Insert() error = %v", err)
+	}
+	if err = c.cloudStore.setRestoreOverride(ctx, "tel:+4"); err != nil {
+		t.Fatalf("setRestoreOverride() error = %v", err)
+	}
+	c.cancelDeleteFromApple(ctx, "tel:+5")
+
+	var deleted []string
+	run := func(at time.Time) int {
+		return c.runDuePendingCloudDeletions(ctx, zerolog.Nop(), at, func(d pendingCloudDeletion) {
+			deleted = append(deleted, d.PortalID)
+		})
+	}
+	if n := run(now); n != 1 || !reflect.DeepEqual(deleted, []string{"tel:+1"}) {
+		t.Errorf("runDuePendingCloudDeletions() = %d, deleted %v, want 1, [tel:+1]", n, deleted)
+	}
+	// Cancelled entries are dropped rather than checked again.
+	remaining, err := c.cloudStore.listDuePendingCloudDeletions(ctx, now.Add(time.Hour).UnixMilli())
+	if err != nil {
+		t.Fatalf("listDuePendingCloudDeletions() error = %v", err)
+	}
+	var ids []string
+	for _, d := range remaining {
+		ids = append(ids, d.PortalID)
+	}
+	sort.Strings(ids)
+	if !reflect.DeepEqual(ids, []string{"tel:+2"}) {
+		t.Errorf("pending deletions after run = %v, want [tel:+2]", ids)
+	}
+
+	deleted = nil
+	if n := run(now.Add(2 * time.Minute)); n != 1 || !reflect.DeepEqual(deleted, []string{"tel:+2"}) {
+		t.Errorf("runDuePendingCloudDeletions(later) = %d, deleted %v, want 1, [tel:+2]", n, deleted)
+	}
+}
+
+func TestCloudDeleteGrace(t *testing.T) {
+	tests := []struct {
+		minutes  int
+		hasStore bool
+		want     time.Duration
+	}{
+		{0, true, 0},
+		{-5, true, 0},
+		{30, false, 0},
+		{30, true, 30 * time.Minute},
+	}
+	for _, tt := range tests {
+		c := &IMClient{Main: &IMConnector{Config: IMConfig{CloudDeleteGraceMinutes: tt.minutes}}}
+		if tt.hasStore {
+			c.cloudStore = newTestCloudStore(t)
+		}
+		if got := c.cloudDeleteGrace(); got != tt.want {
+			t.Errorf("cloudDeleteGrace(%d, store %v) = %v, want %v", tt.minutes, tt.hasStore, got, tt.want)
+		}
+	}
+}
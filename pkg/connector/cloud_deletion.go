@@ -0,0 +1,99 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2024 Ludvig Rhodin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+package connector
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/bridgev2/simplevent"
+)
+
+// Redacting messages deleted on an Apple device (redact_cloud_deleted_messages).
+//
+// CloudKit sync reports a message record as deleted when the user deletes it
+// in Messages. ingestCloudMessages always soft-deletes the cloud_message row
+// so the message isn't backfilled again; with this option the Matrix event
+// bridged for it is redacted too. Only deletions newly observed by this sync
+// count — a row that's already marked deleted was handled by an earlier one —
+// and only messages that actually have a Matrix event.
+
+// cloudDeletionRedaction is one bridged message part to redact.
+type cloudDeletionRedaction struct {
+	portalKey networkid.PortalKey
+	messageID networkid.MessageID
+}
+
+// cloudDeletionRedactions returns the Matrix messages to redact for the
+// deleted message GUIDs of a sync page. Must run before the page's
+// deletions are written to cloud_message. Returns nil when
+// redact_cloud_deleted_messages is off.
+func (c *IMClient) cloudDeletionRedactions(ctx context.Context, deletedGUIDs []string) ([]cloudDeletionRedaction, error) {
+	if !c.Main.Config.RedactCloudDeletedMessages || len(deletedGUIDs) == 0 {
+		return nil, nil
+	}
+	live, err := c.cloudStore.liveMessageBatch(ctx, deletedGUIDs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check deleted messages: %w", err)
+	}
+	msgDB := c.Main.Bridge.DB.Message
+	var redactions []cloudDeletionRedaction
+	for _, guid := range deletedGUIDs {
+		if !live[guid] {
+			continue
+		}
+		// The text and each attachment are separate messages (uuid,
+		// uuid_att0, uuid_att1, …); attachment indexes are contiguous.
+		ids := []networkid.MessageID{makeMessageID(guid)}
+		for i := 0; ; i++ {
+			attID := makeMessageID(fmt.Sprintf("%s_att%d", guid, i))
+			parts, err := msgDB.GetAllPartsByID(ctx, c.UserLogin.ID, attID)
+			if err != nil {
+				return nil, err
+			} else if len(parts) == 0 {
+				break
+			}
+			ids = append(ids, attID)
+		}
+		for _, id := range ids {
+			parts, err := msgDB.GetAllPartsByID(ctx, c.UserLogin.ID, id)
+			if err != nil {
+				return nil, err
+			} else if len(parts) > 0 {
+				redactions = append(redactions, cloudDeletionRedaction{portalKey: parts[0].Room, messageID: id})
+			}
+		}
+	}
+	return redactions, nil
+}
+
+// queueCloudDeletionRedactions redacts the given messages in Matrix. The
+// deletion was made by the user on one of their devices, so it's sent as
+// from the user.
+func (c *IMClient) queueCloudDeletionRedactions(log zerolog.Logger, redactions []cloudDeletionRedaction) {
+	for _, r := range redactions {
+		log.Info().
+			Str("message_id", string(r.messageID)).
+			Str("portal_id", string(r.portalKey.ID)).
+			Msg("Redacting message deleted on an Apple device")
+		c.Main.Bridge.QueueRemoteEvent(c.UserLogin, &simplevent.MessageRemove{
+			EventMeta: simplevent.EventMeta{
+				Type:      bridgev2.RemoteEventMessageRemove,
+				PortalKey: r.portalKey,
+				Sender:    c.makeEventSender(nil),
+				Timestamp: time.Now(),
+			},
+			TargetMessage: r.messageID,
+		})
+	}
+}
@@ -0,0 +1,80 @@
+package connector
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestCloudDeletionRedactions(t *testing.T) {
+	ctx := context.Background()
+	db := newTestBridgeDB(t)
+	store := newTestCloudStore(t)
+	c := &IMClient{
+		Main:       &IMConnector{Bridge: &bridgev2.Bridge{DB: db}},
+		UserLogin:  &bridgev2.UserLogin{UserLogin: &database.UserLogin{ID: "login"}, Log: zerolog.Nop()},
+		cloudStore: store,
+	}
+	portalKey := networkid.PortalKey{ID: "tel:+15551234567", Receiver: "login"}
+	if err := db.Portal.Insert(ctx, &database.Portal{PortalKey: portalKey}); err != nil {
+		t.Fatalf("Portal.Insert() error = %v", err)
+	}
+	ts := time.Unix(1700000000, 0)
+	// PHOTO has a caption and two attachments; TEXT is plain; UNBRIDGED was
+	// synced but never made it to Matrix; GONE was deleted by an earlier sync.
+	for i, msgID := range []string{"PHOTO", "PHOTO_att0", "PHOTO_att1", "TEXT", "GONE"} {
+		err := db.Message.Insert(ctx, &database.Message{
+			ID:        makeMessageID(msgID),
+			MXID:      id.EventID("$" + msgID),
+			Room:      portalKey,
+			SenderID:  "tel:+15551234567",
+			Timestamp: ts.Add(time.Duration(i) * time.Second),
+		})
+		if err != nil {
+			t.Fatalf("Message.Insert(%s) error = %v", msgID, err)
+		}
+	}
+	for _, guid := range []string{"PHOTO", "TEXT", "UNBRIDGED", "GONE"} {
+		if err := store.persistMessageUUID(ctx, guid, string(portalKey.ID), ts.UnixMilli(), false); err != nil {
+			t.Fatalf("persistMessageUUID(%s) error = %v", guid, err)
+		}
+	}
+	if err := store.deleteMessageBatch(ctx, []string{"GONE"}); err != nil {
+		t.Fatalf("deleteMessageBatch() error = %v", err)
+	}
+	deleted := []string{"PHOTO", "UNBRIDGED", "GONE", "NEVER-SEEN"}
+
+	got, err := c.cloudDeletionRedactions(ctx, deleted)
+	if err != nil || got != nil {
+		t.Errorf("cloudDeletionRedactions() when disabled = %v, %v, want nil", got, err)
+	}
+
+	c.Main.Config.RedactCloudDeletedMessages = true
+	got, err = c.cloudDeletionRedactions(ctx, deleted)
+	if err != nil {
+		t.Fatalf("cloudDeletionRedactions() error = %v", err)
+	}
+	want := []cloudDeletionRedaction{
+		{portalKey, makeMessageID("PHOTO")},
+		{portalKey, makeMessageID("PHOTO_att0")},
+		{portalKey, makeMessageID("PHOTO_att1")},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("cloudDeletionRedactions() = %v, want %v", got, want)
+	}
+
+	// Once the deletion is recorded, the next sync doesn't redact again.
+	if err = store.deleteMessageBatch(ctx, deleted); err != nil {
+		t.Fatalf("deleteMessageBatch() error = %v", err)
+	}
+	if got, err = c.cloudDeletionRedactions(ctx, deleted); err != nil || len(got) != 0 {
+		t.Errorf("cloudDeletionRedactions() after deletion recorded = %v, %v, want none", got, err)
+	}
+}
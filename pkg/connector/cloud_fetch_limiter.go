@@ -0,0 +1,139 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2024 Ludvig Rhodin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+package connector
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Pacing of CloudFetchRecentMessages (cloudkit_fetch_recent_*).
+//
+// Restoring a recovered chat runs up to maxRestoreAttempts rounds of
+// targeted fetches with an unfiltered scan as the fallback, each a
+// CloudFetchRecentMessages call of up to 50 pages. Recovering many chats
+// at once multiplies that, which can exhaust the account's CloudKit request
+// quota and get every CloudKit call throttled, the regular sync included.
+// So the calls are capped per restore attempt (cloudFetchBudget), spaced
+// out across the whole client, and paused with a growing backoff once
+// CloudKit says it's throttling.
+
+// errCloudFetchThrottled is returned instead of fetching while backing off.
+var errCloudFetchThrottled = errors.New("CloudKit fetches paused after throttling")
+
+// cloudFetchLimiter spaces out CloudFetchRecentMessages calls and tracks the
+// throttle backoff.
+type cloudFetchLimiter struct {
+	mu             sync.Mutex
+	next           time.Time // earliest start of the next call
+	blockedUntil   time.Time
+	throttleStreak int
+}
+
+// reserve claims the next fetch slot, at least interval after the previous
+// one. It returns how long to wait before fetching, or errCloudFetchThrottled
+// while a throttle backoff is in effect.
+func (l *cloudFetchLimiter) reserve(now time.Time, interval time.Duration) (time.Duration, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Before(l.blockedUntil) {
+		return 0, fmt.Errorf("%w for another %s", errCloudFetchThrottled, l.blockedUntil.Sub(now).Round(time.Second))
+	}
+	start := now
+	if l.next.After(start) {
+		start = l.next
+	}
+	l.next = start.Add(interval)
+	return start.Sub(now), nil
+}
+
+// finished records the outcome of a fetch. A throttle error starts or
+// extends the backoff; a success ends it.
+func (l *cloudFetchLimiter) finished(now time.Time, err error) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err == nil {
+		l.throttleStreak = 0
+		return 0
+	} else if !isCloudKitThrottleError(err) {
+		return 0
+	}
+	l.throttleStreak++
+	backoff := cloudFetchThrottleBackoff(l.throttleStreak)
+	l.blockedUntil = now.Add(backoff)
+	return backoff
+}
+
+// cloudFetchThrottleBackoff is how long fetches pause after the given number
+// of throttle errors in a row.
+func cloudFetchThrottleBackoff(streak int) time.Duration {
+	switch streak {
+	case 1:
+		return 1 * time.Minute
+	case 2:
+		return 5 * time.Minute
+	case 3:
+		return 15 * time.Minute
+	default:
+		return 30 * time.Minute
+	}
+}
+
+// isCloudKitThrottleError reports whether a CloudKit error from rustpush
+// means the request was rate limited. rustpush only passes the error text
+// through, so this matches on what CloudKit and its HTTP layer say. Bare
+// status codes aren't matched: they'd also hit record names and UUIDs.
+func isCloudKitThrottleError(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := strings.ToLower(err.Error())
+	for _, marker := range []string{"throttl", "ratelimit", "rate limit", "too many requests", "service unavailable", "retry after", "retry-after", "quota"} {
+		if strings.Contains(msg, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// cloudFetchBudget is how many CloudFetchRecentMessages calls one restore
+// attempt may still make. Negative means unlimited.
+type cloudFetchBudget int
+
+// take uses up one call, reporting false once the budget is spent.
+func (b *cloudFetchBudget) take() bool {
+	if *b < 0 {
+		return true
+	} else if *b == 0 {
+		return false
+	}
+	*b--
+	return true
+}
+
+// newCloudFetchBudget returns the per-restore budget from
+// cloudkit_fetch_recent_max_per_restore (zero or negative: unlimited).
+func (c *IMClient) newCloudFetchBudget() cloudFetchBudget {
+	if limit := c.Main.Config.CloudFetchRecentMaxPerRestore; limit > 0 {
+		return cloudFetchBudget(limit)
+	}
+	return -1
+}
+
+// cloudFetchInterval returns the minimum spacing between fetches from
+// cloudkit_fetch_recent_interval_seconds.
+func (c *IMClient) cloudFetchInterval() time.Duration {
+	if secs := c.Main.Config.CloudFetchRecentIntervalSeconds; secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	return 0
+}
@@ -0,0 +1,100 @@
+package connector
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCloudFetchBudget(t *testing.T) {
+	tests := []struct {
+		name  string
+		limit int
+		want  int // calls allowed out of 10
+	}{
+		{"capped", 3, 3},
+		{"unlimited", 0, 10},
+		{"negative is unlimited", -1, 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &IMClient{Main: &IMConnector{Config: IMConfig{CloudFetchRecentMaxPerRestore: tt.limit}}}
+			budget := c.newCloudFetchBudget()
+			got := 0
+			for i := 0; i < 10; i++ {
+				if budget.take() {
+					got++
+				}
+			}
+			if got != tt.want {
+				t.Errorf("take() allowed %d of 10 calls, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCloudFetchLimiterSpacing(t *testing.T) {
+	var l cloudFetchLimiter
+	now := time.Unix(1700000000, 0)
+	interval := 2 * time.Second
+
+	for i, want := range []time.Duration{0, 2 * time.Second, 4 * time.Second} {
+		wait, err := l.reserve(now, interval)
+		if err != nil || wait != want {
+			t.Errorf("reserve() #%d = %v, %v, want %v, nil", i, wait, err, want)
+		}
+	}
+	// Once the queued slots have passed, a call goes straight through.
+	if wait, err := l.reserve(now.Add(time.Minute), interval); err != nil || wait != 0 {
+		t.Errorf("reserve() after idle = %v, %v, want 0, nil", wait, err)
+	}
+}
+
+func TestCloudFetchLimiterThrottleBackoff(t *testing.T) {
+	var l cloudFetchLimiter
+	now := time.Unix(1700000000, 0)
+	throttled := errors.New("CloudKit error: RequestRateLimited, retry after 60s")
+
+	if backoff := l.finished(now, errors.New("record not found")); backoff != 0 {
+		t.Errorf("finished(other error) backoff = %v, want 0", backoff)
+	}
+	if backoff := l.finished(now, throttled); backoff != time.Minute {
+		t.Errorf("finished(throttled) backoff = %v, want %v", backoff, time.Minute)
+	}
+	if _, err := l.reserve(now.Add(30*time.Second), 0); !errors.Is(err, errCloudFetchThrottled) {
+		t.Errorf("reserve() during backoff error = %v, want errCloudFetchThrottled", err)
+	}
+	if _, err := l.reserve(now.Add(time.Minute), 0); err != nil {
+		t.Errorf("reserve() after backoff error = %v, want nil", err)
+	}
+
+	// Consecutive throttles back off further; a success resets the streak.
+	now = now.Add(time.Minute)
+	if backoff := l.finished(now, throttled); backoff != 5*time.Minute {
+		t.Errorf("second finished(throttled) backoff = %v, want %v", backoff, 5*time.Minute)
+	}
+	l.finished(now.Add(5*time.Minute), nil)
+	if backoff := l.finished(now.Add(6*time.Minute), throttled); backoff != time.Minute {
+		t.Errorf("finished(throttled) after success backoff = %v, want %v", backoff, time.Minute)
+	}
+}
+
+func TestIsCloudKitThrottleError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{errors.New("CKError: RequestRateLimited"), true},
+		{errors.New("HTTP 429 Too Many Requests"), true},
+		{errors.New("request throttled by server"), true},
+		{errors.New("503 Service Unavailable"), true},
+		{errors.New("record 4290-abcd not found"), false},
+		{errors.New("Operation UUID has no response?"), false},
+	}
+	for _, tt := range tests {
+		if got := isCloudKitThrottleError(tt.err); got != tt.want {
+			t.Errorf("isCloudKitThrottleError(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
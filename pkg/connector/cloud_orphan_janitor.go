@@ -0,0 +1,92 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2024 Ludvig Rhodin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+package connector
+
+import (
+	"context"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// Orphaned cloud_message janitor (orphaned_message_cleanup_days).
+//
+// Ingest can leave cloud_message rows under a portal ID that no longer
+// exists anywhere: portal ID normalization changed, a chat was re-keyed, or
+// the portal was removed on the Matrix side without a tombstone. Those rows
+// are never backfilled, but they bloat the database and make the portal
+// look like it still has pending CloudKit messages. The janitor prunes the
+// live rows of portals that have neither a cloud_chat row nor a Matrix
+// portal, once nothing has been added to them for the configured number of
+// days. It never prunes sooner than the deleted-message retention window,
+// so UUIDs kept for echo detection outlive it, and it leaves soft-deleted
+// rows (deleted chats and messages) to periodicDeletedMessagePrune.
+
+// orphanedMessageCleanupAge returns how long an orphaned portal must go
+// without new rows before the janitor prunes it, or 0 if the janitor is
+// disabled.
+func (c *IMClient) orphanedMessageCleanupAge() time.Duration {
+	days := c.Main.Config.OrphanedMessageCleanupDays
+	if days <= 0 {
+		return 0
+	}
+	return max(time.Duration(days)*24*time.Hour, c.deletedMessageRetention())
+}
+
+// orphanJanitorProtectedPortals lists the portals the janitor must leave
+// alone even if they look orphaned: those mid-deletion, whose rows may not
+// be marked yet, and those the user asked to restore.
+func (c *IMClient) orphanJanitorProtectedPortals(ctx context.Context) []string {
+	c.recentlyDeletedPortalsMu.RLock()
+	protected := make([]string, 0, len(c.recentlyDeletedPortals))
+	for portalID := range c.recentlyDeletedPortals {
+		protected = append(protected, portalID)
+	}
+	c.recentlyDeletedPortalsMu.RUnlock()
+	return append(protected, c.cloudStore.listRestoreOverrides(ctx)...)
+}
+
+// sweepOrphanedCloudMessages runs one janitor pass and returns the number of
+// rows pruned. It skips the pass while CloudKit sync is still running, since
+// portals for freshly synced chats may not have been created yet.
+func (c *IMClient) sweepOrphanedCloudMessages(ctx context.Context, log zerolog.Logger, age time.Duration) int64 {
+	if !c.isCloudSyncDone() {
+		log.Debug().Msg("Skipping orphaned message sweep until CloudKit sync is done")
+		return 0
+	}
+	cutoff := time.Now().Add(-age).UnixMilli()
+	pruned, err := c.cloudStore.pruneOrphanedPortalMessages(ctx, c.Main.Bridge.DB.BridgeID, c.UserLogin.ID, cutoff, c.orphanJanitorProtectedPortals(ctx))
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to prune orphaned cloud messages")
+	}
+	return pruned
+}
+
+// periodicOrphanedMessageCleanup runs the janitor every 12h while
+// orphaned_message_cleanup_days is set. The first pass waits a cycle, as
+// CloudKit sync is rarely done at startup.
+func (c *IMClient) periodicOrphanedMessageCleanup(log zerolog.Logger) {
+	age := c.orphanedMessageCleanupAge()
+	if age == 0 || c.cloudStore == nil {
+		return
+	}
+	log = log.With().Str("component", "orphaned_message_cleanup").Logger()
+	ticker := time.NewTicker(12 * time.Hour)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if pruned := c.sweepOrphanedCloudMessages(context.Background(), log, age); pruned > 0 {
+				log.Info().Int64("pruned", pruned).Msg("Pruned cloud_message rows of portals that no longer exist")
+			}
+		case <-c.stopChan:
+			return
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package connector
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+)
+
+func TestPruneOrphanedPortalMessages(t *testing.T) {
+	ctx := context.Background()
+	db := newTestBridgeDB(t)
+	store := newCloudBackfillStore(db.Database, "test-login")
+	if err := store.ensureSchema(ctx); err != nil {
+		t.Fatalf("ensureSchema() error = %v", err)
+	}
+	now := time.Now()
+	old := now.Add(-90 * 24 * time.Hour).UnixMilli()
+	recent := now.Add(-time.Hour).UnixMilli()
+	cutoff := now.Add(-30 * 24 * time.Hour).UnixMilli()
+
+	// A Matrix portal with no cloud_chat row (a DM), one for another login.
+	for _, key := range []networkid.PortalKey{
+		{ID: "tel:+15550000001", Receiver: "test-login"},
+		{ID: "tel:+15550000009", Receiver: "other-login"},
+	} {
+		if err := db.Portal.Insert(ctx, &database.Portal{PortalKey: key}); err != nil {
+			t.Fatalf("Portal.Insert() error = %v", err)
+		}
+	}
+	for _, chat := range []struct {
+		portalID string
+		deleted  bool
+	}{
+		{"gid:live-group", false},
+		{"tel:+15550000002", true}, // deleted chat: its rows guard against echoes
+	} {
+		if _, err := store.db.Exec(ctx,
+			`INSERT INTO cloud_chat (login_id, cloud_chat_id, portal_id, deleted, created_ts) VALUES ($1, $2, $3, $4, $5)`,
+			store.loginID, "chat-"+chat.portalID, chat.portalID, chat.deleted, old,
+		); err != nil {
+			t.Fatalf("insert cloud_chat: %v", err)
+		}
+	}
+	messages := []struct {
+		guid     string
+		portalID string
+		deleted  bool
+		ts       int64
+		want     bool // still there after the sweep
+	}{
+		{"dm-with-portal", "tel:+15550000001", false, old, true},
+		{"group-with-chat", "gid:live-group", false, old, true},
+		{"deleted-chat", "tel:+15550000002", true, old, true},
+		{"orphan-old", "tel:+15550000003", false, old, false},
+		{"orphan-old-2", "tel:+15550000003", false, old, false},
+		{"orphan-old-soft-deleted", "tel:+15550000003", true, old, true},
+		{"orphan-recent-old", "tel:+15550000004", false, old, true},
+		{"orphan-recent-new", "tel:+15550000004", false, recent, true},
+		{"orphan-protected", "tel:+15550000005", false, old, true},
+		{"other-login-portal", "tel:+15550000009", false, old, false},
+		{"unresolved", "", false, old, true},
+	}
+	for _, msg := range messages {
+		if _, err := store.db.Exec(ctx,
+			`INSERT INTO cloud_message (login_id, guid, portal_id, timestamp_ms, is_from_me, deleted, created_ts, updated_ts)
+			 VALUES ($1, $2, $3, $4, FALSE, $5, $4, $4)`,
+			store.loginID, msg.guid, msg.portalID, msg.ts, msg.deleted,
+		); err != nil {
+			t.Fatalf("insert cloud_message: %v", err)
+		}
+	}
+
+	orphans, err := store.listOrphanedMessagePortals(ctx, db.BridgeID, "test-login", cutoff)
+	if err != nil {
+		t.Fatalf("listOrphanedMessagePortals() error = %v", err)
+	}
+	wantOrphans := []string{"tel:+15550000003", "tel:+15550000005", "tel:+15550000009"}
+	if len(orphans) != len(wantOrphans) {
+		t.Fatalf("listOrphanedMessagePortals() = %v, want %v", orphans, wantOrphans)
+	}
+	for i := range orphans {
+		if orphans[i] != wantOrphans[i] {
+			t.Errorf("listOrphanedMessagePortals() = %v, want %v", orphans, wantOrphans)
+			break
+		}
+	}
+
+	pruned, err := store.pruneOrphanedPortalMessages(ctx, db.BridgeID, "test-login", cutoff, []string{"tel:+15550000005"})
+	if err != nil {
+		t.Fatalf("pruneOrphanedPortalMessages() error = %v", err)
+	}
+	if pruned != 3 {
+		t.Errorf("pruneOrphanedPortalMessages() = %d, want 3", pruned)
+	}
+	for _, msg := range messages {
+		got, err := store.hasMessageUUID(ctx, msg.guid)
+		if err != nil {
+			t.Fatalf("hasMessageUUID(%q) error = %v", msg.guid, err)
+		}
+		if got != msg.want {
+			t.Errorf("hasMessageUUID(%q) = %v, want %v", msg.guid, got, msg.want)
+		}
+	}
+}
+
+func TestOrphanedMessageCleanupAge(t *testing.T) {
+	tests := []struct {
+		days, retentionDays int
+		want                time.Duration
+	}{
+		{0, 30, 0},
+		{-1, 30, 0},
+		{60, 30, 60 * 24 * time.Hour},
+		{7, 30, 30 * 24 * time.Hour},
+		{7, 0, defaultDeletedMessageRetentionDays * 24 * time.Hour},
+	}
+	for _, tt := range tests {
+		c := &IMClient{Main: &IMConnector{Config: IMConfig{OrphanedMessageCleanupDays: tt.days, DeletedMessageRetentionDays: tt.retentionDays}}}
+		if got := c.orphanedMessageCleanupAge(); got != tt.want {
+			t.Errorf("orphanedMessageCleanupAge(%d, retention %d) = %v, want %v", tt.days, tt.retentionDays, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2024 Ludvig Rhodin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+package connector
+
+// Per-portal CloudKit upserts (cloudkit_upsert_by_portal).
+//
+// A CloudKit message page mixes messages from many chats, and
+// upsertMessageBatch writes it as one flat transaction, interleaving
+// portals in cloud_message's portal indexes. With the option on,
+// ingestCloudMessages writes each page as one transaction per portal
+// instead, and counts the new messages imported for each portal.
+// createPortalsFromCloudSync then queues the portals with the most new
+// messages first, ahead of the newest-message order it otherwise uses.
+// Duplicate GUIDs are resolved across the whole page before grouping, so
+// the rows written are the same either way.
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// dedupCloudMessageRows drops rows without a GUID and keeps the newest row
+// per GUID, in order of first appearance. CloudKit can occasionally return
+// duplicate GUID entries within a fetch window.
+func dedupCloudMessageRows(rows []cloudMessageRow) []cloudMessageRow {
+	rowsByGUID := make(map[string]int, len(rows))
+	deduped := make([]cloudMessageRow, 0, len(rows))
+	for _, row := range rows {
+		if row.GUID == "" {
+			continue
+		}
+		if i, ok := rowsByGUID[row.GUID]; !ok {
+			rowsByGUID[row.GUID] = len(deduped)
+			deduped = append(deduped, row)
+		} else if row.TimestampMS >= deduped[i].TimestampMS {
+			deduped[i] = row
+		}
+	}
+	return deduped
+}
+
+// groupCloudRowsByPortal splits rows into one batch per portal, in order of
+// each portal's first row and keeping the rows' order within a portal.
+func groupCloudRowsByPortal(rows []cloudMessageRow) [][]cloudMessageRow {
+	index := make(map[string]int)
+	var groups [][]cloudMessageRow
+	for _, row := range rows {
+		i, ok := index[row.PortalID]
+		if !ok {
+			i = len(groups)
+			index[row.PortalID] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], row)
+	}
+	return groups
+}
+
+// upsertCloudMessageRows writes a page of ingested rows, flat or per portal
+// depending on cloudkit_upsert_by_portal.
+func (c *IMClient) upsertCloudMessageRows(ctx context.Context, rows []cloudMessageRow) error {
+	if !c.Main.Config.CloudKitUpsertByPortal {
+		return c.cloudStore.upsertMessageBatch(ctx, rows)
+	}
+	for _, group := range groupCloudRowsByPortal(dedupCloudMessageRows(rows)) {
+		if err := c.cloudStore.upsertMessageBatch(ctx, group); err != nil {
+			return fmt.Errorf("portal %s: %w", group[0].PortalID, err)
+		}
+	}
+	return nil
+}
+
+// cloudPortalImports counts new messages imported per portal between
+// portal creation passes. The zero value is ready to use.
+type cloudPortalImports struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func (p *cloudPortalImports) add(portalID string, n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.counts == nil {
+		p.counts = make(map[string]int)
+	}
+	p.counts[portalID] += n
+}
+
+// drain returns the counts and starts over.
+func (p *cloudPortalImports) drain() map[string]int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	counts := p.counts
+	p.counts = nil
+	return counts
+}
+
+// prioritizePortalsByImports orders portals with more newly imported
+// messages first. Portals with the same count, including those with none,
+// keep their order.
+func prioritizePortalsByImports(portalIDs []string, imported map[string]int) {
+	if len(imported) == 0 {
+		return
+	}
+	sort.SliceStable(portalIDs, func(i, j int) bool {
+		return imported[portalIDs[i]] > imported[portalIDs[j]]
+	})
+}
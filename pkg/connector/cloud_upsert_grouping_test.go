@@ -0,0 +1,135 @@
+package connector
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridgev2"
+)
+
+func testCloudRow(guid, portalID string, ts int64) cloudMessageRow {
+	return cloudMessageRow{GUID: guid, PortalID: portalID, TimestampMS: ts, Text: guid}
+}
+
+func TestDedupCloudMessageRows(t *testing.T) {
+	rows := []cloudMessageRow{
+		testCloudRow("a", "tel:+1", 1),
+		testCloudRow("", "tel:+1", 2),
+		testCloudRow("b", "tel:+2", 3),
+		testCloudRow("a", "tel:+1", 5),
+		testCloudRow("b", "tel:+2", 2),
+	}
+	want := []cloudMessageRow{testCloudRow("a", "tel:+1", 5), testCloudRow("b", "tel:+2", 3)}
+	if got := dedupCloudMessageRows(rows); !reflect.DeepEqual(got, want) {
+		t.Errorf("dedupCloudMessageRows() = %v, want %v", got, want)
+	}
+}
+
+func TestGroupCloudRowsByPortal(t *testing.T) {
+	tests := []struct {
+		name string
+		rows []cloudMessageRow
+		want [][]cloudMessageRow
+	}{
+		{"empty", nil, nil},
+		{
+			"interleaved portals",
+			[]cloudMessageRow{
+				testCloudRow("a1", "tel:+1", 1),
+				testCloudRow("b1", "tel:+2", 2),
+				testCloudRow("a2", "tel:+1", 3),
+				testCloudRow("c1", "gid:x", 4),
+				testCloudRow("b2", "tel:+2", 5),
+			},
+			[][]cloudMessageRow{
+				{testCloudRow("a1", "tel:+1", 1), testCloudRow("a2", "tel:+1", 3)},
+				{testCloudRow("b1", "tel:+2", 2), testCloudRow("b2", "tel:+2", 5)},
+				{testCloudRow("c1", "gid:x", 4)},
+			},
+		},
+	}
+	for _, tt := range tests {
+		if got := groupCloudRowsByPortal(tt.rows); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("groupCloudRowsByPortal(%s) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestUpsertCloudMessageRowsByPortal(t *testing.T) {
+	// The same GUID in two portals (a message moved between chats) must end
+	// up with the newest row either way, not whichever portal was written last.
+	rows := []cloudMessageRow{
+		testCloudRow("a1", "tel:+1", 1),
+		testCloudRow("m", "tel:+2", 9),
+		testCloudRow("b1", "tel:+2", 2),
+		testCloudRow("a2", "tel:+1", 3),
+		testCloudRow("m", "tel:+1", 4),
+	}
+	ctx := context.Background()
+	results := make(map[bool]map[string]string)
+	for _, byPortal := range []bool{false, true} {
+		c := &IMClient{
+			Main:       &IMConnector{Config: IMConfig{CloudKitUpsertByPortal: byPortal}},
+			UserLogin:  &bridgev2.UserLogin{Log: zerolog.Nop()},
+			cloudStore: newTestCloudStore(t),
+		}
+		if err := c.upsertCloudMessageRows(ctx, rows); err != nil {
+			t.Fatalf("upsertCloudMessageRows(byPortal %v) error = %v", byPortal, err)
+		}
+		dbRows, err := c.cloudStore.db.Query(ctx, `SELECT guid, portal_id FROM cloud_message`)
+		if err != nil {
+			t.Fatalf("query cloud_message: %v", err)
+		}
+		got := make(map[string]string)
+		for dbRows.Next() {
+			var guid, portalID string
+			if err = dbRows.Scan(&guid, &portalID); err != nil {
+				t.Fatalf("scan cloud_message: %v", err)
+			}
+			got[guid] = portalID
+		}
+		_ = dbRows.Close()
+		results[byPortal] = got
+	}
+	want := map[string]string{"a1": "tel:+1", "a2": "tel:+1", "b1": "tel:+2", "m": "tel:+2"}
+	for byPortal, got := range results {
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("upsertCloudMessageRows(byPortal %v) stored %v, want %v", byPortal, got, want)
+		}
+	}
+}
+
+func TestPrioritizePortalsByImports(t *testing.T) {
+	tests := []struct {
+		name     string
+		portals  []string
+		imported map[string]int
+		want     []string
+	}{
+		{"no imports", []string{"a", "b", "c"}, nil, []string{"a", "b", "c"}},
+		{"most imports first", []string{"a", "b", "c"}, map[string]int{"b": 2, "c": 7}, []string{"c", "b", "a"}},
+		{"ties keep order", []string{"a", "b", "c", "d"}, map[string]int{"b": 3, "d": 3}, []string{"b", "d", "a", "c"}},
+	}
+	for _, tt := range tests {
+		got := append([]string(nil), tt.portals...)
+		prioritizePortalsByImports(got, tt.imported)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("prioritizePortalsByImports(%s) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCloudPortalImports(t *testing.T) {
+	var imports cloudPortalImports
+	imports.add("a", 2)
+	imports.add("b", 1)
+	imports.add("a", 3)
+	if got, want := imports.drain(), map[string]int{"a": 5, "b": 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("drain() = %v, want %v", got, want)
+	}
+	if got := imports.drain(); len(got) != 0 {
+		t.Errorf("drain() after drain = %v, want empty", got)
+	}
+}
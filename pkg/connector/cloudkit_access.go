@@ -0,0 +1,104 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2024 Ludvig Rhodin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+package connector
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridgev2/status"
+)
+
+// CloudKit Messages access test (cloudkit_access_test).
+//
+// CloudKit history sync only works when Messages in iCloud is enabled for
+// the account. Without it every sync page fails, the controller retries
+// forever, and the user never learns why no history shows up. Before the
+// bootstrap sync, the controller asks rustpush whether the Messages zones
+// are reachable. If they plainly aren't, cloud sync is skipped for this
+// session, real-time messages go on as without CloudKit, and a warning
+// rides on the connected bridge state. Any other failure may be transient
+// and sync goes ahead with its usual retries.
+
+const cloudKitUnavailableErrorCode status.BridgeStateErrorCode = "im-cloudkit-unavailable"
+
+// cloudKitAccess is the outcome of the access test.
+type cloudKitAccess int
+
+const (
+	cloudKitAccessOK cloudKitAccess = iota
+	// cloudKitAccessUnknown: the test failed for a reason that may pass on
+	// retry (network, auth refresh, a Rust panic).
+	cloudKitAccessUnknown
+	// cloudKitAccessUnavailable: Messages in iCloud isn't enabled.
+	cloudKitAccessUnavailable
+)
+
+// classifyCloudKitAccessTest maps the TestCloudMessages error to an outcome.
+// CloudKit reports a disabled Messages in iCloud as missing or deleted
+// Messages zones, which is all that's treated as unavailable.
+func classifyCloudKitAccessTest(err error) cloudKitAccess {
+	if err == nil {
+		return cloudKitAccessOK
+	}
+	msg := strings.ToLower(err.Error())
+	for _, marker := range []string{"zonenotfound", "zone not found", "userdeletedzone", "messages in icloud", "not enabled"} {
+		if strings.Contains(msg, marker) {
+			return cloudKitAccessUnavailable
+		}
+	}
+	return cloudKitAccessUnknown
+}
+
+// skipCloudSync reports whether the sync controller should stop after the
+// access test: only when the test is enabled and found no access.
+func skipCloudSync(testEnabled bool, access cloudKitAccess) bool {
+	return testEnabled && access == cloudKitAccessUnavailable
+}
+
+// safeTestCloudMessages runs TestCloudMessages, converting a Rust panic to
+// an error.
+func (c *IMClient) safeTestCloudMessages() (result string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("TestCloudMessages panicked: %v", r)
+		}
+	}()
+	return c.client.TestCloudMessages()
+}
+
+// checkCloudKitAccess runs the access test and reports whether CloudKit
+// sync should go ahead.
+func (c *IMClient) checkCloudKitAccess(log zerolog.Logger) bool {
+	if !c.Main.Config.CloudKitAccessTest {
+		return true
+	}
+	result, err := c.safeTestCloudMessages()
+	access := classifyCloudKitAccessTest(err)
+	switch access {
+	case cloudKitAccessOK:
+		log.Info().Str("result", result).Msg("CloudKit Messages access test passed")
+	case cloudKitAccessUnknown:
+		log.Warn().Err(err).Msg("CloudKit Messages access test failed, syncing anyway")
+	case cloudKitAccessUnavailable:
+		log.Warn().Err(err).Msg("Messages in iCloud is not enabled for this account, skipping CloudKit sync")
+	}
+	if !skipCloudSync(c.Main.Config.CloudKitAccessTest, access) {
+		return true
+	}
+	if prev := c.UserLogin.BridgeState.GetPrev(); prev.StateEvent == status.StateConnected {
+		c.UserLogin.BridgeState.Send(status.BridgeState{
+			StateEvent: status.StateConnected,
+			Error:      cloudKitUnavailableErrorCode,
+			Message:    "iCloud Messages in the Cloud not enabled — history sync unavailable",
+		})
+	}
+	return false
+}
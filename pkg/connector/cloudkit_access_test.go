@@ -0,0 +1,46 @@
+package connector
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestClassifyCloudKitAccessTest(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want cloudKitAccess
+	}{
+		{"passed", nil, cloudKitAccessOK},
+		{"zone missing", errors.New("CloudKit error: ZoneNotFound (messageManateeZone)"), cloudKitAccessUnavailable},
+		{"zone deleted", errors.New("UserDeletedZone"), cloudKitAccessUnavailable},
+		{"not enabled", errors.New("Messages in iCloud not enabled"), cloudKitAccessUnavailable},
+		{"network", errors.New("connection reset by peer"), cloudKitAccessUnknown},
+		{"panic", errors.New("TestCloudMessages panicked: Operation UUID has no response?"), cloudKitAccessUnknown},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := classifyCloudKitAccessTest(tt.err); got != tt.want {
+				t.Errorf("classifyCloudKitAccessTest() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSkipCloudSync(t *testing.T) {
+	tests := []struct {
+		testEnabled bool
+		access      cloudKitAccess
+		want        bool
+	}{
+		{true, cloudKitAccessOK, false},
+		{true, cloudKitAccessUnknown, false},
+		{true, cloudKitAccessUnavailable, true},
+		{false, cloudKitAccessUnavailable, false},
+	}
+	for _, tt := range tests {
+		if got := skipCloudSync(tt.testEnabled, tt.access); got != tt.want {
+			t.Errorf("skipCloudSync(%v, %v) = %v, want %v", tt.testEnabled, tt.access, got, tt.want)
+		}
+	}
+}
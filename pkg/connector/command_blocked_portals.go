@@ -0,0 +1,251 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2024 Ludvig Rhodin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package connector
+
+// list-blocked-portals / unblock-portal — admin escape hatch for the deleted
+// chat resurrection guard.
+//
+// A deleted chat is kept from coming back by two things: the soft-deleted
+// cloud_chat/cloud_message rows (persisted, consulted by hasMessageUUID and
+// listDeletedPortalIDs) and the in-memory recentlyDeletedPortals entry. Both
+// are intentional, but when they misfire — e.g. a contact starts a genuinely
+// new conversation that keeps getting dropped as an echo — there was no way
+// to see or clear them short of editing the database. The same goes for a
+// deletion from Apple still waiting out cloud_delete_grace_minutes in
+// pending_cloud_deletion, so those are listed and cleared here too.
+//
+// Flow:
+//   !im list-blocked-portals
+//   → Lists every portal held back by either guard or pending deletion
+//   !im unblock-portal tel:+15551234567
+//   → Clears both guards and the pending deletion; the next message creates
+//     a fresh portal
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"maunium.net/go/mautrix/bridgev2/commands"
+)
+
+// blockedPortal is one portal held back by the resurrection guard.
+type blockedPortal struct {
+	PortalID string
+	Name     string
+	// Messages is the number of soft-deleted cloud_message rows kept for
+	// echo detection.
+	Messages int
+	// Persisted is true when the portal has soft-deleted cloud_chat rows.
+	Persisted bool
+	// Tracked is true when the portal is in recentlyDeletedPortals;
+	// DeletedAt is when that entry was added.
+	Tracked   bool
+	DeletedAt time.Time
+	// PendingDeletion is true when the chat's deletion from Apple is still
+	// waiting out the grace period; DeletionDue is when it runs.
+	PendingDeletion bool
+	DeletionDue     time.Time
+}
+
+// collectBlockedPortals merges the persisted soft-deleted portals, the
+// in-memory recentlyDeletedPortals entries and the pending deletions from
+// Apple into one list sorted by portal ID.
+func collectBlockedPortals(persisted []softDeletedPortal, tracked map[string]deletedPortalEntry, pending []pendingCloudDeletion) []blockedPortal {
+	byID := make(map[string]*blockedPortal, len(persisted)+len(tracked)+len(pending))
+	get := func(portalID string) *blockedPortal {
+		if bp, ok := byID[portalID]; ok {
+			return bp
+		}
+		bp := &blockedPortal{PortalID: portalID}
+		byID[portalID] = bp
+		return bp
+	}
+	for _, p := range persisted {
+		bp := get(p.PortalID)
+		bp.Persisted = true
+		bp.Messages = p.Count
+	}
+	for portalID, entry := range tracked {
+		bp := get(portalID)
+		bp.Tracked = true
+		bp.DeletedAt = entry.deletedAt
+	}
+	for _, d := range pending {
+		bp := get(d.PortalID)
+		bp.PendingDeletion = true
+		bp.DeletionDue = time.UnixMilli(d.DueTS)
+	}
+	out := make([]blockedPortal, 0, len(byID))
+	for _, bp := range byID {
+		out = append(out, *bp)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].PortalID < out[j].PortalID })
+	return out
+}
+
+// formatBlockedPortals renders the list-blocked-portals reply.
+func formatBlockedPortals(portals []blockedPortal, now time.Time) string {
+	if len(portals) == 0 {
+		return "No blocked portals."
+	}
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("**Blocked portals (%d)**\n\n", len(portals)))
+	for i, bp := range portals {
+		sb.WriteString(fmt.Sprintf("%d. `%s`", i+1, bp.PortalID))
+		if bp.Name != "" {
+			sb.WriteString(fmt.Sprintf(" %q", bp.Name))
+		}
+		var sources []string
+		if bp.Persisted {
+			sources = append(sources, fmt.Sprintf("deleted in DB, %d echo rows", bp.Messages))
+		}
+		if bp.Tracked {
+			sources = append(sources, fmt.Sprintf("recently deleted %s ago", now.Sub(bp.DeletedAt).Round(time.Minute)))
+		}
+		if bp.PendingDeletion {
+			sources = append(sources, fmt.Sprintf("deletion from Apple due in %s", max(bp.DeletionDue.Sub(now), 0).Round(time.Minute)))
+		}
+		sb.WriteString(" — " + strings.Join(sources, "; ") + "\n")
+	}
+	sb.WriteString("\nUse `$cmdprefix unblock-portal <portal ID>` to let the next message create a fresh portal and cancel a pending deletion from Apple.")
+	return sb.String()
+}
+
+var cmdListBlockedPortals = &commands.FullHandler{
+	Name:    "list-blocked-portals",
+	Aliases: []string{"blocked-portals"},
+	Func:    fnListBlockedPortals,
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionAdmin,
+		Description: "List deleted chats that are being kept from coming back (echo suppression / resurrection guard) or are waiting to be deleted from Apple.",
+	},
+	RequiresAdmin: true,
+	RequiresLogin: true,
+}
+
+var cmdUnblockPortal = &commands.FullHandler{
+	Name: "unblock-portal",
+	Func: fnUnblockPortal,
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionAdmin,
+		Description: "Clear the deleted-chat guard and any pending deletion from Apple for a portal so the next message creates a fresh portal.",
+		Args:        "<portal ID>",
+	},
+	RequiresAdmin: true,
+	RequiresLogin: true,
+}
+
+func fnListBlockedPortals(ce *commands.Event) {
+	login := ce.User.GetDefaultLogin()
+	if login == nil {
+		ce.Reply("Not logged in.")
+		return
+	}
+	client, ok := login.Client.(*IMClient)
+	if !ok || client == nil {
+		ce.Reply("Bridge client not available.")
+		return
+	}
+
+	var persisted []softDeletedPortal
+	var pending []pendingCloudDeletion
+	if client.cloudStore != nil {
+		var err error
+		persisted, err = client.cloudStore.listSoftDeletedPortals(ce.Ctx)
+		if err != nil {
+			ce.Reply("Failed to list deleted portals: %v", err)
+			return
+		}
+		pending, err = client.cloudStore.listPendingCloudDeletions(ce.Ctx)
+		if err != nil {
+			ce.Reply("Failed to list pending deletions from Apple: %v", err)
+			return
+		}
+	}
+	client.recentlyDeletedPortalsMu.RLock()
+	tracked := make(map[string]deletedPortalEntry, len(client.recentlyDeletedPortals))
+	for portalID, entry := range client.recentlyDeletedPortals {
+		tracked[portalID] = entry
+	}
+	client.recentlyDeletedPortalsMu.RUnlock()
+
+	portals := collectBlockedPortals(persisted, tracked, pending)
+	if client.cloudStore != nil {
+		for i := range portals {
+			portals[i].Name, _ = client.cloudStore.getDisplayNameByPortalID(ce.Ctx, portals[i].PortalID)
+		}
+	}
+	ce.Reply(formatBlockedPortals(portals, time.Now()))
+}
+
+func fnUnblockPortal(ce *commands.Event) {
+	if len(ce.Args) != 1 {
+		ce.Reply("**Usage:** `$cmdprefix unblock-portal <portal ID>`\n\nSee `$cmdprefix list-blocked-portals` for the IDs.")
+		return
+	}
+	portalID := strings.TrimSpace(ce.Args[0])
+
+	login := ce.User.GetDefaultLogin()
+	if login == nil {
+		ce.Reply("Not logged in.")
+		return
+	}
+	client, ok := login.Client.(*IMClient)
+	if !ok || client == nil {
+		ce.Reply("Bridge client not available.")
+		return
+	}
+
+	client.recentlyDeletedPortalsMu.Lock()
+	_, wasTracked := client.recentlyDeletedPortals[portalID]
+	delete(client.recentlyDeletedPortals, portalID)
+	client.recentlyDeletedPortalsMu.Unlock()
+
+	var chats, messages int64
+	var wasPending bool
+	if client.cloudStore != nil {
+		var err error
+		chats, messages, err = client.cloudStore.clearDeletedPortal(ce.Ctx, portalID)
+		if err != nil {
+			ce.Reply("Failed to clear deleted state for `%s`: %v", portalID, err)
+			return
+		}
+		wasPending, err = client.cloudStore.cancelPendingCloudDeletion(ce.Ctx, portalID)
+		if err != nil {
+			ce.Reply("Failed to cancel the pending deletion from Apple for `%s`: %v", portalID, err)
+			return
+		}
+	}
+	if !wasTracked && !wasPending && chats == 0 && messages == 0 {
+		ce.Reply("`%s` is not blocked.", portalID)
+		return
+	}
+	ce.Log.Info().
+		Str("portal_id", portalID).
+		Bool("was_tracked", wasTracked).
+		Bool("was_pending_deletion", wasPending).
+		Int64("chat_rows", chats).
+		Int64("message_rows", messages).
+		Msg("Unblocked deleted portal")
+	reply := fmt.Sprintf("Unblocked `%s` (removed %d chat and %d echo-detection rows). The next message will create a fresh portal.", portalID, chats, messages)
+	if wasPending {
+		reply += " The pending deletion from Apple was cancelled."
+	}
+	ce.Reply(reply)
+}
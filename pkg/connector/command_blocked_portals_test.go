@@ -0,0 +1,90 @@
+package connector
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFormatBlockedPortals(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	portals := collectBlockedPortals(
+		[]softDeletedPortal{
+			{PortalID: "tel:+15550000002", Count: 12},
+			{PortalID: "gid:abc", Count: 0},
+		},
+		map[string]deletedPortalEntry{
+			"tel:+15550000002": {deletedAt: now.Add(-90 * time.Minute)},
+			"tel:+15550000001": {deletedAt: now.Add(-5 * time.Minute)},
+		},
+		[]pendingCloudDeletion{
+			{PortalID: "tel:+15550000001", DueTS: now.Add(25 * time.Minute).UnixMilli()},
+			{PortalID: "tel:+15550000003", DueTS: now.Add(-time.Minute).UnixMilli()},
+		},
+	)
+	portals[0].Name = "Book Club"
+
+	got := formatBlockedPortals(portals, now)
+	wantLines := []string{
+		"**Blocked portals (4)**",
+		"1. `gid:abc` \"Book Club\" — deleted in DB, 0 echo rows",
+		"2. `tel:+15550000001` — recently deleted 5m0s ago; deletion from Apple due in 25m0s",
+		"3. `tel:+15550000002` — deleted in DB, 12 echo rows; recently deleted 1h30m0s ago",
+		"4. `tel:+15550000003` — deletion from Apple due in 0s",
+		"unblock-portal",
+	}
+	for _, want := range wantLines {
+		if !strings.Contains(got, want) {
+			t.Errorf("formatBlockedPortals() missing %q in:\n%s", want, got)
+		}
+	}
+}
+
+func TestFormatBlockedPortals_Empty(t *testing.T) {
+	if got := formatBlockedPortals(nil, time.Now()); got != "No blocked portals." {
+		t.Errorf("formatBlockedPortals(nil) = %q, want %q", got, "No blocked portals.")
+	}
+}
+
+func TestClearDeletedPortal(t *testing.T) {
+	ctx := context.Background()
+	store := newTestCloudStore(t)
+	nowMS := time.Now().UnixMilli()
+	for _, portalID := range []string{"tel:+15550000001", "tel:+15550000002"} {
+		if _, err := store.db.Exec(ctx,
+			`INSERT INTO cloud_chat (login_id, cloud_chat_id, portal_id, deleted, created_ts) VALUES ($1, $2, $2, TRUE, $3)`,
+			store.loginID, portalID, nowMS,
+		); err != nil {
+			t.Fatalf("insert cloud_chat: %v", err)
+		}
+		if err := store.persistMessageUUID(ctx, "msg-"+portalID, portalID, nowMS, false); err != nil {
+			t.Fatalf("persistMessageUUID: %v", err)
+		}
+		if err := store.deleteLocalChatByPortalID(ctx, portalID); err != nil {
+			t.Fatalf("deleteLocalChatByPortalID: %v", err)
+		}
+	}
+
+	chats, messages, err := store.clearDeletedPortal(ctx, "tel:+15550000001")
+	if err != nil {
+		t.Fatalf("clearDeletedPortal() error = %v", err)
+	}
+	if chats != 1 || messages != 1 {
+		t.Errorf("clearDeletedPortal() = (%d, %d), want (1, 1)", chats, messages)
+	}
+
+	deleted, err := store.listDeletedPortalIDs(ctx)
+	if err != nil {
+		t.Fatalf("listDeletedPortalIDs() error = %v", err)
+	}
+	if len(deleted) != 1 || deleted[0] != "tel:+15550000002" {
+		t.Errorf("listDeletedPortalIDs() = %v, want [tel:+15550000002]", deleted)
+	}
+	if known, _ := store.hasMessageUUID(ctx, "msg-tel:+15550000001"); known {
+		t.Error("unblocked portal's echo-detection row should be gone")
+	}
+	if known, _ := store.hasMessageUUID(ctx, "msg-tel:+15550000002"); !known {
+		t.Error("other portal's echo-detection row should be kept")
+	}
+}
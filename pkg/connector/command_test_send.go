@@ -0,0 +1,153 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2024 Ludvig Rhodin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+package connector
+
+// test-send — admin diagnostic for delivery problems.
+//
+// Telling whether a message goes missing because of the room, the portal's
+// state or Apple's side took creating a chat and sending into it. test-send
+// skips the bridge's own state entirely: it runs the IDS lookup for the
+// identifier, sends one message straight to it from the default handle,
+// and replies with the message's UUID, or with the error and what it means.
+// No portal is created; one only appears if the recipient replies.
+//
+// Flow:
+//   !im test-send +15551234567 hello
+//   → Validates the target, sends, replies with the UUID or the error
+
+import (
+	"fmt"
+	"strings"
+
+	"maunium.net/go/mautrix/bridgev2/commands"
+
+	"github.com/lrhodin/imessage/pkg/rustpushgo"
+)
+
+// testSendClient is the part of the rustpush client test-send uses.
+type testSendClient interface {
+	ValidateTargets(targets []string, handle string) []string
+	SendMessage(conversation rustpushgo.WrappedConversation, text string, html *string, handle string, replyGuid *string, replyPart *string, scheduledMs *uint64) (string, error)
+}
+
+// testSendResult is the outcome of a test send. Sent is false when the
+// target didn't validate, in which case nothing was sent.
+type testSendResult struct {
+	Target string
+	Valid  bool
+	Sent   bool
+	UUID   string
+	Err    error
+}
+
+// runTestSend validates target from handle and, if it's reachable on
+// iMessage, sends text to it. ValidateTargets and SendMessage cross into
+// the FFI path, which has reachable panic sites upstream, so a panic is
+// turned into the result's error.
+func runTestSend(client testSendClient, handle, target, text string) (res testSendResult) {
+	res.Target = target
+	defer func() {
+		if r := recover(); r != nil {
+			res.Err = fmt.Errorf("panicked in FFI path: %v", r)
+		}
+	}()
+	if len(client.ValidateTargets([]string{target}, handle)) == 0 {
+		return res
+	}
+	res.Valid = true
+	conv := rustpushgo.WrappedConversation{Participants: []string{handle, target}}
+	res.UUID, res.Err = client.SendMessage(conv, text, nil, handle, nil, nil, nil)
+	res.Sent = res.Err == nil
+	return res
+}
+
+// describeTestSendError explains a send error for the test-send reply.
+func describeTestSendError(err error) string {
+	switch {
+	case isNoValidTargetsError(err):
+		return "the recipient has no devices that can receive iMessage (NoValidTargets)"
+	case isLikelyDeliveredSendTimeout(err):
+		return "timed out waiting for Apple's ACK; the message may still have been delivered"
+	case isNonRetryableResourceClosed(err):
+		return "the identity manager shut down; the bridge needs to reconnect before anything can be sent"
+	case classifyCredentialFailure(err) == credentialFailureKeystore:
+		return "the signing keys are gone; log in again"
+	case classifyCredentialFailure(err) == credentialFailureAppleID:
+		return "Apple rejected the account (password changed or account locked); log in again"
+	default:
+		return "unrecognized error (" + sendErrorReason(err) + ")"
+	}
+}
+
+// formatTestSendResult renders the test-send reply.
+func formatTestSendResult(res testSendResult) string {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("**test-send: `%s`**\n\n", res.Target))
+	switch {
+	case res.Err != nil && !res.Valid:
+		sb.WriteString(fmt.Sprintf("❌ IDS lookup failed: %v", res.Err))
+	case !res.Valid:
+		sb.WriteString("❌ Not reachable on iMessage (ValidateTargets returned nothing), nothing was sent.")
+	case res.Err != nil:
+		sb.WriteString("✓ Reachable on iMessage\n")
+		sb.WriteString(fmt.Sprintf("❌ Send failed: %s\n\n`%v`", describeTestSendError(res.Err), res.Err))
+	default:
+		sb.WriteString("✓ Reachable on iMessage\n")
+		sb.WriteString(fmt.Sprintf("✓ Sent, UUID `%s`", res.UUID))
+	}
+	return sb.String()
+}
+
+var cmdTestSend = &commands.FullHandler{
+	Name: "test-send",
+	Func: fnTestSend,
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionAdmin,
+		Description: "Send a one-off iMessage to a phone number or email without creating a chat, and report the UUID or the decoded error.",
+		Args:        "<phone-or-email> <message>",
+	},
+	RequiresAdmin: true,
+	RequiresLogin: true,
+}
+
+func fnTestSend(ce *commands.Event) {
+	if len(ce.Args) < 2 {
+		ce.Reply("Usage: `$cmdprefix test-send <phone-or-email> <message>`")
+		return
+	}
+	login := ce.User.GetDefaultLogin()
+	if login == nil {
+		ce.Reply("Not logged in.")
+		return
+	}
+	client, ok := login.Client.(*IMClient)
+	if !ok || client == nil || client.client == nil {
+		ce.Reply("Bridge client not available.")
+		return
+	}
+	if client.handle == "" {
+		ce.Reply("No iMessage handle configured. Please complete bridge setup first.")
+		return
+	}
+	target := normalizeIdentifierForPortalID(ce.Args[0])
+	if target == "" || strings.HasPrefix(target, "gid:") {
+		ce.Reply("Could not normalise %q as a phone number or email.", ce.Args[0])
+		return
+	}
+	text := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(ce.RawArgs), ce.Args[0]))
+
+	res := runTestSend(client.client, client.handle, target, text)
+	log := ce.Log.With().Str("target", target).Bool("valid", res.Valid).Logger()
+	if res.Err != nil {
+		log.Warn().Err(res.Err).Msg("test-send failed")
+	} else {
+		log.Info().Str("uuid", res.UUID).Msg("test-send finished")
+	}
+	ce.Reply(formatTestSendResult(res))
+}
@@ -0,0 +1,97 @@
+package connector
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/lrhodin/imessage/pkg/rustpushgo"
+)
+
+type fakeTestSendClient struct {
+	valid    []string
+	uuid     string
+	err      error
+	panicMsg string
+
+	validated []string
+	sent      []rustpushgo.WrappedConversation
+	text      string
+}
+
+func (f *fakeTestSendClient) ValidateTargets(targets []string, handle string) []string {
+	if f.panicMsg != "" {
+		panic(f.panicMsg)
+	}
+	f.validated = append(f.validated, targets...)
+	return f.valid
+}
+
+func (f *fakeTestSendClient) SendMessage(conv rustpushgo.WrappedConversation, text string, html *string, handle string, replyGuid *string, replyPart *string, scheduledMs *uint64) (string, error) {
+	f.sent = append(f.sent, conv)
+	f.text = text
+	return f.uuid, f.err
+}
+
+func TestRunTestSend(t *testing.T) {
+	const handle = "tel:+15550000000"
+	const target = "tel:+15551234567"
+	tests := []struct {
+		name      string
+		client    *fakeTestSendClient
+		wantValid bool
+		wantSent  bool
+		wantUUID  string
+		wantErr   bool
+		wantSends int
+	}{
+		{"sent", &fakeTestSendClient{valid: []string{target}, uuid: "ABC-123"}, true, true, "ABC-123", false, 1},
+		{"not on iMessage", &fakeTestSendClient{}, false, false, "", false, 0},
+		{"send failed", &fakeTestSendClient{valid: []string{target}, err: errors.New("SendTimedOut")}, true, false, "", true, 1},
+		{"lookup panicked", &fakeTestSendClient{panicMsg: "identity_manager.rs:249"}, false, false, "", true, 0},
+	}
+	for _, tt := range tests {
+		res := runTestSend(tt.client, handle, target, "hello")
+		if res.Valid != tt.wantValid || res.Sent != tt.wantSent || res.UUID != tt.wantUUID || (res.Err != nil) != tt.wantErr {
+			t.Errorf("runTestSend(%s) = %+v, want valid %v, sent %v, uuid %q, error %v", tt.name, res, tt.wantValid, tt.wantSent, tt.wantUUID, tt.wantErr)
+		}
+		if len(tt.client.sent) != tt.wantSends {
+			t.Errorf("runTestSend(%s) sent %d messages, want %d", tt.name, len(tt.client.sent), tt.wantSends)
+		}
+		if tt.wantSends > 0 {
+			if got := tt.client.sent[0].Participants; fmt.Sprint(got) != fmt.Sprint([]string{handle, target}) {
+				t.Errorf("runTestSend(%s) participants = %v, want [%s %s]", tt.name, got, handle, target)
+			}
+			if tt.client.text != "hello" {
+				t.Errorf("runTestSend(%s) text = %q, want %q", tt.name, tt.client.text, "hello")
+			}
+		}
+	}
+}
+
+func TestFormatTestSendResult(t *testing.T) {
+	tests := []struct {
+		name string
+		res  testSendResult
+		want []string
+	}{
+		{"sent", testSendResult{Target: "tel:+15551234567", Valid: true, Sent: true, UUID: "ABC-123"}, []string{"`tel:+15551234567`", "Sent, UUID `ABC-123`"}},
+		{"not on iMessage", testSendResult{Target: "mailto:a@example.com"}, []string{"Not reachable on iMessage", "nothing was sent"}},
+		{"lookup panicked", testSendResult{Err: errors.New("panicked in FFI path: boom")}, []string{"IDS lookup failed: panicked in FFI path: boom"}},
+		{"no valid targets", testSendResult{Valid: true, Err: errors.New("send: NoValidTargets")}, []string{"Reachable on iMessage", "(NoValidTargets)", "`send: NoValidTargets`"}},
+		{"timeout", testSendResult{Valid: true, Err: errors.New("Send timeout; try again")}, []string{"may still have been delivered"}},
+		{"resource closed", testSendResult{Valid: true, Err: errors.New("Resource has been closed")}, []string{"needs to reconnect"}},
+		{"keystore", testSendResult{Valid: true, Err: errors.New("Keystore error Key not found")}, []string{"signing keys are gone"}},
+		{"apple id", testSendResult{Valid: true, Err: errors.New("auth failed: -20209")}, []string{"Apple rejected the account"}},
+		{"other", testSendResult{Valid: true, Err: errors.New("message too large")}, []string{"unrecognized error (too_large)"}},
+	}
+	for _, tt := range tests {
+		got := formatTestSendResult(tt.res)
+		for _, want := range tt.want {
+			if !strings.Contains(got, want) {
+				t.Errorf("formatTestSendResult(%s) = %q, want it to contain %q", tt.name, got, want)
+			}
+		}
+	}
+}
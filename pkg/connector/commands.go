@@ -70,6 +70,7 @@ func BridgeCommands(disableFaceTime bool) []*commands.FullHandler {
 		cmdStartChat,
 		cmdResolveIdentifierRedirect,
 		cmdLogout,
+		cmdLoginMatrix,
 		cmdRestoreChat,
 		cmdRestoreDebug,
 		cmdMsgDebug,
@@ -77,7 +78,23 @@ func BridgeCommands(disableFaceTime bool) []*commands.FullHandler {
 		cmdSetCardDAV,
 		cmdSetVideoTranscoding,
 		cmdSetHEICConversion,
+		cmdSetRegion,
 		cmdClearIdentityCache,
+		cmdListBlockedPortals,
+		cmdUnblockPortal,
+		cmdOrphanPortals,
+		cmdSyncStatus,
+		cmdSendAsSMS,
+		cmdBlockSender,
+		cmdReportJunk,
+		cmdUnblockSender,
+		cmdGroupMembers,
+		cmdResolve,
+		cmdSetHandle,
+		cmdDownload,
+		cmdSearch,
+		cmdRotateHardwareKey,
+		cmdTestSend,
 	}
 	if !disableFaceTime {
 		cmds = append(cmds,
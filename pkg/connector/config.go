@@ -24,6 +24,14 @@ type IMConfig struct {
 	DisplaynameTemplate string `yaml:"displayname_template"`
 	displaynameTemplate *template.Template
 
+	// NicknamePrecedence decides between a contact's nickname and their
+	// formal (first/last) name when both are set:
+	//   - "nickname": the nickname is the display name.
+	//   - "formal": the first/last name is; the nickname is only used by
+	//     displayname_template for contacts without one.
+	//   - "" (the default): displayname_template alone decides.
+	NicknamePrecedence string `yaml:"nickname_precedence"`
+
 	// CloudKitBackfill enables message history backfill (master on/off switch).
 	// When false, the bridge only handles real-time messages via APNs push
 	// and skips the device PIN / iCloud Keychain steps during login.
@@ -49,6 +57,13 @@ type IMConfig struct {
 	// converting HEIC/HEIF images. Default is 95.
 	HEICJPEGQuality int `yaml:"heic_jpeg_quality"`
 
+	// HideMediaFilenames leaves the body of image, video and audio
+	// attachments empty instead of repeating the file name, which for
+	// auto-named files like IMG_1234.HEIC is noise some clients show as a
+	// caption. The name is kept as the event's filename, and generic files
+	// keep it as their body. Default is false.
+	HideMediaFilenames bool `yaml:"hide_media_filenames"`
+
 	// MaxAttachmentSizeMB is the maximum attachment size to bridge, in MB.
 	// Attachments larger than this are skipped entirely — not downloaded,
 	// transcoded, or uploaded. The default 100 matches Beeper's upload limit;
@@ -59,6 +74,16 @@ type IMConfig struct {
 	// are buffered in memory while downloading. Default 100.
 	MaxAttachmentSizeMB int `yaml:"max_attachment_size_mb"`
 
+	// AttachmentDownloadRules decide which inbound attachments are uploaded
+	// to Matrix as they arrive. The first rule whose mime pattern matches
+	// wins; attachments no rule matches are always bridged. A skipped
+	// attachment is bridged as a notice placeholder that the `download`
+	// command (replying to the placeholder) replaces with the real file
+	// later. Only live attachments fetched from Apple's servers can be
+	// deferred — small attachments embedded in the message itself and
+	// backfilled history are always bridged. Empty by default.
+	AttachmentDownloadRules []AttachmentDownloadRule `yaml:"attachment_download_rules"`
+
 	// URLPreviewsInBackfill controls whether the bridge fetches link-preview
 	// metadata (og:/twitter: tags + thumbnail image) for messages that
 	// contain a URL during backfill. Each URL-bearing message triggers up to
@@ -69,6 +94,412 @@ type IMConfig struct {
 	// and outbound edits still build previews normally. Default true.
 	URLPreviewsInBackfill bool `yaml:"url_previews_in_backfill"`
 
+	// MessageServiceInBackfill records in each backfilled event whether the
+	// message was sent over SMS, RCS or iMessage, as the
+	// fi.mau.imessage.service field, so clients can keep history green or
+	// blue. Default false.
+	MessageServiceInBackfill bool `yaml:"message_service_in_backfill"`
+
+	// InitialSyncUnreadOnly replaces the count-based initial backfill with
+	// just the messages that are still unread on the Mac: for each chat,
+	// everything after the last message the user sent or read. Older history
+	// is treated as read and not bridged, and chats with nothing unread get
+	// an empty room. Only supported with backfill_source "chatdb" — CloudKit
+	// doesn't carry reliable read state. Default false.
+	InitialSyncUnreadOnly bool `yaml:"initial_sync_unread_only"`
+
+	// ChatDBExtraAttachmentRoot is an additional directory that chat.db
+	// attachment paths may resolve into, for setups where attachments were
+	// relocated (e.g. a Messages library moved to another volume and
+	// symlinked back). Paths are resolved through symlinks before being
+	// checked, so ~/Library/Messages/Attachments and StickerCache are always
+	// allowed and anything resolving elsewhere is skipped. "~/" is expanded.
+	// Empty by default.
+	ChatDBExtraAttachmentRoot string `yaml:"chatdb_extra_attachment_root"`
+
+	// ChatDBPath reads chat.db backfill from this file instead of
+	// ~/Library/Messages/chat.db — for example the sms.db from an iPhone
+	// backup (HomeDomain/Library/SMS/sms.db), which has the same schema. The
+	// file is checked to be a Messages database before use, and a custom
+	// path skips the Full Disk Access prompt since it usually lives outside
+	// the protected Messages folder. Backfill from it runs once per portal
+	// like any chat.db backfill; the file isn't expected to change. Reading
+	// chat.db needs the macOS build, so this is only used when the bridge
+	// runs on macOS, with backfill_source "chatdb" or ChatDBBackfillFallback.
+	// "~/" is expanded. Empty by default.
+	//
+	// A backup only carries text over: its sms.db refers to attachments by
+	// their on-phone paths (~/Library/SMS/Attachments/...), but the backup
+	// stores the files under hashed names, so they're bridged as
+	// "attachment unavailable" placeholders.
+	ChatDBPath string `yaml:"chatdb_path"`
+
+	// ChatDBBackfillFallback backfills portals CloudKit has no messages for
+	// from the local chat.db, when backfill_source is "cloudkit", the bridge
+	// runs on macOS and chat.db is readable (Full Disk Access, or
+	// chatdb_path). Each portal uses one source for all its backfill.
+	// Default false.
+	ChatDBBackfillFallback bool `yaml:"chatdb_backfill_fallback"`
+
+	// RelayBackfillFallback backfills portals CloudKit has no messages for
+	// from the chat.db of the Mac running the nac-relay, through the relay's
+	// /messages endpoint, when backfill_source is "cloudkit" and the hardware
+	// key points at a relay with a token. Unlike ChatDBBackfillFallback it
+	// works wherever the bridge runs, but only carries message text over.
+	// The relay needs Full Disk Access. ChatDBBackfillFallback wins when both
+	// apply. Default false.
+	RelayBackfillFallback bool `yaml:"relay_backfill_fallback"`
+
+	// DeletedMessageRetentionDays is how long soft-deleted cloud_message rows
+	// are kept for APNs echo detection before being pruned. Rows for chats
+	// that are still deleted are never pruned (their UUIDs are what keeps a
+	// stale echo from resurrecting the chat); this only bounds the rows left
+	// behind by individually deleted messages and chats that have since been
+	// revived. Zero or negative uses the default of 30 days.
+	DeletedMessageRetentionDays int `yaml:"deleted_message_retention_days"`
+
+	// AbandonedPortalCleanupDays enables the abandoned-DM janitor: DM portals
+	// whose room has had no real (non-placeholder) message for this many days
+	// since the janitor first saw them empty are deleted for the user, with
+	// the same local tombstones as a manual delete so CloudKit sync and stale
+	// APNs echoes don't bring them back. Meant for the one-off portals left
+	// behind by short-code spam and verification texts. Groups are never
+	// touched, and a portal that still has CloudKit messages waiting to be
+	// backfilled isn't considered empty. Zero or negative disables it
+	// (default).
+	AbandonedPortalCleanupDays int `yaml:"abandoned_portal_cleanup_days"`
+
+	// OrphanedMessageCleanupDays enables the orphaned cloud_message janitor:
+	// CloudKit message rows filed under a portal ID that has neither a
+	// cloud_chat row nor a Matrix portal, and that got no new rows for this
+	// many days, are pruned. Never sooner than
+	// deleted_message_retention_days, and soft-deleted rows are left to that
+	// retention. Zero or negative disables it (default).
+	OrphanedMessageCleanupDays int `yaml:"orphaned_message_cleanup_days"`
+
+	// CloudDeleteGraceMinutes delays the Apple-side part of deleting a room
+	// from Matrix (MoveToRecycleBin and deleting the CloudKit chat record,
+	// which removes the chat from all of the user's devices) by this many
+	// minutes. Restoring the chat, or the room being recreated, within that
+	// time cancels it. The bridge's own cleanup still happens right away.
+	// Zero or negative deletes immediately (default).
+	CloudDeleteGraceMinutes int `yaml:"cloud_delete_grace_minutes"`
+
+	// MessageSearchFTS keeps an SQLite FTS5 index over CloudKit message text
+	// for the search command. Needs SQLite built with FTS5; without it, or on
+	// Postgres, search scans messages with LIKE. Default false.
+	MessageSearchFTS bool `yaml:"message_search_fts"`
+
+	// RealtimeMaxAgeHours keeps messages older than this many hours out of
+	// realtime delivery. After a long disconnect APNs replays the backlog
+	// through the live path, and each replayed message would otherwise land
+	// at the bottom of its room as if new (and notify). Such messages are
+	// routed to a forward backfill of their room instead, after the unsend,
+	// echo, already-bridged and deleted-chat checks (replay_backlog.go).
+	// Zero or negative disables the cutoff (default).
+	RealtimeMaxAgeHours int `yaml:"realtime_max_age_hours"`
+
+	// QuietBootstrap keeps the initial sync from notifying for every
+	// historical message: messages backfilled before the first CloudKit
+	// sync finishes, and backward backfill, are marked
+	// fi.mau.imessage.historical, and an override push rule installed
+	// through the double puppet silences marked events. Messages bridged
+	// after bootstrap notify normally. Default false.
+	QuietBootstrap bool `yaml:"quiet_bootstrap"`
+
+	// PortalCatchUpMinutes lets activity in a room from Matrix (a read
+	// receipt, typing, a message) fetch the messages CloudKit has that are
+	// newer than the room's newest bridged message, such as ones that
+	// reached Apple while the bridge was down and never arrived live. Each
+	// room is checked at most once per this many minutes. Zero or negative
+	// disables catch-up.
+	PortalCatchUpMinutes int `yaml:"portal_catchup_minutes"`
+
+	// GroupJoinBackfillHours makes joining a group CloudKit sync doesn't
+	// know of yet (being added to it) fetch that chat's messages from this
+	// many hours before the join and backfill them into the room right
+	// away, instead of waiting for the next full sync. Zero or negative
+	// disables it.
+	GroupJoinBackfillHours int `yaml:"group_join_backfill_hours"`
+
+	// ReceiptDedupWindowSeconds suppresses repeated delivery and read
+	// receipts for the same message: APNs re-delivers receipts after
+	// reconnects, and each copy would otherwise re-send the same Matrix
+	// message status or read marker. A receipt is remembered for this many
+	// seconds once it has been bridged; read receipts are tracked per sender
+	// so each group member's receipt still comes through. Zero or negative
+	// disables suppression.
+	ReceiptDedupWindowSeconds int `yaml:"receipt_dedup_window_seconds"`
+
+	// RelayHealthCheckMinutes is how often to probe the NAC relay of an
+	// External Key login whose hardware key points at one (Apple Silicon
+	// Macs running tools/nac-relay). The relay is only used when
+	// registering with Apple, so an offline Mac otherwise goes unnoticed
+	// until registration fails; after a few failed probes in a row the
+	// login reports an "im-relay-offline" bridge state warning, cleared
+	// automatically once the relay answers again. Probes back off while the
+	// relay is unreachable. Zero or negative disables the check.
+	RelayHealthCheckMinutes int `yaml:"relay_health_check_minutes"`
+
+	// RelayDiscovery looks for the NAC relay over mDNS when the relay URL in
+	// the hardware key doesn't answer, for Macs whose LAN address changes:
+	// on connect, and (with relay_health_check_minutes) whenever a health
+	// probe fails, rebuilding the client if the relay moved. The relay must
+	// be started with -mdns, and only a relay presenting the certificate
+	// pinned in the key (relay_cert_fp) is used; keys without a pin never
+	// use discovery. The configured URL is still tried first. Default false.
+	RelayDiscovery bool `yaml:"relay_discovery"`
+
+	// NACRelayFallbackURL is a NAC relay (tools/nac-relay) to offer during
+	// login when IDS registration fails to generate NAC validation data.
+	// External Key logins are offered to retry once with their key pointed
+	// at it (the stored key keeps its own relay); Apple ID logins are asked
+	// for the hardware key of the Mac running it and sign in again as that
+	// Mac. Empty disables the offer (default).
+	NACRelayFallbackURL string `yaml:"nac_relay_fallback_url"`
+
+	// CloudKitChatDumpPath writes every chat record seen by CloudKit chat
+	// sync to this file as a JSON array, for debugging chat mapping and
+	// portal creation. Records are streamed to the file page by page as sync
+	// runs rather than collected in memory, and the file is replaced on each
+	// sync. "~/" is expanded. Empty disables the dump (default).
+	CloudKitChatDumpPath string `yaml:"cloudkit_chat_dump_path"`
+
+	// CloudKitUpsertByPortal writes each page of CloudKit messages as one
+	// transaction per portal instead of one for the whole page, keeping a
+	// portal's rows together, and queues the portals with the most newly
+	// imported messages first when creating portals. Default false.
+	CloudKitUpsertByPortal bool `yaml:"cloudkit_upsert_by_portal"`
+
+	// LongMessageLimit is the longest text message, in characters, sent to
+	// iMessage as a single message. Longer Matrix messages are handled per
+	// LongMessageMode instead of being sent as one message that Apple may
+	// reject or the recipient's device may cut short. Zero or negative
+	// disables the check.
+	LongMessageLimit int `yaml:"long_message_limit"`
+
+	// LongMessageMode is what to do with a message over LongMessageLimit:
+	//   - "split" (the default): send it as several consecutive iMessages,
+	//     breaking at paragraph, line or word boundaries where possible.
+	//     Only the first part carries the reply, and unsending the Matrix
+	//     message unsends every part.
+	//   - "attachment": send it as a single message.txt file attachment.
+	// An invalid or empty value falls back to "split".
+	LongMessageMode string `yaml:"long_message_mode"`
+
+	// RedactCloudDeletedMessages redacts the Matrix event of a message when
+	// CloudKit sync sees it deleted after it was bridged, e.g. because it
+	// was deleted in Messages on an iPhone or Mac. Deleting a message on an
+	// Apple device only removes it from that user's devices (unlike unsend,
+	// which is always bridged), so this is off by default and only mirrors
+	// your own deletions into Matrix.
+	RedactCloudDeletedMessages bool `yaml:"redact_cloud_deleted_messages"`
+
+	// FailedUploadRetryAttempts is how many times an attachment whose Matrix
+	// upload failed is retried in the background, for live messages as well
+	// as CloudKit and chat.db backfill. The downloaded bytes are kept until
+	// an upload succeeds or the attempts run out, since MMCS links expire
+	// and the file may be gone from CloudKit by then: files up to 1 MiB in
+	// the bridge database, larger ones under
+	// ~/.local/share/mautrix-imessage/failed_uploads. A notice placeholder is
+	// bridged in the meantime and edited into the attachment. 0 disables the
+	// retry, so the attachment fails as before.
+	FailedUploadRetryAttempts int `yaml:"failed_upload_retry_attempts"`
+
+	// ServerSendTimestamps replaces the bridge's clock with Apple's server
+	// timestamp in the stored timestamp of messages sent from Matrix, once
+	// their echo arrives. Keeps ordering consistent with CloudKit backfill
+	// and other devices when the bridge host's clock is skewed. When off,
+	// the time the bridge sent the message is kept.
+	ServerSendTimestamps bool `yaml:"server_send_timestamps"`
+
+	// MatrixRetentionDays redacts bridged messages from Matrix once they are
+	// this many days old, for users who don't want their history to outlive
+	// a set window on the homeserver. It's Matrix-only: nothing is deleted on
+	// Apple devices or in iCloud. A message is kept while a reaction or a
+	// reply within the window still points at it. Zero or negative disables
+	// it (default).
+	MatrixRetentionDays int `yaml:"matrix_retention_days"`
+
+	// OutboundEchoWindowSeconds is how long the UUIDs of messages sent from
+	// Matrix are remembered to recognize Apple's echo of them. The echo can
+	// arrive before bridgev2 has stored the sent message, and without this
+	// it would be bridged a second time as a message sent from another of
+	// the user's devices. Messages really sent from other devices are not
+	// affected. Zero or negative disables it.
+	OutboundEchoWindowSeconds int `yaml:"outbound_echo_window_seconds"`
+
+	// UnsendSuppressionSeconds is how long unsent message UUIDs are kept in
+	// memory to drop APNs re-deliveries of the message. Unsends are also
+	// recorded in cloud_message, which catches re-deliveries after this
+	// window, such as the replay after a long outage, and across restarts.
+	// Zero or negative leaves only the recorded check.
+	UnsendSuppressionSeconds int `yaml:"unsend_suppression_seconds"`
+
+	// SendPendingTimeoutSeconds is how long a sent message Apple reported a
+	// transient error for ("not delivered, will retry") is shown as pending
+	// before it's marked as failed. A delivery receipt in the meantime marks
+	// it delivered, a terminal error fails it right away. Zero or negative
+	// fails it on the first error, like any other.
+	SendPendingTimeoutSeconds int `yaml:"send_pending_timeout_seconds"`
+
+	// CloudFetchRecentIntervalSeconds is the minimum time between
+	// CloudFetchRecentMessages calls, which restoring recovered chats makes
+	// several of per chat. Spacing them out keeps a bulk recovery from
+	// exhausting the CloudKit request quota. Zero or negative disables the
+	// pacing. Whatever the setting, fetches pause with a growing backoff
+	// when CloudKit reports throttling.
+	CloudFetchRecentIntervalSeconds int `yaml:"cloudkit_fetch_recent_interval_seconds"`
+
+	// CloudFetchRecentMaxPerRestore caps the CloudFetchRecentMessages calls
+	// of one attempt to restore a recovered chat: the targeted fetches for
+	// each chat ID variant plus the unfiltered fallback scan. Zero or
+	// negative means no cap.
+	CloudFetchRecentMaxPerRestore int `yaml:"cloudkit_fetch_recent_max_per_restore"`
+
+	// CloudKitAccessTest checks, before the first CloudKit sync, that
+	// Messages in iCloud is enabled for the account. When it isn't, cloud
+	// sync is skipped for the session and the bridge state carries a
+	// warning, instead of every sync attempt failing and retrying silently.
+	// Inconclusive test failures don't stop the sync.
+	CloudKitAccessTest bool `yaml:"cloudkit_access_test"`
+
+	// DetectAppleIDAuthFailure watches send and connect errors for Apple ID
+	// authentication failures (the password was changed, the account was
+	// locked), which otherwise only show up as individual failed sends.
+	// When one is seen, the login goes to bad credentials with a message
+	// asking to log in again. Lost signing keys are detected separately and
+	// always. Default true.
+	DetectAppleIDAuthFailure bool `yaml:"detect_apple_id_auth_failure"`
+
+	// GhostUpdatesPerSecond paces the ghost profile updates of a bulk
+	// contact refresh, which otherwise push every changed name and avatar
+	// to Matrix at once and can hit homeserver rate limits on large address
+	// books. Zero or negative means no pacing.
+	GhostUpdatesPerSecond int `yaml:"ghost_updates_per_second"`
+
+	// MetricsListen is the address (e.g. "127.0.0.1:9119") to serve
+	// connector metrics on, in the Prometheus text format at /metrics:
+	// inbound events by type, sends and send failures, CloudKit sync imports
+	// and backfilled messages. The listener has no authentication, so bind
+	// it to localhost or a private interface. Empty disables it (default).
+	MetricsListen string `yaml:"metrics_listen"`
+
+	// ContactSyncRetryBudget is how many periodic CardDAV contact syncs may
+	// fail in a row (retried with backoff in between) before the login
+	// reports an "im-contacts-stale" bridge state warning, cleared by the
+	// next successful sync. Zero or negative disables the warning.
+	ContactSyncRetryBudget int `yaml:"contact_sync_retry_budget"`
+
+	// AutoJoinPortals joins the user to new portals through their double
+	// puppet instead of leaving an invite for each one. AutoJoinAllow, when
+	// non-empty, limits that to the chats it lists, and AutoJoinDeny
+	// excludes chats; entries are DM handles, gid: group portal IDs or
+	// group names. Excluded chats are still bridged, just as invites.
+	AutoJoinPortals bool     `yaml:"auto_join_portals"`
+	AutoJoinAllow   []string `yaml:"auto_join_allow"`
+	AutoJoinDeny    []string `yaml:"auto_join_deny"`
+
+	// ErrorNoticeRoom is the ID of a Matrix room to post bridge error
+	// notices to: failed sends, failed CloudKit syncs, the NAC relay going
+	// offline, failed connects, contact syncs that keep failing and expired
+	// double puppet tokens. The bridge bot must already be joined. Empty
+	// disables it (default).
+	ErrorNoticeRoom string `yaml:"error_notice_room"`
+
+	// SkipOutboundOnlyPortals keeps cloud sync from creating rooms for chats
+	// whose synced messages are all from the user, and MinPortalMessages
+	// (when positive) for chats with fewer synced messages than that. Such
+	// chats still get a room once a new message arrives.
+	SkipOutboundOnlyPortals bool `yaml:"skip_outbound_only_portals"`
+	MinPortalMessages       int  `yaml:"min_portal_messages"`
+
+	// SMSFallback retries an outbound message as SMS when the iMessage send
+	// fails because the recipient has no reachable iMessage devices
+	// (NoValidTargets), and marks the portal SMS so later sends go straight
+	// out as SMS. Only takes effect when an SMS relay is available — the
+	// iPhone has enabled Text Message Forwarding to the bridge or has
+	// already relayed an SMS to it (persisted per login, see
+	// UserLoginMetadata.SMSRelay). When false (or no relay is available)
+	// the failed send is reported in the room along with the
+	// `send-as-sms` command to switch the chat over manually. Default true,
+	// since older versions always retried as SMS.
+	SMSFallback bool `yaml:"sms_fallback"`
+
+	// SMSUpgradeCheckHours is how often DMs marked SMS are checked against
+	// IDS again; a contact that has since registered for iMessage gets the
+	// chat switched back to iMessage, like iOS does. Zero or negative
+	// disables the check, leaving chats SMS until the contact sends an
+	// iMessage.
+	SMSUpgradeCheckHours int `yaml:"sms_upgrade_check_hours"`
+
+	// AttachmentTransportRetry resends a DM attachment over the other
+	// transport when sending it failed: as MMS through the iPhone's SMS
+	// relay after an iMessage failure, or over iMessage after an MMS
+	// failure when the contact is reachable there. The chat keeps its
+	// transport; only that attachment (and its caption) goes the other
+	// way. Failures that no transport can fix, like NoValidTargets (see
+	// sms_fallback), are not retried. Default false.
+	AttachmentTransportRetry bool `yaml:"attachment_transport_retry"`
+
+	// MMSImageMaxKB shrinks images sent as MMS to at most this many
+	// kilobytes, re-encoding them as smaller JPEGs, since carriers reject
+	// or mangle MMS over their size limit (commonly 300 KB to 1 MB). GIFs
+	// are left alone to keep their animation. Zero or negative disables it.
+	MMSImageMaxKB int `yaml:"mms_image_max_kb"`
+
+	// EditedMarker appends " (edited)" to the body of bridged iMessage edits
+	// (and of edited messages backfilled from chat.db, which arrive with
+	// their latest text), for Matrix clients that show the new text without
+	// any edit indicator.
+	// The m.replace relation and the edit count (fi.mau.imessage.edit_count
+	// in m.new_content) are always set. Default false.
+	EditedMarker bool `yaml:"edited_marker"`
+
+	// EffectNoteInBody adds a note like "(sent with Slam effect)" under the
+	// text of messages sent with an iMessage effect, so every Matrix client
+	// shows it. When false, the effect is only in the event's
+	// com.beeper.message_effect field, which is always set, for clients
+	// that render effects themselves. Default true.
+	EffectNoteInBody bool `yaml:"effect_note_in_body"`
+
+	// SourceDeviceField records the device a message was sent from (model
+	// identifier and kind, e.g. iPhone) in the event's
+	// fi.mau.imessage.source_device field, for messages that carry it.
+	// Messages without device info never get the field. Default false.
+	SourceDeviceField bool `yaml:"source_device_field"`
+
+	// GroupActorPowerLevel is the Matrix power level given to a group member
+	// when they rename the group or change its membership. iMessage groups
+	// have no admins, so this only reflects who has been acting on the group
+	// (50 makes them a moderator). The user's own level is never touched,
+	// and a member who removed themselves isn't re-added. 0 disables it
+	// (default); the changes are attributed to the acting member either way.
+	GroupActorPowerLevel int `yaml:"group_actor_power_level"`
+
+	// GroupNoticeCoalesceSeconds holds group renames and membership changes
+	// for this many seconds and bridges only the last of a burst, so a name
+	// toggled back and forth or members added one by one don't flood the
+	// room. Renames and membership changes are coalesced separately. 0
+	// bridges every change as it arrives (default).
+	GroupNoticeCoalesceSeconds int `yaml:"group_notice_coalesce_seconds"`
+
+	// GroupMemberLimit caps how many members of a group are put in its
+	// Matrix room, so portals of groups with hundreds of members are quick
+	// to create and resync. The user is always included, then the first
+	// members of the roster up to the limit; the rest are left out of the
+	// room but still listed by the members command. 0 puts everyone in the
+	// room (default).
+	GroupMemberLimit int `yaml:"group_member_limit"`
+
+	// LogPII controls whether log lines may contain personal data. When
+	// false, phone numbers and email addresses are masked in every log line
+	// ("+*********67", "a***@***.com"), and message-derived text such as link
+	// preview titles and URLs, as well as contact and group names, is
+	// replaced by its length. Default true, which
+	// keeps the full identifiers that make debugging easier.
+	LogPII bool `yaml:"log_pii"`
+
 	// PreferredHandle overrides the outgoing iMessage identity.
 	// Use the full URI format: "tel:+15551234567" or "mailto:user@example.com".
 	// If empty, the handle chosen during login is used.
@@ -129,6 +560,13 @@ type IMConfig struct {
 	// Default is true.
 	ReadReceipts bool `yaml:"read_receipts"`
 
+	// PeerReadReceiptsNotice posts a one-time notice in a DM when the
+	// contact seems to have read receipts turned off (they keep replying to
+	// delivered messages without sending any), so the missing "read" is
+	// explained. iMessage doesn't expose the setting, so it's inferred.
+	// Default is false.
+	PeerReadReceiptsNotice bool `yaml:"peer_read_receipts_notice"`
+
 	// TypingNotifications controls whether the bridge sends typing indicators
 	// to iMessage contacts while you compose a reply in Matrix. When false,
 	// iMessage contacts will not see the typing bubble. Incoming typing
@@ -136,11 +574,57 @@ type IMConfig struct {
 	// Default is true.
 	TypingNotifications bool `yaml:"typing_notifications"`
 
+	// ContactSourcePriority orders the contact sources consulted when
+	// resolving names, photos and alternate handles. "carddav" is the
+	// address book source (external CardDAV, iCloud CardDAV or local macOS
+	// Contacts); "chatdb" is the chat.db contact API available in local macOS
+	// mode. Known sources left out of the list are appended in the default
+	// order. Default ["carddav", "chatdb"].
+	ContactSourcePriority []string `yaml:"contact_source_priority"`
+
+	// ContactMergeStrategy controls how a contact known to more than one
+	// source is combined:
+	//   - "merge" (the default): the name and the avatar each come from the
+	//     highest-priority source that has one; phone numbers and emails are
+	//     the union across all sources.
+	//   - "first": the highest-priority source that knows the identifier is
+	//     used as-is and the others are ignored.
+	// An invalid or empty value falls back to "merge".
+	ContactMergeStrategy string `yaml:"contact_merge_strategy"`
+
+	// LinkEmailPhoneContacts puts the DMs with a named contact's email
+	// handles in the same portal as the DMs with their phone number, even
+	// before either portal exists, so someone who writes from their email
+	// on iMessage and gets texted at their number has one room. The portal
+	// is keyed by the contact's phone number. Without it, the handles only
+	// share a portal once one of them already has a room. Default false.
+	LinkEmailPhoneContacts bool `yaml:"link_email_phone_contacts"`
+
+	// FallbackAvatar generates an avatar for contacts without a photo:
+	//   - "initials": the contact's initials on a colored background, or an
+	//     identicon when the bridge has no name for them.
+	//   - "identicon": a pattern derived from the handle, which shows nothing
+	//     about the contact.
+	// Empty (the default) leaves those contacts without an avatar.
+	FallbackAvatar string `yaml:"fallback_avatar"`
+
 	// CardDAV is an external CardDAV server for contact name resolution.
 	// When configured, this is used instead of iCloud CardDAV contacts.
 	CardDAV CardDAVConfig `yaml:"carddav"`
 }
 
+// AttachmentDownloadRule is one entry of attachment_download_rules.
+type AttachmentDownloadRule struct {
+	// Mime is an exact mime type ("application/zip"), a type wildcard
+	// ("video/*") or "*" for everything. Matching is case-insensitive.
+	Mime string `yaml:"mime"`
+	// MaxSizeMB defers matching attachments larger than this many MB.
+	// Zero means no size limit.
+	MaxSizeMB int `yaml:"max_size_mb"`
+	// Never defers every matching attachment regardless of size.
+	Never bool `yaml:"never"`
+}
+
 // CardDAVConfig configures an external CardDAV server for contact name resolution.
 // Supports Google (with app passwords), Nextcloud, Radicale, Fastmail, etc.
 type CardDAVConfig struct {
@@ -198,7 +682,20 @@ type DisplaynameParams struct {
 	ID        string
 }
 
+// FormatDisplayname renders displayname_template, after applying
+// nickname_precedence.
 func (c *IMConfig) FormatDisplayname(params DisplaynameParams) string {
+	hasFormal := strings.TrimSpace(params.FirstName+params.LastName) != ""
+	switch c.NicknamePrecedence {
+	case "nickname":
+		if nick := strings.TrimSpace(params.Nickname); nick != "" {
+			return nick
+		}
+	case "formal":
+		if hasFormal {
+			params.Nickname = ""
+		}
+	}
 	var buf strings.Builder
 	err := c.displaynameTemplate.Execute(&buf, &params)
 	if err != nil {
@@ -223,13 +720,70 @@ func (c *IMConfig) UseCloudKitBackfill() bool {
 
 func upgradeConfig(helper up.Helper) {
 	helper.Copy(up.Str, "displayname_template")
+	helper.Copy(up.Str, "nickname_precedence")
 	helper.Copy(up.Bool, "cloudkit_backfill")
 	helper.Copy(up.Str, "backfill_source")
 	helper.Copy(up.Bool, "video_transcoding")
 	helper.Copy(up.Bool, "heic_conversion")
 	helper.Copy(up.Int, "heic_jpeg_quality")
+	helper.Copy(up.Bool, "hide_media_filenames")
 	helper.Copy(up.Int, "max_attachment_size_mb")
+	helper.Copy(up.List, "attachment_download_rules")
 	helper.Copy(up.Bool, "url_previews_in_backfill")
+	helper.Copy(up.Bool, "message_service_in_backfill")
+	helper.Copy(up.Bool, "initial_sync_unread_only")
+	helper.Copy(up.Str, "chatdb_extra_attachment_root")
+	helper.Copy(up.Str, "chatdb_path")
+	helper.Copy(up.Bool, "chatdb_backfill_fallback")
+	helper.Copy(up.Bool, "relay_backfill_fallback")
+	helper.Copy(up.Int, "deleted_message_retention_days")
+	helper.Copy(up.Int, "abandoned_portal_cleanup_days")
+	helper.Copy(up.Int, "orphaned_message_cleanup_days")
+	helper.Copy(up.Int, "cloud_delete_grace_minutes")
+	helper.Copy(up.Bool, "message_search_fts")
+	helper.Copy(up.Int, "realtime_max_age_hours")
+	helper.Copy(up.Bool, "quiet_bootstrap")
+	helper.Copy(up.Int, "portal_catchup_minutes")
+	helper.Copy(up.Int, "group_join_backfill_hours")
+	helper.Copy(up.Int, "receipt_dedup_window_seconds")
+	helper.Copy(up.Int, "relay_health_check_minutes")
+	helper.Copy(up.Bool, "relay_discovery")
+	helper.Copy(up.Str, "nac_relay_fallback_url")
+	helper.Copy(up.Str, "cloudkit_chat_dump_path")
+	helper.Copy(up.Bool, "cloudkit_upsert_by_portal")
+	helper.Copy(up.Int, "long_message_limit")
+	helper.Copy(up.Str, "long_message_mode")
+	helper.Copy(up.Bool, "redact_cloud_deleted_messages")
+	helper.Copy(up.Int, "failed_upload_retry_attempts")
+	helper.Copy(up.Bool, "server_send_timestamps")
+	helper.Copy(up.Int, "matrix_retention_days")
+	helper.Copy(up.Int, "outbound_echo_window_seconds")
+	helper.Copy(up.Int, "unsend_suppression_seconds")
+	helper.Copy(up.Int, "send_pending_timeout_seconds")
+	helper.Copy(up.Int, "cloudkit_fetch_recent_interval_seconds")
+	helper.Copy(up.Int, "cloudkit_fetch_recent_max_per_restore")
+	helper.Copy(up.Bool, "cloudkit_access_test")
+	helper.Copy(up.Bool, "detect_apple_id_auth_failure")
+	helper.Copy(up.Int, "ghost_updates_per_second")
+	helper.Copy(up.Str, "metrics_listen")
+	helper.Copy(up.Int, "contact_sync_retry_budget")
+	helper.Copy(up.Bool, "auto_join_portals")
+	helper.Copy(up.List, "auto_join_allow")
+	helper.Copy(up.List, "auto_join_deny")
+	helper.Copy(up.Str, "error_notice_room")
+	helper.Copy(up.Bool, "skip_outbound_only_portals")
+	helper.Copy(up.Int, "min_portal_messages")
+	helper.Copy(up.Bool, "sms_fallback")
+	helper.Copy(up.Int, "sms_upgrade_check_hours")
+	helper.Copy(up.Bool, "attachment_transport_retry")
+	helper.Copy(up.Int, "mms_image_max_kb")
+	helper.Copy(up.Bool, "edited_marker")
+	helper.Copy(up.Bool, "effect_note_in_body")
+	helper.Copy(up.Bool, "source_device_field")
+	helper.Copy(up.Int, "group_actor_power_level")
+	helper.Copy(up.Int, "group_notice_coalesce_seconds")
+	helper.Copy(up.Int, "group_member_limit")
+	helper.Copy(up.Bool, "log_pii")
 	helper.Copy(up.Str, "preferred_handle")
 	helper.Copy(up.Str, "facetime_display_name")
 	helper.Copy(up.Bool, "disable_facetime")
@@ -237,7 +791,12 @@ func upgradeConfig(helper up.Helper) {
 	helper.Copy(up.Bool, "statuskit_notifications")
 	helper.Copy(up.Str, "statuskit_notification_style")
 	helper.Copy(up.Bool, "read_receipts")
+	helper.Copy(up.Bool, "peer_read_receipts_notice")
 	helper.Copy(up.Bool, "typing_notifications")
+	helper.Copy(up.List, "contact_source_priority")
+	helper.Copy(up.Str, "contact_merge_strategy")
+	helper.Copy(up.Bool, "link_email_phone_contacts")
+	helper.Copy(up.Str, "fallback_avatar")
 	helper.Copy(up.Str, "carddav", "email")
 	helper.Copy(up.Str, "carddav", "url")
 	helper.Copy(up.Str, "carddav", "username")
@@ -108,6 +108,37 @@ func TestIMConfig_FormatDisplayname_DefaultTemplate(t *testing.T) {
 	}
 }
 
+func TestIMConfig_FormatDisplayname_NicknamePrecedence(t *testing.T) {
+	defaultTmpl := `{{if .FirstName}}{{.FirstName}}{{if .LastName}} {{.LastName}}{{end}}{{else if .Nickname}}{{.Nickname}}{{else}}{{.ID}}{{end}}`
+	nickFirstTmpl := `{{if .Nickname}}{{.Nickname}}{{else}}{{.FirstName}} {{.LastName}}{{end}}`
+	full := DisplaynameParams{FirstName: "Alice", LastName: "Smith", Nickname: "Al", ID: "+1555"}
+	tests := []struct {
+		name       string
+		tmpl       string
+		precedence string
+		params     DisplaynameParams
+		want       string
+	}{
+		{"template decides", defaultTmpl, "", full, "Alice Smith"},
+		{"nickname preferred", defaultTmpl, "nickname", full, "Al"},
+		{"nickname preferred without nickname", defaultTmpl, "nickname", DisplaynameParams{FirstName: "Alice", ID: "+1555"}, "Alice"},
+		{"formal preferred over template", nickFirstTmpl, "formal", full, "Alice Smith"},
+		{"formal preferred, nickname only", nickFirstTmpl, "formal", DisplaynameParams{Nickname: "Al"}, "Al"},
+		{"template prefers nickname", nickFirstTmpl, "", full, "Al"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &IMConfig{DisplaynameTemplate: tt.tmpl, NicknamePrecedence: tt.precedence}
+			if err := c.PostProcess(); err != nil {
+				t.Fatalf("PostProcess() error: %v", err)
+			}
+			if got := c.FormatDisplayname(tt.params); got != tt.want {
+				t.Errorf("FormatDisplayname() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
 func TestIMConfig_UseChatDBBackfill(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -31,6 +31,9 @@ func isRunningOnMacOS() bool {
 type IMConnector struct {
 	Bridge *bridgev2.Bridge
 	Config IMConfig
+
+	metrics      *connectorMetrics
+	errorNotices *errorNoticeSink
 }
 
 var _ bridgev2.NetworkConnector = (*IMConnector)(nil)
@@ -49,6 +52,8 @@ func (c *IMConnector) GetName() bridgev2.BridgeName {
 
 func (c *IMConnector) Init(bridge *bridgev2.Bridge) {
 	c.Bridge = bridge
+	c.metrics = newConnectorMetrics()
+	omitLogText.Store(!c.Config.LogPII)
 }
 
 func (c *IMConnector) Start(ctx context.Context) error {
@@ -126,6 +131,13 @@ func (c *IMConnector) Start(ctx context.Context) error {
 		}
 	}
 
+	if c.Config.MetricsListen != "" {
+		c.startMetricsServer(c.Config.MetricsListen)
+	}
+	if c.Config.ErrorNoticeRoom != "" {
+		c.errorNotices = newErrorNoticeSink(c, id.RoomID(c.Config.ErrorNoticeRoom))
+	}
+
 	// Auto-restore: if the DB has no logins but we have valid backup session
 	// state (session.json + keystore), create a user_login from the backup
 	// instead of requiring a full re-login.
@@ -215,27 +227,7 @@ func (c *IMConnector) tryAutoRestore(ctx context.Context) {
 		Str("username", username).
 		Msg("Auto-restoring login from backup session state")
 
-	platform := state.Platform
-	if platform == "" {
-		platform = runtime.GOOS
-	}
-
-	meta := &UserLoginMetadata{
-		Platform:                 platform,
-		HardwareKey:              state.HardwareKey,
-		DeviceID:                 state.DeviceID,
-		ChatsSynced:              false,
-		APSState:                 state.APSState,
-		IDSUsers:                 state.IDSUsers,
-		IDSIdentity:              state.IDSIdentity,
-		AccountUsername:          state.AccountUsername,
-		AccountHashedPasswordHex: state.AccountHashedPasswordHex,
-		AccountPET:               state.AccountPET,
-		AccountADSID:             state.AccountADSID,
-		AccountDSID:              state.AccountDSID,
-		AccountSPDBase64:         state.AccountSPDBase64,
-		MmeDelegateJSON:          state.MmeDelegateJSON,
-	}
+	meta := state.loginMetadata()
 
 	_, err = user.NewLogin(ctx, &database.UserLogin{
 		ID:         loginID,
@@ -308,12 +300,14 @@ func (c *IMConnector) LoadUserLogin(ctx context.Context, login *bridgev2.UserLog
 	var cfg *rustpushgo.WrappedOsConfig
 	var err error
 
+	var hardwareKey string
 	if meta.HardwareKey != "" {
 		// Cross-platform mode: use hardware key with open-absinthe NAC emulation.
+		hardwareKey = c.discoverRelayKey(ctx, log, meta.HardwareKey)
 		if meta.DeviceID != "" {
-			cfg, err = rustpushgo.CreateConfigFromHardwareKeyWithDeviceId(meta.HardwareKey, meta.DeviceID)
+			cfg, err = rustpushgo.CreateConfigFromHardwareKeyWithDeviceId(hardwareKey, meta.DeviceID)
 		} else {
-			cfg, err = rustpushgo.CreateConfigFromHardwareKey(meta.HardwareKey)
+			cfg, err = rustpushgo.CreateConfigFromHardwareKey(hardwareKey)
 		}
 	} else if isRunningOnMacOS() {
 		// Local macOS mode: use IOKit + AAAbsintheContext.
@@ -344,28 +338,14 @@ func (c *IMConnector) LoadUserLogin(ctx context.Context, login *bridgev2.UserLog
 	if meta.IDSUsers == "" && meta.IDSIdentity == "" && meta.APSState == "" {
 		log.Warn().Msg("LoadUserLogin: meta has no IDSUsers/IDSIdentity/APSState; skipping session.json overwrite to preserve existing backup")
 	} else {
-		saveSessionState(log, PersistedSessionState{
-			IDSIdentity:              meta.IDSIdentity,
-			APSState:                 meta.APSState,
-			IDSUsers:                 meta.IDSUsers,
-			PreferredHandle:          meta.PreferredHandle,
-			Platform:                 meta.Platform,
-			HardwareKey:              meta.HardwareKey,
-			DeviceID:                 meta.DeviceID,
-			AccountUsername:          meta.AccountUsername,
-			AccountHashedPasswordHex: meta.AccountHashedPasswordHex,
-			AccountPET:               meta.AccountPET,
-			AccountADSID:             meta.AccountADSID,
-			AccountDSID:              meta.AccountDSID,
-			AccountSPDBase64:         meta.AccountSPDBase64,
-			MmeDelegateJSON:          meta.MmeDelegateJSON,
-		})
+		saveSessionState(log, sessionStateFromMetadata(meta))
 	}
 
 	client := &IMClient{
 		Main:                    c,
 		UserLogin:               login,
 		config:                  cfg,
+		hardwareKey:             hardwareKey,
 		users:                   rustpushgo.NewWrappedIdsUsers(usersStr),
 		identity:                rustpushgo.NewWrappedIdsngmIdentity(identityStr),
 		connection:              rustpushgo.Connect(cfg, rustpushgo.NewWrappedApsState(apsStateStr)),
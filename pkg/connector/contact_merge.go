@@ -64,9 +64,40 @@ func (c *IMClient) resolveContactPortalID(identifier string) networkid.PortalID
 		}
 	}
 
+	if c.Main.Config.LinkEmailPhoneContacts {
+		if linked, ok := linkedContactPortalID(contact, identifier); ok {
+			c.UserLogin.Log.Debug().
+				Str("original", identifier).
+				Str("resolved", linked).
+				Msg("Linked email DM to contact's phone portal")
+			return networkid.PortalID(linked)
+		}
+	}
+
 	return defaultID
 }
 
+// linkedContactPortalID returns the portal an email handle of contact
+// shares with its phone numbers under link_email_phone_contacts: the same
+// phone handle canonicalContactHandle picks. ok is false for phone handles
+// and for contacts without a name or a phone number.
+func linkedContactPortalID(contact *imessage.Contact, identifier string) (string, bool) {
+	if !strings.HasPrefix(identifier, "mailto:") || contact == nil || !contact.HasName() {
+		return "", false
+	}
+	var phones []string
+	for _, id := range contactPortalIDs(contact) {
+		if strings.HasPrefix(id, "tel:") {
+			phones = append(phones, id)
+		}
+	}
+	if len(phones) == 0 {
+		return "", false
+	}
+	sort.Strings(phones)
+	return phones[0], true
+}
+
 // resolveSendTarget determines the best identifier to send to for a DM portal.
 func (c *IMClient) resolveSendTarget(portalID string) (target string) {
 	if c.client == nil || strings.Contains(portalID, ",") {
@@ -118,25 +149,28 @@ func (c *IMClient) resolveSendTarget(portalID string) (target string) {
 	return portalID
 }
 
-// lookupContact resolves a portal/identifier string to a Contact using
-// cloud contacts (iCloud CardDAV), falling back to chat.db contacts.
+// lookupContact resolves a portal/identifier string to a Contact using every
+// available contact source (address book and chat.db) in the configured
+// priority order, combined per contact_merge_strategy. See contact_sources.go.
 func (c *IMClient) lookupContact(identifier string) *imessage.Contact {
 	localID := stripIdentifierPrefix(identifier)
 	if localID == "" {
 		return nil
 	}
 
-	if c.contacts != nil {
-		contact, _ := c.contacts.GetContactInfo(localID)
-		if contact != nil {
+	strategy := c.Main.Config.contactMergeStrategy()
+	var found []*imessage.Contact
+	for _, source := range c.Main.Config.contactSourceOrder() {
+		contact := c.lookupContactInSource(source, localID)
+		if contact == nil {
+			continue
+		}
+		if strategy == contactMergeStrategyFirst {
 			return contact
 		}
+		found = append(found, contact)
 	}
-	if c.chatDB != nil {
-		contact, _ := c.chatDB.api.GetContactInfo(localID)
-		return contact
-	}
-	return nil
+	return mergeContacts(strategy, found...)
 }
 
 // getUniqueParticipantCount counts the number of unique *people* in a
@@ -197,8 +231,10 @@ func (c *IMClient) getContactChatGUIDs(portalID string) []string {
 
 // contactKeyFromContact returns a stable identity key for grouping a contact's
 // DM entries during initial sync deduplication. Returns "" if no merging is
-// needed (single phone, no name, etc.).
-func contactKeyFromContact(contact *imessage.Contact) string {
+// needed (single phone, no name, etc.). With linkEmails, a single phone
+// number is enough if the contact also has an email, so its email and phone
+// DMs are merged (link_email_phone_contacts).
+func contactKeyFromContact(contact *imessage.Contact, linkEmails bool) string {
 	if contact == nil || !contact.HasName() {
 		return ""
 	}
@@ -209,7 +245,7 @@ func contactKeyFromContact(contact *imessage.Contact) string {
 			phones = append(phones, n)
 		}
 	}
-	if len(phones) <= 1 {
+	if len(phones) == 0 || (len(phones) == 1 && !(linkEmails && len(contact.Emails) > 0)) {
 		return ""
 	}
 	sort.Strings(phones)
@@ -289,6 +325,32 @@ func (c *IMClient) canonicalContactHandle(identifier string) string {
 	return altIDs[0]
 }
 
+// canonicalGhostID returns the ghost for a sender or group member handle.
+// Every alias of a contact with several handles maps to one ghost, keyed by
+// canonicalContactHandle, so someone writing from their email in one group
+// and from their phone in another is a single Matrix user. Other handles,
+// and the user's own, keep a ghost of their own. DM senders are further
+// pinned to the portal's handle by canonicalizeDMSender.
+func (c *IMClient) canonicalGhostID(identifier string) networkid.UserID {
+	normalized := normalizeIdentifierForPortalID(identifier)
+	if normalized == "" || c.isMyHandle(normalized) {
+		return makeUserID(normalized)
+	}
+	return makeUserID(c.canonicalContactHandle(normalized))
+}
+
+// ghostIdentifiers lists the identifiers of a ghost: its own first, then
+// every other handle of its contact, normalized like portal IDs.
+func ghostIdentifiers(identifier string, contact *imessage.Contact) []string {
+	ids := []string{identifier}
+	for _, alias := range contactPortalIDs(contact) {
+		if alias != identifier {
+			ids = append(ids, alias)
+		}
+	}
+	return ids
+}
+
 // canonicalizeDMSender remaps the sender identity for DM events so that the
 // ghost matches the portal's canonical handle. Without this, a contact sending
 // from their email handle into a phone-based DM portal causes a phantom ghost
@@ -0,0 +1,147 @@
+package connector
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/bridgeconfig"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+
+	"github.com/lrhodin/imessage/imessage"
+)
+
+// staticContacts is a contactSource backed by a fixed list.
+type staticContacts []*imessage.Contact
+
+func (s staticContacts) SyncContacts(zerolog.Logger) error { return nil }
+
+func (s staticContacts) GetContactInfo(identifier string) (*imessage.Contact, error) {
+	for _, contact := range s {
+		for _, id := range contactPortalIDs(contact) {
+			if stripIdentifierPrefix(id) == identifier {
+				return contact, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+func (s staticContacts) GetAllContacts() []*imessage.Contact { return s }
+
+func TestCanonicalGhostID(t *testing.T) {
+	alice := &imessage.Contact{
+		FirstName: "Alice",
+		Phones:    []string{"+1 (555) 123-4567"},
+		Emails:    []string{"Alice@Example.com", "alice@work.example"},
+	}
+	unnamed := &imessage.Contact{Emails: []string{"x@example.com", "y@example.com"}}
+	c := &IMClient{
+		Main:       &IMConnector{},
+		UserLogin:  &bridgev2.UserLogin{Log: zerolog.Nop()},
+		allHandles: []string{"tel:+15550001111", "mailto:me@example.com"},
+		contacts:   staticContacts{alice, unnamed},
+	}
+
+	tests := []struct {
+		name       string
+		identifier string
+		want       networkid.UserID
+	}{
+		{"phone alias", "tel:+15551234567", "tel:+15551234567"},
+		{"email alias", "mailto:alice@example.com", "tel:+15551234567"},
+		{"second email alias", "mailto:alice@work.example", "tel:+15551234567"},
+		{"unknown handle", "mailto:bob@example.com", "mailto:bob@example.com"},
+		{"contact without a name", "mailto:y@example.com", "mailto:y@example.com"},
+		{"own handle", "mailto:me@example.com", "mailto:me@example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := c.canonicalGhostID(tt.identifier); got != tt.want {
+				t.Errorf("canonicalGhostID(%q) = %q, want %q", tt.identifier, got, tt.want)
+			}
+		})
+	}
+
+	sender := c.makeEventSender(strPtr("mailto:alice@work.example"))
+	if sender.IsFromMe || sender.Sender != "tel:+15551234567" {
+		t.Errorf("makeEventSender(alias) = %+v, want the canonical ghost", sender)
+	}
+}
+
+func TestGhostIdentifiers(t *testing.T) {
+	contact := &imessage.Contact{
+		FirstName: "Alice",
+		Phones:    []string{"+1 (555) 123-4567", "555-123-4567"},
+		Emails:    []string{"Alice@Example.com"},
+	}
+	got := ghostIdentifiers("mailto:alice@example.com", contact)
+	want := []string{"mailto:alice@example.com", "tel:+15551234567"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ghostIdentifiers() = %v, want %v", got, want)
+	}
+	if got := ghostIdentifiers("tel:+15550000000", nil); !reflect.DeepEqual(got, []string{"tel:+15550000000"}) {
+		t.Errorf("ghostIdentifiers(no contact) = %v, want only the ghost's own", got)
+	}
+}
+
+func TestLinkEmailPhoneContacts(t *testing.T) {
+	alice := &imessage.Contact{
+		FirstName: "Alice",
+		Phones:    []string{"+1 (555) 987-6543", "+1 (555) 123-4567"},
+		Emails:    []string{"Alice@Example.com"},
+	}
+	emailOnly := &imessage.Contact{FirstName: "Bob", Emails: []string{"bob@example.com"}}
+	unnamed := &imessage.Contact{Phones: []string{"+15550002222"}, Emails: []string{"x@example.com"}}
+	newClient := func(link bool) *IMClient {
+		return &IMClient{
+			Main: &IMConnector{
+				Config: IMConfig{LinkEmailPhoneContacts: link},
+				Bridge: &bridgev2.Bridge{DB: newTestBridgeDB(t), Config: &bridgeconfig.BridgeConfig{}},
+			},
+			UserLogin: &bridgev2.UserLogin{UserLogin: &database.UserLogin{ID: "login"}, Log: zerolog.Nop()},
+			contacts:  staticContacts{alice, emailOnly, unnamed},
+		}
+	}
+
+	tests := []struct {
+		name       string
+		link       bool
+		identifier string
+		want       networkid.PortalID
+	}{
+		{"email linked to phone", true, "mailto:alice@example.com", "tel:+15551234567"},
+		{"phone unchanged", true, "tel:+15559876543", "tel:+15559876543"},
+		{"contact without a phone", true, "mailto:bob@example.com", "mailto:bob@example.com"},
+		{"contact without a name", true, "mailto:x@example.com", "mailto:x@example.com"},
+		{"unknown email", true, "mailto:carol@example.com", "mailto:carol@example.com"},
+		{"linking off", false, "mailto:alice@example.com", "mailto:alice@example.com"},
+	}
+	for _, tt := range tests {
+		c := newClient(tt.link)
+		if got := c.resolveContactPortalID(tt.identifier); got != tt.want {
+			t.Errorf("resolveContactPortalID(%s) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	// The chat.db initial sync groups the email and phone DMs together too.
+	keyTests := []struct {
+		name    string
+		contact *imessage.Contact
+		link    bool
+		want    bool
+	}{
+		{"one phone and an email, linked", &imessage.Contact{FirstName: "A", Phones: []string{"+15551234567"}, Emails: []string{"a@example.com"}}, true, true},
+		{"one phone and an email, not linked", &imessage.Contact{FirstName: "A", Phones: []string{"+15551234567"}, Emails: []string{"a@example.com"}}, false, false},
+		{"two phones", &imessage.Contact{FirstName: "A", Phones: []string{"+15551234567", "+15559876543"}}, false, true},
+		{"email only", emailOnly, true, false},
+		{"no name", unnamed, true, false},
+	}
+	for _, tt := range keyTests {
+		if got := contactKeyFromContact(tt.contact, tt.link) != ""; got != tt.want {
+			t.Errorf("contactKeyFromContact(%s) grouped = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
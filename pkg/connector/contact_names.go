@@ -0,0 +1,96 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2024 Ludvig Rhodin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+package connector
+
+// Contact name changes (nickname_precedence).
+//
+// refreshGhostNamesFromContacts updates a ghost whenever its formatted
+// display name changes, which covers a nickname change exactly when the
+// nickname is what's displayed. To tell a nickname edit apart from a name
+// edit, it remembers the name fields each ghost was last refreshed with
+// and classifies the difference, so a nickname change that isn't shown is
+// logged as such instead of looking like nothing happened.
+
+import (
+	"sync"
+
+	"maunium.net/go/mautrix/bridgev2/networkid"
+
+	"github.com/lrhodin/imessage/imessage"
+)
+
+// contactNameFields are the parts of a contact that feed its display name.
+type contactNameFields struct {
+	FirstName string
+	LastName  string
+	Nickname  string
+}
+
+func contactNameFieldsOf(contact *imessage.Contact) contactNameFields {
+	return contactNameFields{FirstName: contact.FirstName, LastName: contact.LastName, Nickname: contact.Nickname}
+}
+
+// contactNameChange is what changed between two contactNameFields.
+type contactNameChange int
+
+const (
+	contactNameUnchanged contactNameChange = iota
+	// contactNameNicknameOnly: only the nickname changed.
+	contactNameNicknameOnly
+	// contactNameFormal: the first or last name changed.
+	contactNameFormal
+)
+
+func (c contactNameChange) String() string {
+	switch c {
+	case contactNameNicknameOnly:
+		return "nickname"
+	case contactNameFormal:
+		return "name"
+	default:
+		return "none"
+	}
+}
+
+// classifyContactNameChange compares a contact's name fields with the ones
+// its ghost was last refreshed with.
+func classifyContactNameChange(prev, cur contactNameFields) contactNameChange {
+	switch {
+	case prev.FirstName != cur.FirstName || prev.LastName != cur.LastName:
+		return contactNameFormal
+	case prev.Nickname != cur.Nickname:
+		return contactNameNicknameOnly
+	default:
+		return contactNameUnchanged
+	}
+}
+
+// contactNameSnapshots holds the name fields each ghost was last refreshed
+// with. The zero value is ready to use.
+type contactNameSnapshots struct {
+	mu    sync.Mutex
+	names map[networkid.UserID]contactNameFields
+}
+
+// swap records cur for a ghost and returns what changed since the last
+// refresh. The first refresh of a ghost in a session has nothing to compare
+// with and reports contactNameUnchanged.
+func (s *contactNameSnapshots) swap(ghostID networkid.UserID, cur contactNameFields) contactNameChange {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.names == nil {
+		s.names = make(map[networkid.UserID]contactNameFields)
+	}
+	prev, ok := s.names[ghostID]
+	s.names[ghostID] = cur
+	if !ok {
+		return contactNameUnchanged
+	}
+	return classifyContactNameChange(prev, cur)
+}
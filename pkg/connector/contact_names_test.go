@@ -0,0 +1,49 @@
+package connector
+
+import (
+	"testing"
+
+	"maunium.net/go/mautrix/bridgev2/networkid"
+)
+
+func TestClassifyContactNameChange(t *testing.T) {
+	alice := contactNameFields{FirstName: "Alice", LastName: "Smith", Nickname: "Al"}
+	tests := []struct {
+		name string
+		cur  contactNameFields
+		want contactNameChange
+	}{
+		{"unchanged", alice, contactNameUnchanged},
+		{"nickname changed", contactNameFields{FirstName: "Alice", LastName: "Smith", Nickname: "Ali"}, contactNameNicknameOnly},
+		{"nickname removed", contactNameFields{FirstName: "Alice", LastName: "Smith"}, contactNameNicknameOnly},
+		{"last name changed", contactNameFields{FirstName: "Alice", LastName: "Jones", Nickname: "Al"}, contactNameFormal},
+		{"both changed", contactNameFields{FirstName: "Alicia", Nickname: "Lis"}, contactNameFormal},
+	}
+	for _, tt := range tests {
+		if got := classifyContactNameChange(alice, tt.cur); got != tt.want {
+			t.Errorf("classifyContactNameChange(%s) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestContactNameSnapshots(t *testing.T) {
+	var s contactNameSnapshots
+	const ghost = networkid.UserID("tel:+15551234567")
+	steps := []struct {
+		fields contactNameFields
+		want   contactNameChange
+	}{
+		{contactNameFields{FirstName: "Alice", Nickname: "Al"}, contactNameUnchanged},
+		{contactNameFields{FirstName: "Alice", Nickname: "Al"}, contactNameUnchanged},
+		{contactNameFields{FirstName: "Alice", Nickname: "Ali"}, contactNameNicknameOnly},
+		{contactNameFields{FirstName: "Alicia", Nickname: "Ali"}, contactNameFormal},
+	}
+	for i, step := range steps {
+		if got := s.swap(ghost, step.fields); got != step.want {
+			t.Errorf("swap() step %d = %v, want %v", i, got, step.want)
+		}
+	}
+	if got := s.swap("mailto:bob@example.com", contactNameFields{Nickname: "Bobby"}); got != contactNameUnchanged {
+		t.Errorf("swap() for a new ghost = %v, want %v", got, contactNameUnchanged)
+	}
+}
@@ -0,0 +1,174 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2024 Ludvig Rhodin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+package connector
+
+// Unified contact lookup across multiple contact sources.
+//
+// A login can have more than one place that knows about a contact: the
+// address book source in c.contacts (external CardDAV, iCloud CardDAV or
+// local macOS Contacts) and, in local macOS mode, the chat.db contact API.
+// Each source often only has part of the picture — e.g. CardDAV has the name
+// but chat.db has the photo — so lookups consult every available source in
+// the configured priority order and combine the results.
+
+import (
+	"strings"
+
+	"github.com/lrhodin/imessage/imessage"
+)
+
+const (
+	// contactSourceCardDAV is the address book source held in c.contacts.
+	contactSourceCardDAV = "carddav"
+	// contactSourceChatDB is the chat.db contact API (local macOS mode).
+	contactSourceChatDB = "chatdb"
+)
+
+const (
+	// contactMergeStrategyMerge combines fields from every source that knows
+	// the identifier: names and avatar come from the highest-priority source
+	// that has them, phones and emails are unioned.
+	contactMergeStrategyMerge = "merge"
+	// contactMergeStrategyFirst uses the first source (in priority order)
+	// that knows the identifier and ignores the rest.
+	contactMergeStrategyFirst = "first"
+)
+
+// defaultContactSourcePriority is the lookup order when the config doesn't
+// list one. Matches the historical lookupContact behavior (address book
+// first, chat.db as fallback).
+var defaultContactSourcePriority = []string{contactSourceCardDAV, contactSourceChatDB}
+
+// contactSourceOrder returns the configured source priority with unknown
+// and duplicate entries dropped. Known sources missing from the config are
+// appended in their default order so a partial list never hides a source.
+func (c *IMConfig) contactSourceOrder() []string {
+	order := make([]string, 0, len(defaultContactSourcePriority))
+	seen := make(map[string]bool, len(defaultContactSourcePriority))
+	add := func(name string) {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if seen[name] {
+			return
+		}
+		for _, known := range defaultContactSourcePriority {
+			if name == known {
+				seen[name] = true
+				order = append(order, name)
+				return
+			}
+		}
+	}
+	for _, name := range c.ContactSourcePriority {
+		add(name)
+	}
+	for _, name := range defaultContactSourcePriority {
+		add(name)
+	}
+	return order
+}
+
+// contactMergeStrategy returns the configured merge strategy, defaulting to
+// "merge" for empty or unrecognized values.
+func (c *IMConfig) contactMergeStrategy() string {
+	if strings.EqualFold(c.ContactMergeStrategy, contactMergeStrategyFirst) {
+		return contactMergeStrategyFirst
+	}
+	return contactMergeStrategyMerge
+}
+
+// lookupContactInSource queries a single named source for a bare (prefix-less)
+// identifier. Returns nil if the source is unavailable or doesn't know it.
+func (c *IMClient) lookupContactInSource(source, localID string) *imessage.Contact {
+	var contact *imessage.Contact
+	var err error
+	switch source {
+	case contactSourceCardDAV:
+		if c.contacts == nil {
+			return nil
+		}
+		contact, err = c.contacts.GetContactInfo(localID)
+	case contactSourceChatDB:
+		if c.chatDB == nil {
+			return nil
+		}
+		contact, err = c.chatDB.api.GetContactInfo(localID)
+	}
+	if err != nil {
+		c.UserLogin.Log.Debug().Err(err).Str("source", source).Str("id", localID).Msg("Failed to resolve contact info")
+	}
+	return contact
+}
+
+// mergeContacts combines contacts for the same person from multiple sources.
+// The input is in priority order; nil entries are skipped. With the "first"
+// strategy the first non-nil contact is returned as-is. With "merge":
+//   - first/last/nickname come from the first contact that has any name, so
+//     a name is never stitched together from two different sources;
+//   - phones and emails are the union across all contacts (deduplicated on
+//     their normalized form, first spelling wins);
+//   - the avatar comes from the first contact that has one;
+//   - UserGUID and PrimaryIdentifier come from the first contact that has them.
+//
+// Inputs are never modified. Returns nil if every input is nil.
+func mergeContacts(strategy string, contacts ...*imessage.Contact) *imessage.Contact {
+	var present []*imessage.Contact
+	for _, contact := range contacts {
+		if contact != nil {
+			present = append(present, contact)
+		}
+	}
+	if len(present) == 0 {
+		return nil
+	}
+	if strategy == contactMergeStrategyFirst || len(present) == 1 {
+		return present[0]
+	}
+
+	merged := &imessage.Contact{}
+	for _, contact := range present {
+		if !merged.HasName() && contact.HasName() {
+			merged.FirstName = contact.FirstName
+			merged.LastName = contact.LastName
+			merged.Nickname = contact.Nickname
+		}
+		if len(merged.Avatar) == 0 && merged.AvatarURL == "" && (len(contact.Avatar) > 0 || contact.AvatarURL != "") {
+			merged.Avatar = contact.Avatar
+			merged.AvatarURL = contact.AvatarURL
+		}
+		if merged.UserGUID == "" {
+			merged.UserGUID = contact.UserGUID
+		}
+		if merged.PrimaryIdentifier == "" {
+			merged.PrimaryIdentifier = contact.PrimaryIdentifier
+		}
+	}
+
+	seenPhones := make(map[string]bool)
+	seenEmails := make(map[string]bool)
+	for _, contact := range present {
+		for _, phone := range contact.Phones {
+			key := normalizePhoneForPortalID(phone)
+			if key == "" {
+				key = phone
+			}
+			if !seenPhones[key] {
+				seenPhones[key] = true
+				merged.Phones = append(merged.Phones, phone)
+			}
+		}
+		for _, email := range contact.Emails {
+			key := strings.ToLower(strings.TrimSpace(email))
+			if !seenEmails[key] {
+				seenEmails[key] = true
+				merged.Emails = append(merged.Emails, email)
+			}
+		}
+	}
+	return merged
+}
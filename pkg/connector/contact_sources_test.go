@@ -0,0 +1,113 @@
+package connector
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/lrhodin/imessage/imessage"
+)
+
+func TestMergeContacts_PartialOverlap(t *testing.T) {
+	// CardDAV knows the name and one phone; chat.db knows the photo, the
+	// same phone in a different spelling, a second phone and an email.
+	cardDAV := &imessage.Contact{
+		FirstName: "Alice",
+		LastName:  "Smith",
+		Phones:    []string{"+15551234567"},
+	}
+	chatDB := &imessage.Contact{
+		FirstName: "alice",
+		Avatar:    []byte{0x89, 'P', 'N', 'G'},
+		Phones:    []string{"(555) 123-4567", "+15559876543"},
+		Emails:    []string{"alice@example.com"},
+	}
+
+	got := mergeContacts(contactMergeStrategyMerge, cardDAV, chatDB)
+	if got.FirstName != "Alice" || got.LastName != "Smith" {
+		t.Errorf("name = %q %q, want Alice Smith from the higher-priority source", got.FirstName, got.LastName)
+	}
+	if !reflect.DeepEqual(got.Avatar, chatDB.Avatar) {
+		t.Errorf("avatar = %v, want the chat.db avatar", got.Avatar)
+	}
+	wantPhones := []string{"+15551234567", "+15559876543"}
+	if !reflect.DeepEqual(got.Phones, wantPhones) {
+		t.Errorf("phones = %v, want %v", got.Phones, wantPhones)
+	}
+	if !reflect.DeepEqual(got.Emails, []string{"alice@example.com"}) {
+		t.Errorf("emails = %v, want [alice@example.com]", got.Emails)
+	}
+	if len(cardDAV.Phones) != 1 || len(cardDAV.Emails) != 0 {
+		t.Error("mergeContacts must not modify its inputs")
+	}
+}
+
+func TestMergeContacts_NameFromLowerPriorityWhenMissing(t *testing.T) {
+	noName := &imessage.Contact{Phones: []string{"+15551234567"}, Avatar: []byte{1}}
+	named := &imessage.Contact{Nickname: "Al", Avatar: []byte{2}}
+
+	got := mergeContacts(contactMergeStrategyMerge, noName, named)
+	if got.Nickname != "Al" {
+		t.Errorf("Nickname = %q, want %q", got.Nickname, "Al")
+	}
+	if !reflect.DeepEqual(got.Avatar, []byte{1}) {
+		t.Errorf("avatar = %v, want the higher-priority avatar", got.Avatar)
+	}
+}
+
+func TestMergeContacts_First(t *testing.T) {
+	a := &imessage.Contact{FirstName: "Alice"}
+	b := &imessage.Contact{Avatar: []byte{1}, Emails: []string{"a@b.com"}}
+	if got := mergeContacts(contactMergeStrategyFirst, nil, a, b); got != a {
+		t.Errorf("mergeContacts(first) = %+v, want the first non-nil contact", got)
+	}
+}
+
+func TestMergeContacts_Nil(t *testing.T) {
+	if got := mergeContacts(contactMergeStrategyMerge, nil, nil); got != nil {
+		t.Errorf("mergeContacts(nil, nil) = %+v, want nil", got)
+	}
+	single := &imessage.Contact{FirstName: "Bob"}
+	if got := mergeContacts(contactMergeStrategyMerge, nil, single); got != single {
+		t.Errorf("single contact should be returned unchanged, got %+v", got)
+	}
+}
+
+func TestIMConfig_ContactSourceOrder(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  []string
+		want []string
+	}{
+		{"default", nil, []string{"carddav", "chatdb"}},
+		{"reversed", []string{"chatdb", "carddav"}, []string{"chatdb", "carddav"}},
+		{"partial appends rest", []string{"chatdb"}, []string{"chatdb", "carddav"}},
+		{"unknown and duplicates dropped", []string{"relay", "ChatDB", "chatdb"}, []string{"chatdb", "carddav"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &IMConfig{ContactSourcePriority: tt.cfg}
+			if got := c.contactSourceOrder(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("contactSourceOrder() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIMConfig_ContactMergeStrategy(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"", "merge"},
+		{"merge", "merge"},
+		{"first", "first"},
+		{"FIRST", "first"},
+		{"bogus", "merge"},
+	}
+	for _, tt := range tests {
+		c := &IMConfig{ContactMergeStrategy: tt.value}
+		if got := c.contactMergeStrategy(); got != tt.want {
+			t.Errorf("contactMergeStrategy(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
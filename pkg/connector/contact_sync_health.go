@@ -0,0 +1,131 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2024 Ludvig Rhodin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+package connector
+
+// CardDAV contact sync failures (contact_sync_retry_budget).
+//
+// The periodic contact sync runs every 15 minutes, and a failure used to
+// only be logged: with a revoked app password or an expired iCloud
+// delegate, contact names silently stay whatever they were forever. A
+// failed sync is now retried sooner, backing off from
+// contactSyncRetryBase up to the regular interval. Once the retry budget
+// of failed syncs in a row is spent, a bridge state warning says contacts
+// are stale (and the error notice room hears about it). The first
+// successful sync clears it.
+
+import (
+	"time"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridgev2/status"
+)
+
+const (
+	// contactSyncInterval is how often contacts are re-fetched.
+	contactSyncInterval = 15 * time.Minute
+	// contactSyncRetryBase is the delay before the first retry of a failed
+	// sync; each further failure doubles it, up to contactSyncInterval.
+	contactSyncRetryBase = time.Minute
+
+	contactsStaleErrorCode status.BridgeStateErrorCode = "im-contacts-stale"
+)
+
+// contactSyncTransition is a change in the reported contact sync health.
+type contactSyncTransition int
+
+const (
+	contactSyncNoChange contactSyncTransition = iota
+	contactSyncWentStale
+	contactSyncRecovered
+)
+
+// contactSyncHealth tracks consecutive failed contact syncs. budget is how
+// many may fail in a row before contacts are reported stale; zero or
+// negative never reports them.
+type contactSyncHealth struct {
+	budget   int
+	failures int
+	stale    bool
+}
+
+// observe records a sync result and returns the transition to report, if
+// any.
+func (h *contactSyncHealth) observe(ok bool) contactSyncTransition {
+	if ok {
+		h.failures = 0
+		if h.stale {
+			h.stale = false
+			return contactSyncRecovered
+		}
+		return contactSyncNoChange
+	}
+	h.failures++
+	if !h.stale && h.budget > 0 && h.failures >= h.budget {
+		h.stale = true
+		return contactSyncWentStale
+	}
+	return contactSyncNoChange
+}
+
+// nextSync returns the delay before the next sync: the regular interval
+// after a success, otherwise contactSyncRetryBase doubled for each failure
+// after the first, capped at the interval.
+func (h *contactSyncHealth) nextSync() time.Duration {
+	if h.failures == 0 {
+		return contactSyncInterval
+	}
+	delay := contactSyncRetryBase
+	for i := 1; i < h.failures && delay < contactSyncInterval; i++ {
+		delay *= 2
+	}
+	return min(delay, contactSyncInterval)
+}
+
+// contactSyncStateNote returns the bridge state to send for a transition,
+// or nil. Like the relay warning it rides on the connected state, is only
+// raised while connected and is only cleared if it's the state shown.
+func contactSyncStateNote(transition contactSyncTransition, prev status.BridgeState) *status.BridgeState {
+	if prev.StateEvent != status.StateConnected {
+		return nil
+	}
+	switch transition {
+	case contactSyncWentStale:
+		return &status.BridgeState{
+			StateEvent: status.StateConnected,
+			Error:      contactsStaleErrorCode,
+			Message:    "Contact sync keeps failing; contact names may be out of date",
+		}
+	case contactSyncRecovered:
+		if prev.Error == contactsStaleErrorCode {
+			return &status.BridgeState{StateEvent: status.StateConnected}
+		}
+	}
+	return nil
+}
+
+// newContactSyncHealth returns the tracker for this login's periodic sync.
+func (c *IMClient) newContactSyncHealth() *contactSyncHealth {
+	return &contactSyncHealth{budget: c.Main.Config.ContactSyncRetryBudget}
+}
+
+// reportContactSync records a periodic sync result, logging and reporting
+// any change in contact sync health.
+func (c *IMClient) reportContactSync(log zerolog.Logger, health *contactSyncHealth, err error) {
+	transition := health.observe(err == nil)
+	switch transition {
+	case contactSyncWentStale:
+		log.Warn().Err(err).Int("failures", health.failures).Msg("Contact sync keeps failing, contacts are stale")
+		c.reportErrorNotice(errorNoticeContactSyncFailed, "", err)
+	case contactSyncRecovered:
+		log.Info().Msg("Contact sync recovered")
+	}
+	if note := contactSyncStateNote(transition, c.UserLogin.BridgeState.GetPrev()); note != nil {
+		c.UserLogin.BridgeState.Send(*note)
+	}
+}
@@ -0,0 +1,97 @@
+package connector
+
+import (
+	"testing"
+	"time"
+
+	"maunium.net/go/mautrix/bridgev2/status"
+)
+
+func TestContactSyncHealthTransitions(t *testing.T) {
+	h := contactSyncHealth{budget: 3}
+	steps := []struct {
+		ok   bool
+		want contactSyncTransition
+	}{
+		{true, contactSyncNoChange},
+		{false, contactSyncNoChange},
+		{false, contactSyncNoChange},
+		{false, contactSyncWentStale},
+		{false, contactSyncNoChange},
+		{true, contactSyncRecovered},
+		{true, contactSyncNoChange},
+		// A blip shorter than the budget never reports stale.
+		{false, contactSyncNoChange},
+		{true, contactSyncNoChange},
+		{false, contactSyncNoChange},
+		{false, contactSyncNoChange},
+		{false, contactSyncWentStale},
+	}
+	for i, step := range steps {
+		if got := h.observe(step.ok); got != step.want {
+			t.Errorf("step %d: observe(%v) = %v, want %v", i, step.ok, got, step.want)
+		}
+	}
+
+	disabled := contactSyncHealth{budget: 0}
+	for i := 0; i < 20; i++ {
+		if got := disabled.observe(false); got != contactSyncNoChange {
+			t.Fatalf("budget 0: observe(false) #%d = %v, want %v", i, got, contactSyncNoChange)
+		}
+	}
+}
+
+func TestContactSyncHealthNextSync(t *testing.T) {
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, contactSyncInterval},
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{4, 8 * time.Minute},
+		{5, contactSyncInterval},
+		{50, contactSyncInterval},
+	}
+	for _, tt := range tests {
+		h := contactSyncHealth{failures: tt.failures}
+		if got := h.nextSync(); got != tt.want {
+			t.Errorf("nextSync() with %d failures = %v, want %v", tt.failures, got, tt.want)
+		}
+	}
+}
+
+func TestContactSyncStateNote(t *testing.T) {
+	connected := status.BridgeState{StateEvent: status.StateConnected}
+	stale := status.BridgeState{StateEvent: status.StateConnected, Error: contactsStaleErrorCode}
+	tests := []struct {
+		name       string
+		transition contactSyncTransition
+		prev       status.BridgeState
+		wantError  status.BridgeStateErrorCode
+		wantNil    bool
+	}{
+		{"went stale while connected", contactSyncWentStale, connected, contactsStaleErrorCode, false},
+		{"went stale while not connected", contactSyncWentStale, status.BridgeState{StateEvent: status.StateTransientDisconnect}, "", true},
+		{"recovered clears own warning", contactSyncRecovered, stale, "", false},
+		{"recovered keeps other warning", contactSyncRecovered, status.BridgeState{StateEvent: status.StateConnected, Error: relayOfflineErrorCode}, "", true},
+		{"no change", contactSyncNoChange, stale, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := contactSyncStateNote(tt.transition, tt.prev)
+			if tt.wantNil {
+				if got != nil {
+					t.Errorf("contactSyncStateNote() = %+v, want nil", *got)
+				}
+				return
+			}
+			if got == nil {
+				t.Fatalf("contactSyncStateNote() = nil, want a state")
+			}
+			if got.StateEvent != status.StateConnected || got.Error != tt.wantError {
+				t.Errorf("contactSyncStateNote() = %s/%q, want %s/%q", got.StateEvent, got.Error, status.StateConnected, tt.wantError)
+			}
+		})
+	}
+}
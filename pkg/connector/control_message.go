@@ -0,0 +1,46 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2024 Ludvig Rhodin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+package connector
+
+// Content-less control messages.
+//
+// Some iMessage payloads only change state on the sender's devices: an
+// audio message being played, kept or expiring, "mark as unread", "read on
+// another device", unscheduling a send, sticker position updates. The
+// wrapper either flags them (IsMarkUnread, IsMessageReadOnDevice,
+// IsUnschedule, IsUpdateExtension) or, for types it doesn't map, like the
+// audio played/kept state, passes them on as a WrappedMessage with nothing
+// set but the UUID, sender and conversation.
+//
+// handleMessage treats anything that reaches it as a new message: it
+// records the UUID in cloud_message (where it then counts as the newest
+// message of the chat for read state) and can revive a deleted chat, even
+// though nothing gets bridged. OnMessage drops these before the buffer
+// instead. The played state of a voice message can't be reflected on the
+// Matrix side until the wrapper exposes which message was played.
+
+import (
+	"github.com/lrhodin/imessage/pkg/rustpushgo"
+)
+
+// isContentlessMessage reports whether msg carries nothing to bridge as a
+// message. Tapbacks and edits have no content of their own but are handled
+// by the buffer, so they don't count.
+func isContentlessMessage(msg *rustpushgo.WrappedMessage) bool {
+	if msg == nil || msg.IsTapback || msg.IsEdit {
+		return false
+	}
+	if wrappedMessageHasText(msg) || len(msg.Attachments) > 0 {
+		return false
+	}
+	if msg.Html != nil || msg.BalloonBundleId != nil || msg.BalloonUrl != nil || msg.StickerData != nil {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,57 @@
+package connector
+
+import (
+	"testing"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridgev2"
+
+	"github.com/lrhodin/imessage/pkg/rustpushgo"
+)
+
+func TestIsContentlessMessage(t *testing.T) {
+	str := func(s string) *string { return &s }
+	sender := str("tel:+15551234567")
+	tests := []struct {
+		name string
+		msg  rustpushgo.WrappedMessage
+		want bool
+	}{
+		{"audio played", rustpushgo.WrappedMessage{Uuid: "A", Sender: sender, Participants: []string{*sender}}, true},
+		{"mark unread", rustpushgo.WrappedMessage{Uuid: "A", IsMarkUnread: true}, true},
+		{"read on device", rustpushgo.WrappedMessage{Uuid: "A", IsMessageReadOnDevice: true}, true},
+		{"update extension", rustpushgo.WrappedMessage{Uuid: "A", IsUpdateExtension: true, UpdateExtensionForUuid: str("B")}, true},
+		{"only placeholder", rustpushgo.WrappedMessage{Uuid: "A", Text: str("￼")}, true},
+		{"voice message", rustpushgo.WrappedMessage{Uuid: "A", Text: str("￼"), IsVoice: true, Attachments: []rustpushgo.WrappedAttachment{{MimeType: "audio/x-caf", Filename: "Audio Message.caf"}}}, false},
+		{"text", rustpushgo.WrappedMessage{Uuid: "A", Text: str("hi")}, false},
+		{"subject", rustpushgo.WrappedMessage{Uuid: "A", Subject: str("Trip")}, false},
+		{"balloon", rustpushgo.WrappedMessage{Uuid: "A", BalloonBundleId: str("com.apple.messages.URLBalloonProvider")}, false},
+		{"html", rustpushgo.WrappedMessage{Uuid: "A", Html: str("<a href=\"https://facetime.apple.com/join\">FaceTime</a>")}, false},
+		{"tapback", rustpushgo.WrappedMessage{Uuid: "A", IsTapback: true}, false},
+		{"edit", rustpushgo.WrappedMessage{Uuid: "A", IsEdit: true}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isContentlessMessage(&tt.msg); got != tt.want {
+				t.Errorf("isContentlessMessage() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestOnMessageIgnoresAudioPlayed checks that a played/kept notification for
+// an audio message stops in OnMessage: it must not reach the buffer or
+// handleMessage (which would need a bridge and record it as a message).
+func TestOnMessageIgnoresAudioPlayed(t *testing.T) {
+	c := &IMClient{
+		Main:      &IMConnector{metrics: newConnectorMetrics()},
+		UserLogin: &bridgev2.UserLogin{Log: zerolog.Nop()},
+	}
+	sender := "tel:+15551234567"
+	c.OnMessage(rustpushgo.WrappedMessage{Uuid: "PLAYED", Sender: &sender, Participants: []string{sender}, TimestampMs: 1700000000000})
+	c.OnMessage(rustpushgo.WrappedMessage{Uuid: "UNREAD", IsMarkUnread: true})
+
+	if got := c.Main.metrics.messagesReceived.get("control"); got != 2 {
+		t.Errorf("messages_received_total{type=control} = %d, want 2", got)
+	}
+}
@@ -0,0 +1,108 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2024 Ludvig Rhodin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+package connector
+
+// Credential failure detection (detect_apple_id_auth_failure).
+//
+// Connect checks that the keystore still has the signing keys, but an Apple
+// ID whose password was changed, or that Apple locked, passes that check
+// and then fails send by send with errors that look like any other. rustpush
+// only passes Apple's errors through as text, so failed sends and connects
+// are classified by what they say: lost signing keys, an Apple ID
+// authentication failure, or neither. The first two put the login in bad
+// credentials with a message saying what happened, once per session, since
+// nothing works again until the user logs in again. Everything else stays
+// an ordinary failure.
+
+import (
+	"strings"
+
+	"maunium.net/go/mautrix/bridgev2/status"
+)
+
+const (
+	keystoreLostErrorCode      status.BridgeStateErrorCode = "im-keystore-lost"
+	appleIDAuthFailedErrorCode status.BridgeStateErrorCode = "im-apple-id-auth-failed"
+)
+
+// credentialFailure is what kind of login problem an error points to.
+type credentialFailure int
+
+const (
+	credentialFailureNone credentialFailure = iota
+	// credentialFailureKeystore: the signing keys for the saved IDS state
+	// are gone ("Keystore error Key not found").
+	credentialFailureKeystore
+	// credentialFailureAppleID: Apple rejected the account itself.
+	credentialFailureAppleID
+)
+
+// appleIDAuthFailureMarkers are what Apple ID authentication failures say.
+// The GSA codes are Apple's; bare IDS status codes aren't matched, as they
+// also show up for per-recipient lookup failures.
+var appleIDAuthFailureMarkers = []string{
+	"-20101", // incorrect Apple ID or password
+	"-20209", // account locked for security reasons
+	"-22406", // authentication required (see docs/apple-auth-research.md)
+	"account locked",
+	"account is locked",
+	"account has been locked",
+	"account is disabled",
+	"incorrect password",
+	"password was incorrect",
+	"password has changed",
+	"password changed",
+}
+
+// classifyCredentialFailure maps a send or connect error to the login
+// problem it points to, if any.
+func classifyCredentialFailure(err error) credentialFailure {
+	if err == nil {
+		return credentialFailureNone
+	}
+	msg := strings.ToLower(err.Error())
+	if strings.Contains(msg, "keystore") {
+		return credentialFailureKeystore
+	}
+	for _, marker := range appleIDAuthFailureMarkers {
+		if strings.Contains(msg, marker) {
+			return credentialFailureAppleID
+		}
+	}
+	return credentialFailureNone
+}
+
+// checkCredentialFailure reports a login problem behind err as a bad
+// credentials bridge state, once per session. It returns whether err was
+// such a problem.
+func (c *IMClient) checkCredentialFailure(err error) bool {
+	var code status.BridgeStateErrorCode
+	var message string
+	switch classifyCredentialFailure(err) {
+	case credentialFailureKeystore:
+		code, message = keystoreLostErrorCode, "Signing keys lost — please re-login to iMessage"
+	case credentialFailureAppleID:
+		if !c.Main.Config.DetectAppleIDAuthFailure {
+			return false
+		}
+		code, message = appleIDAuthFailedErrorCode, "Apple ID password changed or account locked — please re-login"
+	default:
+		return false
+	}
+	if !c.credentialFailureReported.CompareAndSwap(false, true) {
+		return true
+	}
+	c.UserLogin.Log.Error().Err(err).Str("error_code", string(code)).Msg("Login credentials no longer work")
+	c.UserLogin.BridgeState.Send(status.BridgeState{
+		StateEvent: status.StateBadCredentials,
+		Error:      code,
+		Message:    message,
+	})
+	return true
+}
@@ -0,0 +1,42 @@
+package connector
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestClassifyCredentialFailure(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want credentialFailure
+	}{
+		{"keystore", errors.New("Keystore error Key not found"), credentialFailureKeystore},
+		{"wrapped keystore", fmt.Errorf("send failed: %w", errors.New("keystore error: key not found")), credentialFailureKeystore},
+		{"wrong password", errors.New("Auth error -20101: Your Apple ID or password was incorrect."), credentialFailureAppleID},
+		{"locked", errors.New("Auth error -20209: This Apple ID has been locked for security reasons."), credentialFailureAppleID},
+		{"locked by text", errors.New("account is locked"), credentialFailureAppleID},
+		{"authentication required", errors.New("GSA error -22406"), credentialFailureAppleID},
+		{"no valid targets", errors.New("NoValidTargets"), credentialFailureNone},
+		{"lookup failed", errors.New("IDS lookup failed 6001"), credentialFailureNone},
+		{"share key not found", errors.New("Share key not found for record"), credentialFailureNone},
+		{"timeout", errors.New("Send timed out"), credentialFailureNone},
+		{"nil", nil, credentialFailureNone},
+	}
+	for _, tt := range tests {
+		if got := classifyCredentialFailure(tt.err); got != tt.want {
+			t.Errorf("classifyCredentialFailure(%s) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCheckCredentialFailureDisabled(t *testing.T) {
+	c := &IMClient{Main: &IMConnector{Config: IMConfig{DetectAppleIDAuthFailure: false}}}
+	if c.checkCredentialFailure(errors.New("Auth error -20101")) {
+		t.Errorf("checkCredentialFailure() with detect_apple_id_auth_failure off = true, want false")
+	}
+	if c.checkCredentialFailure(errors.New("Send timed out")) {
+		t.Errorf("checkCredentialFailure() on an ordinary error = true, want false")
+	}
+}
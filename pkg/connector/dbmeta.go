@@ -15,8 +15,18 @@ import (
 type PortalMetadata struct {
 	ThreadID   string `json:"thread_id,omitempty"`
 	SenderGuid string `json:"sender_guid,omitempty"` // Persistent iMessage group UUID
-	GroupName  string `json:"group_name,omitempty"`   // iMessage cv_name for outbound routing
-	IsSms      bool   `json:"is_sms,omitempty"`       // True if this portal routes through SMS
+	GroupName  string `json:"group_name,omitempty"`  // iMessage cv_name for outbound routing
+	IsSms      bool   `json:"is_sms,omitempty"`      // True if this portal routes through SMS
+	SendHandle string `json:"send_handle,omitempty"` // Per-portal outgoing handle override (set-handle)
+	Pinned     bool   `json:"pinned,omitempty"`      // Pinned in Messages; m.favourite was set by the bridge
+
+	// PendingGroup is set on a group created from Matrix until its first
+	// message establishes it on iMessage (see group_create.go).
+	PendingGroup bool `json:"pending_group,omitempty"`
+
+	// ReadReceiptsOffNoticeSent is set once the notice that the contact seems
+	// to have read receipts off was sent (see peer_read_receipts.go).
+	ReadReceiptsOffNoticeSent bool `json:"read_receipts_off_notice_sent,omitempty"`
 }
 
 type GhostMetadata struct{}
@@ -28,6 +38,40 @@ type MessageMetadata struct {
 	// iMessages (attachment + follow-up text). Stored on the primary DB row so
 	// redact/unsend can remove both halves together.
 	SiblingUUID string `json:"sibling_uuid,omitempty"`
+
+	// SplitUUIDs are the follow-up iMessages a long Matrix message was split
+	// into (see long_message_mode), after the one this row is keyed by.
+	// Redact/unsend removes them too.
+	SplitUUIDs []string `json:"split_uuids,omitempty"`
+
+	// DeferredAttachment is set on the notice placeholder of an attachment
+	// that attachment_download_rules kept from being bridged, so the
+	// download command can fetch it later. Cleared once it's fetched.
+	DeferredAttachment *DeferredAttachment `json:"deferred_attachment,omitempty"`
+
+	// LastEditTS is the timestamp (unix ms) of the latest iMessage edit
+	// applied to this part. An edit older than it arrived out of order and
+	// is dropped instead of overwriting the newer text.
+	LastEditTS int64 `json:"last_edit_ts,omitempty"`
+
+	// Subject is the subject line of a text part. iMessage edits usually
+	// carry only the new body, so it's kept here to put back above the
+	// edited text, and replaced when an edit does carry a subject.
+	Subject string `json:"subject,omitempty"`
+}
+
+// DeferredAttachment is what the download command needs to fetch and bridge
+// a deferred attachment.
+type DeferredAttachment struct {
+	MessageGUID    string `json:"message_guid"`
+	AttIndex       int    `json:"att_index"`
+	Sender         string `json:"sender,omitempty"`
+	TimestampMs    int64  `json:"timestamp_ms"`
+	Filename       string `json:"filename"`
+	MimeType       string `json:"mime_type"`
+	UtiType        string `json:"uti_type,omitempty"`
+	SizeBytes      int64  `json:"size_bytes"`
+	MmcsDescriptor string `json:"mmcs_descriptor"`
 }
 
 type UserLoginMetadata struct {
@@ -49,6 +93,17 @@ type UserLoginMetadata struct {
 	// (e.g. "tel:+15551234567" or "mailto:user@example.com").
 	PreferredHandle string `json:"preferred_handle,omitempty"`
 
+	// AccountRegion is the ISO 3166-1 alpha-2 region of the Apple ID's
+	// storefront (e.g. "DE"), detected at login or set with set-region.
+	// Empty when unknown. See account_region.go.
+	AccountRegion string `json:"account_region,omitempty"`
+
+	// SMSRelay records whether the iPhone relays SMS to this bridge: true
+	// once Text Message Forwarding was enabled for it or an SMS came in,
+	// false when forwarding was turned off. nil until either is seen. See
+	// sms_fallback.go.
+	SMSRelay *bool `json:"sms_relay,omitempty"`
+
 	// Per-user feature toggles — overrides the global config when non-nil.
 	// Set during the login flow; nil means "use global config default".
 	VideoTranscoding           *bool   `json:"video_transcoding,omitempty"`
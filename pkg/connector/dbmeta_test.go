@@ -82,6 +82,7 @@ func TestUserLoginMetadata_JSON(t *testing.T) {
 		ChatsSynced:     true,
 		PreferredHandle: "tel:+15551234567",
 		HardwareKey:     "base64stuff",
+		AccountRegion:   "DE",
 	}
 	data, err := json.Marshal(ulm)
 	if err != nil {
@@ -98,6 +99,27 @@ func TestUserLoginMetadata_JSON(t *testing.T) {
 	if ulm2.PreferredHandle != "tel:+15551234567" {
 		t.Errorf("PreferredHandle = %q, want %q", ulm2.PreferredHandle, "tel:+15551234567")
 	}
+	if ulm2.AccountRegion != "DE" {
+		t.Errorf("AccountRegion = %q, want %q", ulm2.AccountRegion, "DE")
+	}
+}
+
+func TestUserLoginMetadata_AccountRegionOmitEmpty(t *testing.T) {
+	data, err := json.Marshal(&UserLoginMetadata{Platform: "darwin"})
+	if err != nil {
+		t.Fatalf("Marshal error: %v", err)
+	}
+	if string(data) != `{"platform":"darwin"}` {
+		t.Errorf("UserLoginMetadata without region marshaled to %s", data)
+	}
+	// Logins saved before the field existed have no region.
+	var ulm UserLoginMetadata
+	if err := json.Unmarshal([]byte(`{"platform":"darwin","preferred_handle":"tel:+15551234567"}`), &ulm); err != nil {
+		t.Fatalf("Unmarshal error: %v", err)
+	}
+	if ulm.AccountRegion != "" {
+		t.Errorf("AccountRegion = %q, want empty", ulm.AccountRegion)
+	}
 }
 
 func TestGhostMetadata_JSON(t *testing.T) {
@@ -0,0 +1,146 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2024 Ludvig Rhodin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+package connector
+
+// Double puppet retries (see ensureDoublePuppet).
+//
+// ensureDoublePuppet logs in again with the saved access token whenever the
+// double puppet is missing, which is every message the user sends from an
+// Apple device. Two failures used to look the same: a transient one (the
+// homeserver briefly unreachable), after which the token was nonetheless
+// dropped, and an expired token, which can never work again. Now a
+// transient failure keeps the token and is retried at most once per
+// doublePuppetRetryInterval, while an expired token (M_UNKNOWN_TOKEN) stops
+// the retries and tells the user, in their management room and the error
+// notice room, to refresh it with login-matrix.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/bridgev2/commands"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/format"
+)
+
+// doublePuppetRetryInterval is how long to wait after a transient failure
+// before trying the saved token again.
+const doublePuppetRetryInterval = time.Minute
+
+// isDoublePuppetTokenExpired reports whether a double puppet login failed
+// because the homeserver no longer accepts the token, as opposed to a
+// failure that may go away on its own.
+func isDoublePuppetTokenExpired(err error) bool {
+	return errors.Is(err, mautrix.MUnknownToken)
+}
+
+// doublePuppetRetryState throttles ensureDoublePuppet. The zero value is
+// ready to use.
+type doublePuppetRetryState struct {
+	mu          sync.Mutex
+	nextAttempt time.Time
+}
+
+// shouldAttempt reports whether to try logging in with token now.
+func (s *doublePuppetRetryState) shouldAttempt(token string, now time.Time) bool {
+	if token == "" {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !now.Before(s.nextAttempt)
+}
+
+// recordFailure notes a failed login and reports whether it was an expired
+// token. Transient failures push the next attempt back.
+func (s *doublePuppetRetryState) recordFailure(err error, now time.Time) (expired bool) {
+	if isDoublePuppetTokenExpired(err) {
+		return true
+	}
+	s.mu.Lock()
+	s.nextAttempt = now.Add(doublePuppetRetryInterval)
+	s.mu.Unlock()
+	return false
+}
+
+// reset clears the backoff after a successful login.
+func (s *doublePuppetRetryState) reset() {
+	s.mu.Lock()
+	s.nextAttempt = time.Time{}
+	s.mu.Unlock()
+}
+
+// restoreDoublePuppetToken puts the token back after a transient failure;
+// LogoutDoublePuppet cleared it before the attempt.
+func (c *IMClient) restoreDoublePuppetToken(ctx context.Context, token string) {
+	user := c.UserLogin.User
+	if user.AccessToken != "" {
+		return
+	}
+	user.AccessToken = token
+	if err := user.Save(ctx); err != nil {
+		c.UserLogin.Log.Warn().Err(err).Msg("Failed to save restored double puppet token")
+	}
+}
+
+// promptDoublePuppetRefresh tells the user their double puppet token has
+// expired and how to replace it.
+func (c *IMClient) promptDoublePuppetRefresh(ctx context.Context, log zerolog.Logger, err error) {
+	c.reportErrorNotice(errorNoticeDoublePuppetExpired, "", err)
+	mgmtRoom, mgmtErr := c.UserLogin.User.GetManagementRoom(ctx)
+	if mgmtErr != nil {
+		log.Warn().Err(mgmtErr).Msg("Failed to get management room for double puppet notice")
+		return
+	}
+	content := format.RenderMarkdown(fmt.Sprintf(doublePuppetExpiredMarkdown, c.Main.Bridge.Config.CommandPrefix), true, false)
+	content.MsgType = event.MsgNotice
+	if _, sendErr := c.Main.Bridge.Bot.SendMessage(ctx, mgmtRoom, event.EventMessage, &event.Content{Parsed: content}, nil); sendErr != nil {
+		log.Warn().Err(sendErr).Msg("Failed to send double puppet notice")
+	}
+}
+
+// doublePuppetExpiredMarkdown is the management room notice. %[1]s is the
+// command prefix.
+const doublePuppetExpiredMarkdown = `⚠️ **Double puppeting stopped working**: your Matrix access token has expired.
+
+Until it's refreshed, messages you send from your Apple devices are bridged as if your iMessage contact sent them. Send ` + "`%[1]s login-matrix <access token>`" + ` with a new access token for your Matrix account to fix it.`
+
+var cmdLoginMatrix = &commands.FullHandler{
+	Name: "login-matrix",
+	Func: fnLoginMatrix,
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionAuth,
+		Description: "Replace the Matrix access token used for double puppeting.",
+		Args:        "<access token>",
+	},
+}
+
+func fnLoginMatrix(ce *commands.Event) {
+	if len(ce.Args) != 1 {
+		ce.Reply("**Usage:** `$cmdprefix login-matrix <access token>`")
+		return
+	}
+	// The token is a secret; don't leave it in the room.
+	ce.Redact()
+	if err := ce.User.LoginDoublePuppet(ce.Ctx, ce.Args[0]); err != nil {
+		ce.Reply("Failed to set up double puppeting: %v", err)
+		return
+	}
+	for _, login := range ce.User.GetUserLogins() {
+		if client, ok := login.Client.(*IMClient); ok && client != nil {
+			client.doublePuppetRetry.reset()
+		}
+	}
+	ce.Reply("Double puppeting is set up again.")
+}
@@ -0,0 +1,82 @@
+package connector
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"maunium.net/go/mautrix"
+)
+
+func TestIsDoublePuppetTokenExpired(t *testing.T) {
+	httpErr := func(code string) error {
+		return mautrix.HTTPError{RespError: &mautrix.RespError{ErrCode: code, Err: "nope"}}
+	}
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"unknown token", httpErr("M_UNKNOWN_TOKEN"), true},
+		{"wrapped unknown token", fmt.Errorf("failed to get own user ID: %w", httpErr("M_UNKNOWN_TOKEN")), true},
+		{"rate limited", httpErr("M_LIMIT_EXCEEDED"), false},
+		{"forbidden", httpErr("M_FORBIDDEN"), false},
+		{"network", errors.New("dial tcp: connection refused"), false},
+		{"nil", nil, false},
+	}
+	for _, tt := range tests {
+		if got := isDoublePuppetTokenExpired(tt.err); got != tt.want {
+			t.Errorf("isDoublePuppetTokenExpired(%s) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDoublePuppetRetryState(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	transient := errors.New("dial tcp: connection refused")
+	expired := fmt.Errorf("failed to get own user ID: %w", mautrix.HTTPError{RespError: &mautrix.RespError{ErrCode: "M_UNKNOWN_TOKEN"}})
+
+	var s doublePuppetRetryState
+	if s.shouldAttempt("", now) {
+		t.Errorf("shouldAttempt() with no token = true, want false")
+	}
+	if !s.shouldAttempt("token", now) {
+		t.Errorf("shouldAttempt() on the zero value = false, want true")
+	}
+
+	// A transient failure backs off for the interval, then allows a retry.
+	if s.recordFailure(transient, now) {
+		t.Errorf("recordFailure(%v) = true, want false", transient)
+	}
+	tests := []struct {
+		after time.Duration
+		want  bool
+	}{
+		{0, false},
+		{doublePuppetRetryInterval - time.Second, false},
+		{doublePuppetRetryInterval, true},
+		{2 * doublePuppetRetryInterval, true},
+	}
+	for _, tt := range tests {
+		if got := s.shouldAttempt("token", now.Add(tt.after)); got != tt.want {
+			t.Errorf("shouldAttempt() %v after a transient failure = %v, want %v", tt.after, got, tt.want)
+		}
+	}
+	s.reset()
+	if !s.shouldAttempt("token", now) {
+		t.Errorf("shouldAttempt() after reset() = false, want true")
+	}
+
+	// An expired token is reported as such and doesn't set a backoff: the
+	// caller leaves the token cleared instead, which stops the retries.
+	if !s.recordFailure(expired, now) {
+		t.Errorf("recordFailure(%v) = false, want true", expired)
+	}
+	if !s.shouldAttempt("new token", now) {
+		t.Errorf("shouldAttempt() with a refreshed token after expiry = false, want true")
+	}
+	if s.shouldAttempt("", now) {
+		t.Errorf("shouldAttempt() with the cleared token after expiry = true, want false")
+	}
+}
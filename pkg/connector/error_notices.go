@@ -0,0 +1,185 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2024 Ludvig Rhodin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+package connector
+
+// Bridge error notices (error_notice_room).
+//
+// Failures an operator should know about otherwise only show up in the
+// process log, which hosted setups often can't read. With a notice room
+// configured, they're also posted there by the bridge bot: failed sends,
+// failed CloudKit syncs, the NAC relay going offline, failed connects
+// (which is where registration and NAC validation errors surface),
+// contact syncs that keep failing and expired double puppet tokens. Each
+// notice is an m.notice with a readable body and the same facts as a
+// structured errorNotice under errorNoticeContentKey, for tooling that
+// watches the room. A notice identical to one sent within
+// errorNoticeRepeatWindow is dropped, so a retry loop doesn't flood the
+// room. Like the metrics, the sink is
+// nil-safe: without a room it's nil and reporting does nothing.
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	errorNoticeSendFailed          = "send_failed"
+	errorNoticeSyncFailed          = "sync_failed"
+	errorNoticeRelayOffline        = "relay_offline"
+	errorNoticeConnectFailed       = "connect_failed"
+	errorNoticeContactSyncFailed   = "contact_sync_failed"
+	errorNoticeDoublePuppetExpired = "double_puppet_expired"
+)
+
+// errorNoticeContentKey holds the structured errorNotice in the event content.
+const errorNoticeContentKey = "fi.mau.imessage.error_notice"
+
+// errorNoticeRepeatWindow is how long an identical notice is suppressed.
+const errorNoticeRepeatWindow = 10 * time.Minute
+
+// errorNotice is one reported failure.
+type errorNotice struct {
+	Kind   string `json:"kind"`
+	Login  string `json:"login,omitempty"`
+	Portal string `json:"portal,omitempty"`
+	Reason string `json:"reason,omitempty"`
+	Error  string `json:"error"`
+}
+
+var errorNoticeTitles = map[string]string{
+	errorNoticeSendFailed:          "Send to iMessage failed",
+	errorNoticeSyncFailed:          "CloudKit sync failed",
+	errorNoticeRelayOffline:        "NAC relay offline",
+	errorNoticeConnectFailed:       "iMessage connect failed",
+	errorNoticeContactSyncFailed:   "Contact sync keeps failing",
+	errorNoticeDoublePuppetExpired: "Double puppet access token expired",
+}
+
+// body renders the notice as the plain-text message body.
+func (n errorNotice) body() string {
+	title, ok := errorNoticeTitles[n.Kind]
+	if !ok {
+		title = n.Kind
+	}
+	body := "⚠️ " + title
+	if n.Login != "" {
+		body += " (login " + n.Login + ")"
+	}
+	if n.Portal != "" {
+		body += "\nChat: " + n.Portal
+	}
+	if n.Reason != "" {
+		body += "\nReason: " + n.Reason
+	}
+	return body + "\nError: " + n.Error
+}
+
+// content builds the Matrix event for the notice.
+func (n errorNotice) content() *event.Content {
+	return &event.Content{
+		Parsed: &event.MessageEventContent{
+			MsgType:  event.MsgNotice,
+			Body:     n.body(),
+			Mentions: &event.Mentions{},
+		},
+		Raw: map[string]any{errorNoticeContentKey: n},
+	}
+}
+
+// errorNoticeSink posts errorNotices to the notice room.
+type errorNoticeSink struct {
+	roomID id.RoomID
+	send   func(ctx context.Context, roomID id.RoomID, content *event.Content) error
+	now    func() time.Time
+	log    zerolog.Logger
+
+	mu       sync.Mutex
+	lastSent map[errorNotice]time.Time
+}
+
+func newErrorNoticeSink(c *IMConnector, roomID id.RoomID) *errorNoticeSink {
+	return &errorNoticeSink{
+		roomID: roomID,
+		send: func(ctx context.Context, roomID id.RoomID, content *event.Content) error {
+			_, err := c.Bridge.Bot.SendMessage(ctx, roomID, event.EventMessage, content, nil)
+			return err
+		},
+		now: time.Now,
+		log: c.Bridge.Log.With().Str("component", "error_notices").Logger(),
+	}
+}
+
+// shouldSend reports whether n is new enough to post, recording it if so.
+func (s *errorNoticeSink) shouldSend(n errorNotice) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	if s.lastSent == nil {
+		s.lastSent = make(map[errorNotice]time.Time)
+	}
+	for k, t := range s.lastSent {
+		if now.Sub(t) >= errorNoticeRepeatWindow {
+			delete(s.lastSent, k)
+		}
+	}
+	if _, ok := s.lastSent[n]; ok {
+		return false
+	}
+	s.lastSent[n] = now
+	return true
+}
+
+// report posts n to the notice room in the background, so callers on a
+// send or sync path don't wait on the homeserver. Returns a channel closed
+// once the notice is sent or dropped.
+func (s *errorNoticeSink) report(n errorNotice) <-chan struct{} {
+	done := make(chan struct{})
+	if s == nil || !s.shouldSend(n) {
+		close(done)
+		return done
+	}
+	go func() {
+		defer close(done)
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := s.send(ctx, s.roomID, n.content()); err != nil {
+			s.log.Warn().Err(err).Str("kind", n.Kind).Msg("Failed to post error notice")
+		}
+	}()
+	return done
+}
+
+// reportErrorNotice posts a failure of this login to the notice room, if
+// one is configured.
+func (c *IMClient) reportErrorNotice(kind, portalID string, err error) {
+	if c.Main.errorNotices == nil || err == nil {
+		return
+	}
+	c.Main.errorNotices.report(errorNotice{
+		Kind:   kind,
+		Login:  string(c.UserLogin.ID),
+		Portal: portalID,
+		Reason: errorNoticeReason(kind, err),
+		Error:  err.Error(),
+	})
+}
+
+// errorNoticeReason gives send failures the same reason label as the
+// send-errors metric.
+func errorNoticeReason(kind string, err error) string {
+	if kind == errorNoticeSendFailed {
+		return sendErrorReason(err)
+	}
+	return ""
+}
@@ -0,0 +1,114 @@
+package connector
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+type sentNotice struct {
+	roomID  id.RoomID
+	content *event.Content
+}
+
+func newTestErrorNoticeSink(roomID id.RoomID, now *time.Time) (*errorNoticeSink, chan sentNotice) {
+	sent := make(chan sentNotice, 10)
+	return &errorNoticeSink{
+		roomID: roomID,
+		send: func(_ context.Context, roomID id.RoomID, content *event.Content) error {
+			sent <- sentNotice{roomID, content}
+			return nil
+		},
+		now: func() time.Time { return *now },
+		log: zerolog.Nop(),
+	}, sent
+}
+
+func TestErrorNoticeRoutedToRoom(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	sink, sent := newTestErrorNoticeSink("!notices:example.com", &now)
+	c := &IMClient{
+		Main:      &IMConnector{errorNotices: sink},
+		UserLogin: &bridgev2.UserLogin{UserLogin: &database.UserLogin{ID: "login1"}, Log: zerolog.Nop()},
+	}
+	c.sendFinished("message", &bridgev2.Portal{Portal: &database.Portal{PortalKey: networkid.PortalKey{ID: "tel:+15551234567"}}}, now, errors.New("NoValidTargets"))
+
+	var got sentNotice
+	select {
+	case got = <-sent:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no notice sent")
+	}
+	if got.roomID != "!notices:example.com" {
+		t.Errorf("notice room = %s, want !notices:example.com", got.roomID)
+	}
+	msg, ok := got.content.Parsed.(*event.MessageEventContent)
+	if !ok || msg.MsgType != event.MsgNotice {
+		t.Fatalf("notice content = %#v, want m.notice", got.content.Parsed)
+	}
+	for _, want := range []string{"Send to iMessage failed", "login1", "tel:+15551234567", "no_valid_targets", "NoValidTargets"} {
+		if !strings.Contains(msg.Body, want) {
+			t.Errorf("notice body = %q, missing %q", msg.Body, want)
+		}
+	}
+	wantNotice := errorNotice{
+		Kind:   errorNoticeSendFailed,
+		Login:  "login1",
+		Portal: "tel:+15551234567",
+		Reason: "no_valid_targets",
+		Error:  "NoValidTargets",
+	}
+	if structured := got.content.Raw[errorNoticeContentKey]; structured != wantNotice {
+		t.Errorf("structured notice = %#v, want %#v", structured, wantNotice)
+	}
+}
+
+func TestErrorNoticeSinkSuppressesRepeats(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	sink, _ := newTestErrorNoticeSink("!notices:example.com", &now)
+	syncErr := errorNotice{Kind: errorNoticeSyncFailed, Login: "login1", Error: "timed out"}
+	relayErr := errorNotice{Kind: errorNoticeRelayOffline, Login: "login1", Error: "connection refused"}
+
+	steps := []struct {
+		name    string
+		advance time.Duration
+		notice  errorNotice
+		want    bool
+	}{
+		{"first notice", 0, syncErr, true},
+		{"repeat within window", time.Minute, syncErr, false},
+		{"different notice", 0, relayErr, true},
+		{"repeat after window", errorNoticeRepeatWindow, syncErr, true},
+	}
+	for _, step := range steps {
+		now = now.Add(step.advance)
+		if got := sink.shouldSend(step.notice); got != step.want {
+			t.Errorf("%s: shouldSend() = %v, want %v", step.name, got, step.want)
+		}
+	}
+}
+
+func TestErrorNoticeWithoutRoom(t *testing.T) {
+	c := &IMClient{
+		Main:      &IMConnector{},
+		UserLogin: &bridgev2.UserLogin{Log: zerolog.Nop()},
+	}
+	// Must not panic without a sink.
+	c.reportErrorNotice(errorNoticeSyncFailed, "", errors.New("boom"))
+
+	var sink *errorNoticeSink
+	select {
+	case <-sink.report(errorNotice{Kind: errorNoticeSyncFailed, Error: "boom"}):
+	default:
+		t.Error("report() on nil sink didn't finish immediately")
+	}
+}
@@ -152,8 +152,8 @@ func (c *externalCardDAVClient) SyncContacts(log zerolog.Logger) error {
 	for _, contact := range allContacts {
 		if contact.HasName() {
 			log.Debug().
-				Str("first", contact.FirstName).
-				Str("last", contact.LastName).
+				Str("first", logText(contact.FirstName)).
+				Str("last", logText(contact.LastName)).
 				Strs("phones", contact.Phones).
 				Strs("emails", contact.Emails).
 				Bool("has_photo", contact.Avatar != nil).
@@ -231,7 +231,7 @@ func (c *externalCardDAVClient) discoverPrincipal(log zerolog.Logger) (string, e
 
 	href := extractPropValue(data, "current-user-principal")
 	if href == "" {
-		log.Debug().Str("body", string(data[:min(len(data), 2000)])).Msg("External CardDAV: PROPFIND response (no principal)")
+		log.Debug().Str("body", logText(string(data[:min(len(data), 2000)]))).Msg("External CardDAV: PROPFIND response (no principal)")
 		return "", fmt.Errorf("no current-user-principal in response")
 	}
 
@@ -371,7 +371,7 @@ func (c *externalCardDAVClient) parseAddressBookList(data []byte, homeSetURL str
 			if ps.Prop.ResourceType.AddressBook != nil {
 				log.Debug().
 					Str("href", href).
-					Str("name", ps.Prop.DisplayName).
+					Str("name", logText(ps.Prop.DisplayName)).
 					Msg("External CardDAV: found address book")
 				addressBooks = append(addressBooks, href)
 			}
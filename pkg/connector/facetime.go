@@ -1047,6 +1047,52 @@ func extractFaceTimeGuid(text string) string {
 	return strings.TrimSpace(rest)
 }
 
+// faceTimeCallEvent is a FaceTime call event the bridge posts a notice for.
+type faceTimeCallEvent int
+
+const (
+	faceTimeCallIncoming faceTimeCallEvent = iota
+	faceTimeCallMissed
+	faceTimeCallAnsweredElsewhere
+	// faceTimeCallOutgoing is a call the user placed from another device;
+	// only chat.db records those.
+	faceTimeCallOutgoing
+)
+
+// faceTimeCallHeadline is the first line of a call notice. name is who
+// called; it's left out when empty, e.g. for backfilled calls that are
+// already sent as the caller's ghost.
+func faceTimeCallHeadline(ev faceTimeCallEvent, name string) string {
+	from := ""
+	if name != "" {
+		from = " from " + name
+	}
+	switch ev {
+	case faceTimeCallMissed:
+		return "📞 Missed FaceTime call" + from + "."
+	case faceTimeCallAnsweredElsewhere:
+		return "📞 Incoming FaceTime call was answered on another device."
+	case faceTimeCallOutgoing:
+		return "📞 Outgoing FaceTime call."
+	default:
+		return "📞 Incoming FaceTime call" + from + "."
+	}
+}
+
+// faceTimeCallNoticeMarkdown renders a call notice: the headline in bold
+// and, when there's a join link, a button for it. joinLabel is the
+// button's text.
+func faceTimeCallNoticeMarkdown(ev faceTimeCallEvent, name, joinLabel, link string) string {
+	headline := faceTimeCallHeadline(ev, name)
+	// Bold everything after the emoji, which stays outside the markers.
+	emoji, text, _ := strings.Cut(headline, " ")
+	markdown := emoji + " **" + text + "**"
+	if link != "" {
+		markdown += "\n\n[**" + joinLabel + "**](" + link + ")"
+	}
+	return markdown
+}
+
 func firstFaceTimeLinkInText(text string) string {
 	for _, candidate := range faceTimeURLRegex.FindAllString(text, -1) {
 		if normalized := normalizeFaceTimeLink(candidate); normalized != "" {
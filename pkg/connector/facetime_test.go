@@ -0,0 +1,46 @@
+package connector
+
+import "testing"
+
+func TestFaceTimeCallHeadline(t *testing.T) {
+	tests := []struct {
+		name string
+		ev   faceTimeCallEvent
+		who  string
+		want string
+	}{
+		{"incoming", faceTimeCallIncoming, "Alice", "📞 Incoming FaceTime call from Alice."},
+		{"incoming without name", faceTimeCallIncoming, "", "📞 Incoming FaceTime call."},
+		{"missed", faceTimeCallMissed, "+15551234567", "📞 Missed FaceTime call from +15551234567."},
+		{"answered elsewhere", faceTimeCallAnsweredElsewhere, "Alice", "📞 Incoming FaceTime call was answered on another device."},
+		{"outgoing", faceTimeCallOutgoing, "", "📞 Outgoing FaceTime call."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := faceTimeCallHeadline(tt.ev, tt.who); got != tt.want {
+				t.Errorf("faceTimeCallHeadline() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFaceTimeCallNoticeMarkdown(t *testing.T) {
+	tests := []struct {
+		name  string
+		ev    faceTimeCallEvent
+		label string
+		link  string
+		want  string
+	}{
+		{"no link", faceTimeCallMissed, "", "", "📞 **Missed FaceTime call from Alice.**"},
+		{"join link", faceTimeCallIncoming, "Answer FaceTime call", "https://facetime.apple.com/join#v=1&p=abc",
+			"📞 **Incoming FaceTime call from Alice.**\n\n[**Answer FaceTime call**](https://facetime.apple.com/join#v=1&p=abc)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := faceTimeCallNoticeMarkdown(tt.ev, "Alice", tt.label, tt.link); got != tt.want {
+				t.Errorf("faceTimeCallNoticeMarkdown() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,218 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2024 Ludvig Rhodin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+package connector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/event"
+)
+
+// Retrying attachments whose Matrix upload failed (failed_upload_retry_attempts).
+//
+// The attachment itself downloaded fine, but the homeserver rejected or
+// dropped the upload. Failing the whole message would lose the media for
+// good: the MMCS link expires and the file may be gone from CloudKit by the
+// time anyone notices. Instead the downloaded bytes go into
+// pending_attachment_retry together with the MMCS descriptor, a notice
+// placeholder is bridged, and attachmentRetrier re-runs the upload as an
+// edit of the placeholder. Live messages, CloudKit backfill and chat.db
+// backfill all queue their failed uploads this way.
+//
+// Bytes up to failedUploadMaxInlineBytes are kept in the row itself. Larger
+// files are spilled to failedUploadDir, so a queue of failed video uploads
+// doesn't bloat the database or every retrier batch read.
+
+// failedUploadMaxInlineBytes is the largest attachment kept in inline_data.
+const failedUploadMaxInlineBytes = 1 << 20
+
+// failedUploadPlaceholderGrace is how long the retrier waits for the
+// placeholder of a failed upload to show up in the message DB before giving
+// up on it. Backfilled placeholders are only stored once bridgev2 has sent
+// the batch they're in.
+const failedUploadPlaceholderGrace = 30 * time.Minute
+
+// errAttachmentUpload wraps the error from uploading an attachment's main
+// file in convertAttachment.
+var errAttachmentUpload = errors.New("failed to upload attachment")
+
+// failedUploadDir returns the directory failed uploads too big for
+// inline_data are spilled to:
+// ~/.local/share/mautrix-imessage/failed_uploads
+func failedUploadDir() (string, error) {
+	dataDir := os.Getenv("XDG_DATA_HOME")
+	if dataDir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		dataDir = filepath.Join(home, ".local", "share")
+	}
+	return filepath.Join(dataDir, "mautrix-imessage", "failed_uploads"), nil
+}
+
+// retainData keeps data for the retry: in InlineData if it's small enough,
+// otherwise in a file under failedUploadDir named by DataPath. The file
+// name only depends on the row's key, so queuing the same attachment again
+// overwrites it instead of leaving a stray copy.
+func (r *pendingAttachmentRow) retainData(data []byte) error {
+	if len(data) <= failedUploadMaxInlineBytes {
+		r.InlineData = data
+		return nil
+	}
+	dir, err := failedUploadDir()
+	if err != nil {
+		return err
+	}
+	dir = filepath.Join(dir, url.PathEscape(string(r.LoginID)))
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create failed upload directory: %w", err)
+	}
+	path := filepath.Join(dir, fmt.Sprintf("%s_%d", url.PathEscape(r.MessageGUID), r.AttIndex))
+	if err = os.WriteFile(path, data, 0600); err != nil {
+		return fmt.Errorf("failed to spill attachment to disk: %w", err)
+	}
+	r.DataPath = path
+	return nil
+}
+
+// hasRetainedData reports whether the row is a failed upload with its bytes
+// kept, rather than a download to retry.
+func (r *pendingAttachmentRow) hasRetainedData() bool {
+	return len(r.InlineData) > 0 || r.DataPath != ""
+}
+
+// retainedData returns the bytes kept by retainData.
+func (r *pendingAttachmentRow) retainedData() ([]byte, error) {
+	if r.DataPath == "" {
+		return r.InlineData, nil
+	}
+	return os.ReadFile(r.DataPath)
+}
+
+// discardRetainedData removes the file the row's bytes were spilled to.
+func (r *pendingAttachmentRow) discardRetainedData() {
+	if r.DataPath != "" {
+		_ = os.Remove(r.DataPath)
+	}
+}
+
+// queueFailedUpload queues row, an attachment whose upload failed, for
+// retry with its downloaded bytes. It fills in the login and schedule.
+// Returns false when the retry is disabled or the attachment can't be
+// queued, in which case the upload error should fail the attachment as
+// before.
+func (c *IMClient) queueFailedUpload(ctx context.Context, row *pendingAttachmentRow, data []byte, uploadErr error) bool {
+	maxAttempts := c.Main.Config.FailedUploadRetryAttempts
+	if maxAttempts <= 0 || c.pendingAttachments == nil || len(data) == 0 {
+		return false
+	}
+	log := zerolog.Ctx(ctx).With().
+		Str("msg_guid", row.MessageGUID).
+		Int("att_index", row.AttIndex).
+		Str("file", row.Filename).
+		Logger()
+
+	row.LoginID = c.UserLogin.ID
+	row.SizeBytes = int64(len(data))
+	row.MaxAttempts = maxAttempts
+	now := time.Now()
+	row.CreatedAt = now
+	row.NextAttemptAt = now.Add(attachmentRetrierBackoff(1))
+	if err := row.retainData(data); err != nil {
+		log.Err(err).AnErr("upload_err", uploadErr).Msg("Failed to keep attachment for upload retry")
+		return false
+	}
+	if err := c.insertPendingAttachment(ctx, row); err != nil {
+		row.discardRetainedData()
+		log.Err(err).AnErr("upload_err", uploadErr).Msg("Failed to queue attachment for upload retry")
+		return false
+	}
+	log.Warn().Err(uploadErr).Int("max_attempts", maxAttempts).Bool("spilled", row.DataPath != "").
+		Msg("Attachment upload failed; queued for retry")
+	return true
+}
+
+// failedUploadPlaceholder is the notice bridged in place of an attachment
+// queued by queueFailedUpload. Its part ID is what the retrier's edit
+// targets.
+func failedUploadPlaceholder(index int, filename string) *bridgev2.ConvertedMessage {
+	if filename == "" {
+		filename = "attachment"
+	}
+	return &bridgev2.ConvertedMessage{
+		Parts: []*bridgev2.ConvertedMessagePart{{
+			ID:   networkid.PartID(attachmentPartID(index)),
+			Type: event.EventMessage,
+			Content: &event.MessageEventContent{
+				MsgType: event.MsgNotice,
+				Body:    fmt.Sprintf("Attachment could not be uploaded (%s); retrying in the background.", filename),
+			},
+			DBMetadata: &MessageMetadata{HasAttachments: true},
+		}},
+	}
+}
+
+// enqueueFailedUpload queues a live attachment whose upload failed for
+// retry and returns the placeholder to bridge in its place, or nil if it
+// wasn't queued.
+func (c *IMClient) enqueueFailedUpload(ctx context.Context, portal *bridgev2.Portal, attMsg *attachmentMessage, uploadErr error) *bridgev2.ConvertedMessage {
+	att := attMsg.Attachment
+	if portal == nil || att == nil || att.InlineData == nil {
+		return nil
+	}
+	row := &pendingAttachmentRow{
+		MessageGUID: attMsg.Uuid,
+		AttIndex:    attMsg.Index,
+		AttID:       makeAttID(attMsg.Uuid, attMsg.Index, wrappedMessageHasText(attMsg.WrappedMessage)),
+		PortalID:    string(portal.ID),
+		Filename:    att.Filename,
+		MimeType:    att.MimeType,
+		UtiType:     att.UtiType,
+	}
+	if att.MmcsDescriptorJson != nil {
+		row.MmcsDescriptor = *att.MmcsDescriptorJson
+	}
+	if attMsg.WrappedMessage != nil {
+		row.TimestampMs = int64(attMsg.TimestampMs)
+		if attMsg.Sender != nil {
+			row.Sender = *attMsg.Sender
+		}
+	}
+	if !c.queueFailedUpload(ctx, row, *att.InlineData, uploadErr) {
+		return nil
+	}
+	cm := failedUploadPlaceholder(attMsg.Index, att.Filename)
+	cm.ReplyTo = wrappedReplyTarget(attMsg.WrappedMessage)
+	return cm
+}
+
+// failedBackfillUpload queues a backfilled attachment whose upload failed
+// and returns the placeholder to backfill in its place, or nil if it wasn't
+// queued. The retrier's edit comes from the same sender as the placeholder.
+func (c *IMClient) failedBackfillUpload(ctx context.Context, portalID networkid.PortalID, row *pendingAttachmentRow, data []byte, uploadErr error, sender bridgev2.EventSender, ts time.Time) *bridgev2.ConvertedMessage {
+	row.PortalID = string(portalID)
+	row.TimestampMs = ts.UnixMilli()
+	if !sender.IsFromMe {
+		row.Sender = string(sender.Sender)
+	}
+	if !c.queueFailedUpload(ctx, row, data, uploadErr) {
+		return nil
+	}
+	return failedUploadPlaceholder(row.AttIndex, row.Filename)
+}
@@ -0,0 +1,221 @@
+package connector
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/lrhodin/imessage/imessage"
+	"github.com/lrhodin/imessage/pkg/rustpushgo"
+)
+
+// failingUploadIntent is a MatrixAPI whose uploads always fail.
+type failingUploadIntent struct {
+	bridgev2.MatrixAPI
+}
+
+func (failingUploadIntent) UploadMedia(context.Context, id.RoomID, []byte, string, string) (id.ContentURIString, *event.EncryptedFileInfo, error) {
+	return "", nil, errors.New("502 Bad Gateway")
+}
+
+func TestConvertLiveAttachmentQueuesFailedUpload(t *testing.T) {
+	ctx := context.Background()
+	db := newTestBridgeDB(t)
+	pending := newPendingAttachmentStore(db.Database, "login")
+	if err := pending.ensureSchema(ctx); err != nil {
+		t.Fatalf("ensureSchema() error = %v", err)
+	}
+	c := &IMClient{
+		Main:               &IMConnector{Bridge: &bridgev2.Bridge{DB: db}},
+		UserLogin:          &bridgev2.UserLogin{UserLogin: &database.UserLogin{ID: "login"}, Log: zerolog.Nop()},
+		pendingAttachments: pending,
+	}
+	portal := &bridgev2.Portal{Portal: &database.Portal{PortalKey: networkid.PortalKey{ID: "tel:+15551234567", Receiver: "login"}}}
+
+	text := "see attached"
+	sender := "tel:+15551234567"
+	descriptor := `{"url":"https://example.com/mmcs"}`
+	fileData := []byte("%PDF-1.4 not really a pdf")
+	attMsg := &attachmentMessage{
+		WrappedMessage: &rustpushgo.WrappedMessage{Uuid: "MSG-1", Text: &text, Sender: &sender, TimestampMs: 1700000000000},
+		Attachment: &rustpushgo.WrappedAttachment{
+			MimeType:           "application/pdf",
+			Filename:           "report.pdf",
+			Size:               uint64(len(fileData)),
+			IsInline:           true,
+			InlineData:         &fileData,
+			MmcsDescriptorJson: &descriptor,
+		},
+		Index: 0,
+	}
+
+	// Disabled: the upload error fails the message and nothing is queued.
+	if cm, err := c.convertLiveAttachment(ctx, portal, failingUploadIntent{}, attMsg); cm != nil || !errors.Is(err, errAttachmentUpload) {
+		t.Errorf("convertLiveAttachment() when disabled = %v, %v, want errAttachmentUpload", cm, err)
+	}
+	if row, err := pending.GetOne(ctx, "MSG-1", 0); err != nil || row != nil {
+		t.Fatalf("GetOne() when disabled = %v, %v, want no row", row, err)
+	}
+
+	c.Main.Config.FailedUploadRetryAttempts = 5
+	cm, err := c.convertLiveAttachment(ctx, portal, failingUploadIntent{}, attMsg)
+	if err != nil {
+		t.Fatalf("convertLiveAttachment() error = %v", err)
+	}
+	if len(cm.Parts) != 1 || cm.Parts[0].ID != "att0" || cm.Parts[0].Content.MsgType != event.MsgNotice {
+		t.Fatalf("convertLiveAttachment() parts = %+v, want one att0 notice", cm.Parts)
+	}
+	if meta, ok := cm.Parts[0].DBMetadata.(*MessageMetadata); !ok || !meta.HasAttachments {
+		t.Errorf("placeholder metadata = %+v, want HasAttachments", cm.Parts[0].DBMetadata)
+	}
+
+	row, err := pending.GetOne(ctx, "MSG-1", 0)
+	if err != nil || row == nil {
+		t.Fatalf("GetOne() = %v, %v, want queued row", row, err)
+	}
+	// The message has text, so the attachment is MSG-1_att0 (see makeAttID).
+	if row.AttID != "MSG-1_att0" {
+		t.Errorf("row.AttID = %q, want %q", row.AttID, "MSG-1_att0")
+	}
+	if !bytes.Equal(row.InlineData, fileData) {
+		t.Errorf("row.InlineData = %q, want %q", row.InlineData, fileData)
+	}
+	if row.MmcsDescriptor != descriptor {
+		t.Errorf("row.MmcsDescriptor = %q, want %q", row.MmcsDescriptor, descriptor)
+	}
+	if row.MaxAttempts != 5 || row.maxAttempts() != 5 {
+		t.Errorf("row.MaxAttempts = %d, want 5", row.MaxAttempts)
+	}
+	if row.PortalID != string(portal.ID) || row.Sender != sender || row.TimestampMs != 1700000000000 {
+		t.Errorf("row = %+v, want portal, sender and timestamp of the message", row)
+	}
+	if !row.NextAttemptAt.After(row.CreatedAt) {
+		t.Errorf("row.NextAttemptAt = %v, want after CreatedAt %v", row.NextAttemptAt, row.CreatedAt)
+	}
+}
+
+// newFailedUploadTestClient returns a client with failed upload retries on
+// and an empty pending_attachment_retry table.
+func newFailedUploadTestClient(t *testing.T) *IMClient {
+	t.Helper()
+	db := newTestBridgeDB(t)
+	pending := newPendingAttachmentStore(db.Database, "login")
+	if err := pending.ensureSchema(context.Background()); err != nil {
+		t.Fatalf("ensureSchema() error = %v", err)
+	}
+	c := &IMClient{
+		Main:               &IMConnector{Bridge: &bridgev2.Bridge{DB: db}},
+		UserLogin:          &bridgev2.UserLogin{UserLogin: &database.UserLogin{ID: "login"}, Log: zerolog.Nop()},
+		pendingAttachments: pending,
+	}
+	c.Main.Config.FailedUploadRetryAttempts = 3
+	return c
+}
+
+func TestFailedBackfillUploadSpillsLargeFiles(t *testing.T) {
+	t.Setenv("XDG_DATA_HOME", t.TempDir())
+	ctx := context.Background()
+	c := newFailedUploadTestClient(t)
+	sender := bridgev2.EventSender{Sender: "tel:+15551234567"}
+	ts := time.UnixMilli(1700000000000)
+	tests := []struct {
+		name    string
+		guid    string
+		size    int
+		spilled bool
+	}{
+		{"small file inline", "SMALL", failedUploadMaxInlineBytes, false},
+		{"large file on disk", "LARGE", failedUploadMaxInlineBytes + 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := bytes.Repeat([]byte{0xAB}, tt.size)
+			cm := c.failedBackfillUpload(ctx, "tel:+15551234567", &pendingAttachmentRow{
+				MessageGUID: tt.guid,
+				AttIndex:    1,
+				AttID:       tt.guid + "_att1",
+				Filename:    "clip.mov",
+				MimeType:    "video/quicktime",
+			}, data, errors.New("502 Bad Gateway"), sender, ts)
+			if cm == nil || len(cm.Parts) != 1 || cm.Parts[0].ID != "att1" || cm.Parts[0].Content.MsgType != event.MsgNotice {
+				t.Fatalf("failedBackfillUpload() = %+v, want one att1 notice", cm)
+			}
+			row, err := c.pendingAttachments.GetOne(ctx, tt.guid, 1)
+			if err != nil || row == nil {
+				t.Fatalf("GetOne() = %v, %v, want queued row", row, err)
+			}
+			if row.Sender != string(sender.Sender) || row.TimestampMs != ts.UnixMilli() || row.PortalID != "tel:+15551234567" {
+				t.Errorf("row = %+v, want sender, timestamp and portal of the backfilled message", row)
+			}
+			if (row.DataPath != "") != tt.spilled || (len(row.InlineData) == 0) != tt.spilled {
+				t.Errorf("row.DataPath = %q with %d inline bytes, want spilled = %v", row.DataPath, len(row.InlineData), tt.spilled)
+			}
+			got, err := row.retainedData()
+			if err != nil || !bytes.Equal(got, data) {
+				t.Errorf("retainedData() = %d bytes, %v, want the %d queued bytes", len(got), err, len(data))
+			}
+			if err = c.pendingAttachments.Delete(ctx, row); err != nil {
+				t.Fatalf("Delete() error = %v", err)
+			}
+			if row.DataPath != "" {
+				if _, err = os.Stat(row.DataPath); !os.IsNotExist(err) {
+					t.Errorf("spilled file after Delete() stat error = %v, want not exist", err)
+				}
+			}
+		})
+	}
+
+	// Our own messages are queued without a sender, like live ones.
+	fromMe := bridgev2.EventSender{IsFromMe: true, Sender: "mailto:me@example.com"}
+	c.failedBackfillUpload(ctx, "tel:+15551234567", &pendingAttachmentRow{MessageGUID: "MINE", AttID: "MINE"}, []byte("x"), errors.New("timeout"), fromMe, ts)
+	if row, err := c.pendingAttachments.GetOne(ctx, "MINE", 0); err != nil || row == nil || row.Sender != "" {
+		t.Errorf("GetOne(own message) = %+v, %v, want a row without sender", row, err)
+	}
+}
+
+func TestConvertChatDBAttachmentUploadError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notes.txt")
+	if err := os.WriteFile(path, []byte("hello"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	msg := &imessage.Message{GUID: "CHATDB-1"}
+	att := &imessage.Attachment{PathOnDisk: path, FileName: "notes.txt", MimeType: "text/plain"}
+	_, err := convertChatDBAttachment(context.Background(), nil, failingUploadIntent{}, msg, att, false, false, 0, false)
+	if !errors.Is(err, errAttachmentUpload) {
+		t.Errorf("convertChatDBAttachment() with a failing upload error = %v, want errAttachmentUpload", err)
+	}
+}
+
+func TestWrappedMessageHasText(t *testing.T) {
+	str := func(s string) *string { return &s }
+	tests := []struct {
+		name string
+		msg  *rustpushgo.WrappedMessage
+		want bool
+	}{
+		{"nil message", nil, false},
+		{"no text", &rustpushgo.WrappedMessage{}, false},
+		{"only attachment placeholders", &rustpushgo.WrappedMessage{Text: str("￼￼\n")}, false},
+		{"text", &rustpushgo.WrappedMessage{Text: str("hi ￼")}, true},
+		{"subject only", &rustpushgo.WrappedMessage{Text: str("￼"), Subject: str("Trip")}, true},
+		{"blank subject", &rustpushgo.WrappedMessage{Subject: str("  ")}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := wrappedMessageHasText(tt.msg); got != tt.want {
+				t.Errorf("wrappedMessageHasText() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
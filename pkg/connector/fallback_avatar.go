@@ -0,0 +1,220 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2024 Ludvig Rhodin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+package connector
+
+// Fallback avatars (fallback_avatar).
+//
+// Contacts without a photo leave their ghost, and so their DM room, without
+// an avatar. fallback_avatar generates one instead: the contact's initials,
+// or an identicon derived from the handle, which is the option to use when
+// avatars shouldn't reveal names. Both are deterministic: the same handle
+// and name always give the same PNG, and so the same avatar ID (see
+// avatar_id.go), which means bridgev2 uploads each one once and doesn't
+// touch it again until the contact's name changes or they get a photo.
+// Generated images are also kept in memory, so contact refreshes don't
+// re-render them.
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"strings"
+	"sync"
+	"unicode"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+	"maunium.net/go/mautrix/bridgev2"
+)
+
+const (
+	fallbackAvatarInitials  = "initials"
+	fallbackAvatarIdenticon = "identicon"
+
+	// fallbackAvatarSize is the width and height of generated avatars.
+	fallbackAvatarSize = 120
+	// identiconCells is the identicon grid size; the left half is mirrored.
+	identiconCells = 5
+)
+
+// fallbackAvatarColor picks the background (initials) or foreground
+// (identicon) color from a seed's hash: the hue comes from the hash, at a
+// fixed saturation and lightness that white contrasts with.
+func fallbackAvatarColor(hash [32]byte) color.RGBA {
+	hue := float64(uint16(hash[0])<<8|uint16(hash[1])) / 65536 * 6
+	const chroma, base = 0.45, 0.25
+	x := chroma * (1 - math.Abs(math.Mod(hue, 2)-1))
+	var r, g, b float64
+	switch int(hue) {
+	case 0:
+		r, g = chroma, x
+	case 1:
+		r, g = x, chroma
+	case 2:
+		g, b = chroma, x
+	case 3:
+		g, b = x, chroma
+	case 4:
+		r, b = x, chroma
+	default:
+		r, b = chroma, x
+	}
+	return color.RGBA{R: uint8((r + base) * 255), G: uint8((g + base) * 255), B: uint8((b + base) * 255), A: 255}
+}
+
+func encodeAvatarPNG(img image.Image) []byte {
+	var buf bytes.Buffer
+	// Encoding an in-memory RGBA image can't fail.
+	_ = png.Encode(&buf, img)
+	return buf.Bytes()
+}
+
+// makeIdenticon renders the identicon for seed: a mirrored 5×5 grid of
+// cells switched on by the bits of its hash.
+func makeIdenticon(seed string) []byte {
+	hash := sha256.Sum256([]byte(seed))
+	fg := fallbackAvatarColor(hash)
+	img := image.NewRGBA(image.Rect(0, 0, fallbackAvatarSize, fallbackAvatarSize))
+	fillRect(img, img.Bounds(), color.RGBA{R: 0xf0, G: 0xf0, B: 0xf0, A: 0xff})
+	cell := fallbackAvatarSize / (identiconCells + 1)
+	margin := (fallbackAvatarSize - cell*identiconCells) / 2
+	bit := 0
+	for x := 0; x < (identiconCells+1)/2; x++ {
+		for y := 0; y < identiconCells; y++ {
+			on := hash[2+bit/8]&(1<<(bit%8)) != 0
+			bit++
+			if !on {
+				continue
+			}
+			for _, col := range []int{x, identiconCells - 1 - x} {
+				fillRect(img, image.Rect(margin+col*cell, margin+y*cell, margin+(col+1)*cell, margin+(y+1)*cell), fg)
+			}
+		}
+	}
+	return encodeAvatarPNG(img)
+}
+
+// makeInitialsAvatar renders initials in white on a background picked from
+// seed. The text is drawn with the built-in bitmap face and scaled up, so
+// initials must be printable ASCII (see nameInitials).
+func makeInitialsAvatar(initials, seed string) []byte {
+	face := basicfont.Face7x13
+	textWidth := font.MeasureString(face, initials).Ceil()
+	textHeight := face.Ascent + face.Descent
+	small := image.NewRGBA(image.Rect(0, 0, textWidth, textHeight))
+	drawer := &font.Drawer{
+		Dst:  small,
+		Src:  image.White,
+		Face: face,
+		Dot:  fixed.P(0, face.Ascent),
+	}
+	drawer.DrawString(initials)
+
+	img := image.NewRGBA(image.Rect(0, 0, fallbackAvatarSize, fallbackAvatarSize))
+	fillRect(img, img.Bounds(), fallbackAvatarColor(sha256.Sum256([]byte(seed))))
+	scale := fallbackAvatarSize / 2 / max(textWidth, textHeight)
+	offX := (fallbackAvatarSize - textWidth*scale) / 2
+	offY := (fallbackAvatarSize - textHeight*scale) / 2
+	for y := 0; y < textHeight; y++ {
+		for x := 0; x < textWidth; x++ {
+			if small.RGBAAt(x, y).A < 0x80 {
+				continue
+			}
+			fillRect(img, image.Rect(offX+x*scale, offY+y*scale, offX+(x+1)*scale, offY+(y+1)*scale), color.RGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff})
+		}
+	}
+	return encodeAvatarPNG(img)
+}
+
+func fillRect(img *image.RGBA, rect image.Rectangle, c color.RGBA) {
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			img.SetRGBA(x, y, c)
+		}
+	}
+}
+
+// nameInitials returns the uppercase initials of the first and last words
+// of name, or "" if name has no word starting with a letter or digit the
+// bitmap face can draw.
+func nameInitials(name string) string {
+	var initials []rune
+	for _, word := range strings.Fields(name) {
+		r := unicode.ToUpper([]rune(word)[0])
+		if r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			initials = append(initials, r)
+		}
+	}
+	switch len(initials) {
+	case 0:
+		return ""
+	case 1:
+		return string(initials)
+	default:
+		return string([]rune{initials[0], initials[len(initials)-1]})
+	}
+}
+
+// fallbackAvatarCache keeps generated avatars by mode, identifier and
+// initials. The zero value is ready to use.
+type fallbackAvatarCache struct {
+	mu      sync.Mutex
+	entries map[string][]byte
+}
+
+// get returns the cached avatar for key, generating it on first use.
+func (fc *fallbackAvatarCache) get(key string, generate func() []byte) []byte {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if data, ok := fc.entries[key]; ok {
+		return data
+	}
+	data := generate()
+	if fc.entries == nil {
+		fc.entries = make(map[string][]byte)
+	}
+	fc.entries[key] = data
+	return data
+}
+
+// fallbackAvatar returns the generated avatar for a ghost without a photo,
+// or nil if fallback_avatar is off. name is the contact's real name, if the
+// bridge knows one; it's only used in initials mode.
+func (c *IMClient) fallbackAvatar(identifier, name string) *bridgev2.Avatar {
+	mode := strings.ToLower(c.Main.Config.FallbackAvatar)
+	initials := ""
+	switch mode {
+	case fallbackAvatarInitials:
+		initials = nameInitials(name)
+	case fallbackAvatarIdenticon:
+	default:
+		return nil
+	}
+	var data []byte
+	if initials != "" {
+		data = c.fallbackAvatars.get("initials:"+identifier+":"+initials, func() []byte {
+			return makeInitialsAvatar(initials, identifier)
+		})
+	} else {
+		data = c.fallbackAvatars.get("identicon:"+identifier, func() []byte {
+			return makeIdenticon(identifier)
+		})
+	}
+	return &bridgev2.Avatar{
+		ID: c.avatarIDs.get("fallback", identifier, data),
+		Get: func(ctx context.Context) ([]byte, error) {
+			return data, nil
+		},
+	}
+}
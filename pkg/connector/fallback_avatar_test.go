@@ -0,0 +1,116 @@
+package connector
+
+import (
+	"bytes"
+	"context"
+	"image/png"
+	"testing"
+)
+
+func TestNameInitials(t *testing.T) {
+	tests := map[string]string{
+		"Jane Appleseed":        "JA",
+		"jane":                  "J",
+		"Mary Ann van der Berg": "MB",
+		"  ":                    "",
+		"":                      "",
+		"李 小龙":                  "",
+		"Émile Zola":            "Z",
+		"3 Doors":               "3D",
+	}
+	for name, want := range tests {
+		if got := nameInitials(name); got != want {
+			t.Errorf("nameInitials(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestFallbackAvatarsDeterministic(t *testing.T) {
+	tests := []struct {
+		name     string
+		generate func(seed string) []byte
+	}{
+		{"identicon", makeIdenticon},
+		{"initials", func(seed string) []byte { return makeInitialsAvatar("JA", seed) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := tt.generate("tel:+15551234567")
+			if !bytes.Equal(a, tt.generate("tel:+15551234567")) {
+				t.Errorf("%s avatar differs between runs for the same seed", tt.name)
+			}
+			if bytes.Equal(a, tt.generate("tel:+15557654321")) {
+				t.Errorf("%s avatar is the same for different seeds", tt.name)
+			}
+			img, err := png.Decode(bytes.NewReader(a))
+			if err != nil {
+				t.Fatalf("png.Decode() error = %v", err)
+			}
+			if b := img.Bounds(); b.Dx() != fallbackAvatarSize || b.Dy() != fallbackAvatarSize {
+				t.Errorf("%s avatar size = %v, want %dx%d", tt.name, b.Size(), fallbackAvatarSize, fallbackAvatarSize)
+			}
+		})
+	}
+}
+
+func TestFallbackAvatar(t *testing.T) {
+	const identifier = "mailto:jane@example.com"
+	tests := []struct {
+		mode     string
+		name     string
+		wantNil  bool
+		wantData []byte
+	}{
+		{"", "Jane Appleseed", true, nil},
+		{"bogus", "Jane Appleseed", true, nil},
+		{"identicon", "Jane Appleseed", false, makeIdenticon(identifier)},
+		{"initials", "Jane Appleseed", false, makeInitialsAvatar("JA", identifier)},
+		{"Initials", "", false, makeIdenticon(identifier)},
+	}
+	for _, tt := range tests {
+		c := &IMClient{Main: &IMConnector{Config: IMConfig{FallbackAvatar: tt.mode}}}
+		got := c.fallbackAvatar(identifier, tt.name)
+		if tt.wantNil {
+			if got != nil {
+				t.Errorf("fallbackAvatar() with mode %q = %v, want nil", tt.mode, got)
+			}
+			continue
+		}
+		if got == nil {
+			t.Fatalf("fallbackAvatar() with mode %q = nil, want avatar", tt.mode)
+		}
+		data, err := got.Get(context.Background())
+		if err != nil || !bytes.Equal(data, tt.wantData) {
+			t.Errorf("fallbackAvatar() with mode %q, name %q returned the wrong image (err %v)", tt.mode, tt.name, err)
+		}
+		if want := makeAvatarID("fallback", identifier, tt.wantData); got.ID != want {
+			t.Errorf("fallbackAvatar() ID = %q, want %q", got.ID, want)
+		}
+	}
+}
+
+func TestFallbackAvatarCached(t *testing.T) {
+	c := &IMClient{Main: &IMConnector{Config: IMConfig{FallbackAvatar: "identicon"}}}
+	calls := 0
+	generate := func() []byte {
+		calls++
+		return []byte{byte(calls)}
+	}
+	first := c.fallbackAvatars.get("identicon:tel:+15551234567", generate)
+	second := c.fallbackAvatars.get("identicon:tel:+15551234567", generate)
+	if calls != 1 || !bytes.Equal(first, second) {
+		t.Errorf("fallbackAvatarCache.get() generated %d times, want 1", calls)
+	}
+	c.fallbackAvatars.get("identicon:tel:+15557654321", generate)
+	if calls != 2 {
+		t.Errorf("fallbackAvatarCache.get() for a new key generated %d times in total, want 2", calls)
+	}
+
+	// The same bytes come back for each refresh, so the avatar ID (and
+	// bridgev2's upload) stays put.
+	a := c.fallbackAvatar("tel:+15551234567", "")
+	b := c.fallbackAvatar("tel:+15551234567", "")
+	if a.ID != b.ID {
+		t.Errorf("fallbackAvatar() ID changed between calls: %q, %q", a.ID, b.ID)
+	}
+}
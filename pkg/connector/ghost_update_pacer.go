@@ -0,0 +1,66 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2024 Ludvig Rhodin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+package connector
+
+import (
+	"time"
+)
+
+// Pacing of bulk ghost updates (ghost_updates_per_second).
+//
+// refreshAllGhosts and refreshGhostNamesFromContacts call UpdateInfo for
+// every changed ghost, and each call is a Matrix profile update (or two,
+// with an avatar). bridgev2 has no batch form of those, so a contact sync
+// touching hundreds of ghosts is instead spread out: at most limit updates
+// start per second, and the rest wait their turn. Nothing is dropped.
+
+// ghostUpdatePacer lets at most limit updates start in any interval.
+type ghostUpdatePacer struct {
+	limit    int
+	interval time.Duration
+
+	starts []time.Time // start times of the last limit updates, oldest first
+
+	now   func() time.Time
+	sleep func(time.Duration) bool // false when the wait was cut short
+}
+
+// wait blocks until the next update may start. It returns false if the
+// client stopped while waiting.
+func (p *ghostUpdatePacer) wait() bool {
+	if p.limit <= 0 {
+		return true
+	}
+	if len(p.starts) >= p.limit {
+		if d := p.interval - p.now().Sub(p.starts[0]); d > 0 && !p.sleep(d) {
+			return false
+		}
+		p.starts = p.starts[1:]
+	}
+	p.starts = append(p.starts, p.now())
+	return true
+}
+
+// newGhostUpdatePacer returns a pacer for one bulk refresh, configured from
+// ghost_updates_per_second and interrupted by the client stopping.
+func (c *IMClient) newGhostUpdatePacer() *ghostUpdatePacer {
+	return &ghostUpdatePacer{
+		limit:    c.Main.Config.GhostUpdatesPerSecond,
+		interval: time.Second,
+		now:      time.Now,
+		sleep: func(d time.Duration) bool {
+			select {
+			case <-time.After(d):
+				return true
+			case <-c.stopChan:
+				return false
+			}
+		},
+	}
+}
@@ -0,0 +1,81 @@
+package connector
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGhostUpdatePacer(t *testing.T) {
+	tests := []struct {
+		name       string
+		limit      int
+		updates    int
+		wantSleeps int
+	}{
+		{"under the limit", 10, 10, 0},
+		{"over the limit", 10, 25, 2},
+		{"one per second", 1, 3, 2},
+		{"unlimited", 0, 100, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := time.Unix(1700000000, 0)
+			sleeps := 0
+			p := &ghostUpdatePacer{
+				limit:    tt.limit,
+				interval: time.Second,
+				now:      func() time.Time { return clock },
+				sleep: func(d time.Duration) bool {
+					sleeps++
+					clock = clock.Add(d)
+					return true
+				},
+			}
+			var starts []time.Time
+			for i := 0; i < tt.updates; i++ {
+				if !p.wait() {
+					t.Fatalf("wait() = false on update %d", i)
+				}
+				starts = append(starts, clock)
+				// Each update takes a little time of its own.
+				clock = clock.Add(10 * time.Millisecond)
+			}
+			if sleeps != tt.wantSleeps {
+				t.Errorf("slept %d times, want %d", sleeps, tt.wantSleeps)
+			}
+			if tt.limit <= 0 {
+				return
+			}
+			// No interval-long span may contain more than limit starts.
+			for i, start := range starts {
+				n := 0
+				for _, other := range starts[i:] {
+					if other.Sub(start) < time.Second {
+						n++
+					}
+				}
+				if n > tt.limit {
+					t.Errorf("%d updates started within a second of update %d, want at most %d", n, i, tt.limit)
+				}
+			}
+		})
+	}
+}
+
+func TestGhostUpdatePacerStopped(t *testing.T) {
+	clock := time.Unix(1700000000, 0)
+	p := &ghostUpdatePacer{
+		limit:    2,
+		interval: time.Second,
+		now:      func() time.Time { return clock },
+		sleep:    func(time.Duration) bool { return false },
+	}
+	for i := 0; i < 2; i++ {
+		if !p.wait() {
+			t.Fatalf("wait() = false within the limit")
+		}
+	}
+	if p.wait() {
+		t.Errorf("wait() = true after the client stopped, want false")
+	}
+}
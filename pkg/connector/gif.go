@@ -0,0 +1,175 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2024 Ludvig Rhodin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+package connector
+
+// Outbound GIF handling.
+//
+// iMessage shows a GIF inline (animated, like its own #images picker) only
+// when it arrives as a com.compuserve.gif attachment. Matrix clients send GIFs
+// two ways: as an image/gif upload, or as a bare GIPHY/Tenor link in a text
+// message. The upload path just has to avoid the JPEG re-encode (image.Decode
+// keeps only the first frame); the link path would otherwise go out as a rich
+// link card showing a still thumbnail, so we fetch the GIF and send it as an
+// attachment instead.
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+
+	"github.com/lrhodin/imessage/pkg/rustpushgo"
+)
+
+// maxGIFURLBytes caps GIFs fetched from provider links. downloadURL truncates
+// at 5 MB, so anything that hits the cap is treated as too large and the link
+// is sent as plain text rather than as a corrupt, truncated GIF.
+const maxGIFURLBytes = 5 * 1024 * 1024
+
+// gifProviderMediaURL maps a GIPHY or Tenor link to the URL of the GIF file
+// itself. Direct media links (media*.giphy.com, i.giphy.com, media.tenor.com,
+// c.tenor.com) are returned as-is when they point at a .gif; GIPHY page links
+// (giphy.com/gifs/<slug>-<id>) are rewritten to the canonical media URL.
+// Tenor page links (tenor.com/view/...) can't be resolved without fetching
+// the page, so they report ok=false and are handled by the og:image fallback.
+func gifProviderMediaURL(rawURL string) (string, bool) {
+	u, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return "", false
+	}
+	host := strings.ToLower(u.Hostname())
+	isGIFPath := strings.EqualFold(path.Ext(u.Path), ".gif")
+	switch {
+	case host == "i.giphy.com" || (strings.HasPrefix(host, "media") && strings.HasSuffix(host, ".giphy.com")):
+		if isGIFPath {
+			return "https://" + host + u.Path, true
+		}
+		// media.giphy.com/media/<id>/giphy.webp etc. → the .gif rendition.
+		if parts := strings.Split(strings.Trim(u.Path, "/"), "/"); len(parts) >= 2 && parts[0] == "media" {
+			return "https://media.giphy.com/media/" + parts[1] + "/giphy.gif", true
+		}
+	case host == "giphy.com" || host == "www.giphy.com":
+		parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+		if len(parts) == 2 && (parts[0] == "gifs" || parts[0] == "stickers") {
+			slug := parts[1]
+			gifID := slug[strings.LastIndexByte(slug, '-')+1:]
+			if gifID != "" {
+				return "https://media.giphy.com/media/" + gifID + "/giphy.gif", true
+			}
+		}
+	case host == "media.tenor.com" || host == "c.tenor.com" || strings.HasSuffix(host, ".media.tenor.com"):
+		if isGIFPath {
+			return "https://" + host + u.Path, true
+		}
+	}
+	return "", false
+}
+
+// isGIFProviderPage reports whether a URL is a GIF provider page whose og:image
+// is worth checking for the underlying GIF.
+func isGIFProviderPage(rawURL string) bool {
+	u, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	return host == "tenor.com" || host == "www.tenor.com"
+}
+
+// soleURL returns the body if it consists of exactly one URL (surrounding
+// whitespace aside). GIF links are only converted when they are the whole
+// message: a link inside a sentence stays a link.
+func soleURL(body string) (string, bool) {
+	body = strings.TrimSpace(body)
+	if body == "" || strings.ContainsAny(body, " \t\n") {
+		return "", false
+	}
+	if match := urlRegex.FindString(body); match == body && isLikelyURL(match) {
+		return match, true
+	}
+	return "", false
+}
+
+// outboundGIFMeta reports whether an outbound upload is a GIF and must be sent
+// byte-for-byte. The file magic wins over the declared MIME type, so a GIF
+// mislabeled as image/png still keeps its animation, and a file labeled
+// image/gif that is really a PNG goes through the normal image path. Returns
+// the corrected MIME type and file name (with a .gif extension).
+func outboundGIFMeta(data []byte, mimeType, fileName string) (string, string, bool) {
+	detected := detectImageMIME(data)
+	if detected != "image/gif" && (mimeType != "image/gif" || detected != "") {
+		return mimeType, fileName, false
+	}
+	if !strings.EqualFold(filepath.Ext(fileName), ".gif") {
+		fileName = strings.TrimSuffix(fileName, filepath.Ext(fileName)) + ".gif"
+	}
+	return "image/gif", fileName, true
+}
+
+// trySendGIFURL sends a message that is just a GIPHY/Tenor link as a GIF
+// attachment. Returns handled=false (and no error) when the message isn't a GIF
+// link or the GIF couldn't be fetched, in which case the caller sends the
+// text normally.
+func (c *IMClient) trySendGIFURL(ctx context.Context, msg *bridgev2.MatrixMessage, conv rustpushgo.WrappedConversation) (*bridgev2.MatrixMessageResponse, bool, error) {
+	link, ok := soleURL(msg.Content.Body)
+	if !ok {
+		return nil, false, nil
+	}
+	log := zerolog.Ctx(ctx).With().Str("gif_url", logSafeURL(link)).Logger()
+	mediaURL, ok := gifProviderMediaURL(normalizeURL(link))
+	if !ok && isGIFProviderPage(normalizeURL(link)) {
+		if image := fetchPageMetadata(ctx, normalizeURL(link))["image"]; image != "" {
+			mediaURL, ok = gifProviderMediaURL(image)
+		}
+	}
+	if !ok {
+		return nil, false, nil
+	}
+
+	data, _, err := downloadURL(ctx, mediaURL)
+	if err != nil {
+		log.Debug().Err(err).Msg("Failed to fetch GIF for inline send, sending link as text")
+		return nil, false, nil
+	}
+	if len(data) >= maxGIFURLBytes || detectImageMIME(data) != "image/gif" {
+		log.Debug().Int("size", len(data)).Msg("GIF link didn't resolve to a usable GIF, sending link as text")
+		return nil, false, nil
+	}
+
+	replyGuid, replyPart := extractReplyInfo(msg.ReplyTo)
+	handle := c.portalHandle(msg.Portal)
+	uuid, err := c.sendWithSMSFallback(ctx, msg.Portal, &conv, func(conv rustpushgo.WrappedConversation) (string, error) {
+		return c.client.SendAttachment(conv, data, "image/gif", mimeToUTI("image/gif"), path.Base(mediaURL), handle, replyGuid, replyPart, nil)
+	})
+	if err != nil {
+		return nil, true, fmt.Errorf("failed to send GIF attachment: %w", err)
+	}
+	log.Info().Str("uuid", uuid).Int("size", len(data)).Msg("Sent GIF link as inline GIF attachment")
+	c.rememberOutboundSend(uuid)
+	if c.cloudStore != nil {
+		if err := c.cloudStore.persistMessageUUID(ctx, uuid, string(msg.Portal.ID), time.Now().UnixMilli(), true); err != nil {
+			log.Warn().Err(err).Str("uuid", uuid).Msg("Failed to persist sent GIF UUID; echo may be delivered as duplicate")
+		}
+	}
+	return &bridgev2.MatrixMessageResponse{
+		DB: &database.Message{
+			ID:        makeMessageID(uuid),
+			SenderID:  makeUserID(handle),
+			Timestamp: time.Now(),
+			Metadata:  &MessageMetadata{HasAttachments: true},
+		},
+	}, true, nil
+}
@@ -0,0 +1,83 @@
+package connector
+
+import "testing"
+
+func TestGIFProviderMediaURL(t *testing.T) {
+	tests := []struct {
+		input  string
+		want   string
+		wantOK bool
+	}{
+		{"https://media.giphy.com/media/abc123/giphy.gif", "https://media.giphy.com/media/abc123/giphy.gif", true},
+		{"https://media2.giphy.com/media/abc123/giphy.gif?cid=xyz", "https://media2.giphy.com/media/abc123/giphy.gif", true},
+		{"https://media.giphy.com/media/abc123/giphy.webp", "https://media.giphy.com/media/abc123/giphy.gif", true},
+		{"https://i.giphy.com/abc123.gif", "https://i.giphy.com/abc123.gif", true},
+		{"https://giphy.com/gifs/cat-funny-abc123", "https://media.giphy.com/media/abc123/giphy.gif", true},
+		{"https://giphy.com/gifs/abc123", "https://media.giphy.com/media/abc123/giphy.gif", true},
+		{"https://media.tenor.com/AbCd/tenor.gif", "https://media.tenor.com/AbCd/tenor.gif", true},
+		{"https://c.tenor.com/AbCd/tenor.gif", "https://c.tenor.com/AbCd/tenor.gif", true},
+		{"https://media.tenor.com/AbCd/tenor.mp4", "", false},
+		{"https://tenor.com/view/cat-gif-12345", "", false},
+		{"https://giphy.com/explore/cats", "", false},
+		{"https://example.com/funny.gif", "", false},
+		{"ftp://media.giphy.com/media/abc123/giphy.gif", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := gifProviderMediaURL(tt.input)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("gifProviderMediaURL(%q) = (%q, %v), want (%q, %v)", tt.input, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestSoleURL(t *testing.T) {
+	tests := []struct {
+		body   string
+		want   string
+		wantOK bool
+	}{
+		{"https://giphy.com/gifs/abc123", "https://giphy.com/gifs/abc123", true},
+		{"  https://giphy.com/gifs/abc123\n", "https://giphy.com/gifs/abc123", true},
+		{"look https://giphy.com/gifs/abc123", "", false},
+		{"", "", false},
+		{"hello", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := soleURL(tt.body)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("soleURL(%q) = (%q, %v), want (%q, %v)", tt.body, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestOutboundGIFMeta(t *testing.T) {
+	gifData := []byte("GIF89a\x01\x00\x01\x00\x00\x00\x00")
+	pngData := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x00")
+	tests := []struct {
+		name     string
+		data     []byte
+		mime     string
+		fileName string
+		wantMime string
+		wantName string
+		wantGIF  bool
+	}{
+		{"gif upload", gifData, "image/gif", "party.gif", "image/gif", "party.gif", true},
+		{"gif mislabeled as png", gifData, "image/png", "party.png", "image/gif", "party.gif", true},
+		{"gif without extension", gifData, "application/octet-stream", "party", "image/gif", "party.gif", true},
+		{"png labeled gif", pngData, "image/gif", "still.gif", "image/gif", "still.gif", false},
+		{"png", pngData, "image/png", "still.png", "image/png", "still.png", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotMime, gotName, gotGIF := outboundGIFMeta(tt.data, tt.mime, tt.fileName)
+			if gotMime != tt.wantMime || gotName != tt.wantName || gotGIF != tt.wantGIF {
+				t.Errorf("outboundGIFMeta() = (%q, %q, %v), want (%q, %q, %v)",
+					gotMime, gotName, gotGIF, tt.wantMime, tt.wantName, tt.wantGIF)
+			}
+			if gotGIF && mimeToUTI(gotMime) != "com.compuserve.gif" {
+				t.Errorf("mimeToUTI(%q) = %q, want com.compuserve.gif", gotMime, mimeToUTI(gotMime))
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2024 Ludvig Rhodin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+package connector
+
+import (
+	"time"
+
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/bridgev2/simplevent"
+	"maunium.net/go/mautrix/event"
+
+	"github.com/lrhodin/imessage/pkg/rustpushgo"
+)
+
+// Group change attribution (group_actor_power_level).
+//
+// Renames and membership changes carry the handle of the member who made
+// them. The ChatInfoChange events are sent as that member so the room's
+// state history shows who did what, and with group_actor_power_level set
+// the member is also given that power level, as the closest Matrix
+// equivalent of "runs this group".
+
+// withGroupActor returns members with actor given powerLevel. A full member
+// list only has existing entries updated — an actor missing from it has left
+// the group, and adding them would re-invite them. A partial (or nil) list
+// gets the actor added as joined. members is returned unchanged when
+// powerLevel is 0 or the actor is the user.
+func withGroupActor(members *bridgev2.ChatMemberList, actor bridgev2.EventSender, powerLevel int) *bridgev2.ChatMemberList {
+	if powerLevel <= 0 || actor.IsFromMe || actor.Sender == "" {
+		return members
+	}
+	if members == nil {
+		members = &bridgev2.ChatMemberList{}
+	}
+	member, ok := members.MemberMap[actor.Sender]
+	if !ok {
+		if members.IsFull {
+			return members
+		}
+		member = bridgev2.ChatMember{EventSender: actor, Membership: event.MembershipJoin}
+	}
+	if members.MemberMap == nil {
+		members.MemberMap = make(map[networkid.UserID]bridgev2.ChatMember)
+	}
+	member.PowerLevel = &powerLevel
+	members.MemberMap[actor.Sender] = member
+	return members
+}
+
+// groupRenameEvent builds the ChatInfoChange for a group rename, sent as the
+// member who renamed it.
+func (c *IMClient) groupRenameEvent(portalKey networkid.PortalKey, msg rustpushgo.WrappedMessage, newName string) *simplevent.ChatInfoChange {
+	sender := c.makeEventSender(msg.Sender)
+	return &simplevent.ChatInfoChange{
+		EventMeta: simplevent.EventMeta{
+			Type:      bridgev2.RemoteEventChatInfoChange,
+			PortalKey: portalKey,
+			Sender:    sender,
+			Timestamp: time.UnixMilli(int64(msg.TimestampMs)),
+		},
+		ChatInfoChange: &bridgev2.ChatInfoChange{
+			ChatInfo: &bridgev2.ChatInfo{
+				Name: &newName,
+			},
+			MemberChanges: withGroupActor(nil, sender, c.Main.Config.GroupActorPowerLevel),
+		},
+	}
+}
@@ -0,0 +1,90 @@
+package connector
+
+import (
+	"testing"
+
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/event"
+
+	"github.com/lrhodin/imessage/pkg/rustpushgo"
+)
+
+func TestGroupRenameEventAttributesActor(t *testing.T) {
+	sender := "tel:+15551234567"
+	tests := []struct {
+		name       string
+		powerLevel int
+		wantPL     int
+	}{
+		{"attribution only", 0, 0},
+		{"actor made moderator", 50, 50},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &IMClient{
+				Main:       &IMConnector{Config: IMConfig{GroupActorPowerLevel: tt.powerLevel}},
+				allHandles: []string{"tel:+15559999999"},
+			}
+			portalKey := networkid.PortalKey{ID: "gid:9b2c6a5e-1111-2222-3333-444455556666", Receiver: "login"}
+			evt := c.groupRenameEvent(portalKey, rustpushgo.WrappedMessage{Sender: &sender, TimestampMs: 1700000000000}, "Book Club")
+
+			actor := makeUserID("tel:+15551234567")
+			if evt.Sender.Sender != actor || evt.Sender.IsFromMe {
+				t.Errorf("groupRenameEvent() sender = %+v, want %s", evt.Sender, actor)
+			}
+			if evt.ChatInfoChange.ChatInfo.Name == nil || *evt.ChatInfoChange.ChatInfo.Name != "Book Club" {
+				t.Errorf("groupRenameEvent() name = %v, want Book Club", evt.ChatInfoChange.ChatInfo.Name)
+			}
+			members := evt.ChatInfoChange.MemberChanges
+			if tt.wantPL == 0 {
+				if members != nil {
+					t.Errorf("groupRenameEvent() member changes = %+v, want nil", members)
+				}
+				return
+			}
+			member, ok := members.MemberMap[actor]
+			if !ok || member.PowerLevel == nil || *member.PowerLevel != tt.wantPL {
+				t.Fatalf("groupRenameEvent() actor member = %+v, want power level %d", member, tt.wantPL)
+			}
+			if members.IsFull {
+				t.Errorf("groupRenameEvent() member list is full, want partial")
+			}
+		})
+	}
+}
+
+func TestWithGroupActor(t *testing.T) {
+	actor := bridgev2.EventSender{Sender: "tel:+15551234567"}
+	other := bridgev2.EventSender{Sender: "tel:+15557654321"}
+	fullList := func(senders ...bridgev2.EventSender) *bridgev2.ChatMemberList {
+		members := &bridgev2.ChatMemberList{IsFull: true, MemberMap: map[networkid.UserID]bridgev2.ChatMember{}}
+		for _, s := range senders {
+			members.MemberMap[s.Sender] = bridgev2.ChatMember{EventSender: s, Membership: event.MembershipJoin}
+		}
+		return members
+	}
+	tests := []struct {
+		name    string
+		members *bridgev2.ChatMemberList
+		actor   bridgev2.EventSender
+		wantPL  bool
+		wantLen int
+	}{
+		{"actor in full list", fullList(actor, other), actor, true, 2},
+		{"actor left the group", fullList(other), actor, false, 1},
+		{"user is never changed", fullList(other), bridgev2.EventSender{IsFromMe: true, Sender: "tel:+15559999999"}, false, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := withGroupActor(tt.members, tt.actor, 50)
+			if len(got.MemberMap) != tt.wantLen {
+				t.Errorf("withGroupActor() has %d members, want %d", len(got.MemberMap), tt.wantLen)
+			}
+			member := got.MemberMap[tt.actor.Sender]
+			if hasPL := member.PowerLevel != nil; hasPL != tt.wantPL {
+				t.Errorf("withGroupActor() actor power level set = %v, want %v", hasPL, tt.wantPL)
+			}
+		})
+	}
+}
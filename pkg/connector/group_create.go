@@ -0,0 +1,251 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2024 Ludvig Rhodin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+package connector
+
+// Groups created from Matrix (create-group and the provisioning API).
+//
+// iMessage has no "create group" call. A group comes into being with its
+// first message, which carries a new group UUID (sender_guid), the members
+// and optionally a name (cv_name), and each recipient sets the group up from
+// that. CreateGroup therefore only picks the UUID and sets up a gid: portal
+// for it, the same as for a group first seen from iMessage, flagged
+// PendingGroup. The first message sent in the room then establishes the
+// group: it goes out with the room's name at that point (renames before it
+// only change the room and the pending name), and once it's sent the UUID
+// and name it used are saved to the portal and the flag is cleared.
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/rs/zerolog"
+	"go.mau.fi/util/ptr"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/event"
+
+	"github.com/lrhodin/imessage/pkg/rustpushgo"
+)
+
+// groupCreationType is the only group type in the provisioning capabilities.
+const groupCreationType = "group"
+
+var groupCreationCaps = map[string]bridgev2.GroupTypeCapabilities{
+	groupCreationType: {
+		TypeDescription: "iMessage group",
+		Name:            bridgev2.GroupFieldCapability{Allowed: true},
+		Participants:    bridgev2.GroupFieldCapability{Allowed: true, Required: true, MinLength: 2},
+	},
+}
+
+// newGroupGUID returns a random group UUID, uppercase like the ones Apple
+// devices generate.
+func newGroupGUID() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return strings.ToUpper(fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]))
+}
+
+// newGroupMembers normalizes the participants of a group being created,
+// dropping duplicates and the user's own handles.
+func (c *IMClient) newGroupMembers(participants []networkid.UserID) []string {
+	members := make([]string, 0, len(participants))
+	for _, p := range participants {
+		member := normalizeIdentifierForPortalID(string(p))
+		if member == "" || c.isMyHandle(member) || slices.Contains(members, member) {
+			continue
+		}
+		members = append(members, member)
+	}
+	return members
+}
+
+// validateGroupMembers splits members into those reachable on iMessage and
+// those that aren't. A failed lookup (see lookupReachability) leaves every
+// member unreachable.
+func (c *IMClient) validateGroupMembers(members []string) (valid []string, failed map[networkid.UserID]*bridgev2.CreateChatFailedParticipant) {
+	reachable, _ := c.lookupReachability(members, c.handle)
+	for _, member := range members {
+		if reachable[member] {
+			valid = append(valid, member)
+			continue
+		}
+		if failed == nil {
+			failed = make(map[networkid.UserID]*bridgev2.CreateChatFailedParticipant)
+		}
+		failed[makeUserID(member)] = &bridgev2.CreateChatFailedParticipant{Reason: "not registered with iMessage"}
+	}
+	return valid, failed
+}
+
+// CreateGroup sets up the portal for a new iMessage group. Nothing is sent
+// to iMessage until the first message (see preparePendingGroup).
+func (c *IMClient) CreateGroup(ctx context.Context, params *bridgev2.GroupCreateParams) (*bridgev2.CreateChatResponse, error) {
+	if c.client == nil {
+		return nil, bridgev2.ErrNotLoggedIn
+	}
+	members, failed := c.validateGroupMembers(c.newGroupMembers(params.Participants))
+	if len(members) < 2 {
+		return nil, fmt.Errorf("a group needs at least two other members on iMessage, %d of %d are", len(members), len(params.Participants))
+	}
+	name := ""
+	if params.Name != nil {
+		name = strings.TrimSpace(params.Name.Name)
+	}
+	guid := newGroupGUID()
+	portalKey := networkid.PortalKey{ID: networkid.PortalID("gid:" + strings.ToLower(guid)), Receiver: c.UserLogin.ID}
+	portalID := string(portalKey.ID)
+	participants := append([]string{c.handle}, members...)
+
+	// The same caches makePortalKey fills for groups seen from iMessage, so
+	// portalToConversation and GetChatInfo find the group.
+	c.imGroupGuidsMu.Lock()
+	c.imGroupGuids[portalID] = guid
+	c.imGroupGuidsMu.Unlock()
+	c.imGroupParticipantsMu.Lock()
+	c.imGroupParticipants[portalID] = participants
+	c.imGroupParticipantsMu.Unlock()
+	if c.cloudStore != nil {
+		if err := c.cloudStore.upsertChat(ctx, guid, "", guid, portalID, "iMessage", nil, nil, participants, 0); err != nil {
+			zerolog.Ctx(ctx).Warn().Err(err).Str("portal_id", portalID).Msg("Failed to persist new group participants")
+		}
+	}
+
+	portal, err := c.Main.Bridge.GetPortalByKey(ctx, portalKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get portal: %w", err)
+	}
+	setMeta := func() {
+		portal.Metadata = &PortalMetadata{SenderGuid: guid, GroupName: name, PendingGroup: true}
+	}
+	memberMap := make(map[networkid.UserID]bridgev2.ChatMember, len(participants))
+	for _, member := range members {
+		memberMap[makeUserID(member)] = bridgev2.ChatMember{
+			EventSender: bridgev2.EventSender{Sender: makeUserID(member)},
+			Membership:  event.MembershipJoin,
+		}
+	}
+	memberMap[makeUserID(c.handle)] = bridgev2.ChatMember{
+		EventSender: bridgev2.EventSender{
+			IsFromMe:    true,
+			SenderLogin: c.UserLogin.ID,
+			Sender:      makeUserID(c.handle),
+		},
+		Membership: event.MembershipJoin,
+	}
+	info := &bridgev2.ChatInfo{
+		Type: ptr.Ptr(database.RoomTypeDefault),
+		Members: &bridgev2.ChatMemberList{
+			IsFull:    true,
+			MemberMap: memberMap,
+			PowerLevels: &bridgev2.PowerLevelOverrides{
+				Invite: ptr.Ptr(95), // as in GetChatInfo
+			},
+		},
+	}
+	if name != "" {
+		info.Name = &name
+	}
+	if params.RoomID != "" {
+		// create-group in an existing room: bridge that room.
+		err = portal.UpdateMatrixRoomID(ctx, params.RoomID, bridgev2.UpdateMatrixRoomIDParams{
+			SyncDBMetadata: setMeta,
+			FailIfMXIDSet:  true,
+			ChatInfo:       info,
+			ChatInfoSource: c.UserLogin,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to bridge room: %w", err)
+		}
+	} else {
+		setMeta()
+		if err = portal.Save(ctx); err != nil {
+			return nil, fmt.Errorf("failed to save portal: %w", err)
+		}
+	}
+	zerolog.Ctx(ctx).Info().
+		Str("portal_id", portalID).
+		Int("members", len(members)).
+		Msg("Created group portal, the iMessage group is established by its first message")
+	return &bridgev2.CreateChatResponse{
+		PortalKey:          portalKey,
+		Portal:             portal,
+		PortalInfo:         info,
+		FailedParticipants: failed,
+	}, nil
+}
+
+// isPendingGroup reports whether portal is a group created from Matrix that
+// hasn't sent its first message yet.
+func isPendingGroup(portal *bridgev2.Portal) bool {
+	meta, ok := portal.Metadata.(*PortalMetadata)
+	return ok && meta.PendingGroup
+}
+
+// preparePendingGroup fills in the conversation for the first message of a
+// group created from Matrix: its UUID, its members and the room's name. It
+// reports whether portal is such a group; if so, finishPendingGroup must be
+// called once the message is sent.
+func (c *IMClient) preparePendingGroup(ctx context.Context, portal *bridgev2.Portal, conv *rustpushgo.WrappedConversation) bool {
+	if !isPendingGroup(portal) {
+		return false
+	}
+	meta := portal.Metadata.(*PortalMetadata)
+	if meta.SenderGuid != "" {
+		guid := meta.SenderGuid
+		conv.SenderGuid = &guid
+	}
+	if len(conv.Participants) == 0 {
+		conv.Participants = c.resolveGroupMembers(ctx, string(portal.ID))
+	}
+	// The room's own name, which HandleMatrixRoomName keeps in GroupName
+	// until now; portal.Name may be one the bridge made up from the members.
+	if meta.GroupName != "" {
+		name := meta.GroupName
+		conv.GroupName = &name
+	} else {
+		conv.GroupName = nil
+	}
+	return true
+}
+
+// finishPendingGroup records that the first message established portal's
+// group, with the UUID and name it was sent with.
+func (c *IMClient) finishPendingGroup(ctx context.Context, portal *bridgev2.Portal, conv rustpushgo.WrappedConversation) {
+	meta, ok := portal.Metadata.(*PortalMetadata)
+	if !ok || !meta.PendingGroup {
+		return
+	}
+	portalID := string(portal.ID)
+	meta.PendingGroup = false
+	if conv.SenderGuid != nil && *conv.SenderGuid != "" {
+		guid := *conv.SenderGuid
+		meta.SenderGuid = guid
+		c.imGroupGuidsMu.Lock()
+		c.imGroupGuids[portalID] = guid
+		c.imGroupGuidsMu.Unlock()
+	}
+	if conv.GroupName != nil {
+		meta.GroupName = *conv.GroupName
+		c.imGroupNamesMu.Lock()
+		c.imGroupNames[portalID] = *conv.GroupName
+		c.imGroupNamesMu.Unlock()
+	}
+	if err := portal.Save(ctx); err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Str("portal_id", portalID).Msg("Failed to save established group")
+	} else {
+		zerolog.Ctx(ctx).Info().Str("portal_id", portalID).Str("group_name", logText(meta.GroupName)).Msg("Established iMessage group with its first message")
+	}
+}
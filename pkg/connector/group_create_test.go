@@ -0,0 +1,146 @@
+package connector
+
+import (
+	"context"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"go.mau.fi/util/ptr"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/event"
+
+	"github.com/lrhodin/imessage/pkg/rustpushgo"
+)
+
+func TestNewGroupGUID(t *testing.T) {
+	format := regexp.MustCompile(`^[0-9A-F]{8}-[0-9A-F]{4}-4[0-9A-F]{3}-[89AB][0-9A-F]{3}-[0-9A-F]{12}$`)
+	a, b := newGroupGUID(), newGroupGUID()
+	for _, guid := range []string{a, b} {
+		if !format.MatchString(guid) {
+			t.Errorf("newGroupGUID() = %q, want an uppercase v4 UUID", guid)
+		}
+	}
+	if a == b {
+		t.Errorf("newGroupGUID() returned %q twice", a)
+	}
+}
+
+func TestNewGroupMembers(t *testing.T) {
+	c := &IMClient{allHandles: []string{"tel:+15550000000", "mailto:me@example.com"}}
+	tests := []struct {
+		name         string
+		participants []networkid.UserID
+		want         []string
+	}{
+		{"plain", []networkid.UserID{"tel:+15551111111", "mailto:bob@example.com"}, []string{"tel:+15551111111", "mailto:bob@example.com"}},
+		{"self dropped", []networkid.UserID{"tel:+15550000000", "tel:+15551111111", "mailto:me@example.com"}, []string{"tel:+15551111111"}},
+		{"duplicates", []networkid.UserID{"tel:+15551111111", "tel:+15551111111", ""}, []string{"tel:+15551111111"}},
+	}
+	for _, tt := range tests {
+		if got := c.newGroupMembers(tt.participants); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("newGroupMembers(%s) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func newPendingGroupTestClient() *IMClient {
+	return &IMClient{
+		Main:                &IMConnector{},
+		UserLogin:           &bridgev2.UserLogin{Log: zerolog.Nop()},
+		handle:              "tel:+15550000000",
+		allHandles:          []string{"tel:+15550000000"},
+		imGroupNames:        make(map[string]string),
+		imGroupGuids:        make(map[string]string),
+		imGroupParticipants: make(map[string][]string),
+		gidAliases:          make(map[string]string),
+	}
+}
+
+func TestPendingGroupFirstSend(t *testing.T) {
+	const guid = "0D9A4C1E-3B7F-4A52-9E61-5C2B8F0A7D34"
+	ctx := context.Background()
+	db := newTestBridgeDB(t)
+	key := networkid.PortalKey{ID: networkid.PortalID("gid:" + strings.ToLower(guid)), Receiver: "login"}
+	if err := db.Portal.Insert(ctx, &database.Portal{PortalKey: key}); err != nil {
+		t.Fatalf("Portal.Insert() error = %v", err)
+	}
+	members := []string{"tel:+15550000000", "tel:+15551111111", "mailto:bob@example.com"}
+
+	tests := []struct {
+		name       string
+		groupName  string
+		portalName string
+		rename     string
+		wantName   *string
+	}{
+		{"named", "Hiking", "Hiking", "", ptr.Ptr("Hiking")},
+		{"renamed before sending", "Hiking", "Hiking", "Climbing", ptr.Ptr("Climbing")},
+		// A room without a name shows one made up from the members; that
+		// mustn't become the iMessage group's name.
+		{"unnamed", "", "Alice, Bob", "", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newPendingGroupTestClient()
+			c.imGroupParticipants[string(key.ID)] = members
+			meta := &PortalMetadata{SenderGuid: guid, GroupName: tt.groupName, PendingGroup: true}
+			portal := &bridgev2.Portal{
+				Portal: &database.Portal{PortalKey: key, Name: tt.portalName, Metadata: meta},
+				Bridge: &bridgev2.Bridge{DB: db},
+			}
+			if tt.rename != "" {
+				msg := &bridgev2.MatrixRoomName{MatrixEventBase: bridgev2.MatrixEventBase[*event.RoomNameEventContent]{
+					Portal:  portal,
+					Content: &event.RoomNameEventContent{Name: tt.rename},
+				}}
+				// Not logged in, so this would fail if it tried to send.
+				if changed, err := c.HandleMatrixRoomName(ctx, msg); !changed || err != nil {
+					t.Fatalf("HandleMatrixRoomName() on a pending group = %v, %v, want true, nil", changed, err)
+				}
+			}
+
+			conv := c.portalToConversation(portal)
+			if !c.preparePendingGroup(ctx, portal, &conv) {
+				t.Fatalf("preparePendingGroup() = false, want true")
+			}
+			if !reflect.DeepEqual(conv.GroupName, tt.wantName) {
+				t.Errorf("first send group name = %v, want %v", ptrStringOr(conv.GroupName, "<nil>"), ptrStringOr(tt.wantName, "<nil>"))
+			}
+			if conv.SenderGuid == nil || *conv.SenderGuid != guid {
+				t.Errorf("first send sender_guid = %v, want %q", ptrStringOr(conv.SenderGuid, "<nil>"), guid)
+			}
+			if !reflect.DeepEqual(conv.Participants, members) {
+				t.Errorf("first send participants = %v, want %v", conv.Participants, members)
+			}
+
+			c.finishPendingGroup(ctx, portal, conv)
+			if meta.PendingGroup {
+				t.Errorf("PendingGroup still set after the first send")
+			}
+			if want := ptrStringOr(tt.wantName, ""); meta.GroupName != want {
+				t.Errorf("group name after the first send = %q, want %q", meta.GroupName, want)
+			}
+			if meta.SenderGuid != guid || c.imGroupGuids[string(key.ID)] != guid {
+				t.Errorf("group UUID after the first send = %q (cached %q), want %q", meta.SenderGuid, c.imGroupGuids[string(key.ID)], guid)
+			}
+			var raw string
+			if err := db.QueryRow(ctx, "SELECT metadata FROM portal WHERE id=$1", key.ID).Scan(&raw); err != nil {
+				t.Fatalf("reading saved portal metadata: %v", err)
+			}
+			if strings.Contains(raw, "pending_group") || !strings.Contains(raw, guid) {
+				t.Errorf("saved portal metadata = %s, want the UUID and no pending_group", raw)
+			}
+
+			// Later messages go out like any other group's.
+			next := rustpushgo.WrappedConversation{}
+			if c.preparePendingGroup(ctx, portal, &next) {
+				t.Errorf("preparePendingGroup() after the first send = true, want false")
+			}
+		})
+	}
+}
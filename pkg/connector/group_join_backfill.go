@@ -0,0 +1,208 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2024 Ludvig Rhodin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+package connector
+
+// Group join backfill (group_join_backfill_hours).
+//
+// When someone adds the user to an existing group, the room is created by
+// the first live message (or the membership change) and its creation
+// backfill finds nothing: CloudKit sync hasn't seen the chat yet, so the
+// user gets no context until the next full sync, if then. For a group with
+// no cloud_chat row, the join instead starts a targeted CloudKit fetch of
+// that chat, imports the messages from the configured window before the
+// join into cloud_message, and resets the room's backward backfill task so
+// the backfill queue bridges them above the message that created the room.
+// If the room doesn't exist yet, the imported rows are what its creation
+// backfill picks up. Each group is fetched at most once per run.
+//
+// Flow:
+//   live message / participant change adding us, unknown group
+//     → wait groupJoinBackfillDelay (Apple needs a moment to upload)
+//     → CloudFetchRecentMessages(any;+;<group>) → rows since join - window
+//     → upsert → BackfillTask reset → WakeupBackfillQueue
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+
+	"github.com/lrhodin/imessage/pkg/rustpushgo"
+)
+
+const (
+	// groupJoinBackfillDelay gives the user's devices time to upload the
+	// group's messages to CloudKit before the fetch.
+	groupJoinBackfillDelay = 30 * time.Second
+	// groupJoinFetchPages and groupJoinFetchMessages bound the fetch.
+	groupJoinFetchPages    = 5
+	groupJoinFetchMessages = 1000
+)
+
+// groupJoinBackfillState records the groups a join backfill was started
+// for. The zero value is ready to use.
+type groupJoinBackfillState struct {
+	mu      sync.Mutex
+	started map[string]bool
+}
+
+// start reports whether no join backfill was started for portalID yet, and
+// if so marks it started.
+func (s *groupJoinBackfillState) start(portalID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.started[portalID] {
+		return false
+	}
+	if s.started == nil {
+		s.started = make(map[string]bool)
+	}
+	s.started[portalID] = true
+	return true
+}
+
+// groupJoinBackfillWindow returns how far before a join to backfill, or
+// zero when join backfill is off.
+func (c *IMClient) groupJoinBackfillWindow() time.Duration {
+	hours := c.Main.Config.GroupJoinBackfillHours
+	if hours <= 0 {
+		return 0
+	}
+	return time.Duration(hours) * time.Hour
+}
+
+// addedToGroup reports whether a participant change added one of the
+// user's handles: it's in the new list but wasn't in the old one.
+func addedToGroup(oldParticipants, newParticipants []string, isMe func(string) bool) bool {
+	has := func(participants []string) bool {
+		for _, p := range participants {
+			if n := normalizeIdentifierForPortalID(p); n != "" && isMe(n) {
+				return true
+			}
+		}
+		return false
+	}
+	return has(newParticipants) && !has(oldParticipants)
+}
+
+// groupJoinChatIDs returns the CloudKit chat IDs to try for a group, from
+// its gid: portal ID and the group GUID a message carried.
+func groupJoinChatIDs(portalID, groupGUID string) []string {
+	var ids []string
+	seen := make(map[string]bool)
+	for _, id := range []string{strings.TrimPrefix(portalID, "gid:"), groupGUID} {
+		if id == "" || strings.Contains(id, ",") || seen[normalizeUUID(id)] {
+			continue
+		}
+		seen[normalizeUUID(id)] = true
+		ids = append(ids, "any;+;"+id, "iMessage;+;"+id)
+	}
+	return ids
+}
+
+// groupJoinRows converts the fetched messages sent since since into rows.
+func groupJoinRows(msgs []rustpushgo.WrappedCloudSyncMessage, portalID string, since time.Time) []cloudMessageRow {
+	var rows []cloudMessageRow
+	for _, msg := range msgs {
+		if msg.Deleted || msg.TimestampMs < since.UnixMilli() {
+			continue
+		}
+		rows = append(rows, cloudSyncMessageRow(msg, portalID))
+	}
+	return rows
+}
+
+// groupJoinBackfillDue reports whether joining portalID should start a
+// join backfill: the option is on, it's a group CloudKit sync doesn't know
+// of, and none was started for it yet.
+func (c *IMClient) groupJoinBackfillDue(ctx context.Context, portalID string) bool {
+	if c.groupJoinBackfillWindow() == 0 || !isGroupPortalID(portalID) || c.cloudStore == nil || !c.useCloudKitBackfill() {
+		return false
+	}
+	if known, err := c.cloudStore.portalHasChat(ctx, portalID); err != nil || known {
+		return false
+	}
+	return c.groupJoinBackfills.start(portalID)
+}
+
+// maybeBackfillGroupJoin starts a join backfill for portalKey if it's due.
+// groupGUID is the group's GUID if known, joinedAt when the user joined.
+func (c *IMClient) maybeBackfillGroupJoin(log zerolog.Logger, portalKey networkid.PortalKey, groupGUID string, joinedAt time.Time) {
+	if !c.groupJoinBackfillDue(context.Background(), string(portalKey.ID)) {
+		return
+	}
+	log = log.With().Str("component", "group_join_backfill").Str("portal_id", string(portalKey.ID)).Logger()
+	since := joinedAt.Add(-c.groupJoinBackfillWindow())
+	log.Info().Time("since", since).Msg("Joined an unknown group, scheduling backfill of its recent messages")
+	go func() {
+		select {
+		case <-time.After(groupJoinBackfillDelay):
+		case <-c.stopChan:
+			return
+		}
+		if err := c.backfillGroupJoin(log.WithContext(context.Background()), portalKey, groupGUID, since); err != nil {
+			log.Warn().Err(err).Msg("Group join backfill failed")
+		}
+	}()
+}
+
+// backfillGroupJoin fetches and imports the group's messages since since,
+// then queues a backward backfill of its room if it has one.
+func (c *IMClient) backfillGroupJoin(ctx context.Context, portalKey networkid.PortalKey, groupGUID string, since time.Time) error {
+	log := zerolog.Ctx(ctx)
+	portalID := string(portalKey.ID)
+	if c.client == nil {
+		return fmt.Errorf("rustpush client not initialized")
+	}
+	var msgs []rustpushgo.WrappedCloudSyncMessage
+	for _, chatID := range groupJoinChatIDs(portalID, groupGUID) {
+		fetched, err := c.safeCloudFetchRecent(*log, &chatID, groupJoinFetchPages, groupJoinFetchMessages)
+		if err != nil {
+			return fmt.Errorf("fetch %s: %w", chatID, err)
+		}
+		log.Debug().Str("cloud_chat_id", chatID).Int("count", len(fetched)).Msg("Fetched messages for joined group")
+		if len(fetched) > 0 {
+			msgs = fetched
+			break
+		}
+	}
+	rows := groupJoinRows(msgs, portalID, since)
+	if len(rows) == 0 {
+		log.Info().Msg("No recent messages in CloudKit for joined group")
+		return nil
+	}
+	if err := c.cloudStore.upsertMessageBatch(ctx, rows); err != nil {
+		return fmt.Errorf("failed to import messages: %w", err)
+	}
+	log.Info().Int("imported", len(rows)).Msg("Imported recent messages for joined group")
+
+	portal, err := c.Main.Bridge.GetExistingPortalByKey(ctx, portalKey)
+	if err != nil {
+		return fmt.Errorf("failed to get portal: %w", err)
+	} else if portal == nil || portal.MXID == "" {
+		// Room creation backfills the imported rows.
+		return nil
+	}
+	err = c.Main.Bridge.DB.BackfillTask.Upsert(ctx, &database.BackfillTask{
+		PortalKey:         portalKey,
+		UserLoginID:       c.UserLogin.ID,
+		BatchCount:        -1,
+		NextDispatchMinTS: time.Now(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to reset backfill task: %w", err)
+	}
+	c.Main.Bridge.WakeupBackfillQueue()
+	return nil
+}
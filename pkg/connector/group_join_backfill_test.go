@@ -0,0 +1,120 @@
+package connector
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+
+	"github.com/lrhodin/imessage/pkg/rustpushgo"
+)
+
+func TestAddedToGroup(t *testing.T) {
+	isMe := func(handle string) bool { return handle == "tel:+15550000000" }
+	tests := []struct {
+		name     string
+		old, new []string
+		want     bool
+	}{
+		{"added", []string{"tel:+15551111111", "tel:+15552222222"}, []string{"tel:+15551111111", "tel:+15552222222", "+15550000000"}, true},
+		{"added to a group we didn't know", nil, []string{"tel:+15551111111", "tel:+15550000000"}, true},
+		{"already a member", []string{"tel:+15550000000", "tel:+15551111111"}, []string{"tel:+15550000000", "tel:+15551111111", "tel:+15552222222"}, false},
+		{"someone else added", []string{"tel:+15551111111"}, []string{"tel:+15551111111", "tel:+15552222222"}, false},
+		{"removed", []string{"tel:+15550000000", "tel:+15551111111"}, []string{"tel:+15551111111"}, false},
+	}
+	for _, tt := range tests {
+		if got := addedToGroup(tt.old, tt.new, isMe); got != tt.want {
+			t.Errorf("addedToGroup(%s) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestGroupJoinChatIDs(t *testing.T) {
+	tests := []struct {
+		portalID, groupGUID string
+		want                []string
+	}{
+		{"gid:abc-123", "", []string{"any;+;abc-123", "iMessage;+;abc-123"}},
+		{"gid:abc-123", "ABC123", []string{"any;+;abc-123", "iMessage;+;abc-123"}},
+		{"gid:abc", "def", []string{"any;+;abc", "iMessage;+;abc", "any;+;def", "iMessage;+;def"}},
+		{"tel:+1,tel:+2", "def", []string{"any;+;def", "iMessage;+;def"}},
+		{"tel:+1,tel:+2", "", nil},
+	}
+	for _, tt := range tests {
+		if got := groupJoinChatIDs(tt.portalID, tt.groupGUID); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("groupJoinChatIDs(%q, %q) = %v, want %v", tt.portalID, tt.groupGUID, got, tt.want)
+		}
+	}
+}
+
+func TestGroupJoinRows(t *testing.T) {
+	since := time.UnixMilli(10_000)
+	text := "hi"
+	msgs := []rustpushgo.WrappedCloudSyncMessage{
+		{Guid: "old", TimestampMs: 9_999, Text: &text},
+		{Guid: "new", TimestampMs: 10_000, Text: &text, CloudChatId: "any;+;abc"},
+		{Guid: "gone", TimestampMs: 12_000, Deleted: true},
+		{Guid: "newer", TimestampMs: 15_000, IsFromMe: true},
+	}
+	rows := groupJoinRows(msgs, "gid:abc", since)
+	var got []string
+	for _, row := range rows {
+		if row.PortalID != "gid:abc" {
+			t.Errorf("groupJoinRows() row %s portal = %q, want %q", row.GUID, row.PortalID, "gid:abc")
+		}
+		got = append(got, row.GUID)
+	}
+	if want := []string{"new", "newer"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("groupJoinRows() = %v, want %v", got, want)
+	}
+	if rows[0].Text != "hi" || rows[0].CloudChatID != "any;+;abc" || !rows[1].IsFromMe {
+		t.Errorf("groupJoinRows() = %+v, want fields carried over", rows)
+	}
+}
+
+func TestGroupJoinBackfillDue(t *testing.T) {
+	ctx := context.Background()
+	newClient := func(hours int) *IMClient {
+		return &IMClient{
+			Main:       &IMConnector{Config: IMConfig{CloudKitBackfill: true, GroupJoinBackfillHours: hours}},
+			UserLogin:  &bridgev2.UserLogin{UserLogin: &database.UserLogin{}},
+			cloudStore: newTestCloudStore(t),
+		}
+	}
+
+	c := newClient(24)
+	if _, err := c.cloudStore.db.Exec(ctx, `
+		INSERT INTO cloud_chat (login_id, cloud_chat_id, record_name, group_id, portal_id, service, participants_json, updated_ts, created_ts)
+		VALUES ($1, 'any;+;known', 'rec', 'known', 'gid:known', 'iMessage', '[]', 0, 0)
+	`, c.cloudStore.loginID); err != nil {
+		t.Fatalf("insert cloud_chat: %v", err)
+	}
+	tests := []struct {
+		name     string
+		portalID string
+		want     bool
+	}{
+		{"unknown group", "gid:new", true},
+		{"only once", "gid:new", false},
+		{"unknown comma group", "tel:+1,tel:+2", true},
+		{"known to CloudKit sync", "gid:known", false},
+		{"DM", "tel:+1", false},
+	}
+	for _, tt := range tests {
+		if got := c.groupJoinBackfillDue(ctx, tt.portalID); got != tt.want {
+			t.Errorf("groupJoinBackfillDue(%s) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	if got := newClient(0).groupJoinBackfillDue(ctx, "gid:new"); got {
+		t.Errorf("groupJoinBackfillDue() with option off = true, want false")
+	}
+	c = newClient(24)
+	c.Main.Config.CloudKitBackfill = false
+	if got := c.groupJoinBackfillDue(ctx, "gid:new"); got {
+		t.Errorf("groupJoinBackfillDue() without CloudKit backfill = true, want false")
+	}
+}
@@ -0,0 +1,71 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2024 Ludvig Rhodin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+package connector
+
+// Member limit for large groups (group_member_limit).
+//
+// Every entry in a portal's member map is a ghost bridgev2 creates, fetches
+// user info (contact lookup, avatar) for and joins to the room, so creating
+// or resyncing the room of a group with hundreds of members takes minutes.
+// With a limit, GetChatInfo only puts the user and the first members of the
+// roster up to the limit in the member map, and marks the list as not full
+// so the members left out aren't kicked if they're already in the room.
+// Left-out members still get a ghost when they send a message, and the
+// members command lists the whole roster.
+
+import (
+	"context"
+
+	"github.com/rs/zerolog"
+)
+
+// capGroupMembers keeps every member isMe matches and the first limit other
+// distinct members. capped reports whether any member was left out. A limit
+// of 0 or less keeps everyone.
+func capGroupMembers(members []string, limit int, isMe func(string) bool) (kept []string, capped bool) {
+	if limit <= 0 {
+		return members, false
+	}
+	seen := make(map[string]bool)
+	others := 0
+	for _, member := range members {
+		if isMe(member) {
+			kept = append(kept, member)
+			continue
+		}
+		id := normalizeIdentifierForPortalID(member)
+		if id == "" {
+			id = member
+		}
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		if others < limit {
+			kept = append(kept, member)
+			others++
+		} else {
+			capped = true
+		}
+	}
+	return kept, capped
+}
+
+// limitGroupMembers applies group_member_limit to a group's roster.
+func (c *IMClient) limitGroupMembers(ctx context.Context, portalID string, members []string) (kept []string, capped bool) {
+	kept, capped = capGroupMembers(members, c.Main.Config.GroupMemberLimit, c.isMyHandle)
+	if capped {
+		zerolog.Ctx(ctx).Debug().
+			Str("portal_id", portalID).
+			Int("members", len(members)).
+			Int("kept", len(kept)).
+			Msg("Group has more members than group_member_limit, leaving the rest out of the room")
+	}
+	return kept, capped
+}
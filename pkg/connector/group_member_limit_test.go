@@ -0,0 +1,75 @@
+package connector
+
+import (
+	"context"
+	"reflect"
+	"slices"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+)
+
+func TestCapGroupMembers(t *testing.T) {
+	isMe := func(member string) bool { return member == "tel:+15550000000" }
+	members := []string{"tel:+15551111111", "tel:+15550000000", "tel:+15552222222", "15552222222", "tel:+15553333333"}
+	tests := []struct {
+		name       string
+		limit      int
+		want       []string
+		wantCapped bool
+	}{
+		{"no limit", 0, members, false},
+		{"under the limit", 5, []string{"tel:+15551111111", "tel:+15550000000", "tel:+15552222222", "tel:+15553333333"}, false},
+		{"at the limit", 3, []string{"tel:+15551111111", "tel:+15550000000", "tel:+15552222222", "tel:+15553333333"}, false},
+		{"over the limit keeps me", 1, []string{"tel:+15551111111", "tel:+15550000000"}, true},
+	}
+	for _, tt := range tests {
+		got, capped := capGroupMembers(members, tt.limit, isMe)
+		if !reflect.DeepEqual(got, tt.want) || capped != tt.wantCapped {
+			t.Errorf("capGroupMembers(%s) = %v, %v, want %v, %v", tt.name, got, capped, tt.want, tt.wantCapped)
+		}
+	}
+}
+
+func TestGetChatInfoGroupMemberLimit(t *testing.T) {
+	portal := &bridgev2.Portal{Portal: &database.Portal{
+		PortalKey: networkid.PortalKey{ID: "tel:+15551111111,tel:+15552222222,tel:+15553333333,tel:+15550000000", Receiver: "login"},
+		MXID:      "!room:example.com",
+		Name:      "Big group",
+	}}
+	tests := []struct {
+		name     string
+		limit    int
+		want     []networkid.UserID
+		wantFull bool
+	}{
+		{"no limit", 0, []networkid.UserID{"tel:+15550000000", "tel:+15551111111", "tel:+15552222222", "tel:+15553333333"}, true},
+		{"capped", 2, []networkid.UserID{"tel:+15550000000", "tel:+15551111111", "tel:+15552222222"}, false},
+	}
+	for _, tt := range tests {
+		c := &IMClient{
+			Main:       &IMConnector{Config: IMConfig{GroupMemberLimit: tt.limit}},
+			UserLogin:  &bridgev2.UserLogin{UserLogin: &database.UserLogin{ID: "login"}, Log: zerolog.Nop()},
+			handle:     "tel:+15550000000",
+			allHandles: []string{"tel:+15550000000"},
+		}
+		info, err := c.GetChatInfo(context.Background(), portal)
+		if err != nil {
+			t.Fatalf("GetChatInfo(%s) error = %v", tt.name, err)
+		}
+		var got []networkid.UserID
+		for userID := range info.Members.MemberMap {
+			got = append(got, userID)
+		}
+		slices.Sort(got)
+		if !reflect.DeepEqual(got, tt.want) || info.Members.IsFull != tt.wantFull {
+			t.Errorf("GetChatInfo(%s) members = %v, full %v, want %v, full %v", tt.name, got, info.Members.IsFull, tt.want, tt.wantFull)
+		}
+		if me := info.Members.MemberMap["tel:+15550000000"]; !me.IsFromMe {
+			t.Errorf("GetChatInfo(%s) own member = %+v, want IsFromMe", tt.name, me)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2024 Ludvig Rhodin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+package connector
+
+// members — list everyone in a group chat.
+//
+// buildGroupName cuts large groups down to "A, B, C +N more", and the Matrix
+// member list of a gid: portal only has the ghosts of people who have been
+// synced or have spoken (or, with group_member_limit, only the first
+// members), so neither shows the whole group. The command
+// lists the full roster the bridge sends to (resolveGroupMembers: the
+// cloud_chat participants, or the in-memory roster from live messages),
+// with contact names where there's a contact.
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"maunium.net/go/mautrix/bridgev2/commands"
+)
+
+// groupMember is one line of the members listing.
+type groupMember struct {
+	ID   string // portal-ID form, e.g. tel:+15551234567
+	Name string // contact name, empty if there's no contact
+	IsMe bool
+}
+
+// groupMembers resolves names for a group's member identifiers. Duplicate
+// identifiers are listed once.
+func (c *IMClient) groupMembers(memberIDs []string) []groupMember {
+	seen := make(map[string]bool, len(memberIDs))
+	members := make([]groupMember, 0, len(memberIDs))
+	for _, memberID := range memberIDs {
+		memberID = normalizeIdentifierForPortalID(memberID)
+		if memberID == "" || seen[memberID] {
+			continue
+		}
+		seen[memberID] = true
+		if c.isMyHandle(memberID) {
+			members = append(members, groupMember{ID: memberID, IsMe: true})
+			continue
+		}
+		members = append(members, groupMember{ID: memberID, Name: c.memberContactName(memberID)})
+	}
+	return members
+}
+
+// formatGroupMembers renders the members listing: contacts alphabetically,
+// then members without a contact, then the user's own handles.
+func formatGroupMembers(members []groupMember) string {
+	sorted := make([]groupMember, len(members))
+	copy(sorted, members)
+	rank := func(m groupMember) int {
+		switch {
+		case m.IsMe:
+			return 2
+		case m.Name == "":
+			return 1
+		default:
+			return 0
+		}
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if ri, rj := rank(sorted[i]), rank(sorted[j]); ri != rj {
+			return ri < rj
+		}
+		if ni, nj := strings.ToLower(sorted[i].Name), strings.ToLower(sorted[j].Name); ni != nj {
+			return ni < nj
+		}
+		return stripIdentifierPrefix(sorted[i].ID) < stripIdentifierPrefix(sorted[j].ID)
+	})
+
+	others := 0
+	for _, m := range sorted {
+		if !m.IsMe {
+			others++
+		}
+	}
+	var sb strings.Builder
+	if others == 1 {
+		sb.WriteString("**1 member** besides you:\n\n")
+	} else {
+		fmt.Fprintf(&sb, "**%d members** besides you:\n\n", others)
+	}
+	for i, m := range sorted {
+		handle := stripIdentifierPrefix(m.ID)
+		switch {
+		case m.IsMe:
+			fmt.Fprintf(&sb, "%d. You (`%s`)\n", i+1, handle)
+		case m.Name != "":
+			fmt.Fprintf(&sb, "%d. %s (`%s`)\n", i+1, m.Name, handle)
+		default:
+			fmt.Fprintf(&sb, "%d. `%s`\n", i+1, handle)
+		}
+	}
+	return strings.TrimSuffix(sb.String(), "\n")
+}
+
+var cmdGroupMembers = &commands.FullHandler{
+	Name: "members",
+	Func: fnGroupMembers,
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionChats,
+		Description: "List all members of this group chat with their contact names.",
+	},
+	RequiresLogin:  true,
+	RequiresPortal: true,
+}
+
+func fnGroupMembers(ce *commands.Event) {
+	portalID := string(ce.Portal.ID)
+	if !isGroupPortalID(portalID) {
+		ce.Reply("This only works in a group chat.")
+		return
+	}
+	login := ce.User.GetDefaultLogin()
+	if login == nil {
+		ce.Reply("Not logged in.")
+		return
+	}
+	client, ok := login.Client.(*IMClient)
+	if !ok || client == nil {
+		ce.Reply("Bridge client not available.")
+		return
+	}
+	memberIDs, partial := client.resolveGroupMembersPartial(ce.Ctx, portalID)
+	members := client.groupMembers(memberIDs)
+	if len(members) == 0 {
+		ce.Reply("The member list of this group isn't known yet. It's filled in by CloudKit sync and by new messages in the group.")
+		return
+	}
+	reply := formatGroupMembers(members)
+	if partial {
+		reply += "\n\n_The group's chat record hasn't synced, so this only lists members who have sent a message._"
+	}
+	if _, capped := capGroupMembers(memberIDs, client.Main.Config.GroupMemberLimit, client.isMyHandle); capped {
+		reply += fmt.Sprintf("\n\n_Only the first %d members are in the Matrix room (group_member_limit)._", client.Main.Config.GroupMemberLimit)
+	}
+	ce.Reply(reply)
+}
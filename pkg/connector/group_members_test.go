@@ -0,0 +1,70 @@
+package connector
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/lrhodin/imessage/imessage"
+)
+
+func TestGroupMembers(t *testing.T) {
+	alice := &imessage.Contact{FirstName: "Alice", LastName: "Smith", Phones: []string{"+15551230001"}}
+	c := &IMClient{
+		Main: &IMConnector{Config: IMConfig{DisplaynameTemplate: "{{.FirstName}} {{.LastName}}"}},
+		contacts: &externalCardDAVClient{
+			byPhone: map[string]*imessage.Contact{"+15551230001": alice, "15551230001": alice, "5551230001": alice},
+			byEmail: map[string]*imessage.Contact{},
+		},
+		allHandles: []string{"mailto:me@example.com"},
+	}
+	if err := c.Main.Config.PostProcess(); err != nil {
+		t.Fatalf("PostProcess() error = %v", err)
+	}
+
+	got := c.groupMembers([]string{"tel:+15551230001", "mailto:me@example.com", "+15551230002", "tel:+15551230001"})
+	want := []groupMember{
+		{ID: "tel:+15551230001", Name: "Alice Smith"},
+		{ID: "mailto:me@example.com", IsMe: true},
+		{ID: "tel:+15551230002"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("groupMembers() = %+v, want %+v", got, want)
+	}
+}
+
+func TestFormatGroupMembers(t *testing.T) {
+	tests := []struct {
+		name    string
+		members []groupMember
+		want    string
+	}{
+		{
+			"contacts, unknown numbers and self",
+			[]groupMember{
+				{ID: "tel:+15551230009"},
+				{ID: "mailto:me@example.com", IsMe: true},
+				{ID: "tel:+15551230002", Name: "bob Jones"},
+				{ID: "tel:+15551230001", Name: "Alice Smith"},
+				{ID: "mailto:carol@example.com"},
+			},
+			"**4 members** besides you:\n\n" +
+				"1. Alice Smith (`+15551230001`)\n" +
+				"2. bob Jones (`+15551230002`)\n" +
+				"3. `+15551230009`\n" +
+				"4. `carol@example.com`\n" +
+				"5. You (`me@example.com`)",
+		},
+		{
+			"single other member",
+			[]groupMember{{ID: "tel:+15551230001", Name: "Alice"}},
+			"**1 member** besides you:\n\n1. Alice (`+15551230001`)",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := formatGroupMembers(tt.members); got != tt.want {
+				t.Errorf("formatGroupMembers() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
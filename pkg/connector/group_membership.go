@@ -0,0 +1,186 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2024 Ludvig Rhodin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+package connector
+
+// Outbound group membership changes.
+//
+// Inviting a ghost to a group portal adds that person to the iMessage
+// group and kicking one removes them, by sending a ChangeParticipants
+// message with the whole new roster. Apple's clients apply it like a
+// change made on an iPhone; handleParticipantChange covers the other
+// direction.
+//
+// Only gid: portals are supported. A legacy comma-separated portal is keyed
+// by its roster, so changing members would re-key the portal while bridgev2
+// is still handling the member event for it; such a group gets a gid: key
+// as soon as a message with its group ID arrives. SMS/MMS groups have no
+// way to change members at all.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/bridgev2/simplevent"
+	"maunium.net/go/mautrix/event"
+)
+
+// rosterChange is what a Matrix membership change does to a group roster.
+type rosterChange int
+
+const (
+	rosterUnchanged rosterChange = iota
+	rosterAdd
+	rosterRemove
+)
+
+// membershipRosterChange maps a Matrix membership change to a roster change:
+// an invite adds the target, a kick removes them. Everything else (joins,
+// leaves, bans, knocks) has no iMessage equivalent.
+func membershipRosterChange(t bridgev2.MembershipChangeType) rosterChange {
+	switch t {
+	case bridgev2.Invite:
+		return rosterAdd
+	case bridgev2.Kick:
+		return rosterRemove
+	default:
+		return rosterUnchanged
+	}
+}
+
+// applyRosterChange returns participants with target added or removed, and
+// whether anything changed. Identifiers are compared in portal ID form.
+func applyRosterChange(participants []string, target string, change rosterChange) ([]string, bool) {
+	target = normalizeIdentifierForPortalID(target)
+	out := make([]string, 0, len(participants)+1)
+	present := false
+	for _, p := range participants {
+		if normalizeIdentifierForPortalID(p) == target {
+			present = true
+			if change == rosterRemove {
+				continue
+			}
+		}
+		out = append(out, p)
+	}
+	switch {
+	case change == rosterAdd && !present:
+		return append(out, target), true
+	case change == rosterRemove && present:
+		return out, true
+	default:
+		return participants, false
+	}
+}
+
+// checkRosterComplete refuses a roster a participant change can't be built
+// on. ChangeParticipants replaces the whole member list, so sending one
+// based on a missing roster, or the partial one derived from message
+// senders, would drop everyone it doesn't know about from the group. A
+// roster without any of our own handles is stale or someone else's.
+func checkRosterComplete(members []string, partial bool, isMine func(string) bool) error {
+	if len(members) == 0 || partial {
+		return errors.New("the full member list of this group isn't known yet, so its members can't be changed from Matrix")
+	}
+	for _, member := range members {
+		if isMine(member) {
+			return nil
+		}
+	}
+	return errors.New("you don't appear in this group's member list, so its members can't be changed from Matrix")
+}
+
+// HandleMatrixMembership sends an invite or kick in a group portal to
+// iMessage as a participant change.
+func (c *IMClient) HandleMatrixMembership(ctx context.Context, msg *bridgev2.MatrixMembershipChange) (*bridgev2.MatrixMembershipResult, error) {
+	change := membershipRosterChange(msg.Type)
+	if change == rosterUnchanged {
+		// The user's own joins and leaves only concern the Matrix room.
+		if msg.Type.IsSelf {
+			return nil, nil
+		}
+		return nil, bridgev2.ErrMembershipNotSupported
+	}
+	if c.client == nil {
+		return nil, bridgev2.ErrNotLoggedIn
+	}
+	portalID := string(msg.Portal.ID)
+	if !isGroupPortalID(portalID) {
+		return nil, errors.New("members can only be added to or removed from group chats")
+	} else if !strings.HasPrefix(portalID, "gid:") {
+		return nil, errors.New("this group has no iMessage group ID yet, so its members can't be changed from Matrix")
+	}
+	ghost, ok := msg.Target.(*bridgev2.Ghost)
+	if !ok {
+		return nil, errors.New("only iMessage contacts can be added to or removed from a group")
+	}
+	target := normalizeIdentifierForPortalID(string(ghost.ID))
+	if target == "" || c.isMyHandle(target) {
+		return nil, fmt.Errorf("can't change membership of %s", ghost.ID)
+	}
+
+	conv := c.portalToConversation(msg.Portal)
+	if conv.IsSms {
+		return nil, errors.New("members of SMS/MMS groups can't be changed")
+	}
+	members, partial := c.resolveGroupMembersPartial(ctx, portalID)
+	if err := checkRosterComplete(members, partial, c.isMyHandle); err != nil {
+		return nil, err
+	}
+	conv.Participants = members
+	if change == rosterAdd {
+		// Only finding the target counts: an empty lookup may have failed.
+		found, ok := c.lookupReachability([]string{target}, c.portalHandle(msg.Portal))
+		if !ok || !found[target] {
+			return nil, fmt.Errorf("%s is not on iMessage, or couldn't be looked up", target)
+		}
+	}
+	newParticipants, changed := applyRosterChange(members, target, change)
+	if !changed {
+		return nil, nil
+	}
+
+	log := zerolog.Ctx(ctx)
+	log.Info().
+		Str("portal_id", portalID).
+		Str("target", target).
+		Bool("add", change == rosterAdd).
+		Msg("Sending group participant change to iMessage")
+	// Apple only needs the version to increase; the Unix time does that.
+	_, err := c.client.SendChangeParticipants(conv, newParticipants, uint64(time.Now().Unix()), c.portalHandle(msg.Portal))
+	if err != nil {
+		return nil, fmt.Errorf("failed to send participant change: %w", err)
+	}
+	c.persistGroupParticipantsIfChanged(portalID, newParticipants)
+	if change == rosterAdd {
+		// bridgev2 leaves the ghost invited; have it join like a member
+		// added from an iPhone would.
+		c.Main.Bridge.QueueRemoteEvent(c.UserLogin, &simplevent.ChatInfoChange{
+			EventMeta: simplevent.EventMeta{
+				Type:      bridgev2.RemoteEventChatInfoChange,
+				PortalKey: msg.Portal.PortalKey,
+				Sender:    c.makeEventSender(nil),
+				Timestamp: time.Now(),
+			},
+			ChatInfoChange: &bridgev2.ChatInfoChange{
+				MemberChanges: &bridgev2.ChatMemberList{
+					MemberMap: map[networkid.UserID]bridgev2.ChatMember{
+						ghost.ID: {EventSender: bridgev2.EventSender{Sender: ghost.ID}, Membership: event.MembershipJoin},
+					},
+				},
+			},
+		})
+	}
+	return nil, nil
+}
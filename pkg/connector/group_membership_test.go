@@ -0,0 +1,112 @@
+package connector
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridgev2"
+)
+
+func TestMembershipRosterChange(t *testing.T) {
+	tests := []struct {
+		name string
+		typ  bridgev2.MembershipChangeType
+		want rosterChange
+	}{
+		{"invite adds", bridgev2.Invite, rosterAdd},
+		{"kick removes", bridgev2.Kick, rosterRemove},
+		{"leave", bridgev2.Leave, rosterUnchanged},
+		{"ban", bridgev2.BanJoined, rosterUnchanged},
+		{"accept invite", bridgev2.AcceptInvite, rosterUnchanged},
+		{"revoke invite", bridgev2.RevokeInvite, rosterUnchanged},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := membershipRosterChange(tt.typ); got != tt.want {
+				t.Errorf("membershipRosterChange() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyRosterChange(t *testing.T) {
+	roster := []string{"tel:+15550000001", "mailto:me@icloud.com", "mailto:bob@example.com"}
+	tests := []struct {
+		name        string
+		target      string
+		change      rosterChange
+		want        []string
+		wantChanged bool
+	}{
+		{
+			name:        "invite adds",
+			target:      "tel:+15550000002",
+			change:      rosterAdd,
+			want:        []string{"tel:+15550000001", "mailto:me@icloud.com", "mailto:bob@example.com", "tel:+15550000002"},
+			wantChanged: true,
+		},
+		{
+			name:        "kick removes",
+			target:      "mailto:bob@example.com",
+			change:      rosterRemove,
+			want:        []string{"tel:+15550000001", "mailto:me@icloud.com"},
+			wantChanged: true,
+		},
+		{
+			name:        "kick matches a differently written identifier",
+			target:      "mailto:Bob@Example.com",
+			change:      rosterRemove,
+			want:        []string{"tel:+15550000001", "mailto:me@icloud.com"},
+			wantChanged: true,
+		},
+		{"invite of a member", "tel:+15550000001", rosterAdd, roster, false},
+		{"kick of a non-member", "tel:+15550000009", rosterRemove, roster, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, changed := applyRosterChange(roster, tt.target, tt.change)
+			if !reflect.DeepEqual(got, tt.want) || changed != tt.wantChanged {
+				t.Errorf("applyRosterChange() = %v, %v, want %v, %v", got, changed, tt.want, tt.wantChanged)
+			}
+		})
+	}
+}
+
+func TestCheckRosterComplete(t *testing.T) {
+	isMine := func(handle string) bool { return handle == "mailto:me@icloud.com" }
+	tests := []struct {
+		name    string
+		members []string
+		partial bool
+		wantErr bool
+	}{
+		{"full roster with us", []string{"tel:+15550000001", "mailto:me@icloud.com"}, false, false},
+		{"no roster", nil, false, true},
+		{"partial roster from senders", []string{"tel:+15550000001", "mailto:me@icloud.com"}, true, true},
+		{"roster without us", []string{"tel:+15550000001", "tel:+15550000002"}, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkRosterComplete(tt.members, tt.partial, isMine); (err != nil) != tt.wantErr {
+				t.Errorf("checkRosterComplete() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestHandleMatrixMembershipUnsupported(t *testing.T) {
+	c := &IMClient{UserLogin: &bridgev2.UserLogin{Log: zerolog.Nop()}}
+	ctx := context.Background()
+
+	// The user's own joins and leaves are fine and never reach iMessage.
+	for _, typ := range []bridgev2.MembershipChangeType{bridgev2.AcceptInvite, bridgev2.Leave, bridgev2.ProfileChange} {
+		if _, err := c.HandleMatrixMembership(ctx, &bridgev2.MatrixMembershipChange{Type: typ}); err != nil {
+			t.Errorf("HandleMatrixMembership(%+v) error = %v, want nil", typ, err)
+		}
+	}
+	if _, err := c.HandleMatrixMembership(ctx, &bridgev2.MatrixMembershipChange{Type: bridgev2.BanJoined}); err == nil || err.Error() != bridgev2.ErrMembershipNotSupported.Error() {
+		t.Errorf("HandleMatrixMembership(ban) error = %v, want ErrMembershipNotSupported", err)
+	}
+}
@@ -0,0 +1,135 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2024 Ludvig Rhodin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+package connector
+
+// Group notice coalescing (group_notice_coalesce_seconds).
+//
+// Every group rename and membership change becomes a state event with its
+// own line in the room's timeline. Someone toggling the group name back and
+// forth, or a burst of membership changes, floods the room with them. With
+// a window set, the first change of a kind for a portal is held for that
+// many seconds; later changes of the same kind replace it, and only the
+// last one is bridged when the window ends. Each change carries the group's
+// whole state of that kind (the name, the full member list), so the last
+// one covers the ones it replaced, and a name toggled back to where it
+// started doesn't produce a notice at all. Power levels given to the actors
+// of replaced changes (group_actor_power_level) are carried over. A window
+// of 0 bridges each change as it arrives (default).
+
+import (
+	"sync"
+	"time"
+
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/bridgev2/simplevent"
+)
+
+const (
+	groupNoticeRename  = "rename"
+	groupNoticeMembers = "members"
+)
+
+// groupNoticeCoalescer holds group changes during their window. The zero
+// value is ready to use.
+type groupNoticeCoalescer struct {
+	mu      sync.Mutex
+	pending map[string]*simplevent.ChatInfoChange
+	// afterFunc runs f once window has passed; time.AfterFunc when nil.
+	afterFunc func(window time.Duration, f func())
+}
+
+// submit bridges evt through emit, right away when window is zero, or else
+// once the window for key has passed, unless a later change for key
+// replaces it before then.
+func (gc *groupNoticeCoalescer) submit(key string, evt *simplevent.ChatInfoChange, window time.Duration, emit func(*simplevent.ChatInfoChange)) {
+	if window <= 0 {
+		emit(evt)
+		return
+	}
+	gc.mu.Lock()
+	if gc.pending == nil {
+		gc.pending = make(map[string]*simplevent.ChatInfoChange)
+	}
+	older, waiting := gc.pending[key]
+	if waiting {
+		carryGroupActors(older, evt)
+	}
+	gc.pending[key] = evt
+	gc.mu.Unlock()
+	if waiting {
+		return
+	}
+	flush := func() {
+		gc.mu.Lock()
+		latest := gc.pending[key]
+		delete(gc.pending, key)
+		gc.mu.Unlock()
+		if latest != nil {
+			emit(latest)
+		}
+	}
+	if gc.afterFunc != nil {
+		gc.afterFunc(window, flush)
+	} else {
+		time.AfterFunc(window, flush)
+	}
+}
+
+// carryGroupActors gives the members that older raised a power level for
+// the same level in newer, where newer doesn't set one itself. As in
+// withGroupActor, members missing from a full list have left and stay out.
+func carryGroupActors(older, newer *simplevent.ChatInfoChange) {
+	if older.ChatInfoChange == nil || older.ChatInfoChange.MemberChanges == nil || newer.ChatInfoChange == nil {
+		return
+	}
+	for userID, member := range older.ChatInfoChange.MemberChanges.MemberMap {
+		if member.PowerLevel == nil {
+			continue
+		}
+		members := newer.ChatInfoChange.MemberChanges
+		if members == nil {
+			members = &bridgev2.ChatMemberList{}
+			newer.ChatInfoChange.MemberChanges = members
+		}
+		current, ok := members.MemberMap[userID]
+		if !ok {
+			if members.IsFull {
+				continue
+			}
+			current = member
+		} else if current.PowerLevel != nil {
+			continue
+		}
+		current.PowerLevel = member.PowerLevel
+		if members.MemberMap == nil {
+			members.MemberMap = make(map[networkid.UserID]bridgev2.ChatMember)
+		}
+		members.MemberMap[userID] = current
+	}
+}
+
+// groupNoticeCoalesceWindow returns the configured coalescing window, or
+// zero when coalescing is off.
+func (c *IMClient) groupNoticeCoalesceWindow() time.Duration {
+	secs := c.Main.Config.GroupNoticeCoalesceSeconds
+	if secs <= 0 {
+		return 0
+	}
+	return time.Duration(secs) * time.Second
+}
+
+// queueGroupNotice queues a group rename or membership change, coalesced
+// with others of the same kind for the portal.
+func (c *IMClient) queueGroupNotice(kind string, evt *simplevent.ChatInfoChange) {
+	key := string(evt.PortalKey.ID) + "|" + kind
+	c.groupNotices.submit(key, evt, c.groupNoticeCoalesceWindow(), func(evt *simplevent.ChatInfoChange) {
+		c.Main.Bridge.QueueRemoteEvent(c.UserLogin, evt)
+	})
+}
@@ -0,0 +1,164 @@
+package connector
+
+import (
+	"testing"
+	"time"
+
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/bridgev2/simplevent"
+
+	"github.com/lrhodin/imessage/pkg/rustpushgo"
+)
+
+// manualTimers collects the window callbacks of a groupNoticeCoalescer so a
+// test can end the windows itself.
+type manualTimers struct {
+	windows []time.Duration
+	pending []func()
+}
+
+func (m *manualTimers) afterFunc(window time.Duration, f func()) {
+	m.windows = append(m.windows, window)
+	m.pending = append(m.pending, f)
+}
+
+func (m *manualTimers) fire() {
+	pending := m.pending
+	m.pending = nil
+	for _, f := range pending {
+		f()
+	}
+}
+
+func TestGroupNoticeCoalesceRenameBurst(t *testing.T) {
+	portalKey := networkid.PortalKey{ID: "gid:9b2c6a5e-1111-2222-3333-444455556666", Receiver: "login"}
+	alice, bob := "tel:+15551111111", "tel:+15552222222"
+	burst := []struct {
+		sender string
+		name   string
+	}{
+		{alice, "Book Club"},
+		{bob, "Book Club!!"},
+		{alice, "Book Club"},
+		{bob, "Bookworms"},
+	}
+	tests := []struct {
+		name       string
+		powerLevel int
+		window     time.Duration
+		wantNames  []string
+	}{
+		{"off", 0, 0, []string{"Book Club", "Book Club!!", "Book Club", "Bookworms"}},
+		{"coalesced", 0, 10 * time.Second, []string{"Bookworms"}},
+		{"coalesced with actors", 50, 10 * time.Second, []string{"Bookworms"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &IMClient{
+				Main:       &IMConnector{Config: IMConfig{GroupActorPowerLevel: tt.powerLevel}},
+				allHandles: []string{"tel:+15559999999"},
+			}
+			timers := &manualTimers{}
+			gc := &groupNoticeCoalescer{afterFunc: timers.afterFunc}
+			var emitted []*simplevent.ChatInfoChange
+			emit := func(evt *simplevent.ChatInfoChange) { emitted = append(emitted, evt) }
+
+			for i, r := range burst {
+				sender := r.sender
+				evt := c.groupRenameEvent(portalKey, rustpushgo.WrappedMessage{Sender: &sender, TimestampMs: 1700000000000 + uint64(i)*1000}, r.name)
+				gc.submit(string(portalKey.ID)+"|"+groupNoticeRename, evt, tt.window, emit)
+			}
+			if tt.window > 0 {
+				if len(emitted) != 0 {
+					t.Fatalf("%d renames bridged before the window ended, want 0", len(emitted))
+				}
+				if len(timers.windows) != 1 || timers.windows[0] != tt.window {
+					t.Errorf("window timers = %v, want one of %v", timers.windows, tt.window)
+				}
+				timers.fire()
+			}
+
+			var names []string
+			for _, evt := range emitted {
+				names = append(names, *evt.ChatInfoChange.ChatInfo.Name)
+			}
+			if len(names) != len(tt.wantNames) {
+				t.Fatalf("bridged renames = %v, want %v", names, tt.wantNames)
+			}
+			for i := range names {
+				if names[i] != tt.wantNames[i] {
+					t.Errorf("bridged renames = %v, want %v", names, tt.wantNames)
+					break
+				}
+			}
+			last := emitted[len(emitted)-1]
+			if last.Sender.Sender != makeUserID(bob) {
+				t.Errorf("coalesced rename sender = %s, want %s", last.Sender.Sender, bob)
+			}
+			if tt.powerLevel > 0 {
+				// Both renamers keep the power level from their renames.
+				for _, actor := range []string{alice, bob} {
+					member, ok := last.ChatInfoChange.MemberChanges.MemberMap[makeUserID(actor)]
+					if !ok || member.PowerLevel == nil || *member.PowerLevel != tt.powerLevel {
+						t.Errorf("coalesced rename actor %s = %+v, want power level %d", actor, member, tt.powerLevel)
+					}
+				}
+			}
+
+			// The next rename after the window starts a new one.
+			if tt.window > 0 {
+				sender := alice
+				gc.submit(string(portalKey.ID)+"|"+groupNoticeRename, c.groupRenameEvent(portalKey, rustpushgo.WrappedMessage{Sender: &sender}, "Readers"), tt.window, emit)
+				if len(timers.pending) != 1 {
+					t.Errorf("rename after the window started %d timers, want 1", len(timers.pending))
+				}
+				timers.fire()
+				if got := *emitted[len(emitted)-1].ChatInfoChange.ChatInfo.Name; got != "Readers" {
+					t.Errorf("rename after the window = %q, want Readers", got)
+				}
+			}
+		})
+	}
+}
+
+func TestGroupNoticeCoalesceKeys(t *testing.T) {
+	timers := &manualTimers{}
+	gc := &groupNoticeCoalescer{afterFunc: timers.afterFunc}
+	var emitted []string
+	for _, key := range []string{"gid:a|rename", "gid:b|rename", "gid:a|members", "gid:a|rename"} {
+		key := key
+		gc.submit(key, &simplevent.ChatInfoChange{ChatInfoChange: &bridgev2.ChatInfoChange{}}, time.Second, func(*simplevent.ChatInfoChange) {
+			emitted = append(emitted, key)
+		})
+	}
+	timers.fire()
+	if len(emitted) != 3 {
+		t.Errorf("bridged %v, want one change each for gid:a renames, gid:b renames and gid:a members", emitted)
+	}
+}
+
+func TestCarryGroupActorsFullList(t *testing.T) {
+	pl := 50
+	left, stayed := makeUserID("tel:+15551111111"), makeUserID("tel:+15552222222")
+	older := &simplevent.ChatInfoChange{ChatInfoChange: &bridgev2.ChatInfoChange{MemberChanges: &bridgev2.ChatMemberList{
+		IsFull: true,
+		MemberMap: map[networkid.UserID]bridgev2.ChatMember{
+			left:   {EventSender: bridgev2.EventSender{Sender: left}, PowerLevel: &pl},
+			stayed: {EventSender: bridgev2.EventSender{Sender: stayed}, PowerLevel: &pl},
+		},
+	}}}
+	newer := &simplevent.ChatInfoChange{ChatInfoChange: &bridgev2.ChatInfoChange{MemberChanges: &bridgev2.ChatMemberList{
+		IsFull: true,
+		MemberMap: map[networkid.UserID]bridgev2.ChatMember{
+			stayed: {EventSender: bridgev2.EventSender{Sender: stayed}},
+		},
+	}}}
+	carryGroupActors(older, newer)
+	if _, ok := newer.ChatInfoChange.MemberChanges.MemberMap[left]; ok {
+		t.Errorf("carryGroupActors() re-added %s, who left", left)
+	}
+	if got := newer.ChatInfoChange.MemberChanges.MemberMap[stayed].PowerLevel; got == nil || *got != pl {
+		t.Errorf("carryGroupActors() power level of %s = %v, want %d", stayed, got, pl)
+	}
+}
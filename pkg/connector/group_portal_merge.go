@@ -0,0 +1,107 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2024 Ludvig Rhodin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+package connector
+
+// APNs/CloudKit duplicate group portals.
+//
+// A group message from APNs without a usable group UUID gets a
+// participant-based portal ("tel:+1…,tel:+1…"), while CloudKit always
+// knows the group as gid:<UUID>. When both get a room, the conversation is
+// split in two. Before the startup reconciliation pass, every bridged
+// comma portal is matched against the cloud_chat rosters with
+// findPortalIDsByParticipants, and one that matches exactly one gid:
+// portal is merged into it through reIDPortalWithCacheUpdate: if only the
+// comma portal has a room, the room is re-keyed to the gid: ID; if both
+// do, bridgev2 tombstones the comma room into the gid: one. The gid:
+// portal is the one kept, since its ID survives membership changes. A
+// comma portal matching several gid: portals is left alone: distinct
+// groups can share a roster.
+
+import (
+	"context"
+	"strings"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+)
+
+// groupPortalMerge merges the comma portal From into the gid: portal Into.
+type groupPortalMerge struct {
+	From string
+	Into string
+}
+
+// planGroupPortalMerges pairs each comma portal with the single gid: portal
+// whose roster matches its members. findMatches returns the portal IDs
+// whose participants match the given normalized members; non-gid matches
+// and the comma portal itself are ignored.
+func planGroupPortalMerges(commaPortals []string, findMatches func(members []string) []string) []groupPortalMerge {
+	var merges []groupPortalMerge
+	for _, portalID := range commaPortals {
+		if !strings.Contains(portalID, ",") {
+			continue
+		}
+		var gids []string
+		for _, match := range findMatches(strings.Split(portalID, ",")) {
+			if strings.HasPrefix(match, "gid:") && match != portalID {
+				gids = append(gids, match)
+			}
+		}
+		if len(gids) == 1 {
+			merges = append(merges, groupPortalMerge{From: portalID, Into: gids[0]})
+		}
+	}
+	return merges
+}
+
+// mergeDuplicateGroupPortals merges bridged comma portals into the gid:
+// portals CloudKit has for the same groups.
+func (c *IMClient) mergeDuplicateGroupPortals(ctx context.Context, log zerolog.Logger) {
+	if c.cloudStore == nil {
+		return
+	}
+	portals, err := c.Main.Bridge.GetAllPortalsWithMXID(ctx)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to list bridged portals for duplicate group check")
+		return
+	}
+	var commaPortals []string
+	for _, portal := range portals {
+		if portal.Receiver == c.UserLogin.ID && strings.Contains(string(portal.ID), ",") {
+			commaPortals = append(commaPortals, string(portal.ID))
+		}
+	}
+	merges := planGroupPortalMerges(commaPortals, func(members []string) []string {
+		matches, err := c.cloudStore.findPortalIDsByParticipants(ctx, members, c.isMyHandle)
+		if err != nil {
+			log.Warn().Err(err).Msg("Failed to match group participants against cloud chats")
+		}
+		return matches
+	})
+	for _, merge := range merges {
+		fromKey := networkid.PortalKey{ID: networkid.PortalID(merge.From), Receiver: c.UserLogin.ID}
+		intoKey := networkid.PortalKey{ID: networkid.PortalID(merge.Into), Receiver: c.UserLogin.ID}
+		result, _, err := c.reIDPortalWithCacheUpdate(ctx, fromKey, intoKey)
+		if err != nil {
+			log.Warn().Err(err).
+				Str("old_portal_id", merge.From).
+				Str("new_portal_id", merge.Into).
+				Msg("Failed to merge duplicate group portal")
+			continue
+		}
+		if err = c.cloudStore.reassignMessagePortalID(ctx, merge.From, merge.Into); err != nil {
+			log.Warn().Err(err).Str("portal_id", merge.From).Msg("Failed to re-point cloud messages of merged group portal")
+		}
+		log.Info().
+			Str("old_portal_id", merge.From).
+			Str("new_portal_id", merge.Into).
+			Int("result", int(result)).
+			Msg("Merged duplicate APNs group portal into CloudKit portal")
+	}
+}
@@ -0,0 +1,86 @@
+package connector
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestPlanGroupPortalMerges(t *testing.T) {
+	ctx := context.Background()
+	store := newTestCloudStore(t)
+	self := "tel:+15550000000"
+	isSelf := func(h string) bool { return h == self }
+
+	chats := []struct {
+		chatID, portalID, participants string
+	}{
+		// Same roster as the comma portal, minus self (CloudKit omits it).
+		{"chat-a", "gid:aaaa", `["+15551111111","+15552222222"]`},
+		// Two distinct groups sharing one roster.
+		{"chat-b1", "gid:bbb1", `["tel:+15553333333","tel:+15554444444"]`},
+		{"chat-b2", "gid:bbb2", `["tel:+15553333333","tel:+15554444444"]`},
+		// A cloud chat keyed by the comma ID itself isn't a merge target.
+		{"chat-c", "tel:+15550000000,tel:+15555555555,tel:+15556666666", `["tel:+15555555555","tel:+15556666666"]`},
+	}
+	for _, chat := range chats {
+		if _, err := store.db.Exec(ctx,
+			`INSERT INTO cloud_chat (login_id, cloud_chat_id, portal_id, participants_json, deleted, created_ts) VALUES ($1, $2, $3, $4, FALSE, 0)`,
+			store.loginID, chat.chatID, chat.portalID, chat.participants,
+		); err != nil {
+			t.Fatalf("insert cloud_chat: %v", err)
+		}
+	}
+
+	commaPortals := []string{
+		"tel:+15550000000,tel:+15551111111,tel:+15552222222",
+		"tel:+15550000000,tel:+15553333333,tel:+15554444444",
+		"tel:+15550000000,tel:+15555555555,tel:+15556666666",
+		"tel:+15550000000,tel:+15557777777,tel:+15558888888",
+		"tel:+15551111111",
+		"gid:aaaa",
+	}
+	got := planGroupPortalMerges(commaPortals, func(members []string) []string {
+		matches, err := store.findPortalIDsByParticipants(ctx, members, isSelf)
+		if err != nil {
+			t.Fatalf("findPortalIDsByParticipants() error = %v", err)
+		}
+		return matches
+	})
+	want := []groupPortalMerge{
+		{From: "tel:+15550000000,tel:+15551111111,tel:+15552222222", Into: "gid:aaaa"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("planGroupPortalMerges() = %v, want %v", got, want)
+	}
+}
+
+func TestReassignMessagePortalID(t *testing.T) {
+	ctx := context.Background()
+	store := newTestCloudStore(t)
+	for guid, portalID := range map[string]string{
+		"m1": "tel:+15550000000,tel:+15551111111",
+		"m2": "tel:+15550000000,tel:+15551111111",
+		"m3": "gid:other",
+	} {
+		if _, err := store.db.Exec(ctx,
+			`INSERT INTO cloud_message (login_id, guid, portal_id, timestamp_ms, is_from_me, created_ts, updated_ts) VALUES ($1, $2, $3, 0, FALSE, 0, 0)`,
+			store.loginID, guid, portalID,
+		); err != nil {
+			t.Fatalf("insert cloud_message: %v", err)
+		}
+	}
+	if err := store.reassignMessagePortalID(ctx, "tel:+15550000000,tel:+15551111111", "gid:aaaa"); err != nil {
+		t.Fatalf("reassignMessagePortalID() error = %v", err)
+	}
+	want := map[string]string{"m1": "gid:aaaa", "m2": "gid:aaaa", "m3": "gid:other"}
+	for guid, wantPortal := range want {
+		var portalID string
+		if err := store.db.QueryRow(ctx, `SELECT portal_id FROM cloud_message WHERE guid=$1`, guid).Scan(&portalID); err != nil {
+			t.Fatalf("select %s: %v", guid, err)
+		}
+		if portalID != wantPortal {
+			t.Errorf("portal_id of %s = %q, want %q", guid, portalID, wantPortal)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2024 Ludvig Rhodin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+package connector
+
+// Outbound group renames.
+//
+// Renaming a group portal on Matrix renames the iMessage group (or, for a
+// group created from Matrix that hasn't sent anything yet, the name its
+// first message will carry). Apple then delivers the rename back to us like
+// any other member's, and handleRename would turn it into a second
+// ChatInfoChange for a name the room already has. Renames we sent are
+// remembered for a short while (like recentUnsends) and their echo is
+// dropped.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridgev2"
+)
+
+// outboundRenameWindow is how long a sent rename waits for its echo.
+const outboundRenameWindow = 5 * time.Minute
+
+// outboundRenameSet tracks renames sent from Matrix. The zero value is
+// ready to use.
+type outboundRenameSet struct {
+	mu   sync.Mutex
+	sent map[string]time.Time
+}
+
+func outboundRenameKey(portalID, name string) string {
+	return portalID + "\x00" + name
+}
+
+// track records that portalID was renamed to name at now.
+func (s *outboundRenameSet) track(portalID, name string, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sent == nil {
+		s.sent = make(map[string]time.Time)
+	}
+	for k, t := range s.sent {
+		if now.Sub(t) >= outboundRenameWindow {
+			delete(s.sent, k)
+		}
+	}
+	s.sent[outboundRenameKey(portalID, name)] = now
+}
+
+// consumeEcho reports whether a rename of portalID to name is the echo of
+// one we sent, forgetting it so a later identical rename goes through.
+func (s *outboundRenameSet) consumeEcho(portalID, name string, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := outboundRenameKey(portalID, name)
+	t, ok := s.sent[key]
+	if !ok {
+		return false
+	}
+	delete(s.sent, key)
+	return now.Sub(t) < outboundRenameWindow
+}
+
+// HandleMatrixRoomName sends a group portal's new room name to iMessage as
+// a group rename.
+func (c *IMClient) HandleMatrixRoomName(ctx context.Context, msg *bridgev2.MatrixRoomName) (bool, error) {
+	portalID := string(msg.Portal.ID)
+	if !isGroupPortalID(portalID) {
+		return false, errors.New("only group chats can be renamed")
+	}
+	name := strings.TrimSpace(msg.Content.Name)
+	if meta, ok := msg.Portal.Metadata.(*PortalMetadata); ok && meta.PendingGroup {
+		// Not on iMessage yet: the first message carries the name.
+		meta.GroupName = name
+		msg.Portal.Name = name
+		msg.Portal.NameSet = true
+		return true, nil
+	}
+	conv := c.portalToConversation(msg.Portal)
+	if conv.IsSms {
+		return false, errors.New("SMS/MMS groups can't be renamed")
+	}
+	if c.client == nil {
+		return false, bridgev2.ErrNotLoggedIn
+	}
+
+	zerolog.Ctx(ctx).Info().
+		Str("portal_id", portalID).
+		Str("name", logText(name)).
+		Msg("Sending group rename to iMessage")
+	// Tracked before sending: the echo can beat SendRenameGroup's return.
+	c.outboundRenames.track(portalID, name, time.Now())
+	if _, err := c.client.SendRenameGroup(conv, name, c.portalHandle(msg.Portal)); err != nil {
+		c.outboundRenames.consumeEcho(portalID, name, time.Now())
+		return false, fmt.Errorf("failed to send group rename: %w", err)
+	}
+
+	// Outbound messages carry the group name, so switch it now rather
+	// than when the echo would have.
+	c.imGroupNamesMu.Lock()
+	c.imGroupNames[portalID] = name
+	c.imGroupNamesMu.Unlock()
+	if meta, ok := msg.Portal.Metadata.(*PortalMetadata); ok {
+		meta.GroupName = name
+	}
+	if c.cloudStore != nil {
+		if err := c.cloudStore.updateDisplayNameByPortalID(ctx, portalID, name); err != nil {
+			zerolog.Ctx(ctx).Warn().Err(err).Str("portal_id", portalID).Msg("Failed to update cloud_chat display_name after rename")
+		}
+	}
+	msg.Portal.Name = name
+	msg.Portal.NameSet = true
+	return true, nil
+}
@@ -0,0 +1,83 @@
+package connector
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/event"
+)
+
+func TestOutboundRenameEcho(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name     string
+		portalID string
+		newName  string
+		at       time.Time
+		want     bool
+	}{
+		{"echo of the sent rename", "gid:abc", "Hiking", now.Add(time.Second), true},
+		{"other name", "gid:abc", "Climbing", now.Add(time.Second), false},
+		{"other group", "gid:def", "Hiking", now.Add(time.Second), false},
+		{"echo after the window", "gid:abc", "Hiking", now.Add(outboundRenameWindow), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var s outboundRenameSet
+			s.track("gid:abc", "Hiking", now)
+			if got := s.consumeEcho(tt.portalID, tt.newName, tt.at); got != tt.want {
+				t.Errorf("consumeEcho() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// Only the first copy is an echo; renaming back to the same name later
+	// must still reach Matrix.
+	var s outboundRenameSet
+	s.track("gid:abc", "Hiking", now)
+	s.consumeEcho("gid:abc", "Hiking", now)
+	if s.consumeEcho("gid:abc", "Hiking", now) {
+		t.Errorf("consumeEcho() = true for a second rename, want false")
+	}
+}
+
+func TestHandleMatrixRoomNameRejected(t *testing.T) {
+	c := &IMClient{
+		Main:       &IMConnector{},
+		UserLogin:  &bridgev2.UserLogin{Log: zerolog.Nop()},
+		smsPortals: map[string]bool{"gid:sms": true},
+	}
+	tests := []struct {
+		name     string
+		portalID networkid.PortalID
+		wantErr  error
+	}{
+		{"DM", "tel:+15551234567", nil},
+		{"SMS group", "gid:sms", nil},
+		{"not logged in", "gid:abc", bridgev2.ErrNotLoggedIn},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			portal := &bridgev2.Portal{Portal: &database.Portal{
+				PortalKey: networkid.PortalKey{ID: tt.portalID},
+				Metadata:  &PortalMetadata{},
+			}}
+			msg := &bridgev2.MatrixRoomName{MatrixEventBase: bridgev2.MatrixEventBase[*event.RoomNameEventContent]{
+				Portal:  portal,
+				Content: &event.RoomNameEventContent{Name: "Hiking"},
+			}}
+			changed, err := c.HandleMatrixRoomName(context.Background(), msg)
+			if changed || err == nil || (tt.wantErr != nil && err != tt.wantErr) {
+				t.Errorf("HandleMatrixRoomName() = %v, %v, want false and an error", changed, err)
+			}
+			if portal.NameSet {
+				t.Errorf("HandleMatrixRoomName() set the portal name after failing")
+			}
+		})
+	}
+}
@@ -0,0 +1,166 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2024 Ludvig Rhodin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+package connector
+
+// rotate-hardware-key — replace the hardware key of an External Key login.
+//
+// The hardware key (a base64 JSON HardwareConfig extracted from a Mac) only
+// feeds NAC validation; the APS push state, IDS users and NGM identity are
+// separate and stay valid when the key changes. So instead of a full
+// re-login — new device, "X added a new Mac" on every contact's phone,
+// CloudKit resync — the key is swapped in the login metadata, the client is
+// rebuilt on the same device ID and state, and IDS is re-registered once so
+// Apple sees validation data from the new key right away.
+//
+// Flow:
+//   !im rotate-hardware-key <base64 key>
+//   → Command message is redacted (the key is a credential)
+//   → Key is validated and a config built from it before anything changes
+//   → Metadata + session.json updated, client rebuilt, IDS re-registered
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"maunium.net/go/mautrix/bridgev2/commands"
+
+	"github.com/lrhodin/imessage/pkg/rustpushgo"
+)
+
+// validateHardwareKey normalizes a pasted hardware key (dropping whitespace
+// and anything else a chat client may have wrapped it in) and checks that
+// it decodes to a JSON object. Returns the normalized key.
+func validateHardwareKey(raw string) (string, error) {
+	key := stripNonBase64(raw)
+	if key == "" {
+		return "", errors.New("hardware key is empty")
+	}
+	decoded, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return "", fmt.Errorf("hardware key is not valid base64: %w", err)
+	}
+	var obj map[string]json.RawMessage
+	if err = json.Unmarshal(decoded, &obj); err != nil {
+		return "", fmt.Errorf("hardware key doesn't contain a hardware config: %w", err)
+	}
+	if len(obj) == 0 {
+		return "", errors.New("hardware key contains an empty hardware config")
+	}
+	return key, nil
+}
+
+// swapHardwareKey records newKey in meta. Everything else — device ID, APS
+// state, IDS users and identity, iCloud credentials — is kept so the
+// rebuilt client is the same device to Apple.
+func swapHardwareKey(meta *UserLoginMetadata, newKey string) error {
+	switch {
+	case meta.HardwareKey == "":
+		return errors.New("this login doesn't use a hardware key (it runs on the local Mac)")
+	case meta.HardwareKey == newKey:
+		return errors.New("that is already the current hardware key")
+	}
+	meta.HardwareKey = newKey
+	return nil
+}
+
+var cmdRotateHardwareKey = &commands.FullHandler{
+	Name: "rotate-hardware-key",
+	Func: fnRotateHardwareKey,
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionAuth,
+		Description: "Replace the hardware key of an External Key login without logging in again.",
+		Args:        "<base64 hardware key>",
+	},
+	RequiresLogin: true,
+}
+
+func fnRotateHardwareKey(ce *commands.Event) {
+	if len(ce.Args) == 0 {
+		ce.Reply("**Usage:** `$cmdprefix rotate-hardware-key <base64 hardware key>`")
+		return
+	}
+	// The key is a credential; don't leave it in the room history.
+	ce.Redact()
+
+	login := ce.User.GetDefaultLogin()
+	if login == nil {
+		ce.Reply("Not logged in.")
+		return
+	}
+	client, ok := login.Client.(*IMClient)
+	if !ok || client == nil {
+		ce.Reply("Bridge client not available.")
+		return
+	}
+	meta, ok := login.Metadata.(*UserLoginMetadata)
+	if !ok {
+		ce.Reply("Login metadata not available.")
+		return
+	}
+
+	key, err := validateHardwareKey(ce.RawArgs)
+	if err != nil {
+		ce.Reply("Invalid hardware key: %v", err)
+		return
+	}
+	// Build a config from the new key before touching anything, so a key
+	// the Rust side rejects leaves the working login alone.
+	var cfg *rustpushgo.WrappedOsConfig
+	if meta.DeviceID != "" {
+		cfg, err = rustpushgo.CreateConfigFromHardwareKeyWithDeviceId(key, meta.DeviceID)
+	} else {
+		cfg, err = rustpushgo.CreateConfigFromHardwareKey(key)
+	}
+	if err != nil {
+		ce.Reply("Invalid hardware key: %v", err)
+		return
+	}
+	cfg.Destroy()
+
+	oldKey := meta.HardwareKey
+	if err = swapHardwareKey(meta, key); err != nil {
+		ce.Reply("Can't rotate the hardware key: %v", err)
+		return
+	}
+	ctx := context.Background()
+	if err = login.Save(ctx); err != nil {
+		meta.HardwareKey = oldKey
+		ce.Reply("Failed to save the new hardware key: %v", err)
+		return
+	}
+	ce.Log.Info().Str("device_id", meta.DeviceID).Msg("Hardware key replaced, rebuilding client")
+
+	// Same as bridgev2's client rebuild: LoadUserLogin disconnects the old
+	// client, builds the new config from the metadata and rewrites
+	// session.json with the new key.
+	if err = client.Main.LoadUserLogin(ctx, login); err != nil {
+		meta.HardwareKey = oldKey
+		_ = login.Save(ctx)
+		if reloadErr := client.Main.LoadUserLogin(ctx, login); reloadErr == nil {
+			login.Client.Connect(ctx)
+		}
+		ce.Reply("Failed to rebuild the client with the new key, reverted to the old one: %v", err)
+		return
+	}
+	login.Client.Connect(ctx)
+	newClient, ok := login.Client.(*IMClient)
+	if !ok || newClient.client == nil {
+		ce.Reply("Saved the new hardware key, but the client failed to connect with it. Check the bridge state and logs.")
+		return
+	}
+	count, err := newClient.client.ForceReregisterIdentity()
+	if err != nil {
+		ce.Reply("Saved the new hardware key and reconnected, but IDS re-registration failed: %v\n\nIt will be retried when the registration next refreshes.", err)
+		return
+	}
+	ce.Reply("Hardware key replaced. Reconnected on the same device and re-registered with IDS (services in registration: %d).", count)
+}
@@ -0,0 +1,87 @@
+package connector
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestValidateHardwareKey(t *testing.T) {
+	valid := base64.StdEncoding.EncodeToString([]byte(`{"inner":{"product_name":"Mac14,3"}}`))
+	tests := []struct {
+		name    string
+		raw     string
+		want    string
+		wantErr string
+	}{
+		{"valid key", valid, valid, ""},
+		{"wrapped in whitespace and backticks", "`" + valid[:10] + "\n  " + valid[10:] + "`", valid, ""},
+		{"empty", "  \n", "", "empty"},
+		{"not base64", "abc", "", "not valid base64"},
+		{"not JSON", base64.StdEncoding.EncodeToString([]byte("plist")), "", "doesn't contain"},
+		{"empty object", base64.StdEncoding.EncodeToString([]byte("{}")), "", "empty hardware config"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := validateHardwareKey(tt.raw)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("validateHardwareKey() error = %v, want containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("validateHardwareKey() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("validateHardwareKey() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSwapHardwareKey(t *testing.T) {
+	t.Run("keeps device and session state", func(t *testing.T) {
+		meta := &UserLoginMetadata{
+			HardwareKey: "old-key",
+			DeviceID:    "DEVICE-1",
+			APSState:    "aps",
+			IDSUsers:    "users",
+			IDSIdentity: "identity",
+		}
+		if err := swapHardwareKey(meta, "new-key"); err != nil {
+			t.Fatalf("swapHardwareKey() error = %v", err)
+		}
+		want := UserLoginMetadata{
+			HardwareKey: "new-key",
+			DeviceID:    "DEVICE-1",
+			APSState:    "aps",
+			IDSUsers:    "users",
+			IDSIdentity: "identity",
+		}
+		if meta.HardwareKey != want.HardwareKey || meta.DeviceID != want.DeviceID ||
+			meta.APSState != want.APSState || meta.IDSUsers != want.IDSUsers || meta.IDSIdentity != want.IDSIdentity {
+			t.Errorf("swapHardwareKey() metadata = %+v, want %+v", *meta, want)
+		}
+	})
+
+	tests := []struct {
+		name    string
+		current string
+		newKey  string
+	}{
+		{"local macOS login", "", "new-key"},
+		{"same key", "key", "key"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			meta := &UserLoginMetadata{HardwareKey: tt.current}
+			if err := swapHardwareKey(meta, tt.newKey); err == nil {
+				t.Errorf("swapHardwareKey(%q → %q) error = nil, want error", tt.current, tt.newKey)
+			}
+			if meta.HardwareKey != tt.current {
+				t.Errorf("swapHardwareKey() changed the key to %q on error", meta.HardwareKey)
+			}
+		})
+	}
+}
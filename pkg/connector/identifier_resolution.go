@@ -0,0 +1,157 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2024 Ludvig Rhodin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+package connector
+
+// resolve — preview how an identifier is routed to a DM portal.
+//
+// Incoming messages and start-chat go through the same steps: normalize the
+// handle (normalizeIdentifierForPortalID), redirect it to an existing portal
+// of the same contact (resolveContactPortalID), then to an existing portal
+// under a legacy key variant (resolveExistingDMPortalID). When a room ends
+// up split or merged unexpectedly it's hard to tell which step did it; the
+// command runs the steps read-only and reports each one.
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"maunium.net/go/mautrix/bridgev2/commands"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/id"
+)
+
+// identifierResolution is the report of how one identifier is routed.
+type identifierResolution struct {
+	Input      string
+	Normalized string // empty if the input isn't a phone number or email
+	IsMe       bool
+
+	ContactName    string   // empty if there's no named contact
+	ContactHandles []string // the contact's handles in portal-ID form
+
+	// ContactPortalID is the result of resolveContactPortalID; it differs
+	// from Normalized when another handle of the contact has a portal.
+	ContactPortalID string
+	// Candidates are the legacy key variants checked for ContactPortalID.
+	Candidates []string
+	// PortalID is the final portal ID, after resolveExistingDMPortalID.
+	PortalID string
+	// RoomID is the Matrix room of the portal, empty if it doesn't exist.
+	RoomID id.RoomID
+}
+
+// resolveIdentifierReport runs an identifier through DM portal routing
+// without creating anything.
+func (c *IMClient) resolveIdentifierReport(ctx context.Context, raw string) identifierResolution {
+	r := identifierResolution{Input: raw, Normalized: normalizeIdentifierForPortalID(raw)}
+	if r.Normalized == "" {
+		return r
+	}
+	if c.isMyHandle(r.Normalized) {
+		r.IsMe = true
+		return r
+	}
+	if contact := c.lookupContact(r.Normalized); contact != nil && contact.HasName() {
+		r.ContactName = contact.Name()
+		r.ContactHandles = contactPortalIDs(contact)
+	}
+	r.ContactPortalID = string(c.resolveContactPortalID(r.Normalized))
+	r.Candidates = legacyDMPortalCandidates(r.ContactPortalID)
+	r.PortalID = string(c.resolveExistingDMPortalID(r.ContactPortalID))
+
+	portal, err := c.Main.Bridge.GetExistingPortalByKey(ctx, networkid.PortalKey{
+		ID:       networkid.PortalID(r.PortalID),
+		Receiver: c.UserLogin.ID,
+	})
+	if err == nil && portal != nil {
+		r.RoomID = portal.MXID
+	}
+	return r
+}
+
+// formatIdentifierResolution renders the report for the resolve command.
+func formatIdentifierResolution(r identifierResolution) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "**resolve: `%s`**\n\n", r.Input)
+	if r.Normalized == "" {
+		sb.WriteString("Not a phone number or email address.")
+		return sb.String()
+	}
+	fmt.Fprintf(&sb, "Normalized: `%s`\n", r.Normalized)
+	if r.IsMe {
+		sb.WriteString("This is one of your own handles, so it doesn't route to a DM.")
+		return sb.String()
+	}
+
+	if r.ContactName == "" {
+		sb.WriteString("Contact: none\n")
+	} else {
+		handles := make([]string, len(r.ContactHandles))
+		for i, handle := range r.ContactHandles {
+			handles[i] = "`" + stripIdentifierPrefix(handle) + "`"
+		}
+		fmt.Fprintf(&sb, "Contact: %s (%s)\n", r.ContactName, strings.Join(handles, ", "))
+	}
+	fmt.Fprintf(&sb, "Portal ID: `%s`\n\n", r.PortalID)
+
+	switch {
+	case r.PortalID != r.ContactPortalID:
+		fmt.Fprintf(&sb, "✓ Matched an existing portal via legacy candidate `%s`", r.PortalID)
+	case r.ContactPortalID != r.Normalized:
+		fmt.Fprintf(&sb, "✓ Matched an existing portal via the contact's handle `%s`", stripIdentifierPrefix(r.ContactPortalID))
+	case r.RoomID != "":
+		sb.WriteString("✓ Matched an existing portal directly")
+	default:
+		sb.WriteString("✗ No existing portal; a new chat would be created under this ID")
+	}
+	if r.RoomID != "" {
+		fmt.Fprintf(&sb, " (room `%s`)", r.RoomID)
+	}
+	sb.WriteString("\n")
+
+	if len(r.Candidates) > 0 {
+		candidates := make([]string, len(r.Candidates))
+		for i, candidate := range r.Candidates {
+			candidates[i] = "`" + candidate + "`"
+		}
+		fmt.Fprintf(&sb, "Legacy candidates checked: %s\n", strings.Join(candidates, ", "))
+	}
+	return strings.TrimSuffix(sb.String(), "\n")
+}
+
+var cmdResolve = &commands.FullHandler{
+	Name: "resolve",
+	Func: fnResolve,
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionChats,
+		Description: "Show how a phone number or email is normalized and which portal it routes to, without opening a chat.",
+		Args:        "<phone|email>",
+	},
+	RequiresLogin: true,
+}
+
+func fnResolve(ce *commands.Event) {
+	identifier := strings.TrimSpace(ce.RawArgs)
+	if identifier == "" {
+		ce.Reply("Usage: `$cmdprefix resolve <phone|email>`")
+		return
+	}
+	login := ce.User.GetDefaultLogin()
+	if login == nil {
+		ce.Reply("Not logged in.")
+		return
+	}
+	client, ok := login.Client.(*IMClient)
+	if !ok || client == nil {
+		ce.Reply("Bridge client not available.")
+		return
+	}
+	ce.Reply(formatIdentifierResolution(client.resolveIdentifierReport(ce.Ctx, identifier)))
+}
@@ -0,0 +1,104 @@
+package connector
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLegacyDMPortalCandidates(t *testing.T) {
+	tests := []struct {
+		name       string
+		identifier string
+		want       []string
+	}{
+		{"NANP with plus", "tel:+14155551234", []string{"tel:14155551234", "tel:4155551234"}},
+		{"international with plus", "tel:+447700900123", []string{"tel:447700900123"}},
+		{"ten digits", "tel:4155551234", []string{"tel:14155551234"}},
+		{"eleven digits with 1", "tel:14155551234", []string{"tel:4155551234"}},
+		{"short code", "tel:12345", nil},
+		{"email", "mailto:user@example.com", nil},
+		{"group", "gid:abc", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := legacyDMPortalCandidates(tt.identifier)
+			if len(got) == 0 && len(tt.want) == 0 {
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("legacyDMPortalCandidates(%q) = %v, want %v", tt.identifier, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatIdentifierResolution(t *testing.T) {
+	tests := []struct {
+		name string
+		r    identifierResolution
+		want string
+	}{
+		{
+			name: "not an identifier",
+			r:    identifierResolution{Input: "hello"},
+			want: "**resolve: `hello`**\n\nNot a phone number or email address.",
+		},
+		{
+			name: "own handle",
+			r:    identifierResolution{Input: "me@icloud.com", Normalized: "mailto:me@icloud.com", IsMe: true},
+			want: "**resolve: `me@icloud.com`**\n\nNormalized: `mailto:me@icloud.com`\n" +
+				"This is one of your own handles, so it doesn't route to a DM.",
+		},
+		{
+			name: "new chat",
+			r: identifierResolution{
+				Input: "(415) 555-1234", Normalized: "tel:+14155551234",
+				ContactPortalID: "tel:+14155551234", PortalID: "tel:+14155551234",
+				Candidates: []string{"tel:14155551234", "tel:4155551234"},
+			},
+			want: "**resolve: `(415) 555-1234`**\n\nNormalized: `tel:+14155551234`\nContact: none\nPortal ID: `tel:+14155551234`\n\n" +
+				"✗ No existing portal; a new chat would be created under this ID\n" +
+				"Legacy candidates checked: `tel:14155551234`, `tel:4155551234`",
+		},
+		{
+			name: "direct match",
+			r: identifierResolution{
+				Input: "user@example.com", Normalized: "mailto:user@example.com",
+				ContactName: "Alice", ContactHandles: []string{"mailto:user@example.com"},
+				ContactPortalID: "mailto:user@example.com", PortalID: "mailto:user@example.com", RoomID: "!room:example.com",
+			},
+			want: "**resolve: `user@example.com`**\n\nNormalized: `mailto:user@example.com`\nContact: Alice (`user@example.com`)\nPortal ID: `mailto:user@example.com`\n\n" +
+				"✓ Matched an existing portal directly (room `!room:example.com`)",
+		},
+		{
+			name: "legacy match",
+			r: identifierResolution{
+				Input: "+14155551234", Normalized: "tel:+14155551234",
+				ContactPortalID: "tel:+14155551234", PortalID: "tel:14155551234", RoomID: "!old:example.com",
+				Candidates: []string{"tel:14155551234", "tel:4155551234"},
+			},
+			want: "**resolve: `+14155551234`**\n\nNormalized: `tel:+14155551234`\nContact: none\nPortal ID: `tel:14155551234`\n\n" +
+				"✓ Matched an existing portal via legacy candidate `tel:14155551234` (room `!old:example.com`)\n" +
+				"Legacy candidates checked: `tel:14155551234`, `tel:4155551234`",
+		},
+		{
+			name: "contact match",
+			r: identifierResolution{
+				Input: "bob@example.com", Normalized: "mailto:bob@example.com",
+				ContactName: "Bob", ContactHandles: []string{"tel:+14155550000", "mailto:bob@example.com"},
+				ContactPortalID: "tel:+14155550000", PortalID: "tel:+14155550000", RoomID: "!bob:example.com",
+				Candidates: []string{"tel:14155550000", "tel:4155550000"},
+			},
+			want: "**resolve: `bob@example.com`**\n\nNormalized: `mailto:bob@example.com`\nContact: Bob (`+14155550000`, `bob@example.com`)\nPortal ID: `tel:+14155550000`\n\n" +
+				"✓ Matched an existing portal via the contact's handle `+14155550000` (room `!bob:example.com`)\n" +
+				"Legacy candidates checked: `tel:14155550000`, `tel:4155550000`",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := formatIdentifierResolution(tt.r); got != tt.want {
+				t.Errorf("formatIdentifierResolution() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
@@ -13,6 +13,7 @@ import (
 	"encoding/json"
 	"os"
 	"path/filepath"
+	"runtime"
 
 	"github.com/rs/zerolog"
 
@@ -53,6 +54,52 @@ type PersistedSessionState struct {
 	MmeDelegateJSON string `json:"mme_delegate_json,omitempty"`
 }
 
+// sessionStateFromMetadata returns the part of a login's metadata that is
+// backed up to session.json.
+func sessionStateFromMetadata(meta *UserLoginMetadata) PersistedSessionState {
+	return PersistedSessionState{
+		IDSIdentity:              meta.IDSIdentity,
+		APSState:                 meta.APSState,
+		IDSUsers:                 meta.IDSUsers,
+		PreferredHandle:          meta.PreferredHandle,
+		Platform:                 meta.Platform,
+		HardwareKey:              meta.HardwareKey,
+		DeviceID:                 meta.DeviceID,
+		AccountUsername:          meta.AccountUsername,
+		AccountHashedPasswordHex: meta.AccountHashedPasswordHex,
+		AccountPET:               meta.AccountPET,
+		AccountADSID:             meta.AccountADSID,
+		AccountDSID:              meta.AccountDSID,
+		AccountSPDBase64:         meta.AccountSPDBase64,
+		MmeDelegateJSON:          meta.MmeDelegateJSON,
+	}
+}
+
+// loginMetadata rebuilds login metadata from backed-up session state, as
+// used when restoring a login without re-authenticating.
+func (state PersistedSessionState) loginMetadata() *UserLoginMetadata {
+	platform := state.Platform
+	if platform == "" {
+		platform = runtime.GOOS
+	}
+	return &UserLoginMetadata{
+		Platform:                 platform,
+		HardwareKey:              state.HardwareKey,
+		DeviceID:                 state.DeviceID,
+		PreferredHandle:          state.PreferredHandle,
+		APSState:                 state.APSState,
+		IDSUsers:                 state.IDSUsers,
+		IDSIdentity:              state.IDSIdentity,
+		AccountUsername:          state.AccountUsername,
+		AccountHashedPasswordHex: state.AccountHashedPasswordHex,
+		AccountPET:               state.AccountPET,
+		AccountADSID:             state.AccountADSID,
+		AccountDSID:              state.AccountDSID,
+		AccountSPDBase64:         state.AccountSPDBase64,
+		MmeDelegateJSON:          state.MmeDelegateJSON,
+	}
+}
+
 // sessionFilePath returns the path to the persisted session state file:
 // ~/.local/share/mautrix-imessage/session.json
 func sessionFilePath() (string, error) {
@@ -0,0 +1,168 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2024 Ludvig Rhodin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+package connector
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"sync/atomic"
+
+	"github.com/rs/zerolog"
+)
+
+// Log redaction for log_pii: false.
+//
+// Identifiers end up in log lines everywhere — portal IDs are "tel:+1…" /
+// "mailto:…", chat GUIDs embed the handle, bridgev2 logs sender IDs — so
+// phone numbers (E.164 and formatted national/international forms) and
+// email addresses are scrubbed centrally from every
+// formatted line by PIIRedactingWriter, which the bridge binary installs
+// under all configured log writers. Message-derived text (link preview
+// titles, matched URLs) and contact and group names have no recognizable
+// shape, so the log sites that include them wrap the value in logText
+// instead.
+
+var (
+	// piiPhonePattern matches E.164 numbers ("+15551234567", including inside
+	// chat GUIDs like "iMessage;-;+1555…") and bare tel: URIs (short codes).
+	piiPhonePattern = regexp.MustCompile(`\+\d{6,15}\b|\btel:\d{3,15}\b`)
+	// piiFormattedPhonePattern matches phone numbers written with separators,
+	// the way contact cards and chat.db handles often carry them:
+	// international "+1 (555) 123-4567" / "+44 20 7946 0958" and national
+	// "(555) 123-4567" / "555-123-4567" / "020 7946 0958".
+	piiFormattedPhonePattern = regexp.MustCompile(`\+\d{1,3}(?:[ .\-]?\(\d{1,5}\)|[ .\-]\d{1,5}){2,5}\b|(?:\(\d{2,5}\)[ .\-]?|\b\d{2,5}[ .\-])\d{3,4}[ .\-]\d{4}\b`)
+	// piiEmailPattern matches email addresses, with or without mailto:.
+	piiEmailPattern = regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9\-]+(?:\.[A-Za-z0-9\-]+)*\.[A-Za-z]{2,}`)
+)
+
+// redactPhone masks all but the last two digits of a phone number, keeping
+// the "+" / "tel:" prefix so the kind of identifier stays recognizable:
+// "+15551234567" → "+*********67".
+func redactPhone(phone string) string {
+	prefix := ""
+	if strings.HasPrefix(phone, "tel:") {
+		prefix, phone = "tel:", phone[len("tel:"):]
+	}
+	if strings.HasPrefix(phone, "+") {
+		prefix, phone = prefix+"+", phone[1:]
+	}
+	if len(phone) <= 2 {
+		return prefix + phone
+	}
+	return prefix + strings.Repeat("*", len(phone)-2) + phone[len(phone)-2:]
+}
+
+// redactFormattedPhones masks the numbers piiFormattedPhonePattern finds in
+// s, keeping the separators and the last two digits: "(555) 123-4567" →
+// "(***) ***-**67". A match with fewer than 7 digits, or one that is part of
+// a longer dash-separated token such as a message UUID
+// ("5A0B2C1D-1234-5678-9012-…"), is left alone.
+func redactFormattedPhones(s string) string {
+	matches := piiFormattedPhonePattern.FindAllStringIndex(s, -1)
+	if matches == nil {
+		return s
+	}
+	var b strings.Builder
+	last := 0
+	for _, m := range matches {
+		start, end := m[0], m[1]
+		if (start > 0 && s[start-1] == '-') || (end < len(s) && (s[end] == '-' || isASCIIAlnum(s[end]))) {
+			continue
+		}
+		digits := 0
+		for i := start; i < end; i++ {
+			if s[i] >= '0' && s[i] <= '9' {
+				digits++
+			}
+		}
+		if digits < 7 {
+			continue
+		}
+		b.WriteString(s[last:start])
+		for i := start; i < end; i++ {
+			if s[i] >= '0' && s[i] <= '9' && digits > 2 {
+				b.WriteByte('*')
+				digits--
+			} else {
+				b.WriteByte(s[i])
+			}
+		}
+		last = end
+	}
+	b.WriteString(s[last:])
+	return b.String()
+}
+
+func isASCIIAlnum(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// redactEmail keeps the first character of the local part and the
+// top-level domain: "alice@example.com" → "a***@***.com".
+func redactEmail(email string) string {
+	at := strings.LastIndexByte(email, '@')
+	if at <= 0 {
+		return "***"
+	}
+	tld := email[strings.LastIndexByte(email, '.'):]
+	return email[:1] + "***@***" + tld
+}
+
+// RedactPII masks every phone number and email address in s.
+func RedactPII(s string) string {
+	s = piiEmailPattern.ReplaceAllStringFunc(s, redactEmail)
+	s = piiPhonePattern.ReplaceAllStringFunc(s, redactPhone)
+	return redactFormattedPhones(s)
+}
+
+// PIIRedactingWriter wraps a log writer and applies RedactPII to every line
+// written through it. It works on both JSON and pretty-formatted output.
+type PIIRedactingWriter struct {
+	Out io.Writer
+}
+
+var _ zerolog.LevelWriter = (*PIIRedactingWriter)(nil)
+
+// NewPIIRedactingWriter wraps out in a PIIRedactingWriter.
+func NewPIIRedactingWriter(out io.Writer) *PIIRedactingWriter {
+	return &PIIRedactingWriter{Out: out}
+}
+
+func (w *PIIRedactingWriter) Write(p []byte) (int, error) {
+	if _, err := w.Out.Write([]byte(RedactPII(string(p)))); err != nil {
+		return 0, err
+	}
+	// Report the original length: zerolog treats a short write as an error.
+	return len(p), nil
+}
+
+func (w *PIIRedactingWriter) WriteLevel(level zerolog.Level, p []byte) (int, error) {
+	lw, ok := w.Out.(zerolog.LevelWriter)
+	if !ok {
+		return w.Write(p)
+	}
+	if _, err := lw.WriteLevel(level, []byte(RedactPII(string(p)))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// omitLogText is set from log_pii at connector Init.
+var omitLogText atomic.Bool
+
+// logText returns message-derived text or a contact or group name for a log
+// field, or a length-only placeholder when log_pii is disabled.
+func logText(text string) string {
+	if !omitLogText.Load() || text == "" {
+		return text
+	}
+	return fmt.Sprintf("[omitted, %d chars]", len(text))
+}
@@ -0,0 +1,86 @@
+package connector
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+func TestRedactPII(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"phone", "+15551234567", "+*********67"},
+		{"tel uri", "tel:+15551234567", "tel:+*********67"},
+		{"short code", "tel:262966", "tel:****66"},
+		{"email", "alice@example.com", "a***@***.com"},
+		{"mailto uri", "mailto:Bob.Smith+tag@mail.example.co.uk", "mailto:B***@***.uk"},
+		{"chat guid", "iMessage;-;+447700900123", "iMessage;-;+**********23"},
+		{"json field", `{"sender":"tel:+15551234567","portal_id":"mailto:a@b.io"}`, `{"sender":"tel:+*********67","portal_id":"mailto:a***@***.io"}`},
+		{"national parens", "(555) 123-4567", "(***) ***-**67"},
+		{"national dashes", "call 555-123-4567 now", "call ***-***-**67 now"},
+		{"national dots", "555.123.4567", "***.***.**67"},
+		{"uk national", "020 7946 0958", "*** **** **58"},
+		{"international spaced", "+44 20 7946 0958", "+** ** **** **58"},
+		{"international parens", "+1 (555) 123-4567", "+* (***) ***-**67"},
+		{"json formatted", `{"name":"(555) 123-4567"}`, `{"name":"(***) ***-**67"}`},
+		{"message uuid", "5A0B2C1D-1234-5678-9012-ABCDEF012345", "5A0B2C1D-1234-5678-9012-ABCDEF012345"},
+		{"date", "2026-10-16 12:00:00", "2026-10-16 12:00:00"},
+		{"ip address", "192.168.1.10:8080", "192.168.1.10:8080"},
+		{"no pii", "portal_id=gid:5A0B2C1D uuid=1234-5678", "portal_id=gid:5A0B2C1D uuid=1234-5678"},
+		{"timestamp offset", "2026-10-16T12:00:00+02:00", "2026-10-16T12:00:00+02:00"},
+		{"module path", "mautrix@v0.28.0/bridgev2", "mautrix@v0.28.0/bridgev2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := RedactPII(tt.in); got != tt.want {
+				t.Errorf("RedactPII(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPIIRedactingWriter(t *testing.T) {
+	var buf bytes.Buffer
+	log := zerolog.New(NewPIIRedactingWriter(&buf))
+	log.Info().
+		Str("sender", "tel:+15551234567").
+		Str("handle", "mailto:alice@example.com").
+		Str("portal_id", "gid:abc").
+		Msg("Message from +15551234567")
+	out := buf.String()
+	for _, leaked := range []string{"5551234567", "alice@example.com"} {
+		if strings.Contains(out, leaked) {
+			t.Errorf("log line %q leaks %q", out, leaked)
+		}
+	}
+	if !strings.Contains(out, `"portal_id":"gid:abc"`) {
+		t.Errorf("log line %q lost non-PII field", out)
+	}
+}
+
+func TestLogText(t *testing.T) {
+	defer omitLogText.Store(false)
+	tests := []struct {
+		name string
+		omit bool
+		in   string
+		want string
+	}{
+		{"verbose", false, "Dinner at 8?", "Dinner at 8?"},
+		{"omitted", true, "Dinner at 8?", "[omitted, 12 chars]"},
+		{"empty", true, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			omitLogText.Store(tt.omit)
+			if got := logText(tt.in); got != tt.want {
+				t.Errorf("logText(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
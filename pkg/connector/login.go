@@ -9,6 +9,7 @@
 package connector
 
 import (
+	"cmp"
 	"context"
 	"fmt"
 	"strconv"
@@ -46,6 +47,7 @@ const (
 	LoginStepFaceTime         = "fi.mau.imessage.login.facetime"
 	LoginStepStatusKit        = "fi.mau.imessage.login.statuskit"
 	LoginStepStatusKitStyle   = "fi.mau.imessage.login.statuskit_style"
+	LoginStepNACRelayFallback = "fi.mau.imessage.login.nac_relay_fallback"
 )
 
 // AppleIDLogin implements the multi-step login flow:
@@ -72,6 +74,7 @@ type AppleIDLogin struct {
 	cardDAVURL                 string
 	cardDAVUsername            string
 	cardDAVPasswordEncrypted   string
+	hardwareKey                string // relay Mac's key, set by the NAC relay fallback (nac_fallback.go)
 }
 
 var _ bridgev2.LoginProcessUserInput = (*AppleIDLogin)(nil)
@@ -96,11 +99,16 @@ func (l *AppleIDLogin) Start(ctx context.Context) (*bridgev2.LoginStep, error) {
 	apsState := getExistingAPSState(session, log)
 	l.conn = rustpushgo.Connect(cfg, apsState)
 
+	return l.passwordStep("Enter your Apple ID credentials. " +
+		"Registration uses local NAC (no relay needed)."), nil
+}
+
+// passwordStep asks for the Apple ID and password.
+func (l *AppleIDLogin) passwordStep(instructions string) *bridgev2.LoginStep {
 	return &bridgev2.LoginStep{
-		Type:   bridgev2.LoginStepTypeUserInput,
-		StepID: LoginStepAppleIDPassword,
-		Instructions: "Enter your Apple ID credentials. " +
-			"Registration uses local NAC (no relay needed).",
+		Type:         bridgev2.LoginStepTypeUserInput,
+		StepID:       LoginStepAppleIDPassword,
+		Instructions: instructions,
 		UserInputParams: &bridgev2.LoginUserInputParams{
 			Fields: []bridgev2.LoginInputDataField{{
 				Type: bridgev2.LoginInputFieldTypeEmail,
@@ -112,7 +120,7 @@ func (l *AppleIDLogin) Start(ctx context.Context) (*bridgev2.LoginStep, error) {
 				Name: "Password",
 			}},
 		},
-	}, nil
+	}
 }
 
 func (l *AppleIDLogin) SubmitUserInput(ctx context.Context, input map[string]string) (*bridgev2.LoginStep, error) {
@@ -238,6 +246,11 @@ func (l *AppleIDLogin) SubmitUserInput(ctx context.Context, input map[string]str
 		return l.askVideoTranscodingStep()
 	}
 
+	// NAC relay fallback after a failed registration (see nac_fallback.go)
+	if key, ok := input["nac_fallback_hardware_key"]; ok && l.session != nil {
+		return l.retryRegistrationWithRelay(key)
+	}
+
 	// Step 1: Apple ID + password
 	if l.session == nil {
 		username := input["username"]
@@ -326,6 +339,11 @@ func (l *AppleIDLogin) finishLogin(ctx context.Context) (*bridgev2.LoginStep, er
 	result, err := l.session.Finish(l.cfg, l.conn, existingIdentityArg, existingUsersArg)
 	if err != nil {
 		l.Main.Bridge.Log.Error().Err(err).Msg("IDS registration failed during finishLogin")
+		err = classifyRegistrationError(err)
+		if step := nacRelayFallbackStep(err, l.Main.Config.NACRelayFallbackURL, l.hardwareKey); step != nil {
+			log.Info().Msg("Registration failed on NAC, offering the fallback relay")
+			return step, nil
+		}
 		return nil, fmt.Errorf("login completion failed: %w", err)
 	}
 	l.result = &result
@@ -349,6 +367,34 @@ func (l *AppleIDLogin) finishLogin(ctx context.Context) (*bridgev2.LoginStep, er
 	return l.askCloudKitBackfillStep()
 }
 
+// retryRegistrationWithRelay starts the sign-in over with the hardware key
+// of the Mac running the fallback NAC relay, after local NAC failed. The
+// key's config brings that Mac's device identity, so the local session
+// isn't finished under it; instead the user signs in again and the login
+// continues like an External Key login.
+func (l *AppleIDLogin) retryRegistrationWithRelay(hardwareKey string) (*bridgev2.LoginStep, error) {
+	key, err := relayFallbackKey(hardwareKey, l.Main.Config.NACRelayFallbackURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid hardware key: %w", err)
+	}
+	cfg, err := rustpushgo.CreateConfigFromHardwareKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid hardware key: %w", err)
+	}
+	log := l.Main.Bridge.Log.With().Str("component", "imessage").Logger()
+	log.Info().Msg("Restarting sign-in with the fallback NAC relay's hardware key")
+	session := loadCachedSession(l.User, log)
+	if !session.validate(log) {
+		session = nil
+	}
+	l.conn.Close()
+	l.conn = rustpushgo.Connect(cfg, getExistingAPSState(session, log))
+	l.cfg = cfg
+	l.hardwareKey = key
+	l.session = nil
+	return l.passwordStep("Sign in again to register as the Mac running the NAC relay."), nil
+}
+
 func (l *AppleIDLogin) handleDeviceSelection(device string) (*bridgev2.LoginStep, error) {
 	l.selectedDevice = parseDeviceSelection(device, l.devices)
 	return devicePasscodeStepForDevice(l.devices, l.selectedDevice), nil
@@ -399,6 +445,13 @@ func (l *AppleIDLogin) completeLogin(ctx context.Context) (*bridgev2.LoginStep,
 		CardDAVPasswordEncrypted:   l.cardDAVPasswordEncrypted,
 	}
 
+	if l.hardwareKey != "" {
+		// Registered through the fallback relay: from now on this login
+		// needs the relay Mac's key, like an External Key login.
+		meta.Platform = "rustpush-external-key"
+		meta.HardwareKey = l.hardwareKey
+	}
+
 	return completeLoginWithMeta(ctx, l.User, l.Main, l.username, l.cfg, l.conn, l.result, meta)
 }
 
@@ -520,6 +573,8 @@ type ExternalKeyLogin struct {
 	cardDAVURL                 string
 	cardDAVUsername            string
 	cardDAVPasswordEncrypted   string
+	registrationErr            error  // NAC failure the fallback relay was offered for (nac_fallback.go)
+	fallbackRelayKey           string // hardwareKey pointed at the fallback relay, for this registration only
 }
 
 var _ bridgev2.LoginProcessUserInput = (*ExternalKeyLogin)(nil)
@@ -715,6 +770,14 @@ func (l *ExternalKeyLogin) SubmitUserInput(ctx context.Context, input map[string
 		}, nil
 	}
 
+	// NAC relay fallback after a failed registration (see nac_fallback.go)
+	if choice, ok := input["nac_relay_fallback"]; ok && l.session != nil {
+		if choice != "yes" {
+			return nil, fmt.Errorf("login completion failed: %w", l.registrationErr)
+		}
+		return l.retryRegistrationWithRelay(ctx)
+	}
+
 	// Step 2: Apple ID + password
 	if l.session == nil {
 		username := input["username"]
@@ -799,6 +862,12 @@ func (l *ExternalKeyLogin) finishLogin(ctx context.Context) (*bridgev2.LoginStep
 	result, err := l.session.Finish(l.cfg, l.conn, existingIdentityArg, existingUsersArg)
 	if err != nil {
 		l.Main.Bridge.Log.Error().Err(err).Msg("IDS registration failed during finishLogin")
+		err = classifyRegistrationError(err)
+		if step := nacRelayFallbackStep(err, l.Main.Config.NACRelayFallbackURL, cmp.Or(l.fallbackRelayKey, l.hardwareKey)); step != nil {
+			log.Info().Msg("Registration failed on NAC, offering the fallback relay")
+			l.registrationErr = err
+			return step, nil
+		}
 		return nil, fmt.Errorf("login completion failed: %w", err)
 	}
 	l.result = &result
@@ -844,6 +913,25 @@ func (l *ExternalKeyLogin) handlePasscodeAndContinue(ctx context.Context, passco
 	return l.askVideoTranscodingStep()
 }
 
+// retryRegistrationWithRelay retries IDS registration with the hardware key
+// pointed at the fallback NAC relay. Only this registration uses the
+// fallback: the login stores the key as it was entered, so later
+// re-registrations go to the key's own relay again.
+func (l *ExternalKeyLogin) retryRegistrationWithRelay(ctx context.Context) (*bridgev2.LoginStep, error) {
+	key, err := relayFallbackKey(l.hardwareKey, l.Main.Config.NACRelayFallbackURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to point hardware key at the fallback relay: %w", err)
+	}
+	cfg, err := rustpushgo.CreateConfigFromHardwareKeyWithDeviceId(key, l.cfg.GetDeviceId())
+	if err != nil {
+		return nil, fmt.Errorf("failed to point hardware key at the fallback relay: %w", err)
+	}
+	l.Main.Bridge.Log.Info().Msg("Retrying registration through the fallback NAC relay")
+	l.cfg = cfg
+	l.fallbackRelayKey = key
+	return l.finishLogin(ctx)
+}
+
 func (l *ExternalKeyLogin) completeLogin(ctx context.Context) (*bridgev2.LoginStep, error) {
 	var cloudKitPref *bool
 	if l.Main.Config.UseCloudKitBackfill() {
@@ -1474,24 +1562,13 @@ func completeLoginWithMeta(
 	} else {
 		log.Warn().Msg("No account persist data from login — cloud services will not be available")
 	}
+	if meta.AccountRegion == "" {
+		meta.AccountRegion = detectAccountRegion(append([]string{meta.PreferredHandle}, result.Users.GetHandles()...))
+	}
+	log.Info().Str("account_region", meta.AccountRegion).Msg("Apple ID region")
 
 	// Persist full session state to backup file so it survives DB resets.
-	saveSessionState(log, PersistedSessionState{
-		IDSIdentity:              meta.IDSIdentity,
-		APSState:                 meta.APSState,
-		IDSUsers:                 meta.IDSUsers,
-		PreferredHandle:          meta.PreferredHandle,
-		Platform:                 meta.Platform,
-		HardwareKey:              meta.HardwareKey,
-		DeviceID:                 meta.DeviceID,
-		AccountUsername:          meta.AccountUsername,
-		AccountHashedPasswordHex: meta.AccountHashedPasswordHex,
-		AccountPET:               meta.AccountPET,
-		AccountADSID:             meta.AccountADSID,
-		AccountDSID:              meta.AccountDSID,
-		AccountSPDBase64:         meta.AccountSPDBase64,
-		MmeDelegateJSON:          meta.MmeDelegateJSON,
-	})
+	saveSessionState(log, sessionStateFromMetadata(meta))
 
 	loginID := networkid.UserLoginID(result.Users.LoginId(0))
 
@@ -0,0 +1,157 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2024 Ludvig Rhodin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+package connector
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+
+	"github.com/lrhodin/imessage/pkg/rustpushgo"
+)
+
+// Long outbound messages (long_message_limit, long_message_mode).
+//
+// iMessage has no documented text limit, but very long messages are
+// rejected by Apple or cut short on the recipient's device without any
+// error reaching the bridge. Messages over the configured limit are either
+// split into several iMessages, sent one after another so they arrive in
+// order, or sent as a single plain-text file.
+
+const (
+	longMessageModeSplit      = "split"
+	longMessageModeAttachment = "attachment"
+
+	longMessageFileName = "message.txt"
+	longMessageMimeType = "text/plain"
+)
+
+// longMessagePart is one iMessage to send for a long Matrix message: either
+// a chunk of its text or, in attachment mode, the whole text as a file.
+type longMessagePart struct {
+	text string
+	file []byte
+}
+
+// longMessageMode returns the configured long_message_mode, defaulting to
+// "split" for empty or unknown values.
+func (c *IMConfig) longMessageMode() string {
+	if c.LongMessageMode == longMessageModeAttachment {
+		return longMessageModeAttachment
+	}
+	return longMessageModeSplit
+}
+
+// planLongMessage returns the iMessages to send for text, or nil if it's
+// within limit and should be sent as a normal message.
+func planLongMessage(text string, limit int, mode string) []longMessagePart {
+	if limit <= 0 || utf8.RuneCountInString(text) <= limit {
+		return nil
+	}
+	if mode == longMessageModeAttachment {
+		return []longMessagePart{{file: []byte(text)}}
+	}
+	chunks := splitLongMessage(text, limit)
+	parts := make([]longMessagePart, len(chunks))
+	for i, chunk := range chunks {
+		parts[i] = longMessagePart{text: chunk}
+	}
+	return parts
+}
+
+// splitLongMessage splits text into chunks of at most limit characters. Each
+// chunk ends at the last paragraph break, line break or space in its window,
+// in that order of preference, as long as that's past the window's halfway
+// point; otherwise the text is cut mid-word at the limit. The separator a
+// chunk ends on is dropped, everything else is kept as is.
+func splitLongMessage(text string, limit int) []string {
+	runes := []rune(text)
+	var chunks []string
+	for len(runes) > limit {
+		cut, skip := limit, 0
+		window := string(runes[:limit])
+		for _, sep := range []string{"\n\n", "\n", " "} {
+			idx := strings.LastIndex(window, sep)
+			if idx < 0 {
+				continue
+			}
+			if at := utf8.RuneCountInString(window[:idx]); at > limit/2 {
+				cut, skip = at, utf8.RuneCountInString(sep)
+				break
+			}
+		}
+		chunks = append(chunks, string(runes[:cut]))
+		runes = runes[cut+skip:]
+	}
+	if len(runes) > 0 {
+		chunks = append(chunks, string(runes))
+	}
+	return chunks
+}
+
+// sendLongMessage sends the parts of a long Matrix message in order. The
+// first part carries the reply and goes through the SMS fallback; the rest
+// follow on whichever conversation that settled on. If a later part fails,
+// the parts already delivered are kept and the rest are dropped with a
+// warning, since the Matrix message can no longer be failed as a whole.
+// Only the first part gets a bridge DB row; the others are stored in its
+// SplitUUIDs, and every part is remembered for echo detection.
+func (c *IMClient) sendLongMessage(ctx context.Context, msg *bridgev2.MatrixMessage, conv rustpushgo.WrappedConversation, parts []longMessagePart) (*bridgev2.MatrixMessageResponse, error) {
+	log := zerolog.Ctx(ctx)
+	replyGuid, replyPart := extractReplyInfo(msg.ReplyTo)
+	handle := c.portalHandle(msg.Portal)
+	send := func(conv rustpushgo.WrappedConversation, part longMessagePart, replyGuid, replyPart *string) (string, error) {
+		if part.file != nil {
+			return c.client.SendAttachment(conv, part.file, longMessageMimeType, mimeToUTI(longMessageMimeType), longMessageFileName, handle, replyGuid, replyPart, nil)
+		}
+		return c.client.SendMessage(conv, part.text, nil, handle, replyGuid, replyPart, nil)
+	}
+
+	var uuids []string
+	for i, part := range parts {
+		var uuid string
+		var err error
+		if i == 0 {
+			uuid, err = c.sendWithSMSFallback(ctx, msg.Portal, &conv, func(conv rustpushgo.WrappedConversation) (string, error) {
+				return send(conv, part, replyGuid, replyPart)
+			})
+			if err != nil {
+				return nil, fmt.Errorf("failed to send iMessage: %w", err)
+			}
+		} else if uuid, err = send(conv, part, nil, nil); err != nil {
+			log.Warn().Err(err).Int("part", i).Int("parts", len(parts)).Msg("Failed to send part of long message; earlier parts were delivered")
+			break
+		}
+		uuids = append(uuids, uuid)
+		c.rememberSentMessagePart(ctx, msg.Portal, uuid)
+	}
+	log.Info().
+		Strs("uuids", uuids).
+		Int("parts", len(parts)).
+		Str("portal_id", string(msg.Portal.ID)).
+		Msg("Long message sent")
+
+	return &bridgev2.MatrixMessageResponse{
+		DB: &database.Message{
+			ID:        makeMessageID(uuids[0]),
+			SenderID:  makeUserID(c.portalHandle(msg.Portal)),
+			Timestamp: time.Now(),
+			Metadata: &MessageMetadata{
+				HasAttachments: parts[0].file != nil,
+				SplitUUIDs:     uuids[1:],
+			},
+		},
+	}, nil
+}
@@ -0,0 +1,101 @@
+package connector
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSplitLongMessage(t *testing.T) {
+	tests := []struct {
+		name  string
+		text  string
+		limit int
+		want  []string
+	}{
+		{"exactly at limit", "abcdefghij", 10, []string{"abcdefghij"}},
+		{"hard cut without spaces", "abcdefghijklmnopqrstuvwxy", 10, []string{"abcdefghij", "klmnopqrst", "uvwxy"}},
+		{"word boundary", "hello there world", 12, []string{"hello there", "world"}},
+		{"line over word", "first line\nsecond one", 16, []string{"first line", "second one"}},
+		{"paragraph over line", "para one\nline\n\nnext paragraph", 20, []string{"para one\nline", "next paragraph"}},
+		// A break in the first half of the window would leave a tiny chunk.
+		{"early break ignored", "hi abcdefghijklmnop", 10, []string{"hi abcdefg", "hijklmnop"}},
+		{"multibyte runes", "ééééé ééééé", 6, []string{"ééééé", "ééééé"}},
+		{"emoji never halved", strings.Repeat("😀", 5), 2, []string{"😀😀", "😀😀", "😀"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := splitLongMessage(tt.text, tt.limit)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("splitLongMessage(%q, %d) = %q, want %q", tt.text, tt.limit, got, tt.want)
+			}
+			for _, chunk := range got {
+				if n := utf8.RuneCountInString(chunk); n > tt.limit || !utf8.ValidString(chunk) {
+					t.Errorf("splitLongMessage() chunk %q has %d runes (valid %v), limit %d", chunk, n, utf8.ValidString(chunk), tt.limit)
+				}
+			}
+		})
+	}
+}
+
+func TestSplitLongMessageKeepsOrder(t *testing.T) {
+	var words []string
+	for i := 0; i < 500; i++ {
+		words = append(words, strings.Repeat(string(rune('a'+i%26)), 1+i%9))
+	}
+	text := strings.Join(words, " ")
+	chunks := splitLongMessage(text, 100)
+	if len(chunks) < 2 {
+		t.Fatalf("splitLongMessage() = %d chunks, want several", len(chunks))
+	}
+	// Every split here is at a space, so rejoining restores the original.
+	if got := strings.Join(chunks, " "); got != text {
+		t.Errorf("rejoined chunks differ from original text")
+	}
+}
+
+func TestPlanLongMessage(t *testing.T) {
+	long := strings.Repeat("word ", 5) // 25 characters
+	tests := []struct {
+		name  string
+		text  string
+		limit int
+		mode  string
+		want  []longMessagePart
+	}{
+		{"under limit", "short", 10, longMessageModeSplit, nil},
+		{"limit disabled", long, 0, longMessageModeSplit, nil},
+		{"split", long, 10, longMessageModeSplit, []longMessagePart{{text: "word word"}, {text: "word word"}, {text: "word "}}},
+		{"attachment fallback", long, 10, longMessageModeAttachment, []longMessagePart{{file: []byte(long)}}},
+		{"attachment mode under limit", "short", 10, longMessageModeAttachment, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := planLongMessage(tt.text, tt.limit, tt.mode); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("planLongMessage() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLongMessageMode(t *testing.T) {
+	tests := []struct {
+		mode string
+		want string
+	}{
+		{"", longMessageModeSplit},
+		{"split", longMessageModeSplit},
+		{"attachment", longMessageModeAttachment},
+		{"file", longMessageModeSplit},
+	}
+	for _, tt := range tests {
+		cfg := &IMConfig{LongMessageMode: tt.mode}
+		if got := cfg.longMessageMode(); got != tt.want {
+			t.Errorf("longMessageMode(%q) = %q, want %q", tt.mode, got, tt.want)
+		}
+	}
+	if got := mimeToUTI(longMessageMimeType); got != "public.plain-text" {
+		t.Errorf("mimeToUTI(%q) = %q, want public.plain-text", longMessageMimeType, got)
+	}
+}
@@ -0,0 +1,296 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2024 Ludvig Rhodin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+package connector
+
+import (
+	"slices"
+	"strings"
+
+	"maunium.net/go/mautrix/event"
+)
+
+// Static mappings shared by the live (rustpush), CloudKit and chat.db paths.
+// Keep them here, in one place: the paths used to carry their own copies,
+// which drifted apart.
+
+// standardTapback is one of Apple's fixed tapback types.
+type standardTapback struct {
+	// Type is the rustpush tapback type. chat.db and CloudKit store it as
+	// 2000+Type (3000+Type for removals), so imessage.TapbackLove is type 0.
+	Type uint32
+	// Emoji is the Matrix reaction key it's bridged as.
+	Emoji string
+	// Aliases are other reaction keys, without VS16, sent as this type.
+	Aliases []string
+	// Verb and RemoveVerb are how Apple's SMS relay words the reaction.
+	Verb, RemoveVerb string
+}
+
+// standardTapbacks is the table of tapback types shared by the live,
+// CloudKit and chat.db paths, and by the SMS reaction text. A type Apple
+// adds goes here; until it does, it's bridged as unknownTapbackEmoji.
+var standardTapbacks = []standardTapback{
+	{Type: 0, Emoji: "❤️", Aliases: []string{"❤", "♥"}, Verb: "Loved", RemoveVerb: "Removed a heart from"},
+	{Type: 1, Emoji: "👍", Aliases: []string{"👍"}, Verb: "Liked", RemoveVerb: "Removed a like from"},
+	{Type: 2, Emoji: "👎", Aliases: []string{"👎"}, Verb: "Disliked", RemoveVerb: "Removed a dislike from"},
+	{Type: 3, Emoji: "😂", Aliases: []string{"😂"}, Verb: "Laughed at", RemoveVerb: "Removed a laugh from"},
+	{Type: 4, Emoji: "‼️", Aliases: []string{"‼", "❗"}, Verb: "Emphasized", RemoveVerb: "Removed an exclamation from"},
+	{Type: 5, Emoji: "❓", Aliases: []string{"❓"}, Verb: "Questioned", RemoveVerb: "Removed a question mark from"},
+}
+
+const (
+	// tapbackTypeEmoji is an emoji tapback; the emoji travels with it.
+	tapbackTypeEmoji uint32 = 6
+	// tapbackTypeSticker is a sticker placed on a message (convertStickerTapback).
+	tapbackTypeSticker uint32 = 7
+
+	// unknownTapbackEmoji is the reaction for a tapback type that isn't in
+	// standardTapbacks. It's the same marker imessage.TapbackType.Emoji uses.
+	unknownTapbackEmoji = "\ufffd"
+)
+
+// lookupStandardTapback returns the standardTapbacks entry for a type.
+func lookupStandardTapback(tapbackType uint32) (standardTapback, bool) {
+	for _, tb := range standardTapbacks {
+		if tb.Type == tapbackType {
+			return tb, true
+		}
+	}
+	return standardTapback{}, false
+}
+
+// isKnownTapbackType reports whether a rustpush tapback type can be bridged
+// faithfully. Callers log the others so new types get noticed.
+func isKnownTapbackType(tapbackType *uint32) bool {
+	if tapbackType == nil {
+		return false
+	}
+	if _, ok := lookupStandardTapback(*tapbackType); ok {
+		return true
+	}
+	return *tapbackType == tapbackTypeEmoji || *tapbackType == tapbackTypeSticker
+}
+
+// tapbackTypeToEmoji maps a rustpush tapback type (standardTapbacks, or 6
+// for an emoji tapback) to the Matrix reaction key. Anything else is
+// unknownTapbackEmoji rather than a guess.
+func tapbackTypeToEmoji(tapbackType *uint32, tapbackEmoji *string) string {
+	if tapbackType == nil {
+		return unknownTapbackEmoji
+	}
+	if *tapbackType == tapbackTypeEmoji {
+		// The emoji is passed through as-is: it can be several code points
+		// (skin tones, ZWJ sequences, flags), and removals only match when
+		// it's identical.
+		if tapbackEmoji != nil && *tapbackEmoji != "" {
+			return *tapbackEmoji
+		}
+		return "👍"
+	}
+	if tb, ok := lookupStandardTapback(*tapbackType); ok {
+		return tb.Emoji
+	}
+	return unknownTapbackEmoji
+}
+
+// emojiToTapbackType maps a Matrix reaction to a tapback type, with the
+// emoji itself for anything that isn't a standard tapback. Clients differ
+// in whether they append VS16 (U+FE0F) to these emoji, and chat.db
+// tapbacks (imessage.TapbackType.Emoji) carry it on all of them, so it's
+// ignored when matching.
+func emojiToTapbackType(emoji string) (uint32, *string) {
+	trimmed := strings.TrimSuffix(emoji, "\ufe0f")
+	for _, tb := range standardTapbacks {
+		if slices.Contains(tb.Aliases, trimmed) {
+			return tb.Type, nil
+		}
+	}
+	return tapbackTypeEmoji, &emoji
+}
+
+// sameTapback reports whether two reaction keys are the same tapback: the
+// same classic type, ignoring VS16, or the exact same emoji.
+func sameTapback(a, b string) bool {
+	typeA, emojiA := emojiToTapbackType(a)
+	typeB, emojiB := emojiToTapbackType(b)
+	if typeA != typeB {
+		return false
+	}
+	return emojiA == nil || *emojiA == *emojiB
+}
+
+// mimeToUTI converts a MIME type to the Apple UTI sent with attachments.
+func mimeToUTI(mime string) string {
+	switch {
+	case mime == "image/jpeg":
+		return "public.jpeg"
+	case mime == "image/png":
+		return "public.png"
+	case mime == "image/gif":
+		return "com.compuserve.gif"
+	case mime == "image/heic":
+		return "public.heic"
+	case mime == "video/mp4":
+		return "public.mpeg-4"
+	case mime == "video/quicktime":
+		return "com.apple.quicktime-movie"
+	case mime == "audio/mpeg", mime == "audio/mp3":
+		return "public.mp3"
+	case mime == "audio/aac", mime == "audio/mp4":
+		return "public.aac-audio"
+	case mime == "audio/x-caf":
+		return "com.apple.coreaudio-format"
+	case mime == "text/vcard", mime == "text/x-vcard", mime == "text/directory":
+		return "public.vcard"
+	case mime == "text/plain":
+		return "public.plain-text"
+	case strings.HasPrefix(mime, "image/"):
+		return "public.image"
+	case strings.HasPrefix(mime, "video/"):
+		return "public.movie"
+	case strings.HasPrefix(mime, "audio/"):
+		return "public.audio"
+	default:
+		return "public.data"
+	}
+}
+
+// utiToMIME converts an Apple UTI type to its MIME equivalent.
+// Used as a fallback when CloudKit attachment records have a UTI but no MIME type.
+func utiToMIME(uti string) string {
+	switch uti {
+	case "public.jpeg":
+		return "image/jpeg"
+	case "public.png":
+		return "image/png"
+	case "com.compuserve.gif":
+		return "image/gif"
+	case "public.tiff":
+		return "image/tiff"
+	case "public.heic":
+		return "image/heic"
+	case "public.heif":
+		return "image/heif"
+	case "public.webp":
+		return "image/webp"
+	case "public.mpeg-4":
+		return "video/mp4"
+	case "com.apple.quicktime-movie":
+		return "video/quicktime"
+	case "public.mp3":
+		return "audio/mpeg"
+	case "public.aac-audio":
+		return "audio/aac"
+	case "com.apple.coreaudio-format":
+		return "audio/x-caf"
+	case "public.vcard":
+		return "text/vcard"
+	default:
+		return ""
+	}
+}
+
+// extToMIME converts a file extension (with or without the dot, any case)
+// to its MIME type. Used when an attachment has no usable MIME type of its
+// own. Returns "" for unknown extensions.
+func extToMIME(ext string) string {
+	switch strings.ToLower(strings.TrimPrefix(ext, ".")) {
+	case "jpg", "jpeg":
+		return "image/jpeg"
+	case "png":
+		return "image/png"
+	case "gif":
+		return "image/gif"
+	case "heic":
+		return "image/heic"
+	case "heif":
+		return "image/heif"
+	case "webp":
+		return "image/webp"
+	case "tif", "tiff":
+		return "image/tiff"
+	case "mp4", "m4v":
+		return "video/mp4"
+	case "mov":
+		return "video/quicktime"
+	case "mp3":
+		return "audio/mpeg"
+	case "m4a":
+		return "audio/mp4"
+	case "aac":
+		return "audio/aac"
+	case "caf":
+		return "audio/x-caf"
+	case "amr":
+		return "audio/amr"
+	case "vcf":
+		return "text/vcard"
+	case "txt":
+		return "text/plain"
+	case "pdf":
+		return "application/pdf"
+	default:
+		return ""
+	}
+}
+
+// mimeToMsgType picks the Matrix message type for an attachment.
+func mimeToMsgType(mime string) event.MessageType {
+	switch {
+	case strings.HasPrefix(mime, "image/"):
+		return event.MsgImage
+	case strings.HasPrefix(mime, "video/"):
+		return event.MsgVideo
+	case strings.HasPrefix(mime, "audio/"):
+		return event.MsgAudio
+	default:
+		return event.MsgFile
+	}
+}
+
+// hidesFilenameBody reports whether an attachment of msgType gets an empty
+// body instead of its file name (hide_media_filenames). Only media is
+// affected: a generic file's name says what it is.
+func hidesFilenameBody(msgType event.MessageType, hideMediaFilenames bool) bool {
+	if !hideMediaFilenames {
+		return false
+	}
+	switch msgType {
+	case event.MsgImage, event.MsgVideo, event.MsgAudio:
+		return true
+	default:
+		return false
+	}
+}
+
+// setAttachmentBody sets an attachment's body to its file name, or, when
+// hidesFilenameBody says so, leaves it empty and keeps the name as the
+// filename so downloads are still named.
+func setAttachmentBody(content *event.MessageEventContent, fileName string, hideMediaFilenames bool) {
+	if hidesFilenameBody(content.MsgType, hideMediaFilenames) {
+		content.Body = ""
+		content.FileName = fileName
+		return
+	}
+	content.Body = fileName
+}
+
+func ptrStringOr(s *string, def string) string {
+	if s != nil {
+		return *s
+	}
+	return def
+}
+
+func ptrUint64Or(v *uint64, def uint64) uint64 {
+	if v != nil {
+		return *v
+	}
+	return def
+}
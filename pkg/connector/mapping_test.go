@@ -0,0 +1,283 @@
+package connector
+
+import (
+	"context"
+	"testing"
+
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/event"
+
+	"github.com/lrhodin/imessage/imessage"
+)
+
+// TestTapbackMappingsAgree checks that the chat.db tapback types
+// (imessage.TapbackType) and the rustpush ones map to the same reactions in
+// both directions, whatever VS16 decoration either side uses.
+func TestTapbackMappingsAgree(t *testing.T) {
+	for typ := imessage.TapbackLove; typ <= imessage.TapbackQuestion; typ++ {
+		t.Run(typ.Name(), func(t *testing.T) {
+			want := uint32(typ - imessage.TapbackLove)
+			if got := chatDBTapbackEmoji(&imessage.Tapback{Type: typ}); got != tapbackTypeToEmoji(&want, nil) {
+				t.Errorf("chatDBTapbackEmoji(%s) = %q, want %q", typ.Name(), got, tapbackTypeToEmoji(&want, nil))
+			}
+			for _, emoji := range []string{typ.Emoji(), tapbackTypeToEmoji(&want, nil)} {
+				if got, custom := emojiToTapbackType(emoji); got != want || custom != nil {
+					t.Errorf("emojiToTapbackType(%q) = %d, %v, want %d, nil", emoji, got, custom, want)
+				}
+			}
+		})
+	}
+}
+
+// TestStandardTapbacks checks that every entry of the shared table maps to
+// its emoji and back, and that SMS reaction text comes from it.
+func TestStandardTapbacks(t *testing.T) {
+	seen := make(map[uint32]bool)
+	for _, tb := range standardTapbacks {
+		if seen[tb.Type] || tb.Type == tapbackTypeEmoji || tb.Type == tapbackTypeSticker {
+			t.Errorf("standardTapbacks has type %d twice or in place of a special type", tb.Type)
+		}
+		seen[tb.Type] = true
+		typ := tb.Type
+		if got := tapbackTypeToEmoji(&typ, nil); got != tb.Emoji {
+			t.Errorf("tapbackTypeToEmoji(%d) = %q, want %q", typ, got, tb.Emoji)
+		}
+		if !isKnownTapbackType(&typ) {
+			t.Errorf("isKnownTapbackType(%d) = false, want true", typ)
+		}
+		for _, emoji := range append([]string{tb.Emoji}, tb.Aliases...) {
+			if got, custom := emojiToTapbackType(emoji); got != typ || custom != nil {
+				t.Errorf("emojiToTapbackType(%q) = %d, %v, want %d, nil", emoji, got, custom, typ)
+			}
+		}
+		if got, want := formatSMSReactionTextWithBody(typ, nil, "hi", false), tb.Verb+" \u201chi\u201d"; got != want {
+			t.Errorf("formatSMSReactionTextWithBody(%d) = %q, want %q", typ, got, want)
+		}
+		if got, want := formatSMSReactionText(typ, nil, true), tb.RemoveVerb+" \u201c\u201d"; got != want {
+			t.Errorf("formatSMSReactionText(%d, remove) = %q, want %q", typ, got, want)
+		}
+	}
+}
+
+func TestUnknownTapbackType(t *testing.T) {
+	unknown := uint32(42)
+	emojiType := tapbackTypeEmoji
+	tests := []struct {
+		name      string
+		typ       *uint32
+		want      string
+		wantKnown bool
+	}{
+		{"nil", nil, unknownTapbackEmoji, false},
+		{"new type", &unknown, unknownTapbackEmoji, false},
+		{"emoji", &emojiType, "👍", true},
+	}
+	for _, tt := range tests {
+		if got := tapbackTypeToEmoji(tt.typ, nil); got != tt.want {
+			t.Errorf("tapbackTypeToEmoji(%s) = %q, want %q", tt.name, got, tt.want)
+		}
+		if got := isKnownTapbackType(tt.typ); got != tt.wantKnown {
+			t.Errorf("isKnownTapbackType(%s) = %v, want %v", tt.name, got, tt.wantKnown)
+		}
+	}
+	if unknownTapbackEmoji != imessage.TapbackType(2042).Emoji() {
+		t.Errorf("unknownTapbackEmoji = %q, want the chat.db marker %q", unknownTapbackEmoji, imessage.TapbackType(2042).Emoji())
+	}
+	if got := chatDBTapbackEmoji(&imessage.Tapback{Type: imessage.TapbackLove + 42}); got != unknownTapbackEmoji {
+		t.Errorf("chatDBTapbackEmoji(2042) = %q, want %q", got, unknownTapbackEmoji)
+	}
+}
+
+func TestEmojiToTapbackType(t *testing.T) {
+	tests := []struct {
+		emoji      string
+		want       uint32
+		wantCustom string
+	}{
+		{"❤️", 0, ""},
+		{"❤", 0, ""},
+		{"♥️", 0, ""},
+		{"👍", 1, ""},
+		{"👍️", 1, ""},
+		{"‼️", 4, ""},
+		{"❗", 4, ""},
+		{"❓️", 5, ""},
+		{"🔥", 6, "🔥"},
+		{"☺️", 6, "☺️"},
+	}
+	for _, tt := range tests {
+		got, custom := emojiToTapbackType(tt.emoji)
+		gotCustom := ptrStringOr(custom, "")
+		if got != tt.want || gotCustom != tt.wantCustom {
+			t.Errorf("emojiToTapbackType(%q) = %d, %q, want %d, %q", tt.emoji, got, gotCustom, tt.want, tt.wantCustom)
+		}
+	}
+}
+
+// Emoji tapbacks made of several code points: a skin tone modifier, a ZWJ
+// sequence with a modifier, a flag, and a keycap.
+var multiCodepointEmoji = []string{"👍🏽", "👩🏽‍💻", "🏳️‍🌈", "1️⃣"}
+
+func TestEmojiTapbackRoundTrip(t *testing.T) {
+	for _, emoji := range multiCodepointEmoji {
+		typ, custom := emojiToTapbackType(emoji)
+		if typ != 6 || custom == nil || *custom != emoji {
+			t.Errorf("emojiToTapbackType(%q) = %d, %q, want 6, %q", emoji, typ, ptrStringOr(custom, ""), emoji)
+			continue
+		}
+		if got := tapbackTypeToEmoji(&typ, custom); got != emoji {
+			t.Errorf("tapbackTypeToEmoji(6, %q) = %q, want %q", emoji, got, emoji)
+		}
+	}
+	empty := ""
+	typ := uint32(6)
+	if got := tapbackTypeToEmoji(&typ, &empty); got != "👍" {
+		t.Errorf("tapbackTypeToEmoji(6, \"\") = %q, want 👍", got)
+	}
+}
+
+func TestSameTapback(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"❤️", "❤", true},
+		{"❤️", "♥️", true},
+		{"👍", "👍", true},
+		{"👍", "👎", false},
+		{"👩🏽‍💻", "👩🏽‍💻", true},
+		{"👩🏽‍💻", "👩‍💻", false},
+		{"👍🏽", "👍", false},
+		{"🏳️‍🌈", "🏳️", false},
+	}
+	for _, tt := range tests {
+		if got := sameTapback(tt.a, tt.b); got != tt.want {
+			t.Errorf("sameTapback(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestRemovedTapbackMatches(t *testing.T) {
+	ctx := context.Background()
+	db := newTestBridgeDB(t)
+	c := &IMClient{Main: &IMConnector{Bridge: &bridgev2.Bridge{DB: db}}}
+	portalKey := networkid.PortalKey{ID: "tel:+15551234567", Receiver: "login"}
+	const sender networkid.UserID = "tel:+15551234567"
+	if err := db.Portal.Insert(ctx, &database.Portal{PortalKey: portalKey, MXID: "!dm:example.com"}); err != nil {
+		t.Fatalf("Portal.Insert() error = %v", err)
+	}
+	if err := db.Ghost.Insert(ctx, &database.Ghost{ID: sender}); err != nil {
+		t.Fatalf("Ghost.Insert() error = %v", err)
+	}
+	if err := db.Message.Insert(ctx, &database.Message{ID: "MSG", Room: portalKey, SenderID: sender, MXID: "$msg"}); err != nil {
+		t.Fatalf("Message.Insert() error = %v", err)
+	}
+
+	// No reaction stored yet: let bridgev2 handle it.
+	if !c.removedTapbackMatches(portalKey, "MSG", sender, "👩🏽‍💻") {
+		t.Errorf("removedTapbackMatches() with no reaction = false, want true")
+	}
+
+	// Store the add the way bridgev2 does for our reactions: no emoji ID,
+	// the emoji in the Emoji column.
+	add := "👩🏽‍💻"
+	typ, custom := emojiToTapbackType(add)
+	err := db.Reaction.Upsert(ctx, &database.Reaction{
+		Room: portalKey, MessageID: "MSG", SenderID: sender, MXID: "$react",
+		Emoji: tapbackTypeToEmoji(&typ, custom),
+	})
+	if err != nil {
+		t.Fatalf("Reaction.Upsert() error = %v", err)
+	}
+	stored, err := db.Reaction.GetByIDWithoutMessagePart(ctx, "login", "MSG", sender, "")
+	if err != nil || stored == nil || stored.Emoji != add {
+		t.Fatalf("stored reaction = %+v, %v, want emoji %q", stored, err, add)
+	}
+
+	for _, tt := range []struct {
+		remove string
+		want   bool
+	}{
+		{"👩🏽‍💻", true},
+		{"👩‍💻", false},
+		{"👍", false},
+	} {
+		if got := c.removedTapbackMatches(portalKey, "MSG", sender, tt.remove); got != tt.want {
+			t.Errorf("removedTapbackMatches(%q) with %q stored = %v, want %v", tt.remove, add, got, tt.want)
+		}
+	}
+}
+
+func TestMimeUTIRoundTrip(t *testing.T) {
+	for _, mime := range []string{
+		"image/jpeg", "image/png", "image/gif", "image/heic", "video/mp4",
+		"video/quicktime", "audio/aac", "audio/x-caf", "text/vcard",
+	} {
+		if got := utiToMIME(mimeToUTI(mime)); got != mime {
+			t.Errorf("utiToMIME(mimeToUTI(%q)) = %q, want %q", mime, got, mime)
+		}
+	}
+	if got := utiToMIME(mimeToUTI("audio/mp3")); got != "audio/mpeg" {
+		t.Errorf("utiToMIME(mimeToUTI(audio/mp3)) = %q, want audio/mpeg", got)
+	}
+}
+
+func TestExtToMIME(t *testing.T) {
+	tests := map[string]string{
+		".HEIC": "image/heic",
+		"jpg":   "image/jpeg",
+		".mov":  "video/quicktime",
+		".caf":  "audio/x-caf",
+		".vcf":  "text/vcard",
+		".xyz":  "",
+		"":      "",
+	}
+	for ext, want := range tests {
+		if got := extToMIME(ext); got != want {
+			t.Errorf("extToMIME(%q) = %q, want %q", ext, got, want)
+		}
+	}
+}
+
+func TestHidesFilenameBody(t *testing.T) {
+	tests := []struct {
+		msgType event.MessageType
+		hide    bool
+		want    bool
+	}{
+		{event.MsgImage, true, true},
+		{event.MsgVideo, true, true},
+		{event.MsgAudio, true, true},
+		{event.MsgFile, true, false},
+		{event.MsgNotice, true, false},
+		{event.MsgImage, false, false},
+		{event.MsgFile, false, false},
+	}
+	for _, tt := range tests {
+		if got := hidesFilenameBody(tt.msgType, tt.hide); got != tt.want {
+			t.Errorf("hidesFilenameBody(%s, %v) = %v, want %v", tt.msgType, tt.hide, got, tt.want)
+		}
+	}
+}
+
+func TestSetAttachmentBody(t *testing.T) {
+	tests := []struct {
+		msgType      event.MessageType
+		hide         bool
+		wantBody     string
+		wantFileName string
+	}{
+		{event.MsgImage, true, "", "IMG_1234.HEIC"},
+		{event.MsgImage, false, "IMG_1234.HEIC", ""},
+		{event.MsgFile, true, "IMG_1234.HEIC", ""},
+	}
+	for _, tt := range tests {
+		content := &event.MessageEventContent{MsgType: tt.msgType}
+		setAttachmentBody(content, "IMG_1234.HEIC", tt.hide)
+		if content.Body != tt.wantBody || content.FileName != tt.wantFileName {
+			t.Errorf("setAttachmentBody(%s, %v) = body %q, filename %q, want %q, %q", tt.msgType, tt.hide, content.Body, content.FileName, tt.wantBody, tt.wantFileName)
+		}
+	}
+}
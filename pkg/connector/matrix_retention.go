@@ -0,0 +1,207 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2024 Ludvig Rhodin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+package connector
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/bridgev2/simplevent"
+)
+
+// Matrix-side message retention (matrix_retention_days).
+//
+// A janitor that redacts bridged messages from Matrix once they're older
+// than the retention window, picking them from the bridge's message table.
+// It never talks to Apple: the redactions are plain MessageRemove events,
+// which bridgev2 sends to the room and then drops the message rows for, so
+// a message is only ever picked once. The remove events carry no sender,
+// which makes bridgev2 redact each message as whoever sent it (the ghost,
+// or the user's double puppet).
+//
+// A message is kept while something inside the window still refers to it —
+// a reaction or a reply/thread message newer than the cutoff — so those
+// don't end up pointing at a redacted event; it goes once they age out too.
+// Edits need no such check: iMessage only allows editing for 15 minutes,
+// far less than the shortest window.
+
+const (
+	matrixRetentionSweepInterval = 15 * time.Minute
+	// matrixRetentionBatchSize caps the messages redacted per sweep, so
+	// enabling retention on a long history works through it gradually
+	// instead of flooding the homeserver.
+	matrixRetentionBatchSize = 1000
+)
+
+// retainedPortalsKVKey returns the key holding the JSON list of portal IDs
+// the retention janitor has redacted messages in for a login. The
+// abandoned-DM janitor of the same login leaves those alone: a room emptied
+// by retention isn't an abandoned one.
+func retainedPortalsKVKey(loginID networkid.UserLoginID) database.Key {
+	return database.Key("im.matrix_retention_portals." + string(loginID))
+}
+
+// expiredMessage is one bridged message (all of its parts) to redact.
+type expiredMessage struct {
+	PortalID  string
+	MessageID networkid.MessageID
+}
+
+// findExpiredMessages returns up to limit messages of receiver, oldest
+// first, whose parts are all older than cutoff and that have a Matrix event
+// to redact (placeholder-only messages with ~fake: MXIDs are left alone).
+// Messages that a reaction, reply or thread message newer than cutoff
+// refers to are skipped. Only portals with a Matrix room are considered.
+func findExpiredMessages(ctx context.Context, db *database.Database, receiver networkid.UserLoginID, cutoff time.Time, limit int) ([]expiredMessage, error) {
+	rows, err := db.Query(ctx, `
+		SELECT m.room_id, m.id FROM message m
+		JOIN portal p ON p.bridge_id=m.bridge_id AND p.id=m.room_id AND p.receiver=m.room_receiver
+		WHERE m.bridge_id=$1 AND m.room_receiver=$2 AND p.mxid IS NOT NULL AND p.mxid <> ''
+		GROUP BY m.room_id, m.id
+		HAVING MAX(m.timestamp) < $3
+		   AND SUM(CASE WHEN m.mxid LIKE '~fake:%' THEN 0 ELSE 1 END) > 0
+		   AND NOT EXISTS (
+			SELECT 1 FROM reaction r
+			WHERE r.bridge_id=$1 AND r.room_receiver=$2 AND r.message_id=m.id AND r.timestamp >= $3
+		   )
+		   AND NOT EXISTS (
+			SELECT 1 FROM message n
+			WHERE n.bridge_id=$1 AND n.room_receiver=$2 AND n.timestamp >= $3
+			  AND (n.reply_to_id=m.id OR n.thread_root_id=m.id)
+		   )
+		ORDER BY MIN(m.timestamp), m.room_id, m.id
+		LIMIT $4
+	`, db.BridgeID, receiver, cutoff.UnixNano(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var expired []expiredMessage
+	for rows.Next() {
+		var msg expiredMessage
+		if err = rows.Scan(&msg.PortalID, &msg.MessageID); err != nil {
+			return nil, err
+		}
+		expired = append(expired, msg)
+	}
+	return expired, rows.Err()
+}
+
+// matrixRetentionWindow returns how old a message must be before it's
+// redacted, or 0 if retention is disabled.
+func (c *IMClient) matrixRetentionWindow() time.Duration {
+	days := c.Main.Config.MatrixRetentionDays
+	if days <= 0 {
+		return 0
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// loadRetainedPortals returns the set stored under retainedPortalsKVKey for
+// loginID.
+func loadRetainedPortals(ctx context.Context, db *database.Database, loginID networkid.UserLoginID) map[string]bool {
+	var portalIDs []string
+	if raw := db.KV.Get(ctx, retainedPortalsKVKey(loginID)); raw != "" {
+		_ = json.Unmarshal([]byte(raw), &portalIDs)
+	}
+	set := make(map[string]bool, len(portalIDs))
+	for _, portalID := range portalIDs {
+		set[portalID] = true
+	}
+	return set
+}
+
+// rememberRetainedPortals adds portal IDs to the set under
+// retainedPortalsKVKey for loginID.
+func rememberRetainedPortals(ctx context.Context, db *database.Database, loginID networkid.UserLoginID, expired []expiredMessage) {
+	set := loadRetainedPortals(ctx, db, loginID)
+	before := len(set)
+	for _, msg := range expired {
+		set[msg.PortalID] = true
+	}
+	if len(set) == before {
+		return
+	}
+	portalIDs := make([]string, 0, len(set))
+	for portalID := range set {
+		portalIDs = append(portalIDs, portalID)
+	}
+	sort.Strings(portalIDs)
+	if data, err := json.Marshal(portalIDs); err == nil {
+		db.KV.Set(ctx, retainedPortalsKVKey(loginID), string(data))
+	}
+}
+
+// sweepMatrixRetention runs one retention pass and returns the number of
+// messages queued for redaction.
+func (c *IMClient) sweepMatrixRetention(ctx context.Context, log zerolog.Logger, window time.Duration) int {
+	db := c.Main.Bridge.DB
+	expired, err := findExpiredMessages(ctx, db, c.UserLogin.ID, time.Now().Add(-window), matrixRetentionBatchSize)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to query expired messages")
+		return 0
+	}
+	rememberRetainedPortals(ctx, db, c.UserLogin.ID, expired)
+
+	queued := 0
+	for _, msg := range expired {
+		c.recentlyDeletedPortalsMu.RLock()
+		_, deleting := c.recentlyDeletedPortals[msg.PortalID]
+		c.recentlyDeletedPortalsMu.RUnlock()
+		if deleting {
+			continue
+		}
+		c.Main.Bridge.QueueRemoteEvent(c.UserLogin, &simplevent.MessageRemove{
+			EventMeta: simplevent.EventMeta{
+				Type:      bridgev2.RemoteEventMessageRemove,
+				PortalKey: networkid.PortalKey{ID: networkid.PortalID(msg.PortalID), Receiver: c.UserLogin.ID},
+				Timestamp: time.Now(),
+				LogContext: func(lc zerolog.Context) zerolog.Context {
+					return lc.Str("source", "matrix_retention")
+				},
+			},
+			TargetMessage: msg.MessageID,
+		})
+		queued++
+	}
+	return queued
+}
+
+// periodicMatrixRetention runs the retention janitor at startup and then
+// every matrixRetentionSweepInterval while matrix_retention_days is set.
+func (c *IMClient) periodicMatrixRetention(log zerolog.Logger) {
+	window := c.matrixRetentionWindow()
+	if window == 0 {
+		return
+	}
+	log = log.With().Str("component", "matrix_retention").Logger()
+	sweep := func() {
+		if queued := c.sweepMatrixRetention(context.Background(), log, window); queued > 0 {
+			log.Info().Int("messages", queued).Msg("Redacting messages past the Matrix retention window")
+		}
+	}
+
+	sweep()
+	ticker := time.NewTicker(matrixRetentionSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			sweep()
+		case <-c.stopChan:
+			return
+		}
+	}
+}
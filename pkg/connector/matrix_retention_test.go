@@ -0,0 +1,129 @@
+package connector
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestFindExpiredMessages(t *testing.T) {
+	ctx := context.Background()
+	db := newTestBridgeDB(t)
+	now := time.Unix(1700000000, 0)
+	cutoff := now.Add(-30 * 24 * time.Hour)
+	old := cutoff.Add(-24 * time.Hour)
+	recent := cutoff.Add(24 * time.Hour)
+
+	insertPortal := func(portalID string, receiver networkid.UserLoginID, mxid id.RoomID) networkid.PortalKey {
+		t.Helper()
+		key := networkid.PortalKey{ID: networkid.PortalID(portalID), Receiver: receiver}
+		if err := db.Portal.Insert(ctx, &database.Portal{PortalKey: key, MXID: mxid}); err != nil {
+			t.Fatalf("Portal.Insert(%s) error = %v", portalID, err)
+		}
+		return key
+	}
+	insertMessage := func(msg *database.Message) {
+		t.Helper()
+		if msg.MXID == "" {
+			msg.MXID = id.EventID("$" + string(msg.ID) + string(msg.PartID))
+		}
+		msg.SenderID = "tel:+15551234567"
+		if err := db.Message.Insert(ctx, msg); err != nil {
+			t.Fatalf("Message.Insert(%s) error = %v", msg.ID, err)
+		}
+	}
+	if err := db.Ghost.Insert(ctx, &database.Ghost{ID: "tel:+15551234567"}); err != nil {
+		t.Fatalf("Ghost.Insert() error = %v", err)
+	}
+
+	dm := insertPortal("tel:+15551234567", "login", "!dm:example.com")
+	group := insertPortal("gid:9b2c6a5e-1111-2222-3333-444455556666", "login", "!group:example.com")
+	unbridged := insertPortal("tel:+15550000002", "login", "")
+	other := insertPortal("tel:+15550000003", "other-login", "!other:example.com")
+
+	// Expired: old text, and an old message with two parts in a group.
+	insertMessage(&database.Message{ID: "OLD-1", Room: dm, Timestamp: old.Add(-time.Hour)})
+	insertMessage(&database.Message{ID: "OLD-2", Room: group, Timestamp: old})
+	insertMessage(&database.Message{ID: "OLD-2", PartID: "att0", Room: group, Timestamp: old})
+	// Inside the window.
+	insertMessage(&database.Message{ID: "NEW", Room: dm, Timestamp: recent})
+	// A part inside the window keeps the whole message.
+	insertMessage(&database.Message{ID: "STRADDLE", Room: dm, Timestamp: old})
+	insertMessage(&database.Message{ID: "STRADDLE", PartID: "att0", Room: dm, Timestamp: recent})
+	// Only a bridge placeholder: nothing to redact.
+	insertMessage(&database.Message{ID: "FAKE", MXID: database.FakeMXIDPrefix + "placeholder", Room: dm, Timestamp: old})
+	// Still referenced from inside the window.
+	insertMessage(&database.Message{ID: "REACTED", Room: dm, Timestamp: old})
+	insertMessage(&database.Message{ID: "REACTED-OLD", Room: dm, Timestamp: old})
+	insertMessage(&database.Message{ID: "REPLIED", Room: dm, Timestamp: old})
+	insertMessage(&database.Message{ID: "REPLY", Room: dm, Timestamp: recent, ReplyTo: networkid.MessageOptionalPartID{MessageID: "REPLIED"}})
+	insertMessage(&database.Message{ID: "THREAD-ROOT", Room: group, Timestamp: old})
+	insertMessage(&database.Message{ID: "THREAD-MSG", Room: group, Timestamp: recent, ThreadRoot: "THREAD-ROOT"})
+	// Other login and portal without a room.
+	insertMessage(&database.Message{ID: "OTHER", Room: other, Timestamp: old})
+	insertMessage(&database.Message{ID: "UNBRIDGED", Room: unbridged, Timestamp: old})
+
+	react := func(messageID networkid.MessageID, ts time.Time, emoji string) {
+		t.Helper()
+		err := db.Reaction.Upsert(ctx, &database.Reaction{
+			MessageID: messageID,
+			SenderID:  "tel:+15551234567",
+			EmojiID:   networkid.EmojiID(emoji),
+			Emoji:     emoji,
+			Room:      dm,
+			MXID:      id.EventID("$react-" + string(messageID)),
+			Timestamp: ts,
+		})
+		if err != nil {
+			t.Fatalf("Reaction.Upsert(%s) error = %v", messageID, err)
+		}
+	}
+	react("REACTED", recent, "❤️")
+	// An old reaction doesn't hold the message back.
+	react("REACTED-OLD", old, "👍")
+
+	got, err := findExpiredMessages(ctx, db, "login", cutoff, 100)
+	if err != nil {
+		t.Fatalf("findExpiredMessages() error = %v", err)
+	}
+	want := []expiredMessage{
+		{PortalID: string(dm.ID), MessageID: "OLD-1"},
+		{PortalID: string(group.ID), MessageID: "OLD-2"},
+		{PortalID: string(dm.ID), MessageID: "REACTED-OLD"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("findExpiredMessages() = %+v, want %+v", got, want)
+	}
+
+	got, err = findExpiredMessages(ctx, db, "login", cutoff, 1)
+	if err != nil {
+		t.Fatalf("findExpiredMessages() error = %v", err)
+	}
+	if len(got) != 1 || got[0].MessageID != "OLD-1" {
+		t.Errorf("findExpiredMessages(limit 1) = %+v, want only the oldest, OLD-1", got)
+	}
+}
+
+func TestRememberRetainedPortals(t *testing.T) {
+	ctx := context.Background()
+	db := newTestBridgeDB(t)
+
+	if got := loadRetainedPortals(ctx, db, "login-a"); len(got) != 0 {
+		t.Fatalf("loadRetainedPortals() on empty KV = %v, want empty", got)
+	}
+	rememberRetainedPortals(ctx, db, "login-a", []expiredMessage{{PortalID: "tel:+15550000001"}, {PortalID: "gid:abc"}})
+	rememberRetainedPortals(ctx, db, "login-a", []expiredMessage{{PortalID: "tel:+15550000001"}, {PortalID: "tel:+15550000002"}})
+
+	want := map[string]bool{"gid:abc": true, "tel:+15550000001": true, "tel:+15550000002": true}
+	if got := loadRetainedPortals(ctx, db, "login-a"); !reflect.DeepEqual(got, want) {
+		t.Errorf("loadRetainedPortals() = %v, want %v", got, want)
+	}
+	if got := loadRetainedPortals(ctx, db, "login-b"); len(got) != 0 {
+		t.Errorf("loadRetainedPortals() for another login = %v, want empty", got)
+	}
+}
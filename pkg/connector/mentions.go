@@ -0,0 +1,64 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2024 Ludvig Rhodin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+package connector
+
+// Incoming @-mentions.
+//
+// rustpush renders each mention part of a message into the HTML body as
+// <a href="handle">@Name</a>, with the mentioned person's handle as the
+// link target. When one of those handles is ours, the user's MXID is added
+// to m.mentions, so the message highlights like a Matrix mention, which
+// push rules let through even in a room the user has muted.
+
+import (
+	"html"
+	"regexp"
+	"slices"
+
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/event"
+
+	"github.com/lrhodin/imessage/pkg/rustpushgo"
+)
+
+var mentionLinkRegex = regexp.MustCompile(`<a href="([^"]*)">@`)
+
+// mentionedHandles returns the handles of the mentions in a message's HTML
+// body, in order.
+func mentionedHandles(htmlBody string) []string {
+	var handles []string
+	for _, match := range mentionLinkRegex.FindAllStringSubmatch(htmlBody, -1) {
+		if handle := html.UnescapeString(match[1]); handle != "" {
+			handles = append(handles, handle)
+		}
+	}
+	return handles
+}
+
+// mentionsMe reports whether msg @-mentions one of our handles. Our own
+// messages never count.
+func (c *IMClient) mentionsMe(msg *rustpushgo.WrappedMessage) bool {
+	if msg.Html == nil || (msg.Sender != nil && c.isMyHandle(*msg.Sender)) {
+		return false
+	}
+	return slices.ContainsFunc(mentionedHandles(*msg.Html), c.isMyHandle)
+}
+
+// addSelfMention adds the user to the m.mentions of cm's text part when
+// msg mentions them.
+func (c *IMClient) addSelfMention(cm *bridgev2.ConvertedMessage, msg *rustpushgo.WrappedMessage) {
+	if len(cm.Parts) == 0 || cm.Parts[0].Content == nil || c.UserLogin.UserMXID == "" || !c.mentionsMe(msg) {
+		return
+	}
+	content := cm.Parts[0].Content
+	if content.Mentions == nil {
+		content.Mentions = &event.Mentions{}
+	}
+	content.Mentions.Add(c.UserLogin.UserMXID)
+}
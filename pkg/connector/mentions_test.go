@@ -0,0 +1,66 @@
+package connector
+
+import (
+	"reflect"
+	"testing"
+
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/lrhodin/imessage/pkg/rustpushgo"
+)
+
+func TestMentionedHandles(t *testing.T) {
+	tests := []struct {
+		name string
+		html string
+		want []string
+	}{
+		{"none", "<strong>hi</strong>", nil},
+		{"one", `hey <a href="tel:+15550001111">@Me</a>!`, []string{"tel:+15550001111"}},
+		{"escaped", `<a href="mailto:a&amp;b@example.com">@A &amp; B</a>`, []string{"mailto:a&b@example.com"}},
+		{"several", `<a href="tel:+15551234567">@Ann</a> <a href="mailto:me@example.com">@Me</a>`, []string{"tel:+15551234567", "mailto:me@example.com"}},
+		{"plain link isn't a mention", `<a href="https://example.com">example.com</a>`, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mentionedHandles(tt.html); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("mentionedHandles() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAddSelfMention(t *testing.T) {
+	const me = id.UserID("@me:example.com")
+	c := &IMClient{
+		allHandles: []string{"tel:+15550001111", "mailto:me@example.com"},
+		UserLogin:  &bridgev2.UserLogin{UserLogin: &database.UserLogin{UserMXID: me}},
+	}
+	str := func(s string) *string { return &s }
+	tests := []struct {
+		name string
+		msg  rustpushgo.WrappedMessage
+		want bool
+	}{
+		{"mentions my phone", rustpushgo.WrappedMessage{Sender: str("tel:+15551234567"), Html: str(`<a href="tel:+15550001111">@Me</a> look`)}, true},
+		{"mentions my email without scheme", rustpushgo.WrappedMessage{Sender: str("tel:+15551234567"), Html: str(`<a href="Me@Example.com">@Me</a>`)}, true},
+		{"mentions someone else", rustpushgo.WrappedMessage{Sender: str("tel:+15551234567"), Html: str(`<a href="tel:+15559999999">@Bob</a>`)}, false},
+		{"no html", rustpushgo.WrappedMessage{Sender: str("tel:+15551234567"), Text: str("@Me look")}, false},
+		{"my own message", rustpushgo.WrappedMessage{Sender: str("tel:+15550001111"), Html: str(`<a href="mailto:me@example.com">@Me</a>`)}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cm := &bridgev2.ConvertedMessage{Parts: []*bridgev2.ConvertedMessagePart{{
+				Type:    event.EventMessage,
+				Content: &event.MessageEventContent{MsgType: event.MsgText, Body: "look"},
+			}}}
+			c.addSelfMention(cm, &tt.msg)
+			if got := cm.Parts[0].Content.Mentions.Has(me); got != tt.want {
+				t.Errorf("addSelfMention() highlights = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,162 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2024 Ludvig Rhodin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+package connector
+
+import (
+	"html"
+	"strings"
+
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/event"
+)
+
+// iMessage "send with effect". The expressive send style identifier comes
+// through as WrappedMessage.Effect and falls into two categories:
+//
+//   - bubble effects (com.apple.MobileSMS.expressivesend.*) animate the
+//     message bubble itself: Slam, Loud, Gentle, Invisible Ink.
+//   - screen effects (com.apple.messages.effect.CK*Effect) play a
+//     full-screen animation: Balloons, Confetti, Lasers, Fireworks, …
+//
+// Matrix has no equivalent. The effect always goes in the event as a
+// com.beeper.message_effect field, for clients that can render it, and by
+// default is also annotated as a line under the message text, so every
+// client shows it (effect_note_in_body). Screen effects get their emoji
+// since they're the more visible of the two on Apple devices.
+
+const (
+	bubbleEffectPrefix = "com.apple.MobileSMS.expressivesend."
+	screenEffectPrefix = "com.apple.messages.effect."
+)
+
+// messageEffectField holds the structured effect in the event content.
+const messageEffectField = "com.beeper.message_effect"
+
+type messageEffectKind int
+
+const (
+	messageEffectNone messageEffectKind = iota
+	messageEffectBubble
+	messageEffectScreen
+)
+
+type messageEffect struct {
+	Kind  messageEffectKind
+	Name  string
+	Emoji string // screen effects only
+}
+
+var knownMessageEffects = map[string]messageEffect{
+	bubbleEffectPrefix + "impact":                {messageEffectBubble, "Slam", ""},
+	bubbleEffectPrefix + "loud":                  {messageEffectBubble, "Loud", ""},
+	bubbleEffectPrefix + "gentle":                {messageEffectBubble, "Gentle", ""},
+	bubbleEffectPrefix + "invisibleink":          {messageEffectBubble, "Invisible Ink", ""},
+	screenEffectPrefix + "CKHappyBirthdayEffect": {messageEffectScreen, "Balloons", "🎈"},
+	screenEffectPrefix + "CKConfettiEffect":      {messageEffectScreen, "Confetti", "🎉"},
+	screenEffectPrefix + "CKLasersEffect":        {messageEffectScreen, "Lasers", "🪩"},
+	screenEffectPrefix + "CKFireworksEffect":     {messageEffectScreen, "Fireworks", "🎆"},
+	screenEffectPrefix + "CKSparklesEffect":      {messageEffectScreen, "Celebration", "✨"},
+	screenEffectPrefix + "CKShootingStarEffect":  {messageEffectScreen, "Shooting Star", "🌠"},
+	screenEffectPrefix + "CKHeartEffect":         {messageEffectScreen, "Love", "❤️"},
+	screenEffectPrefix + "CKEchoEffect":          {messageEffectScreen, "Echo", "🔁"},
+	screenEffectPrefix + "CKSpotlightEffect":     {messageEffectScreen, "Spotlight", "🔦"},
+}
+
+// parseMessageEffect categorizes an expressive send style identifier.
+// Identifiers that aren't in the table but have a known prefix still get
+// their category, with a name derived from the identifier.
+func parseMessageEffect(id string) messageEffect {
+	id = strings.TrimSpace(id)
+	if effect, ok := knownMessageEffects[id]; ok {
+		return effect
+	}
+	switch {
+	case strings.HasPrefix(id, bubbleEffectPrefix) && len(id) > len(bubbleEffectPrefix):
+		return messageEffect{Kind: messageEffectBubble, Name: effectDisplayName(strings.TrimPrefix(id, bubbleEffectPrefix))}
+	case strings.HasPrefix(id, screenEffectPrefix) && len(id) > len(screenEffectPrefix):
+		name := strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(id, screenEffectPrefix), "CK"), "Effect")
+		if name == "" {
+			return messageEffect{}
+		}
+		return messageEffect{Kind: messageEffectScreen, Name: effectDisplayName(name), Emoji: "✨"}
+	}
+	return messageEffect{}
+}
+
+// effectDisplayName turns "ShootingStar" or "invisibleink" into a
+// presentable name ("Shooting Star", "Invisibleink").
+func effectDisplayName(raw string) string {
+	var sb strings.Builder
+	for i, r := range raw {
+		if i > 0 && r >= 'A' && r <= 'Z' {
+			sb.WriteByte(' ')
+		}
+		sb.WriteRune(r)
+	}
+	name := sb.String()
+	return strings.ToUpper(name[:1]) + name[1:]
+}
+
+// note is the annotation shown under the message text.
+func (e messageEffect) note() string {
+	switch e.Kind {
+	case messageEffectScreen:
+		return e.Emoji + " sent with " + e.Name
+	case messageEffectBubble:
+		return "(sent with " + e.Name + " effect)"
+	default:
+		return ""
+	}
+}
+
+// kind names the effect category in messageEffectField.
+func (k messageEffectKind) String() string {
+	switch k {
+	case messageEffectBubble:
+		return "bubble"
+	case messageEffectScreen:
+		return "screen"
+	default:
+		return ""
+	}
+}
+
+// applyMessageEffect puts the message's send effect, if it has one, in
+// part's messageEffectField and, with noteInBody, as a note under the text.
+func applyMessageEffect(part *bridgev2.ConvertedMessagePart, effectID *string, noteInBody bool) {
+	if effectID == nil {
+		return
+	}
+	effect := parseMessageEffect(*effectID)
+	note := effect.note()
+	if note == "" {
+		return
+	}
+	if part.Extra == nil {
+		part.Extra = make(map[string]any)
+	}
+	part.Extra[messageEffectField] = map[string]any{
+		"id":          strings.TrimSpace(*effectID),
+		"kind":        effect.Kind.String(),
+		"name":        effect.Name,
+		"description": note,
+	}
+	if !noteInBody {
+		return
+	}
+	content := part.Content
+	if content.Body == "" {
+		content.Body = note
+	} else {
+		content.Body += "\n" + note
+	}
+	if content.Format == event.FormatHTML {
+		content.FormattedBody += "<br/><em>" + html.EscapeString(note) + "</em>"
+	}
+}
@@ -0,0 +1,99 @@
+package connector
+
+import (
+	"reflect"
+	"testing"
+
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/event"
+)
+
+func TestParseMessageEffect(t *testing.T) {
+	tests := []struct {
+		id   string
+		want messageEffect
+		note string
+	}{
+		{"com.apple.MobileSMS.expressivesend.impact", messageEffect{messageEffectBubble, "Slam", ""}, "(sent with Slam effect)"},
+		{"com.apple.MobileSMS.expressivesend.invisibleink", messageEffect{messageEffectBubble, "Invisible Ink", ""}, "(sent with Invisible Ink effect)"},
+		{"com.apple.messages.effect.CKConfettiEffect", messageEffect{messageEffectScreen, "Confetti", "🎉"}, "🎉 sent with Confetti"},
+		{"com.apple.messages.effect.CKHappyBirthdayEffect", messageEffect{messageEffectScreen, "Balloons", "🎈"}, "🎈 sent with Balloons"},
+		{"com.apple.messages.effect.CKFireworksEffect", messageEffect{messageEffectScreen, "Fireworks", "🎆"}, "🎆 sent with Fireworks"},
+		// Effects added in later iOS versions keep their category.
+		{"com.apple.messages.effect.CKRainbowSparkEffect", messageEffect{messageEffectScreen, "Rainbow Spark", "✨"}, "✨ sent with Rainbow Spark"},
+		{"com.apple.MobileSMS.expressivesend.whisper", messageEffect{messageEffectBubble, "Whisper", ""}, "(sent with Whisper effect)"},
+		{"com.apple.messages.effect.CKEffect", messageEffect{}, ""},
+		{"com.apple.MobileSMS.expressivesend.", messageEffect{}, ""},
+		{"", messageEffect{}, ""},
+		{"com.example.other", messageEffect{}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.id, func(t *testing.T) {
+			got := parseMessageEffect(tt.id)
+			if got != tt.want {
+				t.Errorf("parseMessageEffect(%q) = %+v, want %+v", tt.id, got, tt.want)
+			}
+			if note := got.note(); note != tt.note {
+				t.Errorf("parseMessageEffect(%q).note() = %q, want %q", tt.id, note, tt.note)
+			}
+		})
+	}
+}
+
+func TestApplyMessageEffect(t *testing.T) {
+	confetti := "com.apple.messages.effect.CKConfettiEffect"
+	unknown := "com.example.other"
+	newPart := func(subject, text string) *bridgev2.ConvertedMessagePart {
+		return &bridgev2.ConvertedMessagePart{Type: event.EventMessage, Content: subjectMessageContent(subject, text)}
+	}
+	wantField := map[string]any{
+		"id":          confetti,
+		"kind":        "screen",
+		"name":        "Confetti",
+		"description": "🎉 sent with Confetti",
+	}
+
+	part := newPart("", "happy birthday")
+	applyMessageEffect(part, &confetti, true)
+	if want := "happy birthday\n🎉 sent with Confetti"; part.Content.Body != want || part.Content.Format != "" {
+		t.Errorf("applyMessageEffect() body = %q (format %q), want %q", part.Content.Body, part.Content.Format, want)
+	}
+	if got := part.Extra[messageEffectField]; !reflect.DeepEqual(got, wantField) {
+		t.Errorf("applyMessageEffect() %s = %v, want %v", messageEffectField, got, wantField)
+	}
+
+	part = newPart("Party", "tonight")
+	applyMessageEffect(part, &confetti, true)
+	if want := "<strong>Party</strong><br/>tonight<br/><em>🎉 sent with Confetti</em>"; part.Content.FormattedBody != want || part.Content.Format != event.FormatHTML {
+		t.Errorf("applyMessageEffect() formatted body = %q, want %q", part.Content.FormattedBody, want)
+	}
+
+	for _, effect := range []*string{nil, &unknown} {
+		part = newPart("", "hi")
+		applyMessageEffect(part, effect, true)
+		if part.Content.Body != "hi" || part.Extra != nil {
+			t.Errorf("applyMessageEffect(%v) body = %q, extra = %v, want unchanged", effect, part.Content.Body, part.Extra)
+		}
+	}
+}
+
+func TestApplyMessageEffectFieldOnly(t *testing.T) {
+	slam := "com.apple.MobileSMS.expressivesend.impact"
+	part := &bridgev2.ConvertedMessagePart{Type: event.EventMessage, Content: subjectMessageContent("Party", "tonight")}
+	applyMessageEffect(part, &slam, false)
+	if want := "**Party**\ntonight"; part.Content.Body != want {
+		t.Errorf("applyMessageEffect() body = %q, want %q", part.Content.Body, want)
+	}
+	if want := "<strong>Party</strong><br/>tonight"; part.Content.FormattedBody != want {
+		t.Errorf("applyMessageEffect() formatted body = %q, want %q", part.Content.FormattedBody, want)
+	}
+	want := map[string]any{
+		"id":          slam,
+		"kind":        "bubble",
+		"name":        "Slam",
+		"description": "(sent with Slam effect)",
+	}
+	if got := part.Extra[messageEffectField]; !reflect.DeepEqual(got, want) {
+		t.Errorf("applyMessageEffect() %s = %v, want %v", messageEffectField, got, want)
+	}
+}
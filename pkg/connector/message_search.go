@@ -0,0 +1,314 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2024 Ludvig Rhodin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+package connector
+
+// Message search (search command, message_search_fts).
+//
+// The CloudKit backfill store has the text of every synced message, so it
+// can answer "where did they send that address" without scrolling back
+// through the room. The search command matches all words of the query
+// against cloud_message.text, in the current chat or (with --all, or from
+// the management room) across all chats, and links each hit to its event
+// when the message was bridged.
+//
+// Plain LIKE matching scans every row. With message_search_fts on SQLite,
+// an FTS5 index over cloud_message.text is kept up to date by triggers on
+// insert, update and delete, so it follows upserts, edits and deletions
+// without changes to the ingest code. FTS5 needs SQLite built with it (the
+// sqlite_fts5 build tag); without it, or on Postgres, search falls back to
+// LIKE. Turning the option off drops the triggers, so a database indexed
+// once never depends on the FTS5 module again.
+//
+// Flow:
+//   !im search dinner friday       → hits in this chat, newest first
+//   !im search --all dinner friday → hits across all chats
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.mau.fi/util/dbutil"
+	"maunium.net/go/mautrix/bridgev2/commands"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+)
+
+const (
+	messageSearchLimit = 15
+	// messageSearchSnippetLen is how many characters of a hit's text the
+	// reply shows.
+	messageSearchSnippetLen = 120
+)
+
+var messageSearchTriggers = []string{
+	`CREATE TRIGGER IF NOT EXISTS cloud_message_fts_ai AFTER INSERT ON cloud_message BEGIN
+		INSERT INTO cloud_message_fts(rowid, text) VALUES (new.rowid, new.text);
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS cloud_message_fts_ad AFTER DELETE ON cloud_message BEGIN
+		INSERT INTO cloud_message_fts(cloud_message_fts, rowid, text) VALUES ('delete', old.rowid, old.text);
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS cloud_message_fts_au AFTER UPDATE OF text ON cloud_message BEGIN
+		INSERT INTO cloud_message_fts(cloud_message_fts, rowid, text) VALUES ('delete', old.rowid, old.text);
+		INSERT INTO cloud_message_fts(rowid, text) VALUES (new.rowid, new.text);
+	END`,
+}
+
+// setupMessageSearch creates or drops the FTS5 index. It reports whether
+// search can use the index; errors from a SQLite without FTS5 aren't
+// returned, search just uses LIKE.
+func (s *cloudBackfillStore) setupMessageSearch(ctx context.Context, enabled bool) (bool, error) {
+	if !enabled || s.db.Dialect != dbutil.SQLite {
+		s.searchFTS.Store(false)
+		return false, s.dropMessageSearchTriggers(ctx)
+	}
+	var hadTriggers int
+	_ = s.db.QueryRow(ctx, `SELECT COUNT(*) FROM sqlite_master WHERE type='trigger' AND name='cloud_message_fts_ai'`).Scan(&hadTriggers)
+	if _, err := s.db.Exec(ctx, `CREATE VIRTUAL TABLE IF NOT EXISTS cloud_message_fts
+		USING fts5(text, content='cloud_message', content_rowid='rowid')`); err != nil {
+		s.searchFTS.Store(false)
+		return false, s.dropMessageSearchTriggers(ctx)
+	}
+	err := s.db.DoTxn(ctx, nil, func(ctx context.Context) error {
+		for _, query := range messageSearchTriggers {
+			if _, err := s.db.Exec(ctx, query); err != nil {
+				return err
+			}
+		}
+		// Rows written while the triggers were missing aren't indexed.
+		if hadTriggers == 0 {
+			if _, err := s.db.Exec(ctx, `INSERT INTO cloud_message_fts(cloud_message_fts) VALUES ('rebuild')`); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		s.searchFTS.Store(false)
+		return false, fmt.Errorf("failed to set up message search index: %w", err)
+	}
+	s.searchFTS.Store(true)
+	return true, nil
+}
+
+func (s *cloudBackfillStore) dropMessageSearchTriggers(ctx context.Context) error {
+	if s.db.Dialect != dbutil.SQLite {
+		return nil
+	}
+	for _, name := range []string{"cloud_message_fts_ai", "cloud_message_fts_ad", "cloud_message_fts_au"} {
+		if _, err := s.db.Exec(ctx, `DROP TRIGGER IF EXISTS `+name); err != nil {
+			return fmt.Errorf("failed to drop message search trigger: %w", err)
+		}
+	}
+	return nil
+}
+
+// messageSearchHit is one message matching a search.
+type messageSearchHit struct {
+	GUID        string
+	PortalID    string
+	TimestampMS int64
+	Sender      string
+	IsFromMe    bool
+	Text        string
+}
+
+// messageSearchTerms splits a query into words. Each must appear in a hit.
+func messageSearchTerms(query string) []string {
+	return strings.Fields(query)
+}
+
+// ftsMatchQuery quotes each term as an FTS5 string, so punctuation in the
+// query is matched rather than parsed as FTS5 syntax.
+func ftsMatchQuery(terms []string) string {
+	quoted := make([]string, len(terms))
+	for i, term := range terms {
+		quoted[i] = `"` + strings.ReplaceAll(term, `"`, `""`) + `"`
+	}
+	return strings.Join(quoted, " ")
+}
+
+// escapeLike escapes LIKE wildcards in term, with \ as the escape character.
+func escapeLike(term string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(term)
+}
+
+// searchMessages returns the newest live messages whose text contains every
+// word of query, in portalID or in all portals if it's empty.
+func (s *cloudBackfillStore) searchMessages(ctx context.Context, query, portalID string, limit int) ([]messageSearchHit, error) {
+	terms := messageSearchTerms(query)
+	if len(terms) == 0 {
+		return nil, nil
+	}
+	args := []any{s.loginID}
+	arg := func(v any) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	var from string
+	var where []string
+	if s.searchFTS.Load() {
+		from = `cloud_message_fts JOIN cloud_message m ON m.rowid=cloud_message_fts.rowid`
+		where = append(where, `cloud_message_fts MATCH `+arg(ftsMatchQuery(terms)))
+	} else {
+		from = `cloud_message m`
+		for _, term := range terms {
+			where = append(where, `LOWER(m.text) LIKE `+arg("%"+strings.ToLower(escapeLike(term))+"%")+` ESCAPE '\'`)
+		}
+	}
+	where = append(where, `m.login_id=$1`, `m.deleted=FALSE`, `m.text IS NOT NULL`)
+	if portalID != "" {
+		where = append(where, `m.portal_id=`+arg(portalID))
+	}
+	rows, err := s.db.Query(ctx, fmt.Sprintf(`
+		SELECT m.guid, COALESCE(m.portal_id, ''), m.timestamp_ms, COALESCE(m.sender, ''), m.is_from_me, m.text
+		FROM %s
+		WHERE %s
+		ORDER BY m.timestamp_ms DESC
+		LIMIT %s
+	`, from, strings.Join(where, " AND "), arg(limit)), args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search messages: %w", err)
+	}
+	defer rows.Close()
+	var hits []messageSearchHit
+	for rows.Next() {
+		var hit messageSearchHit
+		if err = rows.Scan(&hit.GUID, &hit.PortalID, &hit.TimestampMS, &hit.Sender, &hit.IsFromMe, &hit.Text); err != nil {
+			return nil, fmt.Errorf("failed to scan search hit: %w", err)
+		}
+		hits = append(hits, hit)
+	}
+	return hits, rows.Err()
+}
+
+// messageSnippet shortens text to one line of at most n characters.
+func messageSnippet(text string, n int) string {
+	text = strings.Join(strings.Fields(text), " ")
+	if runes := []rune(text); len(runes) > n {
+		return string(runes[:n-1]) + "…"
+	}
+	return text
+}
+
+// searchHitView is a hit with what the reply shows beyond the stored row.
+type searchHitView struct {
+	messageSearchHit
+	ChatName string // for results across chats
+	Link     string // matrix.to link to the event, if bridged
+}
+
+// formatSearchResults renders the search reply.
+func formatSearchResults(query string, hits []searchHitView, global bool, loc *time.Location) string {
+	if len(hits) == 0 {
+		return fmt.Sprintf("No messages found for %q.", query)
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "**Messages matching %q**", query)
+	if len(hits) == messageSearchLimit {
+		fmt.Fprintf(&sb, " (newest %d)", messageSearchLimit)
+	}
+	sb.WriteString("\n\n")
+	for i, hit := range hits {
+		ts := time.UnixMilli(hit.TimestampMS).In(loc).Format("2006-01-02 15:04")
+		sender := hit.Sender
+		if hit.IsFromMe {
+			sender = "You"
+		} else if sender == "" {
+			sender = "Unknown"
+		}
+		fmt.Fprintf(&sb, "%d. %s", i+1, ts)
+		if global {
+			chat := hit.ChatName
+			if chat == "" {
+				chat = hit.PortalID
+			}
+			fmt.Fprintf(&sb, " in %s", chat)
+		}
+		fmt.Fprintf(&sb, " — **%s**: %s", sender, messageSnippet(hit.Text, messageSearchSnippetLen))
+		if hit.Link != "" {
+			fmt.Fprintf(&sb, " ([jump](%s))", hit.Link)
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+// searchHitViews adds chat names and event links to hits.
+func (c *IMClient) searchHitViews(ctx context.Context, hits []messageSearchHit, global bool) []searchHitView {
+	views := make([]searchHitView, len(hits))
+	for i, hit := range hits {
+		views[i].messageSearchHit = hit
+		portal, _ := c.Main.Bridge.GetExistingPortalByKey(ctx, networkid.PortalKey{ID: networkid.PortalID(hit.PortalID), Receiver: c.UserLogin.ID})
+		if global {
+			if portal != nil && portal.Name != "" {
+				views[i].ChatName = portal.Name
+			} else {
+				views[i].ChatName, _ = c.cloudStore.getDisplayNameByPortalID(ctx, hit.PortalID)
+			}
+		}
+		if portal == nil || portal.MXID == "" {
+			continue
+		}
+		msg, err := c.Main.Bridge.DB.Message.GetFirstPartByID(ctx, c.UserLogin.ID, makeMessageID(hit.GUID))
+		if err == nil && msg != nil && msg.MXID != "" && !strings.HasPrefix(string(msg.MXID), "~") {
+			views[i].Link = portal.MXID.EventURI(msg.MXID, c.Main.Bridge.Matrix.ServerName()).MatrixToURL()
+		}
+	}
+	return views
+}
+
+var cmdSearch = &commands.FullHandler{
+	Name: "search",
+	Func: fnSearch,
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionChats,
+		Description: "Search synced iMessage history in this chat, or in all chats with --all.",
+		Args:        "[--all] <query>",
+	},
+	RequiresLogin: true,
+}
+
+func fnSearch(ce *commands.Event) {
+	args := ce.Args
+	global := ce.Portal == nil
+	if len(args) > 0 && args[0] == "--all" {
+		global = true
+		args = args[1:]
+	}
+	query := strings.Join(args, " ")
+	if strings.TrimSpace(query) == "" {
+		ce.Reply("**Usage:** `$cmdprefix search [--all] <query>`")
+		return
+	}
+	login := ce.User.GetDefaultLogin()
+	if login == nil {
+		ce.Reply("Not logged in.")
+		return
+	}
+	client, ok := login.Client.(*IMClient)
+	if !ok || client == nil {
+		ce.Reply("Bridge client not available.")
+		return
+	}
+	if client.cloudStore == nil {
+		ce.Reply("Message history isn't available: CloudKit backfill is off or not set up.")
+		return
+	}
+	var portalID string
+	if !global {
+		portalID = string(ce.Portal.ID)
+	}
+	hits, err := client.cloudStore.searchMessages(ce.Ctx, query, portalID, messageSearchLimit)
+	if err != nil {
+		ce.Reply("Search failed: %v", err)
+		return
+	}
+	ce.Reply(formatSearchResults(query, client.searchHitViews(ce.Ctx, hits, global), global, time.Local))
+}
@@ -0,0 +1,189 @@
+package connector
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func searchGUIDs(t *testing.T, s *cloudBackfillStore, query, portalID string) []string {
+	t.Helper()
+	hits, err := s.searchMessages(context.Background(), query, portalID, messageSearchLimit)
+	if err != nil {
+		t.Fatalf("searchMessages(%q) error = %v", query, err)
+	}
+	var guids []string
+	for _, hit := range hits {
+		guids = append(guids, hit.GUID)
+	}
+	return guids
+}
+
+func seedSearchMessages(t *testing.T, s *cloudBackfillStore) {
+	t.Helper()
+	rows := []cloudMessageRow{
+		{GUID: "a1", PortalID: "tel:+1", TimestampMS: 1000, Text: "Dinner on Friday?"},
+		{GUID: "a2", PortalID: "tel:+1", TimestampMS: 2000, Text: "friday works, where's dinner"},
+		{GUID: "a3", PortalID: "tel:+1", TimestampMS: 3000, Text: "Lunch instead", IsFromMe: true},
+		{GUID: "b1", PortalID: "tel:+2", TimestampMS: 4000, Text: "DINNER is at 8 on friday"},
+		{GUID: "b2", PortalID: "tel:+2", TimestampMS: 5000, Text: "100% sure, see file_name"},
+		{GUID: "b3", PortalID: "tel:+2", TimestampMS: 6000, Text: "friday dinner (deleted)", Deleted: true},
+	}
+	if err := s.upsertMessageBatch(context.Background(), rows); err != nil {
+		t.Fatalf("upsertMessageBatch() error = %v", err)
+	}
+}
+
+func TestSearchMessagesLike(t *testing.T) {
+	s := newTestCloudStore(t)
+	seedSearchMessages(t, s)
+	tests := []struct {
+		name     string
+		query    string
+		portalID string
+		want     []string
+	}{
+		{"all terms, any case, newest first", "friday DINNER", "", []string{"b1", "a2", "a1"}},
+		{"in one portal", "dinner friday", "tel:+1", []string{"a2", "a1"}},
+		{"one term missing", "dinner tuesday", "", nil},
+		{"percent is literal", "100%", "", []string{"b2"}},
+		{"underscore is literal", "e_n", "", []string{"b2"}},
+		{"wildcard doesn't match", "%", "tel:+1", nil},
+		{"empty query", "   ", "", nil},
+	}
+	for _, tt := range tests {
+		if got := searchGUIDs(t, s, tt.query, tt.portalID); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("searchMessages(%s) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSearchMessagesLimit(t *testing.T) {
+	s := newTestCloudStore(t)
+	seedSearchMessages(t, s)
+	hits, err := s.searchMessages(context.Background(), "dinner", "", 2)
+	if err != nil {
+		t.Fatalf("searchMessages() error = %v", err)
+	}
+	if len(hits) != 2 || hits[0].GUID != "b1" || hits[0].PortalID != "tel:+2" || hits[0].TimestampMS != 4000 {
+		t.Errorf("searchMessages() = %+v, want b1 and a2", hits)
+	}
+}
+
+func TestSearchMessagesFTS(t *testing.T) {
+	ctx := context.Background()
+	s := newTestCloudStore(t)
+	// Rows from before the index exists are picked up by the rebuild.
+	seedSearchMessages(t, s)
+	fts, err := s.setupMessageSearch(ctx, true)
+	if err != nil {
+		t.Fatalf("setupMessageSearch() error = %v", err)
+	}
+	if !fts {
+		t.Skip("SQLite built without FTS5 (build with -tags sqlite_fts5)")
+	}
+	if got, want := searchGUIDs(t, s, "friday dinner", ""), []string{"b1", "a2", "a1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("searchMessages() after rebuild = %v, want %v", got, want)
+	}
+
+	// Insert.
+	if err = s.upsertMessageBatch(ctx, []cloudMessageRow{{GUID: "c1", PortalID: "tel:+3", TimestampMS: 7000, Text: "tacos tonight"}}); err != nil {
+		t.Fatalf("upsertMessageBatch() error = %v", err)
+	}
+	if got, want := searchGUIDs(t, s, "tacos", ""), []string{"c1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("searchMessages() after insert = %v, want %v", got, want)
+	}
+
+	// Update: the old text must drop out of the index.
+	if err = s.upsertMessageBatch(ctx, []cloudMessageRow{{GUID: "c1", PortalID: "tel:+3", TimestampMS: 7000, Text: "pizza tonight"}}); err != nil {
+		t.Fatalf("upsertMessageBatch() error = %v", err)
+	}
+	if got := searchGUIDs(t, s, "tacos", ""); got != nil {
+		t.Errorf("searchMessages(old text) after update = %v, want none", got)
+	}
+	if got, want := searchGUIDs(t, s, "pizza", ""), []string{"c1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("searchMessages(new text) after update = %v, want %v", got, want)
+	}
+
+	// Delete.
+	if _, err = s.db.Exec(ctx, `DELETE FROM cloud_message WHERE guid='c1'`); err != nil {
+		t.Fatalf("delete cloud_message: %v", err)
+	}
+	var indexed int
+	if err = s.db.QueryRow(ctx, `SELECT COUNT(*) FROM cloud_message_fts WHERE cloud_message_fts MATCH 'pizza'`).Scan(&indexed); err != nil {
+		t.Fatalf("query cloud_message_fts: %v", err)
+	}
+	if indexed != 0 {
+		t.Errorf("cloud_message_fts matches for deleted row = %d, want 0", indexed)
+	}
+
+	// Turning the option off drops the triggers and goes back to LIKE.
+	if fts, err = s.setupMessageSearch(ctx, false); err != nil || fts {
+		t.Fatalf("setupMessageSearch(false) = %v, %v, want false, nil", fts, err)
+	}
+	if err = s.upsertMessageBatch(ctx, []cloudMessageRow{{GUID: "c2", PortalID: "tel:+3", TimestampMS: 8000, Text: "burritos"}}); err != nil {
+		t.Fatalf("upsertMessageBatch() without index error = %v", err)
+	}
+	if got, want := searchGUIDs(t, s, "burritos", ""), []string{"c2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("searchMessages() without index = %v, want %v", got, want)
+	}
+}
+
+func TestFTSMatchQuery(t *testing.T) {
+	tests := []struct {
+		terms []string
+		want  string
+	}{
+		{[]string{"dinner"}, `"dinner"`},
+		{[]string{"dinner", "fri*"}, `"dinner" "fri*"`},
+		{[]string{`say "hi"`, "OR"}, `"say ""hi""" "OR"`},
+	}
+	for _, tt := range tests {
+		if got := ftsMatchQuery(tt.terms); got != tt.want {
+			t.Errorf("ftsMatchQuery(%q) = %s, want %s", tt.terms, got, tt.want)
+		}
+	}
+}
+
+func TestMessageSnippet(t *testing.T) {
+	tests := []struct {
+		text string
+		n    int
+		want string
+	}{
+		{"short", 10, "short"},
+		{"multi\nline   text", 20, "multi line text"},
+		{"héllo wörld", 6, "héllo…"},
+	}
+	for _, tt := range tests {
+		if got := messageSnippet(tt.text, tt.n); got != tt.want {
+			t.Errorf("messageSnippet(%q, %d) = %q, want %q", tt.text, tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestFormatSearchResults(t *testing.T) {
+	ts := time.Date(2024, 3, 1, 19, 30, 0, 0, time.UTC).UnixMilli()
+	hits := []searchHitView{
+		{messageSearchHit: messageSearchHit{PortalID: "tel:+1", TimestampMS: ts, Sender: "tel:+1", Text: "dinner?"}, ChatName: "Alice", Link: "https://matrix.to/#/!room/$event"},
+		{messageSearchHit: messageSearchHit{PortalID: "tel:+2", TimestampMS: ts, IsFromMe: true, Text: "dinner!"}},
+	}
+	got := formatSearchResults("dinner", hits, true, time.UTC)
+	for _, want := range []string{
+		`**Messages matching "dinner"**`,
+		"1. 2024-03-01 19:30 in Alice — **tel:+1**: dinner? ([jump](https://matrix.to/#/!room/$event))",
+		"2. 2024-03-01 19:30 in tel:+2 — **You**: dinner!\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("formatSearchResults() = %q, want it to contain %q", got, want)
+		}
+	}
+	if got := formatSearchResults("dinner", hits[1:], false, time.UTC); strings.Contains(got, " in ") {
+		t.Errorf("formatSearchResults(in chat) = %q, want no chat names", got)
+	}
+	if got, want := formatSearchResults("x", nil, false, time.UTC), `No messages found for "x".`; got != want {
+		t.Errorf("formatSearchResults(no hits) = %q, want %q", got, want)
+	}
+}
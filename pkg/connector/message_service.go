@@ -0,0 +1,80 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2024 Ludvig Rhodin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+package connector
+
+// Message service in backfill (message_service_in_backfill).
+//
+// A chat can switch between SMS and iMessage over its lifetime, and Apple
+// clients show each message green or blue accordingly. Both backfill
+// sources know the service of every message (cloud_message.service, and
+// the service of the message or its chat in chat.db), but the backfilled
+// events didn't carry it, so history looked all the same. With the option
+// on, each part of a backfilled message gets messageServiceField set to
+// "SMS", "RCS" or "iMessage". Messages whose service isn't known are left
+// without it.
+
+import (
+	"strings"
+
+	"maunium.net/go/mautrix/bridgev2"
+
+	"github.com/lrhodin/imessage/imessage"
+)
+
+// messageServiceField holds the message's service in the event content.
+const messageServiceField = "fi.mau.imessage.service"
+
+// messageServiceName normalizes a service as stored by CloudKit or chat.db,
+// or returns "" if it isn't one messages are sent over.
+func messageServiceName(service string) string {
+	switch {
+	case strings.EqualFold(service, "SMS"):
+		return "SMS"
+	case strings.EqualFold(service, "RCS"):
+		return "RCS"
+	case strings.EqualFold(service, "iMessage"):
+		return "iMessage"
+	default:
+		return ""
+	}
+}
+
+// chatDBMessageService returns the service of a chat.db message: its own,
+// else the sender's handle's, else the one in its chat's GUID.
+func chatDBMessageService(msg *imessage.Message) string {
+	if service := messageServiceName(msg.Service); service != "" {
+		return service
+	}
+	if !msg.IsFromMe {
+		if service := messageServiceName(msg.Sender.Service); service != "" {
+			return service
+		}
+	}
+	return messageServiceName(imessage.ParseIdentifier(msg.ChatGUID).Service)
+}
+
+// markMessageService sets messageServiceField on every part of msgs, unless
+// service is unknown.
+func markMessageService(msgs []*bridgev2.BackfillMessage, service string) {
+	service = messageServiceName(service)
+	if service == "" {
+		return
+	}
+	for _, msg := range msgs {
+		if msg == nil || msg.ConvertedMessage == nil {
+			continue
+		}
+		for _, part := range msg.Parts {
+			if part.Extra == nil {
+				part.Extra = make(map[string]any)
+			}
+			part.Extra[messageServiceField] = service
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package connector
+
+import (
+	"context"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+
+	"github.com/lrhodin/imessage/imessage"
+)
+
+func TestMessageServiceName(t *testing.T) {
+	tests := []struct {
+		service, want string
+	}{
+		{"SMS", "SMS"},
+		{"sms", "SMS"},
+		{"RCS", "RCS"},
+		{"iMessage", "iMessage"},
+		{"imessage", "iMessage"},
+		{"any", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := messageServiceName(tt.service); got != tt.want {
+			t.Errorf("messageServiceName(%q) = %q, want %q", tt.service, got, tt.want)
+		}
+	}
+}
+
+func TestChatDBMessageService(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  imessage.Message
+		want string
+	}{
+		{"own service", imessage.Message{Service: "SMS", ChatGUID: "iMessage;-;+15551111111"}, "SMS"},
+		{"sender's handle", imessage.Message{Sender: imessage.Identifier{Service: "iMessage"}, ChatGUID: "SMS;-;+15551111111"}, "iMessage"},
+		{"from me uses the chat", imessage.Message{IsFromMe: true, Sender: imessage.Identifier{Service: "iMessage"}, ChatGUID: "SMS;-;+15551111111"}, "SMS"},
+		{"unknown", imessage.Message{ChatGUID: "any;-;+15551111111"}, ""},
+	}
+	for _, tt := range tests {
+		if got := chatDBMessageService(&tt.msg); got != tt.want {
+			t.Errorf("chatDBMessageService(%s) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCloudBackfillMessageService(t *testing.T) {
+	newClient := func(enabled bool) *IMClient {
+		return &IMClient{
+			Main:       &IMConnector{Config: IMConfig{MessageServiceInBackfill: enabled}},
+			UserLogin:  &bridgev2.UserLogin{UserLogin: &database.UserLogin{ID: "login"}, Log: zerolog.Nop()},
+			handle:     "tel:+15550000000",
+			allHandles: []string{"tel:+15550000000"},
+		}
+	}
+	row := func(guid, service string) cloudMessageRow {
+		return cloudMessageRow{GUID: guid, PortalID: "tel:+15551111111", Sender: "tel:+15551111111", Text: "hi", HasBody: true, Service: service, TimestampMS: 1000}
+	}
+	tests := []struct {
+		name    string
+		enabled bool
+		row     cloudMessageRow
+		want    any
+	}{
+		{"SMS", true, row("sms", "SMS"), "SMS"},
+		{"iMessage", true, row("imsg", "iMessage"), "iMessage"},
+		{"unknown service", true, row("none", ""), nil},
+		{"option off", false, row("off", "SMS"), nil},
+	}
+	for _, tt := range tests {
+		msgs := newClient(tt.enabled).cloudRowToBackfillMessages(context.Background(), tt.row, "")
+		if len(msgs) != 1 || len(msgs[0].Parts) != 1 {
+			t.Fatalf("cloudRowToBackfillMessages(%s) = %d messages, want 1 with 1 part", tt.name, len(msgs))
+		}
+		if got := msgs[0].Parts[0].Extra[messageServiceField]; got != tt.want {
+			t.Errorf("cloudRowToBackfillMessages(%s) service = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,279 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2024 Ludvig Rhodin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+package connector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"maunium.net/go/mautrix/bridgev2"
+
+	"github.com/lrhodin/imessage/pkg/rustpushgo"
+)
+
+// Connector metrics (metrics_listen).
+//
+// Counters and a send-latency histogram for the connector's traffic, served
+// in the Prometheus text exposition format on their own listener. The
+// handful of metric types needed here are implemented directly rather than
+// through the Prometheus client library, which would be this module's only
+// use of it. All methods are nil-safe, so code paths that run without a
+// connector (tests, the CLI tools) don't need to check for one.
+
+// labeledCounter is a monotonically increasing counter with one label.
+type labeledCounter struct {
+	name, help, label string
+
+	mu     sync.Mutex
+	values map[string]uint64
+}
+
+func (lc *labeledCounter) add(labelValue string, n uint64) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	if lc.values == nil {
+		lc.values = make(map[string]uint64)
+	}
+	lc.values[labelValue] += n
+}
+
+func (lc *labeledCounter) get(labelValue string) uint64 {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	return lc.values[labelValue]
+}
+
+func (lc *labeledCounter) writeTo(w io.Writer) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", lc.name, lc.help, lc.name)
+	keys := make([]string, 0, len(lc.values))
+	for k := range lc.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if lc.label == "" {
+			fmt.Fprintf(w, "%s %d\n", lc.name, lc.values[k])
+		} else {
+			fmt.Fprintf(w, "%s{%s=%q} %d\n", lc.name, lc.label, k, lc.values[k])
+		}
+	}
+}
+
+// histogram is a cumulative-bucket histogram of durations in seconds.
+type histogram struct {
+	name, help string
+	buckets    []float64
+
+	mu     sync.Mutex
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(seconds float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.counts == nil {
+		h.counts = make([]uint64, len(h.buckets))
+	}
+	for i, le := range h.buckets {
+		if seconds <= le {
+			h.counts[i]++
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+func (h *histogram) writeTo(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for i, le := range h.buckets {
+		var n uint64
+		if h.counts != nil {
+			n = h.counts[i]
+		}
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", h.name, le, n)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n%s_sum %g\n%s_count %d\n", h.name, h.count, h.name, h.sum, h.name, h.count)
+}
+
+// connectorMetrics holds every metric the connector exports.
+type connectorMetrics struct {
+	messagesReceived  *labeledCounter
+	messagesSent      *labeledCounter
+	sendErrors        *labeledCounter
+	cloudSyncImported *labeledCounter
+	backfillMessages  *labeledCounter
+	sendDuration      *histogram
+}
+
+func newConnectorMetrics() *connectorMetrics {
+	return &connectorMetrics{
+		messagesReceived:  &labeledCounter{name: "imessage_messages_received_total", help: "Inbound iMessage events by type.", label: "type"},
+		messagesSent:      &labeledCounter{name: "imessage_messages_sent_total", help: "Matrix events sent to iMessage by type.", label: "type"},
+		sendErrors:        &labeledCounter{name: "imessage_send_errors_total", help: "Failed sends to iMessage by reason.", label: "reason"},
+		cloudSyncImported: &labeledCounter{name: "imessage_cloud_sync_imported_total", help: "Records imported by incremental CloudKit sync by kind.", label: "kind"},
+		backfillMessages:  &labeledCounter{name: "imessage_backfill_messages_total", help: "Messages returned to bridgev2 backfill by source.", label: "source"},
+		sendDuration: &histogram{
+			name:    "imessage_send_duration_seconds",
+			help:    "Time to send a Matrix event to iMessage, including failures.",
+			buckets: []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+		},
+	}
+}
+
+func (m *connectorMetrics) messageReceived(msgType string) {
+	if m != nil {
+		m.messagesReceived.add(msgType, 1)
+	}
+}
+
+// sendFinished records one Matrix→iMessage send of msgType that started at
+// start and ended with err.
+func (m *connectorMetrics) sendFinished(msgType string, start time.Time, err error) {
+	if m == nil {
+		return
+	}
+	m.sendDuration.observe(time.Since(start).Seconds())
+	if err != nil {
+		m.sendErrors.add(sendErrorReason(err), 1)
+	} else {
+		m.messagesSent.add(msgType, 1)
+	}
+}
+
+// sendFinished records a Matrix→iMessage send to portal in the metrics and
+// reports a failure to the error notice room.
+func (c *IMClient) sendFinished(msgType string, portal *bridgev2.Portal, start time.Time, err error) {
+	c.Main.metrics.sendFinished(msgType, start, err)
+	if err != nil {
+		c.checkCredentialFailure(err)
+	}
+	if err != nil && portal != nil {
+		c.reportErrorNotice(errorNoticeSendFailed, string(portal.ID), err)
+	}
+}
+
+func (m *connectorMetrics) cloudSyncImportedAdd(kind string, n int) {
+	if m != nil && n > 0 {
+		m.cloudSyncImported.add(kind, uint64(n))
+	}
+}
+
+func (m *connectorMetrics) backfillAdd(source string, n int) {
+	if m != nil && n > 0 {
+		m.backfillMessages.add(source, uint64(n))
+	}
+}
+
+func (m *connectorMetrics) writeTo(w io.Writer) {
+	m.messagesReceived.writeTo(w)
+	m.messagesSent.writeTo(w)
+	m.sendErrors.writeTo(w)
+	m.cloudSyncImported.writeTo(w)
+	m.backfillMessages.writeTo(w)
+	m.sendDuration.writeTo(w)
+}
+
+func (m *connectorMetrics) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.writeTo(w)
+}
+
+// sendErrorReason buckets a send error into a low-cardinality label.
+func sendErrorReason(err error) string {
+	switch {
+	case errors.Is(err, bridgev2.ErrNotLoggedIn):
+		return "not_logged_in"
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+		return "timeout"
+	case isNoValidTargetsError(err):
+		return "no_valid_targets"
+	case errors.Is(err, bridgev2.ErrMediaTooLarge), strings.Contains(err.Error(), "too large"):
+		return "too_large"
+	case errors.Is(err, bridgev2.ErrUnsupportedMessageType):
+		return "unsupported"
+	default:
+		return "other"
+	}
+}
+
+// inboundMessageType classifies an APNs message for messages_received_total,
+// following the order OnMessage dispatches in.
+func inboundMessageType(msg *rustpushgo.WrappedMessage) string {
+	switch {
+	case msg.IsDelivered:
+		return "delivery_receipt"
+	case msg.IsReadReceipt:
+		return "read_receipt"
+	case msg.IsTyping || msg.IsTypingStop:
+		return "typing"
+	case msg.IsError:
+		return "error"
+	case msg.IsPeerCacheInvalidate:
+		return "peer_cache_invalidate"
+	case msg.IsSmsActivation != nil:
+		return "sms_activation"
+	case msg.IsMoveToRecycleBin || msg.IsPermanentDelete:
+		return "chat_delete"
+	case msg.IsRecoverChat:
+		return "chat_recover"
+	case msg.IsUnsend:
+		return "unsend"
+	case msg.IsRename, msg.IsParticipantChange, msg.IsIconChange:
+		return "group_change"
+	case msg.IsNotifyAnyways:
+		return "notify_anyway"
+	case msg.IsTapback:
+		return "tapback"
+	case msg.IsEdit:
+		return "edit"
+	case msg.IsShareProfile || msg.IsUpdateProfile || msg.IsUpdateProfileSharing:
+		if msg.Text == nil {
+			return "profile"
+		}
+		return "message"
+	case isContentlessMessage(msg):
+		return "control"
+	default:
+		return "message"
+	}
+}
+
+// startMetricsServer serves the connector metrics at /metrics on addr.
+func (c *IMConnector) startMetricsServer(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", c.metrics)
+	log := c.Bridge.Log.With().Str("component", "metrics").Logger()
+	log.Info().Str("listen", addr).Msg("Serving connector metrics")
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Err(err).Msg("Metrics listener stopped")
+		}
+	}()
+}
+
+// backfillSource labels FetchMessages results by the backend serving them.
+func (c *IMClient) backfillSource() string {
+	if c.Main.Config.UseChatDBBackfill() && c.chatDB != nil {
+		return "chatdb"
+	}
+	return "cloudkit"
+}
@@ -0,0 +1,124 @@
+package connector
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridgev2"
+
+	"github.com/lrhodin/imessage/pkg/rustpushgo"
+)
+
+func TestOnMessageCountsReceivedType(t *testing.T) {
+	c := &IMClient{
+		Main:      &IMConnector{metrics: newConnectorMetrics()},
+		UserLogin: &bridgev2.UserLogin{Log: zerolog.Nop()},
+	}
+	c.OnMessage(rustpushgo.WrappedMessage{Uuid: "A", IsPeerCacheInvalidate: true})
+	c.OnMessage(rustpushgo.WrappedMessage{Uuid: "B", IsPeerCacheInvalidate: true})
+	c.OnMessage(rustpushgo.WrappedMessage{Uuid: "C", IsError: true})
+
+	received := c.Main.metrics.messagesReceived
+	if got := received.get("peer_cache_invalidate"); got != 2 {
+		t.Errorf("messages_received_total{type=peer_cache_invalidate} = %d, want 2", got)
+	}
+	if got := received.get("error"); got != 1 {
+		t.Errorf("messages_received_total{type=error} = %d, want 1", got)
+	}
+	if got := received.get("message"); got != 0 {
+		t.Errorf("messages_received_total{type=message} = %d, want 0", got)
+	}
+}
+
+func TestInboundMessageType(t *testing.T) {
+	text := "hi"
+	smsActivation := true
+	tests := []struct {
+		name string
+		msg  rustpushgo.WrappedMessage
+		want string
+	}{
+		{"text message", rustpushgo.WrappedMessage{Text: &text}, "message"},
+		{"delivery receipt", rustpushgo.WrappedMessage{IsDelivered: true}, "delivery_receipt"},
+		{"read receipt", rustpushgo.WrappedMessage{IsReadReceipt: true}, "read_receipt"},
+		{"typing stop", rustpushgo.WrappedMessage{IsTypingStop: true}, "typing"},
+		{"sms activation", rustpushgo.WrappedMessage{IsSmsActivation: &smsActivation}, "sms_activation"},
+		{"recycle bin", rustpushgo.WrappedMessage{IsMoveToRecycleBin: true}, "chat_delete"},
+		{"unsend", rustpushgo.WrappedMessage{IsUnsend: true}, "unsend"},
+		{"rename", rustpushgo.WrappedMessage{IsRename: true}, "group_change"},
+		{"tapback", rustpushgo.WrappedMessage{IsTapback: true}, "tapback"},
+		{"edit", rustpushgo.WrappedMessage{IsEdit: true}, "edit"},
+		{"standalone profile share", rustpushgo.WrappedMessage{IsShareProfile: true}, "profile"},
+		{"text with embedded profile", rustpushgo.WrappedMessage{IsShareProfile: true, Text: &text}, "message"},
+		{"mark unread", rustpushgo.WrappedMessage{IsMarkUnread: true}, "control"},
+		{"unmapped control message", rustpushgo.WrappedMessage{Uuid: "A"}, "control"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := inboundMessageType(&tt.msg); got != tt.want {
+				t.Errorf("inboundMessageType() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSendErrorReason(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"not logged in", bridgev2.ErrNotLoggedIn, "not_logged_in"},
+		{"wrapped deadline", fmt.Errorf("send: %w", context.DeadlineExceeded), "timeout"},
+		{"no valid targets", errors.New("SendError: NoValidTargets"), "no_valid_targets"},
+		{"attachment too large", errors.New("attachment too large: 120 MB"), "too_large"},
+		{"anything else", errors.New("boom"), "other"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sendErrorReason(tt.err); got != tt.want {
+				t.Errorf("sendErrorReason(%v) = %q, want %q", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConnectorMetricsExposition(t *testing.T) {
+	m := newConnectorMetrics()
+	m.messageReceived("tapback")
+	m.sendFinished("message", time.Now(), nil)
+	m.sendFinished("message", time.Now(), bridgev2.ErrNotLoggedIn)
+	m.cloudSyncImportedAdd("message", 3)
+	m.backfillAdd("cloudkit", 0)
+
+	var buf bytes.Buffer
+	m.writeTo(&buf)
+	out := buf.String()
+	for _, want := range []string{
+		"# TYPE imessage_messages_received_total counter\n",
+		"imessage_messages_received_total{type=\"tapback\"} 1\n",
+		"imessage_messages_sent_total{type=\"message\"} 1\n",
+		"imessage_send_errors_total{reason=\"not_logged_in\"} 1\n",
+		"imessage_cloud_sync_imported_total{kind=\"message\"} 3\n",
+		"imessage_send_duration_seconds_bucket{le=\"+Inf\"} 2\n",
+		"imessage_send_duration_seconds_count 2\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("exposition missing %q", want)
+		}
+	}
+	if strings.Contains(out, "imessage_backfill_messages_total{") {
+		t.Errorf("exposition has a backfill sample after adding 0")
+	}
+
+	// A connector without metrics must not panic.
+	var nilMetrics *connectorMetrics
+	nilMetrics.messageReceived("message")
+	nilMetrics.sendFinished("message", time.Now(), nil)
+}
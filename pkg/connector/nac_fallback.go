@@ -0,0 +1,150 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2024 Ludvig Rhodin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+package connector
+
+// NAC relay fallback during login (nac_relay_fallback_url).
+//
+// IDS registration at the end of login needs NAC validation data: the
+// Apple ID flow makes it with the local Mac's AAAbsintheContext, the
+// External Key flow with the NAC emulator or the relay named in the key.
+// When that fails, the login used to end with rustpush's raw error and
+// nothing to try. With a fallback relay configured, a registration error
+// that is about NAC offers to register through that relay instead. The
+// External Key flow asks to confirm and registers once with a copy of its
+// key pointed at the relay; the stored key keeps its own relay. The Apple
+// ID flow asks for the hardware key of the Mac running the relay, since
+// validation data is tied to the Mac it's made on. That key carries the
+// Mac's device identity too, so the sign-in starts over with it and the
+// login then keeps using it like an External Key login. Other errors, or
+// NAC errors without a fallback relay, end the login as before.
+//
+// Flow:
+//   Finish() fails with a NAC error, fallback relay set
+//     → External Key: confirm → key copy pointed at the fallback → Finish()
+//     → Apple ID: paste the relay Mac's hardware key → sign in again with
+//       its config → Finish()
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"maunium.net/go/mautrix/bridgev2"
+)
+
+// nacFailureMarkers are what NAC validation errors from rustpush and
+// open-absinthe say.
+var nacFailureMarkers = []string{
+	"nac relay",
+	"nac validation",
+	"nac error",
+	"validation data",
+	"validationctx",
+	"absinthe",
+}
+
+// nacFailureError is a registration error that is a failure to make NAC
+// validation data, rather than e.g. Apple rejecting the account.
+type nacFailureError struct {
+	err error
+}
+
+func (e *nacFailureError) Error() string { return e.err.Error() }
+func (e *nacFailureError) Unwrap() error { return e.err }
+
+// classifyRegistrationError wraps err in a nacFailureError if it's about
+// NAC. rustpush errors only reach Go as a WrappedError message, so this
+// reads it once, where Finish fails; everything after checks the type.
+func classifyRegistrationError(err error) error {
+	if err == nil {
+		return nil
+	}
+	msg := strings.ToLower(err.Error())
+	for _, marker := range nacFailureMarkers {
+		if strings.Contains(msg, marker) {
+			return &nacFailureError{err: err}
+		}
+	}
+	return err
+}
+
+// hardwareKeyRelayURL returns the NAC relay URL in a hardware key, or "" if
+// it has none or can't be read.
+func hardwareKeyRelayURL(hardwareKey string) string {
+	decoded, err := base64.StdEncoding.DecodeString(stripNonBase64(hardwareKey))
+	if err != nil {
+		return ""
+	}
+	var fields struct {
+		NACRelayURL string `json:"nac_relay_url"`
+	}
+	if json.Unmarshal(decoded, &fields) != nil {
+		return ""
+	}
+	return fields.NACRelayURL
+}
+
+// relayFallbackKey validates a hardware key and points it at relayURL.
+func relayFallbackKey(hardwareKey, relayURL string) (string, error) {
+	key, err := validateHardwareKey(hardwareKey)
+	if err != nil {
+		return "", err
+	}
+	return hardwareKeyWithRelayURL(key, relayURL)
+}
+
+// nacRelayFallbackStep returns the step offering to register through
+// relayURL after registrationErr, or nil if there's nothing to offer: the
+// error isn't about NAC, no fallback relay is configured, or hardwareKey
+// already uses it. An empty hardwareKey (Apple ID flow) asks for the key of
+// the Mac running the relay.
+func nacRelayFallbackStep(registrationErr error, relayURL, hardwareKey string) *bridgev2.LoginStep {
+	var nacErr *nacFailureError
+	if relayURL == "" || !errors.As(registrationErr, &nacErr) {
+		return nil
+	}
+	instructions := fmt.Sprintf("Registration failed because NAC validation data couldn't be generated:\n%v\n\n", registrationErr)
+	if hardwareKey == "" {
+		return &bridgev2.LoginStep{
+			Type:   bridgev2.LoginStepTypeUserInput,
+			StepID: LoginStepNACRelayFallback,
+			Instructions: instructions +
+				fmt.Sprintf("The bridge can register through the NAC relay at %s instead. ", relayURL) +
+				"Paste the hardware key extracted from the Mac running that relay (see tools/nac-relay). " +
+				"The relay must stay reachable whenever the bridge re-registers.",
+			UserInputParams: &bridgev2.LoginUserInputParams{
+				Fields: []bridgev2.LoginInputDataField{{
+					Type: bridgev2.LoginInputFieldTypePassword,
+					ID:   "nac_fallback_hardware_key",
+					Name: "Hardware Key of the relay Mac (base64)",
+				}},
+			},
+		}
+	}
+	if hardwareKeyRelayURL(hardwareKey) == relayURL {
+		return nil
+	}
+	return &bridgev2.LoginStep{
+		Type:   bridgev2.LoginStepTypeUserInput,
+		StepID: LoginStepNACRelayFallback,
+		Instructions: instructions +
+			fmt.Sprintf("Retry registration through the NAC relay at %s? ", relayURL) +
+			"It must be running on the Mac this hardware key was extracted from.",
+		UserInputParams: &bridgev2.LoginUserInputParams{
+			Fields: []bridgev2.LoginInputDataField{{
+				Type:    bridgev2.LoginInputFieldTypeSelect,
+				ID:      "nac_relay_fallback",
+				Name:    "Use the NAC relay",
+				Options: []string{"yes", "no"},
+			}},
+		},
+	}
+}
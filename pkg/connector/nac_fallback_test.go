@@ -0,0 +1,105 @@
+package connector
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestClassifyRegistrationError(t *testing.T) {
+	tests := []struct {
+		err     error
+		wantNAC bool
+	}{
+		{errors.New("NAC relay request failed: connection refused"), true},
+		{errors.New("RelayError(502, \"NAC relay error: bad gateway\")"), true},
+		{fmt.Errorf("login completion failed: %w", errors.New("failed to generate validation data")), true},
+		{errors.New("AbsintheError: ValidationCtx init returned -44023"), true},
+		{errors.New("AuthError(-20101, \"Incorrect Apple ID or password\")"), false},
+		{errors.New("Keystore error Key not found"), false},
+		{errors.New("financial report attached"), false},
+	}
+	for _, tt := range tests {
+		got := classifyRegistrationError(tt.err)
+		var nacErr *nacFailureError
+		if isNAC := errors.As(got, &nacErr); isNAC != tt.wantNAC {
+			t.Errorf("classifyRegistrationError(%v) is NAC failure = %v, want %v", tt.err, isNAC, tt.wantNAC)
+		}
+		if !errors.Is(got, tt.err) {
+			t.Errorf("classifyRegistrationError(%v) = %v, want it to wrap the original error", tt.err, got)
+		}
+	}
+	if got := classifyRegistrationError(nil); got != nil {
+		t.Errorf("classifyRegistrationError(nil) = %v, want nil", got)
+	}
+}
+
+func testHardwareKey(t *testing.T, relayURL string) string {
+	t.Helper()
+	fields := map[string]any{"inner": map[string]any{"serial": "C02XYZ"}}
+	if relayURL != "" {
+		fields["nac_relay_url"] = relayURL
+	}
+	raw, err := json.Marshal(fields)
+	if err != nil {
+		t.Fatalf("json.Marshal() error = %v", err)
+	}
+	return base64.StdEncoding.EncodeToString(raw)
+}
+
+func TestNACRelayFallbackStep(t *testing.T) {
+	const relayURL = "https://192.168.1.5:5001/validation-data"
+	rawErr := errors.New("NAC relay request failed: connection refused")
+	nacErr := classifyRegistrationError(rawErr)
+	tests := []struct {
+		name        string
+		err         error
+		relayURL    string
+		hardwareKey string
+		wantField   string // "" means no offer
+	}{
+		{"not a NAC error", classifyRegistrationError(errors.New("AuthError(-20101)")), relayURL, "", ""},
+		{"unclassified error", rawErr, relayURL, "", ""},
+		{"no fallback relay", nacErr, "", "", ""},
+		{"Apple ID login asks for a key", nacErr, relayURL, "", "nac_fallback_hardware_key"},
+		{"External Key login asks to confirm", nacErr, relayURL, testHardwareKey(t, ""), "nac_relay_fallback"},
+		{"key on another relay", nacErr, relayURL, testHardwareKey(t, "https://192.168.1.9:5001/validation-data"), "nac_relay_fallback"},
+		{"key already on the fallback relay", nacErr, relayURL, testHardwareKey(t, relayURL), ""},
+	}
+	for _, tt := range tests {
+		step := nacRelayFallbackStep(tt.err, tt.relayURL, tt.hardwareKey)
+		if tt.wantField == "" {
+			if step != nil {
+				t.Errorf("nacRelayFallbackStep(%s) = %+v, want no offer", tt.name, step)
+			}
+			continue
+		}
+		if step == nil {
+			t.Errorf("nacRelayFallbackStep(%s) = nil, want an offer", tt.name)
+			continue
+		}
+		if step.StepID != LoginStepNACRelayFallback || len(step.UserInputParams.Fields) != 1 || step.UserInputParams.Fields[0].ID != tt.wantField {
+			t.Errorf("nacRelayFallbackStep(%s) = %+v, want step %s asking for %s", tt.name, step, LoginStepNACRelayFallback, tt.wantField)
+		}
+		if !strings.Contains(step.Instructions, relayURL) || !strings.Contains(step.Instructions, nacErr.Error()) {
+			t.Errorf("nacRelayFallbackStep(%s) instructions = %q, want the relay URL and the error", tt.name, step.Instructions)
+		}
+	}
+}
+
+func TestRelayFallbackKey(t *testing.T) {
+	const relayURL = "https://192.168.1.5:5001/validation-data"
+	key, err := relayFallbackKey(" "+testHardwareKey(t, "https://old:5001/validation-data")+"\n", relayURL)
+	if err != nil {
+		t.Fatalf("relayFallbackKey() error = %v", err)
+	}
+	if got := hardwareKeyRelayURL(key); got != relayURL {
+		t.Errorf("relayFallbackKey() relay URL = %q, want %q", got, relayURL)
+	}
+	if _, err = relayFallbackKey("not a key!", relayURL); err == nil {
+		t.Errorf("relayFallbackKey(invalid) error = nil, want an error")
+	}
+}
@@ -0,0 +1,157 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2024 Ludvig Rhodin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+package connector
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+
+	"github.com/lrhodin/imessage/pkg/rustpushgo"
+)
+
+// Echoes of the user's own messages (outbound_echo_window_seconds).
+//
+// Apple delivers every message the user sends to all of their devices, the
+// bridge included, so handleMessage sees two kinds of from-me messages:
+//
+//   - sent from another device (iPhone, Mac): bridged exactly once, as the
+//     user. makeEventSender attributes them to the login (fromMeEventSender),
+//     which bridgev2 sends through the double puppet; ensureDoublePuppet
+//     retries a double puppet that failed to set up, since otherwise the
+//     message would fall back to a ghost for the user's own handle and
+//     render as received.
+//   - sent by the bridge from Matrix: already in the room. The bridge DB
+//     lookup in handleMessage drops these once bridgev2 has stored the sent
+//     message, but the echo can beat that: SendMessage returns the UUID
+//     before HandleMatrixMessage's response has been saved. The UUIDs of
+//     messages sent from Matrix are remembered for the window, so such an
+//     echo is dropped instead of being bridged a second time. A long
+//     message split into several iMessages only has a bridge DB row for
+//     its first part; the UUIDs of the others are written to cloud_message
+//     when they're sent (rememberSentMessagePart), and an echo found there
+//     by hasSentMessageUUID is dropped.
+//
+// Tapbacks work the same way. One added from another device is bridged as
+// a reaction from the user. The UUIDs of tapbacks sent from Matrix are
+// remembered and persisted like sent messages, so their echo is dropped.
+// An own tapback that is already the user's reaction on the target is
+// dropped too. bridgev2 only drops a duplicate when the key matches exactly,
+// so without this the Matrix key ("❤") being echoed back as the tapback's
+// emoji ("❤️") would replace the reaction.
+
+// fromMeEventSender is the sender of a message the user sent, from any of
+// their devices.
+func fromMeEventSender(loginID networkid.UserLoginID, handle string) bridgev2.EventSender {
+	return bridgev2.EventSender{
+		IsFromMe:    true,
+		SenderLogin: loginID,
+		Sender:      makeUserID(handle),
+	}
+}
+
+// ownReactionSenderID is the SenderID reactions sent from Matrix are stored
+// under. The user's tapbacks from other devices are attributed to c.handle
+// (makeEventSender) whatever handle the portal sends from, so reactions are
+// too: dedup (ownTapbackBridged) and removal from another device look them
+// up by that sender.
+func (c *IMClient) ownReactionSenderID() networkid.UserID {
+	return makeUserID(c.handle)
+}
+
+// outboundEchoKey keys a sent UUID; UUIDs are compared case-insensitively.
+func outboundEchoKey(uuid string) string {
+	return "sent|" + strings.ToUpper(uuid)
+}
+
+// outboundEchoWindow returns how long sent UUIDs are remembered, or zero
+// when echo detection is disabled.
+func (c *IMClient) outboundEchoWindow() time.Duration {
+	secs := c.Main.Config.OutboundEchoWindowSeconds
+	if secs <= 0 {
+		return 0
+	}
+	return time.Duration(secs) * time.Second
+}
+
+// rememberOutboundSend records the UUID of a message sent from Matrix.
+func (c *IMClient) rememberOutboundSend(uuid string) {
+	if uuid == "" {
+		return
+	}
+	c.recentOutboundSends.record(outboundEchoKey(uuid), time.Now(), c.outboundEchoWindow())
+}
+
+// rememberSentMessagePart records the UUID of one iMessage sent for a
+// Matrix message that has no bridge DB row of its own (the follow-up parts
+// of a long message), in memory for the echo window and in cloud_message
+// so echo detection works even if the portal is deleted before the APNs
+// echo arrives.
+func (c *IMClient) rememberSentMessagePart(ctx context.Context, portal *bridgev2.Portal, uuid string) {
+	if uuid == "" {
+		return
+	}
+	c.rememberOutboundSend(uuid)
+	if c.cloudStore == nil {
+		return
+	}
+	if err := c.cloudStore.persistMessageUUID(ctx, uuid, string(portal.ID), time.Now().UnixMilli(), true); err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Str("uuid", uuid).Msg("Failed to persist sent message UUID; echo may be delivered as duplicate")
+	}
+}
+
+// isSplitPartEcho reports whether msg is the user's own message and is one
+// of the follow-up parts of a long message sent from Matrix. Those parts
+// have no bridge DB row, so the exact-ID lookup in handleMessage misses them
+// once the echo window has passed; rememberSentMessagePart recorded their
+// UUIDs in cloud_message, where hasSentMessageUUID finds them.
+func (c *IMClient) isSplitPartEcho(ctx context.Context, msg *rustpushgo.WrappedMessage) bool {
+	if msg.Uuid == "" || msg.Sender == nil || !c.isMyHandle(*msg.Sender) || c.cloudStore == nil {
+		return false
+	}
+	sent, _ := c.cloudStore.hasSentMessageUUID(ctx, msg.Uuid)
+	return sent
+}
+
+// isOutboundEcho reports whether msg is the user's own message carrying the
+// UUID of a message recently sent from Matrix.
+func (c *IMClient) isOutboundEcho(msg *rustpushgo.WrappedMessage) bool {
+	if msg.Uuid == "" || msg.Sender == nil || !c.isMyHandle(*msg.Sender) {
+		return false
+	}
+	return c.recentOutboundSends.seenWithin(outboundEchoKey(msg.Uuid), time.Now(), c.outboundEchoWindow())
+}
+
+// rememberSentTapback records the UUID of a tapback sent from Matrix, in
+// memory for the echo window and in cloud_message so a later re-delivery
+// is caught by hasMessageUUID.
+func (c *IMClient) rememberSentTapback(ctx context.Context, portal *bridgev2.Portal, uuid string, tapbackType uint32, remove bool) {
+	if uuid == "" {
+		return
+	}
+	c.rememberOutboundSend(uuid)
+	if c.cloudStore == nil {
+		return
+	}
+	err := c.cloudStore.persistTapbackUUID(ctx, uuid, string(portal.ID), time.Now().UnixMilli(), true, storedTapbackType(tapbackType, remove))
+	if err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Str("uuid", uuid).Msg("Failed to persist sent tapback UUID; echo may be bridged again")
+	}
+}
+
+// ownTapbackBridged reports whether emoji is already the user's reaction on
+// the target, compared as tapbacks (see sameTapback).
+func (c *IMClient) ownTapbackBridged(portalKey networkid.PortalKey, targetID networkid.MessageID, senderID networkid.UserID, emoji string) bool {
+	existing, err := c.Main.Bridge.DB.Reaction.GetByIDWithoutMessagePart(context.Background(), portalKey.Receiver, targetID, senderID, "")
+	return err == nil && existing != nil && sameTapback(existing.Emoji, emoji)
+}
@@ -0,0 +1,274 @@
+package connector
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/event"
+
+	"github.com/lrhodin/imessage/pkg/rustpushgo"
+)
+
+func TestIsOutboundEcho(t *testing.T) {
+	c := &IMClient{
+		Main:       &IMConnector{Config: IMConfig{OutboundEchoWindowSeconds: 300}},
+		UserLogin:  &bridgev2.UserLogin{Log: zerolog.Nop()},
+		allHandles: []string{"tel:+15550000000", "mailto:me@icloud.com"},
+	}
+	c.rememberOutboundSend("AAAA-1111")
+
+	me := "mailto:Me@iCloud.com"
+	other := "tel:+15551234567"
+	tests := []struct {
+		name   string
+		uuid   string
+		sender *string
+		want   bool
+	}{
+		{"echo of a Matrix send", "AAAA-1111", &me, true},
+		{"echo with lowercase UUID", "aaaa-1111", &me, true},
+		{"sent from another device", "BBBB-2222", &me, false},
+		{"same UUID from someone else", "AAAA-1111", &other, false},
+		{"no sender", "AAAA-1111", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := &rustpushgo.WrappedMessage{Uuid: tt.uuid, Sender: tt.sender}
+			if got := c.isOutboundEcho(msg); got != tt.want {
+				t.Errorf("isOutboundEcho() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	disabled := &IMClient{Main: &IMConnector{}, allHandles: c.allHandles}
+	disabled.rememberOutboundSend("AAAA-1111")
+	if disabled.isOutboundEcho(&rustpushgo.WrappedMessage{Uuid: "AAAA-1111", Sender: &me}) {
+		t.Errorf("isOutboundEcho() with outbound_echo_window_seconds 0 = true, want false")
+	}
+}
+
+func TestFromMeEventSender(t *testing.T) {
+	got := fromMeEventSender("login", "tel:+15550000000")
+	want := bridgev2.EventSender{IsFromMe: true, SenderLogin: "login", Sender: "tel:+15550000000"}
+	if got != want {
+		t.Errorf("fromMeEventSender() = %+v, want %+v", got, want)
+	}
+}
+
+func TestStoredTapbackType(t *testing.T) {
+	tests := []struct {
+		typ    uint32
+		remove bool
+		want   uint32
+	}{
+		{0, false, 2000},
+		{6, false, 2006},
+		{0, true, 3000},
+		{5, true, 3005},
+	}
+	for _, tt := range tests {
+		if got := storedTapbackType(tt.typ, tt.remove); got != tt.want {
+			t.Errorf("storedTapbackType(%d, %v) = %d, want %d", tt.typ, tt.remove, got, tt.want)
+		}
+	}
+}
+
+func TestRememberSentTapback(t *testing.T) {
+	ctx := context.Background()
+	c := &IMClient{
+		Main:       &IMConnector{Config: IMConfig{OutboundEchoWindowSeconds: 300}},
+		UserLogin:  &bridgev2.UserLogin{Log: zerolog.Nop()},
+		allHandles: []string{"tel:+15550000000"},
+		cloudStore: newTestCloudStore(t),
+	}
+	portal := &bridgev2.Portal{Portal: &database.Portal{PortalKey: networkid.PortalKey{ID: "tel:+15551234567"}}}
+	c.rememberSentTapback(ctx, portal, "TAPBACK-1", 1, false)
+	c.rememberSentTapback(ctx, portal, "", 1, false)
+
+	me := "tel:+15550000000"
+	if !c.isOutboundEcho(&rustpushgo.WrappedMessage{Uuid: "TAPBACK-1", Sender: &me}) {
+		t.Errorf("isOutboundEcho() for a sent tapback = false, want true")
+	}
+	if known, err := c.cloudStore.hasMessageUUID(ctx, "TAPBACK-1"); err != nil || !known {
+		t.Errorf("hasMessageUUID() for a sent tapback = %v, %v, want true", known, err)
+	}
+	var portalID string
+	var isFromMe bool
+	var tapbackType uint32
+	err := c.cloudStore.db.QueryRow(ctx, `SELECT portal_id, is_from_me, tapback_type FROM cloud_message WHERE guid='TAPBACK-1'`).Scan(&portalID, &isFromMe, &tapbackType)
+	if err != nil {
+		t.Fatalf("query cloud_message: %v", err)
+	}
+	if portalID != "tel:+15551234567" || !isFromMe || tapbackType != 2001 {
+		t.Errorf("stored tapback = %s, %v, %d, want tel:+15551234567, true, 2001", portalID, isFromMe, tapbackType)
+	}
+}
+
+func TestOwnTapbackBridged(t *testing.T) {
+	ctx := context.Background()
+	db := newTestBridgeDB(t)
+	c := &IMClient{Main: &IMConnector{Bridge: &bridgev2.Bridge{DB: db}}, handle: "tel:+15550000000"}
+	portalKey := networkid.PortalKey{ID: "tel:+15551234567", Receiver: "login"}
+	// Tapbacks from other devices are attributed the same way as the
+	// reactions HandleMatrixReaction stores.
+	me := fromMeEventSender("login", c.handle).Sender
+	const other networkid.UserID = "tel:+15551234567"
+	if err := db.Portal.Insert(ctx, &database.Portal{PortalKey: portalKey, MXID: "!dm:example.com"}); err != nil {
+		t.Fatalf("Portal.Insert() error = %v", err)
+	}
+	for _, ghost := range []networkid.UserID{me, other} {
+		if err := db.Ghost.Insert(ctx, &database.Ghost{ID: ghost}); err != nil {
+			t.Fatalf("Ghost.Insert() error = %v", err)
+		}
+	}
+	if err := db.Message.Insert(ctx, &database.Message{ID: "MSG", Room: portalKey, SenderID: other, MXID: "$msg"}); err != nil {
+		t.Fatalf("Message.Insert() error = %v", err)
+	}
+	if c.ownTapbackBridged(portalKey, "MSG", me, "❤️") {
+		t.Errorf("ownTapbackBridged() with no reaction = true, want false")
+	}
+
+	// A heart sent from Matrix without VS16.
+	err := db.Reaction.Upsert(ctx, &database.Reaction{Room: portalKey, MessageID: "MSG", SenderID: me, MXID: "$react", Emoji: "❤"})
+	if err != nil {
+		t.Fatalf("Reaction.Upsert() error = %v", err)
+	}
+	tests := []struct {
+		name   string
+		sender networkid.UserID
+		emoji  string
+		want   bool
+	}{
+		{"echo as the tapback's emoji", me, "❤️", true},
+		{"same key", me, "❤", true},
+		{"changed from another device", me, "👍", false},
+		{"someone else's heart", other, "❤️", false},
+	}
+	for _, tt := range tests {
+		if got := c.ownTapbackBridged(portalKey, "MSG", tt.sender, tt.emoji); got != tt.want {
+			t.Errorf("ownTapbackBridged(%s) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestOwnReactionSenderWithSendHandle(t *testing.T) {
+	ctx := context.Background()
+	db := newTestBridgeDB(t)
+	c := &IMClient{
+		Main:       &IMConnector{Bridge: &bridgev2.Bridge{DB: db}},
+		handle:     "tel:+15550000000",
+		allHandles: []string{"tel:+15550000000", "mailto:me@icloud.com"},
+	}
+	portalKey := networkid.PortalKey{ID: "tel:+15551234567", Receiver: "login"}
+	portal := &bridgev2.Portal{Portal: &database.Portal{
+		PortalKey: portalKey,
+		MXID:      "!dm:example.com",
+		Metadata:  &PortalMetadata{SendHandle: "mailto:me@icloud.com"},
+	}}
+	if got := c.portalHandle(portal); got != "mailto:me@icloud.com" {
+		t.Fatalf("portalHandle() = %q, want the override", got)
+	}
+	if err := db.Portal.Insert(ctx, portal.Portal); err != nil {
+		t.Fatalf("Portal.Insert() error = %v", err)
+	}
+	const other networkid.UserID = "tel:+15551234567"
+	// Own tapbacks from other devices, whichever handle they come from.
+	inbound := fromMeEventSender("login", c.handle).Sender
+	for _, ghost := range []networkid.UserID{inbound, other} {
+		if err := db.Ghost.Insert(ctx, &database.Ghost{ID: ghost}); err != nil {
+			t.Fatalf("Ghost.Insert() error = %v", err)
+		}
+	}
+	if err := db.Message.Insert(ctx, &database.Message{ID: "MSG", Room: portalKey, SenderID: other, MXID: "$msg"}); err != nil {
+		t.Fatalf("Message.Insert() error = %v", err)
+	}
+
+	pre, err := c.PreHandleMatrixReaction(ctx, &bridgev2.MatrixReaction{MatrixEventBase: bridgev2.MatrixEventBase[*event.ReactionEventContent]{
+		Portal:  portal,
+		Content: &event.ReactionEventContent{RelatesTo: event.RelatesTo{Key: "❤️"}},
+	}})
+	if err != nil {
+		t.Fatalf("PreHandleMatrixReaction() error = %v", err)
+	}
+	if pre.SenderID != inbound {
+		t.Errorf("PreHandleMatrixReaction() sender = %q, want %q", pre.SenderID, inbound)
+	}
+	err = db.Reaction.Upsert(ctx, &database.Reaction{Room: portalKey, MessageID: "MSG", SenderID: pre.SenderID, MXID: "$react", Emoji: "❤️"})
+	if err != nil {
+		t.Fatalf("Reaction.Upsert() error = %v", err)
+	}
+
+	// The echo of the same tapback from another device isn't bridged again.
+	if !c.ownTapbackBridged(portalKey, "MSG", inbound, "❤️") {
+		t.Errorf("ownTapbackBridged() for the reaction sent from Matrix = false, want true")
+	}
+	// Removing it on another device finds the reaction sent from Matrix.
+	existing, err := db.Reaction.GetByIDWithoutMessagePart(ctx, portalKey.Receiver, "MSG", inbound, "")
+	if err != nil || existing == nil || existing.MXID != "$react" {
+		t.Errorf("reaction lookup for a removal from another device = %+v, %v, want $react", existing, err)
+	}
+}
+
+func TestRememberSentMessagePart(t *testing.T) {
+	ctx := context.Background()
+	c := &IMClient{
+		Main:       &IMConnector{Config: IMConfig{OutboundEchoWindowSeconds: 300}},
+		UserLogin:  &bridgev2.UserLogin{Log: zerolog.Nop()},
+		allHandles: []string{"tel:+15550000000"},
+		cloudStore: newTestCloudStore(t),
+	}
+	portal := &bridgev2.Portal{Portal: &database.Portal{PortalKey: networkid.PortalKey{ID: "tel:+15551234567"}}}
+	c.rememberSentMessagePart(ctx, portal, "PART-2")
+
+	me := "tel:+15550000000"
+	if !c.isOutboundEcho(&rustpushgo.WrappedMessage{Uuid: "PART-2", Sender: &me}) {
+		t.Errorf("isOutboundEcho() for a long message part = false, want true")
+	}
+	if known, err := c.cloudStore.hasMessageUUID(ctx, "PART-2"); err != nil || !known {
+		t.Errorf("hasMessageUUID() for a long message part = %v, %v, want true", known, err)
+	}
+}
+
+func TestIsSplitPartEcho(t *testing.T) {
+	ctx := context.Background()
+	c := &IMClient{
+		Main:       &IMConnector{},
+		UserLogin:  &bridgev2.UserLogin{Log: zerolog.Nop()},
+		allHandles: []string{"tel:+15550000000"},
+		cloudStore: newTestCloudStore(t),
+	}
+	portal := &bridgev2.Portal{Portal: &database.Portal{PortalKey: networkid.PortalKey{ID: "tel:+15551234567"}}}
+	c.rememberSentMessagePart(ctx, portal, "PART-2")
+	c.rememberSentMessagePart(ctx, portal, "PART-3")
+	if err := c.cloudStore.persistMessageUUID(ctx, "INBOUND-1", string(portal.ID), time.Now().UnixMilli(), false); err != nil {
+		t.Fatalf("persistMessageUUID() error = %v", err)
+	}
+
+	me := "tel:+15550000000"
+	other := "tel:+15551234567"
+	tests := []struct {
+		name   string
+		uuid   string
+		sender *string
+		want   bool
+	}{
+		{"second part", "PART-2", &me, true},
+		{"last part", "PART-3", &me, true},
+		{"unrelated message", "PART-4", &me, false},
+		{"received message", "INBOUND-1", &me, false},
+		{"same UUID from someone else", "PART-2", &other, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := &rustpushgo.WrappedMessage{Uuid: tt.uuid, Sender: tt.sender}
+			if got := c.isSplitPartEcho(ctx, msg); got != tt.want {
+				t.Errorf("isSplitPartEcho() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
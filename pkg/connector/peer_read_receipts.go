@@ -0,0 +1,192 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2024 Ludvig Rhodin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+package connector
+
+// Contacts with read receipts off (peer_read_receipts_notice).
+//
+// iMessage doesn't say whether a contact sends read receipts: with them
+// off, the receipts simply never come, and "read" never shows up on
+// messages sent to them with no hint why. Apple doesn't expose the setting
+// over IDS either, so the bridge infers it. A contact who replies after a
+// message to them was delivered has seen it; with read receipts on, a read
+// receipt comes first. After peerReadReceiptsOffReplies such replies in a
+// row without one, a one-time notice in the DM explains that the missing
+// read receipts are expected. A read receipt from them resets the count
+// and re-arms the notice.
+//
+// Flow:
+//   handleDeliveryReceipt → awaiting a read receipt
+//   handleReadReceipt     → streak reset (notice re-armed)
+//   handleMessage reply while awaiting → streak+1, notice at the threshold
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/event"
+)
+
+// peerReadReceiptsOffReplies is how many replies in a row to delivered but
+// unread messages it takes to conclude a contact has read receipts off.
+const peerReadReceiptsOffReplies = 3
+
+// peerReceiptState is what's known about one DM's incoming read receipts.
+type peerReceiptState struct {
+	// awaitingRead is set when a message to the contact was delivered and
+	// no read receipt has come since.
+	awaitingRead bool
+	// unreadReplies counts replies in a row that came while awaitingRead.
+	unreadReplies int
+	// readSeen is set once a read receipt came in this session.
+	readSeen bool
+}
+
+// peerReceiptTracker holds peerReceiptState by DM portal. The zero value is
+// ready to use.
+type peerReceiptTracker struct {
+	mu    sync.Mutex
+	peers map[networkid.PortalID]*peerReceiptState
+}
+
+func (t *peerReceiptTracker) get(portalID networkid.PortalID) *peerReceiptState {
+	if t.peers == nil {
+		t.peers = make(map[networkid.PortalID]*peerReceiptState)
+	}
+	state, ok := t.peers[portalID]
+	if !ok {
+		state = &peerReceiptState{}
+		t.peers[portalID] = state
+	}
+	return state
+}
+
+// delivered records that a message to the contact was delivered.
+func (t *peerReceiptTracker) delivered(portalID networkid.PortalID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.get(portalID).awaitingRead = true
+}
+
+// read records a read receipt from the contact. It returns true for the
+// first one this session, when a notice sent before a restart may need
+// re-arming.
+func (t *peerReceiptTracker) read(portalID networkid.PortalID) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	state := t.get(portalID)
+	first := !state.readSeen
+	state.readSeen = true
+	state.awaitingRead = false
+	state.unreadReplies = 0
+	return first
+}
+
+// replied records a message from the contact. It returns true when this
+// reply makes peerReadReceiptsOffReplies in a row without a read receipt.
+func (t *peerReceiptTracker) replied(portalID networkid.PortalID) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	state := t.get(portalID)
+	if !state.awaitingRead {
+		return false
+	}
+	state.awaitingRead = false
+	state.unreadReplies++
+	return state.unreadReplies == peerReadReceiptsOffReplies
+}
+
+// tracksPeerReadReceipts reports whether receipts in a portal count
+// towards the notice. Group chats don't get read receipts on iMessage.
+func (c *IMClient) tracksPeerReadReceipts(portalKey networkid.PortalKey) bool {
+	return c.Main.Config.PeerReadReceiptsNotice && portalKey.ID != "" && !isGroupPortalID(string(portalKey.ID))
+}
+
+// notePeerDelivered is called for a delivery receipt of a message we sent.
+func (c *IMClient) notePeerDelivered(portalKey networkid.PortalKey) {
+	if c.tracksPeerReadReceipts(portalKey) {
+		c.peerReceipts.delivered(portalKey.ID)
+	}
+}
+
+// notePeerRead is called for a read receipt from the contact. The first one
+// in a portal this session clears a notice sent earlier, so it's sent again
+// if the contact turns read receipts off later.
+func (c *IMClient) notePeerRead(log zerolog.Logger, portalKey networkid.PortalKey) {
+	if !c.tracksPeerReadReceipts(portalKey) || !c.peerReceipts.read(portalKey.ID) {
+		return
+	}
+	ctx := log.WithContext(context.Background())
+	portal, err := c.Main.Bridge.GetExistingPortalByKey(ctx, portalKey)
+	if err != nil || portal == nil {
+		return
+	}
+	meta, ok := portal.Metadata.(*PortalMetadata)
+	if !ok || !meta.ReadReceiptsOffNoticeSent {
+		return
+	}
+	meta.ReadReceiptsOffNoticeSent = false
+	if err := portal.Save(ctx); err != nil {
+		log.Warn().Err(err).Str("portal_id", string(portalKey.ID)).Msg("Failed to save portal after read receipts came back")
+		return
+	}
+	log.Info().Str("portal_id", string(portalKey.ID)).Msg("Contact sends read receipts again")
+}
+
+// notePeerReply is called for a live message from the contact. Replies while
+// read receipts are being dropped (sync, stored messages) don't count, since
+// the read receipt before them may have been dropped too.
+func (c *IMClient) notePeerReply(log zerolog.Logger, portalKey networkid.PortalKey, isStored bool) {
+	if !c.tracksPeerReadReceipts(portalKey) || isStored ||
+		!c.isCloudSyncDone() || atomic.LoadInt64(&c.apnsBufferFlushedAt) == 0 {
+		return
+	}
+	if !c.peerReceipts.replied(portalKey.ID) {
+		return
+	}
+	ctx := log.WithContext(context.Background())
+	portal, err := c.Main.Bridge.GetExistingPortalByKey(ctx, portalKey)
+	if err != nil || portal == nil || portal.MXID == "" {
+		return
+	}
+	c.sendReadReceiptsOffNotice(ctx, portal)
+}
+
+// sendReadReceiptsOffNotice tells the user once per portal that the
+// contact seems to have read receipts off.
+func (c *IMClient) sendReadReceiptsOffNotice(ctx context.Context, portal *bridgev2.Portal) {
+	log := zerolog.Ctx(ctx).With().Str("portal_id", string(portal.ID)).Logger()
+	meta, ok := portal.Metadata.(*PortalMetadata)
+	if !ok {
+		meta = &PortalMetadata{}
+	}
+	if meta.ReadReceiptsOffNoticeSent {
+		return
+	}
+	_, err := c.Main.Bridge.Bot.SendMessage(ctx, portal.MXID, event.EventMessage, &event.Content{
+		Parsed: &event.MessageEventContent{
+			MsgType:  event.MsgNotice,
+			Body:     "This contact seems to have read receipts turned off: they've replied to your messages without sending any. Your messages will show as delivered, but not as read.",
+			Mentions: &event.Mentions{},
+		},
+	}, nil)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to send read receipts notice")
+		return
+	}
+	meta.ReadReceiptsOffNoticeSent = true
+	portal.Metadata = meta
+	if err := portal.Save(ctx); err != nil {
+		log.Warn().Err(err).Msg("Failed to save portal after read receipts notice")
+	}
+	log.Info().Msg("Contact seems to have read receipts off, sent notice")
+}
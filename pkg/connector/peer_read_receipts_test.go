@@ -0,0 +1,80 @@
+package connector
+
+import (
+	"testing"
+
+	"maunium.net/go/mautrix/bridgev2/networkid"
+)
+
+func TestPeerReceiptTracker(t *testing.T) {
+	const portal = networkid.PortalID("tel:+15551234567")
+	tests := []struct {
+		name       string
+		events     string // d = delivered, r = read receipt, m = reply
+		wantNotice int    // index of the reply that triggers the notice, -1 for none
+	}{
+		{"read receipts off", "dmdmdm", 5},
+		{"read receipts on", "drmdrmdrm", -1},
+		{"replies without delivered messages", "mmmm", -1},
+		{"several replies to one message", "dmmmm", -1},
+		{"read receipt resets the streak", "dmdmdrmdm", -1},
+		{"off again after a read receipt", "drmdmdmdm", 8},
+		{"notice only once per streak", "dmdmdmdmdm", 5},
+	}
+	for _, tt := range tests {
+		var tracker peerReceiptTracker
+		got := -1
+		for i, ev := range tt.events {
+			switch ev {
+			case 'd':
+				tracker.delivered(portal)
+			case 'r':
+				tracker.read(portal)
+			case 'm':
+				if tracker.replied(portal) {
+					if got != -1 {
+						t.Errorf("replied(%s) triggered the notice again at %d", tt.name, i)
+					}
+					got = i
+				}
+			}
+		}
+		if got != tt.wantNotice {
+			t.Errorf("replied(%s) triggered the notice at %d, want %d", tt.name, got, tt.wantNotice)
+		}
+	}
+}
+
+func TestPeerReceiptTrackerFirstRead(t *testing.T) {
+	var tracker peerReceiptTracker
+	if !tracker.read("tel:+15551234567") {
+		t.Errorf("read() = false for the first read receipt, want true")
+	}
+	if tracker.read("tel:+15551234567") {
+		t.Errorf("read() = true for the second read receipt, want false")
+	}
+	if !tracker.read("mailto:bob@example.com") {
+		t.Errorf("read() = false for another portal's first read receipt, want true")
+	}
+}
+
+func TestTracksPeerReadReceipts(t *testing.T) {
+	tests := []struct {
+		portalID networkid.PortalID
+		enabled  bool
+		want     bool
+	}{
+		{"tel:+15551234567", true, true},
+		{"mailto:bob@example.com", true, true},
+		{"gid:12345678-abcd", true, false},
+		{"tel:+15551234567,tel:+15557654321", true, false},
+		{"", true, false},
+		{"tel:+15551234567", false, false},
+	}
+	for _, tt := range tests {
+		c := &IMClient{Main: &IMConnector{Config: IMConfig{PeerReadReceiptsNotice: tt.enabled}}}
+		if got := c.tracksPeerReadReceipts(networkid.PortalKey{ID: tt.portalID}); got != tt.want {
+			t.Errorf("tracksPeerReadReceipts(%q, enabled %v) = %v, want %v", tt.portalID, tt.enabled, got, tt.want)
+		}
+	}
+}
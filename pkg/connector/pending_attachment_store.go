@@ -27,6 +27,13 @@ import (
 // the rustpush download (which re-runs Layer 1 with a freshly reloaded APS
 // connection) and falling back to CloudKit if the MMCS URL has expired.
 // On success the retrier edits the placeholder into the real m.image/m.video.
+//
+// The same table also holds attachments that downloaded fine but whose
+// Matrix upload failed (failed_upload_retry_attempts). Those rows keep the
+// downloaded bytes, so the retry doesn't depend on MMCS or CloudKit still
+// having the file, and carry their own max_attempts. Small files go in
+// inline_data; larger ones are spilled to a file named by data_path (see
+// failed_upload.go).
 
 // pendingAttachmentRow is a single row in pending_attachment_retry — one per
 // MMCS attachment whose push-time download failed and needs background
@@ -43,7 +50,10 @@ type pendingAttachmentRow struct {
 	MimeType       string
 	UtiType        string
 	SizeBytes      int64
-	MmcsDescriptor string // JSON (see MmcsDescriptor in lib.rs)
+	MmcsDescriptor string // JSON (see MmcsDescriptor in lib.rs); empty if the download succeeded
+	InlineData     []byte // retained bytes of an attachment whose upload failed
+	DataPath       string // file holding the retained bytes when they're too big for InlineData
+	MaxAttempts    int    // 0 means attachmentRetrierMaxAttempts
 	CreatedAt      time.Time
 	LastAttemptAt  time.Time // zero value means "never retried"
 	AttemptCount   int
@@ -77,6 +87,9 @@ func (s *pendingAttachmentStore) ensureSchema(ctx context.Context) error {
 		last_attempt_at   BIGINT  NOT NULL,
 		attempt_count     INTEGER NOT NULL DEFAULT 0,
 		next_attempt_at   BIGINT  NOT NULL,
+		inline_data       BYTEA,
+		max_attempts      INTEGER NOT NULL DEFAULT 0,
+		data_path         TEXT    NOT NULL DEFAULT '',
 		PRIMARY KEY (login_id, message_guid, att_index)
 	)`); err != nil {
 		return fmt.Errorf("failed to create pending_attachment_retry table: %w", err)
@@ -85,6 +98,13 @@ func (s *pendingAttachmentStore) ensureSchema(ctx context.Context) error {
 		ON pending_attachment_retry (login_id, next_attempt_at)`); err != nil {
 		return fmt.Errorf("failed to create pending_attachment_retry due idx: %w", err)
 	}
+	if err := migrateTableColumns(ctx, s.db, "pending_attachment_retry", []struct{ name, def string }{
+		{"inline_data", "BYTEA"},
+		{"max_attempts", "INTEGER NOT NULL DEFAULT 0"},
+		{"data_path", "TEXT NOT NULL DEFAULT ''"},
+	}); err != nil {
+		return fmt.Errorf("failed to migrate pending_attachment_retry: %w", err)
+	}
 	return nil
 }
 
@@ -99,14 +119,16 @@ func (s *pendingAttachmentStore) Insert(ctx context.Context, row *pendingAttachm
 			login_id, message_guid, att_index, att_id, portal_id,
 			sender, timestamp_ms,
 			filename, mime_type, uti_type, size_bytes, mmcs_descriptor,
-			created_at, last_attempt_at, attempt_count, next_attempt_at
-		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16)
+			created_at, last_attempt_at, attempt_count, next_attempt_at,
+			inline_data, max_attempts, data_path
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19)
 		ON CONFLICT (login_id, message_guid, att_index) DO NOTHING`,
 		s.loginID, row.MessageGUID, row.AttIndex, row.AttID, row.PortalID,
 		row.Sender, row.TimestampMs,
 		row.Filename, row.MimeType, row.UtiType, row.SizeBytes, row.MmcsDescriptor,
 		row.CreatedAt.UnixMilli(), row.LastAttemptAt.UnixMilli(),
 		row.AttemptCount, row.NextAttemptAt.UnixMilli(),
+		row.InlineData, row.MaxAttempts, row.DataPath,
 	)
 	return err
 }
@@ -117,7 +139,8 @@ func (s *pendingAttachmentStore) GetDue(ctx context.Context, now time.Time, limi
 		SELECT login_id, message_guid, att_index, att_id, portal_id,
 		       sender, timestamp_ms,
 		       filename, mime_type, uti_type, size_bytes, mmcs_descriptor,
-		       created_at, last_attempt_at, attempt_count, next_attempt_at
+		       created_at, last_attempt_at, attempt_count, next_attempt_at,
+		       inline_data, max_attempts, data_path
 		FROM pending_attachment_retry
 		WHERE login_id = $1 AND next_attempt_at <= $2
 		ORDER BY next_attempt_at ASC
@@ -151,23 +174,40 @@ func (s *pendingAttachmentStore) UpdateSchedule(ctx context.Context, row *pendin
 	return err
 }
 
-// Delete removes a row after success or final give-up.
+// Delete removes a row after success or final give-up, along with the
+// file its retained bytes were spilled to.
 func (s *pendingAttachmentStore) Delete(ctx context.Context, row *pendingAttachmentRow) error {
 	_, err := s.db.Exec(ctx, `
 		DELETE FROM pending_attachment_retry
 		WHERE login_id = $1 AND message_guid = $2 AND att_index = $3`,
 		s.loginID, row.MessageGUID, row.AttIndex,
 	)
+	if err == nil {
+		row.discardRetainedData()
+	}
 	return err
 }
 
+// Count returns how many rows are queued and how many of them are due
+// at now.
+func (s *pendingAttachmentStore) Count(ctx context.Context, now time.Time) (total, due int, err error) {
+	err = s.db.QueryRow(ctx, `
+		SELECT COUNT(*), COALESCE(SUM(CASE WHEN next_attempt_at <= $2 THEN 1 ELSE 0 END), 0)
+		FROM pending_attachment_retry
+		WHERE login_id = $1`,
+		s.loginID, now.UnixMilli(),
+	).Scan(&total, &due)
+	return
+}
+
 // GetOne is useful for manual inspection/debug.
 func (s *pendingAttachmentStore) GetOne(ctx context.Context, msgGUID string, attIndex int) (*pendingAttachmentRow, error) {
 	row := s.db.QueryRow(ctx, `
 		SELECT login_id, message_guid, att_index, att_id, portal_id,
 		       sender, timestamp_ms,
 		       filename, mime_type, uti_type, size_bytes, mmcs_descriptor,
-		       created_at, last_attempt_at, attempt_count, next_attempt_at
+		       created_at, last_attempt_at, attempt_count, next_attempt_at,
+		       inline_data, max_attempts, data_path
 		FROM pending_attachment_retry
 		WHERE login_id = $1 AND message_guid = $2 AND att_index = $3`,
 		s.loginID, msgGUID, attIndex,
@@ -192,6 +232,7 @@ func scanPendingAttachmentRow(sc scannable) (*pendingAttachmentRow, error) {
 		&r.Sender, &r.TimestampMs,
 		&r.Filename, &r.MimeType, &r.UtiType, &r.SizeBytes, &r.MmcsDescriptor,
 		&createdMs, &lastMs, &r.AttemptCount, &nextMs,
+		&r.InlineData, &r.MaxAttempts, &r.DataPath,
 	); err != nil {
 		return nil, err
 	}
@@ -202,3 +243,11 @@ func scanPendingAttachmentRow(sc scannable) (*pendingAttachmentRow, error) {
 	r.NextAttemptAt = time.UnixMilli(nextMs)
 	return r, nil
 }
+
+// maxAttempts is the number of attempts after which the retrier gives up.
+func (r *pendingAttachmentRow) maxAttempts() int {
+	if r.MaxAttempts > 0 {
+		return r.MaxAttempts
+	}
+	return attachmentRetrierMaxAttempts
+}
@@ -0,0 +1,185 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2024 Ludvig Rhodin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+package connector
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/simplevent"
+	"maunium.net/go/mautrix/event"
+
+	"github.com/lrhodin/imessage/imessage"
+)
+
+// Pinned conversations → m.favourite.
+//
+// Messages on the Mac lists the user's pinned conversations (see
+// imessage.PinnedChatsAPI); the chat.db backend mirrors them as the
+// m.favourite room tag: at initial sync, when portals are created, and on a
+// periodic re-read that also covers portals created later by live messages.
+// PortalMetadata.Pinned remembers what the bridge last applied, so unpinning
+// only removes a favourite the bridge set — rooms the user favourited by
+// hand in their Matrix client are left alone. Pins aren't exposed through
+// CloudKit, so the CloudKit backend doesn't sync them.
+
+// pinnedChatSyncInterval is how often the pin list is re-read from the Mac.
+const pinnedChatSyncInterval = 5 * time.Minute
+
+// pinnedRoomTag decides the room tag update for a portal: m.favourite when
+// it's pinned, a tag removal when it was pinned by us and no longer is, and
+// nil (leave the room's tags alone) otherwise.
+func pinnedRoomTag(pinned, wasPinned bool) *event.RoomTag {
+	if pinned {
+		tag := event.RoomTagFavourite
+		return &tag
+	}
+	if wasPinned {
+		var untag event.RoomTag
+		return &untag
+	}
+	return nil
+}
+
+// chatGUIDsPinned reports whether any of a portal's chat GUIDs is pinned.
+// GUIDs are compared case-insensitively: chat.db keeps email handles in
+// whatever case they were first seen in.
+func chatGUIDsPinned(guids []string, pinned map[string]bool) bool {
+	for _, guid := range guids {
+		if pinned[strings.ToLower(guid)] {
+			return true
+		}
+	}
+	return false
+}
+
+// pinnedChatGUIDs returns the set of pinned chat GUIDs (lowercased). ok is
+// false when this platform can't read pins or the read failed, in which case
+// callers must not touch any tags.
+func (db *chatDB) pinnedChatGUIDs(log zerolog.Logger) (pinned map[string]bool, ok bool) {
+	pinAPI, supported := db.api.(imessage.PinnedChatsAPI)
+	if !supported {
+		return nil, false
+	}
+	guids, err := pinAPI.GetPinnedChatGUIDs()
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to read pinned conversations")
+		return nil, false
+	}
+	pinned = make(map[string]bool, len(guids))
+	for _, guid := range guids {
+		pinned[strings.ToLower(guid)] = true
+	}
+	return pinned, true
+}
+
+// portalChatDBGUIDs returns the chat.db GUIDs a portal may correspond to.
+func (c *IMClient) portalChatDBGUIDs(portalID string) []string {
+	if strings.HasPrefix(portalID, "gid:") || strings.Contains(portalID, ",") {
+		if guid := c.chatDB.findGroupChatGUID(portalID, c); guid != "" {
+			return []string{guid}
+		}
+		return nil
+	}
+	return portalIDToChatGUIDs(portalID)
+}
+
+// applyPinnedTag adds the pin state to chatInfo: the room tag decided by
+// pinnedRoomTag, and an ExtraUpdates step that records it in
+// PortalMetadata.Pinned. Returns false if there was nothing to change.
+func applyPinnedTag(chatInfo *bridgev2.ChatInfo, pinned, wasPinned bool) bool {
+	tag := pinnedRoomTag(pinned, wasPinned)
+	if tag == nil {
+		return false
+	}
+	if chatInfo.UserLocal == nil {
+		chatInfo.UserLocal = &bridgev2.UserLocalPortalInfo{}
+	}
+	chatInfo.UserLocal.Tag = tag
+	prev := chatInfo.ExtraUpdates
+	chatInfo.ExtraUpdates = func(ctx context.Context, p *bridgev2.Portal) bool {
+		changed := false
+		if prev != nil {
+			changed = prev(ctx, p)
+		}
+		meta, ok := p.Metadata.(*PortalMetadata)
+		if !ok {
+			meta = &PortalMetadata{}
+		}
+		if meta.Pinned != pinned {
+			meta.Pinned = pinned
+			p.Metadata = meta
+			changed = true
+		}
+		return changed
+	}
+	return true
+}
+
+// syncPinnedChats compares the Mac's pin list with every bridged portal and
+// queues a ChatInfoChange for each portal whose pin state changed.
+func (c *IMClient) syncPinnedChats(ctx context.Context, log zerolog.Logger) {
+	pinned, ok := c.chatDB.pinnedChatGUIDs(log)
+	if !ok {
+		return
+	}
+	portals, err := c.Main.Bridge.GetAllPortalsWithMXID(ctx)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to list portals for pin sync")
+		return
+	}
+	for _, portal := range portals {
+		if portal.Receiver != c.UserLogin.ID {
+			continue
+		}
+		wasPinned := false
+		if meta, ok := portal.Metadata.(*PortalMetadata); ok {
+			wasPinned = meta.Pinned
+		}
+		isPinned := chatGUIDsPinned(c.portalChatDBGUIDs(string(portal.ID)), pinned)
+		if isPinned == wasPinned {
+			continue
+		}
+		chatInfo := &bridgev2.ChatInfo{}
+		if !applyPinnedTag(chatInfo, isPinned, wasPinned) {
+			continue
+		}
+		log.Debug().Str("portal_id", string(portal.ID)).Bool("pinned", isPinned).Msg("Conversation pin changed")
+		c.Main.Bridge.QueueRemoteEvent(c.UserLogin, &simplevent.ChatInfoChange{
+			EventMeta: simplevent.EventMeta{
+				Type:      bridgev2.RemoteEventChatInfoChange,
+				PortalKey: portal.PortalKey,
+				Sender:    bridgev2.EventSender{IsFromMe: true, SenderLogin: c.UserLogin.ID},
+				Timestamp: time.Now(),
+			},
+			ChatInfoChange: &bridgev2.ChatInfoChange{ChatInfo: chatInfo},
+		})
+	}
+}
+
+// periodicPinnedChatSync re-reads the pin list every pinnedChatSyncInterval.
+func (c *IMClient) periodicPinnedChatSync(log zerolog.Logger) {
+	log = log.With().Str("component", "pinned_chat_sync").Logger()
+	ctx := log.WithContext(context.Background())
+	ticker := time.NewTicker(pinnedChatSyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if c.chatDB != nil {
+				c.syncPinnedChats(ctx, log)
+			}
+		case <-c.stopChan:
+			return
+		}
+	}
+}
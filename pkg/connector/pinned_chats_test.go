@@ -0,0 +1,123 @@
+package connector
+
+import (
+	"context"
+	"testing"
+
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/event"
+)
+
+func TestPinnedRoomTag(t *testing.T) {
+	tests := []struct {
+		name      string
+		pinned    bool
+		wasPinned bool
+		wantNil   bool
+		wantTag   event.RoomTag
+	}{
+		{"newly pinned", true, false, false, event.RoomTagFavourite},
+		{"still pinned", true, true, false, event.RoomTagFavourite},
+		{"unpinned", false, true, false, ""},
+		{"never pinned", false, false, true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := pinnedRoomTag(tt.pinned, tt.wasPinned)
+			if tt.wantNil {
+				if got != nil {
+					t.Errorf("pinnedRoomTag(%v, %v) = %q, want nil", tt.pinned, tt.wasPinned, *got)
+				}
+				return
+			}
+			if got == nil {
+				t.Fatalf("pinnedRoomTag(%v, %v) = nil, want %q", tt.pinned, tt.wasPinned, tt.wantTag)
+			}
+			if *got != tt.wantTag {
+				t.Errorf("pinnedRoomTag(%v, %v) = %q, want %q", tt.pinned, tt.wasPinned, *got, tt.wantTag)
+			}
+		})
+	}
+}
+
+func TestChatGUIDsPinned(t *testing.T) {
+	pinned := map[string]bool{
+		"imessage;-;+15551234567":      true,
+		"imessage;-;alice@example.com": true,
+	}
+	tests := []struct {
+		name  string
+		guids []string
+		want  bool
+	}{
+		{"pinned DM", []string{"iMessage;-;+15551234567", "SMS;-;+15551234567"}, true},
+		{"pinned DM via SMS GUID only", []string{"SMS;-;+15551234567"}, false},
+		{"case-insensitive email", []string{"iMessage;-;Alice@Example.com"}, true},
+		{"not pinned", []string{"iMessage;-;+15559876543"}, false},
+		{"no GUIDs", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := chatGUIDsPinned(tt.guids, pinned); got != tt.want {
+				t.Errorf("chatGUIDsPinned(%v) = %v, want %v", tt.guids, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyPinnedTag(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("never pinned leaves chat info alone", func(t *testing.T) {
+		chatInfo := &bridgev2.ChatInfo{}
+		if applyPinnedTag(chatInfo, false, false) {
+			t.Errorf("applyPinnedTag(false, false) = true, want false")
+		}
+		if chatInfo.UserLocal != nil || chatInfo.ExtraUpdates != nil {
+			t.Errorf("applyPinnedTag(false, false) modified chat info")
+		}
+	})
+
+	t.Run("pin records metadata and keeps earlier updates", func(t *testing.T) {
+		earlierRan := false
+		chatInfo := &bridgev2.ChatInfo{
+			ExtraUpdates: func(ctx context.Context, p *bridgev2.Portal) bool {
+				earlierRan = true
+				return false
+			},
+		}
+		if !applyPinnedTag(chatInfo, true, false) {
+			t.Fatalf("applyPinnedTag(true, false) = false, want true")
+		}
+		if chatInfo.UserLocal == nil || chatInfo.UserLocal.Tag == nil || *chatInfo.UserLocal.Tag != event.RoomTagFavourite {
+			t.Fatalf("applyPinnedTag(true, false) UserLocal = %+v, want m.favourite tag", chatInfo.UserLocal)
+		}
+		portal := &bridgev2.Portal{Portal: &database.Portal{Metadata: &PortalMetadata{IsSms: true}}}
+		if !chatInfo.ExtraUpdates(ctx, portal) {
+			t.Errorf("ExtraUpdates() = false on first pin, want true")
+		}
+		if !earlierRan {
+			t.Errorf("ExtraUpdates() skipped the previously set updater")
+		}
+		meta := portal.Metadata.(*PortalMetadata)
+		if !meta.Pinned || !meta.IsSms {
+			t.Errorf("metadata after pin = %+v, want Pinned and IsSms set", meta)
+		}
+		if chatInfo.ExtraUpdates(ctx, portal) {
+			t.Errorf("ExtraUpdates() = true when already pinned, want false")
+		}
+	})
+
+	t.Run("unpin clears metadata", func(t *testing.T) {
+		chatInfo := &bridgev2.ChatInfo{}
+		if !applyPinnedTag(chatInfo, false, true) {
+			t.Fatalf("applyPinnedTag(false, true) = false, want true")
+		}
+		portal := &bridgev2.Portal{Portal: &database.Portal{Metadata: &PortalMetadata{Pinned: true}}}
+		chatInfo.ExtraUpdates(ctx, portal)
+		if portal.Metadata.(*PortalMetadata).Pinned {
+			t.Errorf("metadata after unpin has Pinned = true, want false")
+		}
+	})
+}
@@ -0,0 +1,72 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2024 Ludvig Rhodin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+package connector
+
+// Portal auto-join (auto_join_portals).
+//
+// The user's own entry in a portal's member list decides how they end up
+// in the room: with join membership, bridgev2 invites them and joins
+// through their double puppet; with invite membership, they only get the
+// invite and accept it themselves. Joining is the default, so a large
+// initial sync doesn't leave hundreds of pending invites. The allow and
+// deny lists narrow it down per chat, and anything filtered out (or every
+// portal, with auto_join_portals off) is left as an invite. Without double
+// puppeting, the user is only ever invited.
+
+import (
+	"strings"
+
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/event"
+)
+
+// autoJoinFilterMatches reports whether any entry names the portal: a
+// handle matching a DM's portal ID, a gid: portal ID, or a group's name.
+func autoJoinFilterMatches(entries []string, portalID, groupName string) bool {
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if portalID != "" && normalizeIdentifierForPortalID(entry) == portalID {
+			return true
+		}
+		if groupName != "" && strings.EqualFold(entry, strings.TrimSpace(groupName)) {
+			return true
+		}
+	}
+	return false
+}
+
+// shouldAutoJoin reports whether the user should join the portal through
+// their double puppet rather than just be invited. The deny list wins over
+// the allow list; an empty allow list allows every chat.
+func (c *IMConfig) shouldAutoJoin(portalID, groupName string) bool {
+	if !c.AutoJoinPortals || autoJoinFilterMatches(c.AutoJoinDeny, portalID, groupName) {
+		return false
+	}
+	return len(c.AutoJoinAllow) == 0 || autoJoinFilterMatches(c.AutoJoinAllow, portalID, groupName)
+}
+
+// applyAutoJoin turns the user's own member entry into an invite for a
+// portal they shouldn't auto-join. The invite is only sent while they're
+// out of the room, so once they've accepted it, later resyncs leave them
+// joined rather than inviting them again.
+func (c *IMClient) applyAutoJoin(members *bridgev2.ChatMemberList, portalID, groupName string) {
+	if members == nil || c.Main.Config.shouldAutoJoin(portalID, groupName) {
+		return
+	}
+	for userID, member := range members.MemberMap {
+		if member.IsFromMe {
+			member.Membership = event.MembershipInvite
+			member.PrevMembership = event.MembershipLeave
+			members.MemberMap[userID] = member
+		}
+	}
+}
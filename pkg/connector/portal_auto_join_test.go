@@ -0,0 +1,67 @@
+package connector
+
+import (
+	"testing"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/event"
+)
+
+func TestShouldAutoJoin(t *testing.T) {
+	tests := []struct {
+		name      string
+		cfg       IMConfig
+		portalID  string
+		groupName string
+		want      bool
+	}{
+		{"disabled", IMConfig{AutoJoinPortals: false}, "tel:+15551234567", "", false},
+		{"no filters", IMConfig{AutoJoinPortals: true}, "tel:+15551234567", "", true},
+		{"denied handle", IMConfig{AutoJoinPortals: true, AutoJoinDeny: []string{"+15551234567"}}, "tel:+15551234567", "", false},
+		{"denied email is case-insensitive", IMConfig{AutoJoinPortals: true, AutoJoinDeny: []string{"Friend@Example.com"}}, "mailto:friend@example.com", "", false},
+		{"other handle denied", IMConfig{AutoJoinPortals: true, AutoJoinDeny: []string{"+15559999999"}}, "tel:+15551234567", "", true},
+		{"not on allow list", IMConfig{AutoJoinPortals: true, AutoJoinAllow: []string{"+15559999999"}}, "tel:+15551234567", "", false},
+		{"allowed handle", IMConfig{AutoJoinPortals: true, AutoJoinAllow: []string{"tel:+15551234567"}}, "tel:+15551234567", "", true},
+		{"allowed group portal ID", IMConfig{AutoJoinPortals: true, AutoJoinAllow: []string{"gid:abc-123"}}, "gid:abc-123", "Family", true},
+		{"allowed group name", IMConfig{AutoJoinPortals: true, AutoJoinAllow: []string{"family"}}, "gid:abc-123", "Family", true},
+		{"deny wins over allow", IMConfig{AutoJoinPortals: true, AutoJoinAllow: []string{"Family"}, AutoJoinDeny: []string{"gid:abc-123"}}, "gid:abc-123", "Family", false},
+		{"blank entries ignored", IMConfig{AutoJoinPortals: true, AutoJoinDeny: []string{" "}}, "gid:abc-123", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.cfg.shouldAutoJoin(tt.portalID, tt.groupName); got != tt.want {
+				t.Errorf("shouldAutoJoin(%q, %q) = %v, want %v", tt.portalID, tt.groupName, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyAutoJoin(t *testing.T) {
+	newMembers := func() *bridgev2.ChatMemberList {
+		return &bridgev2.ChatMemberList{MemberMap: map[networkid.UserID]bridgev2.ChatMember{
+			"tel:+15550000000": {EventSender: bridgev2.EventSender{IsFromMe: true, Sender: "tel:+15550000000"}, Membership: event.MembershipJoin},
+			"tel:+15551234567": {EventSender: bridgev2.EventSender{Sender: "tel:+15551234567"}, Membership: event.MembershipJoin},
+		}}
+	}
+	c := &IMClient{
+		Main:      &IMConnector{Config: IMConfig{AutoJoinPortals: true, AutoJoinDeny: []string{"+15551234567"}}},
+		UserLogin: &bridgev2.UserLogin{Log: zerolog.Nop()},
+	}
+
+	allowed := newMembers()
+	c.applyAutoJoin(allowed, "tel:+15559999999", "")
+	if self := allowed.MemberMap["tel:+15550000000"]; self.Membership != event.MembershipJoin || self.PrevMembership != "" {
+		t.Errorf("allowed portal: self = %s (prev %q), want join", self.Membership, self.PrevMembership)
+	}
+
+	denied := newMembers()
+	c.applyAutoJoin(denied, "tel:+15551234567", "")
+	if self := denied.MemberMap["tel:+15550000000"]; self.Membership != event.MembershipInvite || self.PrevMembership != event.MembershipLeave {
+		t.Errorf("denied portal: self = %s (prev %q), want invite from leave", self.Membership, self.PrevMembership)
+	}
+	if other := denied.MemberMap["tel:+15551234567"]; other.Membership != event.MembershipJoin {
+		t.Errorf("denied portal: other member = %s, want join", other.Membership)
+	}
+}
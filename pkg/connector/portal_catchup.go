@@ -0,0 +1,132 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2024 Ludvig Rhodin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+package connector
+
+// Portal catch-up (portal_catchup_minutes).
+//
+// Messages that reached Apple while the bridge was down and never arrived
+// live end up in cloud_message once CloudKit sync catches up, but an
+// existing room only backfills when it's created or recovered, so they
+// would never be bridged. Activity in a room from Matrix (a read receipt,
+// typing, a message) therefore compares the newest message CloudKit knows
+// of for the portal with the newest one bridged to it. If CloudKit has
+// newer ones, a ChatResync runs a forward backfill anchored at the newest
+// bridged message, and FetchMessages pages forward from there. Each portal
+// is checked at most once per interval; the state lives in memory, so the
+// first activity after a restart always checks.
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/simplevent"
+)
+
+// portalCatchUpState records when each portal was last checked. The zero
+// value is ready to use.
+type portalCatchUpState struct {
+	mu          sync.Mutex
+	lastChecked map[string]time.Time
+}
+
+// due reports whether portalID hasn't been checked within interval, and if
+// so records now as its latest check.
+func (s *portalCatchUpState) due(portalID string, now time.Time, interval time.Duration) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if last, ok := s.lastChecked[portalID]; ok && now.Sub(last) < interval {
+		return false
+	}
+	if s.lastChecked == nil {
+		s.lastChecked = make(map[string]time.Time)
+	}
+	s.lastChecked[portalID] = now
+	return true
+}
+
+// catchUpWindow selects the messages a catch-up fetches: those after the
+// newest bridged message (lastBridged, nil if the room has none) up to the
+// newest one known locally (newestKnownMs, 0 if none). ok is false when
+// nothing newer than the bridged messages is known. after is zero when the
+// room has no bridged messages, so the latest ones are fetched.
+func catchUpWindow(lastBridged *database.Message, newestKnownMs int64) (after, until time.Time, ok bool) {
+	if newestKnownMs <= 0 {
+		return time.Time{}, time.Time{}, false
+	}
+	until = time.UnixMilli(newestKnownMs)
+	if lastBridged != nil {
+		if !until.After(lastBridged.Timestamp) {
+			return time.Time{}, time.Time{}, false
+		}
+		after = lastBridged.Timestamp
+	}
+	return after, until, true
+}
+
+// portalCatchUpInterval returns how often a portal may be checked, or zero
+// when catch-up is off.
+func (c *IMClient) portalCatchUpInterval() time.Duration {
+	minutes := c.Main.Config.PortalCatchUpMinutes
+	if minutes <= 0 {
+		return 0
+	}
+	return time.Duration(minutes) * time.Minute
+}
+
+// catchUpPortal queues a forward backfill of portal's missed messages, if
+// it's due for a check and CloudKit has messages newer than its newest
+// bridged one.
+func (c *IMClient) catchUpPortal(ctx context.Context, portal *bridgev2.Portal) {
+	interval := c.portalCatchUpInterval()
+	if interval == 0 || portal == nil || portal.MXID == "" || c.cloudStore == nil || !c.useCloudKitBackfill() {
+		return
+	}
+	portalID := string(portal.ID)
+	if !c.portalCatchUp.due(portalID, time.Now(), interval) {
+		return
+	}
+	// Off the portal's event loop, which the Matrix event came in on.
+	log := zerolog.Ctx(ctx).With().Str("portal_id", portalID).Logger()
+	go func() {
+		// Only rows FetchMessages can serve; placeholder rows would make
+		// every check look like a gap that backfills nothing (see
+		// queueRecoveredPortalResync).
+		newestKnown, err := c.cloudStore.getNewestBackfillableMessageTimestamp(log.WithContext(context.Background()), portalID, true)
+		if err != nil {
+			log.Warn().Err(err).Msg("Catch-up: failed to get newest known message")
+			return
+		} else if newestKnown == 0 {
+			return
+		}
+		c.UserLogin.QueueRemoteEvent(&simplevent.ChatResync{
+			EventMeta: simplevent.EventMeta{
+				Type:      bridgev2.RemoteEventChatResync,
+				PortalKey: portal.PortalKey,
+				Timestamp: time.Now(),
+				LogContext: func(lc zerolog.Context) zerolog.Context {
+					return lc.Str("source", "portal_catchup")
+				},
+			},
+			CheckNeedsBackfillFunc: func(ctx context.Context, latestMessage *database.Message) (bool, error) {
+				after, until, ok := catchUpWindow(latestMessage, newestKnown)
+				if ok {
+					zerolog.Ctx(ctx).Info().
+						Time("after", after).
+						Time("until", until).
+						Msg("Catch-up: fetching messages newer than the last bridged one")
+				}
+				return ok, nil
+			},
+		})
+	}()
+}
@@ -0,0 +1,61 @@
+package connector
+
+import (
+	"testing"
+	"time"
+
+	"maunium.net/go/mautrix/bridgev2/database"
+)
+
+func TestCatchUpWindow(t *testing.T) {
+	bridged := time.UnixMilli(1700000000000)
+	tests := []struct {
+		name        string
+		lastBridged *database.Message
+		newestKnown int64
+		wantAfter   time.Time
+		wantUntil   time.Time
+		wantOK      bool
+	}{
+		{"gap after downtime", &database.Message{Timestamp: bridged}, 1700000360000, bridged, time.UnixMilli(1700000360000), true},
+		{"one millisecond newer", &database.Message{Timestamp: bridged}, 1700000000001, bridged, time.UnixMilli(1700000000001), true},
+		{"up to date", &database.Message{Timestamp: bridged}, 1700000000000, time.Time{}, time.Time{}, false},
+		// A message that came in live after the last CloudKit sync.
+		{"bridged newer than known", &database.Message{Timestamp: bridged}, 1699999990000, time.Time{}, time.Time{}, false},
+		{"nothing known", &database.Message{Timestamp: bridged}, 0, time.Time{}, time.Time{}, false},
+		{"empty room", nil, 1700000000000, time.Time{}, time.UnixMilli(1700000000000), true},
+		{"empty room, nothing known", nil, 0, time.Time{}, time.Time{}, false},
+	}
+	for _, tt := range tests {
+		after, until, ok := catchUpWindow(tt.lastBridged, tt.newestKnown)
+		if ok != tt.wantOK || !after.Equal(tt.wantAfter) || !until.Equal(tt.wantUntil) {
+			t.Errorf("catchUpWindow(%s) = %v, %v, %v, want %v, %v, %v", tt.name, after, until, ok, tt.wantAfter, tt.wantUntil, tt.wantOK)
+		}
+	}
+}
+
+func TestPortalCatchUpStateDue(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	interval := 15 * time.Minute
+	var s portalCatchUpState
+	if !s.due("a", now, interval) {
+		t.Fatalf("due() on the first check = false, want true")
+	}
+	tests := []struct {
+		portalID string
+		after    time.Duration
+		want     bool
+	}{
+		{"a", time.Minute, false},
+		{"b", time.Minute, true},
+		{"a", interval - time.Second, false},
+		{"a", interval, true},
+		// The check at interval restarts the wait.
+		{"a", interval + time.Minute, false},
+	}
+	for _, tt := range tests {
+		if got := s.due(tt.portalID, now.Add(tt.after), interval); got != tt.want {
+			t.Errorf("due(%s) %v after the first check = %v, want %v", tt.portalID, tt.after, got, tt.want)
+		}
+	}
+}
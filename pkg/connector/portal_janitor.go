@@ -0,0 +1,219 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2024 Ludvig Rhodin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+package connector
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/bridgev2/simplevent"
+)
+
+// Abandoned-DM janitor (abandoned_portal_cleanup_days).
+//
+// Short-code spam and one-off verification texts leave DM portals behind
+// whose message never made it into the room (dropped as a duplicate, failed
+// to convert, or the room was created by a chat sync with nothing to
+// backfill). bridgev2 doesn't record when a portal was created, so age is
+// measured from the first sweep that saw the portal empty: the first-seen
+// times are kept in the KV store, a portal that gets a message drops out of
+// the set, and one that stays empty past the threshold is deleted exactly
+// like an Apple-side chat delete, minus the CloudKit calls — the chat is
+// only removed from the bridge, never from the user's devices.
+
+// abandonedPortalsKVKey returns the key holding the JSON map of portal ID →
+// Unix ms at which the janitor first saw the portal empty. Each login sweeps
+// its own portals, so each keeps its own map.
+func abandonedPortalsKVKey(loginID networkid.UserLoginID) database.Key {
+	return database.Key("im.abandoned_portal_candidates." + string(loginID))
+}
+
+// findEmptyDMPortals returns the DM portals of receiver that have a Matrix
+// room but no real messages. Bridge placeholder parts (~fake: MXIDs) don't
+// count as messages. Group portals (gid: and legacy comma-joined IDs) are
+// excluded.
+func findEmptyDMPortals(ctx context.Context, db *database.Database, receiver networkid.UserLoginID) ([]string, error) {
+	rows, err := db.Query(ctx, `
+		SELECT p.id FROM portal p
+		WHERE p.bridge_id=$1 AND p.receiver=$2 AND p.mxid IS NOT NULL AND p.mxid <> ''
+		  AND p.id NOT LIKE 'gid:%' AND p.id NOT LIKE '%,%'
+		  AND NOT EXISTS (
+			SELECT 1 FROM message m
+			WHERE m.bridge_id=p.bridge_id AND m.room_id=p.id AND m.room_receiver=p.receiver
+			  AND m.mxid NOT LIKE '~fake:%'
+		  )
+		ORDER BY p.id
+	`, db.BridgeID, receiver)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var portalIDs []string
+	for rows.Next() {
+		var portalID string
+		if err = rows.Scan(&portalID); err != nil {
+			return nil, err
+		}
+		portalIDs = append(portalIDs, portalID)
+	}
+	return portalIDs, rows.Err()
+}
+
+// expireAbandonedPortals merges the portals found empty in this sweep into
+// firstSeen and returns the ones that have been empty for at least
+// threshold, plus the first-seen map to persist. Portals that are no longer
+// empty, and those skip reports as off-limits, are dropped from the map so
+// their clock restarts if they ever become empty again.
+func expireAbandonedPortals(empty []string, firstSeen map[string]int64, now time.Time, threshold time.Duration, skip func(string) bool) (expired []string, next map[string]int64) {
+	next = make(map[string]int64, len(empty))
+	nowMS := now.UnixMilli()
+	for _, portalID := range empty {
+		if skip != nil && skip(portalID) {
+			continue
+		}
+		seenMS, ok := firstSeen[portalID]
+		if !ok {
+			seenMS = nowMS
+		}
+		if now.Sub(time.UnixMilli(seenMS)) >= threshold {
+			expired = append(expired, portalID)
+			continue
+		}
+		next[portalID] = seenMS
+	}
+	return expired, next
+}
+
+// abandonedPortalThreshold returns how long a DM must stay empty before the
+// janitor deletes it, or 0 if the janitor is disabled.
+func (c *IMClient) abandonedPortalThreshold() time.Duration {
+	days := c.Main.Config.AbandonedPortalCleanupDays
+	if days <= 0 {
+		return 0
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// skipAbandonedPortal reports whether the janitor must leave portalID alone:
+// the self-chat, portals already mid-deletion, and portals whose CloudKit
+// messages haven't been backfilled yet.
+func (c *IMClient) skipAbandonedPortal(ctx context.Context, portalID string) bool {
+	if c.isMyHandle(portalID) {
+		return true
+	}
+	c.recentlyDeletedPortalsMu.RLock()
+	_, deleting := c.recentlyDeletedPortals[portalID]
+	c.recentlyDeletedPortalsMu.RUnlock()
+	if deleting {
+		return true
+	}
+	if c.cloudStore != nil {
+		if pending, err := c.cloudStore.hasPortalMessages(ctx, portalID); err != nil || pending {
+			return true
+		}
+	}
+	return false
+}
+
+// retireAbandonedPortal records portalID as deleted through the same safety
+// nets as handleChatDelete: recentlyDeletedPortals for in-flight echoes and a
+// soft-deleted cloud_chat row so CloudKit sync and restarts don't recreate
+// it. A tombstone is inserted when the chat never had a cloud_chat row.
+func (c *IMClient) retireAbandonedPortal(ctx context.Context, portalID string) error {
+	c.trackDeletedChat(portalID)
+	if c.cloudStore == nil {
+		return nil
+	}
+	if err := c.cloudStore.clearRestoreOverride(ctx, portalID); err != nil {
+		return err
+	}
+	if err := c.cloudStore.deleteLocalChatByPortalID(ctx, portalID); err != nil {
+		return err
+	}
+	return c.cloudStore.ensureDeletedChatTombstoneByPortalID(ctx, portalID)
+}
+
+// sweepAbandonedPortals runs one janitor pass and returns the number of
+// portals deleted.
+func (c *IMClient) sweepAbandonedPortals(ctx context.Context, log zerolog.Logger, threshold time.Duration) int {
+	db := c.Main.Bridge.DB
+	empty, err := findEmptyDMPortals(ctx, db, c.UserLogin.ID)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to query empty DM portals")
+		return 0
+	}
+	kvKey := abandonedPortalsKVKey(c.UserLogin.ID)
+	firstSeen := make(map[string]int64)
+	if raw := db.KV.Get(ctx, kvKey); raw != "" {
+		if err = json.Unmarshal([]byte(raw), &firstSeen); err != nil {
+			log.Warn().Err(err).Msg("Discarding unreadable abandoned-portal state")
+		}
+	}
+	// Rooms emptied by matrix_retention_days had messages; they aren't
+	// abandoned.
+	retained := loadRetainedPortals(ctx, db, c.UserLogin.ID)
+	expired, next := expireAbandonedPortals(empty, firstSeen, time.Now(), threshold, func(portalID string) bool {
+		return retained[portalID] || c.skipAbandonedPortal(ctx, portalID)
+	})
+	if data, err := json.Marshal(next); err == nil {
+		db.KV.Set(ctx, kvKey, string(data))
+	}
+
+	for _, portalID := range expired {
+		if err = c.retireAbandonedPortal(ctx, portalID); err != nil {
+			log.Warn().Err(err).Str("portal_id", portalID).Msg("Failed to record abandoned portal as deleted, skipping")
+			continue
+		}
+		log.Info().Str("portal_id", portalID).Msg("Deleting abandoned empty DM portal")
+		c.Main.Bridge.QueueRemoteEvent(c.UserLogin, &simplevent.ChatDelete{
+			EventMeta: simplevent.EventMeta{
+				Type:      bridgev2.RemoteEventChatDelete,
+				PortalKey: networkid.PortalKey{ID: networkid.PortalID(portalID), Receiver: c.UserLogin.ID},
+				Timestamp: time.Now(),
+				LogContext: func(lc zerolog.Context) zerolog.Context {
+					return lc.Str("source", "abandoned_portal_cleanup")
+				},
+			},
+			OnlyForMe: true,
+		})
+	}
+	return len(expired)
+}
+
+// periodicAbandonedPortalCleanup runs the janitor once at startup and then
+// every 12h while abandoned_portal_cleanup_days is set.
+func (c *IMClient) periodicAbandonedPortalCleanup(log zerolog.Logger) {
+	threshold := c.abandonedPortalThreshold()
+	if threshold == 0 {
+		return
+	}
+	log = log.With().Str("component", "abandoned_portal_cleanup").Logger()
+	sweep := func() {
+		if deleted := c.sweepAbandonedPortals(context.Background(), log, threshold); deleted > 0 {
+			log.Info().Int("deleted", deleted).Msg("Cleaned up abandoned DM portals")
+		}
+	}
+
+	sweep()
+	ticker := time.NewTicker(12 * time.Hour)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			sweep()
+		case <-c.stopChan:
+			return
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package connector
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestFindEmptyDMPortals(t *testing.T) {
+	ctx := context.Background()
+	db := newTestBridgeDB(t)
+	insertPortal := func(portalID string, receiver networkid.UserLoginID, mxid id.RoomID) networkid.PortalKey {
+		t.Helper()
+		key := networkid.PortalKey{ID: networkid.PortalID(portalID), Receiver: receiver}
+		if err := db.Portal.Insert(ctx, &database.Portal{PortalKey: key, MXID: mxid}); err != nil {
+			t.Fatalf("Portal.Insert(%s) error = %v", portalID, err)
+		}
+		return key
+	}
+	insertMessage := func(guid string, room networkid.PortalKey, mxid id.EventID) {
+		t.Helper()
+		err := db.Message.Insert(ctx, &database.Message{
+			ID:        makeMessageID(guid),
+			MXID:      mxid,
+			Room:      room,
+			SenderID:  "tel:+15551234567",
+			Timestamp: time.Unix(1700000000, 0),
+		})
+		if err != nil {
+			t.Fatalf("Message.Insert(%s) error = %v", guid, err)
+		}
+	}
+
+	insertPortal("tel:+15550000001", "login", "!empty:example.com")
+	fakeOnly := insertPortal("tel:+15550000002", "login", "!fake:example.com")
+	insertMessage("PLACEHOLDER", fakeOnly, database.FakeMXIDPrefix+"placeholder")
+	used := insertPortal("tel:+15550000003", "login", "!used:example.com")
+	insertMessage("REAL", used, "$real")
+	insertPortal("tel:+15550000004", "login", "")
+	insertPortal("gid:9b2c6a5e-1111-2222-3333-444455556666", "login", "!group:example.com")
+	insertPortal("tel:+15550000005,tel:+15550000006", "login", "!legacygroup:example.com")
+	insertPortal("tel:+15550000007", "other-login", "!otherlogin:example.com")
+
+	got, err := findEmptyDMPortals(ctx, db, "login")
+	if err != nil {
+		t.Fatalf("findEmptyDMPortals() error = %v", err)
+	}
+	want := []string{"tel:+15550000001", "tel:+15550000002"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("findEmptyDMPortals() = %v, want %v", got, want)
+	}
+}
+
+func TestExpireAbandonedPortals(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	threshold := 7 * 24 * time.Hour
+	old := now.Add(-8 * 24 * time.Hour).UnixMilli()
+	recent := now.Add(-24 * time.Hour).UnixMilli()
+
+	tests := []struct {
+		name        string
+		empty       []string
+		firstSeen   map[string]int64
+		skip        func(string) bool
+		wantExpired []string
+		wantNext    map[string]int64
+	}{
+		{
+			name:      "newly empty portal starts its clock",
+			empty:     []string{"tel:+15550000001"},
+			firstSeen: map[string]int64{},
+			wantNext:  map[string]int64{"tel:+15550000001": now.UnixMilli()},
+		},
+		{
+			name:      "recently seen portal is kept",
+			empty:     []string{"tel:+15550000001"},
+			firstSeen: map[string]int64{"tel:+15550000001": recent},
+			wantNext:  map[string]int64{"tel:+15550000001": recent},
+		},
+		{
+			name:        "portal empty past threshold expires",
+			empty:       []string{"tel:+15550000001"},
+			firstSeen:   map[string]int64{"tel:+15550000001": old},
+			wantExpired: []string{"tel:+15550000001"},
+			wantNext:    map[string]int64{},
+		},
+		{
+			name:      "portal that got a message is forgotten",
+			empty:     nil,
+			firstSeen: map[string]int64{"tel:+15550000001": old},
+			wantNext:  map[string]int64{},
+		},
+		{
+			name:      "skipped portal is neither expired nor tracked",
+			empty:     []string{"tel:+15550000001"},
+			firstSeen: map[string]int64{"tel:+15550000001": old},
+			skip:      func(string) bool { return true },
+			wantNext:  map[string]int64{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expired, next := expireAbandonedPortals(tt.empty, tt.firstSeen, now, threshold, tt.skip)
+			if !reflect.DeepEqual(expired, tt.wantExpired) {
+				t.Errorf("expireAbandonedPortals() expired = %v, want %v", expired, tt.wantExpired)
+			}
+			if !reflect.DeepEqual(next, tt.wantNext) {
+				t.Errorf("expireAbandonedPortals() next = %v, want %v", next, tt.wantNext)
+			}
+		})
+	}
+}
+
+func TestRetireAbandonedPortal(t *testing.T) {
+	ctx := context.Background()
+	store := newTestCloudStore(t)
+	c := &IMClient{cloudStore: store, allHandles: []string{"tel:+15559999999"}}
+	const portalID = "tel:+15550000001"
+
+	if c.skipAbandonedPortal(ctx, portalID) {
+		t.Fatalf("skipAbandonedPortal(%s) = true before deletion, want false", portalID)
+	}
+	if err := c.retireAbandonedPortal(ctx, portalID); err != nil {
+		t.Fatalf("retireAbandonedPortal() error = %v", err)
+	}
+
+	if _, tracked := c.recentlyDeletedPortals[portalID]; !tracked {
+		t.Errorf("recentlyDeletedPortals[%s] missing after retireAbandonedPortal()", portalID)
+	}
+	deleted, err := store.portalIsExplicitlyDeleted(ctx, portalID)
+	if err != nil {
+		t.Fatalf("portalIsExplicitlyDeleted() error = %v", err)
+	}
+	if !deleted {
+		t.Errorf("portalIsExplicitlyDeleted(%s) = false, want true", portalID)
+	}
+	if !c.skipAbandonedPortal(ctx, portalID) {
+		t.Errorf("skipAbandonedPortal(%s) = false for a portal being deleted, want true", portalID)
+	}
+	if !c.skipAbandonedPortal(ctx, "tel:+15559999999") {
+		t.Errorf("skipAbandonedPortal() = false for the self-chat, want true")
+	}
+}
+
+func TestAbandonedPortalsKVKey(t *testing.T) {
+	a, b := abandonedPortalsKVKey("login-a"), abandonedPortalsKVKey("login-b")
+	if a == b {
+		t.Errorf("abandonedPortalsKVKey() = %q for both logins, want one key per login", a)
+	}
+	if a != abandonedPortalsKVKey("login-a") {
+		t.Errorf("abandonedPortalsKVKey() not stable for the same login")
+	}
+}
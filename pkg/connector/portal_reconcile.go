@@ -0,0 +1,305 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2024 Ludvig Rhodin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+package connector
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/commands"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/bridgev2/simplevent"
+)
+
+// Startup portal reconciliation.
+//
+// createPortalsFromCloudSync queues a ChatResync for every CloudKit chat, but
+// nothing checks that the rooms actually appeared: a resync that failed (room
+// creation error, bridge restart mid-queue) leaves the chat unbridged until
+// it happens to get a new message. Conversely, rooms whose chat CloudKit has
+// never heard of pile up silently. Once the first cloud sync has finished and
+// the queued resyncs have had time to run, this pass diffs the two sides:
+//
+//   - missing: CloudKit chats with no bridged room get their ChatResync
+//     queued again. Deleted chats (deleted_portal rows and
+//     recentlyDeletedPortals) are never recreated.
+//   - orphans: bridged rooms the cloud store has no record of at all are
+//     only flagged — stored in the KV store and listed by the orphan-portals
+//     command — never deleted, since a brand-new conversation can be bridged
+//     from APNs before CloudKit syncs it.
+
+// orphanPortalsKVKey returns the key holding the JSON orphanPortalReport of
+// the last pass. Each login reconciles against its own CloudKit account, so
+// each keeps its own report.
+func orphanPortalsKVKey(loginID networkid.UserLoginID) database.Key {
+	return database.Key("im.orphan_portals." + string(loginID))
+}
+
+// portalReconcileDelay is how long after the initial cloud sync the pass
+// runs, giving the ChatResync events it queued time to create their rooms.
+const portalReconcileDelay = 5 * time.Minute
+
+// orphanPortal is one bridged portal the cloud store doesn't know.
+type orphanPortal struct {
+	PortalID string `json:"portal_id"`
+	Name     string `json:"name,omitempty"`
+	MXID     string `json:"mxid"`
+}
+
+// orphanPortalReport is the result of the last reconciliation pass.
+type orphanPortalReport struct {
+	CheckedAt int64          `json:"checked_at"`
+	Portals   []orphanPortal `json:"portals"`
+}
+
+// diffPortals compares the portals the cloud store wants bridged (cloud, in
+// creation order) with the bridged ones. known is every portal ID the cloud
+// store has any record of, including deleted and filtered chats. Portal IDs
+// are compared by dedupKey so the two IDs a group can appear under
+// (gid:<chat_id> and gid:<group_id>) match each other; a nil dedupKey
+// compares IDs as-is.
+//
+// missing keeps cloud's order and holds one portal ID per chat, skipping
+// deleted ones. orphans is sorted and excludes deleted portals, which are
+// already on their way out.
+func diffPortals(cloud, known, bridged []string, deleted map[string]bool, dedupKey func(string) string) (missing, orphans []string) {
+	if dedupKey == nil {
+		dedupKey = func(portalID string) string { return portalID }
+	}
+	bridgedKeys := make(map[string]bool, len(bridged))
+	for _, portalID := range bridged {
+		bridgedKeys[dedupKey(portalID)] = true
+	}
+	knownKeys := make(map[string]bool, len(known)+len(cloud))
+	for _, portalID := range known {
+		knownKeys[dedupKey(portalID)] = true
+	}
+	for _, portalID := range cloud {
+		knownKeys[dedupKey(portalID)] = true
+		if deleted[portalID] {
+			continue
+		}
+		key := dedupKey(portalID)
+		if bridgedKeys[key] {
+			continue
+		}
+		// Mark as bridged so a second ID for the same group isn't queued.
+		bridgedKeys[key] = true
+		missing = append(missing, portalID)
+	}
+	for _, portalID := range bridged {
+		if !deleted[portalID] && !knownKeys[dedupKey(portalID)] {
+			orphans = append(orphans, portalID)
+		}
+	}
+	sort.Strings(orphans)
+	return missing, orphans
+}
+
+// runPortalReconciliation waits for the initial cloud sync to finish, then
+// merges duplicate group portals and runs reconcilePortals once.
+func (c *IMClient) runPortalReconciliation(log zerolog.Logger) {
+	log = log.With().Str("component", "portal_reconcile").Logger()
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+	for !c.isCloudSyncDone() {
+		select {
+		case <-ticker.C:
+		case <-c.stopChan:
+			return
+		}
+	}
+	select {
+	case <-time.After(portalReconcileDelay):
+	case <-c.stopChan:
+		return
+	}
+	ctx := log.WithContext(context.Background())
+	c.mergeDuplicateGroupPortals(ctx, log)
+	c.reconcilePortals(ctx, log)
+}
+
+// reconcilePortals re-queues CloudKit chats that have no bridged room and
+// records bridged rooms the cloud store doesn't know in the KV store.
+func (c *IMClient) reconcilePortals(ctx context.Context, log zerolog.Logger) {
+	if c.cloudStore == nil {
+		return
+	}
+	portalInfos, err := c.cloudStore.listPortalIDsWithNewestTimestamp(ctx)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to list cloud portal IDs")
+		return
+	}
+	known, err := c.cloudStore.listKnownPortalIDs(ctx)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to list known cloud portal IDs")
+		return
+	}
+	deletedIDs, err := c.cloudStore.listDeletedPortalIDs(ctx)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to list deleted portal IDs")
+		return
+	}
+	portals, err := c.Main.Bridge.GetAllPortalsWithMXID(ctx)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to list bridged portals")
+		return
+	}
+
+	deleted := make(map[string]bool, len(deletedIDs))
+	for _, portalID := range deletedIDs {
+		deleted[portalID] = true
+	}
+	c.recentlyDeletedPortalsMu.RLock()
+	for portalID := range c.recentlyDeletedPortals {
+		deleted[portalID] = true
+	}
+	c.recentlyDeletedPortalsMu.RUnlock()
+
+	cloud := make([]string, 0, len(portalInfos))
+	newestTS := make(map[string]int64, len(portalInfos))
+	quiet := make(map[string]bool)
+	for _, p := range portalInfos {
+		cloud = append(cloud, p.PortalID)
+		newestTS[p.PortalID] = p.NewestTS
+		if c.Main.Config.skipQuietPortal(p) {
+			quiet[p.PortalID] = true
+		}
+	}
+	var bridged []string
+	bridgedByID := make(map[string]*bridgev2.Portal)
+	for _, portal := range portals {
+		if portal.Receiver != c.UserLogin.ID {
+			continue
+		}
+		bridged = append(bridged, string(portal.ID))
+		bridgedByID[string(portal.ID)] = portal
+	}
+
+	dedupKeys := make(map[string]string)
+	missing, orphans := diffPortals(cloud, known, bridged, deleted, func(portalID string) string {
+		if !isGroupPortalID(portalID) {
+			return portalID
+		}
+		if key, ok := dedupKeys[portalID]; ok {
+			return key
+		}
+		groupID := ""
+		if strings.HasPrefix(portalID, "gid:") {
+			groupID = c.cloudStore.getGroupIDForPortalID(ctx, portalID)
+		}
+		key := groupPortalDedupKey(portalID, groupID, nil)
+		dedupKeys[portalID] = key
+		return key
+	})
+
+	// Quiet chats are left without a room on purpose (see quiet_portals.go).
+	missing = slices.DeleteFunc(missing, func(portalID string) bool { return quiet[portalID] })
+	for _, portalID := range missing {
+		var latestMessageTS time.Time
+		if ts := newestTS[portalID]; ts > 0 {
+			latestMessageTS = time.UnixMilli(ts)
+		}
+		c.UserLogin.QueueRemoteEvent(&simplevent.ChatResync{
+			EventMeta: simplevent.EventMeta{
+				Type:         bridgev2.RemoteEventChatResync,
+				PortalKey:    networkid.PortalKey{ID: networkid.PortalID(portalID), Receiver: c.UserLogin.ID},
+				CreatePortal: true,
+				LogContext: func(lc zerolog.Context) zerolog.Context {
+					return lc.
+						Str("portal_id", portalID).
+						Str("source", "portal_reconcile")
+				},
+			},
+			GetChatInfoFunc: c.GetChatInfo,
+			LatestMessageTS: latestMessageTS,
+		})
+	}
+
+	report := orphanPortalReport{CheckedAt: time.Now().UnixMilli(), Portals: make([]orphanPortal, 0, len(orphans))}
+	for _, portalID := range orphans {
+		portal := bridgedByID[portalID]
+		report.Portals = append(report.Portals, orphanPortal{
+			PortalID: portalID,
+			Name:     portal.Name,
+			MXID:     string(portal.MXID),
+		})
+		log.Warn().
+			Str("portal_id", portalID).
+			Stringer("mxid", portal.MXID).
+			Msg("Bridged portal has no CloudKit chat, flagged for review")
+	}
+	if data, err := json.Marshal(report); err == nil {
+		c.Main.Bridge.DB.KV.Set(ctx, orphanPortalsKVKey(c.UserLogin.ID), string(data))
+	}
+	log.Info().
+		Int("cloud_portals", len(cloud)).
+		Int("bridged_portals", len(bridged)).
+		Int("missing", len(missing)).
+		Int("orphans", len(orphans)).
+		Msg("Portal reconciliation finished")
+}
+
+// formatOrphanPortals renders the orphan-portals reply.
+func formatOrphanPortals(report orphanPortalReport, now time.Time) string {
+	if report.CheckedAt == 0 {
+		return "Portal reconciliation hasn't run yet. It runs a few minutes after the initial CloudKit sync."
+	}
+	age := now.Sub(time.UnixMilli(report.CheckedAt)).Round(time.Minute)
+	if len(report.Portals) == 0 {
+		return fmt.Sprintf("No orphaned portals (checked %s ago).", age)
+	}
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("**Orphaned portals (%d, checked %s ago)**\n\n", len(report.Portals), age))
+	for i, p := range report.Portals {
+		sb.WriteString(fmt.Sprintf("%d. `%s`", i+1, p.PortalID))
+		if p.Name != "" {
+			sb.WriteString(fmt.Sprintf(" %q", p.Name))
+		}
+		sb.WriteString(fmt.Sprintf(" — %s\n", p.MXID))
+	}
+	sb.WriteString("\nThese rooms have no matching chat in CloudKit. Nothing was deleted; " +
+		"conversations started since the last CloudKit sync can show up here until the next one.")
+	return sb.String()
+}
+
+var cmdOrphanPortals = &commands.FullHandler{
+	Name: "orphan-portals",
+	Func: fnOrphanPortals,
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionAdmin,
+		Description: "List bridged rooms that have no matching CloudKit chat, as found by the startup reconciliation.",
+	},
+	RequiresAdmin: true,
+	RequiresLogin: true,
+}
+
+func fnOrphanPortals(ce *commands.Event) {
+	login := ce.User.GetDefaultLogin()
+	if login == nil {
+		ce.Reply("Not logged in.")
+		return
+	}
+	var report orphanPortalReport
+	if raw := ce.Bridge.DB.KV.Get(ce.Ctx, orphanPortalsKVKey(login.ID)); raw != "" {
+		if err := json.Unmarshal([]byte(raw), &report); err != nil {
+			ce.Reply("Failed to read the last reconciliation result: %v", err)
+			return
+		}
+	}
+	ce.Reply(formatOrphanPortals(report, time.Now()))
+}
@@ -0,0 +1,98 @@
+package connector
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDiffPortals(t *testing.T) {
+	// Both IDs of the same group share a dedup key.
+	dedupKey := func(portalID string) string {
+		if portalID == "gid:chat-uuid" || portalID == "gid:group-uuid" {
+			return "group:group-uuid"
+		}
+		return portalID
+	}
+	tests := []struct {
+		name        string
+		cloud       []string
+		known       []string
+		bridged     []string
+		deleted     map[string]bool
+		wantMissing []string
+		wantOrphans []string
+	}{
+		{
+			name:    "everything bridged",
+			cloud:   []string{"tel:+15550000001", "tel:+15550000002"},
+			bridged: []string{"tel:+15550000002", "tel:+15550000001"},
+		},
+		{
+			name:        "unbridged chats keep cloud order",
+			cloud:       []string{"tel:+15550000003", "tel:+15550000001", "tel:+15550000002"},
+			bridged:     []string{"tel:+15550000001"},
+			wantMissing: []string{"tel:+15550000003", "tel:+15550000002"},
+		},
+		{
+			name:        "deleted chats are not recreated",
+			cloud:       []string{"tel:+15550000001", "tel:+15550000002"},
+			deleted:     map[string]bool{"tel:+15550000001": true},
+			wantMissing: []string{"tel:+15550000002"},
+		},
+		{
+			name:        "unknown bridged portals are orphans",
+			cloud:       []string{"tel:+15550000001"},
+			bridged:     []string{"tel:+15550000009", "tel:+15550000001", "tel:+15550000008"},
+			wantOrphans: []string{"tel:+15550000008", "tel:+15550000009"},
+		},
+		{
+			name:    "deleted or filtered chats known to the store are not orphans",
+			known:   []string{"tel:+15550000008", "tel:+15550000009"},
+			bridged: []string{"tel:+15550000008", "tel:+15550000009"},
+		},
+		{
+			name:    "bridged portal being deleted is not an orphan",
+			bridged: []string{"tel:+15550000009"},
+			deleted: map[string]bool{"tel:+15550000009": true},
+		},
+		{
+			name:    "group bridged under its other ID",
+			cloud:   []string{"gid:group-uuid"},
+			bridged: []string{"gid:chat-uuid"},
+		},
+		{
+			name:        "group listed twice is queued once",
+			cloud:       []string{"gid:group-uuid", "gid:chat-uuid"},
+			wantMissing: []string{"gid:group-uuid"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			missing, orphans := diffPortals(tt.cloud, tt.known, tt.bridged, tt.deleted, dedupKey)
+			if !reflect.DeepEqual(missing, tt.wantMissing) {
+				t.Errorf("diffPortals() missing = %v, want %v", missing, tt.wantMissing)
+			}
+			if !reflect.DeepEqual(orphans, tt.wantOrphans) {
+				t.Errorf("diffPortals() orphans = %v, want %v", orphans, tt.wantOrphans)
+			}
+		})
+	}
+}
+
+func TestFormatOrphanPortalsNotRun(t *testing.T) {
+	if got := formatOrphanPortals(orphanPortalReport{}, time.Now()); !strings.Contains(got, "hasn't run yet") {
+		t.Errorf("formatOrphanPortals(empty) = %q, want not-run message", got)
+	}
+}
+
+func TestOrphanPortalsKVKey(t *testing.T) {
+	a, b := orphanPortalsKVKey("login-a"), orphanPortalsKVKey("login-b")
+	if a == b {
+		t.Errorf("orphanPortalsKVKey() = %q for both logins, want one key per login", a)
+	}
+	if a != orphanPortalsKVKey("login-a") {
+		t.Errorf("orphanPortalsKVKey() not stable for the same login")
+	}
+}
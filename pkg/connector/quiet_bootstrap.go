@@ -0,0 +1,100 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2024 Ludvig Rhodin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+package connector
+
+// Quiet bootstrap (quiet_bootstrap).
+//
+// Without batch sending, backfill goes out as ordinary events, so the
+// initial sync of a large account pushes a notification for every
+// historical message. With quiet_bootstrap, messages backfilled before the
+// initial CloudKit sync finishes (and backward backfill, which is history
+// by definition) are marked with historicalEventField and have their
+// mentions cleared, and an override push rule installed through the
+// user's double puppet turns notifications off for events carrying the
+// marker. Messages bridged live, and forward backfill once bootstrap is
+// done, aren't marked and notify normally. Without double puppeting the
+// rule can't be installed; the marker is still set, for clients or
+// homeserver rules that look at it.
+
+import (
+	"context"
+	"time"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/bridgev2"
+	matrixfmt "maunium.net/go/mautrix/bridgev2/matrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/pushrules"
+)
+
+// historicalEventField marks a backfilled event that shouldn't notify.
+const historicalEventField = "fi.mau.imessage.historical"
+
+// quietBackfillPushRuleID is the override rule that silences marked events.
+const quietBackfillPushRuleID = "fi.mau.imessage.quiet_backfill"
+
+// quietBackfillPushRule matches events with historicalEventField set and
+// has no actions, so they don't notify. The dots in the field name are
+// escaped so they aren't read as nesting.
+var quietBackfillPushRule = &mautrix.ReqPutPushRule{
+	Actions: []pushrules.PushActionType{},
+	Conditions: []pushrules.PushCondition{{
+		Kind:  pushrules.KindEventPropertyIs,
+		Key:   `content.fi\.mau\.imessage\.historical`,
+		Value: true,
+	}},
+}
+
+// quietBackfill reports whether a FetchMessages call's messages should be
+// marked historical.
+func (c *IMClient) quietBackfill(forward bool) bool {
+	return c.Main.Config.QuietBootstrap && (!forward || !c.isCloudSyncDone())
+}
+
+// markQuietBackfill marks every part of msgs as historical and clears its
+// mentions.
+func markQuietBackfill(msgs []*bridgev2.BackfillMessage) {
+	for _, msg := range msgs {
+		if msg == nil || msg.ConvertedMessage == nil {
+			continue
+		}
+		for _, part := range msg.Parts {
+			if part.Extra == nil {
+				part.Extra = make(map[string]any)
+			}
+			part.Extra[historicalEventField] = true
+			if part.Content != nil {
+				part.Content.Mentions = &event.Mentions{}
+			}
+		}
+	}
+}
+
+// ensureQuietBackfillPushRule installs quietBackfillPushRule for the user
+// through their double puppet. The PUT is idempotent, so it runs on every
+// connect.
+func (c *IMClient) ensureQuietBackfillPushRule(log zerolog.Logger) {
+	if !c.Main.Config.QuietBootstrap {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	intent, ok := c.UserLogin.User.DoublePuppet(ctx).(*matrixfmt.ASIntent)
+	if !ok || intent == nil {
+		log.Debug().Msg("No double puppet, not installing quiet backfill push rule")
+		return
+	}
+	err := intent.Matrix.PutPushRule(ctx, "global", pushrules.OverrideRule, quietBackfillPushRuleID, quietBackfillPushRule)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to install quiet backfill push rule")
+		return
+	}
+	log.Debug().Msg("Installed quiet backfill push rule")
+}
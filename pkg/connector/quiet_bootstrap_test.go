@@ -0,0 +1,68 @@
+package connector
+
+import (
+	"context"
+	"testing"
+
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/lrhodin/imessage/pkg/rustpushgo"
+)
+
+func TestQuietBackfill(t *testing.T) {
+	tests := []struct {
+		name      string
+		quiet     bool
+		syncDone  bool
+		forward   bool
+		wantQuiet bool
+	}{
+		{"disabled", false, false, true, false},
+		{"bootstrap forward", true, false, true, true},
+		{"after bootstrap forward", true, true, true, false},
+		{"backward", true, true, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &IMClient{Main: &IMConnector{Config: IMConfig{QuietBootstrap: tt.quiet}}, cloudSyncDone: tt.syncDone}
+			if got := c.quietBackfill(tt.forward); got != tt.wantQuiet {
+				t.Errorf("quietBackfill(%v) = %v, want %v", tt.forward, got, tt.wantQuiet)
+			}
+		})
+	}
+}
+
+func TestMarkQuietBackfill(t *testing.T) {
+	mentioned := &event.Mentions{UserIDs: []id.UserID{"@me:example.com"}}
+	msgs := []*bridgev2.BackfillMessage{
+		{ConvertedMessage: &bridgev2.ConvertedMessage{Parts: []*bridgev2.ConvertedMessagePart{
+			{Type: event.EventMessage, Content: &event.MessageEventContent{MsgType: event.MsgText, Body: "hi", Mentions: mentioned}},
+			{Type: event.EventMessage, Content: &event.MessageEventContent{MsgType: event.MsgImage}, Extra: map[string]any{"other": 1}},
+		}}},
+		{},
+	}
+	markQuietBackfill(msgs)
+	for i, part := range msgs[0].Parts {
+		if part.Extra[historicalEventField] != true {
+			t.Errorf("part %d: %s = %v, want true", i, historicalEventField, part.Extra[historicalEventField])
+		}
+		if part.Content.Mentions == nil || len(part.Content.Mentions.UserIDs) != 0 {
+			t.Errorf("part %d: mentions = %+v, want empty", i, part.Content.Mentions)
+		}
+	}
+	if msgs[0].Parts[1].Extra["other"] != 1 {
+		t.Errorf("markQuietBackfill() dropped existing extra fields")
+	}
+
+	// Realtime messages go through convertMessage alone and stay unmarked.
+	text := "hi"
+	live, err := convertMessage(context.Background(), nil, nil, &rustpushgo.WrappedMessage{Text: &text}, true)
+	if err != nil {
+		t.Fatalf("convertMessage() error = %v", err)
+	}
+	if _, ok := live.Parts[0].Extra[historicalEventField]; ok {
+		t.Errorf("realtime message has %s set", historicalEventField)
+	}
+}
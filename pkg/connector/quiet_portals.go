@@ -0,0 +1,30 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2024 Ludvig Rhodin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+package connector
+
+// Quiet chats (skip_outbound_only_portals, min_portal_messages).
+//
+// An account's CloudKit history is full of stale chats where the user sent
+// one message years ago and never heard back, and bridging each of them
+// makes a room that's mostly clutter. Cloud sync can be told to leave such
+// chats without a room: ones whose synced messages are all from the user,
+// and ones with fewer synced messages than a threshold. Only portals that
+// don't have a room yet are skipped, and nothing is dropped: the messages
+// stay in the cloud store, and the chat gets its room (with that history
+// backfilled) as soon as a new message arrives.
+
+// skipQuietPortal reports whether cloud sync should leave p without a room.
+// Chats with no synced messages at all are only skipped by the threshold:
+// they may just not have had their messages resolved yet.
+func (c *IMConfig) skipQuietPortal(p portalWithNewestMessage) bool {
+	if c.SkipOutboundOnlyPortals && p.MessageCount > 0 && p.IncomingCount == 0 {
+		return true
+	}
+	return c.MinPortalMessages > 0 && p.MessageCount < c.MinPortalMessages
+}
@@ -0,0 +1,68 @@
+package connector
+
+import (
+	"context"
+	"testing"
+)
+
+func TestSkipQuietPortal(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  IMConfig
+		p    portalWithNewestMessage
+		want bool
+	}{
+		{"disabled", IMConfig{}, portalWithNewestMessage{MessageCount: 1}, false},
+		{"outbound only", IMConfig{SkipOutboundOnlyPortals: true}, portalWithNewestMessage{MessageCount: 3}, true},
+		{"got a reply", IMConfig{SkipOutboundOnlyPortals: true}, portalWithNewestMessage{MessageCount: 3, IncomingCount: 1}, false},
+		{"chat only isn't outbound only", IMConfig{SkipOutboundOnlyPortals: true}, portalWithNewestMessage{}, false},
+		{"below threshold", IMConfig{MinPortalMessages: 5}, portalWithNewestMessage{MessageCount: 4, IncomingCount: 2}, true},
+		{"at threshold", IMConfig{MinPortalMessages: 5}, portalWithNewestMessage{MessageCount: 5, IncomingCount: 2}, false},
+		{"chat only below threshold", IMConfig{MinPortalMessages: 1}, portalWithNewestMessage{}, true},
+		{"outbound only above threshold", IMConfig{SkipOutboundOnlyPortals: true, MinPortalMessages: 2}, portalWithNewestMessage{MessageCount: 10}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.cfg.skipQuietPortal(tt.p); got != tt.want {
+				t.Errorf("skipQuietPortal(%+v) = %v, want %v", tt.p, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestListPortalIDsIncomingCount(t *testing.T) {
+	ctx := context.Background()
+	store := newTestCloudStore(t)
+	for _, m := range []struct {
+		guid, portalID string
+		fromMe         bool
+	}{
+		{"m1", "tel:+15551111111", true},
+		{"m2", "tel:+15551111111", true},
+		{"m3", "tel:+15552222222", true},
+		{"m4", "tel:+15552222222", false},
+	} {
+		if _, err := store.db.Exec(ctx,
+			`INSERT INTO cloud_message (login_id, guid, record_name, portal_id, timestamp_ms, is_from_me, created_ts, updated_ts) VALUES ($1, $2, $2, $3, 0, $4, 0, 0)`,
+			store.loginID, m.guid, m.portalID, m.fromMe,
+		); err != nil {
+			t.Fatalf("insert cloud_message: %v", err)
+		}
+	}
+	infos, err := store.listPortalIDsWithNewestTimestamp(ctx)
+	if err != nil {
+		t.Fatalf("listPortalIDsWithNewestTimestamp() error = %v", err)
+	}
+	want := map[string][2]int{
+		"tel:+15551111111": {2, 0},
+		"tel:+15552222222": {2, 1},
+	}
+	if len(infos) != len(want) {
+		t.Fatalf("listPortalIDsWithNewestTimestamp() returned %d portals, want %d", len(infos), len(want))
+	}
+	for _, p := range infos {
+		if got := [2]int{p.MessageCount, p.IncomingCount}; got != want[p.PortalID] {
+			t.Errorf("%s: (messages, incoming) = %v, want %v", p.PortalID, got, want[p.PortalID])
+		}
+	}
+}
@@ -0,0 +1,102 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2024 Ludvig Rhodin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+package connector
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// Receipt re-delivery suppression (receipt_dedup_window_seconds).
+//
+// APNs re-delivers delivery and read receipts after reconnects and on its
+// own retries, and each copy would otherwise send the same Matrix message
+// status or ghost read marker again. Receipts that were fully handled are
+// remembered for the dedup window and repeats inside it are dropped. A
+// receipt is only recorded once it reached Matrix, so a copy that arrives
+// after an earlier one was dropped (portal or message not found yet) still
+// gets its chance. The set lives on the client rather than the connection,
+// so it carries across the APNs reconnects that cause most re-deliveries.
+
+// receiptDedupSet tracks recently handled receipts. The zero value is ready
+// to use.
+type receiptDedupSet struct {
+	mu   sync.Mutex
+	seen map[string]time.Time
+}
+
+// receiptDedupKey identifies a receipt. Delivery receipts all produce the
+// same message status, so they're keyed by message alone; read receipts
+// become a per-sender ghost read marker, so in groups each member's
+// receipt is kept distinct. UUIDs are compared case-insensitively.
+func receiptDedupKey(kind, uuid, sender string) string {
+	key := kind + "|" + strings.ToUpper(uuid)
+	if kind == "read" {
+		key += "|" + strings.ToLower(sender)
+	}
+	return key
+}
+
+// seenWithin reports whether key was recorded less than window before now.
+// A non-positive window disables suppression.
+func (s *receiptDedupSet) seenWithin(key string, now time.Time, window time.Duration) bool {
+	if window <= 0 {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.seen[key]
+	return ok && now.Sub(t) < window
+}
+
+// record marks key as handled at now and prunes entries older than window.
+func (s *receiptDedupSet) record(key string, now time.Time, window time.Duration) {
+	if window <= 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.seen == nil {
+		s.seen = make(map[string]time.Time)
+	}
+	for k, t := range s.seen {
+		if now.Sub(t) >= window {
+			delete(s.seen, k)
+		}
+	}
+	s.seen[key] = now
+}
+
+// receiptDedupWindow returns the configured receipt dedup window, or zero
+// when suppression is disabled.
+func (c *IMClient) receiptDedupWindow() time.Duration {
+	secs := c.Main.Config.ReceiptDedupWindowSeconds
+	if secs <= 0 {
+		return 0
+	}
+	return time.Duration(secs) * time.Second
+}
+
+// isDuplicateReceipt reports whether an identical receipt was handled within
+// the dedup window.
+func (c *IMClient) isDuplicateReceipt(kind, uuid, sender string) bool {
+	if uuid == "" {
+		return false
+	}
+	return c.recentReceipts.seenWithin(receiptDedupKey(kind, uuid, sender), time.Now(), c.receiptDedupWindow())
+}
+
+// recordReceipt remembers a receipt that was delivered to Matrix.
+func (c *IMClient) recordReceipt(kind, uuid, sender string) {
+	if uuid == "" {
+		return
+	}
+	c.recentReceipts.record(receiptDedupKey(kind, uuid, sender), time.Now(), c.receiptDedupWindow())
+}
@@ -0,0 +1,68 @@
+package connector
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReceiptDedupSet(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	window := 2 * time.Minute
+	delivered := receiptDedupKey("delivered", "ABC-123", "")
+
+	var set receiptDedupSet
+	if set.seenWithin(delivered, now, window) {
+		t.Fatalf("seenWithin() = true before any receipt was recorded")
+	}
+	set.record(delivered, now, window)
+
+	tests := []struct {
+		name   string
+		key    string
+		at     time.Time
+		window time.Duration
+		want   bool
+	}{
+		{"duplicate inside window", delivered, now.Add(30 * time.Second), window, true},
+		{"duplicate with different UUID case", receiptDedupKey("delivered", "abc-123", ""), now.Add(time.Second), window, true},
+		{"duplicate after window", delivered, now.Add(window), window, false},
+		{"read receipt for same message", receiptDedupKey("read", "ABC-123", "tel:+15551234567"), now.Add(time.Second), window, false},
+		{"other message", receiptDedupKey("delivered", "DEF-456", ""), now.Add(time.Second), window, false},
+		{"suppression disabled", delivered, now.Add(time.Second), 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := set.seenWithin(tt.key, tt.at, tt.window); got != tt.want {
+				t.Errorf("seenWithin(%q) = %v, want %v", tt.key, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReceiptDedupKeyPerSender(t *testing.T) {
+	alice := receiptDedupKey("read", "ABC-123", "tel:+15551234567")
+	bob := receiptDedupKey("read", "ABC-123", "mailto:bob@example.com")
+	if alice == bob {
+		t.Errorf("receiptDedupKey() gives group members the same read key %q", alice)
+	}
+	if got := receiptDedupKey("read", "abc-123", "mailto:Bob@Example.com"); got != bob {
+		t.Errorf("receiptDedupKey() = %q, want %q regardless of case", got, bob)
+	}
+	if a, b := receiptDedupKey("delivered", "ABC-123", "tel:+15551234567"), receiptDedupKey("delivered", "ABC-123", "mailto:bob@example.com"); a != b {
+		t.Errorf("receiptDedupKey() delivery keys differ by sender: %q, %q", a, b)
+	}
+}
+
+func TestReceiptDedupSetPrunes(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	window := time.Minute
+	var set receiptDedupSet
+	set.record("old", now, window)
+	set.record("new", now.Add(2*window), window)
+	if _, ok := set.seen["old"]; ok {
+		t.Errorf("record() kept an entry older than the window")
+	}
+	if _, ok := set.seen["new"]; !ok {
+		t.Errorf("record() dropped the entry it just added")
+	}
+}
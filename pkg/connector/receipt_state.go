@@ -0,0 +1,109 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2024 Ludvig Rhodin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+package connector
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// Monotonic receipt state.
+//
+// Receipts come from each of the recipient's devices separately: an Apple
+// Watch or an iPad that was asleep can report "delivered" well after the
+// iPhone reported "read". handleDeliveryReceipt sends a Matrix message
+// status for every delivery receipt, so such a late one would show the
+// message as merely delivered again. The highest state each outgoing
+// message reached is tracked here, and a delivery receipt for a message
+// that was already read is dropped. States are kept in memory for
+// receiptStateTTL, which covers receipts re-delivered after reconnects.
+
+// receiptState is how far an outgoing message got. Higher is further.
+type receiptState int
+
+const (
+	receiptNone receiptState = iota
+	receiptDelivered
+	receiptRead
+)
+
+func (s receiptState) String() string {
+	switch s {
+	case receiptDelivered:
+		return "delivered"
+	case receiptRead:
+		return "read"
+	default:
+		return "none"
+	}
+}
+
+const (
+	receiptStateTTL = 24 * time.Hour
+	// receiptStatePruneAt is how many tracked messages trigger pruning of
+	// expired ones.
+	receiptStatePruneAt = 4096
+)
+
+type receiptStateEntry struct {
+	state receiptState
+	at    time.Time
+}
+
+// messageReceiptStates holds the highest receiptState per message UUID.
+// The zero value is ready to use.
+type messageReceiptStates struct {
+	mu     sync.Mutex
+	states map[string]receiptStateEntry
+}
+
+// get returns the state of a message, or receiptNone if it's unknown or
+// expired.
+func (s *messageReceiptStates) get(uuid string, now time.Time) receiptState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.states[strings.ToUpper(uuid)]
+	if !ok || now.Sub(entry.at) >= receiptStateTTL {
+		return receiptNone
+	}
+	return entry.state
+}
+
+// advance raises a message to state. It returns false, changing nothing,
+// when the message is already at state or beyond it.
+func (s *messageReceiptStates) advance(uuid string, state receiptState, now time.Time) bool {
+	if uuid == "" {
+		return true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.states == nil {
+		s.states = make(map[string]receiptStateEntry)
+	}
+	key := strings.ToUpper(uuid)
+	if entry, ok := s.states[key]; ok && now.Sub(entry.at) < receiptStateTTL && entry.state >= state {
+		return false
+	}
+	if len(s.states) >= receiptStatePruneAt {
+		for k, entry := range s.states {
+			if now.Sub(entry.at) >= receiptStateTTL {
+				delete(s.states, k)
+			}
+		}
+	}
+	s.states[key] = receiptStateEntry{state: state, at: now}
+	return true
+}
+
+// deliveryDowngrades reports whether a delivery receipt for uuid would move
+// the message back from read to delivered.
+func (s *messageReceiptStates) deliveryDowngrades(uuid string, now time.Time) bool {
+	return uuid != "" && s.get(uuid, now) > receiptDelivered
+}
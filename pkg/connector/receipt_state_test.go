@@ -0,0 +1,89 @@
+package connector
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestMessageReceiptStatesMonotonic(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	tests := []struct {
+		name     string
+		receipts string // d = delivery receipt, r = read receipt, in arrival order
+		wantSent string // receipts that get bridged; - marks a dropped delivery
+		want     receiptState
+	}{
+		{"in order", "dr", "dr", receiptRead},
+		{"late delivery from another device", "drd", "dr-", receiptRead},
+		{"read before any delivery", "rd", "r-", receiptRead},
+		{"deliveries from several devices", "ddr", "ddr", receiptRead},
+		{"several late deliveries", "rdrdd", "r-r--", receiptRead},
+		{"delivered only", "dd", "dd", receiptDelivered},
+	}
+	for _, tt := range tests {
+		var states messageReceiptStates
+		var sent []byte
+		for i, r := range tt.receipts {
+			at := now.Add(time.Duration(i) * time.Second)
+			switch r {
+			case 'd':
+				if states.deliveryDowngrades("ABC-123", at) {
+					sent = append(sent, '-')
+					continue
+				}
+				states.advance("ABC-123", receiptDelivered, at)
+				sent = append(sent, 'd')
+			case 'r':
+				states.advance("abc-123", receiptRead, at)
+				sent = append(sent, 'r')
+			}
+		}
+		if string(sent) != tt.wantSent {
+			t.Errorf("receipts(%s) bridged %q, want %q", tt.name, sent, tt.wantSent)
+		}
+		if got := states.get("ABC-123", now.Add(time.Minute)); got != tt.want {
+			t.Errorf("get(%s) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMessageReceiptStatesAdvance(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	var states messageReceiptStates
+	tests := []struct {
+		name  string
+		uuid  string
+		state receiptState
+		at    time.Time
+		want  bool
+	}{
+		{"first delivery", "A", receiptDelivered, now, true},
+		{"repeat delivery", "A", receiptDelivered, now, false},
+		{"read", "A", receiptRead, now, true},
+		{"delivery after read", "A", receiptDelivered, now, false},
+		{"other message", "B", receiptDelivered, now, true},
+		{"after the TTL", "A", receiptDelivered, now.Add(receiptStateTTL), true},
+		{"no UUID", "", receiptDelivered, now, true},
+	}
+	for _, tt := range tests {
+		if got := states.advance(tt.uuid, tt.state, tt.at); got != tt.want {
+			t.Errorf("advance(%s) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	if states.deliveryDowngrades("", now) {
+		t.Errorf("deliveryDowngrades(\"\") = true, want false")
+	}
+}
+
+func TestMessageReceiptStatesPrune(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	var states messageReceiptStates
+	for i := 0; i < receiptStatePruneAt; i++ {
+		states.advance(fmt.Sprintf("msg-%d", i), receiptRead, now)
+	}
+	states.advance("NEW", receiptDelivered, now.Add(receiptStateTTL))
+	if len(states.states) != 1 {
+		t.Errorf("len(states) = %d after pruning, want 1", len(states.states))
+	}
+}
@@ -0,0 +1,399 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2024 Ludvig Rhodin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+package connector
+
+// Relay fallback for CloudKit backfill (relay_backfill_fallback).
+//
+// chatdb_backfill_fallback needs the bridge to run on the Mac. A bridge
+// anywhere else whose hardware key points at a nac-relay can read the same
+// chat.db through the relay's GET /messages instead. Like the chat.db
+// fallback, FetchMessages keeps CloudKit as the source and only a portal
+// CloudKit has no messages for at all is backfilled from the relay, in both
+// directions. The relay only hands over message text, so attachments,
+// tapbacks and system messages of those chats aren't backfilled.
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+
+	"github.com/lrhodin/imessage/imessage"
+)
+
+// relayBackfillPageLimit is the page size asked of /messages, the most the
+// relay hands out per page.
+const relayBackfillPageLimit = 1000
+
+// relayMessage is one chat.db message as the relay's /messages returns it.
+type relayMessage struct {
+	RowID          int64  `json:"rowid"`
+	GUID           string `json:"guid"`
+	ChatGUID       string `json:"chat_guid"`
+	Sender         string `json:"sender"`
+	IsFromMe       bool   `json:"is_from_me"`
+	Service        string `json:"service"`
+	Text           string `json:"text"`
+	Timestamp      int64  `json:"timestamp_ms"`
+	ItemType       int    `json:"item_type"`
+	AssociatedType int    `json:"associated_message_type"`
+}
+
+// relayMessagesPage is a /messages response.
+type relayMessagesPage struct {
+	Messages  []relayMessage `json:"messages"`
+	NextAfter int64          `json:"next_after"`
+}
+
+// relayBackfillSource is the relay a login backfills from.
+type relayBackfillSource struct {
+	client      *http.Client
+	healthURL   string
+	messagesURL string
+	token       string
+}
+
+// relayMessagesTarget extracts the relay's /messages URL, bearer token and
+// pinned certificate fingerprint from a hardware key. messagesURL is empty
+// for keys without a relay or without a relay token.
+func relayMessagesTarget(hardwareKey string) (messagesURL, token, certFP string, err error) {
+	if hardwareKey == "" {
+		return "", "", "", nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(stripNonBase64(hardwareKey))
+	if err != nil {
+		return "", "", "", fmt.Errorf("hardware key is not valid base64: %w", err)
+	}
+	var cfg struct {
+		NACRelayURL string `json:"nac_relay_url"`
+		RelayToken  string `json:"relay_token"`
+		RelayCertFP string `json:"relay_cert_fp"`
+	}
+	if err = json.Unmarshal(decoded, &cfg); err != nil {
+		return "", "", "", fmt.Errorf("failed to parse hardware key: %w", err)
+	}
+	if cfg.NACRelayURL == "" || cfg.RelayToken == "" {
+		return "", "", "", nil
+	}
+	u, err := url.Parse(cfg.NACRelayURL)
+	if err != nil {
+		return "", "", "", fmt.Errorf("invalid relay URL: %w", err)
+	}
+	u.Path = "/messages"
+	u.RawQuery = ""
+	return u.String(), cfg.RelayToken, strings.ToLower(cfg.RelayCertFP), nil
+}
+
+// newRelayBackfillSource returns the relay of a hardware key, or nil for
+// keys without one.
+func newRelayBackfillSource(hardwareKey string) (*relayBackfillSource, error) {
+	messagesURL, token, certFP, err := relayMessagesTarget(hardwareKey)
+	if err != nil || messagesURL == "" {
+		return nil, err
+	}
+	healthURL, err := relayHealthURL(messagesURL)
+	if err != nil {
+		return nil, err
+	}
+	return &relayBackfillSource{
+		client:      newRelayProbeClient(certFP),
+		healthURL:   healthURL,
+		messagesURL: messagesURL,
+		token:       token,
+	}, nil
+}
+
+// fetchPage fetches one /messages page of a chat. query holds the window
+// parameters (since_ms, before_ms, newest) on top of chat_guid and limit.
+func (r *relayBackfillSource) fetchPage(ctx context.Context, chatGUID string, query url.Values, limit int) (*relayMessagesPage, error) {
+	query.Set("chat_guid", chatGUID)
+	query.Set("limit", strconv.Itoa(limit))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.messagesURL+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+r.token)
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusServiceUnavailable:
+		return nil, fmt.Errorf("relay can't read chat.db (does it have Full Disk Access?)")
+	default:
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	var page relayMessagesPage
+	if err = json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		return nil, fmt.Errorf("failed to parse /messages response: %w", err)
+	}
+	return &page, nil
+}
+
+// fetchSince returns every message of a chat dated after since, or the
+// whole chat for a zero since, paging by ROWID.
+func (r *relayBackfillSource) fetchSince(ctx context.Context, chatGUID string, since time.Time) ([]relayMessage, error) {
+	var messages []relayMessage
+	var after int64
+	for {
+		query := url.Values{"after": {strconv.FormatInt(after, 10)}}
+		if !since.IsZero() {
+			query.Set("since_ms", strconv.FormatInt(since.UnixMilli(), 10))
+		}
+		page, err := r.fetchPage(ctx, chatGUID, query, relayBackfillPageLimit)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, page.Messages...)
+		if len(page.Messages) < relayBackfillPageLimit || page.NextAfter <= after {
+			return messages, nil
+		}
+		after = page.NextAfter
+	}
+}
+
+// fetchNewest returns the newest limit messages of a chat dated before
+// before, or the newest of the whole chat for a zero before. limit is
+// capped at relayBackfillPageLimit.
+func (r *relayBackfillSource) fetchNewest(ctx context.Context, chatGUID string, before time.Time, limit int) ([]relayMessage, error) {
+	query := url.Values{"newest": {"true"}}
+	if !before.IsZero() {
+		query.Set("before_ms", strconv.FormatInt(before.UnixMilli(), 10))
+	}
+	page, err := r.fetchPage(ctx, chatGUID, query, min(limit, relayBackfillPageLimit))
+	if err != nil {
+		return nil, err
+	}
+	return page.Messages, nil
+}
+
+// useRelayBackfillFallback decides whether a portal on CloudKit backfill is
+// backfilled from the relay. Like for the chat.db fallback, a failed
+// CloudKit lookup doesn't count as empty.
+func useRelayBackfillFallback(enabled, hasRelay, cloudHasMessages bool, cloudErr error) bool {
+	return enabled && hasRelay && cloudErr == nil && !cloudHasMessages
+}
+
+// relayGroupChatGUIDs returns the chat GUIDs a group's messages may be
+// under in chat.db, from its chat identifier (e.g. "chat123456789").
+func relayGroupChatGUIDs(groupChatID string) []string {
+	if groupChatID == "" {
+		return nil
+	}
+	return []string{
+		"any;+;" + groupChatID,
+		"iMessage;+;" + groupChatID,
+		"SMS;+;" + groupChatID,
+	}
+}
+
+// sortRelayMessages orders messages by time, then ROWID. ROWIDs don't
+// follow message time (synced and imported messages get new ones), so the
+// relay's ROWID order can't be windowed by time as is.
+func sortRelayMessages(messages []relayMessage) {
+	sort.Slice(messages, func(i, j int) bool {
+		if messages[i].Timestamp != messages[j].Timestamp {
+			return messages[i].Timestamp < messages[j].Timestamp
+		}
+		return messages[i].RowID < messages[j].RowID
+	})
+}
+
+// relayBackfillWindow picks what one FetchMessages call returns from the
+// relay messages of a portal's chats, the way the chat.db backfill does:
+// without an anchor the newest maxInitial messages, forward everything
+// after the anchor, and backward the count messages before it. messages is
+// sorted in place first.
+func relayBackfillWindow(messages []relayMessage, anchor time.Time, forward bool, count, maxInitial int) []relayMessage {
+	sortRelayMessages(messages)
+	switch {
+	case anchor.IsZero():
+		if len(messages) > maxInitial {
+			messages = messages[len(messages)-maxInitial:]
+		}
+		return messages
+	case forward:
+		start := sort.Search(len(messages), func(i int) bool {
+			return messages[i].Timestamp > anchor.UnixMilli()
+		})
+		return messages[start:]
+	default:
+		end := sort.Search(len(messages), func(i int) bool {
+			return messages[i].Timestamp >= anchor.UnixMilli()
+		})
+		return messages[max(0, end-count):end]
+	}
+}
+
+// relayBackfillFallback returns the relay a portal should be backfilled
+// from because CloudKit has nothing for it, or nil. A relay that doesn't
+// answer leaves the portal to CloudKit.
+func (c *IMClient) relayBackfillFallback(ctx context.Context, portalID string) *relayBackfillSource {
+	enabled := c.Main.Config.RelayBackfillFallback
+	if !enabled || c.cloudStore == nil {
+		return nil
+	}
+	log := zerolog.Ctx(ctx)
+	source, err := newRelayBackfillSource(c.connectedHardwareKey())
+	if err != nil {
+		log.Warn().Err(err).Msg("Can't backfill from the NAC relay")
+	}
+	hasMessages, err := c.cloudStore.hasPortalMessages(ctx, portalID)
+	if !useRelayBackfillFallback(enabled, source != nil, hasMessages, err) {
+		return nil
+	}
+	probeCtx, cancel := context.WithTimeout(ctx, relayProbeTimeout)
+	err = probeRelay(probeCtx, source.client, source.healthURL)
+	cancel()
+	if err != nil {
+		log.Warn().Err(err).Str("portal_id", portalID).Msg("NAC relay unreachable, not backfilling from it")
+		return nil
+	}
+	return source
+}
+
+// fetchRelayMessages is FetchMessages for a portal backfilled from the
+// relay.
+func (c *IMClient) fetchRelayMessages(ctx context.Context, params bridgev2.FetchMessagesParams, source *relayBackfillSource) (*bridgev2.FetchMessagesResponse, error) {
+	log := zerolog.Ctx(ctx)
+	portalID := string(params.Portal.ID)
+	var chatGUIDs []string
+	if isGroupPortalID(portalID) {
+		chatGUIDs = relayGroupChatGUIDs(c.cloudStore.getChatIdentifierByPortalID(ctx, portalID))
+	} else {
+		// Like the chat.db backfill, a merged contact's DM gets the
+		// history of all its numbers.
+		chatGUIDs = c.getContactChatGUIDs(portalID)
+	}
+	if len(chatGUIDs) == 0 {
+		log.Warn().Str("portal_id", portalID).Msg("Could not find chat GUID for portal")
+		return &bridgev2.FetchMessagesResponse{HasMore: false, Forward: params.Forward}, nil
+	}
+
+	// A backward call asks each chat for just the newest messages before the
+	// anchor, a forward one for those after it; the window below then cuts
+	// the merged chats down to one answer. A page is the most a backward
+	// call can get, so its count is capped to that and HasMore stays right.
+	count := params.Count
+	if count <= 0 {
+		count = 50
+	}
+	maxInitial := min(c.Main.Bridge.Config.Backfill.MaxInitialMessages, relayBackfillPageLimit)
+	var anchor time.Time
+	if params.AnchorMessage != nil {
+		anchor = params.AnchorMessage.Timestamp
+	}
+	if !params.Forward {
+		count = min(count, relayBackfillPageLimit)
+	}
+	var messages []relayMessage
+	var lastErr error
+	for _, chatGUID := range chatGUIDs {
+		var msgs []relayMessage
+		var err error
+		switch {
+		case anchor.IsZero():
+			msgs, err = source.fetchNewest(ctx, chatGUID, time.Time{}, maxInitial)
+		case params.Forward:
+			msgs, err = source.fetchSince(ctx, chatGUID, anchor)
+		default:
+			msgs, err = source.fetchNewest(ctx, chatGUID, anchor, count)
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		messages = append(messages, msgs...)
+	}
+	if len(messages) == 0 && lastErr != nil {
+		log.Error().Err(lastErr).Strs("chat_guids", chatGUIDs).Msg("Failed to fetch messages from the NAC relay")
+		return nil, fmt.Errorf("failed to fetch messages from the relay: %w", lastErr)
+	}
+	messages = relayBackfillWindow(messages, anchor, params.Forward, count, maxInitial)
+	fetched := len(messages)
+	log.Info().Strs("chat_guids", chatGUIDs).Int("message_count", fetched).Bool("forward", params.Forward).
+		Msg("Got messages from the NAC relay")
+
+	var seam *backfillSeam
+	if !params.Forward {
+		var err error
+		if seam, err = c.loadBackfillSeam(ctx, params.Portal.PortalKey); err != nil {
+			log.Warn().Err(err).Str("portal_id", portalID).Msg("Failed to load backfill seam")
+		}
+	}
+
+	intent := c.Main.Bridge.Bot
+	backfillMessages := make([]*bridgev2.BackfillMessage, 0, len(messages))
+	for _, rm := range messages {
+		msg := rm.chatDBMessage()
+		if msg == nil || seam.excludes(msg.GUID, msg.Time) {
+			continue
+		}
+		sender := chatDBMakeEventSender(msg, c)
+		if sender.Sender == "" && !sender.IsFromMe {
+			continue
+		}
+		sender = c.canonicalizeDMSender(params.Portal.PortalKey, sender)
+		cm, err := convertChatDBMessage(ctx, params.Portal, intent, msg)
+		if err != nil {
+			continue
+		}
+		converted := len(backfillMessages)
+		backfillMessages = append(backfillMessages, &bridgev2.BackfillMessage{
+			ConvertedMessage: cm,
+			Sender:           sender,
+			ID:               makeMessageID(msg.GUID),
+			TxnID:            networkid.TransactionID(msg.GUID),
+			Timestamp:        msg.Time,
+		})
+		if c.Main.Config.MessageServiceInBackfill {
+			markMessageService(backfillMessages[converted:], chatDBMessageService(msg))
+		}
+	}
+
+	return &bridgev2.FetchMessagesResponse{
+		Messages:                backfillMessages,
+		HasMore:                 fetched >= count,
+		Forward:                 params.Forward,
+		AggressiveDeduplication: params.Forward,
+	}, nil
+}
+
+// chatDBMessage returns m as a text-only chat.db message, or nil for rows
+// the relay fallback doesn't bridge: system messages, tapbacks and other
+// messages acting on another one, and messages without text.
+func (m *relayMessage) chatDBMessage() *imessage.Message {
+	if m.ItemType != 0 || m.AssociatedType != 0 {
+		return nil
+	}
+	text := strings.TrimSpace(strings.ReplaceAll(m.Text, "\uFFFC", ""))
+	if text == "" || m.GUID == "" {
+		return nil
+	}
+	return &imessage.Message{
+		GUID:     m.GUID,
+		Time:     time.UnixMilli(m.Timestamp),
+		Text:     text,
+		IsFromMe: m.IsFromMe,
+		Sender:   imessage.Identifier{LocalID: m.Sender, Service: m.Service},
+		Service:  m.Service,
+	}
+}
@@ -0,0 +1,242 @@
+package connector
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestUseRelayBackfillFallback(t *testing.T) {
+	lookupErr := errors.New("db locked")
+	tests := []struct {
+		name             string
+		enabled          bool
+		hasRelay         bool
+		cloudHasMessages bool
+		cloudErr         error
+		want             bool
+	}{
+		{"CloudKit empty, relay configured", true, true, false, nil, true},
+		{"CloudKit has messages", true, true, true, nil, false},
+		{"option off", false, true, false, nil, false},
+		{"no relay in the hardware key", true, false, false, nil, false},
+		{"CloudKit lookup failed", true, true, false, lookupErr, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := useRelayBackfillFallback(tt.enabled, tt.hasRelay, tt.cloudHasMessages, tt.cloudErr)
+			if got != tt.want {
+				t.Errorf("useRelayBackfillFallback() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRelayMessagesTarget(t *testing.T) {
+	key := func(json string) string { return base64.StdEncoding.EncodeToString([]byte(json)) }
+	tests := []struct {
+		name      string
+		key       string
+		wantURL   string
+		wantToken string
+		wantFP    string
+		wantErr   bool
+	}{
+		{"relay key", key(`{"nac_relay_url":"https://192.168.1.20:5001/validation-data","relay_token":"secret","relay_cert_fp":"ABCDEF"}`), "https://192.168.1.20:5001/messages", "secret", "abcdef", false},
+		{"relay without token", key(`{"nac_relay_url":"https://192.168.1.20:5001/validation-data"}`), "", "", "", false},
+		{"key without relay", key(`{"inner":{},"version":"14.5"}`), "", "", "", false},
+		{"no key", "", "", "", "", false},
+		{"garbage", "not base64!", "", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotURL, gotToken, gotFP, err := relayMessagesTarget(tt.key)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("relayMessagesTarget() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if gotURL != tt.wantURL || gotToken != tt.wantToken || gotFP != tt.wantFP {
+				t.Errorf("relayMessagesTarget() = (%q, %q, %q), want (%q, %q, %q)", gotURL, gotToken, gotFP, tt.wantURL, tt.wantToken, tt.wantFP)
+			}
+		})
+	}
+}
+
+func TestRelayBackfillWindow(t *testing.T) {
+	var history []relayMessage
+	for i := 1; i <= 5; i++ {
+		history = append(history, relayMessage{GUID: "m" + strconv.Itoa(i), Timestamp: int64(i) * 1000})
+	}
+	guids := func(msgs []relayMessage) []string {
+		out := []string{}
+		for _, msg := range msgs {
+			out = append(out, msg.GUID)
+		}
+		return out
+	}
+	tests := []struct {
+		name       string
+		anchor     time.Time
+		forward    bool
+		count      int
+		maxInitial int
+		want       []string
+	}{
+		{"initial, capped", time.Time{}, true, 50, 2, []string{"m4", "m5"}},
+		{"initial, uncapped", time.Time{}, true, 50, 100, []string{"m1", "m2", "m3", "m4", "m5"}},
+		{"forward after anchor", time.UnixMilli(3000), true, 1, 100, []string{"m4", "m5"}},
+		{"backward before anchor", time.UnixMilli(4000), false, 2, 100, []string{"m2", "m3"}},
+		{"backward at the start", time.UnixMilli(2000), false, 5, 100, []string{"m1"}},
+		{"backward before everything", time.UnixMilli(500), false, 5, 100, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The relay returns ROWID order, which needn't be time order.
+			shuffled := []relayMessage{history[3], history[0], history[4], history[2], history[1]}
+			got := guids(relayBackfillWindow(shuffled, tt.anchor, tt.forward, tt.count, tt.maxInitial))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("relayBackfillWindow() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRelayMessageChatDBMessage(t *testing.T) {
+	tests := []struct {
+		name     string
+		msg      relayMessage
+		wantText string
+	}{
+		{"text", relayMessage{GUID: "A", Text: " hi \uFFFC"}, "hi"},
+		{"tapback", relayMessage{GUID: "B", Text: "Loved “hi”", AssociatedType: 2000}, ""},
+		{"group rename", relayMessage{GUID: "C", Text: "Trip", ItemType: 2}, ""},
+		{"attachment only", relayMessage{GUID: "D", Text: "\uFFFC"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.msg.chatDBMessage()
+			if tt.wantText == "" {
+				if got != nil {
+					t.Errorf("chatDBMessage() = %+v, want nil", got)
+				}
+				return
+			}
+			if got == nil || got.Text != tt.wantText || got.GUID != tt.msg.GUID {
+				t.Errorf("chatDBMessage() = %+v, want text %q", got, tt.wantText)
+			}
+		})
+	}
+}
+
+func TestRelayBackfillSourceFetch(t *testing.T) {
+	const chatGUID = "iMessage;-;+15550000001"
+	total := relayBackfillPageLimit + 3
+	// Row n is dated n seconds after the epoch, so the window bounds are
+	// easy to check; the relay's SQL handles ROWIDs out of date order.
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		switch {
+		case r.URL.Path == "/health":
+			_, _ = w.Write([]byte("ok"))
+			return
+		case r.URL.Path != "/messages":
+			w.WriteHeader(http.StatusNotFound)
+			return
+		case r.Header.Get("Authorization") != "Bearer secret":
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		case query.Get("chat_guid") != chatGUID:
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		after, _ := strconv.ParseInt(query.Get("after"), 10, 64)
+		limit, _ := strconv.Atoi(query.Get("limit"))
+		since, _ := strconv.ParseInt(query.Get("since_ms"), 10, 64)
+		before, _ := strconv.ParseInt(query.Get("before_ms"), 10, 64)
+		var window []relayMessage
+		for rowID := int64(1); rowID <= int64(total); rowID++ {
+			ts := rowID * 1000
+			if rowID > after && ts > since && (before == 0 || ts < before) {
+				window = append(window, relayMessage{RowID: rowID, GUID: fmt.Sprint(rowID), Timestamp: ts})
+			}
+		}
+		page := relayMessagesPage{Messages: []relayMessage{}, NextAfter: after}
+		if query.Get("newest") == "true" {
+			page.Messages = window[max(0, len(window)-limit):]
+		} else if len(window) > 0 {
+			page.Messages = window[:min(limit, len(window))]
+			page.NextAfter = page.Messages[len(page.Messages)-1].RowID
+		}
+		_ = json.NewEncoder(w).Encode(page)
+	}))
+	defer srv.Close()
+	sum := sha256.Sum256(srv.Certificate().Raw)
+	key := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf(
+		`{"nac_relay_url":%q,"relay_token":"secret","relay_cert_fp":%q}`,
+		srv.URL+"/validation-data", hex.EncodeToString(sum[:]))))
+
+	source, err := newRelayBackfillSource(key)
+	if err != nil || source == nil {
+		t.Fatalf("newRelayBackfillSource() = %v, %v", source, err)
+	}
+	ctx := context.Background()
+	if err = probeRelay(ctx, source.client, source.healthURL); err != nil {
+		t.Errorf("probeRelay() error = %v", err)
+	}
+	rowIDs := func(msgs []relayMessage) []int64 {
+		out := []int64{}
+		for _, msg := range msgs {
+			out = append(out, msg.RowID)
+		}
+		return out
+	}
+
+	got, err := source.fetchSince(ctx, chatGUID, time.Time{})
+	if err != nil {
+		t.Fatalf("fetchSince() error = %v", err)
+	}
+	if len(got) != total || got[0].RowID != 1 || got[total-1].RowID != int64(total) {
+		t.Errorf("fetchSince() of the whole chat returned %d messages, want rows 1 to %d", len(got), total)
+	}
+	tests := []struct {
+		name  string
+		fetch func() ([]relayMessage, error)
+		want  []int64
+	}{
+		{"since the anchor", func() ([]relayMessage, error) {
+			return source.fetchSince(ctx, chatGUID, time.UnixMilli(int64(total-2)*1000))
+		}, []int64{int64(total - 1), int64(total)}},
+		{"newest", func() ([]relayMessage, error) {
+			return source.fetchNewest(ctx, chatGUID, time.Time{}, 2)
+		}, []int64{int64(total - 1), int64(total)}},
+		{"newest before the anchor", func() ([]relayMessage, error) {
+			return source.fetchNewest(ctx, chatGUID, time.UnixMilli(10_000), 3)
+		}, []int64{7, 8, 9}},
+	}
+	for _, tt := range tests {
+		got, err := tt.fetch()
+		if err != nil {
+			t.Fatalf("%s: error = %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(rowIDs(got), tt.want) {
+			t.Errorf("%s: got rows %v, want %v", tt.name, rowIDs(got), tt.want)
+		}
+	}
+
+	if _, err = source.fetchSince(ctx, "SMS;-;+15550000001", time.Time{}); err == nil {
+		t.Errorf("fetchSince() on a relay without chat.db access error = nil")
+	}
+	source.token = "wrong"
+	if _, err = source.fetchNewest(ctx, chatGUID, time.Time{}, 10); err == nil {
+		t.Errorf("fetchNewest() with a wrong token error = nil")
+	}
+}
@@ -0,0 +1,145 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2024 Ludvig Rhodin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+package connector
+
+// Relay discovery (relay_discovery).
+//
+// The NAC relay's URL is baked into the hardware key when it's extracted,
+// so on a LAN where the Mac's address changes the bridge loses the relay
+// and re-registration fails. With discovery on, LoadUserLogin probes the
+// relay at the key's URL, and if it doesn't answer, asks the LAN over mDNS
+// for relays started with -mdns. A relay presenting the certificate pinned
+// in the key is used in place of the configured URL for this connection.
+// Keys without a pinned certificate never use discovery, since anything on
+// the LAN can advertise a relay. The stored key is left alone, so the
+// configured URL is always tried first.
+//
+// While connected, the relay health monitor looks again whenever a probe
+// of the relay in use fails. If the pinned relay turns up at another
+// address, it asks bridgev2 to rebuild the client, whose LoadUserLogin then
+// picks up the new address.
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/lrhodin/imessage/pkg/relaydiscovery"
+)
+
+const (
+	relayDiscoveryProbeTimeout = 5 * time.Second
+	relayDiscoveryTimeout      = 3 * time.Second
+)
+
+// hardwareKeyWithRelayURL returns hardwareKey with its relay URL replaced,
+// keeping every other field.
+func hardwareKeyWithRelayURL(hardwareKey, relayURL string) (string, error) {
+	decoded, err := base64.StdEncoding.DecodeString(stripNonBase64(hardwareKey))
+	if err != nil {
+		return "", fmt.Errorf("hardware key is not valid base64: %w", err)
+	}
+	var fields map[string]json.RawMessage
+	if err = json.Unmarshal(decoded, &fields); err != nil {
+		return "", fmt.Errorf("failed to parse hardware key: %w", err)
+	}
+	fields["nac_relay_url"], err = json.Marshal(relayURL)
+	if err != nil {
+		return "", err
+	}
+	encoded, err := json.Marshal(fields)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(encoded), nil
+}
+
+// relayHealthURL returns the /health URL of a relay validation URL.
+func relayHealthURL(relayURL string) (string, error) {
+	u, err := url.Parse(relayURL)
+	if err != nil {
+		return "", err
+	}
+	u.Path = "/health"
+	u.RawQuery = ""
+	return u.String(), nil
+}
+
+// discoverRelayKey returns the hardware key to connect with: hardwareKey
+// itself, or a copy pointing at a relay found over mDNS when discovery is
+// on and the configured relay doesn't answer.
+func (c *IMConnector) discoverRelayKey(ctx context.Context, log zerolog.Logger, hardwareKey string) string {
+	if !c.Config.RelayDiscovery {
+		return hardwareKey
+	}
+	healthURL, certFP, err := relayHealthTarget(hardwareKey)
+	if err != nil || healthURL == "" {
+		return hardwareKey
+	}
+	probeCtx, cancel := context.WithTimeout(ctx, relayDiscoveryProbeTimeout)
+	err = probeRelay(probeCtx, newRelayProbeClient(certFP), healthURL)
+	cancel()
+	if err == nil {
+		return hardwareKey
+	}
+	log = log.With().Str("relay_health_url", healthURL).Logger()
+	log.Info().Err(err).Msg("Configured NAC relay didn't answer")
+	relayURL, ok := c.findRelay(ctx, log, hardwareKey)
+	if !ok {
+		return hardwareKey
+	}
+	newKey, err := hardwareKeyWithRelayURL(hardwareKey, relayURL)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to point hardware key at the discovered relay")
+		return hardwareKey
+	}
+	return newKey
+}
+
+// findRelay looks over mDNS for the relay pinned in hardwareKey and returns
+// its validation URL if it's somewhere other than the key's URL and
+// answers there. Keys without a pinned certificate are refused.
+func (c *IMConnector) findRelay(ctx context.Context, log zerolog.Logger, hardwareKey string) (string, bool) {
+	healthURL, certFP, err := relayHealthTarget(hardwareKey)
+	if err != nil || healthURL == "" {
+		return "", false
+	} else if certFP == "" {
+		log.Warn().Msg("Hardware key has no pinned relay certificate, not looking for the relay over mDNS")
+		return "", false
+	}
+	services, err := relaydiscovery.Discover(ctx, relayDiscoveryTimeout)
+	if err != nil {
+		log.Info().Err(err).Msg("No NAC relay found over mDNS")
+		return "", false
+	}
+	svc, ok := relaydiscovery.Match(services, certFP)
+	if !ok {
+		log.Warn().Int("relays", len(services)).Msg("No relay found over mDNS matches this hardware key")
+		return "", false
+	}
+	relayURL := svc.URL()
+	newHealthURL, err := relayHealthURL(relayURL)
+	if err != nil || newHealthURL == healthURL {
+		return "", false
+	}
+	probeCtx, cancel := context.WithTimeout(ctx, relayDiscoveryProbeTimeout)
+	err = probeRelay(probeCtx, newRelayProbeClient(certFP), newHealthURL)
+	cancel()
+	if err != nil {
+		log.Warn().Err(err).Str("relay_url", relayURL).Msg("Relay found over mDNS doesn't answer either")
+		return "", false
+	}
+	log.Info().Str("relay_url", relayURL).Str("relay_instance", svc.Instance).Msg("Found NAC relay over mDNS")
+	return relayURL, true
+}
@@ -0,0 +1,75 @@
+package connector
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+func TestHardwareKeyWithRelayURL(t *testing.T) {
+	orig := map[string]any{
+		"nac_relay_url": "https://192.168.1.5:5001/validation-data",
+		"relay_cert_fp": "ABCD",
+		"relay_token":   "secret",
+		"inner":         map[string]any{"serial": "C02XYZ"},
+	}
+	raw, _ := json.Marshal(orig)
+	key := base64.StdEncoding.EncodeToString(raw)
+
+	got, err := hardwareKeyWithRelayURL(key, "https://192.168.1.9:5001/validation-data")
+	if err != nil {
+		t.Fatalf("hardwareKeyWithRelayURL() error = %v", err)
+	}
+	decoded, err := base64.StdEncoding.DecodeString(got)
+	if err != nil {
+		t.Fatalf("hardwareKeyWithRelayURL() returned invalid base64: %v", err)
+	}
+	var fields map[string]any
+	if err = json.Unmarshal(decoded, &fields); err != nil {
+		t.Fatalf("hardwareKeyWithRelayURL() returned invalid JSON: %v", err)
+	}
+	orig["nac_relay_url"] = "https://192.168.1.9:5001/validation-data"
+	if !reflect.DeepEqual(fields, orig) {
+		t.Errorf("hardwareKeyWithRelayURL() = %v, want %v", fields, orig)
+	}
+	if healthURL, certFP, err := relayHealthTarget(got); err != nil || healthURL != "https://192.168.1.9:5001/health" || certFP != "abcd" {
+		t.Errorf("relayHealthTarget(new key) = %q, %q, %v, want the new relay's health URL", healthURL, certFP, err)
+	}
+
+	if _, err = hardwareKeyWithRelayURL("not base64!", "https://x"); err == nil {
+		t.Errorf("hardwareKeyWithRelayURL(invalid key) error = nil, want error")
+	}
+}
+
+func TestDiscoverRelayKeyUnchanged(t *testing.T) {
+	noRelay := base64.StdEncoding.EncodeToString([]byte(`{"inner":{}}`))
+	tests := []struct {
+		name    string
+		enabled bool
+		key     string
+	}{
+		{"discovery off", false, "key"},
+		{"key without relay", true, noRelay},
+		{"invalid key", true, "not base64!"},
+	}
+	for _, tt := range tests {
+		c := &IMConnector{Config: IMConfig{RelayDiscovery: tt.enabled}}
+		if got := c.discoverRelayKey(context.Background(), zerolog.Nop(), tt.key); got != tt.key {
+			t.Errorf("discoverRelayKey(%s) = %q, want the key unchanged", tt.name, got)
+		}
+	}
+}
+
+func TestFindRelayRequiresPin(t *testing.T) {
+	// Anything on the LAN can answer mDNS, so a key without a pinned
+	// certificate must not look at all.
+	unpinned := base64.StdEncoding.EncodeToString([]byte(`{"inner":{},"nac_relay_url":"https://127.0.0.1:1/validation-data"}`))
+	c := &IMConnector{Config: IMConfig{RelayDiscovery: true}}
+	if relayURL, ok := c.findRelay(context.Background(), zerolog.Nop(), unpinned); ok {
+		t.Errorf("findRelay(unpinned key) = %q, true, want no relay", relayURL)
+	}
+}
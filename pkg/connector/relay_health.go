@@ -0,0 +1,272 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2024 Ludvig Rhodin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+package connector
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridgev2/status"
+)
+
+// Relay health monitor (relay_health_check_minutes).
+//
+// Hardware keys extracted from an Apple Silicon Mac carry the URL of the
+// nac-relay running on that Mac, which the bridge calls for NAC validation
+// data whenever it (re-)registers with IDS. If the Mac goes to sleep or
+// offline, nothing fails until the next registration — which then fails
+// with no earlier sign of why. The monitor probes the relay's unauthenticated
+// /health endpoint, backing off while it's unreachable, and after
+// relayOfflineAfterFailures failed probes in a row reports a bridge state
+// warning. The warning clears on its own once a probe succeeds again.
+
+const (
+	// relayOfflineAfterFailures is how many probes in a row must fail
+	// before the relay is reported offline, so a single dropped request
+	// or a Mac waking from sleep doesn't raise a warning.
+	relayOfflineAfterFailures = 3
+	// relayProbeMaxBackoff caps the delay between probes of an unreachable
+	// relay.
+	relayProbeMaxBackoff = time.Hour
+	relayProbeTimeout    = 15 * time.Second
+
+	relayOfflineErrorCode status.BridgeStateErrorCode = "im-relay-offline"
+	relayMovedErrorCode   status.BridgeStateErrorCode = "im-relay-moved"
+)
+
+// relayTransition is a change in the relay's reported reachability.
+type relayTransition int
+
+const (
+	relayNoChange relayTransition = iota
+	relayWentOffline
+	relayBackOnline
+)
+
+// relayHealth tracks consecutive probe failures. The zero value is a relay
+// assumed reachable.
+type relayHealth struct {
+	failures int
+	offline  bool
+}
+
+// observe records a probe result and returns the transition to report, if
+// any.
+func (h *relayHealth) observe(reachable bool) relayTransition {
+	if reachable {
+		h.failures = 0
+		if h.offline {
+			h.offline = false
+			return relayBackOnline
+		}
+		return relayNoChange
+	}
+	h.failures++
+	if !h.offline && h.failures >= relayOfflineAfterFailures {
+		h.offline = true
+		return relayWentOffline
+	}
+	return relayNoChange
+}
+
+// nextProbe returns the delay before the next probe: the configured
+// interval while the relay answers, doubling with each failure after that
+// up to relayProbeMaxBackoff (or the interval, if that's longer).
+func (h *relayHealth) nextProbe(interval time.Duration) time.Duration {
+	maxDelay := relayProbeMaxBackoff
+	if interval > maxDelay {
+		maxDelay = interval
+	}
+	delay := interval
+	for i := 0; i < h.failures && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+	return delay
+}
+
+// relayHealthTarget extracts the relay's health URL and pinned certificate
+// fingerprint from a hardware key. healthURL is empty for keys without a
+// relay.
+func relayHealthTarget(hardwareKey string) (healthURL, certFP string, err error) {
+	if hardwareKey == "" {
+		return "", "", nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(stripNonBase64(hardwareKey))
+	if err != nil {
+		return "", "", fmt.Errorf("hardware key is not valid base64: %w", err)
+	}
+	var cfg struct {
+		NACRelayURL string `json:"nac_relay_url"`
+		RelayCertFP string `json:"relay_cert_fp"`
+	}
+	if err = json.Unmarshal(decoded, &cfg); err != nil {
+		return "", "", fmt.Errorf("failed to parse hardware key: %w", err)
+	}
+	if cfg.NACRelayURL == "" {
+		return "", "", nil
+	}
+	healthURL, err = relayHealthURL(cfg.NACRelayURL)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid relay URL: %w", err)
+	}
+	return healthURL, strings.ToLower(cfg.RelayCertFP), nil
+}
+
+// newRelayProbeClient returns an HTTP client for the relay. The relay uses a
+// self-signed certificate, so it's pinned by SHA-256 fingerprint when the
+// hardware key has one; otherwise any certificate is accepted, the same as
+// the NAC validation requests themselves.
+func newRelayProbeClient(certFP string) *http.Client {
+	tlsConfig := &tls.Config{InsecureSkipVerify: true}
+	if certFP != "" {
+		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return errors.New("relay presented no certificate")
+			}
+			sum := sha256.Sum256(rawCerts[0])
+			if hex.EncodeToString(sum[:]) != certFP {
+				return errors.New("relay certificate doesn't match the pinned fingerprint")
+			}
+			return nil
+		}
+	}
+	return &http.Client{
+		Timeout:   relayProbeTimeout,
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+	}
+}
+
+// probeRelay reports whether the relay's health endpoint answered OK.
+func probeRelay(ctx context.Context, client *http.Client, healthURL string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, healthURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// connectedHardwareKey returns the hardware key this login connected with,
+// so a relay found by relay discovery is the one used, falling back to the
+// login's own key.
+func (c *IMClient) connectedHardwareKey() string {
+	if c.hardwareKey != "" {
+		return c.hardwareKey
+	}
+	if meta, ok := c.UserLogin.Metadata.(*UserLoginMetadata); ok {
+		return meta.HardwareKey
+	}
+	return ""
+}
+
+// runRelayHealthMonitor probes the relay of this login's hardware key (as
+// connected with, so a relay found by relay discovery is the one probed) until
+// stop is closed. With relay_discovery on, a failed probe also looks for the
+// relay over mDNS, and if it moved the monitor hands off to a client rebuild
+// and returns. Returns immediately for logins without a relay or when
+// relay_health_check_minutes is zero.
+func (c *IMClient) runRelayHealthMonitor(stop <-chan struct{}, log zerolog.Logger) {
+	minutes := c.Main.Config.RelayHealthCheckMinutes
+	if _, ok := c.UserLogin.Metadata.(*UserLoginMetadata); minutes <= 0 || !ok {
+		return
+	}
+	hardwareKey := c.connectedHardwareKey()
+	healthURL, certFP, err := relayHealthTarget(hardwareKey)
+	if err != nil {
+		log.Warn().Err(err).Msg("Can't monitor NAC relay health")
+		return
+	} else if healthURL == "" {
+		return
+	}
+	interval := time.Duration(minutes) * time.Minute
+	client := newRelayProbeClient(certFP)
+	log = log.With().Str("relay_health_url", healthURL).Logger()
+	log.Info().Dur("interval", interval).Msg("Monitoring NAC relay health")
+
+	var health relayHealth
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-timer.C:
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), relayProbeTimeout)
+		err = probeRelay(ctx, client, healthURL)
+		cancel()
+		if err != nil {
+			log.Debug().Err(err).Int("failures", health.failures+1).Msg("NAC relay probe failed")
+			if c.Main.Config.RelayDiscovery {
+				if relayURL, found := c.Main.findRelay(context.Background(), log, hardwareKey); found {
+					// Like the receive-wedge watchdog: have bridgev2 rebuild
+					// the client, whose LoadUserLogin finds the relay again.
+					log.Info().Str("relay_url", relayURL).Msg("NAC relay moved, rebuilding client to use it")
+					c.UserLogin.BridgeState.Send(status.BridgeState{
+						StateEvent: status.StateUnknownError,
+						Error:      relayMovedErrorCode,
+						Message:    "iMessage relay on the Mac moved to a new address; reconnecting",
+					})
+					return
+				}
+			}
+		}
+		switch health.observe(err == nil) {
+		case relayWentOffline:
+			log.Warn().Err(err).Int("failures", health.failures).Msg("NAC relay is unreachable")
+			c.reportRelayState(true)
+			c.reportErrorNotice(errorNoticeRelayOffline, "", err)
+		case relayBackOnline:
+			log.Info().Msg("NAC relay is reachable again")
+			c.reportRelayState(false)
+		}
+		timer.Reset(health.nextProbe(interval))
+	}
+}
+
+// reportRelayState raises or clears the relay-offline warning. The warning
+// rides on the connected state, since messaging itself still works; it's
+// only sent while the login is connected so it never masks a real
+// disconnect, and only cleared if it's the state currently shown.
+func (c *IMClient) reportRelayState(offline bool) {
+	prev := c.UserLogin.BridgeState.GetPrev()
+	if prev.StateEvent != status.StateConnected {
+		return
+	}
+	if offline {
+		c.UserLogin.BridgeState.Send(status.BridgeState{
+			StateEvent: status.StateConnected,
+			Error:      relayOfflineErrorCode,
+			Message:    "iMessage relay on the Mac is offline; re-registration will fail until it's reachable",
+		})
+	} else if prev.Error == relayOfflineErrorCode {
+		c.UserLogin.BridgeState.Send(status.BridgeState{StateEvent: status.StateConnected})
+	}
+}
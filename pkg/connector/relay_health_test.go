@@ -0,0 +1,140 @@
+package connector
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRelayHealthTransitions(t *testing.T) {
+	var h relayHealth
+	steps := []struct {
+		reachable bool
+		want      relayTransition
+	}{
+		{true, relayNoChange},
+		{false, relayNoChange},
+		{false, relayNoChange},
+		{false, relayWentOffline},
+		{false, relayNoChange},
+		{true, relayBackOnline},
+		{true, relayNoChange},
+		// A blip shorter than the threshold never reports offline.
+		{false, relayNoChange},
+		{true, relayNoChange},
+		{false, relayNoChange},
+		{false, relayNoChange},
+		{false, relayWentOffline},
+	}
+	for i, step := range steps {
+		if got := h.observe(step.reachable); got != step.want {
+			t.Errorf("step %d: observe(%v) = %v, want %v", i, step.reachable, got, step.want)
+		}
+	}
+}
+
+func TestRelayHealthNextProbe(t *testing.T) {
+	interval := 5 * time.Minute
+	tests := []struct {
+		failures int
+		interval time.Duration
+		want     time.Duration
+	}{
+		{0, interval, interval},
+		{1, interval, 10 * time.Minute},
+		{3, interval, 40 * time.Minute},
+		{4, interval, relayProbeMaxBackoff},
+		{50, interval, relayProbeMaxBackoff},
+		{2, 2 * time.Hour, 2 * time.Hour},
+	}
+	for _, tt := range tests {
+		h := relayHealth{failures: tt.failures}
+		if got := h.nextProbe(tt.interval); got != tt.want {
+			t.Errorf("nextProbe(%v) after %d failures = %v, want %v", tt.interval, tt.failures, got, tt.want)
+		}
+	}
+}
+
+func TestRelayHealthTarget(t *testing.T) {
+	key := func(json string) string { return base64.StdEncoding.EncodeToString([]byte(json)) }
+	tests := []struct {
+		name    string
+		key     string
+		wantURL string
+		wantFP  string
+		wantErr bool
+	}{
+		{"relay key", key(`{"nac_relay_url":"https://192.168.1.20:5001/validation-data","relay_cert_fp":"ABCDEF"}`), "https://192.168.1.20:5001/health", "abcdef", false},
+		{"key without relay", key(`{"inner":{},"version":"14.5"}`), "", "", false},
+		{"no key", "", "", "", false},
+		{"garbage", "not base64!", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotURL, gotFP, err := relayHealthTarget(tt.key)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("relayHealthTarget() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if gotURL != tt.wantURL || gotFP != tt.wantFP {
+				t.Errorf("relayHealthTarget() = (%q, %q), want (%q, %q)", gotURL, gotFP, tt.wantURL, tt.wantFP)
+			}
+		})
+	}
+}
+
+func TestProbeRelay(t *testing.T) {
+	var healthy atomic.Bool
+	healthy.Store(true)
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" || !healthy.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+	sum := sha256.Sum256(srv.Certificate().Raw)
+	pinned := hex.EncodeToString(sum[:])
+	ctx := context.Background()
+
+	// reachable → unreachable → reachable, as seen by the monitor.
+	var h relayHealth
+	client := newRelayProbeClient(pinned)
+	if err := probeRelay(ctx, client, srv.URL+"/health"); err != nil {
+		t.Fatalf("probeRelay() on healthy relay error = %v", err)
+	}
+	h.observe(true)
+	healthy.Store(false)
+	var last relayTransition
+	for i := 0; i < relayOfflineAfterFailures; i++ {
+		err := probeRelay(ctx, client, srv.URL+"/health")
+		if err == nil {
+			t.Fatalf("probeRelay() on unhealthy relay error = nil")
+		}
+		last = h.observe(false)
+	}
+	if last != relayWentOffline {
+		t.Errorf("transition after %d failed probes = %v, want relayWentOffline", relayOfflineAfterFailures, last)
+	}
+	healthy.Store(true)
+	if err := probeRelay(ctx, client, srv.URL+"/health"); err != nil {
+		t.Fatalf("probeRelay() on recovered relay error = %v", err)
+	}
+	if got := h.observe(true); got != relayBackOnline {
+		t.Errorf("transition after recovery = %v, want relayBackOnline", got)
+	}
+
+	if err := probeRelay(ctx, newRelayProbeClient(strings.Repeat("0", len(pinned))), srv.URL+"/health"); err == nil {
+		t.Errorf("probeRelay() with a mismatched pin error = nil, want error")
+	}
+	if err := probeRelay(ctx, newRelayProbeClient(""), srv.URL+"/health"); err != nil {
+		t.Errorf("probeRelay() without a pin error = %v", err)
+	}
+}
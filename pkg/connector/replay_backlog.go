@@ -0,0 +1,187 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2024 Ludvig Rhodin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+package connector
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/bridgev2/simplevent"
+
+	"github.com/lrhodin/imessage/pkg/rustpushgo"
+)
+
+// Replayed backlogs (realtime_max_age_hours).
+//
+// After a long disconnect APNs replays the backlog through the live path.
+// A message past the cutoff isn't bridged live, where it would land at the
+// bottom of its room as if new and notify. It's held per portal for
+// replayBacklogDelay, so a replayed backlog is collected into batches, and
+// each batch is handed to bridgev2 as a forward backfill: a ChatResync
+// carrying the messages as its bundled backfill data, which FetchMessages
+// converts like any other backfill. The parts are marked historical like
+// quiet_bootstrap's, so with its push rule installed they don't notify
+// either. As with every forward backfill, bridgev2 drops messages older
+// than the newest one already in the room, and nothing is bridged while
+// backfill is disabled in the bridge config.
+
+// replayBacklogDelay is how long replayed messages for a portal are
+// collected before they're backfilled.
+const replayBacklogDelay = 5 * time.Second
+
+// replayedMessage is one live message routed to backfill, with the sender
+// handleMessage resolved for it.
+type replayedMessage struct {
+	Msg    rustpushgo.WrappedMessage
+	Sender bridgev2.EventSender
+}
+
+// replayBacklog is the BundledBackfillData of a replayed batch, oldest
+// message first.
+type replayBacklog struct {
+	Messages []replayedMessage
+}
+
+// pendingReplay is a portal's batch that hasn't been backfilled yet.
+type pendingReplay struct {
+	createPortal bool
+	messages     []replayedMessage
+}
+
+// replayBacklogState holds the pending batches. The zero value is ready to
+// use.
+type replayBacklogState struct {
+	mu      sync.Mutex
+	pending map[networkid.PortalKey]*pendingReplay
+}
+
+// add appends msg to the batch of portalKey and reports whether it started
+// a new batch.
+func (s *replayBacklogState) add(portalKey networkid.PortalKey, createPortal bool, msg replayedMessage) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pending == nil {
+		s.pending = make(map[networkid.PortalKey]*pendingReplay)
+	}
+	batch, ok := s.pending[portalKey]
+	if !ok {
+		batch = &pendingReplay{}
+		s.pending[portalKey] = batch
+	}
+	batch.createPortal = batch.createPortal || createPortal
+	batch.messages = append(batch.messages, msg)
+	return !ok
+}
+
+// take removes and returns the batch of portalKey, oldest message first.
+func (s *replayBacklogState) take(portalKey networkid.PortalKey) *pendingReplay {
+	s.mu.Lock()
+	batch := s.pending[portalKey]
+	delete(s.pending, portalKey)
+	s.mu.Unlock()
+	if batch != nil {
+		sort.SliceStable(batch.messages, func(i, j int) bool {
+			return batch.messages[i].Msg.TimestampMs < batch.messages[j].Msg.TimestampMs
+		})
+	}
+	return batch
+}
+
+// queueReplayedMessage holds a live message past realtime_max_age_hours for
+// backfill, scheduling its portal's batch if it's the first one.
+func (c *IMClient) queueReplayedMessage(log zerolog.Logger, portalKey networkid.PortalKey, createPortal bool, sender bridgev2.EventSender, msg rustpushgo.WrappedMessage) {
+	if !c.replayBacklogs.add(portalKey, createPortal, replayedMessage{Msg: msg, Sender: sender}) {
+		return
+	}
+	time.AfterFunc(replayBacklogDelay, func() {
+		c.flushReplayBacklog(log, portalKey)
+	})
+}
+
+// flushReplayBacklog queues the forward backfill of portalKey's batch.
+func (c *IMClient) flushReplayBacklog(log zerolog.Logger, portalKey networkid.PortalKey) {
+	batch := c.replayBacklogs.take(portalKey)
+	if batch == nil || len(batch.messages) == 0 {
+		return
+	}
+	log.Info().
+		Str("portal_id", string(portalKey.ID)).
+		Int("messages", len(batch.messages)).
+		Msg("Backfilling messages replayed past realtime_max_age_hours")
+	c.UserLogin.QueueRemoteEvent(&simplevent.ChatResync{
+		EventMeta: simplevent.EventMeta{
+			Type:         bridgev2.RemoteEventChatResync,
+			PortalKey:    portalKey,
+			CreatePortal: batch.createPortal,
+			Timestamp:    time.Now(),
+			LogContext: func(lc zerolog.Context) zerolog.Context {
+				return lc.Str("source", "replay_backlog")
+			},
+		},
+		CheckNeedsBackfillFunc: func(ctx context.Context, latestMessage *database.Message) (bool, error) {
+			return true, nil
+		},
+		BundledBackfillData: &replayBacklog{Messages: batch.messages},
+	})
+}
+
+// convertReplayBacklog converts a replayed batch into a forward backfill
+// response. Each message is split into parts the same way as live
+// (convertLiveText, convertLiveAttachment), with the bot intent uploading
+// media as in the other backfill paths; a part that fails to convert is
+// skipped. Every part is marked historical (see quiet_bootstrap.go).
+func (c *IMClient) convertReplayBacklog(ctx context.Context, portal *bridgev2.Portal, backlog *replayBacklog) *bridgev2.FetchMessagesResponse {
+	log := zerolog.Ctx(ctx)
+	intent := c.Main.Bridge.Bot
+	var messages []*bridgev2.BackfillMessage
+	for i := range backlog.Messages {
+		replayed := &backlog.Messages[i]
+		msg := &replayed.Msg
+		ts := time.UnixMilli(int64(msg.TimestampMs))
+		hasText := wrappedMessageHasText(msg)
+		if hasText {
+			if cm, err := c.convertLiveText(ctx, portal, intent, msg); err != nil || cm == nil {
+				log.Warn().Err(err).Str("uuid", msg.Uuid).Msg("Failed to convert replayed message")
+			} else {
+				messages = append(messages, &bridgev2.BackfillMessage{
+					ConvertedMessage: cm,
+					Sender:           replayed.Sender,
+					ID:               makeMessageID(msg.Uuid),
+					Timestamp:        ts,
+				})
+			}
+		}
+		for _, attMsg := range liveAttachmentMessages(msg, hasText) {
+			cm, err := c.convertLiveAttachment(ctx, portal, intent, attMsg)
+			if err != nil || cm == nil {
+				log.Warn().Err(err).Str("uuid", string(attMsg.ID)).Msg("Failed to convert replayed attachment")
+				continue
+			}
+			messages = append(messages, &bridgev2.BackfillMessage{
+				ConvertedMessage: cm,
+				Sender:           replayed.Sender,
+				ID:               attMsg.ID,
+				Timestamp:        ts,
+			})
+		}
+	}
+	assignBackfillStreamOrders(messages)
+	markQuietBackfill(messages)
+	return &bridgev2.FetchMessagesResponse{
+		Messages:                messages,
+		Forward:                 true,
+		AggressiveDeduplication: true,
+	}
+}
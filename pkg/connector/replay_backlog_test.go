@@ -0,0 +1,55 @@
+package connector
+
+import (
+	"reflect"
+	"testing"
+
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+
+	"github.com/lrhodin/imessage/pkg/rustpushgo"
+)
+
+func TestReplayBacklogState(t *testing.T) {
+	var s replayBacklogState
+	dm := networkid.PortalKey{ID: "tel:+15551234567", Receiver: "login"}
+	group := networkid.PortalKey{ID: "gid:abc", Receiver: "login"}
+	replayed := func(uuid string, ts uint64) replayedMessage {
+		return replayedMessage{Msg: rustpushgo.WrappedMessage{Uuid: uuid, TimestampMs: ts}, Sender: bridgev2.EventSender{Sender: "tel:+15551234567"}}
+	}
+
+	if !s.add(dm, false, replayed("B", 2000)) {
+		t.Errorf("add() for a portal's first message = false, want true")
+	}
+	if s.add(dm, true, replayed("A", 1000)) {
+		t.Errorf("add() for a portal's second message = true, want false")
+	}
+	s.add(dm, false, replayed("C", 2000))
+	if !s.add(group, false, replayed("G", 500)) {
+		t.Errorf("add() for another portal's first message = false, want true")
+	}
+
+	batch := s.take(dm)
+	if batch == nil {
+		t.Fatalf("take() = nil, want the portal's batch")
+	}
+	var got []string
+	for _, m := range batch.messages {
+		got = append(got, m.Msg.Uuid)
+	}
+	if want := []string{"A", "B", "C"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("take() order = %v, want %v", got, want)
+	}
+	if !batch.createPortal {
+		t.Errorf("take().createPortal = false, want true when any message could create the portal")
+	}
+	if again := s.take(dm); again != nil {
+		t.Errorf("take() after take() = %+v, want nil", again)
+	}
+	if !s.add(dm, false, replayed("D", 3000)) {
+		t.Errorf("add() after take() = false, want a new batch")
+	}
+	if other := s.take(group); other == nil || len(other.messages) != 1 {
+		t.Errorf("take() for another portal = %+v, want its one message", other)
+	}
+}
@@ -0,0 +1,130 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2024 Ludvig Rhodin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+package connector
+
+// Reply quote fallback.
+//
+// An iMessage reply names its target by GUID, and bridgev2 turns that into
+// an m.in_reply_to when the target is in the bridge database. When it
+// isn't (the target predates the bridge or the backfill window, or was
+// never bridged), bridgev2 drops the relation and the reply reaches Matrix
+// without any context, while iMessage shows a snippet of the quoted
+// message. In that case the target's text is looked up in the CloudKit
+// message store and quoted above the reply, in the shape of the old Matrix
+// reply fallback. A reply to a photo or another attachment, which has no
+// text to quote, quotes a description of it ("Replying to a photo").
+
+import (
+	"context"
+	"html"
+	"path"
+	"strings"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/event"
+)
+
+// maxReplyQuoteRunes caps the quoted snippet, like iMessage's own preview.
+const maxReplyQuoteRunes = 200
+
+// addReplyQuoteFallback quotes the reply target's text in cm when the
+// target isn't in the bridge database.
+func (c *IMClient) addReplyQuoteFallback(ctx context.Context, portal *bridgev2.Portal, cm *bridgev2.ConvertedMessage) {
+	if cm == nil || cm.ReplyTo == nil || len(cm.Parts) == 0 || c.cloudStore == nil {
+		return
+	}
+	existing, err := c.Main.Bridge.DB.Message.GetFirstOrSpecificPartByID(ctx, portal.Receiver, *cm.ReplyTo)
+	if err != nil || existing != nil {
+		return
+	}
+	guid, bp := extractTapbackTarget(string(cm.ReplyTo.MessageID))
+	text, err := c.cloudStore.getMessageTextByGUID(ctx, guid)
+	if err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Str("reply_guid", guid).Msg("Failed to look up reply target text")
+		return
+	}
+	atts, err := c.cloudStore.getMessageAttachmentsByGUID(ctx, guid)
+	if err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Str("reply_guid", guid).Msg("Failed to look up reply target attachments")
+	}
+	applyReplyQuote(cm.Parts[0].Content, replyQuoteText(text, atts, bp))
+}
+
+// replyQuoteText picks what to quote for a reply to balloon part bp of a
+// message (0 for the text, N for the Nth attachment): the text for a text
+// target, or a description of the attachment, also for a message that has
+// nothing but attachments.
+func replyQuoteText(text string, atts []cloudAttachmentRow, bp uint64) string {
+	text = strings.TrimSpace(strings.ReplaceAll(text, "\uFFFC", ""))
+	if bp == 0 && text != "" {
+		return text
+	}
+	if bp >= 1 && int(bp) <= len(atts) && !isPluginPayloadAttachment(atts[bp-1]) {
+		return describeReplyTarget(atts[bp-1])
+	}
+	for _, att := range atts {
+		if !isPluginPayloadAttachment(att) {
+			return describeReplyTarget(att)
+		}
+	}
+	return text
+}
+
+// describeReplyTarget describes an attachment by its type, for quoting it
+// in a reply.
+func describeReplyTarget(att cloudAttachmentRow) string {
+	mimeType := att.MimeType
+	if mimeType == "" {
+		mimeType = utiToMIME(att.UTIType)
+	}
+	if mimeType == "" {
+		mimeType = extToMIME(path.Ext(att.Filename))
+	}
+	switch mimeToMsgType(mimeType) {
+	case event.MsgImage:
+		return "Replying to a photo"
+	case event.MsgVideo:
+		return "Replying to a video"
+	case event.MsgAudio:
+		return "Replying to an audio message"
+	default:
+		return "Replying to a file"
+	}
+}
+
+// applyReplyQuote puts quoted above a text message's body, as "> " lines in
+// the plain body and a blockquote in the HTML. Media and empty quotes are
+// left alone.
+func applyReplyQuote(content *event.MessageEventContent, quoted string) {
+	quoted = strings.TrimSpace(strings.ReplaceAll(quoted, "\uFFFC", ""))
+	if content == nil || quoted == "" {
+		return
+	}
+	switch content.MsgType {
+	case event.MsgText, event.MsgNotice, event.MsgEmote:
+	default:
+		return
+	}
+	if runes := []rune(quoted); len(runes) > maxReplyQuoteRunes {
+		quoted = strings.TrimSpace(string(runes[:maxReplyQuoteRunes])) + "…"
+	}
+
+	lines := strings.Split(quoted, "\n")
+	for i, line := range lines {
+		lines[i] = "> " + line
+	}
+	formattedBody := content.FormattedBody
+	if content.Format != event.FormatHTML || formattedBody == "" {
+		formattedBody = strings.ReplaceAll(html.EscapeString(content.Body), "\n", "<br/>")
+	}
+	content.Body = strings.Join(lines, "\n") + "\n\n" + content.Body
+	content.Format = event.FormatHTML
+	content.FormattedBody = "<blockquote>" + strings.ReplaceAll(html.EscapeString(quoted), "\n", "<br/>") + "</blockquote>" + formattedBody
+}
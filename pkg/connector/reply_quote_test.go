@@ -0,0 +1,116 @@
+package connector
+
+import (
+	"strings"
+	"testing"
+
+	"maunium.net/go/mautrix/event"
+)
+
+func TestApplyReplyQuote(t *testing.T) {
+	long := strings.Repeat("a", maxReplyQuoteRunes+10)
+	tests := []struct {
+		name     string
+		content  event.MessageEventContent
+		quoted   string
+		wantBody string
+		wantHTML string
+	}{
+		{
+			name:     "plain text reply",
+			content:  event.MessageEventContent{MsgType: event.MsgText, Body: "sure"},
+			quoted:   "dinner at 7?",
+			wantBody: "> dinner at 7?\n\nsure",
+			wantHTML: "<blockquote>dinner at 7?</blockquote>sure",
+		},
+		{
+			name:     "multi-line quote is escaped",
+			content:  event.MessageEventContent{MsgType: event.MsgText, Body: "ok"},
+			quoted:   "a < b\nand c",
+			wantBody: "> a < b\n> and c\n\nok",
+			wantHTML: "<blockquote>a &lt; b<br/>and c</blockquote>ok",
+		},
+		{
+			name: "keeps existing HTML",
+			content: event.MessageEventContent{
+				MsgType:       event.MsgText,
+				Body:          "Subject\nbody",
+				Format:        event.FormatHTML,
+				FormattedBody: "<strong>Subject</strong><br/>body",
+			},
+			quoted:   "hi",
+			wantBody: "> hi\n\nSubject\nbody",
+			wantHTML: "<blockquote>hi</blockquote><strong>Subject</strong><br/>body",
+		},
+		{
+			name:     "long quote is cut",
+			content:  event.MessageEventContent{MsgType: event.MsgText, Body: "x"},
+			quoted:   long,
+			wantBody: "> " + long[:maxReplyQuoteRunes] + "…\n\nx",
+			wantHTML: "<blockquote>" + long[:maxReplyQuoteRunes] + "…</blockquote>x",
+		},
+		{
+			name:     "attachment placeholder only",
+			content:  event.MessageEventContent{MsgType: event.MsgText, Body: "x"},
+			quoted:   "\uFFFC",
+			wantBody: "x",
+		},
+		{
+			name:     "media reply",
+			content:  event.MessageEventContent{MsgType: event.MsgImage, Body: "photo.jpg"},
+			quoted:   "send a pic",
+			wantBody: "photo.jpg",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content := tt.content
+			applyReplyQuote(&content, tt.quoted)
+			if content.Body != tt.wantBody {
+				t.Errorf("Body = %q, want %q", content.Body, tt.wantBody)
+			}
+			if tt.wantHTML == "" {
+				if content.FormattedBody != tt.content.FormattedBody {
+					t.Errorf("FormattedBody = %q, want unchanged", content.FormattedBody)
+				}
+				return
+			}
+			if content.Format != event.FormatHTML || content.FormattedBody != tt.wantHTML {
+				t.Errorf("FormattedBody = %q (format %q), want %q", content.FormattedBody, content.Format, tt.wantHTML)
+			}
+		})
+	}
+}
+
+func TestReplyQuoteText(t *testing.T) {
+	photo := cloudAttachmentRow{MimeType: "image/heic", Filename: "IMG_0001.HEIC"}
+	video := cloudAttachmentRow{UTIType: "com.apple.quicktime-movie"}
+	voice := cloudAttachmentRow{Filename: "Audio Message.m4a"}
+	pdf := cloudAttachmentRow{MimeType: "application/pdf", Filename: "menu.pdf"}
+	sideband := cloudAttachmentRow{Filename: "link.pluginPayloadAttachment"}
+	tests := []struct {
+		name string
+		text string
+		atts []cloudAttachmentRow
+		bp   uint64
+		want string
+	}{
+		{"text", "dinner at 7?", nil, 0, "dinner at 7?"},
+		{"photo only", "\uFFFC", []cloudAttachmentRow{photo}, 0, "Replying to a photo"},
+		{"photo part", "\uFFFC", []cloudAttachmentRow{photo}, 1, "Replying to a photo"},
+		{"video by UTI", "", []cloudAttachmentRow{video}, 1, "Replying to a video"},
+		{"audio by extension", "", []cloudAttachmentRow{voice}, 1, "Replying to an audio message"},
+		{"file", "", []cloudAttachmentRow{pdf}, 1, "Replying to a file"},
+		{"second attachment", "\uFFFC\uFFFC", []cloudAttachmentRow{photo, video}, 2, "Replying to a video"},
+		{"photo with caption, caption part", "\uFFFClook", []cloudAttachmentRow{photo}, 0, "look"},
+		{"photo with caption, photo part", "\uFFFClook", []cloudAttachmentRow{photo}, 1, "Replying to a photo"},
+		{"link preview sideband", "https://example.com", []cloudAttachmentRow{sideband}, 0, "https://example.com"},
+		{"part out of range", "", []cloudAttachmentRow{pdf}, 3, "Replying to a file"},
+		{"nothing", "", nil, 0, ""},
+	}
+	for _, tt := range tests {
+		if got := replyQuoteText(tt.text, tt.atts, tt.bp); got != tt.want {
+			t.Errorf("replyQuoteText(%s) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
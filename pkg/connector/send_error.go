@@ -0,0 +1,132 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2024 Ludvig Rhodin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+package connector
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/event"
+
+	"github.com/lrhodin/imessage/pkg/rustpushgo"
+)
+
+// Apple-side send failures.
+//
+// A send that rustpush accepted (so the Matrix event already has its success
+// status) can still fail on Apple's side later: the recipient's devices
+// reject it and Apple delivers an error message naming the UUID of the
+// message it was for. Those used to only be logged, leaving the user
+// believing the message went through. handleMessageError finds the bridged
+// parts of that message and replaces their status with a failure, with a
+// notice in the room when the bridge has message_error_notices enabled.
+// Errors saying Apple will retry are held as pending first.
+
+// appleErrorReason renders the error's status for users. status_str is what
+// Apple sends alongside the numeric code and is usually the more readable of
+// the two.
+func appleErrorReason(status uint64, statusStr string) string {
+	statusStr = strings.TrimSpace(statusStr)
+	switch {
+	case statusStr != "" && status != 0:
+		return fmt.Sprintf("%s (status %d)", statusStr, status)
+	case statusStr != "":
+		return statusStr
+	default:
+		return fmt.Sprintf("status %d", status)
+	}
+}
+
+// appleErrorStatus builds the failure status sent for an Apple error.
+func appleErrorStatus(status uint64, statusStr string) *bridgev2.MessageStatus {
+	return &bridgev2.MessageStatus{
+		Status:      event.MessageStatusFail,
+		ErrorReason: event.MessageStatusNetworkError,
+		Message:     "Apple reported that this message failed to send: " + appleErrorReason(status, statusStr),
+		IsCertain:   true,
+		SendNotice:  true,
+	}
+}
+
+// messageErrorTargets returns the room and the bridged parts of the message
+// an Apple error is for. UUIDs are matched case-insensitively like delivery
+// receipts are; placeholder parts without a real Matrix event are left out.
+// Returns no parts if the message was never bridged.
+func (c *IMClient) messageErrorTargets(ctx context.Context, forUUID string) (*database.Portal, []*database.Message, error) {
+	if forUUID == "" {
+		return nil, nil, nil
+	}
+	db := c.Main.Bridge.DB
+	parts, err := db.Message.GetAllPartsByID(ctx, c.UserLogin.ID, makeMessageID(forUUID))
+	if err == nil && len(parts) == 0 {
+		altUUID := strings.ToUpper(forUUID)
+		if altUUID == forUUID {
+			altUUID = strings.ToLower(forUUID)
+		}
+		parts, err = db.Message.GetAllPartsByID(ctx, c.UserLogin.ID, makeMessageID(altUUID))
+	}
+	if err != nil || len(parts) == 0 {
+		return nil, nil, err
+	}
+	portal, err := db.Portal.GetByKey(ctx, parts[0].Room)
+	if err != nil || portal == nil || portal.MXID == "" {
+		return nil, nil, err
+	}
+	bridged := parts[:0]
+	for _, part := range parts {
+		if part.MXID != "" && !strings.HasPrefix(string(part.MXID), database.FakeMXIDPrefix) {
+			bridged = append(bridged, part)
+		}
+	}
+	return portal, bridged, nil
+}
+
+// handleMessageError marks the Matrix events of a message Apple reported as
+// failed.
+func (c *IMClient) handleMessageError(log zerolog.Logger, msg rustpushgo.WrappedMessage) {
+	forUUID := ptrStringOr(msg.ErrorForUuid, "")
+	status := ptrUint64Or(msg.ErrorStatus, 0)
+	statusStr := ptrStringOr(msg.ErrorStatusStr, "")
+	log = log.With().
+		Str("for_uuid", forUUID).
+		Uint64("status", status).
+		Str("status_str", statusStr).
+		Logger()
+	log.Warn().Msg("Received iMessage error")
+
+	// A transient error only marks the message as pending (see
+	// send_pending.go); a terminal one ends any such wait.
+	if c.holdTransientMessageError(log, forUUID, status, statusStr) {
+		return
+	}
+	c.pendingSends.resolve(forUUID)
+
+	ctx := log.WithContext(context.Background())
+	portal, parts, err := c.messageErrorTargets(ctx, forUUID)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to look up message for iMessage error")
+		return
+	} else if len(parts) == 0 {
+		log.Debug().Msg("iMessage error is for a message that wasn't bridged")
+		return
+	}
+	ms := appleErrorStatus(status, statusStr)
+	for _, part := range parts {
+		c.Main.Bridge.Matrix.SendMessageStatus(ctx, ms, &bridgev2.MessageStatusEventInfo{
+			RoomID:        portal.MXID,
+			SourceEventID: part.MXID,
+			Sender:        part.SenderMXID,
+		})
+	}
+	log.Info().Stringer("room_id", portal.MXID).Int("parts", len(parts)).Msg("Marked message as failed after iMessage error")
+}
@@ -0,0 +1,104 @@
+package connector
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestAppleErrorStatus(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    uint64
+		statusStr string
+		want      string
+	}{
+		{"code and string", 5032, "UnknownRecipient", "Apple reported that this message failed to send: UnknownRecipient (status 5032)"},
+		{"string only", 0, " Blocked ", "Apple reported that this message failed to send: Blocked"},
+		{"code only", 22, "", "Apple reported that this message failed to send: status 22"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ms := appleErrorStatus(tt.status, tt.statusStr)
+			if ms.Message != tt.want {
+				t.Errorf("appleErrorStatus(%d, %q).Message = %q, want %q", tt.status, tt.statusStr, ms.Message, tt.want)
+			}
+			if ms.Status != event.MessageStatusFail || !ms.IsCertain || !ms.SendNotice {
+				t.Errorf("appleErrorStatus() = %+v, want a certain failure with a notice", ms)
+			}
+		})
+	}
+}
+
+func TestMessageErrorTargets(t *testing.T) {
+	ctx := context.Background()
+	db := newTestBridgeDB(t)
+	c := &IMClient{
+		Main:      &IMConnector{Bridge: &bridgev2.Bridge{DB: db}},
+		UserLogin: &bridgev2.UserLogin{UserLogin: &database.UserLogin{ID: "login"}, Log: zerolog.Nop()},
+	}
+	room := networkid.PortalKey{ID: "tel:+15551234567", Receiver: "login"}
+	if err := db.Portal.Insert(ctx, &database.Portal{PortalKey: room, MXID: "!dm:example.com"}); err != nil {
+		t.Fatalf("Portal.Insert() error = %v", err)
+	}
+	insertPart := func(guid string, partID networkid.PartID, mxid id.EventID) {
+		t.Helper()
+		err := db.Message.Insert(ctx, &database.Message{
+			ID:         makeMessageID(guid),
+			PartID:     partID,
+			MXID:       mxid,
+			Room:       room,
+			SenderID:   "tel:+15559999999",
+			SenderMXID: "@user:example.com",
+			Timestamp:  time.Unix(1700000000, 0),
+		})
+		if err != nil {
+			t.Fatalf("Message.Insert(%s, %s) error = %v", guid, partID, err)
+		}
+	}
+	insertPart("ABCD-1234", "", "$text")
+	insertPart("ABCD-1234", "att0", "$photo")
+	insertPart("ABCD-1234", "att1", database.FakeMXIDPrefix+"placeholder")
+
+	tests := []struct {
+		name      string
+		forUUID   string
+		wantParts []id.EventID
+	}{
+		{"exact UUID", "ABCD-1234", []id.EventID{"$text", "$photo"}},
+		{"lowercase UUID", "abcd-1234", []id.EventID{"$text", "$photo"}},
+		{"unbridged message", "FFFF-0000", nil},
+		{"no UUID", "", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			portal, parts, err := c.messageErrorTargets(ctx, tt.forUUID)
+			if err != nil {
+				t.Fatalf("messageErrorTargets(%q) error = %v", tt.forUUID, err)
+			}
+			var got []id.EventID
+			for _, part := range parts {
+				got = append(got, part.MXID)
+			}
+			if len(got) != len(tt.wantParts) {
+				t.Fatalf("messageErrorTargets(%q) parts = %v, want %v", tt.forUUID, got, tt.wantParts)
+			}
+			for i := range got {
+				if got[i] != tt.wantParts[i] {
+					t.Errorf("messageErrorTargets(%q) parts = %v, want %v", tt.forUUID, got, tt.wantParts)
+					break
+				}
+			}
+			if len(tt.wantParts) > 0 && (portal == nil || portal.MXID != "!dm:example.com") {
+				t.Errorf("messageErrorTargets(%q) portal = %+v, want !dm:example.com", tt.forUUID, portal)
+			}
+		})
+	}
+}
@@ -0,0 +1,178 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2024 Ludvig Rhodin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package connector
+
+// set-handle — per-portal outgoing handle override.
+//
+// c.handle (preferred_handle / login choice) is the from-address for every
+// chat. Users with both a phone number and an email registered sometimes
+// want one chat to always go out from the other one, e.g. a work group from
+// the email and family DMs from the number. The override lives in
+// PortalMetadata.SendHandle and is applied by portalToConversation and the
+// Matrix→iMessage send paths via portalHandle.
+//
+// Flow (inside a portal room):
+//   !im set-handle                      → show current handle + registered ones
+//   !im set-handle mailto:me@icloud.com → send this chat from that handle
+//   !im set-handle reset                → back to the default handle
+
+import (
+	"fmt"
+	"strings"
+
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/commands"
+)
+
+// resolveSendHandle returns override if it is one of the registered handles,
+// otherwise fallback. An override that is no longer registered (handle
+// removed from the Apple ID) falls back instead of failing every send.
+func resolveSendHandle(override string, registered []string, fallback string) string {
+	if override == "" {
+		return fallback
+	}
+	for _, h := range registered {
+		if h == override {
+			return h
+		}
+	}
+	return fallback
+}
+
+// matchRegisteredHandle maps user input ("+15551234567", "me@icloud.com",
+// "tel:+1…") to the registered handle it names, or "" if none matches.
+func matchRegisteredHandle(input string, registered []string) string {
+	input = strings.TrimSpace(input)
+	if input == "" {
+		return ""
+	}
+	normalized := normalizeIdentifierForPortalID(addIdentifierPrefix(input))
+	for _, h := range registered {
+		if normalizeIdentifierForPortalID(h) == normalized {
+			return h
+		}
+	}
+	return ""
+}
+
+// withSendHandle replaces our own handle(s) in a group's participant list
+// with handle, so the group is addressed from the overridden handle. Lists
+// that don't contain any of our handles are returned unchanged.
+func withSendHandle(participants []string, handle string, isMine func(string) bool) []string {
+	out := make([]string, 0, len(participants))
+	replaced := false
+	for _, p := range participants {
+		if isMine(p) {
+			if !replaced {
+				out = append(out, handle)
+				replaced = true
+			}
+			continue
+		}
+		out = append(out, p)
+	}
+	if !replaced {
+		return participants
+	}
+	return out
+}
+
+// portalHandle returns the handle to send from in portal: its set-handle
+// override if still registered, otherwise c.handle.
+func (c *IMClient) portalHandle(portal *bridgev2.Portal) string {
+	if portal == nil {
+		return c.handle
+	}
+	meta, ok := portal.Metadata.(*PortalMetadata)
+	if !ok {
+		return c.handle
+	}
+	return resolveSendHandle(meta.SendHandle, c.allHandles, c.handle)
+}
+
+var cmdSetHandle = &commands.FullHandler{
+	Name: "set-handle",
+	Func: fnSetHandle,
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionChats,
+		Description: "Choose which of your handles (phone number or email) this chat sends from.",
+		Args:        "[<handle> | reset]",
+	},
+	RequiresLogin:  true,
+	RequiresPortal: true,
+}
+
+func fnSetHandle(ce *commands.Event) {
+	login := ce.User.GetDefaultLogin()
+	if login == nil {
+		ce.Reply("Not logged in.")
+		return
+	}
+	client, ok := login.Client.(*IMClient)
+	if !ok || client == nil {
+		ce.Reply("Bridge client not available.")
+		return
+	}
+	meta, ok := ce.Portal.Metadata.(*PortalMetadata)
+	if !ok {
+		meta = &PortalMetadata{}
+	}
+
+	if len(ce.Args) == 0 {
+		var sb strings.Builder
+		fmt.Fprintf(&sb, "This chat sends from `%s`", client.portalHandle(ce.Portal))
+		if meta.SendHandle == "" {
+			sb.WriteString(" (default).")
+		} else if client.portalHandle(ce.Portal) != meta.SendHandle {
+			fmt.Fprintf(&sb, " — the override `%s` is no longer registered.", meta.SendHandle)
+		} else {
+			sb.WriteString(" (set for this chat).")
+		}
+		sb.WriteString("\n\nRegistered handles:\n")
+		for _, h := range client.allHandles {
+			fmt.Fprintf(&sb, "- `%s`\n", h)
+		}
+		sb.WriteString("\nUse `$cmdprefix set-handle <handle>` to change it, or `$cmdprefix set-handle reset` for the default.")
+		ce.Reply(sb.String())
+		return
+	}
+
+	var newHandle string
+	if arg := ce.Args[0]; !strings.EqualFold(arg, "reset") {
+		newHandle = matchRegisteredHandle(arg, client.allHandles)
+		if newHandle == "" {
+			ce.Reply("`%s` isn't one of your registered handles. Run `$cmdprefix set-handle` to see them.", arg)
+			return
+		}
+	}
+	if meta.SendHandle == newHandle {
+		ce.Reply("No change — this chat already sends from `%s`.", client.portalHandle(ce.Portal))
+		return
+	}
+	meta.SendHandle = newHandle
+	ce.Portal.Metadata = meta
+	if err := ce.Portal.Save(ce.Ctx); err != nil {
+		ce.Reply("Failed to save handle override: %v", err)
+		return
+	}
+	ce.Log.Info().Str("portal_id", string(ce.Portal.ID)).Str("send_handle", newHandle).Msg("Updated per-portal send handle")
+	if newHandle == "" {
+		ce.Reply("This chat now sends from the default handle `%s`.", client.handle)
+	} else {
+		ce.Reply("This chat now sends from `%s`.", newHandle)
+	}
+}
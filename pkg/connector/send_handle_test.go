@@ -0,0 +1,75 @@
+package connector
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestResolveSendHandle(t *testing.T) {
+	registered := []string{"tel:+15551234567", "mailto:me@icloud.com"}
+	tests := []struct {
+		name     string
+		override string
+		want     string
+	}{
+		{"no override uses default", "", "tel:+15551234567"},
+		{"registered override", "mailto:me@icloud.com", "mailto:me@icloud.com"},
+		{"unregistered override falls back", "mailto:old@icloud.com", "tel:+15551234567"},
+	}
+	for _, tt := range tests {
+		if got := resolveSendHandle(tt.override, registered, "tel:+15551234567"); got != tt.want {
+			t.Errorf("%s: resolveSendHandle(%q) = %q, want %q", tt.name, tt.override, got, tt.want)
+		}
+	}
+}
+
+func TestMatchRegisteredHandle(t *testing.T) {
+	registered := []string{"tel:+15551234567", "mailto:me@icloud.com"}
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"mailto:me@icloud.com", "mailto:me@icloud.com"},
+		{"Me@iCloud.com", "mailto:me@icloud.com"},
+		{"+15551234567", "tel:+15551234567"},
+		{"tel:+15551234567", "tel:+15551234567"},
+		{"+15559999999", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := matchRegisteredHandle(tt.input, registered); got != tt.want {
+			t.Errorf("matchRegisteredHandle(%q) = %q, want %q", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestWithSendHandle(t *testing.T) {
+	mine := map[string]bool{"tel:+15551234567": true, "mailto:me@icloud.com": true}
+	isMine := func(h string) bool { return mine[h] }
+	tests := []struct {
+		name         string
+		participants []string
+		want         []string
+	}{
+		{
+			"replaces own handle",
+			[]string{"tel:+15551234567", "tel:+15550000001", "tel:+15550000002"},
+			[]string{"mailto:me@icloud.com", "tel:+15550000001", "tel:+15550000002"},
+		},
+		{
+			"collapses both own handles",
+			[]string{"tel:+15550000001", "tel:+15551234567", "mailto:me@icloud.com"},
+			[]string{"tel:+15550000001", "mailto:me@icloud.com"},
+		},
+		{
+			"no own handle leaves list alone",
+			[]string{"tel:+15550000001", "tel:+15550000002"},
+			[]string{"tel:+15550000001", "tel:+15550000002"},
+		},
+	}
+	for _, tt := range tests {
+		if got := withSendHandle(tt.participants, "mailto:me@icloud.com", isMine); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: withSendHandle() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2024 Ludvig Rhodin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+package connector
+
+// Transient Apple send errors (send_pending_timeout_seconds).
+//
+// Not every error Apple reports for a sent message is final: some only say
+// the message couldn't be delivered yet and will be retried, and the
+// message then arrives a little later. Marking those as failed, like
+// handleMessageError did for every error, told the user to resend a message
+// that was about to be delivered. Errors are now classified by what Apple
+// says. A transient one marks the message as pending, and the failure is
+// only shown if no delivery receipt arrives within the timeout, or
+// immediately if a terminal error follows. Errors from the send call itself
+// stay failures: rustpush has already retried those (send_with_flap_retry).
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/event"
+)
+
+// sendFailureKind is whether an error Apple reported for a message is final.
+type sendFailureKind int
+
+const (
+	sendFailureTerminal sendFailureKind = iota
+	// sendFailureTransient: not delivered yet, Apple will retry.
+	sendFailureTransient
+)
+
+// sendFailureTerminalMarkers are errors that never resolve on their own,
+// even when Apple's wording mentions retrying.
+var sendFailureTerminalMarkers = []string{
+	"novalidtargets",
+	"unknownrecipient",
+	"unknown recipient",
+	"blocked",
+	"not registered",
+	"too large",
+	"rejected",
+}
+
+// sendFailureTransientMarkers are what Apple says about a message it hasn't
+// delivered yet but will keep trying.
+var sendFailureTransientMarkers = []string{
+	"will retry",
+	"retrying",
+	"try again",
+	"queued",
+	"pending",
+	"temporar", // temporary, temporarily
+	"timed out",
+	"timeout",
+	"unavailable",
+	"not delivered yet",
+}
+
+// classifySendFailure decides from an error's status string whether the
+// message may still be delivered. Anything unrecognized is terminal, as
+// every error used to be.
+func classifySendFailure(statusStr string) sendFailureKind {
+	msg := strings.ToLower(statusStr)
+	if msg == "" {
+		return sendFailureTerminal
+	}
+	for _, marker := range sendFailureTerminalMarkers {
+		if strings.Contains(msg, marker) {
+			return sendFailureTerminal
+		}
+	}
+	for _, marker := range sendFailureTransientMarkers {
+		if strings.Contains(msg, marker) {
+			return sendFailureTransient
+		}
+	}
+	return sendFailureTerminal
+}
+
+// appleErrorPendingStatus builds the status sent for a transient Apple error.
+func appleErrorPendingStatus(status uint64, statusStr string) *bridgev2.MessageStatus {
+	return &bridgev2.MessageStatus{
+		Status:      event.MessageStatusPending,
+		ErrorReason: event.MessageStatusNetworkError,
+		Message:     "Apple hasn't delivered this message yet and will retry: " + appleErrorReason(status, statusStr),
+	}
+}
+
+// pendingSendState holds the timers of messages waiting on a retry after a
+// transient error, keyed by lowercase UUID. The zero value is ready to use.
+type pendingSendState struct {
+	mu     sync.Mutex
+	timers map[string]*time.Timer
+}
+
+// start calls onTimeout after timeout unless the message is resolved first.
+// A message that's already pending keeps its original deadline; start then
+// returns false.
+func (s *pendingSendState) start(uuid string, timeout time.Duration, onTimeout func()) bool {
+	key := strings.ToLower(uuid)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.timers[key]; ok {
+		return false
+	}
+	if s.timers == nil {
+		s.timers = make(map[string]*time.Timer)
+	}
+	s.timers[key] = time.AfterFunc(timeout, func() {
+		s.mu.Lock()
+		_, ok := s.timers[key]
+		delete(s.timers, key)
+		s.mu.Unlock()
+		if ok {
+			onTimeout()
+		}
+	})
+	return true
+}
+
+// resolve stops waiting on the message, returning whether it was pending.
+func (s *pendingSendState) resolve(uuid string) bool {
+	key := strings.ToLower(uuid)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	timer, ok := s.timers[key]
+	if ok {
+		timer.Stop()
+		delete(s.timers, key)
+	}
+	return ok
+}
+
+// sendPendingTimeout returns how long a message stays pending after a
+// transient error, or zero when transient errors count as failures.
+func (c *IMClient) sendPendingTimeout() time.Duration {
+	seconds := c.Main.Config.SendPendingTimeoutSeconds
+	if seconds <= 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// sendMessageErrorStatus sends ms for every bridged part of the message
+// forUUID.
+func (c *IMClient) sendMessageErrorStatus(ctx context.Context, forUUID string, ms *bridgev2.MessageStatus) (int, error) {
+	portal, parts, err := c.messageErrorTargets(ctx, forUUID)
+	if err != nil || len(parts) == 0 {
+		return 0, err
+	}
+	for _, part := range parts {
+		c.Main.Bridge.Matrix.SendMessageStatus(ctx, ms, &bridgev2.MessageStatusEventInfo{
+			RoomID:        portal.MXID,
+			SourceEventID: part.MXID,
+			Sender:        part.SenderMXID,
+		})
+	}
+	return len(parts), nil
+}
+
+// holdTransientMessageError marks the message as pending after a transient
+// error and arms the timeout that fails it. It returns false when transient
+// errors aren't held, so the caller fails the message now.
+func (c *IMClient) holdTransientMessageError(log zerolog.Logger, forUUID string, status uint64, statusStr string) bool {
+	timeout := c.sendPendingTimeout()
+	if timeout == 0 || forUUID == "" || classifySendFailure(statusStr) != sendFailureTransient {
+		return false
+	}
+	ctx := log.WithContext(context.Background())
+	if !c.pendingSends.start(forUUID, timeout, func() {
+		n, err := c.sendMessageErrorStatus(ctx, forUUID, appleErrorStatus(status, statusStr))
+		if err != nil {
+			log.Warn().Err(err).Msg("Failed to look up message after pending timeout")
+			return
+		}
+		log.Info().Int("parts", n).Dur("timeout", timeout).Msg("Marked message as failed after it stayed undelivered")
+	}) {
+		log.Debug().Msg("Message already pending after an earlier transient error")
+		return true
+	}
+	n, err := c.sendMessageErrorStatus(ctx, forUUID, appleErrorPendingStatus(status, statusStr))
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to look up message for transient iMessage error")
+		return true
+	} else if n == 0 {
+		c.pendingSends.resolve(forUUID)
+		log.Debug().Msg("iMessage error is for a message that wasn't bridged")
+		return true
+	}
+	log.Info().Int("parts", n).Dur("timeout", timeout).Msg("Marked message as pending after transient iMessage error")
+	return true
+}
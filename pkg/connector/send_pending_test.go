@@ -0,0 +1,80 @@
+package connector
+
+import (
+	"testing"
+	"time"
+
+	"maunium.net/go/mautrix/event"
+)
+
+func TestClassifySendFailure(t *testing.T) {
+	tests := []struct {
+		statusStr string
+		want      sendFailureKind
+	}{
+		{"Message not delivered, will retry", sendFailureTransient},
+		{"Recipient temporarily unavailable", sendFailureTransient},
+		{"Queued for delivery", sendFailureTransient},
+		{"Delivery timed out", sendFailureTransient},
+		{"UnknownRecipient", sendFailureTerminal},
+		{"NoValidTargets, will retry", sendFailureTerminal},
+		{"Blocked", sendFailureTerminal},
+		{"Message too large, try again with a smaller file", sendFailureTerminal},
+		{"Internal error", sendFailureTerminal},
+		{"", sendFailureTerminal},
+	}
+	for _, tt := range tests {
+		if got := classifySendFailure(tt.statusStr); got != tt.want {
+			t.Errorf("classifySendFailure(%q) = %v, want %v", tt.statusStr, got, tt.want)
+		}
+	}
+}
+
+func TestAppleErrorPendingStatus(t *testing.T) {
+	ms := appleErrorPendingStatus(0, "Not delivered, will retry")
+	want := "Apple hasn't delivered this message yet and will retry: Not delivered, will retry"
+	if ms.Status != event.MessageStatusPending || ms.Message != want || ms.SendNotice {
+		t.Errorf("appleErrorPendingStatus() = %+v, want a pending status %q without a notice", ms, want)
+	}
+}
+
+func TestPendingSendState(t *testing.T) {
+	var s pendingSendState
+	fired := make(chan string, 4)
+	onTimeout := func(uuid string) func() {
+		return func() { fired <- uuid }
+	}
+
+	if !s.start("AAAA", time.Hour, onTimeout("AAAA")) {
+		t.Fatalf("start(AAAA) = false, want true")
+	}
+	if s.start("aaaa", time.Millisecond, onTimeout("aaaa")) {
+		t.Errorf("start(aaaa) while pending = true, want false")
+	}
+	if !s.resolve("aaaa") {
+		t.Errorf("resolve(aaaa) = false, want true")
+	}
+	if s.resolve("AAAA") {
+		t.Errorf("resolve(AAAA) after resolving = true, want false")
+	}
+
+	if !s.start("BBBB", time.Millisecond, onTimeout("BBBB")) {
+		t.Fatalf("start(BBBB) = false, want true")
+	}
+	select {
+	case uuid := <-fired:
+		if uuid != "BBBB" {
+			t.Errorf("timeout fired for %s, want BBBB", uuid)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timeout for BBBB never fired")
+	}
+	if s.resolve("BBBB") {
+		t.Errorf("resolve(BBBB) after the timeout = true, want false")
+	}
+	select {
+	case uuid := <-fired:
+		t.Errorf("timeout fired for resolved %s", uuid)
+	default:
+	}
+}
@@ -0,0 +1,75 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2024 Ludvig Rhodin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+package connector
+
+import (
+	"context"
+	"time"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridgev2/database"
+
+	"github.com/lrhodin/imessage/pkg/rustpushgo"
+)
+
+// Server timestamps for outbound messages (server_send_timestamps).
+//
+// HandleMatrixMessage records a sent message with the bridge's clock, since
+// the rustpush send calls only return the message UUID. Apple echoes every
+// message we send back to our own handles, stamped with the time its servers
+// accepted it — the same clock CloudKit backfill and the other participants'
+// devices go by. When the echo arrives, handleMessage finds the message
+// already in the bridge DB and hands it here, and the row's timestamp is
+// replaced by the acknowledged one, so ordering stays right when the
+// bridge host's clock is off.
+
+// maxSendAckSkew bounds how far the acknowledged timestamp may be from the
+// local send time. Anything further is a misparsed or replayed echo rather
+// than clock skew, so the local time is kept.
+const maxSendAckSkew = 24 * time.Hour
+
+// sendAckTimestamp returns the timestamp to record for a sent message: the
+// server-acknowledged ackMs when there is one and it's plausible, otherwise
+// the local send time.
+func sendAckTimestamp(ackMs uint64, local time.Time) time.Time {
+	if ackMs == 0 {
+		return local
+	}
+	ack := time.UnixMilli(int64(ackMs))
+	if skew := ack.Sub(local); skew > maxSendAckSkew || skew < -maxSendAckSkew {
+		return local
+	}
+	return ack
+}
+
+// applySendAck updates the stored timestamps of a message we sent from
+// Matrix with the server timestamp of its echo. parts are the bridge DB rows
+// of the message.
+func (c *IMClient) applySendAck(ctx context.Context, log zerolog.Logger, msg *rustpushgo.WrappedMessage, parts []*database.Message) {
+	if !c.Main.Config.ServerSendTimestamps || msg.Sender == nil || !c.isMyHandle(*msg.Sender) {
+		return
+	}
+	for _, part := range parts {
+		ts := sendAckTimestamp(msg.TimestampMs, part.Timestamp)
+		if ts.Equal(part.Timestamp) {
+			continue
+		}
+		log.Debug().
+			Str("uuid", msg.Uuid).
+			Str("part_id", string(part.PartID)).
+			Time("local_ts", part.Timestamp).
+			Time("server_ts", ts).
+			Msg("Using server timestamp for sent message")
+		part.Timestamp = ts
+		if err := c.Main.Bridge.DB.Message.Update(ctx, part); err != nil {
+			log.Warn().Err(err).Str("uuid", msg.Uuid).Msg("Failed to update sent message timestamp")
+			return
+		}
+	}
+}
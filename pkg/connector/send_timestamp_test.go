@@ -0,0 +1,91 @@
+package connector
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/lrhodin/imessage/pkg/rustpushgo"
+)
+
+func TestSendAckTimestamp(t *testing.T) {
+	local := time.UnixMilli(1700000000000)
+	tests := []struct {
+		name  string
+		ackMs uint64
+		want  time.Time
+	}{
+		{"no ack", 0, local},
+		{"ack behind skewed local clock", 1700000000000 - 90_000, local.Add(-90 * time.Second)},
+		{"ack ahead of local clock", 1700000000000 + 2_500, local.Add(2500 * time.Millisecond)},
+		{"implausibly old ack", 1700000000000 - uint64(48*time.Hour/time.Millisecond), local},
+		{"implausibly new ack", 1700000000000 + uint64(48*time.Hour/time.Millisecond), local},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sendAckTimestamp(tt.ackMs, local); !got.Equal(tt.want) {
+				t.Errorf("sendAckTimestamp(%d) = %v, want %v", tt.ackMs, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplySendAck(t *testing.T) {
+	ctx := context.Background()
+	db := newTestBridgeDB(t)
+	c := &IMClient{
+		Main:       &IMConnector{Bridge: &bridgev2.Bridge{DB: db}},
+		UserLogin:  &bridgev2.UserLogin{UserLogin: &database.UserLogin{ID: "login"}, Log: zerolog.Nop()},
+		allHandles: []string{"mailto:me@example.com"},
+	}
+	portalKey := networkid.PortalKey{ID: "tel:+15551234567", Receiver: "login"}
+	if err := db.Portal.Insert(ctx, &database.Portal{PortalKey: portalKey}); err != nil {
+		t.Fatalf("Portal.Insert() error = %v", err)
+	}
+	local := time.UnixMilli(1700000000000)
+	if err := db.Message.Insert(ctx, &database.Message{
+		ID:        makeMessageID("SENT"),
+		MXID:      id.EventID("$sent"),
+		Room:      portalKey,
+		SenderID:  makeUserID("mailto:me@example.com"),
+		Timestamp: local,
+	}); err != nil {
+		t.Fatalf("Message.Insert() error = %v", err)
+	}
+	me, other := "mailto:me@example.com", "tel:+15551234567"
+	echo := func(sender string, ackMs uint64) {
+		parts, err := db.Message.GetAllPartsByID(ctx, "login", makeMessageID("SENT"))
+		if err != nil || len(parts) != 1 {
+			t.Fatalf("GetAllPartsByID() = %v, %v", parts, err)
+		}
+		c.applySendAck(ctx, zerolog.Nop(), &rustpushgo.WrappedMessage{Uuid: "SENT", Sender: &sender, TimestampMs: ackMs}, parts)
+	}
+	stored := func() time.Time {
+		msg, err := db.Message.GetPartByID(ctx, "login", makeMessageID("SENT"), "")
+		if err != nil || msg == nil {
+			t.Fatalf("GetPartByID() = %v, %v", msg, err)
+		}
+		return msg.Timestamp
+	}
+
+	echo(me, 1700000000000-5_000)
+	if got := stored(); !got.Equal(local) {
+		t.Errorf("timestamp with server_send_timestamps off = %v, want %v", got, local)
+	}
+
+	c.Main.Config.ServerSendTimestamps = true
+	echo(other, 1700000000000-5_000)
+	if got := stored(); !got.Equal(local) {
+		t.Errorf("timestamp after someone else's message = %v, want %v", got, local)
+	}
+	echo(me, 1700000000000-5_000)
+	if want := local.Add(-5 * time.Second); !stored().Equal(want) {
+		t.Errorf("timestamp after echo = %v, want %v", stored(), want)
+	}
+}
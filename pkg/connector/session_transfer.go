@@ -0,0 +1,296 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2024 Ludvig Rhodin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+package connector
+
+// export-session / import-session — move a login to another host.
+//
+// Everything that makes the bridge the same device to Apple lives in the
+// data directory: session.json (IDS users and identity, APS state, device
+// ID, hardware key, iCloud account credentials), keystore.plist (the
+// signing keys session.json refers to) and, with CloudKit, the keychain
+// trust state in trustedpeers_<dsid>.plist. Exporting bundles those files
+// into one passphrase-encrypted blob; importing writes them into the new
+// host's data directory and checks the IDS users against the keystore.
+// The next start then auto-restores the login (tryAutoRestore) without a
+// re-login, so Apple sees no new device and the portals are picked up by
+// the same login ID.
+//
+// Both are CLI subcommands run with the bridge stopped, like check-restore:
+// the keystore is loaded once per process, so swapping it under a running
+// bridge wouldn't take effect.
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rs/zerolog"
+
+	"github.com/lrhodin/imessage/pkg/rustpushgo"
+)
+
+const (
+	sessionExportPrefix     = "mautrix-imessage-session-v1:"
+	sessionExportVersion    = 1
+	sessionExportSaltSize   = 16
+	sessionExportIterations = 600_000
+)
+
+var errWrongSessionPassphrase = errors.New("wrong passphrase or corrupted session export")
+
+// sessionBundle is the plaintext of a session export.
+type sessionBundle struct {
+	Version      int                   `json:"version"`
+	Session      PersistedSessionState `json:"session"`
+	Keystore     []byte                `json:"keystore"`
+	TrustedPeers []byte                `json:"trusted_peers,omitempty"`
+}
+
+// validate checks that the bundle can restore a login on its own.
+func (b *sessionBundle) validate() error {
+	switch {
+	case b.Version != sessionExportVersion:
+		return fmt.Errorf("unsupported session export version %d", b.Version)
+	case b.Session.IDSUsers == "" || b.Session.IDSIdentity == "" || b.Session.APSState == "":
+		return errors.New("session export is missing IDS or APS state")
+	case len(b.Keystore) == 0:
+		return errors.New("session export has no keystore")
+	}
+	return nil
+}
+
+// sessionExportKey derives the AES-256 key for an export from its passphrase.
+func sessionExportKey(passphrase string, salt []byte) ([]byte, error) {
+	return pbkdf2.Key(sha256.New, passphrase, salt, sessionExportIterations, 32)
+}
+
+// sealSessionBundle encrypts a bundle with AES-256-GCM under a key derived
+// from passphrase. The result is text: the prefix, then base64 of
+// salt || nonce || ciphertext.
+func sealSessionBundle(bundle *sessionBundle, passphrase string) ([]byte, error) {
+	if passphrase == "" {
+		return nil, errors.New("passphrase is empty")
+	}
+	plaintext, err := json.Marshal(bundle)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal session export: %w", err)
+	}
+	salt := make([]byte, sessionExportSaltSize)
+	if _, err = rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("failed to generate salt: %w", err)
+	}
+	gcm, err := sessionExportCipher(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	sealed := append(salt, nonce...)
+	sealed = gcm.Seal(sealed, nonce, plaintext, []byte(sessionExportPrefix))
+	return []byte(sessionExportPrefix + base64.StdEncoding.EncodeToString(sealed)), nil
+}
+
+// openSessionBundle decrypts and validates an export made by
+// sealSessionBundle.
+func openSessionBundle(data []byte, passphrase string) (*sessionBundle, error) {
+	text := strings.TrimSpace(string(data))
+	if !strings.HasPrefix(text, sessionExportPrefix) {
+		return nil, errors.New("not a mautrix-imessage session export")
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(text, sessionExportPrefix))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode session export: %w", err)
+	}
+	if len(sealed) < sessionExportSaltSize {
+		return nil, errWrongSessionPassphrase
+	}
+	salt, sealed := sealed[:sessionExportSaltSize], sealed[sessionExportSaltSize:]
+	gcm, err := sessionExportCipher(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errWrongSessionPassphrase
+	}
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, []byte(sessionExportPrefix))
+	if err != nil {
+		return nil, errWrongSessionPassphrase
+	}
+	var bundle sessionBundle
+	if err = json.Unmarshal(plaintext, &bundle); err != nil {
+		return nil, fmt.Errorf("failed to parse session export: %w", err)
+	}
+	if err = bundle.validate(); err != nil {
+		return nil, err
+	}
+	return &bundle, nil
+}
+
+func sessionExportCipher(passphrase string, salt []byte) (cipher.AEAD, error) {
+	key, err := sessionExportKey(passphrase, salt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive key: %w", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GCM: %w", err)
+	}
+	return gcm, nil
+}
+
+// keystoreFilePath returns the path of the Rust software keystore, which
+// lives next to session.json.
+func keystoreFilePath() (string, error) {
+	path, err := sessionFilePath()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(filepath.Dir(path), "keystore.plist"), nil
+}
+
+// ExportSession bundles this host's session state and keys into an
+// encrypted blob for import-session. Intended for CLI use (export-session
+// subcommand) with the bridge stopped.
+func ExportSession(passphrase string) ([]byte, error) {
+	log := zerolog.Nop()
+	bundle := &sessionBundle{
+		Version: sessionExportVersion,
+		Session: loadSessionState(log),
+	}
+	keystorePath, err := keystoreFilePath()
+	if err != nil {
+		return nil, err
+	}
+	if bundle.Keystore, err = os.ReadFile(keystorePath); err != nil {
+		return nil, fmt.Errorf("failed to read keystore: %w", err)
+	}
+	if bundle.Session.AccountDSID != "" {
+		if path, err := trustedPeersFilePath(bundle.Session.AccountDSID); err == nil {
+			bundle.TrustedPeers, _ = os.ReadFile(path)
+		}
+	}
+	if err = bundle.validate(); err != nil {
+		return nil, fmt.Errorf("no complete session to export: %w", err)
+	}
+	return sealSessionBundle(bundle, passphrase)
+}
+
+// ImportSession restores an export from ExportSession into this host's
+// data directory and validates the IDS users against the imported
+// keystore. Existing session files are only replaced with overwrite; if
+// validation fails they are put back. Intended for CLI use
+// (import-session subcommand) with the bridge stopped, and must run before
+// anything else in the process touches the keystore.
+func ImportSession(data []byte, passphrase string, overwrite bool) error {
+	log := zerolog.New(zerolog.NewConsoleWriter()).With().Timestamp().Logger()
+	bundle, err := openSessionBundle(data, passphrase)
+	if err != nil {
+		return err
+	}
+	sessionPath, err := sessionFilePath()
+	if err != nil {
+		return err
+	}
+	keystorePath, err := keystoreFilePath()
+	if err != nil {
+		return err
+	}
+	stateJSON, err := json.Marshal(bundle.Session)
+	if err != nil {
+		return fmt.Errorf("failed to marshal session state: %w", err)
+	}
+	files := []sessionFile{{path: sessionPath, data: stateJSON}, {path: keystorePath, data: bundle.Keystore}}
+	if len(bundle.TrustedPeers) > 0 && bundle.Session.AccountDSID != "" {
+		path, err := trustedPeersFilePath(bundle.Session.AccountDSID)
+		if err != nil {
+			return err
+		}
+		files = append(files, sessionFile{path: path, data: bundle.TrustedPeers})
+	}
+	if !overwrite {
+		for _, f := range files {
+			if _, err = os.Stat(f.path); err == nil {
+				return fmt.Errorf("%s already exists (pass --overwrite to replace this host's session)", f.path)
+			}
+		}
+	}
+	if err = os.MkdirAll(filepath.Dir(sessionPath), 0700); err != nil {
+		return fmt.Errorf("failed to create data directory: %w", err)
+	}
+	restore, err := writeSessionFiles(files)
+	if err != nil {
+		return err
+	}
+
+	// Loads the keystore just written.
+	rustpushgo.InitLogger()
+	session := &cachedSessionState{
+		IDSIdentity: bundle.Session.IDSIdentity,
+		APSState:    bundle.Session.APSState,
+		IDSUsers:    bundle.Session.IDSUsers,
+		source:      "session import",
+	}
+	if !session.validate(log) {
+		restore()
+		return errors.New("imported session doesn't match the imported keystore")
+	}
+	return nil
+}
+
+type sessionFile struct {
+	path string
+	data []byte
+}
+
+// writeSessionFiles writes files, moving any existing ones aside. The
+// returned function removes the written files and puts the old ones back.
+func writeSessionFiles(files []sessionFile) (restore func(), err error) {
+	var written []string
+	backups := make(map[string]string)
+	restore = func() {
+		for _, path := range written {
+			_ = os.Remove(path)
+		}
+		for path, backup := range backups {
+			_ = os.Rename(backup, path)
+		}
+	}
+	for _, f := range files {
+		if _, statErr := os.Stat(f.path); statErr == nil {
+			backup := f.path + ".bak"
+			if err = os.Rename(f.path, backup); err != nil {
+				restore()
+				return nil, fmt.Errorf("failed to move %s aside: %w", f.path, err)
+			}
+			backups[f.path] = backup
+		}
+		if err = os.WriteFile(f.path, f.data, 0600); err != nil {
+			restore()
+			return nil, fmt.Errorf("failed to write %s: %w", f.path, err)
+		}
+		written = append(written, f.path)
+	}
+	return restore, nil
+}
@@ -0,0 +1,115 @@
+package connector
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSessionExportMetadataFidelity(t *testing.T) {
+	meta := &UserLoginMetadata{
+		Platform:                 "linux",
+		APSState:                 "aps-state",
+		IDSUsers:                 "ids-users",
+		IDSIdentity:              "ids-identity",
+		DeviceID:                 "DEVICE-1",
+		HardwareKey:              "aGFyZHdhcmU=",
+		PreferredHandle:          "tel:+15551234567",
+		AccountUsername:          "user@icloud.com",
+		AccountHashedPasswordHex: "abcd",
+		AccountPET:               "pet",
+		AccountADSID:             "adsid",
+		AccountDSID:              "12345",
+		AccountSPDBase64:         "c3Bk",
+		MmeDelegateJSON:          `{"delegate":true}`,
+	}
+	bundle := &sessionBundle{
+		Version:      sessionExportVersion,
+		Session:      sessionStateFromMetadata(meta),
+		Keystore:     []byte("<plist>keys</plist>"),
+		TrustedPeers: []byte("<plist>peers</plist>"),
+	}
+	sealed, err := sealSessionBundle(bundle, "correct horse")
+	if err != nil {
+		t.Fatalf("sealSessionBundle() error = %v", err)
+	}
+	if bytes.Contains(sealed, []byte("ids-identity")) {
+		t.Errorf("sealSessionBundle() output contains plaintext session state")
+	}
+
+	opened, err := openSessionBundle(sealed, "correct horse")
+	if err != nil {
+		t.Fatalf("openSessionBundle() error = %v", err)
+	}
+	if got := opened.Session.loginMetadata(); !reflect.DeepEqual(got, meta) {
+		t.Errorf("restored metadata = %+v, want %+v", got, meta)
+	}
+	if !bytes.Equal(opened.Keystore, bundle.Keystore) || !bytes.Equal(opened.TrustedPeers, bundle.TrustedPeers) {
+		t.Errorf("openSessionBundle() keystore = %q, trusted peers = %q", opened.Keystore, opened.TrustedPeers)
+	}
+
+	if _, err = openSessionBundle(sealed, "wrong horse"); !errors.Is(err, errWrongSessionPassphrase) {
+		t.Errorf("openSessionBundle() with wrong passphrase error = %v, want %v", err, errWrongSessionPassphrase)
+	}
+	tampered := append([]byte{}, sealed...)
+	// A character in the middle: every bit of it is part of the ciphertext.
+	tampered[len(sessionExportPrefix)+40] ^= 1
+	if _, err = openSessionBundle(tampered, "correct horse"); err == nil {
+		t.Errorf("openSessionBundle() of tampered export succeeded")
+	}
+}
+
+func TestSessionBundleValidate(t *testing.T) {
+	complete := sessionBundle{
+		Version:  sessionExportVersion,
+		Session:  PersistedSessionState{IDSUsers: "u", IDSIdentity: "i", APSState: "a"},
+		Keystore: []byte("k"),
+	}
+	tests := []struct {
+		name    string
+		modify  func(b *sessionBundle)
+		wantErr bool
+	}{
+		{"complete", func(b *sessionBundle) {}, false},
+		{"no keystore", func(b *sessionBundle) { b.Keystore = nil }, true},
+		{"no APS state", func(b *sessionBundle) { b.Session.APSState = "" }, true},
+		{"future version", func(b *sessionBundle) { b.Version++ }, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := complete
+			tt.modify(&b)
+			if err := b.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestWriteSessionFilesRestore(t *testing.T) {
+	dir := t.TempDir()
+	existing := filepath.Join(dir, "session.json")
+	fresh := filepath.Join(dir, "keystore.plist")
+	if err := os.WriteFile(existing, []byte("old"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	restore, err := writeSessionFiles([]sessionFile{{existing, []byte("new")}, {fresh, []byte("keys")}})
+	if err != nil {
+		t.Fatalf("writeSessionFiles() error = %v", err)
+	}
+	if data, _ := os.ReadFile(existing); string(data) != "new" {
+		t.Errorf("session.json = %q after write, want %q", data, "new")
+	}
+
+	restore()
+	if data, _ := os.ReadFile(existing); string(data) != "old" {
+		t.Errorf("session.json = %q after restore, want %q", data, "old")
+	}
+	if _, err = os.Stat(fresh); !os.IsNotExist(err) {
+		t.Errorf("keystore.plist still exists after restore (err = %v)", err)
+	}
+}
@@ -276,9 +276,9 @@ func (c *IMClient) handleSharedProfile(log zerolog.Logger, msg rustpushgo.Wrappe
 
 	log.Info().
 		Str("record_key_prefix", keyPrefix).
-		Str("display_name", row.DisplayName).
-		Str("first_name", row.FirstName).
-		Str("last_name", row.LastName).
+		Str("display_name", logText(row.DisplayName)).
+		Str("first_name", logText(row.FirstName)).
+		Str("last_name", logText(row.LastName)).
 		Bool("has_avatar", len(row.Avatar) > 0).
 		Msg("Cached shared iMessage profile")
 
@@ -334,6 +334,21 @@ func (c *IMClient) lookupSharedProfile(identifier string) *rustpushgo.WrappedPro
 	return nil
 }
 
+// sharedProfileName returns the name from identifier's shared profile,
+// formatted with the displayname template, or "" if there's no profile
+// with a name. This is the name the member chose to show in Messages.
+func (c *IMClient) sharedProfileName(identifier string) string {
+	profile := c.lookupSharedProfile(identifier)
+	if profile == nil || (profile.FirstName == "" && profile.LastName == "" && profile.DisplayName == "") {
+		return ""
+	}
+	return c.Main.Config.FormatDisplayname(DisplaynameParams{
+		FirstName: profile.FirstName,
+		LastName:  profile.LastName,
+		ID:        stripIdentifierPrefix(identifier),
+	})
+}
+
 // refreshSharedProfilesOnConnect runs the startup share-profile refresh
 // independently of CardDAV: first pushes every cached row to its Matrix
 // ghost (no network — handles warm restarts), then re-fetches each row
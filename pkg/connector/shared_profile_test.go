@@ -0,0 +1,47 @@
+package connector
+
+import (
+	"testing"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridgev2"
+
+	"github.com/lrhodin/imessage/imessage"
+)
+
+func TestBuildGroupNameSharedProfilePrecedence(t *testing.T) {
+	cfg := IMConfig{DisplaynameTemplate: "{{.FirstName}} {{.LastName}}"}
+	if err := cfg.PostProcess(); err != nil {
+		t.Fatalf("PostProcess() error = %v", err)
+	}
+	c := &IMClient{
+		Main:       &IMConnector{Config: cfg},
+		UserLogin:  &bridgev2.UserLogin{Log: zerolog.Nop()},
+		allHandles: []string{"tel:+15550001111"},
+		contacts:   staticContacts{&imessage.Contact{FirstName: "Alice", Phones: []string{"+15550002222"}}},
+	}
+	// Alice is in the address book and also shares a profile; Bob only
+	// shares one.
+	c.sharedProfiles.Store("tel:+15550002222", &sharedProfileRow{Identifier: "tel:+15550002222", FirstName: "Ally"})
+	c.sharedProfiles.Store("mailto:bob@example.com", &sharedProfileRow{Identifier: "mailto:bob@example.com", FirstName: "Bobby", LastName: "B"})
+	c.sharedProfiles.Store("tel:+15550004444", &sharedProfileRow{Identifier: "tel:+15550004444", RecordKey: "no-name"})
+
+	tests := []struct {
+		name    string
+		members []string
+		want    string
+	}{
+		{"contact wins over shared profile", []string{"tel:+15550002222"}, "Alice"},
+		{"shared profile over handle", []string{"mailto:Bob@Example.com"}, "Bobby B"},
+		{"shared profile without a name", []string{"tel:+15550004444"}, "+15550004444"},
+		{"no contact or profile", []string{"tel:+15550003333"}, "+15550003333"},
+		{"mixed, self skipped", []string{"tel:+15550001111", "tel:+15550002222", "mailto:bob@example.com", "tel:+15550003333"}, "Alice, Bobby B, +15550003333"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := c.buildGroupName(tt.members); got != tt.want {
+				t.Errorf("buildGroupName(%v) = %q, want %q", tt.members, got, tt.want)
+			}
+		})
+	}
+}
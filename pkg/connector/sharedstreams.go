@@ -676,6 +676,7 @@ func sharedAssetCaption(fileName, dateCreated string) string {
 func (c *IMClient) processSharedAlbumAsset(ctx context.Context, logger zerolog.Logger, intent interface {
 	UploadMedia(ctx context.Context, roomID id.RoomID, data []byte, fileName, mimeType string) (id.ContentURIString, *event.EncryptedFileInfo, error)
 }, data []byte, fileName, dateCreated string) *event.MessageEventContent {
+	fileName = sanitizeAttachmentFileName(fileName)
 	if fileName == "" {
 		fileName = "attachment"
 	}
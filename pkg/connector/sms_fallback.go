@@ -0,0 +1,239 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2024 Ludvig Rhodin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package connector
+
+// iMessage → SMS fallback for outbound sends.
+//
+// When the recipient has no reachable iMessage devices, rustpush fails the
+// send with NoValidTargets. Messages.app would offer "Send as Text Message";
+// the bridge either retries as SMS on its own (sms_fallback, only when an SMS
+// relay is available) or posts a notice pointing at the send-as-sms command.
+//
+// Whether a relay is available is persisted per login (SMSRelay in the login
+// metadata): set by the iPhone's Text Message Forwarding activation and by
+// any SMS coming in, so it survives restarts. Logins from before it was
+// persisted are migrated once from their SMS portals.
+//
+// Flow:
+//   send fails with NoValidTargets
+//   → sms_fallback + relay available: resend as SMS, mark portal SMS
+//   → otherwise: notice in the room; `!im send-as-sms` marks the portal SMS
+//     and the user resends
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/commands"
+	"maunium.net/go/mautrix/event"
+
+	"github.com/lrhodin/imessage/pkg/rustpushgo"
+)
+
+// smsFallbackAction is what to do after an outbound iMessage send failed.
+type smsFallbackAction int
+
+const (
+	// smsFallbackNone: return the error as-is.
+	smsFallbackNone smsFallbackAction = iota
+	// smsFallbackRetry: resend over SMS and mark the portal SMS.
+	smsFallbackRetry
+	// smsFallbackPrompt: fail the send and tell the user about send-as-sms.
+	smsFallbackPrompt
+)
+
+// errSMSFallbackFailed marks a send that failed over iMessage and then
+// over SMS as well.
+var errSMSFallbackFailed = errors.New("failed to send as SMS after iMessage failed")
+
+// isNoValidTargetsError reports whether a send failed because the recipient
+// has no reachable iMessage devices.
+func isNoValidTargetsError(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "NoValidTargets")
+}
+
+// decideSMSFallback picks the fallback for a failed send. Only NoValidTargets
+// on a conversation that was sent as iMessage qualifies; an automatic retry
+// additionally needs the sms_fallback opt-in and an SMS relay, since without
+// a relay the SMS would fail too.
+func decideSMSFallback(err error, sentAsSMS, optIn, relayAvailable bool) smsFallbackAction {
+	if sentAsSMS || !isNoValidTargetsError(err) {
+		return smsFallbackNone
+	}
+	if optIn && relayAvailable {
+		return smsFallbackRetry
+	}
+	return smsFallbackPrompt
+}
+
+// smsRelayAvailable reports whether this bridge can send SMS: the iPhone
+// relays SMS to it.
+func (c *IMClient) smsRelayAvailable() bool {
+	return c.smsRelayEnabled.Load()
+}
+
+// initSMSRelayState restores the persisted relay state.
+func (c *IMClient) initSMSRelayState() {
+	if meta, ok := c.UserLogin.Metadata.(*UserLoginMetadata); ok && meta.SMSRelay != nil {
+		c.smsRelayEnabled.Store(*meta.SMSRelay)
+	}
+}
+
+// recordSMSRelay notes whether the iPhone relays SMS to this bridge and
+// reports whether the persisted state changed, i.e. the login needs saving.
+func (c *IMClient) recordSMSRelay(enabled bool) bool {
+	c.smsRelayEnabled.Store(enabled)
+	meta, ok := c.UserLogin.Metadata.(*UserLoginMetadata)
+	if !ok || (meta.SMSRelay != nil && *meta.SMSRelay == enabled) {
+		return false
+	}
+	meta.SMSRelay = &enabled
+	return true
+}
+
+// setSMSRelay records the relay state and saves the login when it changed.
+func (c *IMClient) setSMSRelay(log zerolog.Logger, enabled bool) {
+	if !c.recordSMSRelay(enabled) {
+		return
+	}
+	log.Info().Bool("enabled", enabled).Msg("SMS forwarding state changed")
+	if err := c.UserLogin.Save(context.Background()); err != nil {
+		log.Warn().Err(err).Msg("Failed to persist SMS forwarding state")
+	}
+}
+
+// migrateSMSRelayState sets the relay state of logins from before it was
+// persisted: SMS portals only exist if SMS have been relayed.
+func (c *IMClient) migrateSMSRelayState(log zerolog.Logger, hasSMSPortal bool) {
+	meta, ok := c.UserLogin.Metadata.(*UserLoginMetadata)
+	if !ok || meta.SMSRelay != nil || !hasSMSPortal {
+		return
+	}
+	c.setSMSRelay(log, true)
+}
+
+// sendWithSMSFallback runs send and, if it fails because the recipient isn't
+// on iMessage, applies decideSMSFallback. On a successful retry conv is
+// updated in place (so follow-up sends such as captions also go out as SMS)
+// and the portal is marked SMS.
+func (c *IMClient) sendWithSMSFallback(ctx context.Context, portal *bridgev2.Portal, conv *rustpushgo.WrappedConversation, send func(rustpushgo.WrappedConversation) (string, error)) (string, error) {
+	uuid, err := send(*conv)
+	if err == nil {
+		return uuid, nil
+	}
+	log := zerolog.Ctx(ctx)
+	if isNoValidTargetsError(err) && conv.SenderGuid == nil && len(conv.Participants) > 0 {
+		// The cached reachability was stale: the next DM send should go
+		// straight out as SMS if it can (see dmTransportIsSMS).
+		c.reachability.set(conv.Participants[len(conv.Participants)-1], false, time.Now())
+	}
+	switch decideSMSFallback(err, conv.IsSms, c.Main.Config.SMSFallback, c.smsRelayAvailable()) {
+	case smsFallbackRetry:
+		log.Info().Str("portal_id", string(portal.ID)).Msg("Recipient isn't on iMessage, retrying as SMS")
+		smsConv := *conv
+		smsConv.IsSms = true
+		uuid, smsErr := send(smsConv)
+		if smsErr != nil {
+			return "", fmt.Errorf("%w: %w", errSMSFallbackFailed, smsErr)
+		}
+		*conv = smsConv
+		c.markPortalSMS(ctx, portal)
+		return uuid, nil
+	case smsFallbackPrompt:
+		go c.sendSMSFallbackNotice(portal)
+	}
+	return "", err
+}
+
+// markPortalSMS switches a portal to SMS and persists it, the same way an
+// inbound SMS does in handleMessage.
+func (c *IMClient) markPortalSMS(ctx context.Context, portal *bridgev2.Portal) {
+	if !c.updatePortalSMS(string(portal.ID), true) {
+		return
+	}
+	meta, ok := portal.Metadata.(*PortalMetadata)
+	if !ok {
+		meta = &PortalMetadata{}
+	}
+	if meta.IsSms {
+		return
+	}
+	meta.IsSms = true
+	portal.Metadata = meta
+	if err := portal.Save(ctx); err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Str("portal_id", string(portal.ID)).Msg("Failed to persist IsSms change to database")
+	}
+}
+
+// sendSMSFallbackNotice tells the user why the send failed and how to switch
+// the chat to SMS.
+func (c *IMClient) sendSMSFallbackNotice(portal *bridgev2.Portal) {
+	if portal.MXID == "" {
+		return
+	}
+	body := fmt.Sprintf("This contact isn't reachable on iMessage. Send `%s send-as-sms` to switch this chat to SMS, then resend your message.", c.Main.Bridge.Config.CommandPrefix)
+	if !c.smsRelayAvailable() {
+		body += " (SMS needs Text Message Forwarding to this bridge enabled on your iPhone.)"
+	}
+	_, err := c.Main.Bridge.Bot.SendMessage(context.Background(), portal.MXID, event.EventMessage, &event.Content{
+		Parsed: &event.MessageEventContent{
+			MsgType:  event.MsgNotice,
+			Body:     body,
+			Mentions: &event.Mentions{},
+		},
+	}, nil)
+	if err != nil {
+		c.UserLogin.Log.Warn().Err(err).Str("portal_id", string(portal.ID)).Msg("Failed to send SMS fallback notice")
+	}
+}
+
+var cmdSendAsSMS = &commands.FullHandler{
+	Name:    "send-as-sms",
+	Aliases: []string{"sms"},
+	Func:    fnSendAsSMS,
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionChats,
+		Description: "Switch this chat to SMS so messages are sent as text messages instead of iMessage.",
+	},
+	RequiresLogin:  true,
+	RequiresPortal: true,
+}
+
+func fnSendAsSMS(ce *commands.Event) {
+	login := ce.User.GetDefaultLogin()
+	if login == nil {
+		ce.Reply("Not logged in.")
+		return
+	}
+	client, ok := login.Client.(*IMClient)
+	if !ok || client == nil {
+		ce.Reply("Bridge client not available.")
+		return
+	}
+	if client.isPortalSMS(string(ce.Portal.ID)) {
+		ce.Reply("This chat is already sending as SMS.")
+		return
+	}
+	client.markPortalSMS(ce.Ctx, ce.Portal)
+	ce.Log.Info().Str("portal_id", string(ce.Portal.ID)).Msg("Switched portal to SMS")
+	ce.Reply("This chat will now send as SMS. Resend your message to deliver it as a text message. It switches back to iMessage when the contact next messages you over iMessage.")
+}
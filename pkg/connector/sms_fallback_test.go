@@ -0,0 +1,63 @@
+package connector
+
+import (
+	"errors"
+	"testing"
+
+	"go.mau.fi/util/ptr"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+)
+
+func TestDecideSMSFallback(t *testing.T) {
+	noTargets := errors.New("failed to send iMessage: Failed to send message: NoValidTargets")
+	other := errors.New("failed to send iMessage: Failed to send message: SendTimedOut")
+	tests := []struct {
+		name           string
+		err            error
+		sentAsSMS      bool
+		optIn          bool
+		relayAvailable bool
+		want           smsFallbackAction
+	}{
+		{"opted in with relay retries", noTargets, false, true, true, smsFallbackRetry},
+		{"opted in without relay prompts", noTargets, false, true, false, smsFallbackPrompt},
+		{"not opted in prompts", noTargets, false, false, true, smsFallbackPrompt},
+		{"already SMS", noTargets, true, true, true, smsFallbackNone},
+		{"other error", other, false, true, true, smsFallbackNone},
+		{"no error", nil, false, true, true, smsFallbackNone},
+	}
+	for _, tt := range tests {
+		if got := decideSMSFallback(tt.err, tt.sentAsSMS, tt.optIn, tt.relayAvailable); got != tt.want {
+			t.Errorf("%s: decideSMSFallback() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRecordSMSRelay(t *testing.T) {
+	meta := &UserLoginMetadata{}
+	c := &IMClient{UserLogin: &bridgev2.UserLogin{UserLogin: &database.UserLogin{Metadata: meta}}}
+	steps := []struct {
+		enabled, wantChanged bool
+	}{
+		{true, true},
+		{true, false},
+		{false, true},
+		{false, false},
+	}
+	for _, step := range steps {
+		if got := c.recordSMSRelay(step.enabled); got != step.wantChanged {
+			t.Errorf("recordSMSRelay(%v) = %v, want %v", step.enabled, got, step.wantChanged)
+		}
+		if meta.SMSRelay == nil || *meta.SMSRelay != step.enabled || c.smsRelayAvailable() != step.enabled {
+			t.Errorf("recordSMSRelay(%v) left SMSRelay = %v, available = %v", step.enabled, meta.SMSRelay, c.smsRelayAvailable())
+		}
+	}
+
+	// A restarted client picks the persisted state back up.
+	restarted := &IMClient{UserLogin: &bridgev2.UserLogin{UserLogin: &database.UserLogin{Metadata: &UserLoginMetadata{SMSRelay: ptr.Ptr(true)}}}}
+	restarted.initSMSRelayState()
+	if !restarted.smsRelayAvailable() {
+		t.Errorf("smsRelayAvailable() after initSMSRelayState() = false, want true")
+	}
+}
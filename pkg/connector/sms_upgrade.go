@@ -0,0 +1,120 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2024 Ludvig Rhodin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+package connector
+
+// SMS → iMessage upgrades (sms_upgrade_check_hours).
+//
+// A DM marked SMS stays that way until the contact sends something over
+// iMessage. Sends already pick the transport from live reachability (see
+// transport_select.go), but the sticky flag still decides the room's SMS
+// state and is what every restart starts from. iOS turns a green contact
+// blue as soon as they register, so every sms_upgrade_check_hours the
+// SMS-flagged DMs are validated against IDS again, and any whose contact
+// now has iMessage devices has its flag cleared and persisted, as if an
+// iMessage had come in from them. A contact that still isn't reachable,
+// or whose lookup fails, stays SMS.
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+)
+
+// smsUpgradeCandidates returns the SMS-flagged DM portals, sorted. Groups
+// switch transport on their own before each send, and legacy portal IDs
+// with an SMS suffix can never be iMessage.
+func smsUpgradeCandidates(smsPortals map[string]bool) []string {
+	var candidates []string
+	for portalID, isSms := range smsPortals {
+		if isSms && !isGroupPortalID(portalID) && stripSmsSuffix(portalID) == portalID {
+			candidates = append(candidates, portalID)
+		}
+	}
+	sort.Strings(candidates)
+	return candidates
+}
+
+// planSMSUpgrades returns the candidates lookup reports as reachable over
+// iMessage. Unknown reachability never upgrades.
+func planSMSUpgrades(candidates []string, lookup func(portalID string) (reachable, known bool)) []string {
+	var upgrades []string
+	for _, portalID := range candidates {
+		if reachable, known := lookup(portalID); known && reachable {
+			upgrades = append(upgrades, portalID)
+		}
+	}
+	return upgrades
+}
+
+// checkSMSUpgrades re-validates the SMS-flagged DMs and switches the ones
+// now reachable over iMessage back to it. Returns how many were upgraded.
+func (c *IMClient) checkSMSUpgrades(ctx context.Context, log zerolog.Logger) int {
+	c.smsPortalsLock.RLock()
+	candidates := smsUpgradeCandidates(c.smsPortals)
+	c.smsPortalsLock.RUnlock()
+
+	upgrades := planSMSUpgrades(candidates, func(portalID string) (bool, bool) {
+		target := c.resolveSendTarget(portalID)
+		if c.isMyHandle(target) {
+			return false, false
+		}
+		// Only finding the target counts: an empty lookup may have failed.
+		found, ok := c.lookupReachability([]string{target}, c.handle)
+		if !ok || !found[target] {
+			return false, false
+		}
+		c.reachability.set(target, true, time.Now())
+		return true, true
+	})
+	for _, portalID := range upgrades {
+		c.upgradeSMSPortal(ctx, log, portalID)
+	}
+	return len(upgrades)
+}
+
+// upgradeSMSPortal clears the SMS flag of a DM, persisting it to the
+// portal's metadata if the portal exists.
+func (c *IMClient) upgradeSMSPortal(ctx context.Context, log zerolog.Logger, portalID string) {
+	portalKey := networkid.PortalKey{ID: networkid.PortalID(portalID), Receiver: c.UserLogin.ID}
+	portal, err := c.Main.Bridge.GetExistingPortalByKey(ctx, portalKey)
+	if err != nil {
+		log.Warn().Err(err).Str("portal_id", portalID).Msg("Failed to load portal for SMS upgrade")
+	}
+	if portal != nil {
+		c.setPortalSMS(ctx, portal, false)
+	} else {
+		c.updatePortalSMS(portalID, false)
+	}
+	log.Info().Str("portal_id", portalID).Msg("Contact registered for iMessage, switched DM from SMS")
+}
+
+// periodicSMSUpgradeCheck runs checkSMSUpgrades every
+// sms_upgrade_check_hours.
+func (c *IMClient) periodicSMSUpgradeCheck(log zerolog.Logger) {
+	hours := c.Main.Config.SMSUpgradeCheckHours
+	if hours <= 0 {
+		return
+	}
+	log = log.With().Str("component", "sms_upgrade").Logger()
+	ticker := time.NewTicker(time.Duration(hours) * time.Hour)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if upgraded := c.checkSMSUpgrades(context.Background(), log); upgraded > 0 {
+				log.Info().Int("upgraded", upgraded).Msg("Switched SMS DMs to iMessage")
+			}
+		case <-c.stopChan:
+			return
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package connector
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/bridgeconfig"
+	"maunium.net/go/mautrix/bridgev2/database"
+)
+
+func TestSMSUpgradeCandidates(t *testing.T) {
+	got := smsUpgradeCandidates(map[string]bool{
+		"tel:+15552222222":                  true,
+		"tel:+15551111111":                  true,
+		"mailto:friend@example.com":         false,
+		"gid:abc-123":                       true,
+		"tel:+15553333333,tel:+15554444444": true,
+		"tel:+15555555555(smsft)":           true,
+	})
+	want := []string{"tel:+15551111111", "tel:+15552222222"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("smsUpgradeCandidates() = %v, want %v", got, want)
+	}
+}
+
+func TestPlanSMSUpgrades(t *testing.T) {
+	lookups := map[string][2]bool{ // reachable, known
+		"tel:+15551111111": {true, true},
+		"tel:+15552222222": {false, true},
+		"tel:+15553333333": {false, false},
+	}
+	got := planSMSUpgrades([]string{"tel:+15551111111", "tel:+15552222222", "tel:+15553333333"}, func(portalID string) (bool, bool) {
+		r := lookups[portalID]
+		return r[0], r[1]
+	})
+	if want := []string{"tel:+15551111111"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("planSMSUpgrades() = %v, want %v", got, want)
+	}
+}
+
+func TestUpgradeSMSPortal(t *testing.T) {
+	c := &IMClient{
+		Main:       &IMConnector{Bridge: &bridgev2.Bridge{DB: newTestBridgeDB(t), Config: &bridgeconfig.BridgeConfig{}}},
+		UserLogin:  &bridgev2.UserLogin{UserLogin: &database.UserLogin{ID: "login"}, Log: zerolog.Nop()},
+		smsPortals: map[string]bool{"tel:+15551111111": true, "tel:+15552222222": true},
+	}
+	c.upgradeSMSPortal(context.Background(), zerolog.Nop(), "tel:+15551111111")
+	if c.isPortalSMS("tel:+15551111111") {
+		t.Errorf("isPortalSMS() after upgrade = true, want false")
+	}
+	if !c.isPortalSMS("tel:+15552222222") {
+		t.Errorf("isPortalSMS() of other portal = false, want true")
+	}
+}
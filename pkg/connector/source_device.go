@@ -0,0 +1,78 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2024 Ludvig Rhodin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+package connector
+
+import (
+	"strings"
+
+	"maunium.net/go/mautrix/bridgev2"
+
+	"github.com/lrhodin/imessage/pkg/rustpushgo"
+)
+
+// "Sent from <device>" (source_device_field).
+//
+// With the option on, a message whose sending device is known gets it in
+// the event content as fi.mau.imessage.source_device: the Apple model
+// identifier it came with (e.g. "iPhone15,2") and the kind of device that
+// names ("iPhone"). Messages without device info get no field, and with the
+// option off (the default) nothing is added at all.
+
+// sourceDeviceField holds the sending device in the event content.
+const sourceDeviceField = "fi.mau.imessage.source_device"
+
+// sourceDeviceKinds maps Apple model identifier prefixes to device kinds.
+// "Mac" covers MacBookPro18,3, Macmini9,1 and the like.
+var sourceDeviceKinds = []struct{ prefix, kind string }{
+	{"iPhone", "iPhone"},
+	{"iPad", "iPad"},
+	{"iPod", "iPod touch"},
+	{"Watch", "Apple Watch"},
+	{"RealityDevice", "Apple Vision Pro"},
+	{"iMac", "Mac"},
+	{"Mac", "Mac"},
+}
+
+// sourceDeviceKind names the kind of device an Apple model identifier
+// belongs to, or "" for identifiers it doesn't know.
+func sourceDeviceKind(model string) string {
+	for _, k := range sourceDeviceKinds {
+		if strings.HasPrefix(model, k.prefix) {
+			return k.kind
+		}
+	}
+	return ""
+}
+
+// messageSourceDevice returns the model identifier of the device msg was
+// sent from, or "" if it isn't known. rustpush only hands the sender's
+// handle through WrappedMessage, not the device token it came from, so
+// live messages have no device info yet and the field stays omitted.
+func messageSourceDevice(msg *rustpushgo.WrappedMessage) string {
+	return ""
+}
+
+// applySourceDevice puts model in the sourceDeviceField of every part of
+// cm. An empty model leaves cm alone.
+func applySourceDevice(cm *bridgev2.ConvertedMessage, model string) {
+	model = strings.TrimSpace(model)
+	if model == "" {
+		return
+	}
+	field := map[string]any{"model": model}
+	if kind := sourceDeviceKind(model); kind != "" {
+		field["kind"] = kind
+	}
+	for _, part := range cm.Parts {
+		if part.Extra == nil {
+			part.Extra = make(map[string]any)
+		}
+		part.Extra[sourceDeviceField] = field
+	}
+}
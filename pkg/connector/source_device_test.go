@@ -0,0 +1,71 @@
+package connector
+
+import (
+	"reflect"
+	"testing"
+
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/event"
+
+	"github.com/lrhodin/imessage/pkg/rustpushgo"
+)
+
+func TestSourceDeviceKind(t *testing.T) {
+	tests := []struct {
+		model string
+		want  string
+	}{
+		{"iPhone15,2", "iPhone"},
+		{"iPad13,1", "iPad"},
+		{"Watch6,1", "Apple Watch"},
+		{"MacBookPro18,3", "Mac"},
+		{"Mac14,2", "Mac"},
+		{"iMac21,1", "Mac"},
+		{"RealityDevice14,1", "Apple Vision Pro"},
+		{"AppleTV14,1", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := sourceDeviceKind(tt.model); got != tt.want {
+			t.Errorf("sourceDeviceKind(%q) = %q, want %q", tt.model, got, tt.want)
+		}
+	}
+}
+
+func testSourceDeviceMessage() *bridgev2.ConvertedMessage {
+	return &bridgev2.ConvertedMessage{Parts: []*bridgev2.ConvertedMessagePart{
+		{Type: event.EventMessage, Content: &event.MessageEventContent{MsgType: event.MsgText, Body: "hi"}},
+		{Type: event.EventMessage, Content: &event.MessageEventContent{MsgType: event.MsgImage, Body: "photo.jpg"}},
+	}}
+}
+
+func TestApplySourceDevice(t *testing.T) {
+	cm := testSourceDeviceMessage()
+	applySourceDevice(cm, "iPhone15,2")
+	want := map[string]any{"model": "iPhone15,2", "kind": "iPhone"}
+	for i, part := range cm.Parts {
+		if got := part.Extra[sourceDeviceField]; !reflect.DeepEqual(got, want) {
+			t.Errorf("applySourceDevice() part %d %s = %v, want %v", i, sourceDeviceField, got, want)
+		}
+	}
+
+	cm = testSourceDeviceMessage()
+	applySourceDevice(cm, "AppleTV14,1")
+	want = map[string]any{"model": "AppleTV14,1"}
+	if got := cm.Parts[0].Extra[sourceDeviceField]; !reflect.DeepEqual(got, want) {
+		t.Errorf("applySourceDevice(unknown model) %s = %v, want %v", sourceDeviceField, got, want)
+	}
+}
+
+func TestApplySourceDeviceAbsent(t *testing.T) {
+	text := "hi"
+	for _, model := range []string{"", "  ", messageSourceDevice(&rustpushgo.WrappedMessage{Text: &text})} {
+		cm := testSourceDeviceMessage()
+		applySourceDevice(cm, model)
+		for i, part := range cm.Parts {
+			if _, ok := part.Extra[sourceDeviceField]; ok {
+				t.Errorf("applySourceDevice(%q) part %d has %s, want it omitted", model, i, sourceDeviceField)
+			}
+		}
+	}
+}
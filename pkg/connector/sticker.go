@@ -0,0 +1,73 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2024 Ludvig Rhodin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+package connector
+
+import (
+	"strings"
+
+	"maunium.net/go/mautrix/event"
+)
+
+// Stickers arrive two ways: as an attachment of their own (a sticker or
+// Memoji sticker sent as a message, recognised by its UTI), or as a sticker
+// tapback (type 7) placed on top of another message's bubble. Both are
+// bridged as m.sticker when the payload is an image Matrix can render; a
+// sticker placed on a message keeps that message as its reply target, since
+// Matrix has no way to attach a sticker to another event. Sticker UTIs we
+// don't recognise, and stickers whose payload isn't an image, fall back to a
+// plain m.image.
+
+type stickerKind int
+
+const (
+	stickerKindNone stickerKind = iota
+	// stickerKindImage is a sticker pack or photo sticker.
+	stickerKindImage
+	// stickerKindMemoji is a rendered Memoji/Animoji sticker.
+	stickerKindMemoji
+	// stickerKindUnknown is a sticker-typed attachment we don't know how to
+	// render as a sticker.
+	stickerKindUnknown
+)
+
+// stickerKindForUTI classifies an attachment by its uniform type identifier.
+func stickerKindForUTI(uti string) stickerKind {
+	switch strings.ToLower(uti) {
+	case "com.apple.memoji-sticker", "com.apple.animoji-sticker", "com.apple.avatarkit.sticker":
+		return stickerKindMemoji
+	case "com.apple.sticker", "com.apple.messages.sticker", "com.apple.sticker-image":
+		return stickerKindImage
+	}
+	if strings.Contains(strings.ToLower(uti), "sticker") {
+		return stickerKindUnknown
+	}
+	return stickerKindNone
+}
+
+// bridgesAsSticker reports whether an attachment of this kind with the given
+// (post-conversion) MIME type is sent as m.sticker.
+func (k stickerKind) bridgesAsSticker(mimeType string) bool {
+	return (k == stickerKindImage || k == stickerKindMemoji) && strings.HasPrefix(mimeType, "image/")
+}
+
+// stickerBody is the description used as the body of a bridged sticker.
+func (k stickerKind) stickerBody() string {
+	if k == stickerKindMemoji {
+		return "Memoji sticker"
+	}
+	return "Sticker"
+}
+
+// makeStickerContent turns converted image content into m.sticker content,
+// which carries no msgtype and describes the sticker in its body.
+func makeStickerContent(content *event.MessageEventContent, kind stickerKind) {
+	content.MsgType = ""
+	content.Body = kind.stickerBody()
+	content.FileName = ""
+}
@@ -0,0 +1,132 @@
+package connector
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/png"
+	"testing"
+
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/event"
+
+	"github.com/lrhodin/imessage/pkg/rustpushgo"
+)
+
+func testStickerPNG(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewNRGBA(image.Rect(0, 0, 3, 2))); err != nil {
+		t.Fatalf("png.Encode() error = %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestStickerKindForUTI(t *testing.T) {
+	tests := []struct {
+		uti  string
+		want stickerKind
+	}{
+		{"com.apple.memoji-sticker", stickerKindMemoji},
+		{"com.apple.Animoji-Sticker", stickerKindMemoji},
+		{"com.apple.sticker", stickerKindImage},
+		{"com.apple.messages.sticker", stickerKindImage},
+		{"com.example.sticker-pack.hologram", stickerKindUnknown},
+		{"public.png", stickerKindNone},
+		{"", stickerKindNone},
+	}
+	for _, tt := range tests {
+		if got := stickerKindForUTI(tt.uti); got != tt.want {
+			t.Errorf("stickerKindForUTI(%q) = %v, want %v", tt.uti, got, tt.want)
+		}
+	}
+}
+
+func TestConvertAttachmentSticker(t *testing.T) {
+	data := testStickerPNG(t)
+	reply := "TARGET-GUID"
+	tests := []struct {
+		name     string
+		uti      string
+		mime     string
+		wantType event.Type
+		wantMsg  event.MessageType
+		wantBody string
+	}{
+		{"memoji", "com.apple.memoji-sticker", "image/png", event.EventSticker, "", "Memoji sticker"},
+		{"sticker", "com.apple.sticker", "image/png", event.EventSticker, "", "Sticker"},
+		{"unknown sticker type", "com.example.sticker-pack.hologram", "image/png", event.EventMessage, event.MsgImage, "sticker.png"},
+		{"sticker that isn't an image", "com.apple.sticker", "application/octet-stream", event.EventMessage, event.MsgFile, "sticker.png"},
+		{"plain image", "public.png", "image/png", event.EventMessage, event.MsgImage, "sticker.png"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inline := data
+			attMsg := &attachmentMessage{
+				WrappedMessage: &rustpushgo.WrappedMessage{Uuid: "STICKER-MSG", ReplyGuid: &reply},
+				Attachment: &rustpushgo.WrappedAttachment{
+					MimeType:   tt.mime,
+					Filename:   "sticker.png",
+					UtiType:    tt.uti,
+					IsInline:   true,
+					InlineData: &inline,
+				},
+			}
+			cm, err := convertAttachment(context.Background(), nil, nil, attMsg, false, false, 0, false)
+			if err != nil {
+				t.Fatalf("convertAttachment() error = %v", err)
+			}
+			part := cm.Parts[len(cm.Parts)-1]
+			if part.Type != tt.wantType || part.Content.MsgType != tt.wantMsg || part.Content.Body != tt.wantBody {
+				t.Errorf("convertAttachment() part = (%v, %q, %q), want (%v, %q, %q)",
+					part.Type, part.Content.MsgType, part.Content.Body, tt.wantType, tt.wantMsg, tt.wantBody)
+			}
+			if cm.ReplyTo == nil || cm.ReplyTo.MessageID != makeMessageID(reply) {
+				t.Errorf("convertAttachment() ReplyTo = %+v, want %s", cm.ReplyTo, reply)
+			}
+		})
+	}
+}
+
+func TestConvertStickerTapback(t *testing.T) {
+	data := testStickerPNG(t)
+	target := networkid.MessageID("TARGET-GUID_att1")
+	tests := []struct {
+		name     string
+		mime     string
+		target   networkid.MessageID
+		wantType event.Type
+	}{
+		{"image sticker on a part", "image/png", target, event.EventSticker},
+		{"non-image payload", "application/x-apple-sticker", target, event.EventMessage},
+		{"no target", "image/png", "", event.EventSticker},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cm, err := convertStickerTapback(context.Background(), nil, &stickerTapbackData{
+				ImageData: data,
+				MimeType:  tt.mime,
+				TargetID:  tt.target,
+			})
+			if err != nil {
+				t.Fatalf("convertStickerTapback() error = %v", err)
+			}
+			part := cm.Parts[0]
+			if part.Type != tt.wantType {
+				t.Errorf("convertStickerTapback() type = %v, want %v", part.Type, tt.wantType)
+			}
+			if tt.wantType == event.EventSticker && (part.Content.MsgType != "" || part.Content.Info.Width != 3 || part.Content.Info.Height != 2) {
+				t.Errorf("convertStickerTapback() content = %+v, want sticker with 3x2 info", part.Content)
+			}
+			if tt.wantType == event.EventMessage && part.Content.MsgType != event.MsgImage {
+				t.Errorf("convertStickerTapback() msgtype = %q, want %q", part.Content.MsgType, event.MsgImage)
+			}
+			switch {
+			case tt.target == "" && cm.ReplyTo != nil:
+				t.Errorf("convertStickerTapback() ReplyTo = %+v, want nil", cm.ReplyTo)
+			case tt.target != "" && (cm.ReplyTo == nil || cm.ReplyTo.MessageID != tt.target):
+				t.Errorf("convertStickerTapback() ReplyTo = %+v, want %s", cm.ReplyTo, tt.target)
+			}
+		})
+	}
+}
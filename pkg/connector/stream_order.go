@@ -0,0 +1,94 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2024 Ludvig Rhodin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+package connector
+
+// Backfill stream order.
+//
+// StreamOrder is what batch sending orders backfilled events by. It used to
+// be the message's millisecond timestamp (plus the attachment index on the
+// chat.db path, nothing at all on the CloudKit path), so two messages sent
+// in the same millisecond got the same order and could render either way
+// round. The order is now the timestamp shifted left, with the low bits
+// taken from the start of the message ID, so same-millisecond messages sort
+// by GUID like listBackwardMessages and listForwardMessages do, and a spare
+// range below that for attachments and companion parts of the same message.
+// Each batch is then made strictly increasing in the order it's sent, which
+// covers GUIDs that share a prefix and IDs that aren't hex.
+//
+// Live messages get the same orders: the text part at the base order and
+// each attachment one above the part before it, which is what a batch
+// assigns the parts of a backfilled message. Without that, the text and
+// attachments of a live message all shared one timestamp and could render
+// in a different order on each client.
+
+import (
+	"time"
+
+	"maunium.net/go/mautrix/bridgev2"
+)
+
+const (
+	// streamOrderGUIDBits is how many bits of the message ID go into the
+	// order: the first three hex digits.
+	streamOrderGUIDBits = 12
+	// streamOrderPartBits leaves room for the parts of one message, and for
+	// bumping past collisions, below the GUID bits.
+	streamOrderPartBits = 8
+)
+
+// guidOrderKey maps the first three hex digits of a message ID to a number
+// that sorts like the IDs themselves. Digits that aren't hex count as 0.
+func guidOrderKey(id string) int64 {
+	var key int64
+	for i := 0; i < streamOrderGUIDBits/4; i++ {
+		var digit byte
+		if i < len(id) {
+			switch ch := id[i]; {
+			case ch >= '0' && ch <= '9':
+				digit = ch - '0'
+			case ch >= 'A' && ch <= 'F':
+				digit = ch - 'A' + 10
+			case ch >= 'a' && ch <= 'f':
+				digit = ch - 'a' + 10
+			}
+		}
+		key = key<<4 | int64(digit)
+	}
+	return key
+}
+
+// backfillStreamOrder is the base stream order of a backfilled message.
+func backfillStreamOrder(ts time.Time, id string) int64 {
+	return (ts.UnixMilli()<<streamOrderGUIDBits | guidOrderKey(id)) << streamOrderPartBits
+}
+
+// liveStreamOrder is the stream order of part number part (0 for the text,
+// or the first attachment if there's no text) of a live message, matching
+// what assignBackfillStreamOrders gives the parts of a backfilled one.
+func liveStreamOrder(ts time.Time, id string, part int) int64 {
+	return backfillStreamOrder(ts, id) + int64(part)
+}
+
+// assignBackfillStreamOrders sets the stream order of each message in a
+// FetchMessages batch, which is oldest first, so the orders are unique and
+// increase through the batch.
+func assignBackfillStreamOrders(msgs []*bridgev2.BackfillMessage) {
+	var prev int64
+	for _, msg := range msgs {
+		if msg == nil {
+			continue
+		}
+		order := backfillStreamOrder(msg.Timestamp, string(msg.ID))
+		if order <= prev {
+			order = prev + 1
+		}
+		msg.StreamOrder = order
+		prev = order
+	}
+}
@@ -0,0 +1,130 @@
+package connector
+
+import (
+	"testing"
+	"time"
+
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+)
+
+func TestGUIDOrderKey(t *testing.T) {
+	tests := []struct {
+		id   string
+		want int64
+	}{
+		{"000A-...", 0x000},
+		{"1B2C3D4E-1111-2222-3333-444455556666", 0x1b2},
+		{"fab0", 0xfab},
+		{"F", 0xf00},
+		{"", 0},
+		{"p:0/GUID", 0x000},
+	}
+	for _, tt := range tests {
+		if got := guidOrderKey(tt.id); got != tt.want {
+			t.Errorf("guidOrderKey(%q) = %#x, want %#x", tt.id, got, tt.want)
+		}
+	}
+}
+
+func TestAssignBackfillStreamOrders(t *testing.T) {
+	ts := time.UnixMilli(1700000000123)
+	msg := func(id string, ts time.Time) *bridgev2.BackfillMessage {
+		return &bridgev2.BackfillMessage{ID: networkid.MessageID(id), Timestamp: ts}
+	}
+	tests := []struct {
+		name string
+		msgs []*bridgev2.BackfillMessage
+	}{
+		{"same millisecond, GUID order", []*bridgev2.BackfillMessage{
+			msg("3A000000-0000-0000-0000-000000000000", ts),
+			msg("C7000000-0000-0000-0000-000000000000", ts),
+		}},
+		{"same millisecond, shared GUID prefix", []*bridgev2.BackfillMessage{
+			msg("ABC00000-0000-0000-0000-000000000001", ts),
+			msg("ABC00000-0000-0000-0000-000000000002", ts),
+			msg("ABC00000-0000-0000-0000-000000000002_att0", ts),
+		}},
+		{"later message with a smaller GUID", []*bridgev2.BackfillMessage{
+			msg("FFF00000-0000-0000-0000-000000000000", ts),
+			msg("00000000-0000-0000-0000-000000000000", ts.Add(time.Millisecond)),
+		}},
+		{"nil entry", []*bridgev2.BackfillMessage{
+			msg("B0000000-0000-0000-0000-000000000000", ts),
+			nil,
+			msg("B0000000-0000-0000-0000-000000000000_att0", ts),
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assignBackfillStreamOrders(tt.msgs)
+			var prev int64
+			for i, m := range tt.msgs {
+				if m == nil {
+					continue
+				}
+				if m.StreamOrder <= prev {
+					t.Errorf("message %d (%s) StreamOrder = %d, want > %d", i, m.ID, m.StreamOrder, prev)
+				}
+				prev = m.StreamOrder
+			}
+		})
+	}
+}
+
+// Two same-millisecond messages split across backfill batches still get
+// orders that agree with the store's (timestamp, guid) order.
+func TestBackfillStreamOrderAcrossBatches(t *testing.T) {
+	ts := time.UnixMilli(1700000000123)
+	older := []*bridgev2.BackfillMessage{{ID: "3A000000-0000-0000-0000-000000000000", Timestamp: ts}}
+	newer := []*bridgev2.BackfillMessage{{ID: "C7000000-0000-0000-0000-000000000000", Timestamp: ts}}
+	assignBackfillStreamOrders(newer)
+	assignBackfillStreamOrders(older)
+	if older[0].StreamOrder >= newer[0].StreamOrder {
+		t.Errorf("StreamOrder of %s = %d, want < %d (%s)", older[0].ID, older[0].StreamOrder, newer[0].StreamOrder, newer[0].ID)
+	}
+	next := backfillStreamOrder(ts.Add(time.Millisecond), "00000000")
+	if newer[0].StreamOrder >= next {
+		t.Errorf("StreamOrder at %v = %d, want < %d for the next millisecond", ts, newer[0].StreamOrder, next)
+	}
+}
+
+// The parts of a live message are ordered text first, then the attachments
+// in order, with the orders backfill would give the same parts.
+func TestLiveStreamOrder(t *testing.T) {
+	ts := time.UnixMilli(1700000000123)
+	const guid = "5D000000-0000-0000-0000-000000000000"
+	tests := []struct {
+		name    string
+		hasText bool
+		atts    int
+	}{
+		{"text and attachments", true, 3},
+		{"attachments only", false, 2},
+		{"text only", true, 0},
+	}
+	for _, tt := range tests {
+		var backfill []*bridgev2.BackfillMessage
+		if tt.hasText {
+			backfill = append(backfill, &bridgev2.BackfillMessage{ID: makeMessageID(guid), Timestamp: ts})
+		}
+		for i := 0; i < tt.atts; i++ {
+			backfill = append(backfill, &bridgev2.BackfillMessage{ID: makeMessageID(makeAttID(guid, i, tt.hasText)), Timestamp: ts})
+		}
+		assignBackfillStreamOrders(backfill)
+		var prev int64
+		for part, m := range backfill {
+			got := liveStreamOrder(ts, guid, part)
+			if got != m.StreamOrder {
+				t.Errorf("liveStreamOrder(%s, part %d) = %d, want %d like backfill", tt.name, part, got, m.StreamOrder)
+			}
+			if got <= prev {
+				t.Errorf("liveStreamOrder(%s, part %d) = %d, want > %d", tt.name, part, got, prev)
+			}
+			prev = got
+		}
+		if next := liveStreamOrder(ts.Add(time.Millisecond), "00000000-0000-0000-0000-000000000000", 0); next <= prev {
+			t.Errorf("liveStreamOrder(%s) of the next message = %d, want > %d", tt.name, next, prev)
+		}
+	}
+}
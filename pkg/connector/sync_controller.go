@@ -407,7 +407,7 @@ func (c *IMClient) seedDeletedChatsFromRecycleBin(log zerolog.Logger) {
 			log.Info().
 				Str("portal_id", portalID).
 				Str("record_name", chat.RecordName).
-				Str("name", name).
+				Str("name", logText(name)).
 				Msg("DELETE-SEED: seeded deleted chat from recoverable chat identity")
 		}
 	}
@@ -542,7 +542,7 @@ func (c *IMClient) seedDeletedChatsFromRecycleBin(log zerolog.Logger) {
 					}
 					log.Info().
 						Str("portal_id", portalID).
-						Str("name", name).
+						Str("name", logText(name)).
 						Int("recoverable", state.Recoverable).
 						Int("recoverable_suffix", state.RecoverableSuffix).
 						Int("total", state.Total).
@@ -678,7 +678,7 @@ func (c *IMClient) seedDeletedChatsFromRecycleBin(log zerolog.Logger) {
 			}
 			log.Info().
 				Str("portal_id", hint.PortalID).
-				Str("name", name).
+				Str("name", logText(name)).
 				Int("recoverable", hint.Count).
 				Str("cloud_chat_id", hint.CloudChatID).
 				Msg("DELETE-SEED: seeded deleted chat from recoverable message metadata")
@@ -1354,6 +1354,7 @@ func (c *IMClient) refreshGhostNamesFromContacts(log zerolog.Logger) {
 	rows.Close()
 
 	updated := 0
+	pacer := c.newGhostUpdatePacer()
 	for _, g := range ghosts {
 		// Skip ghosts with no matching contact (efficiency: avoids loading
 		// the full ghost object for participants who aren't in the address book).
@@ -1361,10 +1362,11 @@ func (c *IMClient) refreshGhostNamesFromContacts(log zerolog.Logger) {
 		if localID == "" {
 			continue
 		}
-		contact, _ := c.contacts.GetContactInfo(localID)
+		contact := c.lookupContact(localID)
 		if contact == nil || !contact.HasName() {
 			continue
 		}
+		change := c.contactNames.swap(g.id, contactNameFieldsOf(contact))
 		// Diff-gate: compute the expected displayname and skip if it matches
 		// the stored name. This prevents unnecessary Matrix profile update API
 		// calls on every contact refresh cycle (AggressiveUpdateInfo=true means
@@ -1376,6 +1378,10 @@ func (c *IMClient) refreshGhostNamesFromContacts(log zerolog.Logger) {
 			ID:        localID,
 		})
 		if g.name == expectedName {
+			if change == contactNameNicknameOnly {
+				log.Debug().Str("ghost_id", string(g.id)).Str("nickname_precedence", c.Main.Config.NicknamePrecedence).
+					Msg("Contact nickname changed, but it isn't part of the display name")
+			}
 			continue
 		}
 		ghost, err := c.Main.Bridge.GetGhostByID(ctx, g.id)
@@ -1383,12 +1389,20 @@ func (c *IMClient) refreshGhostNamesFromContacts(log zerolog.Logger) {
 			log.Warn().Err(err).Str("ghost_id", string(g.id)).Msg("Failed to load ghost for name refresh")
 			continue
 		}
+		if change != contactNameUnchanged {
+			log.Info().Str("ghost_id", string(g.id)).Stringer("changed", change).
+				Msg("Contact name changed, updating ghost")
+		}
 		// Use the full GetUserInfo → UpdateInfo cycle (same as refreshAllGhosts)
 		// to ensure name, avatar, and identifiers are all propagated to Matrix.
 		info, err := c.GetUserInfo(ctx, ghost)
 		if err != nil || info == nil {
 			continue
 		}
+		if !pacer.wait() {
+			log.Info().Int("updated", updated).Msg("Stopped before all ghost names were refreshed")
+			return
+		}
 		ghost.UpdateInfo(ctx, info)
 		updated++
 	}
@@ -1529,6 +1543,11 @@ func (c *IMClient) runCloudSyncController(log zerolog.Logger) {
 	}
 	log.Info().Dur("contacts_wait", time.Since(controllerStart)).Msg("Contacts ready, proceeding with CloudKit sync")
 
+	if !c.checkCloudKitAccess(log) {
+		c.setCloudSyncDone() // unblock APNs portal creation
+		return
+	}
+
 	// Repopulate recentlyDeletedPortals from DB before CloudKit sync.
 	// This ensures tombstones from prior sessions survive bridge restarts
 	// even if CloudKit's incremental sync (with a saved continuation token)
@@ -1576,6 +1595,7 @@ func (c *IMClient) runCloudSyncController(log zerolog.Logger) {
 			log.Error().Err(err).
 				Dur("retry_in", cloudSyncRetryInterval).
 				Msg("CloudKit sync failed, will retry (APNs gate stays closed)")
+			c.reportErrorNotice(errorNoticeSyncFailed, "", err)
 			select {
 			case <-time.After(cloudSyncRetryInterval):
 				continue
@@ -1702,6 +1722,7 @@ func (c *IMClient) runCloudSyncController(log zerolog.Logger) {
 			c.cloudSyncRunning = false
 			c.cloudSyncRunningLock.Unlock()
 			resyncLog.Warn().Err(err).Msg("Delayed incremental re-sync failed")
+			c.reportErrorNotice(errorNoticeSyncFailed, "", err)
 			continue
 		}
 		// Extend skipPortals with any portals deleted since bootstrap.
@@ -1984,6 +2005,7 @@ func (c *IMClient) runCloudKitBackfill(ctx context.Context, log zerolog.Logger)
 		}
 	}
 	total.add(chatCounts)
+	c.Main.metrics.cloudSyncImportedAdd("chat", chatCounts.Imported)
 
 	if attErr != nil {
 		log.Warn().Err(attErr).Msg("Failed to sync CloudKit attachments (continuing without)")
@@ -2006,6 +2028,7 @@ func (c *IMClient) runCloudKitBackfill(ctx context.Context, log zerolog.Logger)
 		}
 	}
 	total.add(msgCounts)
+	c.Main.metrics.cloudSyncImportedAdd("message", msgCounts.Imported)
 
 	log.Info().
 		Dur("phase2_elapsed", time.Since(phase2Start)).
@@ -2177,6 +2200,23 @@ func (c *IMClient) syncCloudChats(ctx context.Context) (cloudSyncCounters, *stri
 	totalPages := 0
 	consecutiveErrors := 0
 	const maxConsecutiveChatErrors = 3
+
+	var dump *cloudChatDump
+	if dumpPath := c.Main.Config.CloudKitChatDumpPath; dumpPath != "" {
+		if dump, err = openCloudChatDump(dumpPath); err != nil {
+			log.Warn().Err(err).Str("path", dumpPath).Msg("Not dumping CloudKit chats")
+		} else {
+			defer func() {
+				n, closeErr := dump.Close()
+				if closeErr != nil {
+					log.Warn().Err(closeErr).Str("path", dumpPath).Msg("Failed to finish CloudKit chat dump")
+				} else {
+					log.Info().Int("chats", n).Str("path", dumpPath).Msg("Dumped CloudKit chats")
+				}
+			}()
+		}
+	}
+
 	for page := 0; page < maxCloudSyncPages; page++ {
 		resp, syncErr := safeCloudSyncChats(c.client, token)
 		if syncErr != nil {
@@ -2207,6 +2247,12 @@ func (c *IMClient) syncCloudChats(ctx context.Context) (cloudSyncCounters, *stri
 			Bool("done", resp.Done).
 			Msg("CloudKit chat sync page")
 
+		if dump != nil {
+			if dumpErr := dump.writePage(resp.Chats); dumpErr != nil {
+				log.Warn().Err(dumpErr).Int("page", page).Msg("Failed to write CloudKit chat dump")
+			}
+		}
+
 		ingestCounts, ingestErr := c.ingestCloudChats(ctx, resp.Chats)
 		if ingestErr != nil {
 			return counts, token, ingestErr
@@ -2741,20 +2787,36 @@ func (c *IMClient) ingestCloudMessages(
 	var deletedGUIDs []string
 	var liveMessages []rustpushgo.WrappedCloudSyncMessage
 	for _, msg := range messages {
+		// Some CloudKit records have a record name but no GUID; give them
+		// a deterministic synthetic one so they're stored and de-duplicated
+		// like any other message (synthetic_guid.go).
+		if msg.Guid == "" {
+			msg.Guid = cloudMessageGUID(&msg)
+			log.Debug().
+				Str("record_name", msg.RecordName).
+				Str("synthetic_guid", msg.Guid).
+				Msg("Synthesized GUID for CloudKit message without one")
+		}
 		if msg.Deleted {
 			counts.Deleted++
-			if msg.Guid != "" {
-				deletedGUIDs = append(deletedGUIDs, msg.Guid)
-			}
+			deletedGUIDs = append(deletedGUIDs, msg.Guid)
 			continue
 		}
 		liveMessages = append(liveMessages, msg)
 	}
 
+	// Work out which bridged messages to redact (redact_cloud_deleted_messages)
+	// while the rows still show which deletions are new.
+	redactions, err := c.cloudDeletionRedactions(ctx, deletedGUIDs)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to look up deleted messages to redact")
+	}
+
 	// Remove deleted messages from DB.
 	if err := c.cloudStore.deleteMessageBatch(ctx, deletedGUIDs); err != nil {
 		return fmt.Errorf("failed to delete messages: %w", err)
 	}
+	c.queueCloudDeletionRedactions(log, redactions)
 
 	// Snapshot recentlyDeletedPortals so we can mark re-imported messages for
 	// deleted portals as deleted=TRUE. This closes the race where a periodic
@@ -2833,18 +2895,8 @@ func (c *IMClient) ingestCloudMessages(
 	}
 
 	batch := make([]cloudMessageRow, 0, len(liveMessages))
+	importedByPortal := make(map[string]int)
 	for _, msg := range liveMessages {
-		if msg.Guid == "" {
-			log.Warn().
-				Str("cloud_chat_id", msg.CloudChatId).
-				Str("sender", msg.Sender).
-				Bool("is_from_me", msg.IsFromMe).
-				Int64("timestamp_ms", msg.TimestampMs).
-				Msg("Skipping message with empty GUID")
-			counts.Skipped++
-			continue
-		}
-
 		// NOTE: msgType=0 is a REGULAR user message in CloudKit — do NOT filter
 		// it. System/service messages are already filtered on the Rust side using
 		// IS_SYSTEM_MESSAGE / IS_SERVICE_MESSAGE flags. A previous version of this
@@ -3057,13 +3109,20 @@ func (c *IMClient) ingestCloudMessages(
 			counts.Updated++
 		} else {
 			counts.Imported++
+			if c.Main.Config.CloudKitUpsertByPortal {
+				importedByPortal[portalID]++
+			}
 		}
 	}
 
-	// Phase 2: Batch insert all live rows in a single transaction.
-	if err := c.cloudStore.upsertMessageBatch(ctx, batch); err != nil {
+	// Phase 2: Batch insert all live rows, in a single transaction or one
+	// per portal (cloud_upsert_grouping.go).
+	if err := c.upsertCloudMessageRows(ctx, batch); err != nil {
 		return err
 	}
+	for portalID, n := range importedByPortal {
+		c.cloudPortalImports.add(portalID, n)
+	}
 
 	return nil
 }
@@ -3185,6 +3244,7 @@ func (c *IMClient) createPortalsFromCloudSync(ctx context.Context, log zerolog.L
 	alreadyQueued := 0
 	pendingDeleteSkipped := 0
 	groupDedupSkipped := 0
+	quietSkipped := 0
 	seenGroupKeys := make(map[string]string) // dedup key → chosen portal_id
 	for _, p := range portalInfos {
 		newestTSByPortal[p.PortalID] = p.NewestTS
@@ -3251,7 +3311,14 @@ func (c *IMClient) createPortalsFromCloudSync(ctx context.Context, log zerolog.L
 		}
 		portalKey := networkid.PortalKey{ID: networkid.PortalID(p.PortalID), Receiver: c.UserLogin.ID}
 		existingPortal, _ := c.UserLogin.Bridge.GetExistingPortalByKey(ctx, portalKey)
-		if p.MessageCount > 0 && (existingPortal == nil || existingPortal.MXID == "") {
+		hasRoom := existingPortal != nil && existingPortal.MXID != ""
+		// Leave quiet chats without a room (see quiet_portals.go). Not
+		// recorded in queuedPortals, so a later sync re-checks them.
+		if !hasRoom && c.Main.Config.skipQuietPortal(p) {
+			quietSkipped++
+			continue
+		}
+		if p.MessageCount > 0 && !hasRoom {
 			forwardBackfillPortals++
 		}
 		ordered = append(ordered, p.PortalID)
@@ -3262,12 +3329,21 @@ func (c *IMClient) createPortalsFromCloudSync(ctx context.Context, log zerolog.L
 	if groupDedupSkipped > 0 {
 		log.Info().Int("skipped", groupDedupSkipped).Msg("Skipped duplicate group portal IDs (same group, different UUID)")
 	}
+	if quietSkipped > 0 {
+		log.Info().Int("skipped", quietSkipped).Msg("Skipped outbound-only or low-activity chats without a room")
+	}
+	// Portals with the most new messages first (cloud_upsert_grouping.go).
+	if imported := c.cloudPortalImports.drain(); len(imported) > 0 {
+		prioritizePortalsByImports(ordered, imported)
+		log.Debug().Int("portals_with_imports", len(imported)).Msg("Prioritized portals by newly imported messages")
+	}
 
 	portalStart := time.Now()
 	log.Info().
 		Int("total_candidates", len(portalInfos)).
 		Int("already_queued", alreadyQueued).
 		Int("group_dedup_skipped", groupDedupSkipped).
+		Int("quiet_skipped", quietSkipped).
 		Int("to_process", len(ordered)).
 		Msg("Creating portals from cloud sync")
 
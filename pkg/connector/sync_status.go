@@ -0,0 +1,110 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2024 Ludvig Rhodin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+package connector
+
+// CloudKit sync status (sync-status command).
+//
+// cloud_sync_state records, per zone, the continuation token, when the zone
+// last synced successfully and the last error, but none of it was visible
+// without reading the database. sync-status reports it, along with how far
+// behind each zone is and how many attachments are waiting in the
+// pending_attachment_retry queue. It only reads; nothing is synced or
+// retried.
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"maunium.net/go/mautrix/bridgev2/commands"
+)
+
+// syncStatusReport is what sync-status shows.
+type syncStatusReport struct {
+	Zones []syncZoneState
+	// RetryQueued and RetryDue count pending_attachment_retry rows; -1 if
+	// the queue couldn't be read.
+	RetryQueued int
+	RetryDue    int
+}
+
+// formatSyncStatus renders the sync-status reply.
+func formatSyncStatus(report syncStatusReport, now time.Time) string {
+	var sb strings.Builder
+	sb.WriteString("**CloudKit sync status**\n\n")
+	if len(report.Zones) == 0 {
+		sb.WriteString("No zone has synced yet.\n")
+	}
+	for _, zone := range report.Zones {
+		sb.WriteString(fmt.Sprintf("* `%s`: ", zone.Zone))
+		if zone.LastSuccessTS > 0 {
+			last := time.UnixMilli(zone.LastSuccessTS)
+			sb.WriteString(fmt.Sprintf("last success %s (%s ago)",
+				last.UTC().Format("2006-01-02 15:04 UTC"), now.Sub(last).Round(time.Minute)))
+		} else {
+			sb.WriteString("never synced successfully")
+		}
+		if zone.HasToken {
+			sb.WriteString(", continuation token saved")
+		} else {
+			sb.WriteString(", no continuation token (next sync starts from scratch)")
+		}
+		sb.WriteString("\n")
+		if zone.LastError != "" {
+			sb.WriteString(fmt.Sprintf("  * Last error (%s ago): %s\n",
+				now.Sub(time.UnixMilli(zone.UpdatedTS)).Round(time.Minute), zone.LastError))
+		}
+	}
+	sb.WriteString("\n")
+	if report.RetryQueued < 0 {
+		sb.WriteString("Attachment retry queue: unavailable.")
+	} else {
+		sb.WriteString(fmt.Sprintf("Attachment retry queue: %d queued, %d due now.", report.RetryQueued, report.RetryDue))
+	}
+	return sb.String()
+}
+
+var cmdSyncStatus = &commands.FullHandler{
+	Name: "sync-status",
+	Func: fnSyncStatus,
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionGeneral,
+		Description: "Show when each CloudKit zone last synced, any sync errors and the attachment retry queue.",
+	},
+	RequiresLogin: true,
+}
+
+func fnSyncStatus(ce *commands.Event) {
+	login := ce.User.GetDefaultLogin()
+	if login == nil {
+		ce.Reply("Not logged in.")
+		return
+	}
+	client, ok := login.Client.(*IMClient)
+	if !ok || client == nil {
+		ce.Reply("Bridge client not available.")
+		return
+	}
+	if client.cloudStore == nil {
+		ce.Reply("CloudKit sync isn't enabled for this login.")
+		return
+	}
+	zones, err := client.cloudStore.listSyncZoneStates(ce.Ctx)
+	if err != nil {
+		ce.Reply("Failed to read the sync state: %v", err)
+		return
+	}
+	report := syncStatusReport{Zones: zones, RetryQueued: -1, RetryDue: -1}
+	if client.pendingAttachments != nil {
+		if total, due, err := client.pendingAttachments.Count(ce.Ctx, time.Now()); err == nil {
+			report.RetryQueued, report.RetryDue = total, due
+		}
+	}
+	ce.Reply(formatSyncStatus(report, time.Now()))
+}
@@ -0,0 +1,102 @@
+package connector
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestListSyncZoneStates(t *testing.T) {
+	ctx := context.Background()
+	store := newTestCloudStore(t)
+	token := "tok"
+	if err := store.setSyncStateSuccess(ctx, cloudZoneMessages, &token); err != nil {
+		t.Fatalf("setSyncStateSuccess() error = %v", err)
+	}
+	if err := store.setSyncStateError(ctx, cloudZoneChats, "zone busy"); err != nil {
+		t.Fatalf("setSyncStateError() error = %v", err)
+	}
+	if err := store.setSyncVersion(ctx, 3); err != nil {
+		t.Fatalf("setSyncVersion() error = %v", err)
+	}
+
+	zones, err := store.listSyncZoneStates(ctx)
+	if err != nil {
+		t.Fatalf("listSyncZoneStates() error = %v", err)
+	}
+	var names []string
+	for _, zone := range zones {
+		names = append(names, zone.Zone)
+	}
+	if want := []string{cloudZoneChats, cloudZoneMessages}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("listSyncZoneStates() zones = %v, want %v", names, want)
+	}
+	if chats := zones[0]; chats.HasToken || chats.LastSuccessTS != 0 || chats.LastError != "zone busy" {
+		t.Errorf("chat zone = %+v, want no token, no success, last error %q", chats, "zone busy")
+	}
+	if msgs := zones[1]; !msgs.HasToken || msgs.LastSuccessTS == 0 || msgs.LastError != "" {
+		t.Errorf("message zone = %+v, want token, a success time and no error", msgs)
+	}
+}
+
+func TestFormatSyncStatus(t *testing.T) {
+	now := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	report := syncStatusReport{
+		Zones: []syncZoneState{
+			{Zone: cloudZoneAttachments, HasToken: true, LastSuccessTS: now.Add(-2 * time.Hour).UnixMilli(), UpdatedTS: now.Add(-2 * time.Hour).UnixMilli()},
+			{Zone: cloudZoneChats, LastError: "zone busy", UpdatedTS: now.Add(-5 * time.Minute).UnixMilli()},
+		},
+		RetryQueued: 4,
+		RetryDue:    1,
+	}
+	got := formatSyncStatus(report, now)
+	for _, want := range []string{
+		"`attachmentManateeZone`: last success 2025-03-01 10:00 UTC (2h0m0s ago), continuation token saved",
+		"`chatManateeZone`: never synced successfully, no continuation token",
+		"Last error (5m0s ago): zone busy",
+		"Attachment retry queue: 4 queued, 1 due now.",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("formatSyncStatus() = %q, want it to contain %q", got, want)
+		}
+	}
+
+	empty := formatSyncStatus(syncStatusReport{RetryQueued: -1}, now)
+	for _, want := range []string{"No zone has synced yet.", "Attachment retry queue: unavailable."} {
+		if !strings.Contains(empty, want) {
+			t.Errorf("formatSyncStatus(empty) = %q, want it to contain %q", empty, want)
+		}
+	}
+}
+
+func TestPendingAttachmentCount(t *testing.T) {
+	ctx := context.Background()
+	db := newTestBridgeDB(t)
+	pending := newPendingAttachmentStore(db.Database, "login")
+	if err := pending.ensureSchema(ctx); err != nil {
+		t.Fatalf("ensureSchema() error = %v", err)
+	}
+	now := time.Now()
+	for i, next := range []time.Time{now.Add(-time.Minute), now.Add(time.Hour), now.Add(2 * time.Hour)} {
+		if err := pending.Insert(ctx, &pendingAttachmentRow{
+			MessageGUID:   "guid",
+			AttIndex:      i,
+			AttID:         "guid",
+			PortalID:      "tel:+15551234567",
+			CreatedAt:     now,
+			LastAttemptAt: now,
+			NextAttemptAt: next,
+		}); err != nil {
+			t.Fatalf("Insert() error = %v", err)
+		}
+	}
+	total, due, err := pending.Count(ctx, now)
+	if err != nil {
+		t.Fatalf("Count() error = %v", err)
+	}
+	if total != 3 || due != 1 {
+		t.Errorf("Count() = %d, %d, want 3, 1", total, due)
+	}
+}
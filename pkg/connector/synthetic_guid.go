@@ -0,0 +1,107 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2024 Ludvig Rhodin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+package connector
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/lrhodin/imessage/pkg/rustpushgo"
+)
+
+// Every message ID in the bridge is the iMessage GUID, but a few legitimate
+// CloudKit records (and the odd APNs payload) arrive with an empty one.
+// Dropping them loses real messages; giving them a synthetic ID keeps them,
+// and as long as the ID is deterministic a re-sync of the same record maps
+// to the same row and Matrix event instead of duplicating it.
+//
+// Synthetic IDs carry a prefix that can't occur in a real GUID (those are
+// bare UUIDs), so they never collide with one. CloudKit and APNs derive them
+// from the same key, so a message that arrives both ways maps to one row.
+// The exception is a message with attachments: the key includes each
+// attachment's identity so two attachment-only messages sent in the same
+// second stay apart, and the two sources don't describe attachments the same
+// way (CloudKit has the transfer GUIDs, APNs the file name and size).
+// Apple has never seen a synthetic ID, so replies, tapbacks, edits, unsends
+// and read receipts must not send one (isSyntheticGUID).
+
+const syntheticGUIDContentPrefix = "synthetic:"
+
+// errSyntheticTarget is returned for outgoing events that target a message
+// with a synthetic ID.
+var errSyntheticTarget = errors.New("the target message has no iMessage ID, so it can't be reacted to, edited or unsent")
+
+// isSyntheticGUID reports whether a message ID (optionally with an _attN
+// suffix) is synthetic.
+func isSyntheticGUID(id string) bool {
+	return strings.HasPrefix(id, syntheticGUIDContentPrefix)
+}
+
+// syntheticContentGUID derives an ID from what identifies a message when
+// nothing else does: who sent it, when, what it said and what it attached.
+// The sender is normalized, and left out of the user's own messages, and the
+// time is cut to whole seconds, so the differences in how CloudKit and APNs
+// report those don't give one message two IDs.
+func syntheticContentGUID(sender string, isFromMe bool, timestampMS int64, text string, attachments []string) string {
+	if isFromMe {
+		sender = ""
+	} else if normalized := normalizeIdentifierForPortalID(sender); normalized != "" {
+		sender = normalized
+	}
+	h := sha256.New()
+	h.Write([]byte(sender))
+	h.Write([]byte{0})
+	h.Write([]byte(strconv.FormatBool(isFromMe)))
+	h.Write([]byte{0})
+	h.Write([]byte(strconv.FormatInt(timestampMS/1000, 10)))
+	h.Write([]byte{0})
+	h.Write([]byte(text))
+	for _, att := range attachments {
+		h.Write([]byte{0})
+		h.Write([]byte(att))
+	}
+	return syntheticGUIDContentPrefix + hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// cloudMessageGUID returns msg.Guid, or a synthetic ID from sender,
+// timestamp, text and attachment GUIDs when it is empty. The CloudKit record name isn't used:
+// the same message coming in over APNs has none.
+func cloudMessageGUID(msg *rustpushgo.WrappedCloudSyncMessage) string {
+	if msg.Guid != "" {
+		return msg.Guid
+	}
+	text := ""
+	if msg.Text != nil {
+		text = *msg.Text
+	}
+	return syntheticContentGUID(msg.Sender, msg.IsFromMe, msg.TimestampMs, text, msg.AttachmentGuids)
+}
+
+// apnsMessageGUID returns msg.Uuid, or a synthetic ID from sender, timestamp,
+// text and attachment names and sizes when it is empty.
+func apnsMessageGUID(msg *rustpushgo.WrappedMessage, isFromMe bool) string {
+	if msg.Uuid != "" {
+		return msg.Uuid
+	}
+	sender, text := "", ""
+	if msg.Sender != nil {
+		sender = *msg.Sender
+	}
+	if msg.Text != nil {
+		text = *msg.Text
+	}
+	var attachments []string
+	for _, att := range msg.Attachments {
+		attachments = append(attachments, att.Filename+"/"+strconv.FormatUint(att.Size, 10))
+	}
+	return syntheticContentGUID(sender, isFromMe, int64(msg.TimestampMs), text, attachments)
+}
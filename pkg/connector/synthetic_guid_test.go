@@ -0,0 +1,157 @@
+package connector
+
+import (
+	"strings"
+	"testing"
+
+	"maunium.net/go/mautrix/bridgev2/database"
+
+	"github.com/lrhodin/imessage/pkg/rustpushgo"
+)
+
+func TestCloudMessageGUID(t *testing.T) {
+	text := "See you at 8"
+	otherText := "See you at 9"
+	base := rustpushgo.WrappedCloudSyncMessage{
+		Sender:      "tel:+15551234567",
+		TimestampMs: 1700000000000,
+		Text:        &text,
+	}
+	with := func(mutate func(*rustpushgo.WrappedCloudSyncMessage)) *rustpushgo.WrappedCloudSyncMessage {
+		msg := base
+		mutate(&msg)
+		return &msg
+	}
+	contentID := cloudMessageGUID(with(func(*rustpushgo.WrappedCloudSyncMessage) {}))
+
+	tests := []struct {
+		name string
+		msg  *rustpushgo.WrappedCloudSyncMessage
+		want func(string) bool
+	}{
+		{"real guid kept", with(func(m *rustpushgo.WrappedCloudSyncMessage) { m.Guid = "6B1D8E8A-1C2B-4D0E-9F3A-0123456789AB" }),
+			func(got string) bool { return got == "6B1D8E8A-1C2B-4D0E-9F3A-0123456789AB" }},
+		{"record name ignored", with(func(m *rustpushgo.WrappedCloudSyncMessage) { m.RecordName = "abc123" }),
+			func(got string) bool { return got == contentID }},
+		{"content hash fallback", with(func(*rustpushgo.WrappedCloudSyncMessage) {}),
+			func(got string) bool { return strings.HasPrefix(got, "synthetic:") && len(got) == len("synthetic:")+32 }},
+		{"different text", with(func(m *rustpushgo.WrappedCloudSyncMessage) { m.Text = &otherText }),
+			func(got string) bool { return got != contentID }},
+		{"same second", with(func(m *rustpushgo.WrappedCloudSyncMessage) { m.TimestampMs += 999 }),
+			func(got string) bool { return got == contentID }},
+		{"different timestamp", with(func(m *rustpushgo.WrappedCloudSyncMessage) { m.TimestampMs += 1000 }),
+			func(got string) bool { return got != contentID }},
+		{"different sender", with(func(m *rustpushgo.WrappedCloudSyncMessage) { m.Sender = "tel:+15559876543" }),
+			func(got string) bool { return got != contentID }},
+		{"from me", with(func(m *rustpushgo.WrappedCloudSyncMessage) { m.IsFromMe = true }),
+			func(got string) bool { return got != contentID }},
+		{"with attachment", with(func(m *rustpushgo.WrappedCloudSyncMessage) { m.AttachmentGuids = []string{"at_0_A"} }),
+			func(got string) bool { return got != contentID }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := cloudMessageGUID(tt.msg); !tt.want(got) {
+				t.Errorf("cloudMessageGUID() = %q", got)
+			}
+		})
+	}
+}
+
+func TestCloudMessageGUIDDeterministic(t *testing.T) {
+	textA, textB := "hello", "hello"
+	a := rustpushgo.WrappedCloudSyncMessage{Sender: "mailto:a@example.com", TimestampMs: 42, Text: &textA}
+	b := rustpushgo.WrappedCloudSyncMessage{Sender: "mailto:a@example.com", TimestampMs: 42, Text: &textB}
+	if ga, gb := cloudMessageGUID(&a), cloudMessageGUID(&b); ga != gb {
+		t.Errorf("cloudMessageGUID() of identical records = %q, %q, want equal", ga, gb)
+	}
+	a.RecordName, b.RecordName = "rec-1", "rec-1"
+	if ga, gb := cloudMessageGUID(&a), cloudMessageGUID(&b); ga != gb {
+		t.Errorf("cloudMessageGUID() of identical records with record name = %q, %q, want equal", ga, gb)
+	}
+}
+
+func TestAPNsMessageGUID(t *testing.T) {
+	sender, text := "tel:+15551234567", "hi"
+	msg := rustpushgo.WrappedMessage{Sender: &sender, Text: &text, TimestampMs: 1700000000000}
+	first := apnsMessageGUID(&msg, false)
+	if !strings.HasPrefix(first, "synthetic:") {
+		t.Errorf("apnsMessageGUID() = %q, want synthetic: prefix", first)
+	}
+	if again := apnsMessageGUID(&msg, false); again != first {
+		t.Errorf("apnsMessageGUID() not deterministic: %q != %q", again, first)
+	}
+	msg.Uuid = "ABC"
+	if got := apnsMessageGUID(&msg, false); got != "ABC" {
+		t.Errorf("apnsMessageGUID() = %q, want %q", got, "ABC")
+	}
+}
+
+func TestSyntheticGUIDAttachmentOnly(t *testing.T) {
+	// Two attachment-only messages from the same sender in the same second.
+	cloudA := rustpushgo.WrappedCloudSyncMessage{Sender: "tel:+15551234567", TimestampMs: 1700000000100, AttachmentGuids: []string{"at_0_A"}}
+	cloudB := rustpushgo.WrappedCloudSyncMessage{Sender: "tel:+15551234567", TimestampMs: 1700000000900, AttachmentGuids: []string{"at_0_B"}}
+	if a, b := cloudMessageGUID(&cloudA), cloudMessageGUID(&cloudB); a == b {
+		t.Errorf("cloudMessageGUID() of two attachment-only messages = %q for both, want different", a)
+	}
+	if a, again := cloudMessageGUID(&cloudA), cloudMessageGUID(&cloudA); a != again {
+		t.Errorf("cloudMessageGUID() with attachments not deterministic: %q != %q", a, again)
+	}
+
+	sender := "tel:+15551234567"
+	apnsA := rustpushgo.WrappedMessage{Sender: &sender, TimestampMs: 1700000000100,
+		Attachments: []rustpushgo.WrappedAttachment{{Filename: "IMG_0001.jpeg", Size: 204800}}}
+	apnsB := rustpushgo.WrappedMessage{Sender: &sender, TimestampMs: 1700000000900,
+		Attachments: []rustpushgo.WrappedAttachment{{Filename: "IMG_0002.jpeg", Size: 198112}}}
+	if a, b := apnsMessageGUID(&apnsA, false), apnsMessageGUID(&apnsB, false); a == b {
+		t.Errorf("apnsMessageGUID() of two attachment-only messages = %q for both, want different", a)
+	}
+	if a, again := apnsMessageGUID(&apnsA, false), apnsMessageGUID(&apnsA, false); a != again {
+		t.Errorf("apnsMessageGUID() with attachments not deterministic: %q != %q", a, again)
+	}
+}
+
+func TestSyntheticGUIDSameAcrossSources(t *testing.T) {
+	text := "hi"
+	tests := []struct {
+		name        string
+		cloudSender string
+		apnsSender  string
+		isFromMe    bool
+		cloudTS     int64
+		apnsTS      uint64
+	}{
+		{"same sender and time", "tel:+15551234567", "tel:+15551234567", false, 1700000000123, 1700000000123},
+		{"sender without prefix", "+15551234567", "tel:+15551234567", false, 1700000000000, 1700000000456},
+		{"from me, sender differs", "", "mailto:me@example.com", true, 1700000000000, 1700000000000},
+	}
+	for _, tt := range tests {
+		cloud := rustpushgo.WrappedCloudSyncMessage{Sender: tt.cloudSender, IsFromMe: tt.isFromMe, TimestampMs: tt.cloudTS, Text: &text, RecordName: "rec-1"}
+		apnsSender := tt.apnsSender
+		apns := rustpushgo.WrappedMessage{Sender: &apnsSender, Text: &text, TimestampMs: tt.apnsTS}
+		if cloudID, apnsID := cloudMessageGUID(&cloud), apnsMessageGUID(&apns, tt.isFromMe); cloudID != apnsID {
+			t.Errorf("%s: cloudMessageGUID() = %q, apnsMessageGUID() = %q, want equal", tt.name, cloudID, apnsID)
+		}
+	}
+}
+
+func TestSyntheticGUIDNotSentToApple(t *testing.T) {
+	synthetic := syntheticContentGUID("tel:+15551234567", false, 1700000000000, "hi", nil)
+	tests := []struct {
+		id        string
+		wantReply bool
+	}{
+		{"6B1D8E8A-1C2B-4D0E-9F3A-0123456789AB", true},
+		{"6B1D8E8A-1C2B-4D0E-9F3A-0123456789AB_att0", true},
+		{synthetic, false},
+		{synthetic + "_att1", false},
+	}
+	for _, tt := range tests {
+		if got := isSyntheticGUID(tt.id); got == tt.wantReply {
+			t.Errorf("isSyntheticGUID(%q) = %v, want %v", tt.id, got, !tt.wantReply)
+		}
+		guid, part := extractReplyInfo(&database.Message{ID: makeMessageID(tt.id)})
+		if (guid != nil) != tt.wantReply || (part != nil) != tt.wantReply {
+			t.Errorf("extractReplyInfo(%q) = %v, %v, want a reply target: %v", tt.id, guid, part, tt.wantReply)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2024 Ludvig Rhodin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+package connector
+
+// Tapback reconciliation for backfill.
+//
+// CloudKit keeps every tapback a message got as a row of its own, additions
+// and removals alike, and a ChatResync backfill reads them all again.
+// Replaying them one by one churns the room: a tapback changed a few times
+// is added, replaced and removed again, and a stale removal can take down a
+// reaction that was changed since. Instead the tapbacks of a batch are
+// reduced to the state they end in for each message and sender (iMessage
+// allows one tapback per sender per message, so the latest one decides),
+// compared with the reactions already bridged, and only the difference is
+// sent: an addition where the bridged reaction is missing or different, and
+// a removal only where it's the reaction being removed.
+
+import (
+	"context"
+	"time"
+
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/bridgev2/simplevent"
+)
+
+// tapbackChange is one tapback from a sender on a message: the emoji it
+// sets, or for a removal the emoji it takes away.
+type tapbackChange struct {
+	Target    networkid.MessageID
+	Part      *networkid.PartID
+	Sender    bridgev2.EventSender
+	Emoji     string
+	Remove    bool
+	Timestamp time.Time
+}
+
+// tapbackKey identifies the single reaction a sender can have on a message
+// part.
+type tapbackKey struct {
+	target networkid.MessageID
+	part   networkid.PartID
+	sender networkid.UserID
+}
+
+func (tc tapbackChange) key() tapbackKey {
+	key := tapbackKey{target: tc.Target, sender: tc.Sender.Sender}
+	if tc.Part != nil {
+		key.part = *tc.Part
+	}
+	return key
+}
+
+// latestTapbacks reduces changes, in chronological order, to the last one
+// for each message part and sender, in the order they were first seen.
+func latestTapbacks(changes []tapbackChange) []tapbackChange {
+	index := make(map[tapbackKey]int, len(changes))
+	var latest []tapbackChange
+	for _, tc := range changes {
+		key := tc.key()
+		if i, ok := index[key]; ok {
+			latest[i] = tc
+			continue
+		}
+		index[key] = len(latest)
+		latest = append(latest, tc)
+	}
+	return latest
+}
+
+// reconcileTapbacks returns the changes among latest (one per message part
+// and sender, see latestTapbacks) that the bridged reactions in current
+// don't already reflect. Reactions of senders not in latest are left alone.
+func reconcileTapbacks(current map[tapbackKey]string, latest []tapbackChange) []tapbackChange {
+	var changes []tapbackChange
+	for _, tc := range latest {
+		bridged := current[tc.key()]
+		if tc.Remove {
+			if bridged == "" || !sameTapback(bridged, tc.Emoji) {
+				continue
+			}
+		} else if bridged != "" && sameTapback(bridged, tc.Emoji) {
+			continue
+		}
+		changes = append(changes, tc)
+	}
+	return changes
+}
+
+// queueTapbackChanges bridges tapbacks on already-bridged messages as
+// reaction events, sending only what differs from the reactions there.
+func (c *IMClient) queueTapbackChanges(ctx context.Context, portalKey networkid.PortalKey, changes []tapbackChange) {
+	latest := latestTapbacks(changes)
+	current := make(map[tapbackKey]string, len(latest))
+	for _, tc := range latest {
+		existing, err := c.Main.Bridge.DB.Reaction.GetByIDWithoutMessagePart(ctx, c.UserLogin.ID, tc.Target, tc.Sender.Sender, "")
+		if err == nil && existing != nil {
+			current[tc.key()] = existing.Emoji
+		}
+	}
+	for _, tc := range reconcileTapbacks(current, latest) {
+		evtType := bridgev2.RemoteEventReaction
+		if tc.Remove {
+			evtType = bridgev2.RemoteEventReactionRemove
+		}
+		c.UserLogin.QueueRemoteEvent(&simplevent.Reaction{
+			EventMeta: simplevent.EventMeta{
+				Type:      evtType,
+				PortalKey: portalKey,
+				Sender:    tc.Sender,
+				Timestamp: tc.Timestamp,
+			},
+			TargetMessage: tc.Target,
+			Emoji:         tc.Emoji,
+		})
+	}
+}
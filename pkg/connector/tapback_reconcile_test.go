@@ -0,0 +1,116 @@
+package connector
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+)
+
+func TestReconcileTapbacks(t *testing.T) {
+	alice := bridgev2.EventSender{Sender: "tel:+15551111111"}
+	bob := bridgev2.EventSender{Sender: "mailto:bob@example.com"}
+	att0 := networkid.PartID("att0")
+	change := func(sender bridgev2.EventSender, target networkid.MessageID, emoji string, remove bool, sec int) tapbackChange {
+		return tapbackChange{Target: target, Sender: sender, Emoji: emoji, Remove: remove, Timestamp: time.Unix(int64(sec), 0)}
+	}
+	key := func(sender bridgev2.EventSender, target networkid.MessageID) tapbackKey {
+		return tapbackKey{target: target, sender: sender.Sender}
+	}
+	format := func(changes []tapbackChange) []string {
+		var out []string
+		for _, tc := range changes {
+			op := "+"
+			if tc.Remove {
+				op = "-"
+			}
+			part := ""
+			if tc.Part != nil {
+				part = "/" + string(*tc.Part)
+			}
+			out = append(out, fmt.Sprintf("%s%s %s%s %s", op, tc.Emoji, tc.Target, part, tc.Sender.Sender))
+		}
+		return out
+	}
+
+	tests := []struct {
+		name    string
+		current map[tapbackKey]string
+		changes []tapbackChange
+		want    []string
+	}{
+		{
+			name:    "new reaction",
+			changes: []tapbackChange{change(alice, "m1", "❤️", false, 1)},
+			want:    []string{"+❤️ m1 tel:+15551111111"},
+		},
+		{
+			name:    "already bridged",
+			current: map[tapbackKey]string{key(alice, "m1"): "❤️"},
+			changes: []tapbackChange{change(alice, "m1", "❤️", false, 1)},
+		},
+		{
+			name:    "changed tapback replaces the bridged one",
+			current: map[tapbackKey]string{key(alice, "m1"): "❤️"},
+			changes: []tapbackChange{
+				change(alice, "m1", "❤️", false, 1),
+				change(alice, "m1", "👍", false, 2),
+			},
+			want: []string{"+👍 m1 tel:+15551111111"},
+		},
+		{
+			name:    "toggled back to the bridged one",
+			current: map[tapbackKey]string{key(alice, "m1"): "❤️"},
+			changes: []tapbackChange{
+				change(alice, "m1", "👍", false, 1),
+				change(alice, "m1", "😂", false, 2),
+				change(alice, "m1", "❤️", false, 3),
+			},
+		},
+		{
+			name: "added and removed before bridging",
+			changes: []tapbackChange{
+				change(alice, "m1", "❤️", false, 1),
+				change(alice, "m1", "❤️", true, 2),
+			},
+		},
+		{
+			name:    "removal of the bridged one",
+			current: map[tapbackKey]string{key(alice, "m1"): "❤️"},
+			changes: []tapbackChange{change(alice, "m1", "❤️", true, 1)},
+			want:    []string{"-❤️ m1 tel:+15551111111"},
+		},
+		{
+			name:    "stale removal of a replaced one",
+			current: map[tapbackKey]string{key(alice, "m1"): "👍"},
+			changes: []tapbackChange{change(alice, "m1", "❤️", true, 1)},
+		},
+		{
+			name:    "others untouched",
+			current: map[tapbackKey]string{key(alice, "m1"): "❤️", key(bob, "m1"): "‼️"},
+			changes: []tapbackChange{
+				change(bob, "m1", "❓", false, 1),
+				change(alice, "m2", "👎", false, 2),
+				change(bob, "m2", "😂", false, 3),
+				change(bob, "m2", "😂", true, 4),
+			},
+			want: []string{"+❓ m1 mailto:bob@example.com", "+👎 m2 tel:+15551111111"},
+		},
+		{
+			name: "parts are separate",
+			changes: []tapbackChange{
+				change(alice, "m1", "❤️", false, 1),
+				{Target: "m1", Part: &att0, Sender: alice, Emoji: "👍", Timestamp: time.Unix(2, 0)},
+			},
+			want: []string{"+❤️ m1 tel:+15551111111", "+👍 m1/att0 tel:+15551111111"},
+		},
+	}
+	for _, tt := range tests {
+		got := format(reconcileTapbacks(tt.current, latestTapbacks(tt.changes)))
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("reconcileTapbacks(%s) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
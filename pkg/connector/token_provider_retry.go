@@ -0,0 +1,168 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2024 Ludvig Rhodin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+package connector
+
+import (
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/lrhodin/imessage/pkg/rustpushgo"
+)
+
+// TokenProvider restore retry.
+//
+// Connect restores the iCloud TokenProvider from the credentials persisted in
+// UserLoginMetadata. If that fails (iCloud auth hiccup, network down at
+// startup) the rust Client is built without one and every iCloud-backed
+// feature — CardDAV contacts first of all — stays off until a restart, with
+// contacts silently degrading to raw numbers. retryTokenProviderRestore keeps
+// retrying the restore with a capped backoff and, once it succeeds, brings
+// cloud contacts online from the restored provider directly.
+
+const (
+	tokenProviderRetryMinDelay = 1 * time.Minute
+	tokenProviderRetryMaxDelay = 30 * time.Minute
+)
+
+// tokenProviderRetryDelay is the wait before retry attempt n (0-based):
+// 1m, 2m, 4m, … capped at 30m so a long iCloud outage doesn't turn into a
+// login storm against Apple.
+func tokenProviderRetryDelay(attempt int) time.Duration {
+	delay := tokenProviderRetryMinDelay
+	for i := 0; i < attempt && delay < tokenProviderRetryMaxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, tokenProviderRetryMaxDelay)
+}
+
+// runWithRetryBackoff calls try after each tokenProviderRetryDelay until it
+// returns true or stop is closed. Returns the number of attempts made. after
+// is time.After outside of tests.
+func runWithRetryBackoff(stop <-chan struct{}, after func(time.Duration) <-chan time.Time, try func(attempt int) bool) int {
+	for attempt := 0; ; attempt++ {
+		select {
+		case <-stop:
+			return attempt
+		case <-after(tokenProviderRetryDelay(attempt)):
+		}
+		if try(attempt) {
+			return attempt + 1
+		}
+	}
+}
+
+// tokenProviderAuth adapts a WrappedTokenProvider to icloudAuthProvider. The
+// rust Client's accessors return pointers (None without a TokenProvider); a
+// bare TokenProvider always has values.
+type tokenProviderAuth struct {
+	tp *rustpushgo.WrappedTokenProvider
+}
+
+func (a tokenProviderAuth) GetContactsUrl() (*string, error) {
+	return a.tp.GetContactsUrl()
+}
+
+func (a tokenProviderAuth) GetDsid() (*string, error) {
+	dsid, err := a.tp.GetDsid()
+	if err != nil {
+		return nil, err
+	}
+	return &dsid, nil
+}
+
+func (a tokenProviderAuth) GetIcloudAuthHeaders() (*map[string]string, error) {
+	headers, err := a.tp.GetIcloudAuthHeaders()
+	if err != nil {
+		return nil, err
+	}
+	return &headers, nil
+}
+
+// hasPersistedTokenProviderCredentials reports whether login metadata has
+// what restoreTokenProvider needs.
+func (c *IMClient) hasPersistedTokenProviderCredentials() bool {
+	meta, ok := c.UserLogin.Metadata.(*UserLoginMetadata)
+	return ok && meta.AccountUsername != "" && meta.AccountPET != "" && meta.AccountSPDBase64 != ""
+}
+
+// restoreTokenProvider restores the TokenProvider from persisted credentials
+// into c.tokenProvider and seeds the persisted MobileMe delegate.
+func (c *IMClient) restoreTokenProvider(log zerolog.Logger) error {
+	meta := c.UserLogin.Metadata.(*UserLoginMetadata)
+	tp, err := safeRestoreTokenProvider(c.config, c.connection,
+		meta.AccountUsername, meta.AccountHashedPasswordHex,
+		meta.AccountPET, meta.AccountSPDBase64)
+	if err != nil {
+		return err
+	}
+	c.tokenProvider = &tp
+	// Seed the persisted MobileMe delegate so CloudKit / keychain
+	// ops have something to work with on first use. The wrapper's
+	// RestoreTokenProvider path intentionally returns a
+	// WrappedTokenProvider with empty mme_delegate_bytes (see
+	// pkg/rustpushgo/src/lib.rs::restore_token_provider — "callers
+	// must seed_mme_delegate_json() from persisted state before
+	// using keychain/contacts features"), so we seed it here. The
+	// delegate is whatever was captured during the most recent
+	// successful login; if it's expired, CloudKit calls will
+	// surface an auth error and the user can re-login.
+	if meta.MmeDelegateJSON != "" {
+		if seedErr := tp.SeedMmeDelegateJson(meta.MmeDelegateJSON); seedErr != nil {
+			log.Warn().Err(seedErr).Msg("Failed to seed persisted MobileMe delegate — CloudKit unavailable until re-login")
+		} else {
+			log.Info().Msg("Seeded persisted MobileMe delegate into restored TokenProvider")
+		}
+	} else {
+		log.Warn().Msg("TokenProvider restored but no persisted MobileMe delegate — CloudKit unavailable until re-login captures a fresh one")
+	}
+	return nil
+}
+
+// retryTokenProviderRestore retries restoreTokenProvider after a failed
+// restore at Connect. On success it sets up iCloud CardDAV contacts from the
+// restored provider (the rust Client still doesn't have it, so
+// newCloudContactsClient would keep failing), syncs them, and refreshes all
+// ghosts so names and avatars replace the raw numbers shown meanwhile.
+// CloudKit backfill and other Client-side iCloud features still need a
+// reconnect to pick the provider up.
+func (c *IMClient) retryTokenProviderRestore(log zerolog.Logger) {
+	log = log.With().Str("component", "token_provider_retry").Logger()
+	var tp *rustpushgo.WrappedTokenProvider
+	attempts := runWithRetryBackoff(c.stopChan, time.After, func(attempt int) bool {
+		log.Info().Int("attempt", attempt+1).Msg("Retrying TokenProvider restore")
+		if err := c.restoreTokenProvider(log); err != nil {
+			log.Warn().Err(err).
+				Dur("next_retry", tokenProviderRetryDelay(attempt+1)).
+				Msg("TokenProvider restore retry failed")
+			return false
+		}
+		tp = *c.tokenProvider
+		return true
+	})
+	if tp == nil {
+		return
+	}
+	log.Info().Int("attempts", attempts).Msg("TokenProvider restored, bringing cloud contacts online")
+
+	cloudContacts := newCloudContactsClientWithAuth(regionalICloudAuth{tokenProviderAuth{tp}, c.accountRegion}, log)
+	if cloudContacts == nil {
+		log.Warn().Msg("Cloud contacts still unavailable after TokenProvider restore")
+		return
+	}
+	c.contacts = cloudContacts
+	if syncErr := cloudContacts.SyncContacts(log); syncErr != nil {
+		log.Warn().Err(syncErr).Msg("Contact sync after TokenProvider restore failed; periodic sync will retry")
+	} else {
+		c.setContactsReady(log)
+		c.persistMmeDelegate(log)
+		go c.refreshAllGhosts(log)
+	}
+	go c.periodicCloudContactSync(log)
+}
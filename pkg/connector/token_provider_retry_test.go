@@ -0,0 +1,110 @@
+package connector
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+func TestTokenProviderRetryDelay(t *testing.T) {
+	tests := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{0, 1 * time.Minute},
+		{1, 2 * time.Minute},
+		{2, 4 * time.Minute},
+		{4, 16 * time.Minute},
+		{5, 30 * time.Minute},
+		{50, 30 * time.Minute},
+	}
+	for _, tt := range tests {
+		if got := tokenProviderRetryDelay(tt.attempt); got != tt.want {
+			t.Errorf("tokenProviderRetryDelay(%d) = %v, want %v", tt.attempt, got, tt.want)
+		}
+	}
+}
+
+// instantAfter records requested delays and fires immediately.
+func instantAfter(delays *[]time.Duration) func(time.Duration) <-chan time.Time {
+	return func(d time.Duration) <-chan time.Time {
+		*delays = append(*delays, d)
+		ch := make(chan time.Time, 1)
+		ch <- time.Time{}
+		return ch
+	}
+}
+
+func TestRunWithRetryBackoff(t *testing.T) {
+	var delays []time.Duration
+	attempts := runWithRetryBackoff(make(chan struct{}), instantAfter(&delays), func(attempt int) bool {
+		return attempt == 3
+	})
+	if attempts != 4 {
+		t.Errorf("attempts = %d, want 4", attempts)
+	}
+	want := []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 8 * time.Minute}
+	if len(delays) != len(want) {
+		t.Fatalf("delays = %v, want %v", delays, want)
+	}
+	for i := range want {
+		if delays[i] != want[i] {
+			t.Errorf("delays[%d] = %v, want %v", i, delays[i], want[i])
+		}
+	}
+}
+
+func TestRunWithRetryBackoffStop(t *testing.T) {
+	stop := make(chan struct{})
+	close(stop)
+	called := false
+	never := func(time.Duration) <-chan time.Time { return nil }
+	if attempts := runWithRetryBackoff(stop, never, func(int) bool { called = true; return true }); attempts != 0 || called {
+		t.Errorf("runWithRetryBackoff() after stop = %d attempts (called=%v), want 0", attempts, called)
+	}
+}
+
+type fakeICloudAuth struct {
+	url  *string
+	dsid string
+	err  error
+}
+
+func (f fakeICloudAuth) GetContactsUrl() (*string, error) { return f.url, f.err }
+func (f fakeICloudAuth) GetDsid() (*string, error)        { return &f.dsid, nil }
+func (f fakeICloudAuth) GetIcloudAuthHeaders() (*map[string]string, error) {
+	return &map[string]string{}, nil
+}
+
+func TestNewCloudContactsClientWithAuth(t *testing.T) {
+	url := "https://p42-contacts.icloud.com/"
+	empty := ""
+	tests := []struct {
+		name    string
+		auth    fakeICloudAuth
+		wantURL string
+	}{
+		{"restored provider activates contacts", fakeICloudAuth{url: &url, dsid: "123"}, "https://p42-contacts.icloud.com"},
+		{"no contacts URL yet", fakeICloudAuth{url: &empty}, ""},
+		{"nil contacts URL", fakeICloudAuth{}, ""},
+		{"auth error", fakeICloudAuth{err: errors.New("401")}, ""},
+	}
+	for _, tt := range tests {
+		got := newCloudContactsClientWithAuth(tt.auth, zerolog.Nop())
+		if tt.wantURL == "" {
+			if got != nil {
+				t.Errorf("%s: newCloudContactsClientWithAuth() = %+v, want nil", tt.name, got)
+			}
+			continue
+		}
+		if got == nil {
+			t.Errorf("%s: newCloudContactsClientWithAuth() = nil, want client", tt.name)
+			continue
+		}
+		if got.baseURL != tt.wantURL || got.dsid != tt.auth.dsid {
+			t.Errorf("%s: baseURL, dsid = %q, %q, want %q, %q", tt.name, got.baseURL, got.dsid, tt.wantURL, tt.auth.dsid)
+		}
+	}
+}
@@ -0,0 +1,271 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2024 Ludvig Rhodin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+package connector
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"maunium.net/go/mautrix/bridgev2"
+)
+
+// Per-send transport selection for DMs.
+//
+// smsPortals is sticky: it flips when the contact's last inbound message came
+// in over the other transport. iOS instead decides per send — a blue contact
+// whose devices went offline (or who left iMessage) drops to green, and goes
+// back to blue once reachable again. portalToConversation does the same for
+// DMs, using a cached ValidateTargets result. Only message sends
+// (sendConversation) look up targets missing from the cache; typing,
+// receipts, tapbacks and the like use what's cached and never wait on IDS.
+//
+// ValidateTargets swallows lookup errors and returns the reachable targets,
+// so an empty result means either "not on iMessage" or "lookup failed". A DM
+// target is therefore only cached as reachable from a lookup; it's cached as
+// unreachable when a send fails with NoValidTargets (sendWithSMSFallback).
+// A group's members are looked up together, and a non-empty result shows the
+// lookup went through, so the members missing from it are unreachable. An
+// empty result is remembered as inconclusive: the target stays unknown, but
+// isn't looked up again for reachabilityRetryInterval. A contact who isn't
+// on iMessage never produces a NoValidTargets error once the DM sends as
+// SMS, so without that every send to them would block on a fresh lookup.
+// A send therefore costs at most one identity lookup per target per
+// reachabilityCacheTTL, or per reachabilityRetryInterval while lookups come
+// back empty.
+//
+// Groups can flip too: adding a member without iMessage turns an iMessage
+// group into an SMS/MMS group, and a group whose members are all reachable
+// again goes back to iMessage. Inbound messages already re-stamp the flag
+// from their service (handleMessage); before each send portalToConversation
+// re-checks the members' reachability and persists any flip to
+// PortalMetadata.IsSms, so later sends and restarts keep the new transport.
+
+// reachabilityCacheTTL is how long an iMessage reachability lookup is trusted.
+const reachabilityCacheTTL = 10 * time.Minute
+
+// reachabilityRetryInterval is how long after an inconclusive lookup the
+// target isn't looked up again.
+const reachabilityRetryInterval = 2 * time.Minute
+
+type reachabilityEntry struct {
+	reachable    bool
+	inconclusive bool
+	checkedAt    time.Time
+}
+
+// reachabilityCache caches iMessage reachability per DM send target. The zero
+// value is ready to use.
+type reachabilityCache struct {
+	mu      sync.Mutex
+	entries map[string]reachabilityEntry
+}
+
+// get returns the cached reachability of target and whether it is known and
+// still fresh at now.
+func (rc *reachabilityCache) get(target string, now time.Time) (reachable, known bool) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	entry, ok := rc.entries[target]
+	if !ok || entry.inconclusive || now.Sub(entry.checkedAt) >= reachabilityCacheTTL {
+		return false, false
+	}
+	return entry.reachable, true
+}
+
+// needsLookup reports whether target should be looked up at now: it has no
+// fresh entry, and no inconclusive lookup within reachabilityRetryInterval.
+func (rc *reachabilityCache) needsLookup(target string, now time.Time) bool {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	entry, ok := rc.entries[target]
+	switch {
+	case !ok:
+		return true
+	case entry.inconclusive:
+		return now.Sub(entry.checkedAt) >= reachabilityRetryInterval
+	default:
+		return now.Sub(entry.checkedAt) >= reachabilityCacheTTL
+	}
+}
+
+// setInconclusive records a lookup of target that came back empty.
+func (rc *reachabilityCache) setInconclusive(target string, now time.Time) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.entries == nil {
+		rc.entries = make(map[string]reachabilityEntry)
+	}
+	rc.entries[target] = reachabilityEntry{inconclusive: true, checkedAt: now}
+}
+
+func (rc *reachabilityCache) set(target string, reachable bool, now time.Time) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.entries == nil {
+		rc.entries = make(map[string]reachabilityEntry)
+	}
+	rc.entries[target] = reachabilityEntry{reachable: reachable, checkedAt: now}
+}
+
+// decideDMTransport picks SMS (true) or iMessage (false) for one DM send.
+// Known reachability wins over the sticky portal flag: reachable contacts
+// get iMessage, unreachable ones get SMS — but only with an SMS relay, since
+// without one an SMS send can't succeed and the iMessage send's
+// NoValidTargets error is what drives the send-as-sms prompt. Unknown
+// reachability (lookup failed) keeps the sticky flag.
+func decideDMTransport(stickySMS, reachable, known, relayAvailable bool) bool {
+	if !known {
+		return stickySMS
+	}
+	if reachable {
+		return false
+	}
+	return relayAvailable
+}
+
+// decideGroupTransport picks SMS (true) or iMessage (false) for one group
+// send from its members' reachability. Any member without iMessage makes it
+// an SMS group, given a relay to send it through; without one the iMessage
+// send still reaches everyone else. All members reachable makes it an
+// iMessage group. Any unknown member, or no members to check at all, keeps
+// the sticky flag.
+func decideGroupTransport(stickySMS bool, reachable, unreachable, unknown int, relayAvailable bool) bool {
+	if unreachable > 0 {
+		return relayAvailable
+	}
+	if unknown > 0 || reachable == 0 {
+		return stickySMS
+	}
+	return false
+}
+
+// cachedReachability returns target's iMessage reachability, looking it up
+// as handle when the cache has no fresh entry and no recent inconclusive
+// lookup. Only a lookup that found the target is cached as reachable;
+// anything else is recorded as inconclusive and stays unknown.
+func (c *IMClient) cachedReachability(target, handle string) (reachable, known bool) {
+	now := time.Now()
+	if reachable, known = c.reachability.get(target, now); known || !c.reachability.needsLookup(target, now) {
+		return reachable, known
+	}
+	if found, ok := c.lookupReachability([]string{target}, handle); ok && found[target] {
+		c.reachability.set(target, true, now)
+		return true, true
+	}
+	c.reachability.setInconclusive(target, now)
+	return false, false
+}
+
+// dmTransportIsSMS decides the transport for a DM send to target. With
+// lookup, a target missing from the cache is looked up as handle first.
+func (c *IMClient) dmTransportIsSMS(target, handle string, stickySMS, lookup bool) bool {
+	var reachable, known bool
+	if lookup {
+		reachable, known = c.cachedReachability(target, handle)
+	} else {
+		reachable, known = c.reachability.get(target, time.Now())
+	}
+	isSms := decideDMTransport(stickySMS, reachable, known, c.smsRelayAvailable())
+	if isSms != stickySMS {
+		c.UserLogin.Log.Debug().
+			Str("send_target", target).
+			Bool("imessage_reachable", reachable).
+			Bool("sms", isSms).
+			Msg("Overriding sticky DM transport from iMessage reachability")
+	}
+	return isSms
+}
+
+// groupTransportIsSMS decides the transport for a group send to members.
+// The user's own handles are ignored. With lookup, members missing from the
+// cache are looked up together as handle first.
+func (c *IMClient) groupTransportIsSMS(members []string, handle string, stickySMS, lookup bool) bool {
+	now := time.Now()
+	var others, missing []string
+	for _, member := range members {
+		if c.isMyHandle(member) {
+			continue
+		}
+		others = append(others, member)
+		if c.reachability.needsLookup(member, now) {
+			missing = append(missing, member)
+		}
+	}
+	if lookup && len(missing) > 0 {
+		found, ok := c.lookupReachability(missing, handle)
+		for _, member := range missing {
+			if ok {
+				c.reachability.set(member, found[member], now)
+			} else {
+				c.reachability.setInconclusive(member, now)
+			}
+		}
+	}
+	var reachable, unreachable, unknown int
+	for _, member := range others {
+		switch isReachable, known := c.reachability.get(member, now); {
+		case !known:
+			unknown++
+		case isReachable:
+			reachable++
+		default:
+			unreachable++
+		}
+	}
+	return decideGroupTransport(stickySMS, reachable, unreachable, unknown, c.smsRelayAvailable())
+}
+
+// setPortalSMS records a service flip in smsPortals and persists it to
+// PortalMetadata.IsSms.
+func (c *IMClient) setPortalSMS(ctx context.Context, portal *bridgev2.Portal, isSms bool) {
+	c.updatePortalSMS(string(portal.ID), isSms)
+	meta, ok := portal.Metadata.(*PortalMetadata)
+	if !ok {
+		meta = &PortalMetadata{}
+	}
+	if meta.IsSms == isSms {
+		return
+	}
+	meta.IsSms = isSms
+	portal.Metadata = meta
+	log := c.UserLogin.Log.With().Str("portal_id", string(portal.ID)).Bool("is_sms", isSms).Logger()
+	if err := portal.Save(ctx); err != nil {
+		log.Warn().Err(err).Msg("Failed to persist portal service change")
+		return
+	}
+	log.Info().Msg("Portal service changed")
+}
+
+// lookupReachability asks IDS, as handle, which of targets have iMessage
+// devices. ok is false when nothing came back, which may just as well be a
+// failed lookup; otherwise targets missing from found are unreachable.
+func (c *IMClient) lookupReachability(targets []string, handle string) (found map[string]bool, ok bool) {
+	if c.client == nil {
+		return nil, false
+	}
+	// ValidateTargets crosses into the identity-manager FFI path, which has
+	// reachable panic sites upstream; treat a panic as an unknown result.
+	defer func() {
+		if r := recover(); r != nil {
+			c.UserLogin.Log.Error().Interface("panic", r).Strs("send_targets", targets).
+				Msg("Reachability lookup panicked in FFI path")
+			found, ok = nil, false
+		}
+	}()
+	valid := c.client.ValidateTargets(targets, handle)
+	if len(valid) == 0 {
+		return nil, false
+	}
+	found = make(map[string]bool, len(valid))
+	for _, target := range valid {
+		found[target] = true
+	}
+	return found, true
+}
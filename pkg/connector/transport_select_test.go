@@ -0,0 +1,202 @@
+package connector
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+)
+
+func TestDecideDMTransport(t *testing.T) {
+	tests := []struct {
+		name           string
+		stickySMS      bool
+		reachable      bool
+		known          bool
+		relayAvailable bool
+		want           bool
+	}{
+		{"reachable overrides sticky sms", true, true, true, true, false},
+		{"reachable imessage portal", false, true, true, true, false},
+		{"unreachable drops to sms", false, false, true, true, true},
+		{"unreachable without relay stays imessage", false, false, true, false, false},
+		{"unreachable sms portal without relay", true, false, true, false, false},
+		{"unknown keeps sticky sms", true, false, false, true, true},
+		{"unknown keeps sticky imessage", false, false, false, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := decideDMTransport(tt.stickySMS, tt.reachable, tt.known, tt.relayAvailable); got != tt.want {
+				t.Errorf("decideDMTransport(%v, %v, %v, %v) = %v, want %v",
+					tt.stickySMS, tt.reachable, tt.known, tt.relayAvailable, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReachabilityCache(t *testing.T) {
+	var rc reachabilityCache
+	now := time.Unix(1700000000, 0)
+
+	if _, known := rc.get("tel:+15551234567", now); known {
+		t.Errorf("get() on empty cache: known = true, want false")
+	}
+	rc.set("tel:+15551234567", true, now)
+	if reachable, known := rc.get("tel:+15551234567", now.Add(reachabilityCacheTTL-time.Second)); !known || !reachable {
+		t.Errorf("get() before TTL = (%v, %v), want (true, true)", reachable, known)
+	}
+	if _, known := rc.get("tel:+15551234567", now.Add(reachabilityCacheTTL)); known {
+		t.Errorf("get() at TTL: known = true, want false")
+	}
+	rc.set("tel:+15551234567", false, now.Add(time.Minute))
+	if reachable, known := rc.get("tel:+15551234567", now.Add(2*time.Minute)); !known || reachable {
+		t.Errorf("get() after update = (%v, %v), want (false, true)", reachable, known)
+	}
+	if _, known := rc.get("mailto:other@example.com", now); known {
+		t.Errorf("get() for other target: known = true, want false")
+	}
+}
+
+func TestDecideGroupTransport(t *testing.T) {
+	tests := []struct {
+		name           string
+		stickySMS      bool
+		reachable      int
+		unreachable    int
+		unknown        int
+		relayAvailable bool
+		want           bool
+	}{
+		{"all reachable stays imessage", false, 3, 0, 0, true, false},
+		{"all reachable flips sms group back", true, 3, 0, 0, true, false},
+		{"member without imessage flips to sms", false, 2, 1, 0, true, true},
+		{"member without imessage and no relay", false, 2, 1, 0, false, false},
+		{"unreachable wins over unknown", false, 1, 1, 1, true, true},
+		{"unknown keeps sticky sms", true, 2, 0, 1, true, true},
+		{"unknown keeps sticky imessage", false, 2, 0, 1, true, false},
+		{"no members keeps sticky sms", true, 0, 0, 0, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := decideGroupTransport(tt.stickySMS, tt.reachable, tt.unreachable, tt.unknown, tt.relayAvailable); got != tt.want {
+				t.Errorf("decideGroupTransport(%v, %d, %d, %d, %v) = %v, want %v",
+					tt.stickySMS, tt.reachable, tt.unreachable, tt.unknown, tt.relayAvailable, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPortalToConversationGroupServiceFlip(t *testing.T) {
+	ctx := context.Background()
+	db := newTestBridgeDB(t)
+	const portalID = "tel:+15550000001,tel:+15550000002,tel:+15559999999"
+	portal := &bridgev2.Portal{
+		Portal: &database.Portal{
+			PortalKey: networkid.PortalKey{ID: portalID, Receiver: "login"},
+			Metadata:  &PortalMetadata{},
+		},
+		Bridge: &bridgev2.Bridge{DB: db},
+	}
+	if err := db.Portal.Insert(ctx, portal.Portal); err != nil {
+		t.Fatalf("Portal.Insert() error = %v", err)
+	}
+	c := &IMClient{
+		Main:       &IMConnector{Bridge: portal.Bridge},
+		UserLogin:  &bridgev2.UserLogin{UserLogin: &database.UserLogin{ID: "login"}, Log: zerolog.Nop()},
+		handle:     "tel:+15559999999",
+		allHandles: []string{"tel:+15559999999"},
+		smsPortals: map[string]bool{},
+	}
+	c.smsRelayEnabled.Store(true)
+	now := time.Now()
+	c.reachability.set("tel:+15550000001", true, now)
+	c.reachability.set("tel:+15550000002", false, now)
+
+	if conv := c.portalToConversation(portal); !conv.IsSms {
+		t.Fatalf("portalToConversation() IsSms = false with a member off iMessage, want true")
+	}
+	if !c.isPortalSMS(portalID) {
+		t.Errorf("isPortalSMS() = false after flip to SMS, want true")
+	}
+	var savedMeta string
+	if err := db.QueryRow(ctx, "SELECT metadata FROM portal WHERE id=$1", portalID).Scan(&savedMeta); err != nil {
+		t.Fatalf("reading portal metadata: %v", err)
+	}
+	if !strings.Contains(savedMeta, `"is_sms":true`) {
+		t.Errorf("persisted metadata = %s, want is_sms set", savedMeta)
+	}
+
+	// The member comes back to iMessage: the next send goes out as iMessage.
+	c.reachability.set("tel:+15550000002", true, now)
+	conv := c.portalToConversation(portal)
+	if conv.IsSms {
+		t.Errorf("portalToConversation() IsSms = true with every member on iMessage, want false")
+	}
+	if len(conv.Participants) != 3 {
+		t.Errorf("portalToConversation() participants = %v, want all 3 members", conv.Participants)
+	}
+	if portal.Metadata.(*PortalMetadata).IsSms || c.isPortalSMS(portalID) {
+		t.Errorf("IsSms still set after flip back to iMessage")
+	}
+}
+
+func TestCachedReachabilityFailedLookup(t *testing.T) {
+	c := &IMClient{UserLogin: &bridgev2.UserLogin{UserLogin: &database.UserLogin{ID: "login"}, Log: zerolog.Nop()}}
+	// No client: the lookup can't be made, which must not read as "not on
+	// iMessage" or be cached.
+	if reachable, known := c.cachedReachability("tel:+15550000001", "tel:+15559999999"); reachable || known {
+		t.Errorf("cachedReachability() = (%v, %v), want (false, false)", reachable, known)
+	}
+	if _, known := c.reachability.get("tel:+15550000001", time.Now()); known {
+		t.Errorf("failed lookup was cached")
+	}
+	if isSms := c.dmTransportIsSMS("tel:+15550000001", "tel:+15559999999", true, true); !isSms {
+		t.Errorf("dmTransportIsSMS() after failed lookup = false, want sticky SMS kept")
+	}
+}
+
+func TestReachabilityCacheInconclusive(t *testing.T) {
+	var rc reachabilityCache
+	now := time.Unix(1700000000, 0)
+	const target = "tel:+15550000001"
+	if !rc.needsLookup(target, now) {
+		t.Errorf("needsLookup() for an unknown target = false, want true")
+	}
+	// A lookup that came back empty: still unknown, but not retried on
+	// every send.
+	rc.setInconclusive(target, now)
+	if _, known := rc.get(target, now); known {
+		t.Errorf("get() after an inconclusive lookup known = true, want false")
+	}
+	if rc.needsLookup(target, now.Add(reachabilityRetryInterval-time.Second)) {
+		t.Errorf("needsLookup() within the retry interval = true, want false")
+	}
+	if !rc.needsLookup(target, now.Add(reachabilityRetryInterval)) {
+		t.Errorf("needsLookup() after the retry interval = false, want true")
+	}
+	rc.set(target, false, now.Add(time.Minute))
+	if reachable, known := rc.get(target, now.Add(time.Minute)); !known || reachable {
+		t.Errorf("get() after a NoValidTargets failure = (%v, %v), want (false, true)", reachable, known)
+	}
+	if rc.needsLookup(target, now.Add(time.Minute+reachabilityRetryInterval)) {
+		t.Errorf("needsLookup() for a fresh entry = true, want false")
+	}
+}
+
+func TestCachedReachabilityBacksOff(t *testing.T) {
+	c := &IMClient{UserLogin: &bridgev2.UserLogin{UserLogin: &database.UserLogin{ID: "login"}, Log: zerolog.Nop()}}
+	const target = "tel:+15550000001"
+	c.cachedReachability(target, "tel:+15559999999")
+	if c.reachability.needsLookup(target, time.Now()) {
+		t.Errorf("needsLookup() right after an inconclusive lookup = true, want false")
+	}
+	// Group sends back off on the same record.
+	if isSms := c.groupTransportIsSMS([]string{target}, "tel:+15559999999", true, true); !isSms {
+		t.Errorf("groupTransportIsSMS() with an unknown member = false, want sticky SMS kept")
+	}
+}
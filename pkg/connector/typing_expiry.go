@@ -0,0 +1,96 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2024 Ludvig Rhodin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+package connector
+
+// Per-member typing expiry.
+//
+// A member who closes the conversation or loses signal mid-sentence never
+// sends a typing stop. The Matrix typing timeout is only a hint the
+// homeserver may cap or ignore, and bridgev2 keeps the ghost in the portal's
+// typing set until it's told otherwise, so the indicator can stick around.
+// Each member's typing start therefore arms an expiry of its own, keyed by
+// portal and member: when it runs out without a newer start, an explicit
+// stop is bridged for that member only. In a group, members typing at the
+// same time expire independently; one member re-sending typing doesn't
+// extend anyone else's indicator.
+
+import (
+	"sync"
+	"time"
+
+	"maunium.net/go/mautrix/bridgev2/networkid"
+)
+
+// typingMember identifies one member's typing indicator in one portal.
+type typingMember struct {
+	portal networkid.PortalKey
+	sender networkid.UserID
+}
+
+// typingExpiry tracks the armed expiry of each typing member. The zero
+// value is ready to use.
+type typingExpiry struct {
+	mu sync.Mutex
+	// generation of the latest start per member; an expiry only clears the
+	// indicator if no start came after the one that armed it.
+	current map[typingMember]uint64
+	next    uint64
+	// afterFunc runs f once timeout has passed; time.AfterFunc when nil.
+	afterFunc func(timeout time.Duration, f func())
+}
+
+// start arms member's expiry, replacing the one armed before. expire runs
+// once timeout passes without another start or a stop for member.
+func (te *typingExpiry) start(member typingMember, timeout time.Duration, expire func()) {
+	te.mu.Lock()
+	if te.current == nil {
+		te.current = make(map[typingMember]uint64)
+	}
+	te.next++
+	gen := te.next
+	te.current[member] = gen
+	te.mu.Unlock()
+	run := func() {
+		if te.expired(member, gen) {
+			expire()
+		}
+	}
+	if te.afterFunc != nil {
+		te.afterFunc(timeout, run)
+	} else {
+		time.AfterFunc(timeout, run)
+	}
+}
+
+// stop disarms member's expiry, e.g. because an explicit typing stop came.
+func (te *typingExpiry) stop(member typingMember) {
+	te.mu.Lock()
+	delete(te.current, member)
+	te.mu.Unlock()
+}
+
+// expired reports whether the start with generation gen is still member's
+// latest, and if so stops tracking member.
+func (te *typingExpiry) expired(member typingMember, gen uint64) bool {
+	te.mu.Lock()
+	defer te.mu.Unlock()
+	if cur, ok := te.current[member]; !ok || cur != gen {
+		return false
+	}
+	delete(te.current, member)
+	return true
+}
+
+// typing reports whether member has an armed expiry.
+func (te *typingExpiry) typing(member typingMember) bool {
+	te.mu.Lock()
+	defer te.mu.Unlock()
+	_, ok := te.current[member]
+	return ok
+}
@@ -0,0 +1,65 @@
+package connector
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"maunium.net/go/mautrix/bridgev2/networkid"
+)
+
+func TestTypingExpiryPerMember(t *testing.T) {
+	group := networkid.PortalKey{ID: "gid:abc", Receiver: "login"}
+	alice := typingMember{portal: group, sender: "tel:+15551111111"}
+	bob := typingMember{portal: group, sender: "tel:+15552222222"}
+	timers := &manualTimers{}
+	te := &typingExpiry{afterFunc: timers.afterFunc}
+	var expired []networkid.UserID
+	start := func(m typingMember) {
+		te.start(m, 60*time.Second, func() { expired = append(expired, m.sender) })
+	}
+
+	start(alice) // timer 0
+	start(bob)   // timer 1
+	start(alice) // timer 2: alice is still typing
+	if want := []time.Duration{60 * time.Second, 60 * time.Second, 60 * time.Second}; !reflect.DeepEqual(timers.windows, want) {
+		t.Errorf("typingExpiry timeouts = %v, want %v", timers.windows, want)
+	}
+
+	// Alice's first timeout passes: her refresh keeps her typing, and it
+	// doesn't clear Bob either.
+	timers.pending[0]()
+	if len(expired) != 0 || !te.typing(alice) || !te.typing(bob) {
+		t.Errorf("after alice's first timeout: expired %v, alice typing %v, bob typing %v, want none, true, true", expired, te.typing(alice), te.typing(bob))
+	}
+	// Bob's timeout passes: only Bob is cleared; Alice's refresh didn't
+	// extend his.
+	timers.pending[1]()
+	if !reflect.DeepEqual(expired, []networkid.UserID{bob.sender}) || !te.typing(alice) || te.typing(bob) {
+		t.Errorf("after bob's timeout: expired %v, alice typing %v, bob typing %v, want [bob], true, false", expired, te.typing(alice), te.typing(bob))
+	}
+	timers.pending[2]()
+	if !reflect.DeepEqual(expired, []networkid.UserID{bob.sender, alice.sender}) || te.typing(alice) {
+		t.Errorf("after alice's second timeout: expired %v, alice typing %v, want [bob alice], false", expired, te.typing(alice))
+	}
+}
+
+func TestTypingExpiryStop(t *testing.T) {
+	group := networkid.PortalKey{ID: "gid:abc", Receiver: "login"}
+	other := networkid.PortalKey{ID: "tel:+15551111111", Receiver: "login"}
+	alice := typingMember{portal: group, sender: "tel:+15551111111"}
+	aliceDM := typingMember{portal: other, sender: "tel:+15551111111"}
+	timers := &manualTimers{}
+	te := &typingExpiry{afterFunc: timers.afterFunc}
+	var expired []typingMember
+	for _, m := range []typingMember{alice, aliceDM} {
+		te.start(m, 60*time.Second, func() { expired = append(expired, m) })
+	}
+
+	// An explicit stop disarms the expiry in that portal only.
+	te.stop(alice)
+	timers.fire()
+	if !reflect.DeepEqual(expired, []typingMember{aliceDM}) {
+		t.Errorf("expired after stop = %v, want only %v", expired, aliceDM)
+	}
+}
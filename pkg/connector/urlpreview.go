@@ -104,7 +104,7 @@ func fetchURLPreview(ctx context.Context, bridge *bridgev2.Bridge, intent bridge
 	if mc, ok := bridge.Matrix.(bridgev2.MatrixConnectorWithURLPreviews); ok {
 		lp, err := mc.GetURLPreview(ctx, fetchURL)
 		if err != nil {
-			log.Debug().Err(err).Str("url", fetchURL).Msg("Homeserver URL preview failed, falling back to meta scraping")
+			log.Debug().Err(err).Str("url", logText(fetchURL)).Msg("Homeserver URL preview failed, falling back to meta scraping")
 		}
 		if err == nil && lp != nil {
 			preview.LinkPreview = *lp
@@ -196,11 +196,11 @@ func fetchPageMetadata(ctx context.Context, targetURL string) map[string]string
 	for _, ua := range userAgents {
 		result := fetchPageMetadataWithUA(ctx, targetURL, ua)
 		if result["image"] != "" || result["title"] != "" {
-			log.Debug().Str("ua", ua).Str("url", targetURL).Str("title", result["title"]).
+			log.Debug().Str("ua", ua).Str("url", logText(targetURL)).Str("title", logText(result["title"])).
 				Bool("has_image", result["image"] != "").Msg("Found page metadata")
 			return result
 		}
-		log.Debug().Str("ua", ua).Str("url", targetURL).Msg("No metadata found with this UA, trying next")
+		log.Debug().Str("ua", ua).Str("url", logText(targetURL)).Msg("No metadata found with this UA, trying next")
 	}
 
 	return make(map[string]string)
@@ -243,13 +243,13 @@ func fetchPageMetadataWithUA(ctx context.Context, targetURL string, ua string) m
 
 	resp, err := ogHTTPClient.Do(req)
 	if err != nil {
-		log.Debug().Err(err).Str("url", targetURL).Str("ua", ua).Msg("HTTP request failed for meta scraping")
+		log.Debug().Err(err).Str("url", logText(targetURL)).Str("ua", ua).Msg("HTTP request failed for meta scraping")
 		return result
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode >= 400 {
-		log.Debug().Int("status", resp.StatusCode).Str("url", targetURL).Str("ua", ua).Msg("HTTP error for meta scraping")
+		log.Debug().Int("status", resp.StatusCode).Str("url", logText(targetURL)).Str("ua", ua).Msg("HTTP error for meta scraping")
 		return result
 	}
 
@@ -259,7 +259,7 @@ func fetchPageMetadataWithUA(ctx context.Context, targetURL string, ua string) m
 	if len(data) == 0 {
 		return result
 	}
-	log.Debug().Int("status", resp.StatusCode).Int("body_bytes", len(data)).Str("url", targetURL).Str("ua", ua).Msg("Fetched page for meta scraping")
+	log.Debug().Int("status", resp.StatusCode).Int("body_bytes", len(data)).Str("url", logText(targetURL)).Str("ua", ua).Msg("Fetched page for meta scraping")
 	htmlStr := string(data)
 
 	// Parse ALL <meta> tags generically into namespaced buckets.
@@ -0,0 +1,425 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2024 Ludvig Rhodin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// Package relaydiscovery finds nac-relay on the local network over mDNS.
+//
+// The relay URL is baked into the hardware key when it's extracted, so when
+// the Mac's LAN address changes the bridge loses the relay. With -mdns,
+// nac-relay advertises itself as a DNS-SD service (_imessage-relay._tcp)
+// with its TLS certificate fingerprint in a TXT record, and the bridge can
+// query for it and pick the relay whose fingerprint matches the one pinned
+// in the hardware key.
+package relaydiscovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// ServiceType is the DNS-SD service type nac-relay advertises.
+	ServiceType = "_imessage-relay._tcp"
+
+	serviceName = ServiceType + ".local."
+	mdnsPort    = 5353
+	recordTTL   = 120
+	// cacheFlush marks records only this responder owns (RFC 6762 10.2).
+	cacheFlush = 1 << 15
+	// unicastResponse is the QU bit of a question's class (RFC 6762 5.4).
+	unicastResponse = 1 << 15
+
+	// txtFingerprint prefixes the TXT entry with the relay's certificate
+	// fingerprint (SHA-256 of the DER certificate, hex).
+	txtFingerprint = "fp="
+)
+
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: mdnsPort}
+
+// Service is one advertised relay.
+type Service struct {
+	// Instance is the service instance label, usually the Mac's name.
+	Instance string
+	// Host is the target host name of the SRV record, e.g. "mac.local.".
+	Host   string
+	Port   int
+	IPs    []net.IP
+	CertFP string
+}
+
+// instanceLabel makes a name usable as a single DNS label.
+func instanceLabel(name string) string {
+	name = strings.ReplaceAll(strings.TrimSpace(name), ".", "-")
+	if name == "" {
+		name = "nac-relay"
+	}
+	if len(name) > 63 {
+		name = name[:63]
+	}
+	return name
+}
+
+// hostName returns a fully qualified .local host name.
+func hostName(host string) string {
+	host = strings.TrimSuffix(strings.TrimSpace(host), ".")
+	if host == "" {
+		host = "nac-relay"
+	}
+	if !strings.HasSuffix(host, ".local") {
+		host += ".local"
+	}
+	return host + "."
+}
+
+func (s Service) instanceName() string {
+	return instanceLabel(s.Instance) + "." + serviceName
+}
+
+// Records returns the DNS-SD records advertising s: the PTR record for the
+// service type, then its SRV, TXT and address records.
+func (s Service) Records() ([]dnsmessage.Resource, error) {
+	svc, err := dnsmessage.NewName(serviceName)
+	if err != nil {
+		return nil, err
+	}
+	inst, err := dnsmessage.NewName(s.instanceName())
+	if err != nil {
+		return nil, fmt.Errorf("instance name: %w", err)
+	}
+	host, err := dnsmessage.NewName(hostName(s.Host))
+	if err != nil {
+		return nil, fmt.Errorf("host name: %w", err)
+	}
+	if s.Port <= 0 || s.Port > 65535 {
+		return nil, fmt.Errorf("invalid port %d", s.Port)
+	}
+	header := func(name dnsmessage.Name, typ dnsmessage.Type, unique bool) dnsmessage.ResourceHeader {
+		class := dnsmessage.ClassINET
+		if unique {
+			class |= cacheFlush
+		}
+		return dnsmessage.ResourceHeader{Name: name, Type: typ, Class: class, TTL: recordTTL}
+	}
+	records := []dnsmessage.Resource{
+		{Header: header(svc, dnsmessage.TypePTR, false), Body: &dnsmessage.PTRResource{PTR: inst}},
+		{Header: header(inst, dnsmessage.TypeSRV, true), Body: &dnsmessage.SRVResource{Target: host, Port: uint16(s.Port)}},
+		{Header: header(inst, dnsmessage.TypeTXT, true), Body: &dnsmessage.TXTResource{TXT: []string{txtFingerprint + strings.ToLower(s.CertFP)}}},
+	}
+	for _, ip := range s.IPs {
+		if ip4 := ip.To4(); ip4 != nil {
+			records = append(records, dnsmessage.Resource{
+				Header: header(host, dnsmessage.TypeA, true),
+				Body:   &dnsmessage.AResource{A: [4]byte(ip4)},
+			})
+		} else if ip16 := ip.To16(); ip16 != nil {
+			records = append(records, dnsmessage.Resource{
+				Header: header(host, dnsmessage.TypeAAAA, true),
+				Body:   &dnsmessage.AAAAResource{AAAA: [16]byte(ip16)},
+			})
+		}
+	}
+	return records, nil
+}
+
+// Response packs s as an mDNS response with the PTR record as the answer
+// and the rest as additional records.
+func (s Service) Response(id uint16, questions []dnsmessage.Question) ([]byte, error) {
+	records, err := s.Records()
+	if err != nil {
+		return nil, err
+	}
+	msg := dnsmessage.Message{
+		Header:      dnsmessage.Header{ID: id, Response: true, Authoritative: true},
+		Questions:   questions,
+		Answers:     records[:1],
+		Additionals: records[1:],
+	}
+	return msg.Pack()
+}
+
+// URL returns the relay's NAC validation URL, addressed by its first IPv4
+// address, or its first address, or its host name.
+func (s Service) URL() string {
+	var host string
+	for _, ip := range s.IPs {
+		if ip.To4() != nil {
+			host = ip.String()
+			break
+		}
+	}
+	if host == "" && len(s.IPs) > 0 {
+		host = s.IPs[0].String()
+	} else if host == "" {
+		host = strings.TrimSuffix(s.Host, ".")
+	}
+	return "https://" + net.JoinHostPort(host, strconv.Itoa(s.Port)) + "/validation-data"
+}
+
+// Query packs an mDNS query for relays.
+func Query() ([]byte, error) {
+	svc, err := dnsmessage.NewName(serviceName)
+	if err != nil {
+		return nil, err
+	}
+	msg := dnsmessage.Message{Questions: []dnsmessage.Question{{Name: svc, Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET}}}
+	return msg.Pack()
+}
+
+// MatchQuery parses an mDNS message and returns its header and the
+// questions asking for relays, if any. Responses never match.
+func MatchQuery(msg []byte) (dnsmessage.Header, []dnsmessage.Question, bool) {
+	var p dnsmessage.Parser
+	header, err := p.Start(msg)
+	if err != nil || header.Response {
+		return header, nil, false
+	}
+	questions, err := p.AllQuestions()
+	if err != nil {
+		return header, nil, false
+	}
+	var matched []dnsmessage.Question
+	for _, q := range questions {
+		if (q.Type == dnsmessage.TypePTR || q.Type == dnsmessage.TypeALL) &&
+			q.Class&^unicastResponse == dnsmessage.ClassINET &&
+			strings.EqualFold(q.Name.String(), serviceName) {
+			matched = append(matched, q)
+		}
+	}
+	return header, matched, len(matched) > 0
+}
+
+// ParseResponse extracts the relays advertised in an mDNS response.
+// Instances without an SRV record are skipped.
+func ParseResponse(msg []byte) ([]Service, error) {
+	var parsed dnsmessage.Message
+	if err := parsed.Unpack(msg); err != nil {
+		return nil, err
+	}
+	if !parsed.Header.Response {
+		return nil, nil
+	}
+	var instances []string
+	srvs := make(map[string]*dnsmessage.SRVResource)
+	fps := make(map[string]string)
+	ips := make(map[string][]net.IP)
+	for _, rec := range append(parsed.Answers, parsed.Additionals...) {
+		name := strings.ToLower(rec.Header.Name.String())
+		switch body := rec.Body.(type) {
+		case *dnsmessage.PTRResource:
+			if name == strings.ToLower(serviceName) {
+				instances = append(instances, strings.ToLower(body.PTR.String()))
+			}
+		case *dnsmessage.SRVResource:
+			srvs[name] = body
+		case *dnsmessage.TXTResource:
+			for _, txt := range body.TXT {
+				if fp, ok := strings.CutPrefix(txt, txtFingerprint); ok {
+					fps[name] = strings.ToLower(fp)
+				}
+			}
+		case *dnsmessage.AResource:
+			ips[name] = append(ips[name], net.IP(body.A[:]))
+		case *dnsmessage.AAAAResource:
+			ips[name] = append(ips[name], net.IP(body.AAAA[:]))
+		}
+	}
+	var services []Service
+	for _, inst := range instances {
+		srv, ok := srvs[inst]
+		if !ok {
+			continue
+		}
+		host := strings.ToLower(srv.Target.String())
+		services = append(services, Service{
+			Instance: strings.TrimSuffix(inst, "."+strings.ToLower(serviceName)),
+			Host:     host,
+			Port:     int(srv.Port),
+			IPs:      ips[host],
+			CertFP:   fps[inst],
+		})
+	}
+	return services, nil
+}
+
+// Match picks the relay with the given certificate fingerprint. Anyone on
+// the LAN can advertise a relay, so without a fingerprint nothing matches.
+func Match(services []Service, certFP string) (Service, bool) {
+	if certFP == "" {
+		return Service{}, false
+	}
+	for _, s := range services {
+		if strings.EqualFold(s.CertFP, certFP) {
+			return s, true
+		}
+	}
+	return Service{}, false
+}
+
+// addressCheckInterval is how often Advertise re-reads the host's
+// addresses to announce a change without waiting for a query.
+const addressCheckInterval = 30 * time.Second
+
+// liveService is an advertised Service whose addresses follow the host's.
+type liveService struct {
+	mu         sync.Mutex
+	svc        Service
+	currentIPs func() []net.IP
+}
+
+// refresh re-reads the addresses, if there's a source for them, and
+// returns the service to advertise and whether they changed.
+func (l *liveService) refresh() (Service, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.currentIPs == nil {
+		return l.svc, false
+	}
+	ips := l.currentIPs()
+	if slices.EqualFunc(ips, l.svc.IPs, net.IP.Equal) {
+		return l.svc, false
+	}
+	l.svc.IPs = ips
+	return l.svc, true
+}
+
+// Advertise answers mDNS queries for relays with s until ctx is done.
+// Queries from port 5353 get a multicast answer; others (one-shot queries
+// like Discover's) get a unicast one. With currentIPs, the advertised
+// addresses are re-read for every answer and every addressCheckInterval,
+// and a change is announced right away, so a relay that outlives a change
+// of the host's address doesn't keep advertising the old one.
+func Advertise(ctx context.Context, s Service, currentIPs func() []net.IP) error {
+	if _, err := s.Records(); err != nil {
+		return err
+	}
+	conn, err := net.ListenMulticastUDP("udp4", nil, mdnsGroup)
+	if err != nil {
+		return fmt.Errorf("listen on mDNS group: %w", err)
+	}
+	live := &liveService{svc: s, currentIPs: currentIPs}
+	announce := func(s Service) {
+		if resp, err := s.Response(0, nil); err == nil {
+			_, _ = conn.WriteToUDP(resp, mdnsGroup)
+		}
+	}
+	go func() {
+		var tick <-chan time.Time
+		if currentIPs != nil {
+			ticker := time.NewTicker(addressCheckInterval)
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+		for {
+			select {
+			case <-ctx.Done():
+				_ = conn.Close()
+				return
+			case <-tick:
+				if svc, changed := live.refresh(); changed {
+					announce(svc)
+				}
+			}
+		}
+	}()
+	// Announce once on startup so caches pick up a new address right away.
+	svc, _ := live.refresh()
+	announce(svc)
+	buf := make([]byte, 9000)
+	for {
+		n, src, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		header, questions, ok := MatchQuery(buf[:n])
+		if !ok {
+			continue
+		}
+		dst := mdnsGroup
+		var id uint16
+		if src.Port != mdnsPort {
+			// Legacy unicast query: reply directly, echoing the ID and
+			// questions (RFC 6762 6.7).
+			dst, id = src, header.ID
+		} else {
+			questions = nil
+		}
+		svc, changed := live.refresh()
+		if changed && dst != mdnsGroup {
+			announce(svc)
+		}
+		resp, err := svc.Response(id, questions)
+		if err != nil {
+			return err
+		}
+		_, _ = conn.WriteToUDP(resp, dst)
+	}
+}
+
+// ErrNotFound is returned by Discover when no relay answered.
+var ErrNotFound = errors.New("no relay found")
+
+// Discover queries for relays and collects the answers until timeout.
+func Discover(ctx context.Context, timeout time.Duration) ([]Service, error) {
+	query, err := Query()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if err = conn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+	if _, err = conn.WriteToUDP(query, mdnsGroup); err != nil {
+		return nil, fmt.Errorf("send mDNS query: %w", err)
+	}
+	var services []Service
+	seen := make(map[string]bool)
+	buf := make([]byte, 9000)
+	for ctx.Err() == nil {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				break
+			}
+			return services, err
+		}
+		found, err := ParseResponse(buf[:n])
+		if err != nil {
+			continue
+		}
+		for _, s := range found {
+			if key := s.Instance + "|" + s.CertFP; !seen[key] {
+				seen[key] = true
+				services = append(services, s)
+			}
+		}
+	}
+	if len(services) == 0 {
+		return nil, ErrNotFound
+	}
+	return services, nil
+}
@@ -0,0 +1,257 @@
+package relaydiscovery
+
+import (
+	"net"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const testFP = "ab12cd34ef56ab12cd34ef56ab12cd34ef56ab12cd34ef56ab12cd34ef56ab12"
+
+func TestRecords(t *testing.T) {
+	s := Service{
+		Instance: "Ludvig's Mac.lan",
+		Host:     "ludvigs-mac",
+		Port:     5001,
+		IPs:      []net.IP{net.ParseIP("192.168.1.20"), net.ParseIP("fe80::1")},
+		CertFP:   "AB12",
+	}
+	records, err := s.Records()
+	if err != nil {
+		t.Fatalf("Records() error = %v", err)
+	}
+	type rec struct {
+		name, typ string
+		flush     bool
+		body      string
+	}
+	want := []rec{
+		{"_imessage-relay._tcp.local.", "TypePTR", false, "Ludvig's Mac-lan._imessage-relay._tcp.local."},
+		{"Ludvig's Mac-lan._imessage-relay._tcp.local.", "TypeSRV", true, "ludvigs-mac.local.:5001"},
+		{"Ludvig's Mac-lan._imessage-relay._tcp.local.", "TypeTXT", true, "fp=ab12"},
+		{"ludvigs-mac.local.", "TypeA", true, "192.168.1.20"},
+		{"ludvigs-mac.local.", "TypeAAAA", true, "fe80::1"},
+	}
+	var got []rec
+	for _, r := range records {
+		var body string
+		switch b := r.Body.(type) {
+		case *dnsmessage.PTRResource:
+			body = b.PTR.String()
+		case *dnsmessage.SRVResource:
+			body = b.Target.String() + ":" + strconv.Itoa(int(b.Port))
+		case *dnsmessage.TXTResource:
+			body = b.TXT[0]
+		case *dnsmessage.AResource:
+			body = net.IP(b.A[:]).String()
+		case *dnsmessage.AAAAResource:
+			body = net.IP(b.AAAA[:]).String()
+		}
+		got = append(got, rec{r.Header.Name.String(), r.Header.Type.String(), r.Header.Class&cacheFlush != 0, body})
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Records() = %+v, want %+v", got, want)
+	}
+}
+
+func TestRecordsInvalid(t *testing.T) {
+	for _, port := range []int{0, -1, 70000} {
+		if _, err := (Service{Instance: "mac", Port: port}).Records(); err == nil {
+			t.Errorf("Records() with port %d error = nil, want error", port)
+		}
+	}
+}
+
+func TestResponseRoundTrip(t *testing.T) {
+	s := Service{Instance: "mac", Host: "mac.local.", Port: 5001, IPs: []net.IP{net.ParseIP("10.0.0.5").To4()}, CertFP: testFP}
+	resp, err := s.Response(0, nil)
+	if err != nil {
+		t.Fatalf("Response() error = %v", err)
+	}
+	got, err := ParseResponse(resp)
+	if err != nil {
+		t.Fatalf("ParseResponse() error = %v", err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("ParseResponse() = %+v, want 1 service", got)
+	}
+	if got[0].Instance != "mac" || got[0].Port != 5001 || got[0].CertFP != testFP || !got[0].IPs[0].Equal(s.IPs[0]) {
+		t.Errorf("ParseResponse() = %+v, want %+v", got[0], s)
+	}
+	if url := got[0].URL(); url != "https://10.0.0.5:5001/validation-data" {
+		t.Errorf("URL() = %q, want %q", url, "https://10.0.0.5:5001/validation-data")
+	}
+}
+
+func TestParseResponse(t *testing.T) {
+	svc := dnsmessage.MustNewName(serviceName)
+	inst := dnsmessage.MustNewName("Mac._imessage-relay._tcp.local.")
+	other := dnsmessage.MustNewName("NoSRV._imessage-relay._tcp.local.")
+	host := dnsmessage.MustNewName("mac.local.")
+	hdr := func(name dnsmessage.Name, typ dnsmessage.Type) dnsmessage.ResourceHeader {
+		return dnsmessage.ResourceHeader{Name: name, Type: typ, Class: dnsmessage.ClassINET | cacheFlush}
+	}
+	tests := []struct {
+		name string
+		msg  dnsmessage.Message
+		want []Service
+	}{
+		{
+			"records split across sections",
+			dnsmessage.Message{
+				Header: dnsmessage.Header{Response: true},
+				Answers: []dnsmessage.Resource{
+					{Header: hdr(svc, dnsmessage.TypePTR), Body: &dnsmessage.PTRResource{PTR: inst}},
+					{Header: hdr(svc, dnsmessage.TypePTR), Body: &dnsmessage.PTRResource{PTR: other}},
+				},
+				Additionals: []dnsmessage.Resource{
+					{Header: hdr(host, dnsmessage.TypeA), Body: &dnsmessage.AResource{A: [4]byte{192, 168, 0, 9}}},
+					{Header: hdr(inst, dnsmessage.TypeTXT), Body: &dnsmessage.TXTResource{TXT: []string{"v=1", "fp=ABCD"}}},
+					{Header: hdr(inst, dnsmessage.TypeSRV), Body: &dnsmessage.SRVResource{Target: host, Port: 6000}},
+				},
+			},
+			[]Service{{Instance: "mac", Host: "mac.local.", Port: 6000, IPs: []net.IP{net.IP{192, 168, 0, 9}}, CertFP: "abcd"}},
+		},
+		{
+			"query is ignored",
+			dnsmessage.Message{
+				Answers: []dnsmessage.Resource{{Header: hdr(svc, dnsmessage.TypePTR), Body: &dnsmessage.PTRResource{PTR: inst}}},
+			},
+			nil,
+		},
+		{
+			"other service type",
+			dnsmessage.Message{
+				Header: dnsmessage.Header{Response: true},
+				Answers: []dnsmessage.Resource{
+					{Header: hdr(dnsmessage.MustNewName("_http._tcp.local."), dnsmessage.TypePTR), Body: &dnsmessage.PTRResource{PTR: inst}},
+					{Header: hdr(inst, dnsmessage.TypeSRV), Body: &dnsmessage.SRVResource{Target: host, Port: 6000}},
+				},
+			},
+			nil,
+		},
+	}
+	for _, tt := range tests {
+		packed, err := tt.msg.Pack()
+		if err != nil {
+			t.Fatalf("Pack(%s) error = %v", tt.name, err)
+		}
+		got, err := ParseResponse(packed)
+		if err != nil {
+			t.Fatalf("ParseResponse(%s) error = %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseResponse(%s) = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMatchQuery(t *testing.T) {
+	query, err := Query()
+	if err != nil {
+		t.Fatalf("Query() error = %v", err)
+	}
+	if _, questions, ok := MatchQuery(query); !ok || len(questions) != 1 {
+		t.Errorf("MatchQuery(Query()) = %v, %v, want one question", questions, ok)
+	}
+	qu := dnsmessage.Message{Questions: []dnsmessage.Question{{
+		Name: dnsmessage.MustNewName("_IMESSAGE-RELAY._tcp.local."), Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET | unicastResponse,
+	}}}
+	if packed, _ := qu.Pack(); !matches(packed) {
+		t.Errorf("MatchQuery() = false for a QU query, want true")
+	}
+	other := dnsmessage.Message{Questions: []dnsmessage.Question{{
+		Name: dnsmessage.MustNewName("_airplay._tcp.local."), Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET,
+	}}}
+	if packed, _ := other.Pack(); matches(packed) {
+		t.Errorf("MatchQuery() = true for another service, want false")
+	}
+	resp, _ := Service{Instance: "mac", Port: 5001}.Response(0, nil)
+	if matches(resp) {
+		t.Errorf("MatchQuery() = true for a response, want false")
+	}
+}
+
+func matches(msg []byte) bool {
+	_, _, ok := MatchQuery(msg)
+	return ok
+}
+
+func TestMatch(t *testing.T) {
+	a := Service{Instance: "a", CertFP: "aaaa"}
+	b := Service{Instance: "b", CertFP: "bbbb"}
+	tests := []struct {
+		name     string
+		services []Service
+		certFP   string
+		want     string
+	}{
+		{"by fingerprint", []Service{a, b}, "BBBB", "b"},
+		{"no matching fingerprint", []Service{a, b}, "cccc", ""},
+		{"single relay without fingerprint", []Service{a}, "", ""},
+		{"relay advertising no fingerprint", []Service{{Instance: "c"}}, "", ""},
+		{"none", nil, "aaaa", ""},
+	}
+	for _, tt := range tests {
+		got, ok := Match(tt.services, tt.certFP)
+		if got.Instance != tt.want || ok != (tt.want != "") {
+			t.Errorf("Match(%s) = %q, %v, want %q", tt.name, got.Instance, ok, tt.want)
+		}
+	}
+}
+
+func TestURL(t *testing.T) {
+	tests := []struct {
+		s    Service
+		want string
+	}{
+		{Service{Host: "mac.local.", Port: 5001, IPs: []net.IP{net.ParseIP("fe80::1"), net.ParseIP("10.0.0.2")}}, "https://10.0.0.2:5001/validation-data"},
+		{Service{Host: "mac.local.", Port: 5001, IPs: []net.IP{net.ParseIP("fd00::2")}}, "https://[fd00::2]:5001/validation-data"},
+		{Service{Host: "mac.local.", Port: 5001}, "https://mac.local:5001/validation-data"},
+	}
+	for _, tt := range tests {
+		if got := tt.s.URL(); got != tt.want {
+			t.Errorf("URL(%+v) = %q, want %q", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestLiveServiceRefresh(t *testing.T) {
+	ips := []net.IP{net.ParseIP("10.0.0.5").To4()}
+	live := &liveService{
+		svc:        Service{Instance: "mac", Host: "mac.local.", Port: 5001, IPs: ips, CertFP: testFP},
+		currentIPs: func() []net.IP { return ips },
+	}
+	if _, changed := live.refresh(); changed {
+		t.Errorf("refresh() with the same address changed = true, want false")
+	}
+
+	// The Mac moved to another address while the relay kept running.
+	ips = []net.IP{net.ParseIP("10.0.0.9").To4()}
+	svc, changed := live.refresh()
+	if !changed {
+		t.Fatalf("refresh() after an address change changed = false, want true")
+	}
+	resp, err := svc.Response(0, nil)
+	if err != nil {
+		t.Fatalf("Response() error = %v", err)
+	}
+	got, err := ParseResponse(resp)
+	if err != nil || len(got) != 1 {
+		t.Fatalf("ParseResponse() = %+v, %v, want 1 service", got, err)
+	}
+	if url := got[0].URL(); url != "https://10.0.0.9:5001/validation-data" {
+		t.Errorf("advertised URL after the change = %q, want the new address", url)
+	}
+	if _, changed = live.refresh(); changed {
+		t.Errorf("refresh() again changed = true, want false")
+	}
+
+	static := &liveService{svc: Service{Instance: "mac", IPs: ips}}
+	if svc, changed := static.refresh(); changed || !svc.IPs[0].Equal(ips[0]) {
+		t.Errorf("refresh() without an address source = %+v, %v, want the fixed addresses", svc, changed)
+	}
+}
@@ -7273,6 +7273,7 @@ type WrappedMessage struct {
 	IsTyping                      bool
 	TypingAppBundleId             *string
 	TypingAppIcon                 *[]byte
+	IsTypingStop                  bool
 	IsReadReceipt                 bool
 	IsDelivered                   bool
 	IsError                       bool
@@ -7319,6 +7320,9 @@ type WrappedMessage struct {
 	TranscriptBackgroundFileSize  *uint64
 	StickerData                   *[]byte
 	StickerMime                   *string
+	BalloonBundleId               *string
+	BalloonUrl                    *string
+	BalloonLdText                 *string
 	IsShareProfile                bool
 	ShareProfileRecordKey         *string
 	ShareProfileDecryptionKey     *[]byte
@@ -7361,6 +7365,7 @@ func (r *WrappedMessage) Destroy() {
 	FfiDestroyerBool{}.Destroy(r.IsTyping)
 	FfiDestroyerOptionalString{}.Destroy(r.TypingAppBundleId)
 	FfiDestroyerOptionalBytes{}.Destroy(r.TypingAppIcon)
+	FfiDestroyerBool{}.Destroy(r.IsTypingStop)
 	FfiDestroyerBool{}.Destroy(r.IsReadReceipt)
 	FfiDestroyerBool{}.Destroy(r.IsDelivered)
 	FfiDestroyerBool{}.Destroy(r.IsError)
@@ -7407,6 +7412,9 @@ func (r *WrappedMessage) Destroy() {
 	FfiDestroyerOptionalUint64{}.Destroy(r.TranscriptBackgroundFileSize)
 	FfiDestroyerOptionalBytes{}.Destroy(r.StickerData)
 	FfiDestroyerOptionalString{}.Destroy(r.StickerMime)
+	FfiDestroyerOptionalString{}.Destroy(r.BalloonBundleId)
+	FfiDestroyerOptionalString{}.Destroy(r.BalloonUrl)
+	FfiDestroyerOptionalString{}.Destroy(r.BalloonLdText)
 	FfiDestroyerBool{}.Destroy(r.IsShareProfile)
 	FfiDestroyerOptionalString{}.Destroy(r.ShareProfileRecordKey)
 	FfiDestroyerOptionalBytes{}.Destroy(r.ShareProfileDecryptionKey)
@@ -7461,6 +7469,7 @@ func (c FfiConverterTypeWrappedMessage) Read(reader io.Reader) WrappedMessage {
 		FfiConverterBoolINSTANCE.Read(reader),
 		FfiConverterBoolINSTANCE.Read(reader),
 		FfiConverterBoolINSTANCE.Read(reader),
+		FfiConverterBoolINSTANCE.Read(reader),
 		FfiConverterOptionalStringINSTANCE.Read(reader),
 		FfiConverterOptionalUint64INSTANCE.Read(reader),
 		FfiConverterOptionalStringINSTANCE.Read(reader),
@@ -7504,6 +7513,9 @@ func (c FfiConverterTypeWrappedMessage) Read(reader io.Reader) WrappedMessage {
 		FfiConverterOptionalUint64INSTANCE.Read(reader),
 		FfiConverterOptionalBytesINSTANCE.Read(reader),
 		FfiConverterOptionalStringINSTANCE.Read(reader),
+		FfiConverterOptionalStringINSTANCE.Read(reader),
+		FfiConverterOptionalStringINSTANCE.Read(reader),
+		FfiConverterOptionalStringINSTANCE.Read(reader),
 		FfiConverterBoolINSTANCE.Read(reader),
 		FfiConverterOptionalStringINSTANCE.Read(reader),
 		FfiConverterOptionalBytesINSTANCE.Read(reader),
@@ -7551,6 +7563,7 @@ func (c FfiConverterTypeWrappedMessage) Write(writer io.Writer, value WrappedMes
 	FfiConverterBoolINSTANCE.Write(writer, value.IsTyping)
 	FfiConverterOptionalStringINSTANCE.Write(writer, value.TypingAppBundleId)
 	FfiConverterOptionalBytesINSTANCE.Write(writer, value.TypingAppIcon)
+	FfiConverterBoolINSTANCE.Write(writer, value.IsTypingStop)
 	FfiConverterBoolINSTANCE.Write(writer, value.IsReadReceipt)
 	FfiConverterBoolINSTANCE.Write(writer, value.IsDelivered)
 	FfiConverterBoolINSTANCE.Write(writer, value.IsError)
@@ -7597,6 +7610,9 @@ func (c FfiConverterTypeWrappedMessage) Write(writer io.Writer, value WrappedMes
 	FfiConverterOptionalUint64INSTANCE.Write(writer, value.TranscriptBackgroundFileSize)
 	FfiConverterOptionalBytesINSTANCE.Write(writer, value.StickerData)
 	FfiConverterOptionalStringINSTANCE.Write(writer, value.StickerMime)
+	FfiConverterOptionalStringINSTANCE.Write(writer, value.BalloonBundleId)
+	FfiConverterOptionalStringINSTANCE.Write(writer, value.BalloonUrl)
+	FfiConverterOptionalStringINSTANCE.Write(writer, value.BalloonLdText)
 	FfiConverterBoolINSTANCE.Write(writer, value.IsShareProfile)
 	FfiConverterOptionalStringINSTANCE.Write(writer, value.ShareProfileRecordKey)
 	FfiConverterOptionalBytesINSTANCE.Write(writer, value.ShareProfileDecryptionKey)
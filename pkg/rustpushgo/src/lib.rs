@@ -2464,6 +2464,8 @@ pub struct WrappedMessage {
     pub is_typing: bool,
     pub typing_app_bundle_id: Option<String>,
     pub typing_app_icon: Option<Vec<u8>>,
+    /// True when the sender explicitly stopped typing (Typing(false)).
+    pub is_typing_stop: bool,
 
     // Read receipt
     pub is_read_receipt: bool,
@@ -2571,6 +2573,14 @@ pub struct WrappedMessage {
     pub sticker_data: Option<Vec<u8>>,
     pub sticker_mime: Option<String>,
 
+    // Extension balloon metadata (iMessage app messages such as Check In).
+    // balloon_bundle_id is the full extension bundle id; balloon_url carries
+    // the app-defined payload (usually a query string) and balloon_ld_text
+    // the localized summary Apple shows in notifications.
+    pub balloon_bundle_id: Option<String>,
+    pub balloon_url: Option<String>,
+    pub balloon_ld_text: Option<String>,
+
     // Profile sharing: set when a contact shares their name/photo with us.
     // record_key + decryption_key + has_poster identify the CloudKit record;
     // display_name/first_name/last_name/avatar are populated inline by the
@@ -4457,6 +4467,7 @@ fn message_inst_to_wrapped(msg: &MessageInst) -> WrappedMessage {
         is_typing: false,
         typing_app_bundle_id: None,
         typing_app_icon: None,
+        is_typing_stop: false,
         is_read_receipt: false,
         is_delivered: false,
         is_error: false,
@@ -4503,6 +4514,9 @@ fn message_inst_to_wrapped(msg: &MessageInst) -> WrappedMessage {
         transcript_background_file_size: None,
         sticker_data: None,
         sticker_mime: None,
+        balloon_bundle_id: None,
+        balloon_url: None,
+        balloon_ld_text: None,
         is_share_profile: false,
         share_profile_record_key: None,
         share_profile_decryption_key: None,
@@ -4638,7 +4652,10 @@ fn message_inst_to_wrapped(msg: &MessageInst) -> WrappedMessage {
 
             // Sticker data from extension balloons (icon field)
             if let Some(ref app) = normal.app {
+                w.balloon_bundle_id = Some(app.bundle_id.clone());
                 if let Some(ref balloon) = app.balloon {
+                    w.balloon_url = Some(balloon.url.clone());
+                    w.balloon_ld_text = balloon.ld_text.clone();
                     if let Some(ref icon_data) = balloon.icon {
                         if !icon_data.is_empty() {
                             w.sticker_data = Some(icon_data.clone());
@@ -4691,6 +4708,7 @@ fn message_inst_to_wrapped(msg: &MessageInst) -> WrappedMessage {
         }
         Message::Typing(typing, app) => {
             w.is_typing = *typing;
+            w.is_typing_stop = !*typing;
             if let Some(app) = app {
                 w.typing_app_bundle_id = Some(app.bundle_id.clone());
                 w.typing_app_icon = Some(app.icon.clone());
@@ -9048,22 +9066,12 @@ impl Client {
         );
         match self.send_with_flap_retry(&mut msg).await {
             Ok(_) => Ok(msg.id.clone()),
+            // No IDS targets: the recipient isn't on iMessage. Surface a
+            // fixed marker so Go can decide whether to retry as SMS (opt-in,
+            // needs an SMS relay) instead of silently switching services here.
             Err(rustpush::PushError::NoValidTargets) if !conversation.is_sms => {
-                // iMessage failed — no IDS targets. Retry as SMS (without rich link).
-                info!("No IDS targets, falling back to SMS for {:?}", conv.participants);
-                let sms_service = MessageType::SMS {
-                    is_phone: false,
-                    using_number: handle.clone(),
-                    from_handle: None,
-                };
-                let mut sms_msg = MessageInst::new(
-                    conv,
-                    &handle,
-                    Message::Message(NormalMessage::new(actual_text, sms_service)),
-                );
-                self.send_with_flap_retry(&mut sms_msg).await
-                    .map_err(|e| WrappedError::GenericError { msg: format!("Failed to send SMS: {}", e) })?;
-                Ok(sms_msg.id.clone())
+                info!("No IDS targets for {:?}", conv.participants);
+                Err(WrappedError::GenericError { msg: "Failed to send message: NoValidTargets".to_string() })
             }
             Err(e) => Err(WrappedError::GenericError { msg: format!("Failed to send message: {}", e) }),
         }
@@ -9815,39 +9823,10 @@ impl Client {
         );
         match self.send_with_flap_retry(&mut msg).await {
             Ok(_) => Ok(msg.id.clone()),
+            // See send_message: the SMS retry decision is made in Go.
             Err(rustpush::PushError::NoValidTargets) if !conversation.is_sms => {
-                info!("No IDS targets for attachment, falling back to SMS for {:?}", conv.participants);
-                let sms_service = MessageType::SMS {
-                    is_phone: false,
-                    using_number: handle.clone(),
-                    from_handle: None,
-                };
-                let sms_parts = vec![IndexedMessagePart {
-                    part: MessagePart::Attachment(attachment),
-                    idx: None,
-                    ext: None,
-                }];
-                let sms_subject = body.filter(|s| !s.is_empty());
-                let mut sms_msg = MessageInst::new(
-                    conv,
-                    &handle,
-                    Message::Message(NormalMessage {
-                        parts: MessageParts(sms_parts),
-                        effect: None,
-                        reply_guid: reply_guid,
-                        reply_part: reply_part,
-                        service: sms_service,
-                        subject: sms_subject,
-                        app: None,
-                        link_meta: None,
-                        voice: is_voice,
-                        scheduled: None,
-                        embedded_profile: None,
-                    }),
-                );
-                self.send_with_flap_retry(&mut sms_msg).await
-                    .map_err(|e| WrappedError::GenericError { msg: format!("Failed to send SMS attachment: {}", e) })?;
-                Ok(sms_msg.id.clone())
+                info!("No IDS targets for attachment to {:?}", conv.participants);
+                Err(WrappedError::GenericError { msg: "Failed to send attachment: NoValidTargets".to_string() })
             }
             Err(e) => Err(WrappedError::GenericError { msg: format!("Failed to send attachment: {}", e) }),
         }
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+)
+
+// accountInfo is the GET /account response: the iMessage handles this Mac's
+// Messages.app sends from. The bridge uses it to cross-check its own handle
+// selection against what the paired Mac is actually registered with.
+type accountInfo struct {
+	Hostname string   `json:"hostname"`
+	Handles  []string `json:"handles"`
+}
+
+// queryAccountHandles returns the Mac's own iMessage/SMS aliases as
+// tel:/mailto: URIs, sorted and deduplicated.
+//
+// chat.db has no table of "my handles" — the handle table only lists the
+// other side of each conversation. The local aliases show up instead as the
+// sending account on each chat (chat.account_login, "E:user@icloud.com" /
+// "P:+15551234567") and on each outgoing message (message.account, the same
+// format in lower case), so both are unioned.
+func queryAccountHandles(db *sql.DB) ([]string, error) {
+	rows, err := db.Query(`
+		SELECT account_login FROM chat WHERE account_login IS NOT NULL AND account_login <> ''
+		UNION
+		SELECT account FROM message WHERE is_from_me = 1 AND account IS NOT NULL AND account <> ''
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query account handles: %w", err)
+	}
+	defer rows.Close()
+
+	seen := make(map[string]bool)
+	var handles []string
+	for rows.Next() {
+		var raw string
+		if err = rows.Scan(&raw); err != nil {
+			return nil, fmt.Errorf("failed to scan account handle: %w", err)
+		}
+		if handle := normalizeAccountHandle(raw); handle != "" && !seen[handle] {
+			seen[handle] = true
+			handles = append(handles, handle)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to query account handles: %w", err)
+	}
+	sort.Strings(handles)
+	return handles, nil
+}
+
+// normalizeAccountHandle converts a chat.db account string ("E:addr",
+// "e:addr", "P:+1555…", or a bare address) to a tel:/mailto: URI. Returns ""
+// for values that aren't a phone number or email address.
+func normalizeAccountHandle(raw string) string {
+	raw = strings.TrimSpace(raw)
+	if len(raw) > 2 && raw[1] == ':' {
+		raw = raw[2:]
+	}
+	switch {
+	case strings.Contains(raw, "@"):
+		return "mailto:" + strings.ToLower(raw)
+	case strings.HasPrefix(raw, "+"):
+		return "tel:" + raw
+	}
+	return ""
+}
+
+// handleAccount serves GET /account from chat.db. Reading chat.db requires
+// Full Disk Access for the relay; without it the endpoint returns 503 so the
+// bridge can tell "no access" apart from "no handles".
+func handleAccount(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "GET only", http.StatusMethodNotAllowed)
+		return
+	}
+	db, err := sharedChatDB()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	handles, err := queryAccountHandles(db)
+	if err != nil {
+		log.Printf("ERROR: account query failed: %v", err)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	hostname, _ := os.Hostname()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(accountInfo{Hostname: hostname, Handles: handles})
+	log.Printf("Served %d account handles (from %s)", len(handles), r.RemoteAddr)
+}
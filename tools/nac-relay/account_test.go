@@ -0,0 +1,52 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestQueryAccountHandles(t *testing.T) {
+	db := newTestChatDB(t,
+		// Other people's handles must not show up.
+		`INSERT INTO handle (id, service) VALUES ('+15550000001', 'iMessage'), ('friend@example.com', 'iMessage')`,
+		`INSERT INTO chat (guid, account_login) VALUES
+			('iMessage;-;+15550000001', 'E:Me@iCloud.com'),
+			('SMS;-;+15550000001', 'P:+15551234567'),
+			('iMessage;-;friend@example.com', ''),
+			('iMessage;-;legacy', NULL)`,
+		`INSERT INTO message (is_from_me, account) VALUES
+			(1, 'e:me@icloud.com'),
+			(1, 'e:work@example.com'),
+			(0, 'e:friend@example.com'),
+			(1, 'e:')`,
+	)
+
+	got, err := queryAccountHandles(db)
+	if err != nil {
+		t.Fatalf("queryAccountHandles() error = %v", err)
+	}
+	want := []string{"mailto:me@icloud.com", "mailto:work@example.com", "tel:+15551234567"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("queryAccountHandles() = %v, want %v", got, want)
+	}
+}
+
+func TestNormalizeAccountHandle(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"E:User@Example.com", "mailto:user@example.com"},
+		{"e:user@example.com", "mailto:user@example.com"},
+		{"P:+15551234567", "tel:+15551234567"},
+		{"+15551234567", "tel:+15551234567"},
+		{"e:", ""},
+		{"", ""},
+		{"unknown", ""},
+	}
+	for _, tt := range tests {
+		if got := normalizeAccountHandle(tt.input); got != tt.want {
+			t.Errorf("normalizeAccountHandle(%q) = %q, want %q", tt.input, got, tt.want)
+		}
+	}
+}
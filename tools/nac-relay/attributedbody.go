@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"unicode/utf8"
+)
+
+// On newer macOS, message.text is often NULL and the body only exists in
+// attributedBody, an NSAttributedString archived as a typedstream. The relay
+// doesn't need the attributes, so instead of a full typedstream decoder it
+// pulls out the string the archive stores right after the NSString class:
+//
+//	"NSString" ... 0x2B <length> <UTF-8 bytes>
+//
+// The length is one byte, or 0x81 followed by a little-endian uint16, or
+// 0x82 followed by a little-endian uint32.
+
+// attributedBodyTagWindow is how far past the NSString class name the
+// 0x2B string tag may start.
+const attributedBodyTagWindow = 8
+
+// attributedBodyText returns the plain text of an attributedBody blob, or ""
+// if it doesn't hold a readable string.
+func attributedBodyText(data []byte) string {
+	idx := bytes.Index(data, []byte("NSString"))
+	if idx < 0 {
+		return ""
+	}
+	rest := data[idx+len("NSString"):]
+	tag := bytes.IndexByte(rest[:min(len(rest), attributedBodyTagWindow)], 0x2B)
+	if tag < 0 {
+		return ""
+	}
+	rest = rest[tag+1:]
+	if len(rest) == 0 {
+		return ""
+	}
+	var length int
+	switch rest[0] {
+	case 0x81:
+		if len(rest) < 3 {
+			return ""
+		}
+		length = int(binary.LittleEndian.Uint16(rest[1:3]))
+		rest = rest[3:]
+	case 0x82:
+		if len(rest) < 5 {
+			return ""
+		}
+		length = int(binary.LittleEndian.Uint32(rest[1:5]))
+		rest = rest[5:]
+	default:
+		length = int(rest[0])
+		rest = rest[1:]
+	}
+	if length > len(rest) || !utf8.Valid(rest[:length]) {
+		return ""
+	}
+	return string(rest[:length])
+}
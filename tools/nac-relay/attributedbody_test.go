@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// typedstreamBody builds an attributedBody blob shaped like the ones
+// Messages writes, with text in the NSString slot and its length encoded
+// the way a typedstream would.
+func typedstreamBody(text string) []byte {
+	data := []byte("\x04\x0bstreamtyped\x81\xe8\x03\x84\x01@\x84\x84\x84\x12NSAttributedString\x00\x84\x84\x08NSObject\x00\x85\x92\x84\x84\x84\x08NSString\x01\x94\x84\x01+")
+	switch n := len(text); {
+	case n < 0x80:
+		data = append(data, byte(n))
+	case n <= 0xFFFF:
+		data = append(data, 0x81, byte(n), byte(n>>8))
+	default:
+		data = append(data, 0x82, byte(n), byte(n>>8), byte(n>>16), byte(n>>24))
+	}
+	data = append(data, text...)
+	return append(data, "\x86\x84\x02iI\x01\x01\x92\x84\x84\x84\x0cNSDictionary\x00"...)
+}
+
+func TestAttributedBodyText(t *testing.T) {
+	long := strings.Repeat("a", 300)
+	huge := strings.Repeat("b", 70000)
+	hello := typedstreamBody("hello")
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"short", typedstreamBody("hello"), "hello"},
+		{"emoji", typedstreamBody("hi 👋"), "hi 👋"},
+		{"two-byte length", typedstreamBody(long), long},
+		{"four-byte length", typedstreamBody(huge), huge},
+		{"empty", nil, ""},
+		{"no NSString", []byte("\x04\x0bstreamtyped\x81\xe8\x03"), ""},
+		{"truncated", hello[:strings.Index(string(hello), "hello")+3], ""},
+		{"invalid UTF-8", typedstreamBody("\xff\xfe"), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := attributedBodyText(tt.data); got != tt.want {
+				t.Errorf("attributedBodyText() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQueryMessagesAttributedBody(t *testing.T) {
+	db := newTestChatDB(t,
+		`INSERT INTO chat (ROWID, guid) VALUES (1, 'iMessage;-;+15550000001')`,
+		`INSERT INTO message (ROWID, guid, text, attributedBody, is_from_me, date) VALUES
+			(1, 'GUID-1', 'plain', NULL, 1, 0),
+			(2, 'GUID-2', NULL, X'`+hex.EncodeToString(typedstreamBody("from attributedBody"))+`', 1, 0),
+			(3, 'GUID-3', 'text wins', X'`+hex.EncodeToString(typedstreamBody("stale"))+`', 1, 0)`,
+		`INSERT INTO chat_message_join (chat_id, message_id) VALUES (1, 1), (1, 2), (1, 3)`,
+	)
+	want := []string{"plain", "from attributedBody", "text wins"}
+	check := func(name string, messages []relayMessage, err error) {
+		if err != nil {
+			t.Fatalf("%s() error = %v", name, err)
+		}
+		var got []string
+		for _, msg := range messages {
+			got = append(got, msg.Text)
+		}
+		if strings.Join(got, "|") != strings.Join(want, "|") {
+			t.Errorf("%s() texts = %q, want %q", name, got, want)
+		}
+	}
+	messages, err := queryMessagesAfter(db, 0, 10)
+	check("queryMessagesAfter", messages, err)
+	messages, err = queryChatMessages(db, messagesRequest{ChatGUID: "iMessage;-;+15550000001", Limit: 10})
+	check("queryChatMessages", messages, err)
+}
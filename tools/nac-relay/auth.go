@@ -11,6 +11,7 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"encoding/pem"
+	"encoding/xml"
 	"fmt"
 	"log"
 	"math/big"
@@ -253,8 +254,10 @@ func installAppBundle() (string, error) {
 	return destPath, nil
 }
 
-// runSetup installs the .app bundle and LaunchAgent plist, then starts the service.
-func runSetup() {
+// runSetup installs the .app bundle and LaunchAgent plist, then starts the
+// service. With mdns the service is started with -mdns, and a non-empty
+// chatDB is passed on as -chatdb.
+func runSetup(mdns bool, chatDB string) {
 	log.Println("=== nac-relay setup ===")
 	log.Println()
 
@@ -268,6 +271,19 @@ func runSetup() {
 
 	home, _ := os.UserHomeDir()
 	plistPath := filepath.Join(home, "Library", "LaunchAgents", "com.imessage.nac-relay.plist")
+	var extraArgs string
+	if mdns {
+		extraArgs = "\n\t\t<string>-mdns</string>"
+	}
+	if chatDB != "" {
+		path, err := expandChatDBPath(chatDB)
+		if err != nil {
+			log.Fatalf("Invalid -chatdb path: %v", err)
+		}
+		var escaped strings.Builder
+		_ = xml.EscapeText(&escaped, []byte(path))
+		extraArgs += "\n\t\t<string>-chatdb</string>\n\t\t<string>" + escaped.String() + "</string>"
+	}
 	plistContent := fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
 <!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
 <plist version="1.0">
@@ -276,7 +292,7 @@ func runSetup() {
 	<string>com.imessage.nac-relay</string>
 	<key>ProgramArguments</key>
 	<array>
-		<string>%s</string>
+		<string>%s</string>%s
 	</array>
 	<key>RunAtLoad</key>
 	<true/>
@@ -287,7 +303,7 @@ func runSetup() {
 	<key>StandardErrorPath</key>
 	<string>/tmp/nac-relay.log</string>
 </dict>
-</plist>`, binPath)
+</plist>`, binPath, extraArgs)
 
 	exec.Command("launchctl", "unload", plistPath).Run()
 	os.MkdirAll(filepath.Dir(plistPath), 0755)
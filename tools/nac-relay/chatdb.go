@@ -0,0 +1,123 @@
+package main
+
+import (
+	"database/sql"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/lrhodin/imessage/imessage"
+)
+
+// chat.db connection strategy.
+//
+// All endpoints share one read-only *sql.DB for chat.db instead of opening
+// a database per request. Every open /stream polls once a second, and with
+// a handle per request each stream kept its own connection (and WAL read
+// mark) for as long as the bridge stayed connected.
+//
+// The pool is capped (-chatdb-max-conns, default 4): SQLite serves reads in
+// WAL mode concurrently, but each connection holds a file descriptor and a
+// slot in chat.db's shared-memory index, which Messages.app also uses, so
+// there's no point in more connections than concurrent queries. Callers
+// beyond the cap wait for a free connection rather than fail. Idle
+// connections (-chatdb-max-idle-conns, default 2) are closed after
+// chatDBConnMaxIdleTime so a quiet relay doesn't keep chat.db open.
+//
+// busy_timeout covers the moments Messages.app holds the write lock while
+// checkpointing the WAL. Queries must close their rows on every path
+// (defer rows.Close() right after the error check) or they hold a
+// connection until the *sql.Rows is garbage collected.
+
+const (
+	defaultChatDBMaxOpenConns = 4
+	defaultChatDBMaxIdleConns = 2
+	chatDBConnMaxIdleTime     = 5 * time.Minute
+	chatDBBusyTimeoutMs       = 5000
+)
+
+var (
+	chatDBMaxOpenConns = defaultChatDBMaxOpenConns
+	chatDBMaxIdleConns = defaultChatDBMaxIdleConns
+	// chatDBPathOverride is set by -chatdb.
+	chatDBPathOverride string
+
+	chatDBMu sync.Mutex
+	chatDB   *sql.DB
+)
+
+// chatDBPath returns the Messages database the relay reads: the file given
+// with -chatdb ("~/" expanded), e.g. the sms.db from an iPhone backup, or
+// the current user's chat.db.
+func chatDBPath() (string, error) {
+	if chatDBPathOverride != "" {
+		return expandChatDBPath(chatDBPathOverride)
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, "Library", "Messages", "chat.db"), nil
+}
+
+// expandChatDBPath expands a leading "~/" in path and makes it absolute, so
+// the LaunchAgent installed by -setup finds the same file.
+func expandChatDBPath(path string) (string, error) {
+	if strings.HasPrefix(path, "~/") {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		path = filepath.Join(home, path[2:])
+	}
+	return filepath.Abs(path)
+}
+
+// chatDBDSN is the read-only go-sqlite3 DSN for a chat.db path.
+func chatDBDSN(path string) string {
+	return imessage.ChatDBURI(path, url.Values{"_busy_timeout": {strconv.Itoa(chatDBBusyTimeoutMs)}})
+}
+
+// configureChatDBPool applies the connection limits to a chat.db handle.
+// maxIdle is clamped to maxOpen; non-positive values use the defaults.
+func configureChatDBPool(db *sql.DB, maxOpen, maxIdle int) {
+	if maxOpen <= 0 {
+		maxOpen = defaultChatDBMaxOpenConns
+	}
+	if maxIdle <= 0 {
+		maxIdle = defaultChatDBMaxIdleConns
+	}
+	if maxIdle > maxOpen {
+		maxIdle = maxOpen
+	}
+	db.SetMaxOpenConns(maxOpen)
+	db.SetMaxIdleConns(maxIdle)
+	db.SetConnMaxIdleTime(chatDBConnMaxIdleTime)
+}
+
+// sharedChatDB returns the process-wide chat.db handle, opening it on first
+// use. The handle is never closed; it lives as long as the relay.
+func sharedChatDB() (*sql.DB, error) {
+	chatDBMu.Lock()
+	defer chatDBMu.Unlock()
+	if chatDB != nil {
+		return chatDB, nil
+	}
+	path, err := chatDBPath()
+	if err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("sqlite3", chatDBDSN(path))
+	if err != nil {
+		return nil, err
+	}
+	configureChatDBPool(db, chatDBMaxOpenConns, chatDBMaxIdleConns)
+	chatDB = db
+	return chatDB, nil
+}
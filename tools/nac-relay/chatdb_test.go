@@ -0,0 +1,169 @@
+package main
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// testChatDBSchema is the part of the Messages schema the relay queries.
+var testChatDBSchema = []string{
+	`PRAGMA journal_mode=WAL`,
+	`CREATE TABLE handle (ROWID INTEGER PRIMARY KEY, id TEXT, service TEXT)`,
+	`CREATE TABLE chat (ROWID INTEGER PRIMARY KEY, guid TEXT, account_login TEXT)`,
+	`CREATE TABLE message (ROWID INTEGER PRIMARY KEY, guid TEXT, text TEXT, attributedBody BLOB, handle_id INTEGER,
+		service TEXT, is_from_me INTEGER, date INTEGER, account TEXT, item_type INTEGER,
+		associated_message_type INTEGER)`,
+	`CREATE TABLE chat_message_join (chat_id INTEGER, message_id INTEGER)`,
+}
+
+// testChatDBMessages is the default chat.db content: a DM and a group chat
+// with four messages, the last of them in both chats.
+var testChatDBMessages = []string{
+	`INSERT INTO handle (ROWID, id, service) VALUES (1, '+15550000001', 'iMessage')`,
+	`INSERT INTO chat (ROWID, guid, account_login) VALUES
+		(1, 'iMessage;-;+15550000001', 'E:me@icloud.com'),
+		(2, 'iMessage;+;chat123', 'E:me@icloud.com')`,
+	`INSERT INTO message (ROWID, guid, text, handle_id, service, is_from_me, date, account) VALUES
+		(1, 'GUID-1', 'old', 1, 'iMessage', 0, 700000000000000000, NULL),
+		(2, 'GUID-2', 'hello', 1, 'iMessage', 0, 700000001000000000, NULL),
+		(3, 'GUID-3', NULL, 0, 'iMessage', 1, 700000002000000000, 'e:me@icloud.com'),
+		(4, 'GUID-4', 'in two chats', 1, 'SMS', 0, 700000003000000000, NULL)`,
+	`INSERT INTO chat_message_join (chat_id, message_id) VALUES (1, 1), (1, 2), (1, 3), (1, 4), (2, 4)`,
+}
+
+// newTestChatDB writes a chat.db with testChatDBSchema and the given rows
+// (testChatDBMessages if none) and opens it the way the relay does:
+// read-only, through chatDBDSN. It lives on disk because ":memory:" would
+// give every pooled connection its own empty database.
+func newTestChatDB(t *testing.T, rows ...string) *sql.DB {
+	t.Helper()
+	if len(rows) == 0 {
+		rows = testChatDBMessages
+	}
+	path := filepath.Join(t.TempDir(), "chat.db")
+	rw, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatalf("failed to open sqlite: %v", err)
+	}
+	for _, q := range append(append([]string{}, testChatDBSchema...), rows...) {
+		if _, err = rw.Exec(q); err != nil {
+			t.Fatalf("seed %q: %v", q, err)
+		}
+	}
+	if err = rw.Close(); err != nil {
+		t.Fatalf("failed to close seed db: %v", err)
+	}
+
+	db, err := sql.Open("sqlite3", chatDBDSN(path))
+	if err != nil {
+		t.Fatalf("failed to open chat.db: %v", err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	return db
+}
+
+func TestChatDBPath(t *testing.T) {
+	defer func() { chatDBPathOverride = "" }()
+	home, err := os.UserHomeDir()
+	if err != nil {
+		t.Skipf("no home directory: %v", err)
+	}
+	tests := []struct {
+		name     string
+		override string
+		want     string
+	}{
+		{"default", "", filepath.Join(home, "Library", "Messages", "chat.db")},
+		{"absolute", "/Volumes/Backup/sms.db", "/Volumes/Backup/sms.db"},
+		{"home relative", "~/Backups/sms.db", filepath.Join(home, "Backups", "sms.db")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chatDBPathOverride = tt.override
+			got, err := chatDBPath()
+			if err != nil {
+				t.Fatalf("chatDBPath() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("chatDBPath() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfigureChatDBPool(t *testing.T) {
+	tests := []struct {
+		name             string
+		maxOpen, maxIdle int
+		wantOpen         int
+	}{
+		{"explicit", 8, 2, 8},
+		{"defaults", 0, 0, defaultChatDBMaxOpenConns},
+		{"idle clamped to open", 1, 5, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, err := sql.Open("sqlite3", ":memory:")
+			if err != nil {
+				t.Fatalf("failed to open sqlite: %v", err)
+			}
+			defer db.Close()
+			configureChatDBPool(db, tt.maxOpen, tt.maxIdle)
+			if got := db.Stats().MaxOpenConnections; got != tt.wantOpen {
+				t.Errorf("MaxOpenConnections = %d, want %d", got, tt.wantOpen)
+			}
+		})
+	}
+}
+
+func TestChatDBDSNIsReadOnly(t *testing.T) {
+	db := newTestChatDB(t)
+	if _, err := db.Exec(`DELETE FROM message`); err == nil {
+		t.Error("DELETE through chatDBDSN succeeded, want read-only error")
+	}
+}
+
+// TestChatDBConcurrentQueries runs many /account and /stream queries at once
+// on a small pool: none may fail for lack of a connection, the pool must
+// stay within its cap, and every connection must be returned afterwards.
+func TestChatDBConcurrentQueries(t *testing.T) {
+	const maxOpen = 2
+	db := newTestChatDB(t)
+	configureChatDBPool(db, maxOpen, 1)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 200)
+	for i := 0; i < 100; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if msgs, err := queryMessagesAfter(db, 0, streamBatchLimit); err != nil {
+				errs <- err
+			} else if len(msgs) != 4 {
+				t.Errorf("queryMessagesAfter() returned %d messages, want 4", len(msgs))
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if _, err := queryAccountHandles(db); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("concurrent query error = %v", err)
+	}
+
+	stats := db.Stats()
+	if stats.InUse != 0 {
+		t.Errorf("connections in use after queries = %d, want 0 (leaked rows)", stats.InUse)
+	}
+	if stats.OpenConnections > maxOpen {
+		t.Errorf("open connections = %d, want at most %d", stats.OpenConnections, maxOpen)
+	}
+}
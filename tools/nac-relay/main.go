@@ -7,11 +7,22 @@
 // extract-key reads relay-info.json from the same directory and embeds
 // the token + cert fingerprint into the hardware key.
 //
+// With -mdns the relay advertises itself on the LAN (_imessage-relay._tcp)
+// so the bridge can find it again when the Mac's address changes.
+//
+// -chatdb serves /account, /stream and /messages from another Messages
+// database than ~/Library/Messages/chat.db, such as the sms.db copied out of
+// an iPhone backup (HomeDomain/Library/SMS/sms.db), which has the same
+// schema.
+//
 // Usage:
-//   go run tools/nac-relay/main.go [-port 5001] [-addr 0.0.0.0]
+//   go run tools/nac-relay/main.go [-port 5001] [-addr 0.0.0.0] [-chatdb path] [-chatdb-max-conns 4] [-mdns]
 //
 // Endpoints (all require Authorization: Bearer <token> except /health):
 //   POST /validation-data → base64-encoded validation data
+//   GET  /account         → JSON list of this Mac's iMessage handles (needs Full Disk Access)
+//   GET  /stream          → Server-Sent Events of new chat.db messages (needs Full Disk Access)
+//   GET  /messages        → JSON page of chat.db history, per chat (optionally by time) or all=true (needs Full Disk Access)
 //   GET  /health          → "ok" (no auth required)
 package main
 
@@ -72,10 +83,14 @@ func main() {
 	addr := flag.String("addr", "0.0.0.0", "Address to bind to")
 	port := flag.Int("port", 5001, "Port to listen on")
 	setup := flag.Bool("setup", false, "Install .app bundle and LaunchAgent, then start service")
+	mdns := flag.Bool("mdns", false, "Advertise the relay over mDNS/Bonjour so the bridge can discover it")
+	flag.StringVar(&chatDBPathOverride, "chatdb", "", "Read Messages history from this database (e.g. an iPhone backup's sms.db) instead of ~/Library/Messages/chat.db")
+	flag.IntVar(&chatDBMaxOpenConns, "chatdb-max-conns", defaultChatDBMaxOpenConns, "Maximum open chat.db connections shared by /account, /stream and /messages")
+	flag.IntVar(&chatDBMaxIdleConns, "chatdb-max-idle-conns", defaultChatDBMaxIdleConns, "Maximum idle chat.db connections kept open")
 	flag.Parse()
 
 	if *setup {
-		runSetup()
+		runSetup(*mdns, chatDBPathOverride)
 		return
 	}
 
@@ -107,6 +122,10 @@ func main() {
 			len(data), time.Since(start), r.RemoteAddr)
 	})
 
+	http.HandleFunc("/account", handleAccount)
+	http.HandleFunc("/stream", handleStream)
+	http.HandleFunc("/messages", handleMessages)
+
 	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("ok"))
 	})
@@ -129,6 +148,9 @@ func main() {
 		}
 	}
 	log.Println("Use -relay <url> when running extract-key to embed this URL in the hardware key.")
+	if *mdns {
+		advertiseRelay(*port, certFingerprint(tlsConfig.Certificates[0]))
+	}
 
 	server := &http.Server{
 		Addr:      listenAddr,
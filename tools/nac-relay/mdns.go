@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/lrhodin/imessage/pkg/relaydiscovery"
+)
+
+// mDNS advertisement (-mdns).
+//
+// The bridge finds the relay through the URL baked into the hardware key,
+// which breaks when the Mac's LAN address changes. With -mdns the relay
+// advertises itself as _imessage-relay._tcp with its certificate
+// fingerprint, and a bridge with relay_discovery enabled looks it up there
+// when the URL in its key stops answering.
+
+// relayService describes this relay for the advertisement.
+func relayService(port int, certFP string) relaydiscovery.Service {
+	host, _ := os.Hostname()
+	host = strings.TrimSuffix(host, ".local")
+	return relaydiscovery.Service{
+		Instance: host,
+		Host:     host,
+		Port:     port,
+		IPs:      relayIPv4s(),
+		CertFP:   certFP,
+	}
+}
+
+// relayIPv4s returns the non-loopback IPv4 addresses, the same ones printed
+// as bridge relay URLs on startup.
+func relayIPv4s() []net.IP {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+	var ips []net.IP
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok && !ipnet.IP.IsLoopback() && ipnet.IP.To4() != nil {
+			ips = append(ips, ipnet.IP.To4())
+		}
+	}
+	return ips
+}
+
+// advertiseRelay runs the mDNS responder in the background. The advertised
+// addresses are re-read while it runs, since the LaunchAgent keeps the relay
+// up across address changes. Failures are logged; the relay keeps serving
+// at its address either way.
+func advertiseRelay(port int, certFP string) {
+	svc := relayService(port, certFP)
+	log.Printf("Advertising %s over mDNS as %q", relaydiscovery.ServiceType, svc.Instance)
+	go func() {
+		if err := relaydiscovery.Advertise(context.Background(), svc, relayIPv4s); err != nil {
+			log.Printf("WARNING: mDNS advertisement stopped: %v", err)
+		}
+	}()
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// GET /messages pages through chat.db history by ROWID, for bulk imports
+// that can't wait on /stream. A request names either one chat
+// (?chat_guid=<guid>) or asks for every chat explicitly (?all=true); a
+// missing or empty chat_guid is an error rather than "all chats", so a
+// client bug can't turn into a scan of the whole database. Global mode also
+// needs an explicit ?limit=, and every page is capped at
+// messagesMaxPageLimit. Pages resume with ?after=<rowid> from the previous
+// page's next_after; an empty page means the end.
+//
+// A chat request can be narrowed to a time window: ?since_ms= and
+// ?before_ms= (Unix milliseconds, exclusive) keep only messages dated after
+// and before them. ?newest=true returns the newest limit messages of the
+// window as a single page instead of paging by ROWID, which is what a
+// backward backfill from an anchor needs. ROWIDs don't follow message time
+// (synced and imported messages get new ones), so a client that cares about
+// order sorts by timestamp_ms.
+
+const (
+	messagesDefaultPageLimit = 100
+	messagesMaxPageLimit     = 1000
+)
+
+// messagesRequest is a parsed /messages query.
+type messagesRequest struct {
+	ChatGUID string
+	All      bool
+	After    int64
+	Limit    int
+	SinceMs  int64 // 0 for no lower bound
+	BeforeMs int64 // 0 for no upper bound
+	Newest   bool
+}
+
+// messagesPage is the /messages response.
+type messagesPage struct {
+	Messages  []relayMessage `json:"messages"`
+	NextAfter int64          `json:"next_after"`
+}
+
+// parseMessagesRequest validates a /messages query.
+func parseMessagesRequest(r *http.Request) (messagesRequest, error) {
+	query := r.URL.Query()
+	req := messagesRequest{ChatGUID: query.Get("chat_guid")}
+	if raw := query.Get("all"); raw != "" {
+		all, err := strconv.ParseBool(raw)
+		if err != nil {
+			return req, fmt.Errorf("invalid all %q", raw)
+		}
+		req.All = all
+	}
+	switch {
+	case req.All && req.ChatGUID != "":
+		return req, fmt.Errorf("chat_guid and all=true are mutually exclusive")
+	case !req.All && req.ChatGUID == "":
+		return req, fmt.Errorf("chat_guid is required (use all=true to page through every chat)")
+	}
+	if raw := query.Get("after"); raw != "" {
+		after, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || after < 0 {
+			return req, fmt.Errorf("invalid after %q", raw)
+		}
+		req.After = after
+	}
+	for _, bound := range []struct {
+		name string
+		dst  *int64
+	}{{"since_ms", &req.SinceMs}, {"before_ms", &req.BeforeMs}} {
+		if raw := query.Get(bound.name); raw != "" {
+			ms, err := strconv.ParseInt(raw, 10, 64)
+			if err != nil || ms <= 0 {
+				return req, fmt.Errorf("invalid %s %q", bound.name, raw)
+			}
+			*bound.dst = ms
+		}
+	}
+	if raw := query.Get("newest"); raw != "" {
+		newest, err := strconv.ParseBool(raw)
+		if err != nil {
+			return req, fmt.Errorf("invalid newest %q", raw)
+		}
+		req.Newest = newest
+	}
+	switch {
+	case req.All && (req.SinceMs != 0 || req.BeforeMs != 0 || req.Newest):
+		return req, fmt.Errorf("since_ms, before_ms and newest need chat_guid")
+	case req.Newest && req.After != 0:
+		return req, fmt.Errorf("newest and after are mutually exclusive")
+	}
+	raw := query.Get("limit")
+	if raw == "" {
+		if req.All {
+			return req, fmt.Errorf("limit is required with all=true")
+		}
+		req.Limit = messagesDefaultPageLimit
+		return req, nil
+	}
+	limit, err := strconv.Atoi(raw)
+	if err != nil || limit <= 0 {
+		return req, fmt.Errorf("invalid limit %q", raw)
+	}
+	req.Limit = min(limit, messagesMaxPageLimit)
+	return req, nil
+}
+
+// chatDBDateNanos is a message's date in nanoseconds since appleEpoch,
+// whichever unit the row stores it in (see appleDateToUnixMilli).
+const chatDBDateNanos = `(CASE WHEN ABS(COALESCE(m.date, 0)) > 1000000000000 THEN m.date ELSE COALESCE(m.date, 0) * 1000000000 END)`
+
+// unixMilliToAppleNanos converts Unix milliseconds to nanoseconds since
+// appleEpoch, saturating instead of overflowing.
+func unixMilliToAppleNanos(ms int64) int64 {
+	return int64(time.UnixMilli(ms).Sub(appleEpoch))
+}
+
+// queryChatMessages returns up to limit messages of one chat, oldest
+// first: with ROWID > req.After in ROWID order, or with req.Newest the
+// newest ones by date. req.SinceMs and req.BeforeMs narrow both.
+func queryChatMessages(db *sql.DB, req messagesRequest) ([]relayMessage, error) {
+	where := "c.guid = ?"
+	args := []any{req.ChatGUID}
+	if req.SinceMs != 0 {
+		where += " AND " + chatDBDateNanos + " > ?"
+		args = append(args, unixMilliToAppleNanos(req.SinceMs))
+	}
+	if req.BeforeMs != 0 {
+		where += " AND " + chatDBDateNanos + " < ?"
+		args = append(args, unixMilliToAppleNanos(req.BeforeMs))
+	}
+	order := "m.ROWID"
+	if req.Newest {
+		order = chatDBDateNanos + " DESC, m.ROWID DESC"
+	} else {
+		where += " AND m.ROWID > ?"
+		args = append(args, req.After)
+	}
+	args = append(args, req.Limit)
+	rows, err := db.Query(`
+		SELECT m.ROWID, m.guid, c.guid, COALESCE(h.id, ''), m.is_from_me,
+		       COALESCE(m.service, ''), COALESCE(m.text, ''), m.attributedBody, COALESCE(m.date, 0),
+		       COALESCE(m.item_type, 0), COALESCE(m.associated_message_type, 0)
+		FROM message m
+		JOIN chat_message_join cmj ON cmj.message_id = m.ROWID
+		JOIN chat c ON c.ROWID = cmj.chat_id
+		LEFT JOIN handle h ON h.ROWID = m.handle_id
+		WHERE `+where+`
+		ORDER BY `+order+`
+		LIMIT ?
+	`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query chat messages: %w", err)
+	}
+	defer rows.Close()
+
+	var messages []relayMessage
+	for rows.Next() {
+		var msg relayMessage
+		var date int64
+		var attributedBody []byte
+		if err = rows.Scan(&msg.RowID, &msg.GUID, &msg.ChatGUID, &msg.Sender, &msg.IsFromMe, &msg.Service, &msg.Text, &attributedBody, &date, &msg.ItemType, &msg.AssociatedType); err != nil {
+			return nil, fmt.Errorf("failed to scan message: %w", err)
+		}
+		if msg.Text == "" {
+			msg.Text = attributedBodyText(attributedBody)
+		}
+		msg.Timestamp = appleDateToUnixMilli(date)
+		messages = append(messages, msg)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to query chat messages: %w", err)
+	}
+	if req.Newest {
+		slices.Reverse(messages)
+	}
+	return messages, nil
+}
+
+// queryMessagesPage runs a parsed /messages request.
+func queryMessagesPage(db *sql.DB, req messagesRequest) (messagesPage, error) {
+	var messages []relayMessage
+	var err error
+	if req.All {
+		messages, err = queryMessagesAfter(db, req.After, req.Limit)
+	} else {
+		messages, err = queryChatMessages(db, req)
+	}
+	if err != nil {
+		return messagesPage{}, err
+	}
+	page := messagesPage{Messages: messages, NextAfter: req.After}
+	if page.Messages == nil {
+		page.Messages = []relayMessage{}
+	}
+	// A newest page is the whole answer; it doesn't resume.
+	if n := len(messages); n > 0 && !req.Newest {
+		page.NextAfter = messages[n-1].RowID
+	}
+	return page, nil
+}
+
+// handleMessages serves GET /messages. Like /account it needs Full Disk
+// Access to read chat.db and returns 503 without it.
+func handleMessages(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "GET only", http.StatusMethodNotAllowed)
+		return
+	}
+	req, err := parseMessagesRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	db, err := sharedChatDB()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	page, err := queryMessagesPage(db, req)
+	if err != nil {
+		log.Printf("ERROR: messages query failed: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
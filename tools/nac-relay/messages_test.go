@@ -0,0 +1,166 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseMessagesRequest(t *testing.T) {
+	tests := []struct {
+		query   string
+		want    messagesRequest
+		wantErr string
+	}{
+		{"chat_guid=iMessage%3B-%3B%2B15550000001", messagesRequest{ChatGUID: "iMessage;-;+15550000001", Limit: messagesDefaultPageLimit}, ""},
+		{"chat_guid=c&after=7&limit=10", messagesRequest{ChatGUID: "c", After: 7, Limit: 10}, ""},
+		{"chat_guid=c&limit=50000", messagesRequest{ChatGUID: "c", Limit: messagesMaxPageLimit}, ""},
+		{"all=true&limit=2", messagesRequest{All: true, Limit: 2}, ""},
+		{"all=1&after=3&limit=5", messagesRequest{All: true, After: 3, Limit: 5}, ""},
+		{"chat_guid=c&since_ms=5&before_ms=9", messagesRequest{ChatGUID: "c", Limit: messagesDefaultPageLimit, SinceMs: 5, BeforeMs: 9}, ""},
+		{"chat_guid=c&newest=true&before_ms=9&limit=3", messagesRequest{ChatGUID: "c", Limit: 3, BeforeMs: 9, Newest: true}, ""},
+		// The guard: no chat and no explicit all never means every chat.
+		{"", messagesRequest{}, "chat_guid is required"},
+		{"chat_guid=", messagesRequest{}, "chat_guid is required"},
+		{"all=false&limit=10", messagesRequest{}, "chat_guid is required"},
+		{"all=true", messagesRequest{}, "limit is required"},
+		{"all=true&chat_guid=c&limit=1", messagesRequest{}, "mutually exclusive"},
+		{"all=yes&limit=1", messagesRequest{}, "invalid all"},
+		{"all=true&limit=0", messagesRequest{}, "invalid limit"},
+		{"chat_guid=c&after=-1", messagesRequest{}, "invalid after"},
+		{"chat_guid=c&since_ms=0", messagesRequest{}, "invalid since_ms"},
+		{"chat_guid=c&before_ms=x", messagesRequest{}, "invalid before_ms"},
+		{"chat_guid=c&newest=maybe", messagesRequest{}, "invalid newest"},
+		{"chat_guid=c&newest=true&after=2", messagesRequest{}, "newest and after are mutually exclusive"},
+		{"all=true&limit=1&newest=true", messagesRequest{}, "need chat_guid"},
+		{"all=true&limit=1&since_ms=5", messagesRequest{}, "need chat_guid"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			got, err := parseMessagesRequest(httptest.NewRequest("GET", "/messages?"+tt.query, nil))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("parseMessagesRequest(%q) error = %v, want %q", tt.query, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("parseMessagesRequest(%q) = %+v, %v, want %+v", tt.query, got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestQueryMessagesPageGlobal(t *testing.T) {
+	db := newTestChatDB(t)
+	req := messagesRequest{All: true, Limit: 2}
+	var pages [][]string
+	for i := 0; i < 5; i++ {
+		page, err := queryMessagesPage(db, req)
+		if err != nil {
+			t.Fatalf("queryMessagesPage(%+v) error = %v", req, err)
+		}
+		if len(page.Messages) == 0 {
+			if page.NextAfter != req.After {
+				t.Errorf("empty page NextAfter = %d, want %d", page.NextAfter, req.After)
+			}
+			break
+		}
+		var guids []string
+		for _, msg := range page.Messages {
+			guids = append(guids, msg.GUID)
+		}
+		pages = append(pages, guids)
+		req.After = page.NextAfter
+	}
+	want := [][]string{{"GUID-1", "GUID-2"}, {"GUID-3", "GUID-4"}}
+	if !reflect.DeepEqual(pages, want) {
+		t.Errorf("global pages = %v, want %v", pages, want)
+	}
+}
+
+func TestQueryMessagesPageChat(t *testing.T) {
+	db := newTestChatDB(t)
+	tests := []struct {
+		req       messagesRequest
+		wantGUIDs []string
+		wantNext  int64
+	}{
+		{messagesRequest{ChatGUID: "iMessage;+;chat123", Limit: 10}, []string{"GUID-4"}, 4},
+		{messagesRequest{ChatGUID: "iMessage;-;+15550000001", After: 1, Limit: 2}, []string{"GUID-2", "GUID-3"}, 3},
+		{messagesRequest{ChatGUID: "iMessage;-;+15550000001", After: 4, Limit: 2}, nil, 4},
+		{messagesRequest{ChatGUID: "nope", Limit: 10}, nil, 0},
+	}
+	for _, tt := range tests {
+		page, err := queryMessagesPage(db, tt.req)
+		if err != nil {
+			t.Fatalf("queryMessagesPage(%+v) error = %v", tt.req, err)
+		}
+		var gotGUIDs []string
+		for _, msg := range page.Messages {
+			gotGUIDs = append(gotGUIDs, msg.GUID)
+			if msg.ChatGUID != tt.req.ChatGUID {
+				t.Errorf("queryMessagesPage(%+v) message %s chat = %q, want %q", tt.req, msg.GUID, msg.ChatGUID, tt.req.ChatGUID)
+			}
+		}
+		if !reflect.DeepEqual(gotGUIDs, tt.wantGUIDs) || page.NextAfter != tt.wantNext {
+			t.Errorf("queryMessagesPage(%+v) = %v, next %d, want %v, next %d", tt.req, gotGUIDs, page.NextAfter, tt.wantGUIDs, tt.wantNext)
+		}
+	}
+}
+
+func TestQueryMessagesPageChatWindow(t *testing.T) {
+	// GUID-4 was imported after GUID-3, so its ROWID is out of date order,
+	// and GUID-5 still has a seconds-resolution date.
+	db := newTestChatDB(t,
+		`INSERT INTO chat (ROWID, guid) VALUES (1, 'iMessage;-;+15550000001')`,
+		`INSERT INTO message (ROWID, guid, text, is_from_me, date) VALUES
+			(1, 'GUID-1', 'a', 0, 700000000000000000),
+			(2, 'GUID-2', 'b', 0, 700000002000000000),
+			(3, 'GUID-3', 'c', 0, 700000003000000000),
+			(4, 'GUID-4', 'd', 0, 700000001000000000),
+			(5, 'GUID-5', 'e', 0, 700000004)`,
+		`INSERT INTO chat_message_join (chat_id, message_id) VALUES (1, 1), (1, 2), (1, 3), (1, 4), (1, 5)`,
+	)
+	at := func(sec int64) int64 { return appleDateToUnixMilli(700000000 + sec) }
+	const chat = "iMessage;-;+15550000001"
+	tests := []struct {
+		name      string
+		req       messagesRequest
+		wantGUIDs []string
+		wantNext  int64
+	}{
+		{"newest", messagesRequest{ChatGUID: chat, Newest: true, Limit: 2}, []string{"GUID-3", "GUID-5"}, 0},
+		{"newest before", messagesRequest{ChatGUID: chat, Newest: true, BeforeMs: at(3), Limit: 2}, []string{"GUID-4", "GUID-2"}, 0},
+		{"since, by ROWID", messagesRequest{ChatGUID: chat, SinceMs: at(0), Limit: 10}, []string{"GUID-2", "GUID-3", "GUID-4", "GUID-5"}, 5},
+		{"since excludes the anchor", messagesRequest{ChatGUID: chat, SinceMs: at(2), Limit: 10}, []string{"GUID-3", "GUID-5"}, 5},
+		{"between", messagesRequest{ChatGUID: chat, SinceMs: at(0), BeforeMs: at(3), Limit: 10}, []string{"GUID-2", "GUID-4"}, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			page, err := queryMessagesPage(db, tt.req)
+			if err != nil {
+				t.Fatalf("queryMessagesPage(%+v) error = %v", tt.req, err)
+			}
+			var gotGUIDs []string
+			for _, msg := range page.Messages {
+				gotGUIDs = append(gotGUIDs, msg.GUID)
+			}
+			if !reflect.DeepEqual(gotGUIDs, tt.wantGUIDs) || page.NextAfter != tt.wantNext {
+				t.Errorf("queryMessagesPage(%+v) = %v, next %d, want %v, next %d", tt.req, gotGUIDs, page.NextAfter, tt.wantGUIDs, tt.wantNext)
+			}
+		})
+	}
+}
+
+func TestHandleMessagesRejectsImplicitGlobal(t *testing.T) {
+	for _, query := range []string{"", "chat_guid=", "all=true"} {
+		rec := httptest.NewRecorder()
+		handleMessages(rec, httptest.NewRequest("GET", "/messages?"+query, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("GET /messages?%s status = %d, want %d", query, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// GET /stream pushes new chat.db messages to the bridge as Server-Sent
+// Events, so a Mac-local deployment gets near-realtime delivery without
+// polling. chat.db is polled by ROWID high-water mark: ROWIDs only grow, so
+// "ROWID > last seen" is exactly the set of messages that landed since the
+// previous poll, and it is cheap enough to run every second.
+//
+// Each event carries the ROWID as its SSE id, so a reconnecting client resumes
+// with Last-Event-ID (or ?since=<rowid>) without gaps. Without either, the
+// stream starts at the current end of chat.db.
+
+const (
+	streamPollInterval      = 1 * time.Second
+	streamHeartbeatInterval = 15 * time.Second
+	streamBatchLimit        = 200
+)
+
+// appleEpoch is chat.db's time origin (2001-01-01 UTC).
+var appleEpoch = time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// relayMessage is one streamed chat.db message. ItemType is non-zero for
+// system rows (renames, member changes, ...) and AssociatedType for
+// tapbacks and other messages that act on another one.
+type relayMessage struct {
+	RowID          int64  `json:"rowid"`
+	GUID           string `json:"guid"`
+	ChatGUID       string `json:"chat_guid,omitempty"`
+	Sender         string `json:"sender,omitempty"`
+	IsFromMe       bool   `json:"is_from_me"`
+	Service        string `json:"service,omitempty"`
+	Text           string `json:"text,omitempty"`
+	Timestamp      int64  `json:"timestamp_ms"`
+	ItemType       int    `json:"item_type,omitempty"`
+	AssociatedType int    `json:"associated_message_type,omitempty"`
+}
+
+// appleDateToUnixMilli converts a chat.db date to Unix milliseconds. Dates
+// are nanoseconds since appleEpoch on macOS 10.13+ and seconds before that.
+func appleDateToUnixMilli(date int64) int64 {
+	if date > 1e12 || date < -1e12 {
+		return appleEpoch.Add(time.Duration(date)).UnixMilli()
+	}
+	return appleEpoch.Add(time.Duration(date) * time.Second).UnixMilli()
+}
+
+// queryMessagesAfter returns up to limit messages with ROWID > after, oldest
+// first. Messages whose body only exists in attributedBody (newer macOS)
+// get their text from there.
+func queryMessagesAfter(db *sql.DB, after int64, limit int) ([]relayMessage, error) {
+	rows, err := db.Query(`
+		SELECT m.ROWID, m.guid, COALESCE(c.guid, ''), COALESCE(h.id, ''), m.is_from_me,
+		       COALESCE(m.service, ''), COALESCE(m.text, ''), m.attributedBody, COALESCE(m.date, 0),
+		       COALESCE(m.item_type, 0), COALESCE(m.associated_message_type, 0)
+		FROM message m
+		LEFT JOIN chat_message_join cmj ON cmj.message_id = m.ROWID
+		LEFT JOIN chat c ON c.ROWID = cmj.chat_id
+		LEFT JOIN handle h ON h.ROWID = m.handle_id
+		WHERE m.ROWID > ?
+		ORDER BY m.ROWID
+		LIMIT ?
+	`, after, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query new messages: %w", err)
+	}
+	defer rows.Close()
+
+	var messages []relayMessage
+	for rows.Next() {
+		var msg relayMessage
+		var date int64
+		var attributedBody []byte
+		if err = rows.Scan(&msg.RowID, &msg.GUID, &msg.ChatGUID, &msg.Sender, &msg.IsFromMe, &msg.Service, &msg.Text, &attributedBody, &date, &msg.ItemType, &msg.AssociatedType); err != nil {
+			return nil, fmt.Errorf("failed to scan message: %w", err)
+		}
+		if msg.Text == "" {
+			msg.Text = attributedBodyText(attributedBody)
+		}
+		msg.Timestamp = appleDateToUnixMilli(date)
+		// A message joined to several chats appears once per chat; the
+		// first row wins.
+		if n := len(messages); n > 0 && messages[n-1].RowID == msg.RowID {
+			continue
+		}
+		messages = append(messages, msg)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to query new messages: %w", err)
+	}
+	return messages, nil
+}
+
+// queryMaxRowID returns the highest message ROWID, 0 for an empty chat.db.
+func queryMaxRowID(db *sql.DB) (int64, error) {
+	var maxRowID int64
+	err := db.QueryRow(`SELECT COALESCE(MAX(ROWID), 0) FROM message`).Scan(&maxRowID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to query max message ROWID: %w", err)
+	}
+	return maxRowID, nil
+}
+
+// streamStartRowID picks the resume point from Last-Event-ID or ?since=.
+// ok is false when the client gave neither.
+func streamStartRowID(r *http.Request) (rowID int64, ok bool, err error) {
+	raw := r.Header.Get("Last-Event-ID")
+	if raw == "" {
+		raw = r.URL.Query().Get("since")
+	}
+	if raw == "" {
+		return 0, false, nil
+	}
+	rowID, err = strconv.ParseInt(raw, 10, 64)
+	if err != nil || rowID < 0 {
+		return 0, false, fmt.Errorf("invalid resume ROWID %q", raw)
+	}
+	return rowID, true, nil
+}
+
+// handleStream serves GET /stream. Like /account it needs Full Disk Access to
+// read chat.db and returns 503 without it.
+func handleStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "GET only", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	after, resumed, err := streamStartRowID(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	db, err := sharedChatDB()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if !resumed {
+		if after, err = queryMaxRowID(db); err != nil {
+			log.Printf("ERROR: stream start failed: %v", err)
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	log.Printf("Streaming chat.db messages after ROWID %d to %s", after, r.RemoteAddr)
+
+	poll := time.NewTicker(streamPollInterval)
+	defer poll.Stop()
+	lastWrite := time.Now()
+	for {
+		select {
+		case <-r.Context().Done():
+			log.Printf("Stream to %s closed at ROWID %d", r.RemoteAddr, after)
+			return
+		case <-poll.C:
+		}
+		messages, err := queryMessagesAfter(db, after, streamBatchLimit)
+		if err != nil {
+			// chat.db is briefly locked while Messages.app checkpoints the
+			// WAL; try again on the next tick.
+			log.Printf("WARN: stream poll failed: %v", err)
+			continue
+		}
+		for _, msg := range messages {
+			data, _ := json.Marshal(msg)
+			if _, err = fmt.Fprintf(w, "id: %d\nevent: message\ndata: %s\n\n", msg.RowID, data); err != nil {
+				return
+			}
+			after = msg.RowID
+		}
+		if len(messages) == 0 && time.Since(lastWrite) >= streamHeartbeatInterval {
+			if _, err = fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		} else if len(messages) == 0 {
+			continue
+		}
+		lastWrite = time.Now()
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestQueryMessagesAfter(t *testing.T) {
+	db := newTestChatDB(t)
+	tests := []struct {
+		name      string
+		after     int64
+		limit     int
+		wantGUIDs []string
+	}{
+		{"from start", 0, 100, []string{"GUID-1", "GUID-2", "GUID-3", "GUID-4"}},
+		{"after high-water mark", 2, 100, []string{"GUID-3", "GUID-4"}},
+		{"at end", 4, 100, nil},
+		{"limited batch", 0, 2, []string{"GUID-1", "GUID-2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := queryMessagesAfter(db, tt.after, tt.limit)
+			if err != nil {
+				t.Fatalf("queryMessagesAfter() error = %v", err)
+			}
+			var gotGUIDs []string
+			for _, msg := range got {
+				gotGUIDs = append(gotGUIDs, msg.GUID)
+			}
+			if len(gotGUIDs) != len(tt.wantGUIDs) {
+				t.Fatalf("queryMessagesAfter(%d) = %v, want %v", tt.after, gotGUIDs, tt.wantGUIDs)
+			}
+			for i := range gotGUIDs {
+				if gotGUIDs[i] != tt.wantGUIDs[i] {
+					t.Errorf("queryMessagesAfter(%d) = %v, want %v", tt.after, gotGUIDs, tt.wantGUIDs)
+					break
+				}
+			}
+		})
+	}
+
+	got, err := queryMessagesAfter(db, 1, 100)
+	if err != nil {
+		t.Fatalf("queryMessagesAfter() error = %v", err)
+	}
+	want := relayMessage{
+		RowID:     2,
+		GUID:      "GUID-2",
+		ChatGUID:  "iMessage;-;+15550000001",
+		Sender:    "+15550000001",
+		Service:   "iMessage",
+		Text:      "hello",
+		Timestamp: appleEpoch.Add(700000001 * time.Second).UnixMilli(),
+	}
+	if got[0] != want {
+		t.Errorf("queryMessagesAfter()[0] = %+v, want %+v", got[0], want)
+	}
+	if !got[1].IsFromMe || got[1].Sender != "" || got[1].Text != "" {
+		t.Errorf("queryMessagesAfter()[1] = %+v, want outgoing message without sender or text", got[1])
+	}
+}
+
+func TestQueryMessagesAfterTypes(t *testing.T) {
+	db := newTestChatDB(t,
+		`INSERT INTO message (ROWID, guid, text, is_from_me, date, item_type, associated_message_type) VALUES
+			(1, 'GUID-1', 'hi', 1, 0, 0, 0),
+			(2, 'GUID-2', 'Loved “hi”', 0, 0, 0, 2000),
+			(3, 'GUID-3', NULL, 0, 0, 2, NULL)`,
+	)
+	got, err := queryMessagesAfter(db, 0, 10)
+	if err != nil {
+		t.Fatalf("queryMessagesAfter() error = %v", err)
+	}
+	var types [][2]int
+	for _, msg := range got {
+		types = append(types, [2]int{msg.ItemType, msg.AssociatedType})
+	}
+	want := [][2]int{{0, 0}, {0, 2000}, {2, 0}}
+	if !reflect.DeepEqual(types, want) {
+		t.Errorf("queryMessagesAfter() item/associated types = %v, want %v", types, want)
+	}
+}
+
+func TestQueryMaxRowID(t *testing.T) {
+	db := newTestChatDB(t)
+	if got, err := queryMaxRowID(db); err != nil || got != 4 {
+		t.Errorf("queryMaxRowID() = %d, %v, want 4, nil", got, err)
+	}
+}
+
+func TestAppleDateToUnixMilli(t *testing.T) {
+	tests := []struct {
+		date int64
+		want int64
+	}{
+		{0, appleEpoch.UnixMilli()},
+		{700000000, appleEpoch.Add(700000000 * time.Second).UnixMilli()},
+		{700000000123000000, appleEpoch.Add(700000000123 * time.Millisecond).UnixMilli()},
+	}
+	for _, tt := range tests {
+		if got := appleDateToUnixMilli(tt.date); got != tt.want {
+			t.Errorf("appleDateToUnixMilli(%d) = %d, want %d", tt.date, got, tt.want)
+		}
+	}
+}
+
+func TestStreamStartRowID(t *testing.T) {
+	tests := []struct {
+		name        string
+		url         string
+		lastEventID string
+		want        int64
+		wantOK      bool
+		wantErr     bool
+	}{
+		{"no resume point", "/stream", "", 0, false, false},
+		{"since query", "/stream?since=42", "", 42, true, false},
+		{"last event id wins", "/stream?since=42", "50", 50, true, false},
+		{"invalid", "/stream?since=abc", "", 0, false, true},
+		{"negative", "/stream?since=-1", "", 0, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", tt.url, nil)
+			if tt.lastEventID != "" {
+				r.Header.Set("Last-Event-ID", tt.lastEventID)
+			}
+			got, ok, err := streamStartRowID(r)
+			if got != tt.want || ok != tt.wantOK || (err != nil) != tt.wantErr {
+				t.Errorf("streamStartRowID(%s) = %d, %v, %v, want %d, %v, err=%v", tt.url, got, ok, err, tt.want, tt.wantOK, tt.wantErr)
+			}
+		})
+	}
+}